@@ -3,24 +3,140 @@ package config
 import (
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/robfig/config"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // SMTPConfig contains the SMTP server configuration - not using pointers so that we can pass around
 // copies of the object safely.
 type SMTPConfig struct {
-	IP4address      net.IP
-	IP4port         int
-	Domain          string
-	DomainNoStore   string
-	MaxRecipients   int
-	MaxIdleSeconds  int
-	MaxMessageBytes int
-	StoreMessages   bool
+	Name             string // Listener name from an [smtp.<name>] section, empty for [smtp]
+	IP4address       net.IP
+	IP4port          int
+	Domain           string
+	DomainNoStore    string
+	MaxRecipients    int
+	MaxIdleSeconds   int
+	GreetingTimeout  int // Seconds to wait for HELO, 0 for MaxIdleSeconds
+	CommandTimeout   int // Seconds to wait for a command, 0 for MaxIdleSeconds
+	DataTimeout      int // Seconds to wait for message data, 0 for MaxIdleSeconds
+	MaxMessageBytes  int
+	DomainMaxBytes   map[string]int
+	MaxHeaderBytes   int // Limit on the message header size, 0 for unlimited
+	MaxHeaderCount   int // Limit on the number of header fields, 0 for unlimited
+	MaxReceived      int // Received headers allowed before a mail loop is assumed, 0 for unlimited
+	StoreMessages    bool
+	TLSEnabled       bool
+	TLSPrivKey       string
+	TLSCert          string
+	TLSClientCA      string // CA certificates used to verify client certificates
+	TLSClientAuth    string // "" or "none", "request", "require"
+	AuthEnabled      bool
+	AuthCredentials  map[string]string
+	DSNEnabled       bool
+	DSNFailureDomain string
+	LMTPEnabled      bool
+	LMTPPort         int
+	ProxyProtocol    bool
+	XClientNetworks  []*net.IPNet
+	RateConnections  int
+	RateMessages     int
+	AllowNetworks    []*net.IPNet
+	DenyNetworks     []*net.IPNet
+	RecipientRules   []RecipientRule
+	BounceRules      []RecipientRule
+	Chaos            ChaosConfig
+	Tarpit           TarpitConfig
+	Relay            RelayConfig
+	SubAddressSep    string // Empty if sub-addressing is disabled
+	SubAddressLabel  bool   // Preserve the sub-address label with each message
+	SPFEnabled       bool
+	DKIMEnabled      bool
+	DMARCEnabled     bool
+	DNSRecordsFile   string // Static DNS records for authentication checks
+	DNSRecordsOnly   bool   // Do not use system DNS for authentication checks
+	Transcripts      bool   // Store the SMTP session transcript with each message
+	ScriptFile       string // Lua script defining SMTP event hooks
+	DuplicateMinutes int    // Window for suppressing duplicate Message-IDs, 0 to disable
+	DelaySeconds     int    // Delay before delivered messages appear, 0 for none
+	VRFYMode         string // How VRFY and EXPN are answered: always, lookup or disabled
+	LenientAddresses bool   // Accept common violations of RFC 5321 address syntax
+	AddHeaders       bool   // Add Message-ID and Date headers to messages lacking them
+	DelayRules       []DelayRule
+	RewriteRules     []RewriteRule
+	HeaderRules      []HeaderRule
+	Listeners        []SMTPConfig
+}
+
+// RelayConfig controls forwarding of messages for selected domains to an upstream SMTP server
+type RelayConfig struct {
+	Domains  []string // Lower case, relaying is disabled if empty
+	Host     string   // host:port of the upstream server
+	Username string   // Optional, enables AUTH PLAIN
+	Password string
+	Security string // "" for opportunistic STARTTLS, or "none", "starttls", "tls"
+}
+
+// ChaosConfig controls injection of faults into SMTP sessions.  Percentages are the chance of
+// each fault occurring on a given command.
+type ChaosConfig struct {
+	Enabled           bool
+	TempFailPercent   int
+	DisconnectPercent int
+	DelayPercent      int
+	DelayMillis       int
+	Recipients        *regexp.Regexp // Limits faults to these recipients, nil for all
+}
+
+// TarpitConfig controls the progressive delaying of replies to misbehaving clients.  A session
+// is tarpitted once it has been sent Errors error replies, or sends more than Commands
+// commands in a second; 0 disables either trigger.
+type TarpitConfig struct {
+	Errors         int
+	Commands       int
+	DelayMillis    int // Initial delay, doubled for each further offense
+	MaxDelayMillis int
+}
+
+// RecipientRule causes RCPT TO addresses matching Pattern to be rejected with the specified
+// SMTP reply.  Bounce rules use the reply in the generated delivery status notification.
+type RecipientRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Code    int
+	Message string
+}
+
+// DelayRule defers the delivery of messages to recipients matching Pattern
+type DelayRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Seconds int
+}
+
+// RewriteRule replaces RCPT TO addresses matching Pattern before the mailbox is chosen,
+// Replacement may refer to submatches of a regular expression as $1 and so on
+type RewriteRule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// HeaderRule causes messages with a Header value matching Pattern to be refused with a 554
+// reply at the end of DATA
+type HeaderRule struct {
+	Name    string
+	Header  string
+	Pattern *regexp.Regexp
+	Message string
 }
 
 // POP3Config contains the POP3 server configuration
@@ -29,6 +145,28 @@ type POP3Config struct {
 	IP4port        int
 	Domain         string
 	MaxIdleSeconds int
+	ProxyProtocol  bool
+	STLSEnabled    bool // Offer STLS using the [smtp] TLS certificate
+	TLSEnabled     bool // Listen for implicit TLS (POP3S) connections on TLSPort
+	TLSPort        int
+	TLSPrivKey     string
+	TLSCert        string
+	APOPSecrets    map[string]string // Shared secret by mailbox, see POP3 apop.secrets
+	Passwords      map[string]string // Password by mailbox, "*" for the default
+	DeleteMode     string            // How DELE and RETR remove messages: normal, readonly or retr
+	Transcripts    bool              // Log the transcript of each session
+	MaxSessions    int               // Concurrent sessions, 0 is unlimited
+	MaxSessionsIP  int               // Concurrent sessions per remote IP, 0 is unlimited
+	LoginDelay     int               // Minimum seconds between logins to a mailbox, 0 is none
+}
+
+// IMAPConfig contains the IMAP server configuration, the [imap] section is optional
+type IMAPConfig struct {
+	Enabled        bool
+	IP4address     net.IP
+	IP4port        int
+	Domain         string
+	MaxIdleSeconds int
 }
 
 // WebConfig contains the HTTP server configuration
@@ -41,8 +179,41 @@ type WebConfig struct {
 	GreetingFile   string
 	MailboxPrompt  string
 	CookieAuthKey  string
+	BaseURL        string // Scheme and host of links to this server, from requests if empty
 	MonitorVisible bool
 	MonitorHistory int
+	AdminToken     string          // Bearer token required by admin endpoints, disabled if empty
+	APITokens      []APIToken      // Bearer tokens required by the REST API, open if empty
+	CORSOrigins    []string        // Origins allowed to call the REST API from a browser
+	CORSMethods    []string        // Methods allowed in CORS requests
+	CORSHeaders    []string        // Request headers allowed in CORS requests
+	SignedURLKey   string          // HMAC key of signed message URLs, disabled if empty
+	SignedURLMax   int             // Longest lifetime of a signed URL in minutes
+	RateRequests   int             // API requests per minute from a client IP, 0 is unlimited
+	RateTokenReqs  int             // API requests per minute with an API token, 0 is unlimited
+	BasicAuthUsers []BasicAuthUser // Logins required by the web UI and API, open if empty
+	BasicAuthRealm string          // Realm named in basic authentication challenges
+	OIDCIssuer     string          // OpenID Connect provider required by the web UI, off if empty
+	OIDCClientID   string          // Client ID registered with the OpenID Connect provider
+	OIDCSecret     string          // Client secret registered with the OpenID Connect provider
+	OIDCRedirect   string          // URL of /oidc/callback registered with the provider
+	OIDCSessionMax int             // Minutes an OpenID Connect login lasts
+	ImportMaxBytes int             // Largest mailbox import, before and after unpacking
+}
+
+// APIToken grants access to the REST API with a scope of read, write or admin, each of which
+// includes the ones before it
+type APIToken struct {
+	Name  string
+	Scope string
+	Token string
+}
+
+// BasicAuthUser is a login accepted by the web UI and REST API, its password is stored as a
+// bcrypt hash
+type BasicAuthUser struct {
+	Name string
+	Hash []byte
 }
 
 // DataStoreConfig contains the mail store configuration
@@ -51,6 +222,18 @@ type DataStoreConfig struct {
 	RetentionMinutes int
 	RetentionSleep   int
 	MailboxMsgCap    int
+	MailboxNaming    string           // How mailboxes are keyed: local, full or domain
+	MailboxCaseFold  bool             // Apply full Unicode case folding to mailbox names
+	SearchIndex      bool             // Maintain a full-text search index of stored messages
+	PrivateMailboxes []PrivateMailbox // Mailboxes readable only with their tokens
+}
+
+// PrivateMailbox makes the mailboxes matching Pattern, a path.Match pattern, readable only with
+// Token through the web UI, REST API, POP3 and IMAP
+type PrivateMailbox struct {
+	Name    string
+	Pattern string
+	Token   string
 }
 
 const (
@@ -69,9 +252,26 @@ var (
 	Config   *config.Config
 	logLevel string
 
+	// Raw values of options that require further parsing
+	smtpAuthCredentials string
+	smtpDomainMaxBytes  string
+	smtpXClientNetworks string
+	smtpAllowNetworks   string
+	smtpDenyNetworks    string
+	smtpChaosRecipients string
+	smtpRelayDomains    string
+	smtpSubAddressSep   string
+	smtpAddressParsing  string
+	pop3APOPSecrets     string
+	pop3Passwords       string
+	webCORSOrigins      string
+	webCORSMethods      string
+	webCORSHeaders      string
+
 	// Parsed specific configs
 	smtpConfig      = &SMTPConfig{}
 	pop3Config      = &POP3Config{}
+	imapConfig      = &IMAPConfig{}
 	webConfig       = &WebConfig{}
 	dataStoreConfig = &DataStoreConfig{}
 )
@@ -86,6 +286,11 @@ func GetPOP3Config() POP3Config {
 	return *pop3Config
 }
 
+// GetIMAPConfig returns a copy of the IMAPConfig object
+func GetIMAPConfig() IMAPConfig {
+	return *imapConfig
+}
+
 // GetWebConfig returns a copy of the WebConfig object
 func GetWebConfig() WebConfig {
 	return *webConfig
@@ -136,13 +341,52 @@ func LoadConfig(filename string) error {
 		{"logging", "level", &logLevel, true},
 		{"smtp", "domain", &smtpConfig.Domain, true},
 		{"smtp", "domain.nostore", &smtpConfig.DomainNoStore, false},
+		{"smtp", "tls.privkey", &smtpConfig.TLSPrivKey, false},
+		{"smtp", "tls.cert", &smtpConfig.TLSCert, false},
+		{"smtp", "tls.client.ca", &smtpConfig.TLSClientCA, false},
+		{"smtp", "tls.client.auth", &smtpConfig.TLSClientAuth, false},
+		{"smtp", "auth.credentials", &smtpAuthCredentials, false},
+		{"smtp", "max.message.bytes.domains", &smtpDomainMaxBytes, false},
+		{"smtp", "dsn.failure.domain", &smtpConfig.DSNFailureDomain, false},
+		{"smtp", "xclient.networks", &smtpXClientNetworks, false},
+		{"smtp", "allow.networks", &smtpAllowNetworks, false},
+		{"smtp", "deny.networks", &smtpDenyNetworks, false},
+		{"smtp", "chaos.recipients", &smtpChaosRecipients, false},
+		{"smtp", "relay.domains", &smtpRelayDomains, false},
+		{"smtp", "relay.host", &smtpConfig.Relay.Host, false},
+		{"smtp", "relay.username", &smtpConfig.Relay.Username, false},
+		{"smtp", "relay.password", &smtpConfig.Relay.Password, false},
+		{"smtp", "relay.security", &smtpConfig.Relay.Security, false},
+		{"smtp", "subaddress.separator", &smtpSubAddressSep, false},
+		{"smtp", "address.parsing", &smtpAddressParsing, false},
+		{"smtp", "dns.records.file", &smtpConfig.DNSRecordsFile, false},
+		{"smtp", "script.file", &smtpConfig.ScriptFile, false},
+		{"smtp", "vrfy.mode", &smtpConfig.VRFYMode, false},
 		{"pop3", "domain", &pop3Config.Domain, true},
+		{"pop3", "tls.privkey", &pop3Config.TLSPrivKey, false},
+		{"pop3", "tls.cert", &pop3Config.TLSCert, false},
+		{"pop3", "apop.secrets", &pop3APOPSecrets, false},
+		{"pop3", "passwords", &pop3Passwords, false},
+		{"pop3", "delete.mode", &pop3Config.DeleteMode, false},
+		{"imap", "domain", &imapConfig.Domain, false},
 		{"web", "template.dir", &webConfig.TemplateDir, true},
 		{"web", "public.dir", &webConfig.PublicDir, true},
 		{"web", "greeting.file", &webConfig.GreetingFile, true},
 		{"web", "mailbox.prompt", &webConfig.MailboxPrompt, false},
 		{"web", "cookie.auth.key", &webConfig.CookieAuthKey, false},
+		{"web", "base.url", &webConfig.BaseURL, false},
+		{"web", "admin.token", &webConfig.AdminToken, false},
+		{"web", "cors.origins", &webCORSOrigins, false},
+		{"web", "cors.methods", &webCORSMethods, false},
+		{"web", "cors.headers", &webCORSHeaders, false},
+		{"web", "signed.url.key", &webConfig.SignedURLKey, false},
+		{"web", "basic.auth.realm", &webConfig.BasicAuthRealm, false},
+		{"web", "oidc.issuer", &webConfig.OIDCIssuer, false},
+		{"web", "oidc.client.id", &webConfig.OIDCClientID, false},
+		{"web", "oidc.client.secret", &webConfig.OIDCSecret, false},
+		{"web", "oidc.redirect.url", &webConfig.OIDCRedirect, false},
 		{"datastore", "path", &dataStoreConfig.Path, true},
+		{"datastore", "mailbox.naming", &dataStoreConfig.MailboxNaming, false},
 	}
 	for _, opt := range stringOptions {
 		str, err := Config.String(opt.section, opt.name)
@@ -163,8 +407,28 @@ func LoadConfig(filename string) error {
 		required bool
 	}{
 		{"smtp", "store.messages", &smtpConfig.StoreMessages, true},
+		{"smtp", "tls.enabled", &smtpConfig.TLSEnabled, false},
+		{"smtp", "auth.enabled", &smtpConfig.AuthEnabled, false},
+		{"smtp", "dsn.enabled", &smtpConfig.DSNEnabled, false},
+		{"smtp", "lmtp.enabled", &smtpConfig.LMTPEnabled, false},
+		{"smtp", "proxy.protocol", &smtpConfig.ProxyProtocol, false},
+		{"smtp", "chaos.enabled", &smtpConfig.Chaos.Enabled, false},
+		{"smtp", "subaddress.label", &smtpConfig.SubAddressLabel, false},
+		{"smtp", "spf.enabled", &smtpConfig.SPFEnabled, false},
+		{"smtp", "dkim.enabled", &smtpConfig.DKIMEnabled, false},
+		{"smtp", "dmarc.enabled", &smtpConfig.DMARCEnabled, false},
+		{"smtp", "dns.records.only", &smtpConfig.DNSRecordsOnly, false},
+		{"smtp", "transcript.enabled", &smtpConfig.Transcripts, false},
+		{"smtp", "headers.add.missing", &smtpConfig.AddHeaders, false},
+		{"pop3", "proxy.protocol", &pop3Config.ProxyProtocol, false},
+		{"pop3", "stls.enabled", &pop3Config.STLSEnabled, false},
+		{"pop3", "tls.enabled", &pop3Config.TLSEnabled, false},
+		{"pop3", "transcript.enabled", &pop3Config.Transcripts, false},
+		{"imap", "enabled", &imapConfig.Enabled, false},
 		{"web", "template.cache", &webConfig.TemplateCache, true},
 		{"web", "monitor.visible", &webConfig.MonitorVisible, true},
+		{"datastore", "mailbox.casefold", &dataStoreConfig.MailboxCaseFold, false},
+		{"datastore", "search.index", &dataStoreConfig.SearchIndex, false},
 	}
 	for _, opt := range boolOptions {
 		if Config.HasOption(opt.section, opt.name) {
@@ -189,11 +453,41 @@ func LoadConfig(filename string) error {
 		{"smtp", "ip4.port", &smtpConfig.IP4port, true},
 		{"smtp", "max.recipients", &smtpConfig.MaxRecipients, true},
 		{"smtp", "max.idle.seconds", &smtpConfig.MaxIdleSeconds, true},
+		{"smtp", "timeout.greeting.seconds", &smtpConfig.GreetingTimeout, false},
+		{"smtp", "timeout.command.seconds", &smtpConfig.CommandTimeout, false},
+		{"smtp", "timeout.data.seconds", &smtpConfig.DataTimeout, false},
 		{"smtp", "max.message.bytes", &smtpConfig.MaxMessageBytes, true},
+		{"smtp", "max.header.bytes", &smtpConfig.MaxHeaderBytes, false},
+		{"smtp", "max.header.count", &smtpConfig.MaxHeaderCount, false},
+		{"smtp", "max.received.headers", &smtpConfig.MaxReceived, false},
+		{"smtp", "lmtp.ip4.port", &smtpConfig.LMTPPort, false},
+		{"smtp", "rate.connections", &smtpConfig.RateConnections, false},
+		{"smtp", "rate.messages", &smtpConfig.RateMessages, false},
+		{"smtp", "chaos.tempfail.percent", &smtpConfig.Chaos.TempFailPercent, false},
+		{"smtp", "chaos.disconnect.percent", &smtpConfig.Chaos.DisconnectPercent, false},
+		{"smtp", "chaos.delay.percent", &smtpConfig.Chaos.DelayPercent, false},
+		{"smtp", "chaos.delay.ms", &smtpConfig.Chaos.DelayMillis, false},
+		{"smtp", "tarpit.errors", &smtpConfig.Tarpit.Errors, false},
+		{"smtp", "tarpit.commands.per.second", &smtpConfig.Tarpit.Commands, false},
+		{"smtp", "tarpit.delay.ms", &smtpConfig.Tarpit.DelayMillis, false},
+		{"smtp", "tarpit.max.delay.ms", &smtpConfig.Tarpit.MaxDelayMillis, false},
+		{"smtp", "duplicate.window.minutes", &smtpConfig.DuplicateMinutes, false},
+		{"smtp", "delivery.delay.seconds", &smtpConfig.DelaySeconds, false},
 		{"pop3", "ip4.port", &pop3Config.IP4port, true},
 		{"pop3", "max.idle.seconds", &pop3Config.MaxIdleSeconds, true},
+		{"pop3", "tls.ip4.port", &pop3Config.TLSPort, false},
+		{"pop3", "max.sessions", &pop3Config.MaxSessions, false},
+		{"pop3", "max.sessions.ip", &pop3Config.MaxSessionsIP, false},
+		{"pop3", "login.delay.seconds", &pop3Config.LoginDelay, false},
+		{"imap", "ip4.port", &imapConfig.IP4port, false},
+		{"imap", "max.idle.seconds", &imapConfig.MaxIdleSeconds, false},
 		{"web", "ip4.port", &webConfig.IP4port, true},
 		{"web", "monitor.history", &webConfig.MonitorHistory, true},
+		{"web", "signed.url.max.minutes", &webConfig.SignedURLMax, false},
+		{"web", "rate.requests", &webConfig.RateRequests, false},
+		{"web", "rate.token.requests", &webConfig.RateTokenReqs, false},
+		{"web", "oidc.session.minutes", &webConfig.OIDCSessionMax, false},
+		{"web", "import.max.bytes", &webConfig.ImportMaxBytes, false},
 		{"datastore", "retention.minutes", &dataStoreConfig.RetentionMinutes, true},
 		{"datastore", "retention.sleep.millis", &dataStoreConfig.RetentionSleep, true},
 		{"datastore", "mailbox.message.cap", &dataStoreConfig.MailboxMsgCap, true},
@@ -220,6 +514,7 @@ func LoadConfig(filename string) error {
 	}{
 		{"smtp", "ip4.address", &smtpConfig.IP4address, true},
 		{"pop3", "ip4.address", &pop3Config.IP4address, true},
+		{"imap", "ip4.address", &imapConfig.IP4address, false},
 		{"web", "ip4.address", &webConfig.IP4address, true},
 	}
 	for _, opt := range ipOptions {
@@ -248,6 +543,245 @@ func LoadConfig(filename string) error {
 			}
 		}
 	}
+	// Validate TLS settings
+	if smtpConfig.TLSEnabled {
+		if smtpConfig.TLSPrivKey == "" {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "smtp", "tls.privkey"))
+		}
+		if smtpConfig.TLSCert == "" {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "smtp", "tls.cert"))
+		}
+		switch smtpConfig.TLSClientAuth {
+		case "", "none":
+		case "request", "require":
+			if smtpConfig.TLSClientCA == "" {
+				messages = append(messages, fmt.Sprintf(missingErrorFmt, "smtp", "tls.client.ca"))
+			}
+		default:
+			messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "tls.client.auth",
+				fmt.Sprintf("unknown client auth %q", smtpConfig.TLSClientAuth)))
+		}
+	}
+	// Validate LMTP settings
+	if smtpConfig.LMTPEnabled && smtpConfig.LMTPPort == 0 {
+		messages = append(messages, fmt.Sprintf(missingErrorFmt, "smtp", "lmtp.ip4.port"))
+	}
+	// Validate POP3 TLS settings, STLS shares the SMTP certificate
+	if pop3Config.STLSEnabled {
+		if smtpConfig.TLSPrivKey == "" {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "smtp", "tls.privkey"))
+		}
+		if smtpConfig.TLSCert == "" {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "smtp", "tls.cert"))
+		}
+	}
+	if pop3Config.TLSEnabled {
+		if pop3Config.TLSPort == 0 {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "pop3", "tls.ip4.port"))
+		}
+		if pop3Config.TLSPrivKey == "" {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "pop3", "tls.privkey"))
+		}
+		if pop3Config.TLSCert == "" {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "pop3", "tls.cert"))
+		}
+	}
+	// Validate IMAP settings
+	if imapConfig.Enabled {
+		if imapConfig.IP4address == nil {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "imap", "ip4.address"))
+		}
+		if imapConfig.IP4port == 0 {
+			messages = append(messages, fmt.Sprintf(missingErrorFmt, "imap", "ip4.port"))
+		}
+		if imapConfig.MaxIdleSeconds == 0 {
+			// RFC 3501 requires at least 30 minutes
+			imapConfig.MaxIdleSeconds = 1800
+		}
+		if imapConfig.Domain == "" {
+			imapConfig.Domain = pop3Config.Domain
+		}
+	}
+	// Parse SMTP AUTH credentials
+	smtpConfig.AuthCredentials, err = parseCredentials(smtpAuthCredentials)
+	if err != nil {
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "auth.credentials", err))
+	}
+	// Parse POP3 APOP secrets
+	pop3Config.APOPSecrets, err = parseMailboxCredentials(pop3APOPSecrets)
+	if err != nil {
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "pop3", "apop.secrets", err))
+	}
+	pop3Config.Passwords, err = parseMailboxCredentials(pop3Passwords)
+	if err != nil {
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "pop3", "passwords", err))
+	}
+	// Parse per domain message size limits
+	smtpConfig.DomainMaxBytes, err = parseDomainLimits(smtpDomainMaxBytes)
+	if err != nil {
+		messages = append(messages,
+			fmt.Sprintf(parseErrorFmt, "smtp", "max.message.bytes.domains", err))
+	}
+	// Parse XCLIENT trusted networks
+	smtpConfig.XClientNetworks, err = parseNetworks(smtpXClientNetworks)
+	if err != nil {
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "xclient.networks", err))
+	}
+	// Parse connection access control networks
+	smtpConfig.AllowNetworks, err = parseNetworks(smtpAllowNetworks)
+	if err != nil {
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "allow.networks", err))
+	}
+	smtpConfig.DenyNetworks, err = parseNetworks(smtpDenyNetworks)
+	if err != nil {
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "deny.networks", err))
+	}
+	// Validate chaos settings
+	for _, opt := range []struct {
+		name string
+		pct  int
+	}{
+		{"chaos.tempfail.percent", smtpConfig.Chaos.TempFailPercent},
+		{"chaos.disconnect.percent", smtpConfig.Chaos.DisconnectPercent},
+		{"chaos.delay.percent", smtpConfig.Chaos.DelayPercent},
+	} {
+		if opt.pct < 0 || opt.pct > 100 {
+			messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", opt.name,
+				"must be between 0 and 100"))
+		}
+	}
+	smtpConfig.Chaos.Recipients, err = parseAddressPattern(smtpChaosRecipients)
+	if err != nil {
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "chaos.recipients", err))
+	}
+	// Parse CORS settings
+	webConfig.CORSOrigins = parseList(webCORSOrigins)
+	webConfig.CORSMethods = parseList(webCORSMethods)
+	if len(webConfig.CORSMethods) == 0 {
+		webConfig.CORSMethods = []string{"GET", "POST", "PATCH", "DELETE"}
+	}
+	webConfig.CORSHeaders = parseList(webCORSHeaders)
+	if len(webConfig.CORSHeaders) == 0 {
+		webConfig.CORSHeaders = []string{"Authorization", "Content-Type"}
+	}
+	if webConfig.BaseURL != "" {
+		u, err := url.Parse(webConfig.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			messages = append(messages, fmt.Sprintf(parseErrorFmt, "web", "base.url",
+				"must be an http or https URL"))
+		}
+		webConfig.BaseURL = strings.TrimRight(webConfig.BaseURL, "/")
+	}
+	if webConfig.SignedURLMax <= 0 {
+		webConfig.SignedURLMax = 24 * 60
+	}
+	if webConfig.BasicAuthRealm == "" {
+		webConfig.BasicAuthRealm = "Inbucket"
+	}
+	if webConfig.OIDCIssuer != "" && webConfig.OIDCClientID == "" {
+		messages = append(messages, fmt.Sprintf(missingErrorFmt, "web", "oidc.client.id"))
+	}
+	if webConfig.OIDCSessionMax <= 0 {
+		webConfig.OIDCSessionMax = 12 * 60
+	}
+	if webConfig.ImportMaxBytes <= 0 {
+		webConfig.ImportMaxBytes = 50000000
+	}
+	// Validate relay settings
+	smtpConfig.Relay.Domains = parseDomains(smtpRelayDomains)
+	if len(smtpConfig.Relay.Domains) > 0 && smtpConfig.Relay.Host == "" {
+		messages = append(messages, fmt.Sprintf(missingErrorFmt, "smtp", "relay.host"))
+	}
+	smtpConfig.Relay.Security = strings.ToLower(smtpConfig.Relay.Security)
+	switch smtpConfig.Relay.Security {
+	case "", "none", "starttls", "tls":
+	default:
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "relay.security",
+			fmt.Sprintf("unknown security %q", smtpConfig.Relay.Security)))
+	}
+	// Validate sub-address separator
+	switch strings.TrimSpace(smtpSubAddressSep) {
+	case "":
+		smtpConfig.SubAddressSep = "+"
+	case "+", "-", "=":
+		smtpConfig.SubAddressSep = strings.TrimSpace(smtpSubAddressSep)
+	case "none":
+		smtpConfig.SubAddressSep = ""
+	default:
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "subaddress.separator",
+			fmt.Sprintf("expected +, -, = or none, got %q", smtpSubAddressSep)))
+	}
+	// Validate address parsing mode
+	switch smtpAddressParsing {
+	case "", "strict":
+		smtpConfig.LenientAddresses = false
+	case "lenient":
+		smtpConfig.LenientAddresses = true
+	default:
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "address.parsing",
+			fmt.Sprintf("expected strict or lenient, got %q", smtpAddressParsing)))
+	}
+	// Validate VRFY/EXPN mode
+	switch smtpConfig.VRFYMode {
+	case "":
+		smtpConfig.VRFYMode = "always"
+	case "always", "lookup", "disabled":
+	default:
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "vrfy.mode",
+			fmt.Sprintf("expected always, lookup or disabled, got %q", smtpConfig.VRFYMode)))
+	}
+	// Validate POP3 delete mode
+	switch pop3Config.DeleteMode {
+	case "":
+		pop3Config.DeleteMode = "normal"
+	case "normal", "readonly", "retr":
+	default:
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "pop3", "delete.mode",
+			fmt.Sprintf("expected normal, readonly or retr, got %q", pop3Config.DeleteMode)))
+	}
+	// Validate mailbox naming policy
+	switch dataStoreConfig.MailboxNaming {
+	case "":
+		dataStoreConfig.MailboxNaming = "local"
+	case "local", "full", "domain":
+	default:
+		messages = append(messages, fmt.Sprintf(parseErrorFmt, "datastore", "mailbox.naming",
+			fmt.Sprintf("expected local, full or domain, got %q", dataStoreConfig.MailboxNaming)))
+	}
+	// Load recipient rejection and bounce rules
+	var ruleMessages []string
+	smtpConfig.RecipientRules, ruleMessages = loadRecipientRules("smtp", "reject.")
+	messages = append(messages, ruleMessages...)
+	smtpConfig.BounceRules, ruleMessages = loadRecipientRules("smtp", "bounce.")
+	messages = append(messages, ruleMessages...)
+	for _, rule := range smtpConfig.BounceRules {
+		if rule.Code < 500 {
+			messages = append(messages, fmt.Sprintf(parseErrorFmt, "smtp", "bounce."+rule.Name,
+				fmt.Sprintf("reply code must be 5xx, got %v", rule.Code)))
+		}
+	}
+	smtpConfig.DelayRules, ruleMessages = loadDelayRules("smtp")
+	messages = append(messages, ruleMessages...)
+	smtpConfig.RewriteRules, ruleMessages = loadRewriteRules("smtp")
+	messages = append(messages, ruleMessages...)
+	smtpConfig.HeaderRules, ruleMessages = loadHeaderRules("smtp")
+	messages = append(messages, ruleMessages...)
+	webConfig.APITokens, ruleMessages = loadAPITokens("web")
+	messages = append(messages, ruleMessages...)
+	webConfig.BasicAuthUsers, ruleMessages = loadBasicAuthUsers("web")
+	messages = append(messages, ruleMessages...)
+	dataStoreConfig.PrivateMailboxes, ruleMessages = loadPrivateMailboxes("datastore")
+	messages = append(messages, ruleMessages...)
+	// Load additional SMTP listeners, each inheriting the [smtp] settings
+	smtpConfig.Listeners = nil
+	for _, section := range Config.Sections() {
+		if !strings.HasPrefix(section, "smtp.") {
+			continue
+		}
+		listener, listenerMessages := loadSMTPListener(section, *smtpConfig)
+		messages = append(messages, listenerMessages...)
+		smtpConfig.Listeners = append(smtpConfig.Listeners, listener)
+	}
 	// Validate log level
 	switch strings.ToUpper(logLevel) {
 	case "":
@@ -268,3 +802,470 @@ func LoadConfig(filename string) error {
 	}
 	return nil
 }
+
+// loadRuleOptions calls parse with the name suffix and value of each option of section named
+// prefix<name>, in name order
+func loadRuleOptions(section, prefix string, parse func(name, value string) error) (
+	messages []string) {
+	names, err := Config.Options(section)
+	if err != nil {
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		str, err := Config.String(section, name)
+		if err == nil {
+			err = parse(strings.TrimPrefix(name, prefix), str)
+		}
+		if err != nil {
+			messages = append(messages, fmt.Sprintf(parseErrorFmt, section, name, err))
+		}
+	}
+	return messages
+}
+
+// loadRecipientRules loads the options of section named prefix<name>, in name order
+func loadRecipientRules(section, prefix string) (rules []RecipientRule, messages []string) {
+	messages = loadRuleOptions(section, prefix, func(name, value string) error {
+		rule, err := parseRecipientRule(value)
+		if err != nil {
+			return err
+		}
+		rule.Name = name
+		rules = append(rules, rule)
+		return nil
+	})
+	return rules, messages
+}
+
+// loadDelayRules loads the delay.<name> options of section, in name order
+func loadDelayRules(section string) (rules []DelayRule, messages []string) {
+	messages = loadRuleOptions(section, "delay.", func(name, value string) error {
+		rule, err := parseDelayRule(value)
+		if err != nil {
+			return err
+		}
+		rule.Name = name
+		rules = append(rules, rule)
+		return nil
+	})
+	return rules, messages
+}
+
+// loadRewriteRules loads the rewrite.<name> options of section, in name order
+func loadRewriteRules(section string) (rules []RewriteRule, messages []string) {
+	messages = loadRuleOptions(section, "rewrite.", func(name, value string) error {
+		rule, err := parseRewriteRule(value)
+		if err != nil {
+			return err
+		}
+		rule.Name = name
+		rules = append(rules, rule)
+		return nil
+	})
+	return rules, messages
+}
+
+// loadHeaderRules loads the content.<name> options of section, in name order
+func loadHeaderRules(section string) (rules []HeaderRule, messages []string) {
+	messages = loadRuleOptions(section, "content.", func(name, value string) error {
+		rule, err := parseHeaderRule(value)
+		if err != nil {
+			return err
+		}
+		rule.Name = name
+		rules = append(rules, rule)
+		return nil
+	})
+	return rules, messages
+}
+
+// loadAPITokens loads the api.token.<name> options of section, in name order
+func loadAPITokens(section string) (tokens []APIToken, messages []string) {
+	messages = loadRuleOptions(section, "api.token.", func(name, value string) error {
+		token, err := parseAPIToken(value)
+		if err != nil {
+			return err
+		}
+		token.Name = name
+		tokens = append(tokens, token)
+		return nil
+	})
+	return tokens, messages
+}
+
+// loadBasicAuthUsers loads the basic.auth.user.<name> options of section, in name order
+func loadBasicAuthUsers(section string) (users []BasicAuthUser, messages []string) {
+	messages = loadRuleOptions(section, "basic.auth.user.", func(name, value string) error {
+		hash := []byte(strings.TrimSpace(value))
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return fmt.Errorf("expected a bcrypt password hash: %v", err)
+		}
+		users = append(users, BasicAuthUser{Name: name, Hash: hash})
+		return nil
+	})
+	return users, messages
+}
+
+// loadPrivateMailboxes loads the private.<name> options of section, in name order
+func loadPrivateMailboxes(section string) (private []PrivateMailbox, messages []string) {
+	messages = loadRuleOptions(section, "private.", func(name, value string) error {
+		mailbox, err := parsePrivateMailbox(value)
+		if err != nil {
+			return err
+		}
+		mailbox.Name = name
+		private = append(private, mailbox)
+		return nil
+	})
+	return private, messages
+}
+
+// loadSMTPListener loads an additional SMTP listener from an [smtp.<name>] section.  The
+// listener's address, TLS, AUTH, size and acceptance settings may be overridden, all others
+// are inherited from base.
+func loadSMTPListener(section string, base SMTPConfig) (cfg SMTPConfig, messages []string) {
+	cfg = base
+	cfg.Name = strings.TrimPrefix(section, "smtp.")
+	cfg.Listeners = nil
+	cfg.LMTPEnabled = false
+	for _, opt := range []struct {
+		name   string
+		target *string
+	}{
+		{"tls.privkey", &cfg.TLSPrivKey},
+		{"tls.cert", &cfg.TLSCert},
+		{"tls.client.ca", &cfg.TLSClientCA},
+		{"tls.client.auth", &cfg.TLSClientAuth},
+	} {
+		if Config.HasOption(section, opt.name) {
+			*opt.target, _ = Config.String(section, opt.name)
+		}
+	}
+	for _, opt := range []struct {
+		name   string
+		target *bool
+	}{
+		{"tls.enabled", &cfg.TLSEnabled},
+		{"auth.enabled", &cfg.AuthEnabled},
+		{"proxy.protocol", &cfg.ProxyProtocol},
+	} {
+		if Config.HasOption(section, opt.name) {
+			flag, err := Config.Bool(section, opt.name)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf(parseErrorFmt, section, opt.name, err))
+			}
+			*opt.target = flag
+		}
+	}
+	for _, opt := range []struct {
+		name   string
+		target *int
+	}{
+		{"ip4.port", &cfg.IP4port},
+		{"max.recipients", &cfg.MaxRecipients},
+		{"max.message.bytes", &cfg.MaxMessageBytes},
+	} {
+		if Config.HasOption(section, opt.name) {
+			num, err := Config.Int(section, opt.name)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf(parseErrorFmt, section, opt.name, err))
+			}
+			*opt.target = num
+		}
+	}
+	if !Config.HasOption(section, "ip4.port") {
+		messages = append(messages, fmt.Sprintf(missingErrorFmt, section, "ip4.port"))
+	}
+	if Config.HasOption(section, "ip4.address") {
+		str, _ := Config.String(section, "ip4.address")
+		cfg.IP4address = net.ParseIP(str).To4()
+		if cfg.IP4address == nil {
+			messages = append(messages,
+				fmt.Sprintf("Failed to parse IP [%v]%v: %q", section, "ip4.address", str))
+		}
+	}
+	for _, opt := range []struct {
+		name   string
+		target *[]*net.IPNet
+	}{
+		{"allow.networks", &cfg.AllowNetworks},
+		{"deny.networks", &cfg.DenyNetworks},
+	} {
+		if Config.HasOption(section, opt.name) {
+			str, _ := Config.String(section, opt.name)
+			networks, err := parseNetworks(str)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf(parseErrorFmt, section, opt.name, err))
+			}
+			*opt.target = networks
+		}
+	}
+	if Config.HasOption(section, "auth.credentials") {
+		str, _ := Config.String(section, "auth.credentials")
+		var err error
+		cfg.AuthCredentials, err = parseCredentials(str)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf(parseErrorFmt, section, "auth.credentials", err))
+		}
+	}
+	if rules, ruleMessages := loadRecipientRules(section, "reject."); len(rules) > 0 ||
+		len(ruleMessages) > 0 {
+		cfg.RecipientRules = rules
+		messages = append(messages, ruleMessages...)
+	}
+	if cfg.TLSEnabled && cfg.TLSPrivKey == "" {
+		messages = append(messages, fmt.Sprintf(missingErrorFmt, section, "tls.privkey"))
+	}
+	if cfg.TLSEnabled && cfg.TLSCert == "" {
+		messages = append(messages, fmt.Sprintf(missingErrorFmt, section, "tls.cert"))
+	}
+	return cfg, messages
+}
+
+// parseCredentials parses a comma separated list of user:password pairs into a map
+func parseCredentials(str string) (map[string]string, error) {
+	creds := make(map[string]string)
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		idx := strings.IndexByte(pair, ':')
+		if idx < 1 {
+			return nil, fmt.Errorf("expected user:password, got %q", pair)
+		}
+		creds[pair[:idx]] = pair[idx+1:]
+	}
+	return creds, nil
+}
+
+// parseMailboxCredentials is like parseCredentials, but for mailbox:password pairs, mailbox
+// names are lowercased
+func parseMailboxCredentials(str string) (map[string]string, error) {
+	creds, err := parseCredentials(str)
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make(map[string]string, len(creds))
+	for name, password := range creds {
+		mailboxes[strings.ToLower(name)] = password
+	}
+	return mailboxes, nil
+}
+
+// parseNetworks parses a comma separated list of CIDR networks, a plain IP address is treated
+// as a network containing only that address
+func parseNetworks(str string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(str, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseList parses a comma separated list, dropping empty entries
+func parseList(str string) []string {
+	var list []string
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// parseDomains parses a comma separated list of domains, returning them in lower case
+func parseDomains(str string) []string {
+	var domains []string
+	for _, domain := range strings.Split(str, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// parseAddressPattern parses a pattern matched against an entire address, case insensitively.
+// The pattern is a glob supporting * and ?, or a regular expression if enclosed in slashes.
+// An empty string results in a nil pattern.
+func parseAddressPattern(str string) (*regexp.Regexp, error) {
+	expr := strings.TrimSpace(str)
+	if expr == "" {
+		return nil, nil
+	}
+	if len(expr) > 1 && strings.HasPrefix(expr, "/") && strings.HasSuffix(expr, "/") {
+		expr = expr[1 : len(expr)-1]
+	} else {
+		expr = regexp.QuoteMeta(expr)
+		expr = strings.Replace(expr, "\\*", ".*", -1)
+		expr = strings.Replace(expr, "\\?", ".", -1)
+		expr = "^" + expr + "$"
+	}
+	return regexp.Compile("(?i)" + expr)
+}
+
+// parseRecipientRule parses a rule of the form "pattern code message", see parseAddressPattern
+// for the pattern syntax
+func parseRecipientRule(str string) (RecipientRule, error) {
+	fields := strings.SplitN(strings.TrimSpace(str), " ", 3)
+	if len(fields) < 3 {
+		return RecipientRule{}, fmt.Errorf("expected pattern code message, got %q", str)
+	}
+	pattern, err := parseAddressPattern(fields[0])
+	if err != nil {
+		return RecipientRule{}, err
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil || code < 400 || code > 599 {
+		return RecipientRule{}, fmt.Errorf("reply code must be 4xx or 5xx, got %q", fields[1])
+	}
+	return RecipientRule{
+		Pattern: pattern,
+		Code:    code,
+		Message: strings.TrimSpace(fields[2]),
+	}, nil
+}
+
+// parseDelayRule parses a rule of the form "pattern seconds", see parseAddressPattern for the
+// pattern syntax
+func parseDelayRule(str string) (DelayRule, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 2 {
+		return DelayRule{}, fmt.Errorf("expected pattern seconds, got %q", str)
+	}
+	pattern, err := parseAddressPattern(fields[0])
+	if err != nil {
+		return DelayRule{}, err
+	}
+	seconds, err := strconv.Atoi(fields[1])
+	if err != nil || seconds < 0 {
+		return DelayRule{}, fmt.Errorf("seconds must be a positive integer, got %q", fields[1])
+	}
+	return DelayRule{Pattern: pattern, Seconds: seconds}, nil
+}
+
+// parseRewriteRule parses a rule of the form "pattern replacement", see parseAddressPattern
+// for the pattern syntax
+func parseRewriteRule(str string) (RewriteRule, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 2 {
+		return RewriteRule{}, fmt.Errorf("expected pattern replacement, got %q", str)
+	}
+	pattern, err := parseAddressPattern(fields[0])
+	if err != nil {
+		return RewriteRule{}, err
+	}
+	return RewriteRule{Pattern: pattern, Replacement: fields[1]}, nil
+}
+
+// parseHeaderRule parses a rule of the form "header pattern [message]", see
+// parseAddressPattern for the pattern syntax
+func parseHeaderRule(str string) (HeaderRule, error) {
+	fields := strings.SplitN(strings.TrimSpace(str), " ", 3)
+	if len(fields) < 2 {
+		return HeaderRule{}, fmt.Errorf("expected header pattern [message], got %q", str)
+	}
+	header := strings.TrimSuffix(fields[0], ":")
+	if header == "" || strings.ContainsAny(header, ":\t") {
+		return HeaderRule{}, fmt.Errorf("invalid header name %q", fields[0])
+	}
+	pattern, err := parseAddressPattern(fields[1])
+	if err != nil {
+		return HeaderRule{}, err
+	}
+	rule := HeaderRule{Header: header, Pattern: pattern, Message: "5.7.1 Message content rejected"}
+	if len(fields) == 3 && strings.TrimSpace(fields[2]) != "" {
+		rule.Message = strings.TrimSpace(fields[2])
+	}
+	return rule, nil
+}
+
+// parseAPIToken parses a scope:token pair
+func parseAPIToken(str string) (APIToken, error) {
+	idx := strings.IndexByte(str, ':')
+	if idx < 0 {
+		return APIToken{}, fmt.Errorf("expected scope:token, got %q", str)
+	}
+	token := APIToken{
+		Scope: strings.ToLower(strings.TrimSpace(str[:idx])),
+		Token: strings.TrimSpace(str[idx+1:]),
+	}
+	switch token.Scope {
+	case "read", "write", "admin":
+	default:
+		return APIToken{}, fmt.Errorf("expected scope read, write or admin, got %q", token.Scope)
+	}
+	if token.Token == "" {
+		return APIToken{}, fmt.Errorf("missing token after %v:", token.Scope)
+	}
+	return token, nil
+}
+
+// parsePrivateMailbox parses a pattern:token pair, the pattern is lowercased to match mailbox
+// names
+func parsePrivateMailbox(str string) (PrivateMailbox, error) {
+	idx := strings.IndexByte(str, ':')
+	if idx < 0 {
+		return PrivateMailbox{}, fmt.Errorf("expected pattern:token, got %q", str)
+	}
+	mailbox := PrivateMailbox{
+		Pattern: strings.ToLower(strings.TrimSpace(str[:idx])),
+		Token:   strings.TrimSpace(str[idx+1:]),
+	}
+	if mailbox.Pattern == "" {
+		return PrivateMailbox{}, fmt.Errorf("missing mailbox pattern before the token")
+	}
+	if _, err := path.Match(mailbox.Pattern, ""); err != nil {
+		return PrivateMailbox{}, fmt.Errorf("invalid mailbox pattern %q: %v", mailbox.Pattern, err)
+	}
+	if mailbox.Token == "" {
+		return PrivateMailbox{}, fmt.Errorf("missing token after %v:", mailbox.Pattern)
+	}
+	return mailbox, nil
+}
+
+// parseDomainLimits parses a comma separated list of domain:bytes pairs into a map, domains
+// are lowercased
+func parseDomainLimits(str string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		idx := strings.IndexByte(pair, ':')
+		if idx < 1 {
+			return nil, fmt.Errorf("expected domain:bytes, got %q", pair)
+		}
+		num, err := strconv.Atoi(strings.TrimSpace(pair[idx+1:]))
+		if err != nil || num < 1 {
+			return nil, fmt.Errorf("invalid byte limit for domain %q", pair[:idx])
+		}
+		limits[strings.ToLower(strings.TrimSpace(pair[:idx]))] = num
+	}
+	return limits, nil
+}
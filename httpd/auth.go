@@ -0,0 +1,99 @@
+package httpd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/inbucket/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// verifiedLogins remembers the SHA-256 of logins that matched a bcrypt hash, so that the
+// deliberately slow comparison runs once per login rather than once per request.  Only
+// valid logins are stored, so its size is bounded by the configured users.
+var verifiedLogins = struct {
+	sync.Mutex
+	sums map[[sha256.Size]byte]bool
+}{sums: make(map[[sha256.Size]byte]bool)}
+
+// LoginRequired returns true if basic authentication users or an OpenID Connect provider are
+// configured
+func LoginRequired(cfg config.WebConfig) bool {
+	return len(cfg.BasicAuthUsers) > 0 || cfg.OIDCIssuer != ""
+}
+
+// LoginUser returns the name of the user logged in by req, with the basic authentication login
+// of a configured user in its Authorization header or with an OpenID Connect session, or "" if
+// there is none
+func LoginUser(req *http.Request, cfg config.WebConfig) string {
+	if user := basicAuthUser(req, cfg); user != "" {
+		return user
+	}
+	if cfg.OIDCIssuer != "" {
+		return sessionUser(req)
+	}
+	return ""
+}
+
+// basicAuthUser returns the name of the configured user whose login was sent with req in its
+// Authorization header, or "" if there is none
+func basicAuthUser(req *http.Request, cfg config.WebConfig) string {
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return ""
+	}
+	for _, u := range cfg.BasicAuthUsers {
+		if subtle.ConstantTimeCompare([]byte(name), []byte(u.Name)) != 1 {
+			continue
+		}
+		sum := sha256.Sum256([]byte(name + "\x00" + password + "\x00" + string(u.Hash)))
+		verifiedLogins.Lock()
+		verified := verifiedLogins.sums[sum]
+		verifiedLogins.Unlock()
+		if verified {
+			return u.Name
+		}
+		if bcrypt.CompareHashAndPassword(u.Hash, []byte(password)) == nil {
+			verifiedLogins.Lock()
+			verifiedLogins.sums[sum] = true
+			verifiedLogins.Unlock()
+			return u.Name
+		}
+	}
+	return ""
+}
+
+// RequestLogin adds a basic authentication challenge for the configured realm to the response
+func RequestLogin(w http.ResponseWriter, cfg config.WebConfig) {
+	w.Header().Add("WWW-Authenticate", "Basic realm="+strconv.Quote(cfg.BasicAuthRealm))
+}
+
+// requireLogin wraps next to require the login of a configured user, or an OpenID Connect
+// session, when either is configured.  Browsers are sent to the OpenID Connect provider to log
+// in.  The REST API also accepts API tokens and signed URLs, so it checks credentials itself.
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := webConfig
+		if cfg.OIDCIssuer != "" && req.URL.Path == oidcCallbackPath {
+			oidcCallback(w, req, cfg)
+			return
+		}
+		if !LoginRequired(cfg) || strings.HasPrefix(req.URL.Path, "/api/") ||
+			LoginUser(req, cfg) != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if cfg.OIDCIssuer != "" && (req.Method == "GET" || req.Method == "HEAD") {
+			oidcLogin(w, req, cfg)
+			return
+		}
+		if len(cfg.BasicAuthUsers) > 0 {
+			RequestLogin(w, cfg)
+		}
+		http.Error(w, "Login required", http.StatusUnauthorized)
+	})
+}
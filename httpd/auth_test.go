@@ -0,0 +1,51 @@
+package httpd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRequireLogin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	webConfig = config.WebConfig{
+		BasicAuthUsers: []config.BasicAuthUser{{Name: "lab", Hash: hash}},
+		BasicAuthRealm: "Inbucket",
+	}
+	defer func() {
+		webConfig = config.WebConfig{}
+	}()
+	handler := requireLogin(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	get := func(path, user, password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/mailbox/good", "", "")
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, `Basic realm="Inbucket"`, w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, 401, get("/public/inbucket.css", "lab", "wrong").Code)
+	assert.Equal(t, 401, get("/debug/vars", "fred", "s3cret").Code)
+	assert.Equal(t, 204, get("/mailbox/good", "lab", "s3cret").Code)
+	// Remembered logins are still checked against the password
+	assert.Equal(t, 204, get("/debug/vars", "lab", "s3cret").Code)
+	assert.Equal(t, 401, get("/debug/vars", "lab", "s3cre").Code)
+	// The REST API checks its own credentials
+	assert.Equal(t, 204, get("/api/v1/mailbox/good", "", "").Code)
+
+	// Everything is open without users
+	webConfig.BasicAuthUsers = nil
+	assert.Equal(t, 204, get("/mailbox/good", "", "").Code)
+}
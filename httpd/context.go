@@ -26,6 +26,32 @@ func (c *Context) Close() {
 	// Do nothing
 }
 
+// MailboxUnlocked returns true if the named mailbox is not private, or token or the token saved
+// in the session by UnlockMailbox is one of its tokens
+func (c *Context) MailboxUnlocked(name, token string) bool {
+	if !smtpd.MailboxPrivate(name) {
+		return true
+	}
+	if token != "" && smtpd.MailboxTokenValid(name, token) {
+		return true
+	}
+	if c.Session == nil {
+		return false
+	}
+	saved, _ := c.Session.Values["mailbox.token."+name].(string)
+	return saved != "" && smtpd.MailboxTokenValid(name, saved)
+}
+
+// UnlockMailbox saves token in the session if it is a token of the named private mailbox,
+// returning false if it is not.  The caller must save the session.
+func (c *Context) UnlockMailbox(name, token string) bool {
+	if !smtpd.MailboxTokenValid(name, token) {
+		return false
+	}
+	c.Session.Values["mailbox.token."+name] = token
+	return true
+}
+
 // headerMatch returns true if the request header specified by name contains
 // the specified value.  Case is ignored.
 func headerMatch(req *http.Request, name string, value string) bool {
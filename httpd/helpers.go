@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"html"
 	"html/template"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/log"
 )
 
@@ -32,6 +34,19 @@ func FriendlyTime(t time.Time) template.HTML {
 	return template.HTML(t.Format("Mon Jan 2, 2006"))
 }
 
+// BaseURL returns the scheme and host of links to this server: the configured base.url, or else
+// the host req was sent to, over https if req arrived with TLS.  Forwarded headers are not
+// trusted, base.url must be set when Inbucket is behind a reverse proxy.
+func BaseURL(req *http.Request, cfg config.WebConfig) string {
+	if cfg.BaseURL != "" {
+		return cfg.BaseURL
+	}
+	if req.TLS != nil {
+		return "https://" + req.Host
+	}
+	return "http://" + req.Host
+}
+
 // Reverse routing function (shared with templates)
 func Reverse(name string, things ...interface{}) string {
 	// Convert the things to strings
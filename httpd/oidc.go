@@ -0,0 +1,371 @@
+package httpd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/log"
+)
+
+// oidcCallbackPath receives the authorization code from the OpenID Connect provider
+const oidcCallbackPath = "/oidc/callback"
+
+// oidcClient makes the requests to the OpenID Connect provider
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider holds the discovery document and signing keys of an OpenID Connect issuer
+type oidcProvider struct {
+	Issuer        string                    `json:"issuer"`
+	AuthEndpoint  string                    `json:"authorization_endpoint"`
+	TokenEndpoint string                    `json:"token_endpoint"`
+	JWKSURI       string                    `json:"jwks_uri"`
+	keys          map[string]*rsa.PublicKey // Guarded by oidcProviders
+}
+
+// oidcProviders caches the discovered providers by issuer
+var oidcProviders = struct {
+	sync.Mutex
+	m map[string]*oidcProvider
+}{m: make(map[string]*oidcProvider)}
+
+// oidcClaims are the ID token claims checked by Inbucket
+type oidcClaims struct {
+	Issuer   string       `json:"iss"`
+	Audience oidcAudience `json:"aud"`
+	Expires  int64        `json:"exp"`
+	Nonce    string       `json:"nonce"`
+	Subject  string       `json:"sub"`
+	Email    string       `json:"email"`
+}
+
+// oidcAudience is the aud claim, which may be a single string or an array
+type oidcAudience []string
+
+// UnmarshalJSON accepts both forms of the aud claim
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// getJSON decodes the JSON document at url into v
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discoverOIDC returns the provider of issuer, fetching its discovery document the first time
+func discoverOIDC(issuer string) (*oidcProvider, error) {
+	oidcProviders.Lock()
+	p := oidcProviders.m[issuer]
+	oidcProviders.Unlock()
+	if p != nil {
+		return p, nil
+	}
+	p = &oidcProvider{}
+	err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, want %q", p.Issuer, issuer)
+	}
+	if p.AuthEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %q lacks endpoints", issuer)
+	}
+	oidcProviders.Lock()
+	oidcProviders.m[issuer] = p
+	oidcProviders.Unlock()
+	return p, nil
+}
+
+// key returns the RSA signing key with ID kid, refetching the key set when it is not known in
+// case the provider has rotated its keys
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	oidcProviders.Lock()
+	key := p.keys[kid]
+	oidcProviders.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(p.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		n, nerr := base64.RawURLEncoding.DecodeString(k.N)
+		e, eerr := base64.RawURLEncoding.DecodeString(k.E)
+		if k.Kty != "RSA" || nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	oidcProviders.Lock()
+	p.keys = keys
+	oidcProviders.Unlock()
+	if key = keys[kid]; key == nil {
+		return nil, fmt.Errorf("no RSA signing key with ID %q", kid)
+	}
+	return key, nil
+}
+
+// verifyIDToken checks the RS256 signature and the claims of an ID token issued by p to
+// clientID for a login started with nonce
+func (p *oidcProvider) verifyIDToken(token, clientID, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %v", err)
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid ID token signature: %v", err)
+	}
+
+	claims := &oidcClaims{}
+	if err := decodeTokenPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	audience := false
+	for _, aud := range claims.Audience {
+		audience = audience || aud == clientID
+	}
+	if !audience {
+		return nil, fmt.Errorf("ID token issued to %q", claims.Audience)
+	}
+	// Allow a minute of clock skew
+	if time.Now().Unix() > claims.Expires+60 {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// decodeTokenPart decodes a base64url encoded JSON part of an ID token into v
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed ID token: %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("malformed ID token: %v", err)
+	}
+	return nil
+}
+
+// oidcRedirect returns the callback URL the provider returns the browser to
+func oidcRedirect(req *http.Request, cfg config.WebConfig) string {
+	if cfg.OIDCRedirect != "" {
+		return cfg.OIDCRedirect
+	}
+	return BaseURL(req, cfg) + oidcCallbackPath
+}
+
+// randomToken returns 128 random bits, hex encoded
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionUser returns the user logged in by the OpenID Connect session of req, or "" if there
+// is none or it has expired
+func sessionUser(req *http.Request) string {
+	sess, err := sessionStore.Get(req, "inbucket")
+	if err != nil {
+		return ""
+	}
+	user, _ := sess.Values["oidc.user"].(string)
+	expires, _ := sess.Values["oidc.expires"].(int64)
+	if time.Now().Unix() > expires {
+		return ""
+	}
+	return user
+}
+
+// oidcLogin redirects the browser to the provider to log in, after which the callback returns
+// it to the requested page
+func oidcLogin(w http.ResponseWriter, req *http.Request, cfg config.WebConfig) {
+	p, err := discoverOIDC(cfg.OIDCIssuer)
+	if err != nil {
+		log.Errorf("HTTP OIDC discovery failed: %v", err)
+		http.Error(w, "Login provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	state, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// An invalid session cookie is replaced
+	sess, _ := sessionStore.Get(req, "inbucket")
+	sess.Values["oidc.state"] = state
+	sess.Values["oidc.nonce"] = nonce
+	sess.Values["oidc.return"] = req.URL.RequestURI()
+	if err := sess.Save(req, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.OIDCClientID)
+	query.Set("redirect_uri", oidcRedirect(req, cfg))
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(p.AuthEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, req, p.AuthEndpoint+sep+query.Encode(), http.StatusFound)
+}
+
+// oidcCallback completes a login by exchanging the authorization code for an ID token, then
+// stores the user in the session and returns the browser to the page it requested
+func oidcCallback(w http.ResponseWriter, req *http.Request, cfg config.WebConfig) {
+	sess, _ := sessionStore.Get(req, "inbucket")
+	state, _ := sess.Values["oidc.state"].(string)
+	nonce, _ := sess.Values["oidc.nonce"].(string)
+	returnTo, _ := sess.Values["oidc.return"].(string)
+	query := req.URL.Query()
+	if msg := query.Get("error"); msg != "" {
+		http.Error(w, "Login failed: "+msg+" "+query.Get("error_description"),
+			http.StatusForbidden)
+		return
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		http.Error(w, "Invalid or expired login state, please try again", http.StatusBadRequest)
+		return
+	}
+	claims, err := oidcExchange(req, cfg, query.Get("code"), nonce)
+	if err != nil {
+		log.Warnf("HTTP[%v] OIDC login failed: %v", req.RemoteAddr, err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	user := claims.Email
+	if user == "" {
+		user = claims.Subject
+	}
+	delete(sess.Values, "oidc.state")
+	delete(sess.Values, "oidc.nonce")
+	delete(sess.Values, "oidc.return")
+	sess.Values["oidc.user"] = user
+	sess.Values["oidc.expires"] = time.Now().Add(
+		time.Duration(cfg.OIDCSessionMax) * time.Minute).Unix()
+	if err := sess.Save(req, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("HTTP[%v] OIDC login by %q", req.RemoteAddr, user)
+
+	// Only return to local paths
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	http.Redirect(w, req, returnTo, http.StatusFound)
+}
+
+// oidcExchange redeems an authorization code at the token endpoint of the provider, returning
+// the claims of the verified ID token
+func oidcExchange(req *http.Request, cfg config.WebConfig, code, nonce string) (
+	*oidcClaims, error) {
+	p, err := discoverOIDC(cfg.OIDCIssuer)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oidcRedirect(req, cfg))
+	treq, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	treq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	treq.SetBasicAuth(url.QueryEscape(cfg.OIDCClientID), url.QueryEscape(cfg.OIDCSecret))
+	resp, err := oidcClient.Do(treq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %v", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	return p.verifyIDToken(tokens.IDToken, cfg.OIDCClientID, nonce)
+}
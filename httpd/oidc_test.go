@@ -0,0 +1,190 @@
+package httpd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// signToken returns claims as an RS256 signed JWT
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	assert.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	var nonce string
+	provider := httptest.NewServer(nil)
+	defer provider.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter,
+		req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/auth",
+			"token_endpoint":         provider.URL + "/token",
+			"jwks_uri":               provider.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "inbucket" || secret != "s3cret" || req.FormValue("code") != "c0de" ||
+			req.FormValue("redirect_uri") != "http://localhost/oidc/callback" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"id_token": signToken(t, key, "k1", map[string]interface{}{
+				"iss":   provider.URL,
+				"aud":   "inbucket",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"nonce": nonce,
+				"sub":   "1234",
+				"email": "lab@example.com",
+			}),
+		})
+	})
+	provider.Config.Handler = mux
+
+	sessionStore = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
+	webConfig = config.WebConfig{
+		OIDCIssuer:     provider.URL,
+		OIDCClientID:   "inbucket",
+		OIDCSecret:     "s3cret",
+		OIDCSessionMax: 60,
+	}
+	defer func() {
+		webConfig = config.WebConfig{}
+	}()
+	handler := requireLogin(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "lab@example.com", LoginUser(req, webConfig))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	send := func(method, path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Browsers are sent to the provider, other requests are refused
+	assert.Equal(t, 401, send("POST", "/mailbox/good", nil).Code)
+	w := send("GET", "/mailbox/good?x=1", nil)
+	assert.Equal(t, 302, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, provider.URL+"/auth", strings.Split(location.String(), "?")[0])
+	query := location.Query()
+	assert.Equal(t, "inbucket", query.Get("client_id"))
+	assert.Equal(t, "http://localhost/oidc/callback", query.Get("redirect_uri"))
+	nonce = query.Get("nonce")
+	assert.NotEmpty(t, nonce)
+	cookies := w.Result().Cookies()
+
+	// The callback checks the state
+	w = send("GET", "/oidc/callback?code=c0de&state=wrong", cookies)
+	assert.Equal(t, 400, w.Code)
+	w = send("GET", "/oidc/callback?code=bad&state="+query.Get("state"), cookies)
+	assert.Equal(t, 403, w.Code)
+
+	// A successful login returns to the requested page
+	w = send("GET", "/oidc/callback?code=c0de&state="+query.Get("state"), cookies)
+	assert.Equal(t, 302, w.Code)
+	assert.Equal(t, "/mailbox/good?x=1", w.Header().Get("Location"))
+	cookies = w.Result().Cookies()
+	assert.Equal(t, 204, send("GET", "/mailbox/good", cookies).Code)
+	assert.Equal(t, 204, send("POST", "/mailbox/good", cookies).Code)
+
+	// The state can not be reused
+	w = send("GET", "/oidc/callback?code=c0de&state="+query.Get("state"), cookies)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	p := &oidcProvider{
+		Issuer: "https://idp.example.com",
+		keys:   map[string]*rsa.PublicKey{"k1": &key.PublicKey},
+	}
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "https://idp.example.com",
+			"aud":   []string{"other", "inbucket"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "n0nce",
+			"sub":   "1234",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	got, err := p.verifyIDToken(signToken(t, key, "k1", claims(nil)), "inbucket", "n0nce")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1234", got.Subject)
+	}
+
+	var testTable = []struct {
+		name  string
+		token string
+	}{
+		{"other key", signToken(t, other, "k1", claims(nil))},
+		{"issuer", signToken(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		}))},
+		{"audience", signToken(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["aud"] = "other"
+		}))},
+		{"expired", signToken(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		}))},
+		{"nonce", signToken(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["nonce"] = "replayed"
+		}))},
+		{"unsigned", strings.Join(strings.Split(
+			signToken(t, key, "k1", claims(nil)), ".")[:2], ".") + "."},
+	}
+	for _, tt := range testTable {
+		_, err := p.verifyIDToken(tt.token, "inbucket", "n0nce")
+		assert.Error(t, err, tt.name)
+	}
+}
@@ -1,8 +1,12 @@
 package httpd
 
 import (
+	"crypto/sha1"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // RenderJSON sets the correct HTTP headers for JSON, then writes the specified
@@ -13,3 +17,50 @@ func RenderJSON(w http.ResponseWriter, data interface{}) error {
 	enc := json.NewEncoder(w)
 	return enc.Encode(data)
 }
+
+// RenderJSONConditional renders data like RenderJSON, along with an ETag of the encoded data,
+// and a Last-Modified header if modified is not zero.  If the If-None-Match or
+// If-Modified-Since header of req shows the client already has this content, 304 Not Modified
+// is sent instead.
+func RenderJSONConditional(w http.ResponseWriter, req *http.Request, data interface{},
+	modified time.Time) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	// Match the output of RenderJSON
+	b = append(b, '\n')
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(b))
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Expires", "-1")
+	if notModified(req, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err = w.Write(b)
+	return err
+}
+
+// notModified returns true if the conditional headers of req match etag or modified.
+// If-Modified-Since is ignored when If-None-Match is present, per RFC 7232.
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since := req.Header.Get("If-Modified-Since"); since != "" && !modified.IsZero() {
+		t, err := http.ParseTime(since)
+		// HTTP dates have a resolution of one second
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package httpd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderJSONConditional(t *testing.T) {
+	modified := time.Date(2017, 11, 21, 10, 0, 0, 500, time.UTC)
+	render := func(header, value string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		assert.NoError(t, RenderJSONConditional(w, req, map[string]int{"a": 1}, modified))
+		return w
+	}
+
+	w := render("", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "{\"a\":1}\n", w.Body.String())
+	assert.Equal(t, "Tue, 21 Nov 2017 10:00:00 GMT", w.Header().Get("Last-Modified"))
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	var testTable = []struct {
+		header, value string
+		code          int
+	}{
+		{"If-None-Match", etag, 304},
+		{"If-None-Match", `"other", W/` + etag, 304},
+		{"If-None-Match", `"other"`, 200},
+		{"If-Modified-Since", "Tue, 21 Nov 2017 10:00:00 GMT", 304},
+		{"If-Modified-Since", "Tue, 21 Nov 2017 09:59:59 GMT", 200},
+		{"If-Modified-Since", "yesterday", 200},
+	}
+	for _, tt := range testTable {
+		w = render(tt.header, tt.value)
+		assert.Equal(t, tt.code, w.Code, "%v: %v", tt.header, tt.value)
+		if tt.code == 304 {
+			assert.Empty(t, w.Body.String(), "%v: %v", tt.header, tt.value)
+		}
+	}
+}
@@ -69,13 +69,17 @@ func Initialize(
 	http.Handle("/", Router)
 
 	// Session cookie setup
+	var store *sessions.CookieStore
 	if cfg.CookieAuthKey == "" {
 		log.Infof("HTTP generating random cookie.auth.key")
-		sessionStore = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
+		store = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
 	} else {
 		log.Tracef("HTTP using configured cookie.auth.key")
-		sessionStore = sessions.NewCookieStore([]byte(cfg.CookieAuthKey))
+		store = sessions.NewCookieStore([]byte(cfg.CookieAuthKey))
 	}
+	// Sessions hold OpenID Connect logins, keep them from scripts
+	store.Options.HttpOnly = true
+	sessionStore = store
 }
 
 // Start begins listening for HTTP requests
@@ -83,7 +87,7 @@ func Start(ctx context.Context) {
 	addr := fmt.Sprintf("%v:%v", webConfig.IP4address, webConfig.IP4port)
 	server = &http.Server{
 		Addr:         addr,
-		Handler:      nil,
+		Handler:      requireLogin(http.DefaultServeMux),
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 	}
@@ -0,0 +1,344 @@
+package imapd
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// fetchItem is a message data item requested by FETCH
+type fetchItem struct {
+	name    string   // Upper cased item name, BODY for both BODY[] and BODY.PEEK[]
+	section string   // Section of BODY[], such as HEADER or TEXT
+	fields  []string // Header field names for HEADER.FIELDS and HEADER.FIELDS.NOT
+	peek    bool     // BODY.PEEK[], does not set \Seen
+	partial bool     // Only part of the section was requested
+	start   int64    // Offset of a partial fetch
+	count   int64    // Length of a partial fetch
+}
+
+// fetchMacros expand to their equivalent list of items per RFC 3501
+var fetchMacros = map[string]string{
+	"ALL":  "FLAGS INTERNALDATE RFC822.SIZE ENVELOPE",
+	"FAST": "FLAGS INTERNALDATE RFC822.SIZE",
+}
+
+// fetchHandler returns data items of messages
+func (ses *Session) fetchHandler(tag string, args []string, uid bool) {
+	if len(args) != 2 {
+		ses.send(tag + " BAD FETCH requires a sequence set and data items")
+		return
+	}
+	set, err := parseSeqSet(args[0])
+	if err != nil {
+		ses.send(fmt.Sprintf("%v BAD %v", tag, err))
+		return
+	}
+	items, err := parseFetchItems(args[1])
+	if err != nil {
+		ses.send(fmt.Sprintf("%v BAD %v", tag, err))
+		return
+	}
+	if uid {
+		// UID FETCH always includes the UID of each message, first and only once
+		rest := items[:0]
+		for _, item := range items {
+			if item.name != "UID" {
+				rest = append(rest, item)
+			}
+		}
+		items = append([]fetchItem{{name: "UID"}}, rest...)
+	}
+	for i := range ses.messages {
+		if !ses.inSet(set, i, uid) {
+			continue
+		}
+		resp, err := ses.fetchMessage(i, items)
+		if err != nil {
+			ses.logError("Failed to fetch %v: %v", ses.messages[i], err)
+			ses.send(fmt.Sprintf("%v NO Failed to fetch message %v", tag, i+1))
+			return
+		}
+		ses.send(fmt.Sprintf("* %v FETCH (%v)", i+1, resp))
+		expFetchesTotal.Add(1)
+	}
+	ses.send(tag + " OK FETCH completed")
+}
+
+// parseFetchItems parses the data items argument of FETCH
+func parseFetchItems(arg string) ([]fetchItem, error) {
+	if macro, ok := fetchMacros[strings.ToUpper(arg)]; ok {
+		arg = "(" + macro + ")"
+	}
+	names, err := parseList(arg)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]fetchItem, 0, len(names))
+	seen := false
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return nil, err
+		}
+		if item.name == "UID" {
+			if seen {
+				continue
+			}
+			seen = true
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseFetchItem parses a single data item, such as FLAGS or BODY.PEEK[HEADER]<0.512>
+func parseFetchItem(name string) (fetchItem, error) {
+	upper := strings.ToUpper(name)
+	switch upper {
+	case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "RFC822",
+		"RFC822.HEADER", "RFC822.TEXT":
+		return fetchItem{name: upper}, nil
+	}
+	item := fetchItem{name: "BODY"}
+	switch {
+	case strings.HasPrefix(upper, "BODY.PEEK["):
+		item.peek = true
+		upper = upper[len("BODY.PEEK["):]
+	case strings.HasPrefix(upper, "BODY["):
+		upper = upper[len("BODY["):]
+	default:
+		return item, fmt.Errorf("Unsupported FETCH item %v", name)
+	}
+	end := strings.LastIndex(upper, "]")
+	if end < 0 {
+		return item, fmt.Errorf("Invalid FETCH item %v", name)
+	}
+	section, partial := upper[:end], upper[end+1:]
+	switch {
+	case section == "", section == "HEADER", section == "TEXT":
+		item.section = section
+	case strings.HasPrefix(section, "HEADER.FIELDS"):
+		open := strings.Index(section, " ")
+		if open < 0 {
+			return item, fmt.Errorf("Missing header field names in %v", name)
+		}
+		item.section = section[:open]
+		if item.section != "HEADER.FIELDS" && item.section != "HEADER.FIELDS.NOT" {
+			return item, fmt.Errorf("Unsupported section %v", section)
+		}
+		fields, err := parseList(section[open+1:])
+		if err != nil {
+			return item, err
+		}
+		item.fields = fields
+	default:
+		return item, fmt.Errorf("Unsupported section %v", section)
+	}
+	if partial != "" {
+		if !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") {
+			return item, fmt.Errorf("Invalid partial %v", partial)
+		}
+		bounds := strings.SplitN(partial[1:len(partial)-1], ".", 2)
+		if len(bounds) != 2 {
+			return item, fmt.Errorf("Invalid partial %v", partial)
+		}
+		var err error
+		if item.start, err = parseNumber(bounds[0]); err != nil {
+			return item, err
+		}
+		if item.count, err = parseNumber(bounds[1]); err != nil {
+			return item, err
+		}
+		item.partial = true
+	}
+	return item, nil
+}
+
+// fetchMessage builds the FETCH response for message i
+func (ses *Session) fetchMessage(i int, items []fetchItem) (string, error) {
+	msg, uid := ses.messages[i], ses.uids[i]
+	var raw *string
+	resp := make([]string, 0, len(items))
+	setSeen, hasFlags := false, false
+	for _, item := range items {
+		// Items other than these need the message content
+		switch item.name {
+		case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE":
+		default:
+			if raw == nil {
+				var err error
+				if raw, err = msg.ReadRaw(); err != nil {
+					return "", err
+				}
+			}
+		}
+		switch item.name {
+		case "FLAGS":
+			hasFlags = true
+			resp = append(resp, "FLAGS ("+strings.Join(messageFlags(msg), " ")+")")
+		case "UID":
+			resp = append(resp, fmt.Sprintf("UID %v", uid))
+		case "INTERNALDATE":
+			resp = append(resp,
+				`INTERNALDATE "`+msg.Date().Format("_2-Jan-2006 15:04:05 -0700")+`"`)
+		case "RFC822.SIZE":
+			resp = append(resp, fmt.Sprintf("RFC822.SIZE %v", msg.Size()))
+		case "ENVELOPE":
+			header, _ := splitMessage(*raw)
+			resp = append(resp, "ENVELOPE "+envelope(header))
+		case "RFC822":
+			setSeen = true
+			resp = append(resp, "RFC822 "+literal(*raw))
+		case "RFC822.HEADER":
+			header, _ := splitMessage(*raw)
+			resp = append(resp, "RFC822.HEADER "+literal(header))
+		case "RFC822.TEXT":
+			setSeen = true
+			_, text := splitMessage(*raw)
+			resp = append(resp, "RFC822.TEXT "+literal(text))
+		case "BODY":
+			setSeen = setSeen || !item.peek
+			resp = append(resp, bodySection(*raw, item))
+		}
+	}
+	if setSeen && !ses.readOnly && !smtpd.HasFlag(msg, smtpd.FlagSeen) {
+		flags, err := updateFlags(msg, '+', []string{smtpd.FlagSeen})
+		if err != nil {
+			return "", err
+		}
+		if !hasFlags {
+			// The client must be told of the flag change
+			resp = append(resp, "FLAGS ("+strings.Join(flags, " ")+")")
+		}
+	}
+	return strings.Join(resp, " "), nil
+}
+
+// bodySection returns the BODY[] response for item
+func bodySection(raw string, item fetchItem) string {
+	header, text := splitMessage(raw)
+	data := raw
+	switch item.section {
+	case "HEADER":
+		data = header
+	case "TEXT":
+		data = text
+	case "HEADER.FIELDS":
+		data = headerFields(header, item.fields, false)
+	case "HEADER.FIELDS.NOT":
+		data = headerFields(header, item.fields, true)
+	}
+	section := item.section
+	if item.fields != nil {
+		section += " (" + strings.ToUpper(strings.Join(item.fields, " ")) + ")"
+	}
+	name := "BODY[" + section + "]"
+	if item.partial {
+		name += fmt.Sprintf("<%v>", item.start)
+		if item.start > int64(len(data)) {
+			data = ""
+		} else {
+			data = data[item.start:]
+		}
+		if item.count < int64(len(data)) {
+			data = data[:item.count]
+		}
+	}
+	return name + " " + literal(data)
+}
+
+// splitMessage splits a raw message into its header, including the blank line that ends it,
+// and its text
+func splitMessage(raw string) (header, text string) {
+	if i := strings.Index(raw, "\r\n\r\n"); i >= 0 {
+		return raw[:i+4], raw[i+4:]
+	}
+	if i := strings.Index(raw, "\n\n"); i >= 0 {
+		return raw[:i+2], raw[i+2:]
+	}
+	return raw, ""
+}
+
+// headerFields returns the header fields named in names, or all others if not is set,
+// followed by a blank line
+func headerFields(header string, names []string, not bool) string {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[strings.ToLower(name)] = true
+	}
+	var buf []string
+	include := false
+	for _, line := range strings.SplitAfter(header, "\n") {
+		if strings.TrimRight(line, "\r\n") == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			// Start of a new field
+			name := line
+			if colon := strings.Index(line, ":"); colon >= 0 {
+				name = line[:colon]
+			}
+			include = wanted[strings.ToLower(strings.TrimSpace(name))] != not
+		}
+		if include {
+			buf = append(buf, line)
+		}
+	}
+	return strings.Join(buf, "") + "\r\n"
+}
+
+// envelope returns the ENVELOPE structure for a message header
+func envelope(header string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(header))
+	var h mail.Header
+	if err == nil {
+		h = msg.Header
+	} else {
+		h = make(mail.Header)
+	}
+	from := addressList(h.Get("From"))
+	sender, replyTo := from, from
+	if v := h.Get("Sender"); v != "" {
+		sender = addressList(v)
+	}
+	if v := h.Get("Reply-To"); v != "" {
+		replyTo = addressList(v)
+	}
+	fields := []string{
+		nstring(h.Get("Date")),
+		nstring(h.Get("Subject")),
+		from,
+		sender,
+		replyTo,
+		addressList(h.Get("To")),
+		addressList(h.Get("Cc")),
+		addressList(h.Get("Bcc")),
+		nstring(h.Get("In-Reply-To")),
+		nstring(h.Get("Message-Id")),
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+// addressList returns an ENVELOPE address list, NIL if there are no parsable addresses
+func addressList(value string) string {
+	if value == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		local, domain := addr.Address, ""
+		if at := strings.LastIndex(local, "@"); at >= 0 {
+			local, domain = local[:at], local[at+1:]
+		}
+		list[i] = fmt.Sprintf("(%v NIL %v %v)", nstring(addr.Name), nstring(local),
+			nstring(domain))
+	}
+	return "(" + strings.Join(list, "") + ")"
+}
@@ -0,0 +1,68 @@
+package imapd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// systemFlags are the RFC 3501 flags that may be stored for any message, \Recent is
+// maintained by the server and never stored
+var systemFlags = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+
+// messageFlags returns the sorted flags of msg
+func messageFlags(msg smtpd.Message) []string {
+	flags := append([]string(nil), msg.Flags()...)
+	sort.Strings(flags)
+	return flags
+}
+
+// updateFlags replaces the flags of msg when op is '=', adds them when op is '+' and removes
+// them when op is '-'.  The flags are stored with the message, so that other sessions, POP3
+// and the web UI see them, and the resulting flags are returned.
+func updateFlags(msg smtpd.Message, op byte, flags []string) ([]string, error) {
+	set := make(map[string]bool)
+	if op != '=' {
+		for _, flag := range msg.Flags() {
+			set[flag] = true
+		}
+	}
+	for _, flag := range flags {
+		flag = canonicalFlag(flag)
+		if strings.EqualFold(flag, `\Recent`) {
+			continue
+		}
+		if op == '-' {
+			delete(set, flag)
+		} else {
+			set[flag] = true
+		}
+	}
+	result := sortedFlags(set)
+	if err := msg.SetFlags(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// canonicalFlag returns the standard capitalization of system flags, which are case
+// insensitive, and any other keyword unchanged
+func canonicalFlag(flag string) string {
+	for _, sf := range systemFlags {
+		if strings.EqualFold(flag, sf) {
+			return sf
+		}
+	}
+	return flag
+}
+
+// sortedFlags returns the members of set in a stable order
+func sortedFlags(set map[string]bool) []string {
+	flags := make([]string, 0, len(set))
+	for flag := range set {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return flags
+}
@@ -0,0 +1,105 @@
+package imapd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// listHandler lists the folders matching a pattern: INBOX, and a folder for each sub-address
+// label of the messages in the mailbox
+func (ses *Session) listHandler(tag, cmd string, args []string) {
+	if len(args) != 2 {
+		ses.send(fmt.Sprintf("%v BAD %v requires a reference and a mailbox name", tag, cmd))
+		return
+	}
+	if args[1] == "" {
+		// Request for the hierarchy delimiter
+		ses.send(fmt.Sprintf(`* %v (\Noselect) "/" ""`, cmd))
+		ses.send(fmt.Sprintf("%v OK %v completed", tag, cmd))
+		return
+	}
+	labels, err := ses.folders()
+	if err != nil {
+		ses.logError("Failed to load messages for %v: %v", ses.user, err)
+		ses.send(fmt.Sprintf("%v NO Failed to list folders", tag))
+		return
+	}
+	pattern := args[0] + args[1]
+	if listMatch(strings.ToUpper(pattern), inbox) {
+		ses.send(fmt.Sprintf(`* %v (\HasNoChildren) "/" %v`, cmd, inbox))
+	}
+	for _, label := range labels {
+		if listMatch(pattern, label) {
+			ses.send(fmt.Sprintf(`* %v (\HasNoChildren) "/" %v`, cmd, folderName(label)))
+		}
+	}
+	ses.send(fmt.Sprintf("%v OK %v completed", tag, cmd))
+}
+
+// folders returns the sorted sub-address labels of the messages in the user's mailbox
+func (ses *Session) folders() ([]string, error) {
+	messages, _, err := ses.loadMailbox("")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var labels []string
+	for _, msg := range messages {
+		label := msg.Delivery().Label
+		if label == "" || seen[label] || strings.EqualFold(label, inbox) {
+			continue
+		}
+		seen[label] = true
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+// findFolder returns the label of the named folder, empty for INBOX, and false if there is
+// no such folder
+func (ses *Session) findFolder(name string) (string, bool, error) {
+	if strings.EqualFold(name, inbox) {
+		return "", true, nil
+	}
+	labels, err := ses.folders()
+	if err != nil {
+		return "", false, err
+	}
+	for _, label := range labels {
+		if label == name {
+			return label, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// folderName returns the name of a folder for use in responses
+func folderName(folder string) string {
+	if folder == "" {
+		return inbox
+	}
+	return quote(folder)
+}
+
+// listMatch matches a LIST pattern, where * matches anything and % anything but the hierarchy
+// delimiter
+func listMatch(pattern, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for i := 0; i <= len(name); i++ {
+			if pattern[0] == '%' && i > 0 && name[i-1] == '/' {
+				break
+			}
+			if listMatch(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return name != "" && pattern[0] == name[0] && listMatch(pattern[1:], name[1:])
+}
@@ -0,0 +1,175 @@
+package imapd
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// Test LIST, LSUB and STATUS of the sub-address label folders
+func TestListStatus(t *testing.T) {
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "team", Pattern: "team-*", Token: "t0k"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mb2 := &MockMailbox{}
+	mds.On("MailboxFor", "u1").Return(mb1, nil)
+	mds.On("MailboxFor", "U1+promo").Return(mb1, nil)
+	mds.On("MailboxFor", "team-a").Return(mb2, nil)
+	mb1.On("Name").Return("u1")
+	setMessages(mb1,
+		mockMessage("m1", 1, "", testRaw),
+		mockMessage("m2", 2, "shop", testRaw),
+		mockMessage("m3", 3, "news", testRaw),
+		mockMessage("m4", 4, "shop", testRaw, smtpd.FlagSeen),
+		mockMessage("m5", 5, `say "hi"`, testRaw),
+		mockMessage("m6", 6, "Inbox", testRaw),
+		mockMessage("m7", 7, "a/b", testRaw),
+	)
+	mb2.On("Name").Return("team-a")
+	setMessages(mb2, mockMessage("s1", 1, "secret", testRaw))
+
+	server, logbuf, teardown := setupIMAPServer(mds)
+	defer teardown()
+
+	var testTable = []struct {
+		send   string
+		expect []string
+	}{
+		{`LIST "" *`, []string{
+			`* LIST (\HasNoChildren) "/" INBOX`,
+			`* LIST (\HasNoChildren) "/" "a/b"`,
+			`* LIST (\HasNoChildren) "/" "news"`,
+			`* LIST (\HasNoChildren) "/" "say \"hi\""`,
+			`* LIST (\HasNoChildren) "/" "shop"`,
+		}},
+		{`LIST "" %`, []string{
+			`* LIST (\HasNoChildren) "/" INBOX`,
+			`* LIST (\HasNoChildren) "/" "news"`,
+			`* LIST (\HasNoChildren) "/" "say \"hi\""`,
+			`* LIST (\HasNoChildren) "/" "shop"`,
+		}},
+		{`LIST a/ %`, []string{
+			`* LIST (\HasNoChildren) "/" "a/b"`,
+		}},
+		{`LIST "" ""`, []string{
+			`* LIST (\Noselect) "/" ""`,
+		}},
+		{`LIST "" inbox`, []string{
+			`* LIST (\HasNoChildren) "/" INBOX`,
+		}},
+		{`LSUB "" s*`, []string{
+			`* LSUB (\HasNoChildren) "/" "say \"hi\""`,
+			`* LSUB (\HasNoChildren) "/" "shop"`,
+		}},
+		// Folders of other mailboxes are not listed
+		{`LIST "" secret`, nil},
+		{`LIST "" team-a*`, nil},
+		{`STATUS shop (MESSAGES UNSEEN UIDNEXT UIDVALIDITY RECENT)`, []string{
+			`* STATUS "shop" (MESSAGES 2 UNSEEN 1 UIDNEXT 5 UIDVALIDITY 1 RECENT 0)`,
+		}},
+		{`STATUS inbox (MESSAGES unseen)`, []string{
+			`* STATUS INBOX (MESSAGES 7 UNSEEN 6)`,
+		}},
+		{`STATUS "say \"hi\"" (MESSAGES)`, []string{
+			`* STATUS "say \"hi\"" (MESSAGES 1)`,
+		}},
+	}
+
+	// A sub-addressed login opens the folders of the base mailbox
+	for _, login := range []string{"u1", `"U1+promo"`} {
+		c, _, err := dialIMAP(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script := []scriptStep{{"LOGIN " + login + " any", "OK"}}
+		if err := playScriptAgainst(t, c, script); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range testTable {
+			status, lines, err := c.command(tt.send)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(status, "OK ") {
+				t.Errorf("%v: expected OK, got %q", tt.send, status)
+				continue
+			}
+			if strings.Join(lines, "\n") != strings.Join(tt.expect, "\n") {
+				t.Errorf("%v:\nexpected %q\n     got %q", tt.send, tt.expect, lines)
+			}
+		}
+		script = []scriptStep{
+			// Labels are case sensitive, other than INBOX
+			{"STATUS Shop (MESSAGES)", "NO"},
+			{"STATUS Inbox (MESSAGES)", "OK"},
+			// Private mailboxes and their folders can not be reached from another login
+			{"STATUS secret (MESSAGES)", "NO"},
+			{"STATUS team-a (MESSAGES)", "NO"},
+			{"SELECT team-a", "NO"},
+			{"EXAMINE secret", "NO"},
+			{"SELECT shop", "OK"},
+			{"STATUS shop (BOGUS)", "BAD"},
+			{"STATUS shop MESSAGES", "BAD"},
+			{"LIST *", "BAD"},
+			{"CREATE other", "NO"},
+			{"LOGOUT", "OK"},
+		}
+		if err := playScriptAgainst(t, c, script); err != nil {
+			t.Error(err)
+		}
+		c.close()
+	}
+	mds.AssertNotCalled(t, "MailboxFor", "team-a")
+
+	// The folders of a private mailbox need its token
+	c, _, err := dialIMAP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := []scriptStep{
+		{"LOGIN team-a wrong", "NO"},
+		{`LIST "" *`, "BAD"},
+		{"STATUS secret (MESSAGES)", "BAD"},
+		{"LOGIN team-a t0k", "OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+	status, lines, err := c.command(`LIST "" *`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		`* LIST (\HasNoChildren) "/" INBOX`,
+		`* LIST (\HasNoChildren) "/" "secret"`,
+	}
+	if !strings.HasPrefix(status, "OK ") ||
+		strings.Join(lines, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Expected %q, got %q, %q", expect, lines, status)
+	}
+	status, lines, err = c.command("STATUS secret (MESSAGES)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(status, "OK ") || !hasLine(lines, `* STATUS "secret" (MESSAGES 1)`) {
+		t.Errorf("Expected the status of secret, got %q, %q", lines, status)
+	}
+	c.close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,757 @@
+package imapd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// State tracks the current mode of our IMAP state machine
+type State int
+
+const (
+	// NOTAUTHENTICATED state: the client must LOGIN
+	NOTAUTHENTICATED State = iota
+	// AUTHENTICATED state: the client must SELECT a mailbox
+	AUTHENTICATED
+	// SELECTED state: mailbox open, client may now access messages
+	SELECTED
+	// LOGOUT state: client requests us to end session
+	LOGOUT
+)
+
+func (s State) String() string {
+	switch s {
+	case NOTAUTHENTICATED:
+		return "NOTAUTHENTICATED"
+	case AUTHENTICATED:
+		return "AUTHENTICATED"
+	case SELECTED:
+		return "SELECTED"
+	case LOGOUT:
+		return "LOGOUT"
+	}
+	return "Unknown"
+}
+
+const (
+	// capabilities are listed in the greeting and in reply to CAPABILITY
+	capabilities = "IMAP4rev1 LITERAL+ UNSELECT IDLE"
+	// inbox holds all messages of the user's Inbucket mailbox, other folders are named after
+	// sub-address labels
+	inbox = "INBOX"
+	// uidValidity never changes, UIDs are never reused within a mailbox
+	uidValidity = 1
+	// maxLiteral limits the size of literals in commands, Inbucket does not support APPEND
+	maxLiteral = 64 * 1024
+)
+
+var commands = map[string]bool{
+	"CAPABILITY":  true,
+	"NOOP":        true,
+	"LOGOUT":      true,
+	"LOGIN":       true,
+	"SELECT":      true,
+	"EXAMINE":     true,
+	"CREATE":      true,
+	"DELETE":      true,
+	"RENAME":      true,
+	"SUBSCRIBE":   true,
+	"UNSUBSCRIBE": true,
+	"LIST":        true,
+	"LSUB":        true,
+	"STATUS":      true,
+	"CHECK":       true,
+	"CLOSE":       true,
+	"UNSELECT":    true,
+	"EXPUNGE":     true,
+	"SEARCH":      true,
+	"FETCH":       true,
+	"STORE":       true,
+	"UID":         true,
+	"IDLE":        true,
+}
+
+var errLiteralTooLarge = errors.New("Literal too large")
+
+// Session defines an active IMAP session
+type Session struct {
+	server     *Server         // Reference to the server we belong to
+	id         int             // Session ID number
+	conn       net.Conn        // Our network connection
+	remoteHost string          // IP address of client
+	sendError  error           // Used to bail out of read loop on send error
+	state      State           // Current session state
+	reader     *bufio.Reader   // Buffered reader for our net conn
+	user       string          // Mailbox name
+	folder     string          // Label of the selected folder, empty for INBOX
+	readOnly   bool            // Mailbox opened with EXAMINE
+	messages   []smtpd.Message // Messages in the selected mailbox, by sequence number - 1
+	uids       []uint32        // UID of each message in messages
+}
+
+// NewSession creates a new IMAP session
+func NewSession(server *Server, id int, conn net.Conn) *Session {
+	reader := bufio.NewReader(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &Session{server: server, id: id, conn: conn, state: NOTAUTHENTICATED,
+		reader: reader, remoteHost: host}
+}
+
+func (ses *Session) String() string {
+	return fmt.Sprintf("Session{id: %v, state: %v}", ses.id, ses.state)
+}
+
+/* Session flow:
+ *  1. Send initial greeting
+ *  2. Receive tagged cmd
+ *  3. If good cmd, respond, optionally change state
+ *  4. If bad cmd, respond error
+ *  5. Goto 2
+ */
+func (s *Server) startSession(id int, conn net.Conn) {
+	log.Infof("IMAP connection from %v, starting session <%v>", conn.RemoteAddr(), id)
+	expConnectsTotal.Add(1)
+	expConnectsCurrent.Add(1)
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Errorf("Error closing IMAP connection for <%v>: %v", id, err)
+		}
+		s.waitgroup.Done()
+		expConnectsCurrent.Add(-1)
+	}()
+
+	ses := NewSession(s, id, conn)
+	ses.send(fmt.Sprintf("* OK [CAPABILITY %v] Inbucket IMAP4rev1 server ready at %v",
+		capabilities, s.domain))
+
+	// This is our command reading loop
+	for ses.state != LOGOUT && ses.sendError == nil {
+		line, err := ses.readCommand()
+		if err == nil {
+			tag, cmd, args, err := parseCommand(line)
+			if tag == "" {
+				ses.send("* BAD Missing command tag")
+				continue
+			}
+			if cmd == "" {
+				ses.send(tag + " BAD Missing command")
+				continue
+			}
+			if !commands[cmd] {
+				ses.send(fmt.Sprintf("%v BAD Syntax error, %v command unrecognized", tag, cmd))
+				ses.logWarn("Unrecognized command: %v", cmd)
+				continue
+			}
+			if err != nil {
+				ses.send(fmt.Sprintf("%v BAD %v", tag, err))
+				ses.logWarn("Failed to parse %v arguments: %v", cmd, err)
+				continue
+			}
+			ses.commandHandler(tag, cmd, args)
+		} else {
+			// readCommand() returned an error
+			if err == io.EOF {
+				switch ses.state {
+				case NOTAUTHENTICATED:
+					// EOF is common here
+					ses.logInfo("Client closed connection (state %v)", ses.state)
+				default:
+					ses.logWarn("Got EOF while in state %v", ses.state)
+				}
+				break
+			}
+			if err == errLiteralTooLarge {
+				ses.logWarn("Client sent a literal larger than %v bytes", maxLiteral)
+				ses.send("* BYE Literal too large")
+				break
+			}
+			// not an EOF
+			ses.logWarn("Connection error: %v", err)
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() {
+					ses.send("* BYE Idle timeout, bye bye")
+					break
+				}
+			}
+			ses.send("* BYE Connection error, sorry")
+			break
+		}
+	}
+	if ses.sendError != nil {
+		ses.logWarn("Network send error: %v", ses.sendError)
+	}
+	ses.logInfo("Closing connection")
+}
+
+// commandHandler dispatches a command to its handler, if it is valid in the current state
+func (ses *Session) commandHandler(tag, cmd string, args []string) {
+	// Commands we handle in any state
+	switch cmd {
+	case "CAPABILITY":
+		ses.send("* CAPABILITY " + capabilities)
+		ses.send(tag + " OK CAPABILITY completed")
+		return
+	case "NOOP":
+		if ses.state == SELECTED {
+			ses.refresh()
+		}
+		ses.send(tag + " OK NOOP completed")
+		return
+	case "LOGOUT":
+		ses.send("* BYE Inbucket IMAP server logging out")
+		ses.send(tag + " OK LOGOUT completed")
+		ses.enterState(LOGOUT)
+		return
+	}
+
+	switch ses.state {
+	case NOTAUTHENTICATED:
+		if cmd == "LOGIN" {
+			ses.loginHandler(tag, args)
+			return
+		}
+	case AUTHENTICATED:
+		if ses.authenticatedHandler(tag, cmd, args) {
+			return
+		}
+	case SELECTED:
+		if ses.authenticatedHandler(tag, cmd, args) || ses.selectedHandler(tag, cmd, args) {
+			return
+		}
+	}
+	ses.ooSeq(tag, cmd)
+}
+
+// loginHandler authenticates the user, any password is accepted except for private mailboxes,
+// which need one of their tokens
+func (ses *Session) loginHandler(tag string, args []string) {
+	if len(args) != 2 {
+		ses.send(tag + " BAD LOGIN requires a user name and password")
+		return
+	}
+	mb, err := ses.server.dataStore.MailboxFor(args[0])
+	if err != nil {
+		ses.logWarn("Failed to open mailbox for %v: %v", args[0], err)
+		ses.send(tag + " NO [AUTHENTICATIONFAILED] Invalid mailbox name")
+		return
+	}
+	if smtpd.MailboxPrivate(mb.Name()) && !smtpd.MailboxTokenValid(mb.Name(), args[1]) {
+		ses.logWarn("Invalid token for private mailbox %v", mb.Name())
+		ses.send(tag + " NO [AUTHENTICATIONFAILED] Invalid token for private mailbox")
+		return
+	}
+	// The parsed name matches the mailbox of messages announced by the msghub
+	ses.user = mb.Name()
+	expLoginsTotal.Add(1)
+	ses.logInfo("Logged in as %v", ses.user)
+	ses.send(tag + " OK LOGIN completed")
+	ses.enterState(AUTHENTICATED)
+}
+
+// authenticatedHandler handles commands valid in both the AUTHENTICATED and SELECTED states,
+// returns false if cmd is not one of them
+func (ses *Session) authenticatedHandler(tag, cmd string, args []string) bool {
+	switch cmd {
+	case "SELECT", "EXAMINE":
+		ses.selectHandler(tag, cmd, args)
+	case "CREATE", "DELETE", "RENAME":
+		ses.send(fmt.Sprintf("%v NO %v not permitted, folders follow sub-address labels", tag,
+			cmd))
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		ses.send(fmt.Sprintf("%v OK %v completed", tag, cmd))
+	case "LIST", "LSUB":
+		ses.listHandler(tag, cmd, args)
+	case "STATUS":
+		ses.statusHandler(tag, args)
+	default:
+		return false
+	}
+	return true
+}
+
+// selectHandler opens a folder, read-only for EXAMINE
+func (ses *Session) selectHandler(tag, cmd string, args []string) {
+	// A failed SELECT leaves no mailbox selected
+	ses.enterState(AUTHENTICATED)
+	ses.messages, ses.uids = nil, nil
+	if len(args) != 1 {
+		ses.send(fmt.Sprintf("%v BAD %v requires a mailbox name", tag, cmd))
+		return
+	}
+	folder, ok, err := ses.findFolder(args[0])
+	if err != nil {
+		ses.logError("Failed to load messages for %v: %v", ses.user, err)
+		ses.send(fmt.Sprintf("%v NO Failed to open mailbox", tag))
+		return
+	}
+	if !ok {
+		ses.send(fmt.Sprintf("%v NO Mailbox does not exist", tag))
+		return
+	}
+	messages, uids, err := ses.loadMailbox(folder)
+	if err != nil {
+		ses.logError("Failed to load messages for %v: %v", ses.user, err)
+		ses.send(fmt.Sprintf("%v NO Failed to open mailbox", tag))
+		return
+	}
+	ses.folder, ses.messages, ses.uids = folder, messages, uids
+	ses.readOnly = cmd == "EXAMINE"
+
+	ses.send(fmt.Sprintf("* FLAGS (%v)", strings.Join(systemFlags, " ")))
+	if ses.readOnly {
+		ses.send("* OK [PERMANENTFLAGS ()] No permanent flags permitted")
+	} else {
+		ses.send(fmt.Sprintf(`* OK [PERMANENTFLAGS (%v \*)] Flags permitted`,
+			strings.Join(systemFlags, " ")))
+	}
+	ses.send(fmt.Sprintf("* %v EXISTS", len(ses.messages)))
+	ses.send("* 0 RECENT")
+	for i, msg := range ses.messages {
+		if !smtpd.HasFlag(msg, smtpd.FlagSeen) {
+			ses.send(fmt.Sprintf("* OK [UNSEEN %v] First unseen message", i+1))
+			break
+		}
+	}
+	ses.send(fmt.Sprintf("* OK [UIDVALIDITY %v] UIDs valid", uidValidity))
+	ses.send(fmt.Sprintf("* OK [UIDNEXT %v] Predicted next UID", ses.uidNext()))
+	if ses.readOnly {
+		ses.send(fmt.Sprintf("%v OK [READ-ONLY] %v completed", tag, cmd))
+	} else {
+		ses.send(fmt.Sprintf("%v OK [READ-WRITE] %v completed", tag, cmd))
+	}
+	ses.enterState(SELECTED)
+}
+
+// statusHandler reports the status of a folder without selecting it
+func (ses *Session) statusHandler(tag string, args []string) {
+	if len(args) != 2 || !isList(args[1]) {
+		ses.send(tag + " BAD STATUS requires a mailbox name and a list of items")
+		return
+	}
+	items, err := parseList(args[1])
+	if err != nil {
+		ses.send(fmt.Sprintf("%v BAD %v", tag, err))
+		return
+	}
+	folder, ok, err := ses.findFolder(args[0])
+	if err != nil {
+		ses.logError("Failed to load messages for %v: %v", ses.user, err)
+		ses.send(tag + " NO Failed to open mailbox")
+		return
+	}
+	if !ok {
+		ses.send(fmt.Sprintf("%v NO Mailbox does not exist", tag))
+		return
+	}
+	messages, uids, err := ses.loadMailbox(folder)
+	if err != nil {
+		ses.logError("Failed to load messages for %v: %v", ses.user, err)
+		ses.send(tag + " NO Failed to open mailbox")
+		return
+	}
+	var next uint32 = 1
+	if len(uids) > 0 {
+		next = uids[len(uids)-1] + 1
+	}
+	status := make([]string, 0, len(items))
+	for _, item := range items {
+		item = strings.ToUpper(item)
+		switch item {
+		case "MESSAGES":
+			status = append(status, fmt.Sprintf("MESSAGES %v", len(messages)))
+		case "RECENT":
+			status = append(status, "RECENT 0")
+		case "UIDNEXT":
+			status = append(status, fmt.Sprintf("UIDNEXT %v", next))
+		case "UIDVALIDITY":
+			status = append(status, fmt.Sprintf("UIDVALIDITY %v", uidValidity))
+		case "UNSEEN":
+			unseen := 0
+			for _, msg := range messages {
+				if !smtpd.HasFlag(msg, smtpd.FlagSeen) {
+					unseen++
+				}
+			}
+			status = append(status, fmt.Sprintf("UNSEEN %v", unseen))
+		default:
+			ses.send(fmt.Sprintf("%v BAD Unknown STATUS item %v", tag, item))
+			return
+		}
+	}
+	ses.send(fmt.Sprintf("* STATUS %v (%v)", folderName(folder), strings.Join(status, " ")))
+	ses.send(tag + " OK STATUS completed")
+}
+
+// selectedHandler handles commands only valid in the SELECTED state, returns false if cmd is
+// not one of them
+func (ses *Session) selectedHandler(tag, cmd string, args []string) bool {
+	switch cmd {
+	case "CHECK":
+		ses.send(tag + " OK CHECK completed")
+	case "CLOSE":
+		if !ses.readOnly {
+			ses.expunge(false)
+		}
+		ses.messages, ses.uids = nil, nil
+		ses.enterState(AUTHENTICATED)
+		ses.send(tag + " OK CLOSE completed")
+	case "UNSELECT":
+		ses.messages, ses.uids = nil, nil
+		ses.enterState(AUTHENTICATED)
+		ses.send(tag + " OK UNSELECT completed")
+	case "EXPUNGE":
+		if ses.readOnly {
+			ses.send(tag + " NO Mailbox is read-only")
+			return true
+		}
+		ses.expunge(true)
+		ses.send(tag + " OK EXPUNGE completed")
+	case "SEARCH":
+		ses.searchHandler(tag, args, false)
+	case "FETCH":
+		ses.fetchHandler(tag, args, false)
+	case "STORE":
+		ses.storeHandler(tag, args, false)
+	case "IDLE":
+		ses.idleHandler(tag)
+	case "UID":
+		if len(args) == 0 {
+			ses.send(tag + " BAD UID requires a command")
+			return true
+		}
+		switch strings.ToUpper(args[0]) {
+		case "SEARCH":
+			ses.searchHandler(tag, args[1:], true)
+		case "FETCH":
+			ses.fetchHandler(tag, args[1:], true)
+		case "STORE":
+			ses.storeHandler(tag, args[1:], true)
+		default:
+			ses.send(fmt.Sprintf("%v BAD UID %v is not supported", tag, args[0]))
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// storeHandler alters the flags of messages
+func (ses *Session) storeHandler(tag string, args []string, uid bool) {
+	if len(args) < 3 {
+		ses.send(tag + " BAD STORE requires a sequence set, an item name and flags")
+		return
+	}
+	if ses.readOnly {
+		ses.send(tag + " NO Mailbox is read-only")
+		return
+	}
+	set, err := parseSeqSet(args[0])
+	if err != nil {
+		ses.send(fmt.Sprintf("%v BAD %v", tag, err))
+		return
+	}
+	item := strings.ToUpper(args[1])
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	var op byte
+	switch item {
+	case "FLAGS":
+		op = '='
+	case "+FLAGS":
+		op = '+'
+	case "-FLAGS":
+		op = '-'
+	default:
+		ses.send(fmt.Sprintf("%v BAD Unknown STORE item %v", tag, args[1]))
+		return
+	}
+	flags := args[2:]
+	if len(flags) == 1 && isList(flags[0]) {
+		if flags, err = parseList(flags[0]); err != nil {
+			ses.send(fmt.Sprintf("%v BAD %v", tag, err))
+			return
+		}
+	}
+	for i := range ses.messages {
+		if !ses.inSet(set, i, uid) {
+			continue
+		}
+		result, err := updateFlags(ses.messages[i], op, flags)
+		if err != nil {
+			ses.logError("Failed to store flags of %v: %v", ses.messages[i], err)
+			ses.send(tag + " NO Failed to store flags")
+			return
+		}
+		if silent {
+			continue
+		}
+		resp := fmt.Sprintf("FLAGS (%v)", strings.Join(result, " "))
+		if uid {
+			resp = fmt.Sprintf("UID %v %v", ses.uids[i], resp)
+		}
+		ses.send(fmt.Sprintf("* %v FETCH (%v)", i+1, resp))
+	}
+	ses.send(tag + " OK STORE completed")
+}
+
+// expunge deletes the messages flagged \Deleted, sending EXPUNGE responses if notify is set
+func (ses *Session) expunge(notify bool) {
+	deleted := make(map[string]bool)
+	for _, msg := range ses.messages {
+		if smtpd.HasFlag(msg, `\Deleted`) {
+			deleted[msg.ID()] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return
+	}
+	// Delete through a freshly loaded mailbox, so that the index written includes any
+	// messages delivered since this one was selected
+	mb, err := ses.server.dataStore.MailboxFor(ses.user)
+	if err != nil {
+		ses.logError("Failed to open mailbox for %v: %v", ses.user, err)
+		return
+	}
+	current, err := mb.GetMessages()
+	if err != nil {
+		ses.logError("Failed to load messages for %v: %v", ses.user, err)
+		return
+	}
+	for _, msg := range current {
+		if deleted[msg.ID()] {
+			ses.logTrace("Deleting %v", msg)
+			if err := msg.Delete(); err != nil {
+				ses.logWarn("Error deleting %v: %v", msg, err)
+				delete(deleted, msg.ID())
+			}
+		}
+	}
+	// Working backwards keeps the sequence numbers of the remaining messages unchanged
+	for i := len(ses.messages) - 1; i >= 0; i-- {
+		if deleted[ses.messages[i].ID()] {
+			ses.removeMessage(i, notify)
+			expExpungesTotal.Add(1)
+		}
+	}
+}
+
+// refresh reloads the selected mailbox, reporting messages deleted and delivered since it was
+// last loaded
+func (ses *Session) refresh() {
+	messages, uids, err := ses.loadMailbox(ses.folder)
+	if err != nil {
+		ses.logError("Failed to load messages for %v: %v", ses.user, err)
+		return
+	}
+	present := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		present[uid] = true
+	}
+	for i := len(ses.uids) - 1; i >= 0; i-- {
+		if !present[ses.uids[i]] {
+			ses.removeMessage(i, true)
+		}
+	}
+	if len(messages) != len(ses.messages) {
+		ses.send(fmt.Sprintf("* %v EXISTS", len(messages)))
+	}
+	ses.messages, ses.uids = messages, uids
+}
+
+// removeMessage drops message i from the session, sending an EXPUNGE response if notify is
+// set
+func (ses *Session) removeMessage(i int, notify bool) {
+	ses.messages = append(ses.messages[:i], ses.messages[i+1:]...)
+	ses.uids = append(ses.uids[:i], ses.uids[i+1:]...)
+	if notify {
+		ses.send(fmt.Sprintf("* %v EXPUNGE", i+1))
+	}
+}
+
+// loadMailbox reads the messages of the user's mailbox in folder, and their UIDs
+func (ses *Session) loadMailbox(folder string) ([]smtpd.Message, []uint32, error) {
+	mb, err := ses.server.dataStore.MailboxFor(ses.user)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err := mb.GetMessages()
+	if err != nil {
+		return nil, nil, err
+	}
+	uids := make([]uint32, len(messages))
+	var last uint32
+	for i, msg := range messages {
+		uid := msg.IMAPUID()
+		if uid <= last {
+			// Messages stored before UIDs were persisted may share a derived UID
+			uid = last + 1
+		}
+		uids[i] = uid
+		last = uid
+	}
+	if folder == "" {
+		return messages, uids, nil
+	}
+	// UIDs are assigned above, so that they are the same in every folder
+	var fmessages []smtpd.Message
+	var fuids []uint32
+	for i, msg := range messages {
+		if msg.Delivery().Label == folder {
+			fmessages = append(fmessages, msg)
+			fuids = append(fuids, uids[i])
+		}
+	}
+	return fmessages, fuids, nil
+}
+
+// uidNext returns the predicted UID of the next message delivered to the selected mailbox
+func (ses *Session) uidNext() uint32 {
+	if len(ses.uids) == 0 {
+		return 1
+	}
+	return ses.uids[len(ses.uids)-1] + 1
+}
+
+// inSet returns true if message i is a member of set, which holds UIDs if uid is set and
+// sequence numbers otherwise
+func (ses *Session) inSet(set seqSet, i int, uid bool) bool {
+	if uid {
+		var largest uint32
+		if len(ses.uids) > 0 {
+			largest = ses.uids[len(ses.uids)-1]
+		}
+		return set.contains(ses.uids[i], largest)
+	}
+	return set.contains(uint32(i+1), uint32(len(ses.messages)))
+}
+
+func (ses *Session) enterState(state State) {
+	ses.state = state
+	ses.logTrace("Entering state %v", state)
+}
+
+// Calculate the next read or write deadline based on maxIdleSeconds
+func (ses *Session) nextDeadline() time.Time {
+	return time.Now().Add(time.Duration(ses.server.maxIdleSeconds) * time.Second)
+}
+
+// Send requested message, store errors in Session.sendError
+func (ses *Session) send(msg string) {
+	if err := ses.conn.SetWriteDeadline(ses.nextDeadline()); err != nil {
+		ses.sendError = err
+		return
+	}
+	if _, err := fmt.Fprint(ses.conn, msg+"\r\n"); err != nil {
+		ses.sendError = err
+		ses.logWarn("Failed to send: '%v'", msg)
+		return
+	}
+	ses.logTrace(">> %v >>", msg)
+}
+
+// Reads a line of input
+func (ses *Session) readLine() (line string, err error) {
+	if err = ses.conn.SetReadDeadline(ses.nextDeadline()); err != nil {
+		return "", err
+	}
+	line, err = ses.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	ses.logTrace("<< %v <<", strings.TrimRight(line, "\r\n"))
+	return line, nil
+}
+
+// readCommand reads a complete command, replacing any literals it contains with quoted
+// strings
+func (ses *Session) readCommand() (string, error) {
+	line, err := ses.readLine()
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	for {
+		size, sync, ok := literalSize(line)
+		if !ok {
+			return line, nil
+		}
+		if size > maxLiteral {
+			return "", errLiteralTooLarge
+		}
+		line = line[:strings.LastIndex(line, "{")]
+		if sync {
+			ses.send("+ Ready for literal data")
+		}
+		data := make([]byte, size)
+		if err := ses.conn.SetReadDeadline(ses.nextDeadline()); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(ses.reader, data); err != nil {
+			return "", err
+		}
+		rest, err := ses.readLine()
+		if err != nil {
+			return "", err
+		}
+		line += `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(string(data)) + `"` +
+			strings.TrimRight(rest, "\r\n")
+	}
+}
+
+// parseCommand splits a command line into its tag, upper cased command name and arguments
+func parseCommand(line string) (tag, cmd string, args []string, err error) {
+	words := strings.SplitN(line, " ", 3)
+	tag = words[0]
+	if len(words) < 2 {
+		return tag, "", nil, nil
+	}
+	cmd = strings.ToUpper(words[1])
+	if len(words) == 3 {
+		args, err = splitArgs(words[2])
+	}
+	return tag, cmd, args, err
+}
+
+// parseNumber parses a non-negative decimal argument
+func parseNumber(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid number %q", s)
+	}
+	return n, nil
+}
+
+func (ses *Session) ooSeq(tag, cmd string) {
+	ses.send(fmt.Sprintf("%v BAD Command %v is not valid in state %v", tag, cmd, ses.state))
+	ses.logWarn("Wasn't expecting %v here", cmd)
+}
+
+// Session specific logging methods
+func (ses *Session) logTrace(msg string, args ...interface{}) {
+	log.Tracef("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logInfo(msg string, args ...interface{}) {
+	log.Infof("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logWarn(msg string, args ...interface{}) {
+	// Update metrics
+	expWarnsTotal.Add(1)
+	log.Warnf("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logError(msg string, args ...interface{}) {
+	// Update metrics
+	expErrorsTotal.Add(1)
+	log.Errorf("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
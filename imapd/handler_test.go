@@ -0,0 +1,768 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/smtpd"
+	"github.com/stretchr/testify/mock"
+)
+
+type scriptStep struct {
+	send   string
+	expect string // Status of the tagged reply: "OK", "NO" or "BAD"
+}
+
+const testRaw = "From: Alice <alice@example.com>\r\nSubject: Hi\r\n\r\nHello world\r\n"
+
+// Test LOGIN to public and private mailboxes
+func TestLogin(t *testing.T) {
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "team", Pattern: "team-*", Token: "t0k"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mb2 := &MockMailbox{}
+	mds.On("MailboxFor", "u1").Return(mb1, nil)
+	mds.On("MailboxFor", "U1+promo").Return(mb1, nil)
+	mds.On("MailboxFor", "team-a").Return(mb2, nil)
+	mds.On("MailboxFor", "bad@name").Return(&MockMailbox{}, fmt.Errorf("Invalid name"))
+	mb1.On("Name").Return("u1")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+	mb2.On("Name").Return("team-a")
+	mb2.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	server, logbuf, teardown := setupIMAPServer(mds)
+	defer teardown()
+
+	var testTable = []struct {
+		name   string
+		script []scriptStep
+	}{
+		{"public mailbox, any password", []scriptStep{
+			{"LOGIN u1 anything", "OK"},
+			{"SELECT INBOX", "OK"},
+		}},
+		{"public mailbox, sub-address", []scriptStep{
+			{`LOGIN "U1+promo" ""`, "OK"},
+		}},
+		{"private mailbox, token", []scriptStep{
+			{"LOGIN team-a t0k", "OK"},
+			{"SELECT INBOX", "OK"},
+		}},
+		{"private mailbox, wrong token", []scriptStep{
+			{"LOGIN team-a wrong", "NO"},
+			{"SELECT INBOX", "BAD"},
+			{"LOGIN team-a t0k", "OK"},
+		}},
+		{"invalid mailbox", []scriptStep{
+			{"LOGIN bad@name any", "NO"},
+		}},
+		{"missing password", []scriptStep{
+			{"LOGIN u1", "BAD"},
+		}},
+		{"commands need a login", []scriptStep{
+			{"SELECT INBOX", "BAD"},
+			{"LIST \"\" *", "BAD"},
+			{"FETCH 1 FLAGS", "BAD"},
+		}},
+		{"logged in twice", []scriptStep{
+			{"LOGIN u1 any", "OK"},
+			{"LOGIN u1 any", "BAD"},
+		}},
+	}
+	for _, tt := range testTable {
+		if err := playSession(t, server, tt.script); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+	}
+
+	// The reason for a failed login is reported to the client
+	c, _, err := dialIMAP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := c.command("LOGIN team-a wrong"); err != nil {
+		t.Error(err)
+	} else if !strings.HasPrefix(status, "NO [AUTHENTICATIONFAILED] ") {
+		t.Errorf("Expected NO [AUTHENTICATIONFAILED], got %q", status)
+	}
+	c.close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test SELECT and EXAMINE of INBOX
+func TestSelect(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	m1 := mockMessage("m1", 5, "", testRaw, smtpd.FlagSeen, `\Deleted`)
+	m2 := mockMessage("m2", 9, "", testRaw)
+	setMessages(mb1, m1, m2)
+
+	server, logbuf, teardown := setupIMAPServer(mds)
+	defer teardown()
+
+	c, _, err := dialIMAP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := playScriptAgainst(t, c, []scriptStep{{"LOGIN u1 any", "OK"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, lines, err := c.command("SELECT inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "OK [READ-WRITE] SELECT completed" {
+		t.Errorf("Expected a read-write SELECT, got %q", status)
+	}
+	for _, want := range []string{
+		`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`,
+		`* OK [PERMANENTFLAGS (\Answered \Flagged \Deleted \Seen \Draft \*)] Flags permitted`,
+		"* 2 EXISTS",
+		"* 0 RECENT",
+		"* OK [UNSEEN 2] First unseen message",
+		"* OK [UIDVALIDITY 1] UIDs valid",
+		"* OK [UIDNEXT 10] Predicted next UID",
+	} {
+		if !hasLine(lines, want) {
+			t.Errorf("Expected %q in SELECT response, got %q", want, lines)
+		}
+	}
+
+	status, lines, err = c.command("EXAMINE INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "OK [READ-ONLY] EXAMINE completed" {
+		t.Errorf("Expected a read-only EXAMINE, got %q", status)
+	}
+	if !hasLine(lines, "* OK [PERMANENTFLAGS ()] No permanent flags permitted") {
+		t.Errorf("Expected no PERMANENTFLAGS in EXAMINE response, got %q", lines)
+	}
+
+	// A read-only mailbox can not be changed, not even by fetching a message
+	script := []scriptStep{
+		{`STORE 1 +FLAGS (\Deleted)`, "NO"},
+		{"EXPUNGE", "NO"},
+		{"FETCH 2 BODY[TEXT]", "OK"},
+		{"CLOSE", "OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	if m2.hasFlag(smtpd.FlagSeen) {
+		t.Error("FETCH of an examined message should not set \\Seen")
+	}
+	if called(m1.MockMessage, "Delete") || called(m2.MockMessage, "Delete") {
+		t.Error("CLOSE of an examined mailbox should not delete messages")
+	}
+
+	// A failed SELECT leaves no mailbox selected
+	script = []scriptStep{
+		{"SELECT INBOX", "OK"},
+		{"SELECT nosuch", "NO"},
+		{"FETCH 1 FLAGS", "BAD"},
+		{"SELECT", "BAD"},
+		{"UNSELECT", "BAD"},
+		{"LOGOUT", "OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	c.close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test FETCH of flags, body sections and partials
+func TestFetch(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	m1 := mockMessage("m1", 5, "", testRaw, smtpd.FlagSeen)
+	m2 := mockMessage("m2", 9, "", testRaw)
+	setMessages(mb1, m1, m2)
+
+	server, logbuf, teardown := setupIMAPServer(mds)
+	defer teardown()
+
+	c, _, err := dialIMAP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := []scriptStep{
+		{"LOGIN u1 any", "OK"},
+		{"SELECT INBOX", "OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+
+	size := len(testRaw)
+	header := "From: Alice <alice@example.com>\r\nSubject: Hi\r\n\r\n"
+	var testTable = []struct {
+		send   string
+		expect []string
+	}{
+		{"FETCH 1:* (FLAGS UID RFC822.SIZE)", []string{
+			fmt.Sprintf(`* 1 FETCH (FLAGS (\Seen) UID 5 RFC822.SIZE %v)`, size),
+			fmt.Sprintf(`* 2 FETCH (FLAGS () UID 9 RFC822.SIZE %v)`, size),
+		}},
+		{"FETCH 2 BODY.PEEK[HEADER]", []string{
+			fmt.Sprintf("* 2 FETCH (BODY[HEADER] {%v}\r\n%v)", len(header), header),
+		}},
+		{"FETCH 2 BODY.PEEK[HEADER.FIELDS (subject)]", []string{
+			"* 2 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {15}\r\nSubject: Hi\r\n\r\n)",
+		}},
+		{"FETCH 2 BODY.PEEK[HEADER.FIELDS.NOT (SUBJECT)]", []string{
+			"* 2 FETCH (BODY[HEADER.FIELDS.NOT (SUBJECT)] {35}\r\n" +
+				"From: Alice <alice@example.com>\r\n\r\n)",
+		}},
+		{"FETCH 2 BODY.PEEK[]<6.5>", []string{
+			"* 2 FETCH (BODY[]<6> {5}\r\nAlice)",
+		}},
+		{"FETCH 2 BODY.PEEK[TEXT]<6.100>", []string{
+			"* 2 FETCH (BODY[TEXT]<6> {7}\r\nworld\r\n)",
+		}},
+		{"FETCH 2 BODY.PEEK[]<1000.10>", []string{
+			"* 2 FETCH (BODY[]<1000> {0}\r\n)",
+		}},
+		{"FETCH 1 ENVELOPE", []string{
+			`* 1 FETCH (ENVELOPE (NIL "Hi" (("Alice" NIL "alice" "example.com")) ` +
+				`(("Alice" NIL "alice" "example.com")) (("Alice" NIL "alice" "example.com")) ` +
+				`NIL NIL NIL NIL NIL))`,
+		}},
+		{"UID FETCH 9 FLAGS", []string{
+			`* 2 FETCH (UID 9 FLAGS ())`,
+		}},
+		{"UID FETCH 6:* (UID FLAGS)", []string{
+			`* 2 FETCH (UID 9 FLAGS ())`,
+		}},
+		{"FETCH 3 FLAGS", nil},
+		// The message has not been seen until its text is fetched without PEEK
+		{"FETCH 2 BODY[TEXT]<0.5>", []string{
+			"* 2 FETCH (BODY[TEXT]<0> {5}\r\nHello FLAGS (\\Seen))",
+		}},
+		{"FETCH 2 (FLAGS BODY[TEXT]<0.5>)", []string{
+			"* 2 FETCH (FLAGS (\\Seen) BODY[TEXT]<0> {5}\r\nHello)",
+		}},
+	}
+	for _, tt := range testTable {
+		status, lines, err := c.command(tt.send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(status, "OK ") {
+			t.Errorf("%v: expected OK, got %q", tt.send, status)
+			continue
+		}
+		if strings.Join(lines, "\n") != strings.Join(tt.expect, "\n") {
+			t.Errorf("%v:\nexpected %q\n     got %q", tt.send, tt.expect, lines)
+		}
+	}
+
+	script = []scriptStep{
+		{"FETCH 1 BODY[MIME]", "BAD"},
+		{"FETCH 1 BODY[]<0>", "BAD"},
+		{"FETCH x FLAGS", "BAD"},
+		{"FETCH 1", "BAD"},
+		{"UID COPY 1 other", "BAD"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	c.close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test STORE of flags and EXPUNGE of deleted messages
+func TestStoreExpunge(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	m1 := mockMessage("m1", 5, "", testRaw)
+	m2 := mockMessage("m2", 9, "", testRaw)
+	m3 := mockMessage("m3", 12, "", testRaw)
+	setMessages(mb1, m1, m2, m3)
+
+	server, logbuf, teardown := setupIMAPServer(mds)
+	defer teardown()
+
+	c, _, err := dialIMAP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := []scriptStep{
+		{"LOGIN u1 any", "OK"},
+		{"SELECT INBOX", "OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+
+	var testTable = []struct {
+		send   string
+		expect []string
+	}{
+		{`STORE 1 +FLAGS (\Deleted \Recent)`, []string{`* 1 FETCH (FLAGS (\Deleted))`}},
+		{`STORE 1 -FLAGS.SILENT (\Deleted)`, nil},
+		{`STORE 1:2 FLAGS (\seen $Label1)`, []string{
+			`* 1 FETCH (FLAGS ($Label1 \Seen))`,
+			`* 2 FETCH (FLAGS ($Label1 \Seen))`,
+		}},
+		{`STORE 2 -FLAGS $Label1`, []string{`* 2 FETCH (FLAGS (\Seen))`}},
+		{`UID STORE 9,12 +FLAGS (\Flagged \Deleted)`, []string{
+			`* 2 FETCH (UID 9 FLAGS (\Deleted \Flagged \Seen))`,
+			`* 3 FETCH (UID 12 FLAGS (\Deleted \Flagged))`,
+		}},
+		{`UID STORE 5 -FLAGS.SILENT (\Seen)`, nil},
+		{"FETCH 1:* FLAGS", []string{
+			`* 1 FETCH (FLAGS ($Label1))`,
+			`* 2 FETCH (FLAGS (\Deleted \Flagged \Seen))`,
+			`* 3 FETCH (FLAGS (\Deleted \Flagged))`,
+		}},
+		// Expunged messages are reported highest first, so sequence numbers stay valid
+		{"EXPUNGE", []string{"* 3 EXPUNGE", "* 2 EXPUNGE"}},
+		{"UID FETCH 1:* FLAGS", []string{`* 1 FETCH (UID 5 FLAGS ($Label1))`}},
+	}
+	for _, tt := range testTable {
+		status, lines, err := c.command(tt.send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(status, "OK ") {
+			t.Errorf("%v: expected OK, got %q", tt.send, status)
+			continue
+		}
+		if strings.Join(lines, "\n") != strings.Join(tt.expect, "\n") {
+			t.Errorf("%v:\nexpected %q\n     got %q", tt.send, tt.expect, lines)
+		}
+	}
+	if called(m1.MockMessage, "Delete") {
+		t.Error("Expected m1 to be kept")
+	}
+	if !called(m2.MockMessage, "Delete") || !called(m3.MockMessage, "Delete") {
+		t.Error("Expected m2 and m3 to be deleted")
+	}
+
+	script = []scriptStep{
+		{"STORE 1 FLAGS", "BAD"},
+		{`STORE 1 XFLAGS (\Seen)`, "BAD"},
+		{`STORE x +FLAGS (\Seen)`, "BAD"},
+		{"UID", "BAD"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	c.close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test LOGOUT in each state
+func TestLogout(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	m1 := mockMessage("m1", 1, "", testRaw, `\Deleted`)
+	setMessages(mb1, m1)
+
+	server, logbuf, teardown := setupIMAPServer(mds)
+	defer teardown()
+
+	var testTable = []struct {
+		name   string
+		script []scriptStep
+	}{
+		{"not authenticated", nil},
+		{"authenticated", []scriptStep{
+			{"LOGIN u1 any", "OK"},
+		}},
+		{"selected", []scriptStep{
+			{"LOGIN u1 any", "OK"},
+			{"SELECT INBOX", "OK"},
+		}},
+	}
+	for _, tt := range testTable {
+		c, _, err := dialIMAP(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := playScriptAgainst(t, c, tt.script); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+		status, lines, err := c.command("LOGOUT")
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if status != "OK LOGOUT completed" {
+			t.Errorf("%v: expected OK, got %q", tt.name, status)
+		}
+		if len(lines) != 1 || !strings.HasPrefix(lines[0], "* BYE ") {
+			t.Errorf("%v: expected a BYE before the reply, got %q", tt.name, lines)
+		}
+		// The server closes the connection
+		if line, err := c.readResponse(); err != io.EOF {
+			t.Errorf("%v: expected EOF after LOGOUT, got %q, %v", tt.name, line, err)
+		}
+		c.close()
+	}
+	// Unlike CLOSE, LOGOUT does not expunge
+	if called(m1.MockMessage, "Delete") {
+		t.Error("LOGOUT should not delete messages")
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test IDLE updates for messages delivered while idling
+func TestIdle(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	m1 := mockMessage("m1", 1, "", testRaw)
+	m2 := mockMessage("m2", 2, "", testRaw)
+	loads := make(chan bool, 10)
+	loaded := func(mock.Arguments) { loads <- true }
+	mb1.On("GetMessages").Return([]smtpd.Message{m1}, nil).Run(loaded).Once()
+	mb1.On("GetMessages").Return([]smtpd.Message{m1, m2}, nil).Run(loaded)
+
+	server, logbuf, teardown := setupIMAPServer(mds)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server.msgHub = msghub.New(ctx, 10)
+	// Deliveries before IDLE are in the history buffer, and must not be announced again
+	server.msgHub.Dispatch(msghub.Message{Mailbox: "u1", ID: "m1"})
+
+	c, _, err := dialIMAP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	script := []scriptStep{
+		{"LOGIN u1 any", "OK"},
+		{"SELECT INBOX", "OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fmt.Fprint(c.conn, "I1 IDLE\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := c.readResponse(); err != nil || !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("Expected a continuation for IDLE, got %q, %v", line, err)
+	}
+	<-loads
+	server.msgHub.Sync()
+	select {
+	case <-loads:
+		t.Error("IDLE refreshed the mailbox for a delivery before it started")
+	case <-time.After(100 * time.Millisecond):
+	}
+	server.msgHub.Dispatch(msghub.Message{Mailbox: "u2", ID: "x1"})
+	server.msgHub.Dispatch(msghub.Message{Mailbox: "u1", ID: "m2"})
+	if line, err := c.readResponse(); err != nil || line != "* 2 EXISTS" {
+		t.Fatalf("Expected * 2 EXISTS, got %q, %v", line, err)
+	}
+	if _, err := fmt.Fprint(c.conn, "DONE\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for {
+		line, err := c.readResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "I1 ") {
+			if line != "I1 OK IDLE terminated" {
+				t.Errorf("Expected IDLE to be terminated, got %q", line)
+			}
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 0 {
+		t.Errorf("Expected exactly one EXISTS update, got %q more", lines)
+	}
+	// SELECT, the delivery of m2 and DONE each load the mailbox once
+	mb1.AssertNumberOfCalls(t, "GetMessages", 3)
+	// Log out before the msghub is shut down
+	if _, _, err := c.command("LOGOUT"); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// testMessage is a mock message that keeps the flags stored by the session
+type testMessage struct {
+	*MockMessage
+	mu    sync.Mutex
+	flags []string
+}
+
+func (m *testMessage) Flags() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.flags...)
+}
+
+func (m *testMessage) SetFlags(flags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flags = append([]string(nil), flags...)
+	return nil
+}
+
+func (m *testMessage) hasFlag(flag string) bool {
+	for _, f := range m.Flags() {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// mockMessage returns a message with the given UID, sub-address label, content and flags
+func mockMessage(id string, uid uint32, label, raw string, flags ...string) *testMessage {
+	msg := &MockMessage{}
+	msg.On("ID").Return(id)
+	msg.On("String").Return(id)
+	msg.On("IMAPUID").Return(uid)
+	msg.On("Delivery").Return(smtpd.Delivery{Label: label})
+	msg.On("Date").Return(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC))
+	msg.On("Size").Return(len(raw))
+	msg.On("ReadRaw").Return(&raw, nil)
+	msg.On("Delete").Return(nil)
+	return &testMessage{MockMessage: msg, flags: flags}
+}
+
+// setMessages sets the messages returned by mb
+func setMessages(mb *MockMailbox, msgs ...*testMessage) {
+	messages := make([]smtpd.Message, len(msgs))
+	for i, msg := range msgs {
+		messages[i] = msg
+	}
+	mb.On("GetMessages").Return(messages, nil)
+}
+
+// called returns true if method of m was called
+func called(m *MockMessage, method string) bool {
+	for _, call := range m.Calls {
+		if call.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// imapClient sends tagged commands and reads their responses
+type imapClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	tagNum int
+}
+
+// dialIMAP starts a session and reads its greeting
+func dialIMAP(server *Server) (c *imapClient, greeting string, err error) {
+	conn := setupIMAPSession(server)
+	c = &imapClient{conn: conn, reader: bufio.NewReader(conn)}
+	if greeting, err = c.readResponse(); err != nil {
+		return nil, "", err
+	}
+	if !strings.HasPrefix(greeting, "* OK ") {
+		return nil, "", fmt.Errorf("Expected an OK greeting, got %q", greeting)
+	}
+	return c, greeting, nil
+}
+
+// readResponse reads a response line, including the contents of any literals
+func (c *imapClient) readResponse() (string, error) {
+	var resp string
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return resp + line, err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		resp += line
+		size, _, ok := literalSize(line)
+		if !ok {
+			return resp, nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return resp, err
+		}
+		resp += "\r\n" + string(data)
+	}
+}
+
+// command sends cmd with the next tag, returning the tagged status without the tag, and the
+// untagged responses before it
+func (c *imapClient) command(cmd string) (status string, lines []string, err error) {
+	c.tagNum++
+	tag := fmt.Sprintf("A%03d", c.tagNum)
+	if _, err = fmt.Fprintf(c.conn, "%v %v\r\n", tag, cmd); err != nil {
+		return "", nil, err
+	}
+	for {
+		line, err := c.readResponse()
+		if err != nil {
+			return "", lines, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return line[len(tag)+1:], lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (c *imapClient) close() {
+	_ = c.conn.Close()
+}
+
+// playSession plays script in a new session, then logs out
+func playSession(t *testing.T, server *Server, script []scriptStep) error {
+	c, _, err := dialIMAP(server)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if err := playScriptAgainst(t, c, script); err != nil {
+		return err
+	}
+	_, _, err = c.command("LOGOUT")
+	return err
+}
+
+// playScriptAgainst sends each command of script, checking the status of its tagged reply
+func playScriptAgainst(t *testing.T, c *imapClient, script []scriptStep) error {
+	for i, step := range script {
+		status, _, err := c.command(step.send)
+		if err != nil {
+			return fmt.Errorf("Step %d, failed to send %q: %v", i, step.send, err)
+		}
+		if !strings.HasPrefix(status+" ", step.expect+" ") {
+			t.Errorf("Step %d, sent %q, expected %v, got %q", i, step.send, step.expect, status)
+		}
+	}
+	return nil
+}
+
+// hasLine returns true if lines contains line
+func hasLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// net.Pipe does not implement deadlines
+type mockConn struct {
+	net.Conn
+}
+
+func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// setupIMAPServer creates a server with the default test configuration, tests may change its
+// settings before starting sessions
+func setupIMAPServer(ds smtpd.DataStore) (s *Server, buf *bytes.Buffer, teardown func()) {
+	// Capture log output
+	buf = new(bytes.Buffer)
+	log.SetOutput(buf)
+
+	// Create a server, don't start it
+	shutdownChan := make(chan bool)
+	teardown = func() {
+		close(shutdownChan)
+	}
+	s = &Server{
+		domain:         "inbucket.local",
+		maxIdleSeconds: 5,
+		dataStore:      ds,
+		globalShutdown: shutdownChan,
+		waitgroup:      new(sync.WaitGroup),
+	}
+	return s, buf, teardown
+}
+
+var sessionNum int
+
+// setupIMAPSession starts a session over a pipe, returning the client end
+func setupIMAPSession(server *Server) net.Conn {
+	// Pair of pipes to communicate
+	serverConn, clientConn := net.Pipe()
+	// Start the session
+	server.waitgroup.Add(1)
+	sessionNum++
+	go server.startSession(sessionNum, &mockConn{serverConn})
+
+	return clientConn
+}
@@ -0,0 +1,84 @@
+package imapd
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/msghub"
+)
+
+// idlePollInterval is how often an idling session checks for changes the msghub does not
+// announce, such as messages deleted through the web UI
+const idlePollInterval = 10 * time.Second
+
+// idleListener wakes an idling session when a message is delivered to its mailbox
+type idleListener struct {
+	mailbox string
+	notify  chan struct{}
+}
+
+// Receive implements msghub.Listener
+func (l *idleListener) Receive(msg msghub.Message) error {
+	if msg.Mailbox == l.mailbox {
+		select {
+		case l.notify <- struct{}{}:
+		default:
+			// A wake up is already pending
+		}
+	}
+	return nil
+}
+
+// idleResult is the line read from the client while idling
+type idleResult struct {
+	line string
+	err  error
+}
+
+// idleHandler implements RFC 2177 IDLE, sending updates to the selected mailbox as they happen
+// until the client sends DONE
+func (ses *Session) idleHandler(tag string) {
+	listener := &idleListener{mailbox: ses.user, notify: make(chan struct{}, 1)}
+	if ses.server.msgHub != nil {
+		ses.server.msgHub.AddLiveListener(listener)
+		defer ses.server.msgHub.RemoveListener(listener)
+	}
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+
+	// Only this goroutine reads from the client until IDLE ends
+	done := make(chan idleResult, 1)
+	go func() {
+		line, err := ses.readLine()
+		done <- idleResult{line, err}
+	}()
+
+	ses.send("+ idling")
+	ses.logTrace("Idling")
+	for ses.sendError == nil {
+		select {
+		case <-listener.notify:
+			ses.refresh()
+		case <-ticker.C:
+			ses.refresh()
+		case result := <-done:
+			if result.err != nil {
+				ses.logWarn("Connection error while idling: %v", result.err)
+				if netErr, ok := result.err.(net.Error); ok && netErr.Timeout() {
+					ses.send("* BYE Idle timeout, bye bye")
+				}
+				ses.enterState(LOGOUT)
+				return
+			}
+			if !strings.EqualFold(strings.TrimRight(result.line, "\r\n"), "DONE") {
+				ses.logWarn("Expected DONE to end IDLE")
+				ses.send(tag + " BAD Expected DONE")
+				return
+			}
+			ses.refresh()
+			ses.send(tag + " OK IDLE terminated")
+			return
+		}
+	}
+}
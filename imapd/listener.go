@@ -0,0 +1,150 @@
+package imapd
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// Server defines an instance of our IMAP server
+type Server struct {
+	ip4address     net.IP
+	ip4port        int
+	domain         string
+	maxIdleSeconds int
+	dataStore      smtpd.DataStore
+	msgHub         *msghub.Hub // Announces deliveries to idling sessions
+	listener       net.Listener
+	globalShutdown chan bool
+	waitgroup      *sync.WaitGroup
+}
+
+var (
+	// Raw stat collectors
+	expConnectsTotal   = new(expvar.Int)
+	expConnectsCurrent = new(expvar.Int)
+	expLoginsTotal     = new(expvar.Int)
+	expFetchesTotal    = new(expvar.Int)
+	expExpungesTotal   = new(expvar.Int)
+	expErrorsTotal     = new(expvar.Int)
+	expWarnsTotal      = new(expvar.Int)
+)
+
+// New creates a new Server struct
+func New(cfg config.IMAPConfig, globalShutdown chan bool, ds smtpd.DataStore,
+	msgHub *msghub.Hub) *Server {
+	return &Server{
+		ip4address:     cfg.IP4address,
+		ip4port:        cfg.IP4port,
+		domain:         cfg.Domain,
+		maxIdleSeconds: cfg.MaxIdleSeconds,
+		dataStore:      ds,
+		msgHub:         msgHub,
+		globalShutdown: globalShutdown,
+		waitgroup:      new(sync.WaitGroup),
+	}
+}
+
+// Start the server and listen for connections
+func (s *Server) Start(ctx context.Context) {
+	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v", s.ip4address, s.ip4port))
+	if err != nil {
+		log.Errorf("IMAP Failed to build tcp4 address: %v", err)
+		s.emergencyShutdown()
+		return
+	}
+
+	log.Infof("IMAP listening on TCP4 %v", addr)
+	s.listener, err = net.ListenTCP("tcp4", addr)
+	if err != nil {
+		log.Errorf("IMAP failed to start tcp4 listener: %v", err)
+		s.emergencyShutdown()
+		return
+	}
+
+	// Listener go routine
+	go s.serve(ctx)
+
+	// Wait for shutdown
+	<-ctx.Done()
+
+	log.Tracef("IMAP shutdown requested, connections will be drained")
+	// Closing the listener will cause the serve() go routine to exit
+	if err := s.listener.Close(); err != nil {
+		log.Errorf("Error closing IMAP listener: %v", err)
+	}
+}
+
+// serve is the listen/accept loop
+func (s *Server) serve(ctx context.Context) {
+	// Handle incoming connections
+	var tempDelay time.Duration
+	for sid := 1; ; sid++ {
+		if conn, err := s.listener.Accept(); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				// Temporary error, sleep for a bit and try again
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Errorf("IMAP accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			} else {
+				// Permanent error
+				select {
+				case <-ctx.Done():
+					// IMAP is shutting down
+					return
+				default:
+					// Something went wrong
+					s.emergencyShutdown()
+					return
+				}
+			}
+		} else {
+			tempDelay = 0
+			s.waitgroup.Add(1)
+			go s.startSession(sid, conn)
+		}
+	}
+}
+
+func (s *Server) emergencyShutdown() {
+	// Shutdown Inbucket
+	select {
+	case <-s.globalShutdown:
+	default:
+		close(s.globalShutdown)
+	}
+}
+
+// Drain causes the caller to block until all active IMAP sessions have finished
+func (s *Server) Drain() {
+	// Wait for sessions to close
+	s.waitgroup.Wait()
+	log.Tracef("IMAP connections have drained")
+}
+
+func init() {
+	m := expvar.NewMap("imap")
+	m.Set("ConnectsTotal", expConnectsTotal)
+	m.Set("ConnectsCurrent", expConnectsCurrent)
+	m.Set("LoginsTotal", expLoginsTotal)
+	m.Set("FetchesTotal", expFetchesTotal)
+	m.Set("ExpungesTotal", expExpungesTotal)
+	m.Set("ErrorsTotal", expErrorsTotal)
+	m.Set("WarnsTotal", expWarnsTotal)
+}
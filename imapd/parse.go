@@ -0,0 +1,202 @@
+package imapd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errUnbalanced = errors.New("Unbalanced parentheses or brackets")
+
+// splitArgs splits the arguments of an IMAP command into tokens.  Quoted strings are
+// unquoted, while parenthesized lists are returned whole, including their parentheses, to be
+// split again with parseList.  Brackets, as in BODY[HEADER.FIELDS (FROM)], keep a token
+// together.
+func splitArgs(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case ' ':
+			i++
+		case '"':
+			token, n, err := unquote(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+			i += n
+		default:
+			start := i
+			depth := 0
+			for ; i < len(s); i++ {
+				c := s[i]
+				if c == ' ' && depth == 0 {
+					break
+				}
+				switch c {
+				case '(', '[':
+					depth++
+				case ')', ']':
+					depth--
+				case '"':
+					// A quoted string within a list
+					_, n, err := unquote(s[i:])
+					if err != nil {
+						return nil, err
+					}
+					i += n - 1
+				}
+				if depth < 0 {
+					return nil, errUnbalanced
+				}
+			}
+			if depth != 0 {
+				return nil, errUnbalanced
+			}
+			tokens = append(tokens, s[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+// unquote parses the quoted string at the start of s, returning its content and the number of
+// bytes consumed
+func unquote(s string) (string, int, error) {
+	buf := make([]byte, 0, len(s))
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, errors.New("Unterminated quoted string")
+			}
+			buf = append(buf, s[i])
+		case '"':
+			return string(buf), i + 1, nil
+		default:
+			buf = append(buf, s[i])
+		}
+	}
+	return "", 0, errors.New("Unterminated quoted string")
+}
+
+// isList returns true if token is a parenthesized list
+func isList(token string) bool {
+	return len(token) >= 2 && token[0] == '(' && token[len(token)-1] == ')'
+}
+
+// parseList splits a parenthesized list into its members, any other token is treated as a
+// list of one
+func parseList(token string) ([]string, error) {
+	if !isList(token) {
+		return []string{token}, nil
+	}
+	return splitArgs(token[1 : len(token)-1])
+}
+
+// literalSize returns the size of the literal announced at the end of a command line, and
+// whether the client will wait for a continuation before sending it (false for LITERAL+)
+func literalSize(line string) (size int, sync bool, ok bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	open := strings.LastIndex(line, "{")
+	if open < 0 {
+		return 0, false, false
+	}
+	digits := line[open+1 : len(line)-1]
+	sync = true
+	if strings.HasSuffix(digits, "+") {
+		digits = digits[:len(digits)-1]
+		sync = false
+	}
+	size, err := strconv.Atoi(digits)
+	if err != nil || size < 0 {
+		return 0, false, false
+	}
+	return size, sync, true
+}
+
+// quote returns s as an IMAP quoted string, or as a literal if it cannot be quoted
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c == 0 || c > 0x7f {
+			return literal(s)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// nstring returns s quoted, or NIL if it is empty
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+// literal returns s as an IMAP literal
+func literal(s string) string {
+	return fmt.Sprintf("{%v}\r\n%v", len(s), s)
+}
+
+// seqRange is an inclusive range of a sequence set, 0 stands for *
+type seqRange struct {
+	lo, hi uint32
+}
+
+// seqSet is a parsed IMAP sequence set such as 1:4,7,9:*
+type seqSet []seqRange
+
+// parseSeqSet parses an IMAP sequence set of message sequence numbers or UIDs
+func parseSeqSet(s string) (seqSet, error) {
+	var set seqSet
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		lo, err := parseSeqNum(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = parseSeqNum(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{lo, hi})
+	}
+	return set, nil
+}
+
+// parseSeqNum parses a single member of a sequence set, returning 0 for *
+func parseSeqNum(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("Invalid sequence number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// contains returns true if num is in the set, where * represents largest
+func (set seqSet) contains(num, largest uint32) bool {
+	for _, r := range set {
+		lo, hi := r.lo, r.hi
+		if lo == 0 {
+			lo = largest
+		}
+		if hi == 0 {
+			hi = largest
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= num && num <= hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package imapd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	var testTable = []struct {
+		input  string
+		expect []string
+	}{
+		{"", nil},
+		{"fred secret", []string{"fred", "secret"}},
+		{`"fred" "sec ret"`, []string{"fred", "sec ret"}},
+		{`"a \"quoted\" \\ string"`, []string{`a "quoted" \ string`}},
+		{"1:* (FLAGS UID)", []string{"1:*", "(FLAGS UID)"}},
+		{"1 BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>",
+			[]string{"1", "BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>"}},
+		{`(FROM "a b" (SUBJECT x))`, []string{`(FROM "a b" (SUBJECT x))`}},
+	}
+	for _, tt := range testTable {
+		result, err := splitArgs(tt.input)
+		if assert.NoError(t, err, "splitArgs(%q)", tt.input) {
+			assert.Equal(t, tt.expect, result, "splitArgs(%q)", tt.input)
+		}
+	}
+
+	for _, input := range []string{`"unterminated`, "(FLAGS", "BODY[HEADER", "a)"} {
+		_, err := splitArgs(input)
+		assert.Error(t, err, "splitArgs(%q) should fail", input)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	result, err := parseList(`(FLAGS BODY[HEADER.FIELDS (FROM)] "x y")`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"FLAGS", "BODY[HEADER.FIELDS (FROM)]", "x y"}, result)
+
+	result, err = parseList("FLAGS")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"FLAGS"}, result)
+}
+
+func TestLiteralSize(t *testing.T) {
+	var testTable = []struct {
+		input string
+		size  int
+		sync  bool
+		ok    bool
+	}{
+		{"a LOGIN fred {6}", 6, true, true},
+		{"a LOGIN fred {6+}", 6, false, true},
+		{"a LOGIN fred secret", 0, false, false},
+		{"a LOGIN fred {x}", 0, false, false},
+		{"a LOGIN fred }", 0, false, false},
+	}
+	for _, tt := range testTable {
+		size, sync, ok := literalSize(tt.input)
+		assert.Equal(t, tt.ok, ok, "literalSize(%q)", tt.input)
+		assert.Equal(t, tt.size, size, "literalSize(%q)", tt.input)
+		assert.Equal(t, tt.sync, sync, "literalSize(%q)", tt.input)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, `"plain"`, quote("plain"))
+	assert.Equal(t, `"a \"b\" \\"`, quote(`a "b" \`))
+	assert.Equal(t, "{4}\r\na\r\nb", quote("a\r\nb"))
+	assert.Equal(t, "NIL", nstring(""))
+}
+
+func TestSeqSet(t *testing.T) {
+	var testTable = []struct {
+		set     string
+		largest uint32
+		member  []uint32
+		other   []uint32
+	}{
+		{"1", 5, []uint32{1}, []uint32{2}},
+		{"2:4", 5, []uint32{2, 3, 4}, []uint32{1, 5}},
+		{"4:2", 5, []uint32{2, 3, 4}, []uint32{1, 5}},
+		{"3:*", 5, []uint32{3, 5}, []uint32{2, 6}},
+		{"*", 5, []uint32{5}, []uint32{4}},
+		{"1,3,5:6", 9, []uint32{1, 3, 5, 6}, []uint32{2, 4, 7}},
+		// A range beyond the largest includes the largest
+		{"7:*", 5, []uint32{5, 6, 7}, []uint32{4}},
+	}
+	for _, tt := range testTable {
+		set, err := parseSeqSet(tt.set)
+		if !assert.NoError(t, err, "parseSeqSet(%q)", tt.set) {
+			continue
+		}
+		for _, n := range tt.member {
+			assert.True(t, set.contains(n, tt.largest), "%v should contain %v", tt.set, n)
+		}
+		for _, n := range tt.other {
+			assert.False(t, set.contains(n, tt.largest), "%v should not contain %v", tt.set, n)
+		}
+	}
+
+	for _, input := range []string{"", "0", "1:", "a", "1:b"} {
+		_, err := parseSeqSet(input)
+		assert.Error(t, err, "parseSeqSet(%q) should fail", input)
+	}
+}
+
+func TestListMatch(t *testing.T) {
+	assert.True(t, listMatch("*", "INBOX"))
+	assert.True(t, listMatch("%", "INBOX"))
+	assert.True(t, listMatch("INBOX", "INBOX"))
+	assert.True(t, listMatch("IN*", "INBOX"))
+	assert.True(t, listMatch("I%X", "INBOX"))
+	assert.False(t, listMatch("OUTBOX", "INBOX"))
+	assert.False(t, listMatch("INBOX/*", "INBOX"))
+	assert.False(t, listMatch("%", "INBOX/SUB"))
+	assert.True(t, listMatch("*", "INBOX/SUB"))
+}
+
+func TestHeaderFields(t *testing.T) {
+	header := "From: a@b\r\nSubject: long\r\n subject\r\nTo: c@d\r\n\r\n"
+	assert.Equal(t, "Subject: long\r\n subject\r\nTo: c@d\r\n\r\n",
+		headerFields(header, []string{"SUBJECT", "to"}, false))
+	assert.Equal(t, "From: a@b\r\n\r\n", headerFields(header, []string{"SUBJECT", "to"}, true))
+
+	h, text := splitMessage(header + "Body\r\n")
+	assert.Equal(t, header, h)
+	assert.Equal(t, "Body\r\n", text)
+}
+
+func TestEnvelope(t *testing.T) {
+	header := "Date: Mon, 2 Jan 2017 15:04:05 -0700\r\n" +
+		"Subject: Hello \"there\"\r\n" +
+		"From: Fred Flintstone <fred@example.com>\r\n" +
+		"To: wilma@example.com, barney@example.com\r\n" +
+		"Message-ID: <1@example.com>\r\n\r\n"
+	assert.Equal(t, `("Mon, 2 Jan 2017 15:04:05 -0700" "Hello \"there\"" `+
+		`(("Fred Flintstone" NIL "fred" "example.com")) `+
+		`(("Fred Flintstone" NIL "fred" "example.com")) `+
+		`(("Fred Flintstone" NIL "fred" "example.com")) `+
+		`((NIL NIL "wilma" "example.com")(NIL NIL "barney" "example.com")) `+
+		`NIL NIL NIL "<1@example.com>")`, envelope(header))
+}
+
+func TestParseFetchItems(t *testing.T) {
+	items, err := parseFetchItems("FAST")
+	assert.NoError(t, err)
+	assert.Equal(t, []fetchItem{{name: "FLAGS"}, {name: "INTERNALDATE"}, {name: "RFC822.SIZE"}},
+		items)
+
+	items, err = parseFetchItems("(UID BODY.PEEK[HEADER.FIELDS (From To)]<10.20>)")
+	assert.NoError(t, err)
+	assert.Equal(t, []fetchItem{
+		{name: "UID"},
+		{name: "BODY", section: "HEADER.FIELDS", fields: []string{"FROM", "TO"}, peek: true,
+			partial: true, start: 10, count: 20},
+	}, items)
+
+	raw := "Subject: x\r\n\r\n0123456789"
+	item, _ := parseFetchItem("BODY[TEXT]<2.3>")
+	assert.Equal(t, "BODY[TEXT]<2> {3}\r\n234", bodySection(raw, item))
+
+	for _, input := range []string{"BODYSTRUCTURE", "BODY[1.MIME]", "BODY[]<1>", "(FLAGS"} {
+		_, err := parseFetchItems(input)
+		assert.Error(t, err, "parseFetchItems(%q) should fail", input)
+	}
+}
+
+func TestParseSearchDate(t *testing.T) {
+	date, err := parseSearchDate("1-Feb-1994")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(1994, time.February, 1, 0, 0, 0, 0, time.UTC), date)
+
+	date, err = parseSearchDate("21-Nov-2017")
+	assert.NoError(t, err)
+	assert.Equal(t, date, messageDay(time.Date(2017, time.November, 21, 23, 59, 0, 0,
+		time.FixedZone("PST", -8*60*60))))
+
+	for _, input := range []string{"", "1994-02-01", "1-February-1994", "32-Jan-2017"} {
+		_, err := parseSearchDate(input)
+		assert.Error(t, err, "parseSearchDate(%q) should fail", input)
+	}
+}
@@ -0,0 +1,287 @@
+package imapd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// searchFunc returns true if message i of the session matches a search key
+type searchFunc func(ses *Session, i int) bool
+
+// flagKeys are the search keys matching messages with, or without, a flag
+var flagKeys = map[string]struct {
+	flag string
+	set  bool
+}{
+	"ANSWERED":   {`\Answered`, true},
+	"DELETED":    {`\Deleted`, true},
+	"DRAFT":      {`\Draft`, true},
+	"FLAGGED":    {`\Flagged`, true},
+	"SEEN":       {`\Seen`, true},
+	"UNANSWERED": {`\Answered`, false},
+	"UNDELETED":  {`\Deleted`, false},
+	"UNDRAFT":    {`\Draft`, false},
+	"UNFLAGGED":  {`\Flagged`, false},
+	"UNSEEN":     {`\Seen`, false},
+	"NEW":        {`\Seen`, false},
+}
+
+// searchHandler lists the messages matching all of the search keys
+func (ses *Session) searchHandler(tag string, args []string, uid bool) {
+	if len(args) >= 2 && strings.EqualFold(args[0], "CHARSET") {
+		if !strings.EqualFold(args[1], "US-ASCII") && !strings.EqualFold(args[1], "UTF-8") {
+			ses.send(tag + " NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+			return
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		ses.send(tag + " BAD SEARCH requires search keys")
+		return
+	}
+	var keys []searchFunc
+	for len(args) > 0 {
+		key, rest, err := parseSearchKey(args)
+		if err != nil {
+			ses.send(fmt.Sprintf("%v BAD %v", tag, err))
+			return
+		}
+		keys = append(keys, key)
+		args = rest
+	}
+	var found []string
+	for i := range ses.messages {
+		if matchAll(ses, i, keys) {
+			if uid {
+				found = append(found, fmt.Sprint(ses.uids[i]))
+			} else {
+				found = append(found, fmt.Sprint(i+1))
+			}
+		}
+	}
+	if len(found) == 0 {
+		ses.send("* SEARCH")
+	} else {
+		ses.send("* SEARCH " + strings.Join(found, " "))
+	}
+	ses.send(tag + " OK SEARCH completed")
+}
+
+// matchAll returns true if message i matches every key
+func matchAll(ses *Session, i int, keys []searchFunc) bool {
+	for _, key := range keys {
+		if !key(ses, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSearchKey parses the first search key in args, returning the remaining arguments
+func parseSearchKey(args []string) (searchFunc, []string, error) {
+	token, name := args[0], strings.ToUpper(args[0])
+	args = args[1:]
+	if f, ok := flagKeys[name]; ok {
+		return func(ses *Session, i int) bool {
+			return smtpd.HasFlag(ses.messages[i], f.flag) == f.set
+		}, args, nil
+	}
+	switch name {
+	case "ALL", "OLD":
+		return func(*Session, int) bool { return true }, args, nil
+	case "RECENT":
+		return func(*Session, int) bool { return false }, args, nil
+	case "KEYWORD", "UNKEYWORD":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("%v requires a flag", name)
+		}
+		flag, set := canonicalFlag(args[0]), name == "KEYWORD"
+		return func(ses *Session, i int) bool {
+			return smtpd.HasFlag(ses.messages[i], flag) == set
+		}, args[1:], nil
+	case "FROM", "TO", "SUBJECT":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("%v requires a string", name)
+		}
+		want := strings.ToLower(args[0])
+		return func(ses *Session, i int) bool {
+			return strings.Contains(strings.ToLower(searchText(ses.messages[i], name)), want)
+		}, args[1:], nil
+	case "CC", "BCC":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("%v requires a string", name)
+		}
+		return headerKey(name, args[0]), args[1:], nil
+	case "HEADER":
+		if len(args) < 2 {
+			return nil, nil, fmt.Errorf("HEADER requires a field name and a string")
+		}
+		return headerKey(args[0], args[1]), args[2:], nil
+	case "BODY", "TEXT":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("%v requires a string", name)
+		}
+		want := strings.ToLower(args[0])
+		return func(ses *Session, i int) bool {
+			raw, err := ses.messages[i].ReadRaw()
+			if err != nil {
+				ses.logWarn("Failed to read %v: %v", ses.messages[i], err)
+				return false
+			}
+			text := *raw
+			if name == "BODY" {
+				_, text = splitMessage(text)
+			}
+			return strings.Contains(strings.ToLower(text), want)
+		}, args[1:], nil
+	case "SINCE", "BEFORE", "ON":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("%v requires a date", name)
+		}
+		date, err := parseSearchDate(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(ses *Session, i int) bool {
+			day := messageDay(ses.messages[i].Date())
+			switch name {
+			case "SINCE":
+				return !day.Before(date)
+			case "BEFORE":
+				return day.Before(date)
+			}
+			return day.Equal(date)
+		}, args[1:], nil
+	case "LARGER", "SMALLER":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("%v requires a size", name)
+		}
+		size, err := parseNumber(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		larger := name == "LARGER"
+		return func(ses *Session, i int) bool {
+			if larger {
+				return ses.messages[i].Size() > size
+			}
+			return ses.messages[i].Size() < size
+		}, args[1:], nil
+	case "UID":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("UID requires a sequence set")
+		}
+		set, err := parseSeqSet(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(ses *Session, i int) bool {
+			return ses.inSet(set, i, true)
+		}, args[1:], nil
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("NOT requires a search key")
+		}
+		key, rest, err := parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(ses *Session, i int) bool { return !key(ses, i) }, rest, nil
+	case "OR":
+		if len(args) < 2 {
+			return nil, nil, fmt.Errorf("OR requires two search keys")
+		}
+		key1, rest, err := parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, fmt.Errorf("OR requires two search keys")
+		}
+		key2, rest, err := parseSearchKey(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(ses *Session, i int) bool { return key1(ses, i) || key2(ses, i) }, rest, nil
+	}
+	if isList(token) {
+		members, err := parseList(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		var keys []searchFunc
+		for len(members) > 0 {
+			var key searchFunc
+			if key, members, err = parseSearchKey(members); err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, key)
+		}
+		return func(ses *Session, i int) bool { return matchAll(ses, i, keys) }, args, nil
+	}
+	if set, err := parseSeqSet(name); err == nil {
+		return func(ses *Session, i int) bool {
+			return ses.inSet(set, i, false)
+		}, args, nil
+	}
+	return nil, nil, fmt.Errorf("Unsupported search key %v", name)
+}
+
+// headerKey returns a searchFunc matching messages with a header field containing want, an
+// empty want matches any message with the field
+func headerKey(field, want string) searchFunc {
+	want = strings.ToLower(want)
+	return func(ses *Session, i int) bool {
+		raw, err := ses.messages[i].ReadRaw()
+		if err != nil {
+			ses.logWarn("Failed to read %v: %v", ses.messages[i], err)
+			return false
+		}
+		header, _ := splitMessage(*raw)
+		fields := headerFields(header, []string{field}, false)
+		if fields == "\r\n" {
+			// No such field
+			return false
+		}
+		for _, line := range strings.Split(fields, "\n") {
+			if colon := strings.Index(line, ":"); colon >= 0 {
+				// The first line of a field, compare only its value
+				line = line[colon+1:]
+			}
+			if strings.Contains(strings.ToLower(line), want) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// parseSearchDate parses an RFC 3501 date such as 1-Feb-1994
+func parseSearchDate(s string) (time.Time, error) {
+	date, err := time.Parse("2-Jan-2006", s)
+	if err != nil {
+		return date, fmt.Errorf("Invalid date %q", s)
+	}
+	return date, nil
+}
+
+// messageDay returns the date a message was received, without its time and zone, for
+// comparison with search dates
+func messageDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// searchText returns the text searched by the FROM, TO and SUBJECT keys
+func searchText(msg smtpd.Message, key string) string {
+	switch key {
+	case "FROM":
+		return msg.From()
+	case "TO":
+		return strings.Join(msg.To(), ", ")
+	}
+	return msg.Subject()
+}
@@ -8,16 +8,19 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"time"
 
 	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/imapd"
 	"github.com/jhillyerd/inbucket/log"
 	"github.com/jhillyerd/inbucket/msghub"
 	"github.com/jhillyerd/inbucket/pop3d"
 	"github.com/jhillyerd/inbucket/rest"
+	"github.com/jhillyerd/inbucket/search"
 	"github.com/jhillyerd/inbucket/smtpd"
 	"github.com/jhillyerd/inbucket/webui"
 )
@@ -40,6 +43,7 @@ var (
 	// Server instances
 	smtpServer *smtpd.Server
 	pop3Server *pop3d.Server
+	imapServer *imapd.Server
 )
 
 func init() {
@@ -85,7 +89,7 @@ func main() {
 	}
 
 	// Setup signal handler
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 
 	// Initialize logging
@@ -111,13 +115,32 @@ func main() {
 		}
 	}
 
+	// Mailbox names are parsed throughout, so this must precede server startup
+	smtpd.SetSubAddressSeparator(config.GetSMTPConfig().SubAddressSep)
+	smtpd.SetMailboxNaming(config.GetDataStoreConfig().MailboxNaming)
+	smtpd.SetMailboxCaseFolding(config.GetDataStoreConfig().MailboxCaseFold)
+	smtpd.SetPrivateMailboxes(config.GetDataStoreConfig().PrivateMailboxes)
+
 	// Create message hub
 	msgHub := msghub.New(rootCtx, config.GetWebConfig().MonitorHistory)
 
 	// Grab our datastore
 	ds := smtpd.DefaultFileDataStore()
 
+	// Open the search index, it must be in place before messages are delivered or deleted
+	if dsConfig := config.GetDataStoreConfig(); dsConfig.SearchIndex {
+		index, err := search.Open(filepath.Join(dsConfig.Path, "search.index"))
+		if err != nil {
+			log.Errorf("Failed to open search index: %v", err)
+			os.Exit(1)
+		}
+		search.NewIndexer(rootCtx, index, ds, msgHub)
+		rest.SetSearchIndex(index)
+	}
+
 	// Start HTTP server
+	smtpd.AddDeleteHook(rest.NotifyDelete)
+	rest.StartWebhooks(rootCtx, msgHub)
 	httpd.Initialize(config.GetWebConfig(), shutdownChan, ds, msgHub)
 	webui.SetupRoutes(httpd.Router)
 	rest.SetupRoutes(httpd.Router)
@@ -128,6 +151,12 @@ func main() {
 	pop3Server = pop3d.New(shutdownChan)
 	go pop3Server.Start(rootCtx)
 
+	// Start IMAP server
+	if imapConfig := config.GetIMAPConfig(); imapConfig.Enabled {
+		imapServer = imapd.New(imapConfig, shutdownChan, ds, msgHub)
+		go imapServer.Start(rootCtx)
+	}
+
 	// Startup SMTP server
 	smtpServer = smtpd.NewServer(config.GetSMTPConfig(), shutdownChan, ds, msgHub)
 	go smtpServer.Start(rootCtx)
@@ -160,6 +189,9 @@ signalLoop:
 	go timedExit()
 	smtpServer.Drain()
 	pop3Server.Drain()
+	if imapServer != nil {
+		imapServer.Drain()
+	}
 
 	removePIDFile()
 }
@@ -0,0 +1,367 @@
+package mailauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1" // Registers the hashes used by signatures
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMStatus is the outcome of verifying a single RFC 6376 DKIM signature
+type DKIMStatus string
+
+// DKIM statuses
+const (
+	DKIMPass      DKIMStatus = "pass"
+	DKIMFail      DKIMStatus = "fail"
+	DKIMTempError DKIMStatus = "temperror"
+	DKIMPermError DKIMStatus = "permerror"
+)
+
+// dkimMaxSignatures limits the signatures verified on a single message
+const dkimMaxSignatures = 5
+
+// DKIMResult describes the verification of one DKIM-Signature header
+type DKIMResult struct {
+	Domain   string     // Signing domain, the d= tag
+	Selector string     // Key selector, the s= tag
+	Result   DKIMStatus // Outcome of verification
+	Reason   string     // Explanation of a failure, empty on success
+}
+
+// dkimTagRegex matches the b= tag of a signature, so its value can be removed
+var dkimTagRegex = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// dkimHeader is a single header field of a message, raw includes folding and the final CRLF
+type dkimHeader struct {
+	name string
+	raw  string
+}
+
+// VerifyDKIM verifies each DKIM signature on the raw message, looking up public keys with r.
+// Returns nil if the message was not signed.
+func VerifyDKIM(r Resolver, raw []byte) []DKIMResult {
+	headers, body := splitMessage(raw)
+	var results []DKIMResult
+	for i, h := range headers {
+		if strings.ToLower(h.name) != "dkim-signature" {
+			continue
+		}
+		if len(results) == dkimMaxSignatures {
+			break
+		}
+		results = append(results, verifySignature(r, headers, i, body, time.Now()))
+	}
+	return results
+}
+
+// verifySignature verifies the signature in headers[sigIdx]
+func verifySignature(r Resolver, headers []dkimHeader, sigIdx int, body []byte,
+	now time.Time) DKIMResult {
+	sig := headers[sigIdx]
+	tags, err := parseTags(headerValue(sig.raw))
+	result := DKIMResult{Domain: tags["d"], Selector: tags["s"]}
+	fail := func(status DKIMStatus, format string, args ...interface{}) DKIMResult {
+		result.Result = status
+		result.Reason = fmt.Sprintf(format, args...)
+		return result
+	}
+	if err != nil {
+		return fail(DKIMPermError, "%v", err)
+	}
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[tag]; !ok {
+			return fail(DKIMPermError, "missing required tag %v=", tag)
+		}
+	}
+	if tags["v"] != "1" {
+		return fail(DKIMPermError, "unsupported version %q", tags["v"])
+	}
+	var hash crypto.Hash
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		hash = crypto.SHA256
+	case "rsa-sha1":
+		hash = crypto.SHA1
+	default:
+		return fail(DKIMPermError, "unsupported algorithm %q", tags["a"])
+	}
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") ||
+		(bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return fail(DKIMPermError, "unsupported canonicalization %q", tags["c"])
+	}
+	signed := strings.Split(removeWSP(tags["h"]), ":")
+	hasFrom := false
+	for _, name := range signed {
+		if strings.ToLower(name) == "from" {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		return fail(DKIMPermError, "From header not signed")
+	}
+	if auid, ok := tags["i"]; ok {
+		domain := strings.ToLower(auid[strings.LastIndex(auid, "@")+1:])
+		d := strings.ToLower(tags["d"])
+		if domain != d && !strings.HasSuffix(domain, "."+d) {
+			return fail(DKIMPermError, "i= domain does not match d=")
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail(DKIMPermError, "invalid x= tag")
+		}
+		if now.Unix() > expires {
+			return fail(DKIMFail, "signature expired")
+		}
+	}
+
+	// Body hash
+	canonBody := canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 {
+			return fail(DKIMPermError, "invalid l= tag")
+		}
+		if length > int64(len(canonBody)) {
+			return fail(DKIMFail, "body shorter than l= tag")
+		}
+		canonBody = canonBody[:length]
+	}
+	h := hash.New()
+	_, _ = h.Write(canonBody)
+	bodyHash, err := base64.StdEncoding.DecodeString(removeWSP(tags["bh"]))
+	if err != nil {
+		return fail(DKIMPermError, "invalid bh= tag")
+	}
+	if !bytes.Equal(h.Sum(nil), bodyHash) {
+		return fail(DKIMFail, "body hash did not verify")
+	}
+
+	// Public key
+	key, status, err := lookupDKIMKey(r, tags["s"], tags["d"])
+	if err != nil {
+		return fail(status, "%v", err)
+	}
+
+	// Header hash, each signed name selects the next unused instance from the bottom up
+	h = hash.New()
+	used := make(map[int]bool)
+	for _, name := range signed {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headers[i].name, name) {
+				used[i] = true
+				_, _ = h.Write([]byte(canonicalHeader(headers[i], headerCanon)))
+				break
+			}
+		}
+	}
+	idx := strings.IndexByte(sig.raw, ':')
+	stripped := dkimHeader{
+		name: sig.name,
+		raw:  sig.raw[:idx+1] + dkimTagRegex.ReplaceAllString(sig.raw[idx+1:], "$1$2"),
+	}
+	_, _ = h.Write([]byte(strings.TrimSuffix(canonicalHeader(stripped, headerCanon), "\r\n")))
+	signature, err := base64.StdEncoding.DecodeString(removeWSP(tags["b"]))
+	if err != nil {
+		return fail(DKIMPermError, "invalid b= tag")
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+		return fail(DKIMFail, "signature did not verify")
+	}
+	result.Result = DKIMPass
+	return result
+}
+
+// lookupDKIMKey fetches the public key for the selector and domain
+func lookupDKIMKey(r Resolver, selector, domain string) (*rsa.PublicKey, DKIMStatus, error) {
+	txts, err := r.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, DKIMTempError, fmt.Errorf("key lookup failed: %v", err)
+	}
+	if len(txts) == 0 {
+		return nil, DKIMPermError, fmt.Errorf("no key for signature")
+	}
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, DKIMPermError, fmt.Errorf("invalid key record: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, DKIMPermError, fmt.Errorf("unsupported key version %q", v)
+	}
+	if k, ok := tags["k"]; ok && strings.ToLower(k) != "rsa" {
+		return nil, DKIMPermError, fmt.Errorf("unsupported key type %q", k)
+	}
+	p := removeWSP(tags["p"])
+	if p == "" {
+		return nil, DKIMPermError, fmt.Errorf("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, DKIMPermError, fmt.Errorf("invalid key encoding")
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, DKIMPermError, fmt.Errorf("invalid key: %v", err)
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, DKIMPermError, fmt.Errorf("key is not RSA")
+	}
+	return key, "", nil
+}
+
+// splitMessage normalizes line endings to CRLF, and splits the message into its header
+// fields and body
+func splitMessage(raw []byte) ([]dkimHeader, []byte) {
+	raw = bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+	raw = bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1)
+	var headers []dkimHeader
+	for len(raw) > 0 {
+		if bytes.HasPrefix(raw, []byte("\r\n")) {
+			return headers, raw[2:]
+		}
+		// Find the end of this field, including continuation lines
+		end := 0
+		for {
+			idx := bytes.Index(raw[end:], []byte("\r\n"))
+			if idx < 0 {
+				end = len(raw)
+				break
+			}
+			end += idx + 2
+			if end >= len(raw) || (raw[end] != ' ' && raw[end] != '\t') {
+				break
+			}
+		}
+		field := string(raw[:end])
+		raw = raw[end:]
+		colon := strings.IndexByte(field, ':')
+		if colon < 0 {
+			// Not a header field, treat the remainder as body
+			return headers, []byte(field + string(raw))
+		}
+		headers = append(headers, dkimHeader{name: strings.TrimRight(field[:colon], " \t"),
+			raw: field})
+	}
+	return headers, nil
+}
+
+// headerValue returns the value of a raw header field, unfolded
+func headerValue(raw string) string {
+	value := raw[strings.IndexByte(raw, ':')+1:]
+	return strings.Replace(value, "\r\n", "", -1)
+}
+
+// canonicalHeader applies the simple or relaxed header canonicalization algorithm
+func canonicalHeader(h dkimHeader, canon string) string {
+	if canon == "simple" {
+		if !strings.HasSuffix(h.raw, "\r\n") {
+			return h.raw + "\r\n"
+		}
+		return h.raw
+	}
+	value := compressWSP(headerValue(h.raw))
+	return strings.ToLower(strings.TrimSpace(h.name)) + ":" + strings.Trim(value, " ") + "\r\n"
+}
+
+// canonicalBody applies the simple or relaxed body canonicalization algorithm
+func canonicalBody(body []byte, canon string) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+	buf := new(bytes.Buffer)
+	blank := 0
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		crlf := strings.HasSuffix(line, "\r\n")
+		line = strings.TrimSuffix(line, "\r\n")
+		if canon == "relaxed" {
+			line = strings.TrimRight(compressWSP(line), " ")
+		}
+		if line == "" && crlf {
+			// Defer empty lines, those at the end of the body are removed
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	if buf.Len() == 0 && canon == "simple" {
+		return []byte("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// compressWSP reduces each run of whitespace to a single space
+func compressWSP(s string) string {
+	b := make([]byte, 0, len(s))
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b = append(b, ' ')
+			space = false
+		}
+		b = append(b, s[i])
+	}
+	if space {
+		b = append(b, ' ')
+	}
+	return string(b)
+}
+
+// removeWSP removes all whitespace from s
+func removeWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// parseTags parses an RFC 6376 tag=value list
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		idx := strings.IndexByte(spec, '=')
+		if idx < 1 {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:idx])
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %v=", name)
+		}
+		tags[name] = strings.TrimSpace(spec[idx+1:])
+	}
+	return tags, nil
+}
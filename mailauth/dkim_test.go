@@ -0,0 +1,106 @@
+package mailauth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Public key for the test vectors below, which were signed by an independent implementation
+const dkimTestKey = "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCw084/7vxnl8O1I/MNnr" +
+	"PmFx1KNv70TRgxQhR0Ut4XVqmEcfUsr04f80mYrsqC6VDGJ+GvtpexqAnmYqgzXYeWGksKJ0FhcKKrFbXf9rXUPY" +
+	"F0j4mHlvNwcBQFRjnRjFGRcAH65Wamo3jl4BN558yZ0dKd8KAm7leeBP4aJzquqwIDAQAB"
+
+const dkimTestHeaders = "From: Joe  SixPack <joe@example.com>\r\n" +
+	"To: Suzie Q <suzie@example.org>\r\n" +
+	"Subject:  Is dinner\r\n\tready?  \r\n" +
+	"Received: from elsewhere\r\n" +
+	"\r\n"
+
+const dkimTestBody = "Hi.\r\n\r\nWe lost  the game. \t Are you hungry yet?\r\n\r\nJoe.\r\n\r\n\r\n"
+
+var dkimRelaxed = "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=test;\r\n" +
+	"\th=From : Subject:To; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=kcow4oqrXUlXD5kb1/yTyVJvsP7YzwOmUob7ef/zRQWw/I1zwgqMSpThULv0P4a9\r\n" +
+	"\t x2NdYhCz6+qtHMo/KRrvxIYPWGHHuNAoqP41xaHluMV/snl1rtIoaDHecpi9GqUq\r\n" +
+	"\t xW8FZmN8EQnNU0R/K9EyiofaeZHO825L83PSd7qIw6I=\r\n" +
+	dkimTestHeaders + dkimTestBody
+
+var dkimSimple = "DKIM-Signature: v=1; a=rsa-sha256; c=simple/simple; d=example.com; s=test;\r\n" +
+	"\th=From : Subject:To; bh=qPYfWViUVO7ne7RKgzrINWHmEQPanVcHXELerxP3/HQ=;\r\n" +
+	"\tb=r42mI74Z6ZdsKrd4q3CZckCuwbaftdtWziktdI0Im1E6HV9gYPIAfhAbpZzIpTka\r\n" +
+	"\t 5mMZVFQyCRc3g7u6sAdiu2lho9X3NGoYggs1NLoXYlKEq+tOEos8NiZKxcVFCRcS\r\n" +
+	"\t MyJO9PqbTBgMtgdj89x/d2oFGRmWJdim6NTGWrFno6A=\r\n" +
+	dkimTestHeaders + dkimTestBody
+
+func TestVerifyDKIM(t *testing.T) {
+	r := NewStaticResolver(nil)
+	assert.Nil(t, r.Add("test._domainkey.example.com", "TXT", dkimTestKey))
+	revoked := NewStaticResolver(nil)
+	assert.Nil(t, revoked.Add("test._domainkey.example.com", "TXT", "v=DKIM1; p="))
+
+	var table = []struct {
+		name     string
+		resolver Resolver
+		msg      string
+		expect   DKIMStatus
+	}{
+		{"relaxed", r, dkimRelaxed, DKIMPass},
+		{"simple", r, dkimSimple, DKIMPass},
+		{"relaxed LF", r, strings.Replace(dkimRelaxed, "\r\n", "\n", -1), DKIMPass},
+		{"relaxed whitespace", r, strings.Replace(dkimRelaxed, "lost  the", "lost the", 1),
+			DKIMPass},
+		{"simple whitespace", r, strings.Replace(dkimSimple, "lost  the", "lost the", 1),
+			DKIMFail},
+		{"body changed", r, strings.Replace(dkimRelaxed, "hungry", "thirsty", 1), DKIMFail},
+		{"header changed", r, strings.Replace(dkimRelaxed, "dinner", "lunch", 1), DKIMFail},
+		{"unsigned header", r, strings.Replace(dkimRelaxed, "elsewhere", "somewhere", 1),
+			DKIMPass},
+		{"no key", NewStaticResolver(nil), dkimRelaxed, DKIMPermError},
+		{"revoked key", revoked, dkimRelaxed, DKIMPermError},
+		{"bad algorithm", r, strings.Replace(dkimRelaxed, "rsa-sha256", "rsa-md5", 1),
+			DKIMPermError},
+		{"missing tag", r, strings.Replace(dkimRelaxed, " s=test;", "", 1), DKIMPermError},
+	}
+	for _, tt := range table {
+		results := VerifyDKIM(tt.resolver, []byte(tt.msg))
+		if len(results) != 1 {
+			t.Errorf("%v: expected 1 result, got %v", tt.name, len(results))
+			continue
+		}
+		if results[0].Result != tt.expect {
+			t.Errorf("%v: expected %v, got %v (%v)", tt.name, tt.expect, results[0].Result,
+				results[0].Reason)
+		}
+	}
+
+	results := VerifyDKIM(r, []byte(dkimRelaxed))
+	assert.Equal(t, []DKIMResult{{Domain: "example.com", Selector: "test", Result: DKIMPass}},
+		results)
+	assert.Nil(t, VerifyDKIM(r, []byte(dkimTestHeaders+dkimTestBody)), "unsigned message")
+}
+
+func TestDKIMExpiry(t *testing.T) {
+	headers, body := splitMessage([]byte(strings.Replace(dkimRelaxed, "s=test;",
+		"s=test; x=1000;", 1)))
+	r := NewStaticResolver(nil)
+	result := verifySignature(r, headers, 0, body, time.Unix(1001, 0))
+	assert.Equal(t, DKIMFail, result.Result)
+}
+
+func TestCanonicalBody(t *testing.T) {
+	var table = []struct {
+		body, simple, relaxed string
+	}{
+		{"", "\r\n", ""},
+		{"\r\n\r\n", "\r\n", ""},
+		{"text", "text\r\n", "text\r\n"},
+		{" a \t b \r\n\r\n \r\n", " a \t b \r\n\r\n \r\n", " a b\r\n"},
+	}
+	for _, tt := range table {
+		assert.Equal(t, tt.simple, string(canonicalBody([]byte(tt.body), "simple")), tt.body)
+		assert.Equal(t, tt.relaxed, string(canonicalBody([]byte(tt.body), "relaxed")), tt.body)
+	}
+}
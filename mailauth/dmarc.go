@@ -0,0 +1,143 @@
+package mailauth
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// DMARCStatus is the outcome of an RFC 7489 DMARC evaluation
+type DMARCStatus string
+
+// DMARC statuses
+const (
+	DMARCNone      DMARCStatus = "none"
+	DMARCPass      DMARCStatus = "pass"
+	DMARCFail      DMARCStatus = "fail"
+	DMARCTempError DMARCStatus = "temperror"
+	DMARCPermError DMARCStatus = "permerror"
+)
+
+// DMARCResult describes the DMARC verdict for a message
+type DMARCResult struct {
+	Result DMARCStatus
+	Domain string // Domain of the From header
+	Policy string // Policy the domain requests for failing messages: none, quarantine or reject
+}
+
+// CheckDMARC evaluates the DMARC policy of fromDomain, the domain of the message's From
+// header, against the SPF result for spfDomain and the DKIM results for the message.
+func CheckDMARC(r Resolver, fromDomain string, spf SPFResult, spfDomain string,
+	dkim []DKIMResult) DMARCResult {
+	result := DMARCResult{Result: DMARCNone, Domain: strings.ToLower(fromDomain)}
+	if result.Domain == "" {
+		return result
+	}
+	tags, subdomain, err := lookupDMARC(r, result.Domain)
+	if err != nil {
+		result.Result = DMARCTempError
+		return result
+	}
+	if tags == nil {
+		return result
+	}
+	result.Policy = strings.ToLower(tags["p"])
+	if sp, ok := tags["sp"]; ok && subdomain {
+		result.Policy = strings.ToLower(sp)
+	}
+	switch result.Policy {
+	case "none", "quarantine", "reject":
+	default:
+		result.Result = DMARCPermError
+		return result
+	}
+
+	strictSPF := strings.ToLower(tags["aspf"]) == "s"
+	strictDKIM := strings.ToLower(tags["adkim"]) == "s"
+	result.Result = DMARCFail
+	if spf == SPFPass && aligned(result.Domain, spfDomain, strictSPF) {
+		result.Result = DMARCPass
+	}
+	for _, d := range dkim {
+		if d.Result == DKIMPass && aligned(result.Domain, d.Domain, strictDKIM) {
+			result.Result = DMARCPass
+		}
+	}
+	return result
+}
+
+// lookupDMARC finds the DMARC record for domain, falling back to its organizational domain.
+// subdomain is true if the record found belongs to the organizational domain.  A nil map is
+// returned if there is no record.
+func lookupDMARC(r Resolver, domain string) (tags map[string]string, subdomain bool,
+	err error) {
+	tags, err = dmarcRecord(r, domain)
+	if err != nil || tags != nil {
+		return tags, false, err
+	}
+	if org := organizationalDomain(domain); org != domain {
+		tags, err = dmarcRecord(r, org)
+		return tags, tags != nil, err
+	}
+	return nil, false, nil
+}
+
+// dmarcRecord returns the tags of the single DMARC record published for domain, or nil
+func dmarcRecord(r Resolver, domain string) (map[string]string, error) {
+	txts, err := r.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		return nil, err
+	}
+	var record string
+	records := 0
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			record = txt
+			records++
+		}
+	}
+	if records != 1 {
+		// Multiple records are treated as none at all
+		return nil, nil
+	}
+	tags, err := parseTags(record)
+	if err != nil || tags["v"] != "DMARC1" {
+		return nil, nil
+	}
+	return tags, nil
+}
+
+// aligned returns true if domain aligns with the From domain.  Relaxed alignment only
+// requires the organizational domains to match.
+func aligned(from, domain string, strict bool) bool {
+	domain = strings.ToLower(domain)
+	if strict {
+		return from == domain
+	}
+	return organizationalDomain(from) == organizationalDomain(domain)
+}
+
+// organizationalDomain approximates the registered domain as the last two labels, it does not
+// consult the public suffix list
+func organizationalDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// HeaderFromDomain returns the domain of the address in the From header of raw, or an empty
+// string if there is not exactly one valid address
+func HeaderFromDomain(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	addrs, err := msg.Header.AddressList("From")
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	addr := addrs[0].Address
+	return strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+}
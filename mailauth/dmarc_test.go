@@ -0,0 +1,62 @@
+package mailauth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	r := &testResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+			"_dmarc.strict.test": {"v=DMARC1; p=quarantine; aspf=s; adkim=s"},
+			"_dmarc.bad.test":    {"v=DMARC1; p=bogus"},
+			"_dmarc.two.test":    {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+		},
+		fail: map[string]bool{"_dmarc.down.test": true},
+	}
+	pass := []DKIMResult{{Domain: "mail.example.com", Selector: "s", Result: DKIMPass}}
+	fail := []DKIMResult{{Domain: "example.com", Selector: "s", Result: DKIMFail}}
+
+	var table = []struct {
+		name, from string
+		spf        SPFResult
+		spfDomain  string
+		dkim       []DKIMResult
+		expect     DMARCResult
+	}{
+		{"spf aligned", "example.com", SPFPass, "bounce.example.com", nil,
+			DMARCResult{DMARCPass, "example.com", "reject"}},
+		{"dkim aligned", "example.com", SPFFail, "example.com", pass,
+			DMARCResult{DMARCPass, "example.com", "reject"}},
+		{"spf unaligned", "example.com", SPFPass, "example.net", fail,
+			DMARCResult{DMARCFail, "example.com", "reject"}},
+		{"subdomain policy", "news.example.com", SPFNone, "", nil,
+			DMARCResult{DMARCFail, "news.example.com", "quarantine"}},
+		{"strict spf", "strict.test", SPFPass, "mail.strict.test", nil,
+			DMARCResult{DMARCFail, "strict.test", "quarantine"}},
+		{"strict exact", "strict.test", SPFPass, "strict.test", nil,
+			DMARCResult{DMARCPass, "strict.test", "quarantine"}},
+		{"no record", "example.org", SPFPass, "example.org", nil,
+			DMARCResult{DMARCNone, "example.org", ""}},
+		{"multiple records", "two.test", SPFPass, "two.test", nil,
+			DMARCResult{DMARCNone, "two.test", ""}},
+		{"bad policy", "bad.test", SPFPass, "bad.test", nil,
+			DMARCResult{DMARCPermError, "bad.test", "bogus"}},
+		{"dns failure", "down.test", SPFPass, "down.test", nil,
+			DMARCResult{DMARCTempError, "down.test", ""}},
+		{"no from", "", SPFPass, "example.com", nil, DMARCResult{DMARCNone, "", ""}},
+	}
+	for _, tt := range table {
+		got := CheckDMARC(r, tt.from, tt.spf, tt.spfDomain, tt.dkim)
+		assert.Equal(t, tt.expect, got, tt.name)
+	}
+}
+
+func TestHeaderFromDomain(t *testing.T) {
+	assert.Equal(t, "example.com",
+		HeaderFromDomain([]byte("From: Joe <joe@Example.COM>\r\nTo: x@y.z\r\n\r\nBody")))
+	assert.Equal(t, "", HeaderFromDomain([]byte("To: x@y.z\r\n\r\nBody")))
+	assert.Equal(t, "", HeaderFromDomain([]byte("From: a@b.c, d@e.f\r\n\r\nBody")))
+}
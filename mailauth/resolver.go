@@ -0,0 +1,53 @@
+// Package mailauth implements the sender authentication checks performed on inbound mail.
+package mailauth
+
+import (
+	"net"
+)
+
+// Resolver performs the DNS lookups required by the authentication checks.  Records that do
+// not exist are reported as an empty result with a nil error, errors are reserved for
+// failures that may succeed if retried.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+}
+
+// DNSResolver is a Resolver using the system DNS configuration
+type DNSResolver struct{}
+
+// LookupTXT returns the TXT records for name
+func (DNSResolver) LookupTXT(name string) ([]string, error) {
+	txts, err := net.LookupTXT(name)
+	if notFound(err) {
+		return nil, nil
+	}
+	return txts, err
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host
+func (DNSResolver) LookupIP(host string) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if notFound(err) {
+		return nil, nil
+	}
+	return ips, err
+}
+
+// LookupMX returns the MX records for name
+func (DNSResolver) LookupMX(name string) ([]*net.MX, error) {
+	mxs, err := net.LookupMX(name)
+	if notFound(err) {
+		return nil, nil
+	}
+	return mxs, err
+}
+
+// notFound returns true if err indicates the requested records do not exist
+func notFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return !dnsErr.Temporary() && !dnsErr.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,475 @@
+package mailauth
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SPFResult is the outcome of an RFC 7208 SPF check
+type SPFResult string
+
+// SPF results
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+const (
+	// spfMaxLookups limits the DNS querying mechanisms and modifiers evaluated
+	spfMaxLookups = 10
+	// spfMaxVoidLookups limits the lookups returning no records
+	spfMaxVoidLookups = 2
+)
+
+// spfModifierRegex matches the name of a modifier term, such as redirect=
+var spfModifierRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*=`)
+
+// spfCheck holds the state of a single evaluation, including nested includes
+type spfCheck struct {
+	resolver    Resolver
+	ip          net.IP
+	helo        string
+	sender      string
+	lookups     int
+	voidLookups int
+}
+
+// spfError aborts evaluation with the specified result
+type spfError SPFResult
+
+func (e spfError) Error() string {
+	return string(e)
+}
+
+// CheckSPF determines whether the client at ip is authorized to send mail for the sender
+// address.  The domain given in HELO is checked instead when the sender is empty (a null
+// reverse-path).
+func CheckSPF(r Resolver, ip net.IP, helo, sender string) SPFResult {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	domain := sender
+	if idx := strings.LastIndex(sender, "@"); idx >= 0 {
+		domain = sender[idx+1:]
+		if idx == 0 {
+			sender = "postmaster" + sender
+		}
+	} else {
+		sender = "postmaster@" + sender
+	}
+	c := &spfCheck{resolver: r, ip: ip, helo: helo, sender: sender}
+	return c.checkHost(domain)
+}
+
+// checkHost implements the check_host() function of RFC 7208
+func (c *spfCheck) checkHost(domain string) SPFResult {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || !strings.Contains(domain, ".") || len(domain) > 253 {
+		return SPFNone
+	}
+	txts, err := c.resolver.LookupTXT(domain)
+	if err != nil {
+		return SPFTempError
+	}
+	var record string
+	records := 0
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			record = txt
+			records++
+		}
+	}
+	switch records {
+	case 0:
+		return SPFNone
+	case 1:
+	default:
+		return SPFPermError
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		if spfModifierRegex.MatchString(term) {
+			idx := strings.IndexByte(term, '=')
+			if strings.ToLower(term[:idx]) == "redirect" {
+				if redirect != "" {
+					return SPFPermError
+				}
+				redirect = term[idx+1:]
+			}
+			// Other modifiers, such as exp, do not affect the result
+			continue
+		}
+		result := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = SPFFail, term[1:]
+		case '~':
+			result, term = SPFSoftFail, term[1:]
+		case '?':
+			result, term = SPFNeutral, term[1:]
+		}
+		match, err := c.mechanism(term, domain)
+		if err != nil {
+			if e, ok := err.(spfError); ok {
+				return SPFResult(e)
+			}
+			return SPFPermError
+		}
+		if match {
+			return result
+		}
+	}
+	if redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return SPFPermError
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError
+		}
+		result := c.checkHost(target)
+		if result == SPFNone {
+			return SPFPermError
+		}
+		return result
+	}
+	return SPFNeutral
+}
+
+// mechanism evaluates a single mechanism term, without its qualifier
+func (c *spfCheck) mechanism(term, domain string) (bool, error) {
+	name, arg, cidr := term, "", ""
+	if idx := strings.IndexAny(term, ":/"); idx >= 0 {
+		name, arg = term[:idx], term[idx:]
+		if arg[0] == ':' {
+			arg = arg[1:]
+			if slash := strings.IndexByte(arg, '/'); slash >= 0 {
+				arg, cidr = arg[:slash], arg[slash:]
+			}
+		} else {
+			arg, cidr = "", arg
+		}
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "all":
+		return true, nil
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil || target == "" {
+			return false, spfError(SPFPermError)
+		}
+		switch c.checkHost(target) {
+		case SPFPass:
+			return true, nil
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, nil
+		case SPFTempError:
+			return false, spfError(SPFTempError)
+		}
+		return false, spfError(SPFPermError)
+	case "a":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.targetDomain(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		v4len, v6len, err := parseDualCIDR(cidr)
+		if err != nil {
+			return false, err
+		}
+		return c.hostMatches(target, v4len, v6len)
+	case "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.targetDomain(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		v4len, v6len, err := parseDualCIDR(cidr)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(target)
+		if err != nil {
+			return false, spfError(SPFTempError)
+		}
+		if err := c.countVoid(len(mxs)); err != nil {
+			return false, err
+		}
+		if len(mxs) > spfMaxLookups {
+			return false, spfError(SPFPermError)
+		}
+		for _, mx := range mxs {
+			match, err := c.hostMatches(strings.TrimSuffix(mx.Host, "."), v4len, v6len)
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		// Deprecated by RFC 7208 and expensive to evaluate; treated as never matching
+		return false, c.countLookup()
+	case "ip4", "ip6":
+		spec := arg + cidr
+		if !strings.Contains(spec, "/") {
+			if name == "ip4" {
+				spec += "/32"
+			} else {
+				spec += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return false, spfError(SPFPermError)
+		}
+		if (network.IP.To4() != nil) != (name == "ip4") {
+			return false, spfError(SPFPermError)
+		}
+		return network.Contains(c.ip), nil
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil || target == "" {
+			return false, spfError(SPFPermError)
+		}
+		ips, err := c.resolver.LookupIP(target)
+		if err != nil {
+			return false, spfError(SPFTempError)
+		}
+		if err := c.countVoid(len(ips)); err != nil {
+			return false, err
+		}
+		return len(ips) > 0, nil
+	}
+	return false, spfError(SPFPermError)
+}
+
+// hostMatches returns true if any address of host, masked to the prefix lengths, matches
+// the client address
+func (c *spfCheck) hostMatches(host string, v4len, v6len int) (bool, error) {
+	ips, err := c.resolver.LookupIP(host)
+	if err != nil {
+		return false, spfError(SPFTempError)
+	}
+	if err := c.countVoid(len(ips)); err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if ip4 := c.ip.To4(); ip4 != nil {
+			if cand := ip.To4(); cand != nil {
+				mask := net.CIDRMask(v4len, 32)
+				if ip4.Mask(mask).Equal(cand.Mask(mask)) {
+					return true, nil
+				}
+			}
+		} else if ip.To4() == nil {
+			mask := net.CIDRMask(v6len, 128)
+			if c.ip.Mask(mask).Equal(ip.Mask(mask)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// targetDomain returns the expanded domain-spec, or the current domain if none was given
+func (c *spfCheck) targetDomain(arg, domain string) (string, error) {
+	if arg == "" {
+		return domain, nil
+	}
+	target, err := c.expand(arg, domain)
+	if err != nil {
+		return "", spfError(SPFPermError)
+	}
+	return target, nil
+}
+
+// countLookup enforces the limit on terms that cause DNS queries
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfMaxLookups {
+		return spfError(SPFPermError)
+	}
+	return nil
+}
+
+// countVoid enforces the limit on DNS queries returning no records
+func (c *spfCheck) countVoid(records int) error {
+	if records > 0 {
+		return nil
+	}
+	c.voidLookups++
+	if c.voidLookups > spfMaxVoidLookups {
+		return spfError(SPFPermError)
+	}
+	return nil
+}
+
+// expand performs RFC 7208 macro expansion on a domain-spec
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	out := make([]byte, 0, len(spec))
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out = append(out, spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("Truncated macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out = append(out, '%')
+		case '_':
+			out = append(out, ' ')
+		case '-':
+			out = append(out, "%20"...)
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 2 {
+				return "", fmt.Errorf("Malformed macro in %q", spec)
+			}
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			out = append(out, value...)
+			i += end
+		default:
+			return "", fmt.Errorf("Invalid macro in %q", spec)
+		}
+	}
+	return string(out), nil
+}
+
+// macro expands the body of a single %{...} macro
+func (c *spfCheck) macro(body, domain string) (string, error) {
+	var value string
+	local, senderDomain := c.sender, domain
+	if idx := strings.LastIndex(c.sender, "@"); idx >= 0 {
+		local, senderDomain = c.sender[:idx], c.sender[idx+1:]
+	}
+	switch body[0] {
+	case 's', 'S':
+		value = c.sender
+	case 'l', 'L':
+		value = local
+	case 'o', 'O':
+		value = senderDomain
+	case 'd', 'D':
+		value = domain
+	case 'h', 'H':
+		value = c.helo
+	case 'i', 'I':
+		value = dottedIP(c.ip)
+	case 'v', 'V':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	default:
+		return "", fmt.Errorf("Unsupported macro letter %q", body[0])
+	}
+
+	// Transformers: optional digits, optional r, then delimiters
+	rest := body[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", fmt.Errorf("Invalid macro transformer %q", body)
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("Invalid macro delimiter %q", body)
+		}
+		delims = rest
+	}
+	if keep == 0 && !reverse && delims == "." {
+		return value, nil
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// dottedIP formats an IPv4 address normally, and an IPv6 address as dot separated nibbles
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xF))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// parseDualCIDR parses the optional "/v4len//v6len" suffix of the a and mx mechanisms
+func parseDualCIDR(cidr string) (v4len, v6len int, err error) {
+	v4len, v6len = 32, 128
+	if cidr == "" {
+		return v4len, v6len, nil
+	}
+	v4, v6 := cidr, ""
+	if idx := strings.Index(cidr, "//"); idx >= 0 {
+		v4, v6 = cidr[:idx], cidr[idx+2:]
+	}
+	if v4 != "" {
+		if v4len, err = strconv.Atoi(strings.TrimPrefix(v4, "/")); err != nil ||
+			!strings.HasPrefix(v4, "/") || v4len < 0 || v4len > 32 {
+			return 0, 0, spfError(SPFPermError)
+		}
+	}
+	if v6 != "" {
+		if v6len, err = strconv.Atoi(v6); err != nil || v6len < 0 || v6len > 128 {
+			return 0, 0, spfError(SPFPermError)
+		}
+	}
+	return v4len, v6len, nil
+}
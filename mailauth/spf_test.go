@@ -0,0 +1,166 @@
+package mailauth
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// testResolver answers lookups from maps, names missing from all maps do not exist
+type testResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	fail map[string]bool // Names that return a temporary error
+}
+
+func (r *testResolver) LookupTXT(name string) ([]string, error) {
+	if r.fail[name] {
+		return nil, errors.New("timeout")
+	}
+	return r.txt[name], nil
+}
+
+func (r *testResolver) LookupIP(host string) ([]net.IP, error) {
+	if r.fail[host] {
+		return nil, errors.New("timeout")
+	}
+	var ips []net.IP
+	for _, s := range r.ip[host] {
+		ips = append(ips, net.ParseIP(s))
+	}
+	return ips, nil
+}
+
+func (r *testResolver) LookupMX(name string) ([]*net.MX, error) {
+	if r.fail[name] {
+		return nil, errors.New("timeout")
+	}
+	var mxs []*net.MX
+	for _, host := range r.mx[name] {
+		mxs = append(mxs, &net.MX{Host: host, Pref: 10})
+	}
+	return mxs, nil
+}
+
+func TestCheckSPF(t *testing.T) {
+	r := &testResolver{
+		txt: map[string][]string{
+			"example.com":       {"v=spf1 ip4:192.0.2.0/24 a mx include:_spf.example.net -all"},
+			"_spf.example.net":  {"unrelated", "v=spf1 ip6:2001:db8::/32 ~all"},
+			"soft.example.com":  {"v=spf1 ~all"},
+			"neutral.test":      {"v=spf1 ?all"},
+			"empty.test":        {"v=spf1"},
+			"redirect.test":     {"v=spf1 redirect=example.com"},
+			"two.test":          {"v=spf1 -all", "v=spf1 +all"},
+			"bad.test":          {"v=spf1 ip4:not-an-ip -all"},
+			"macro.test":        {"v=spf1 exists:%{l}.%{d} -all"},
+			"cidr.test":         {"v=spf1 a:host.cidr.test/24 -all"},
+			"temp.test":         {"v=spf1 include:down.test -all"},
+			"loop.test":         {"v=spf1 include:loop.test -all"},
+			"helo.example.com":  {"v=spf1 ip4:198.51.100.9 -all"},
+			"unknownmod.test":   {"v=spf1 foo=bar +all"},
+			"void.test":         {"v=spf1 a:n1.void.test a:n2.void.test a:n3.void.test +all"},
+			"case.test":         {"V=SPF1 IP4:192.0.2.77 -ALL"},
+			"nxinclude.test":    {"v=spf1 include:nothing.test +all"},
+			"ipv6mismatch.test": {"v=spf1 ip4:2001:db8::1 +all"},
+		},
+		ip: map[string][]string{
+			"example.com":         {"203.0.113.5"},
+			"mail.example.com":    {"203.0.113.25", "2001:db8:ffff::25"},
+			"john.macro.test":     {"127.0.0.2"},
+			"host.cidr.test":      {"198.51.100.1"},
+			"mail.unrelated.test": {"203.0.113.99"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mail.example.com."},
+		},
+		fail: map[string]bool{"down.test": true},
+	}
+
+	var table = []struct {
+		ip, helo, sender string
+		expect           SPFResult
+	}{
+		{"192.0.2.10", "h", "user@example.com", SPFPass},
+		{"203.0.113.5", "h", "user@example.com", SPFPass},
+		{"203.0.113.25", "h", "user@example.com", SPFPass},
+		{"2001:db8:ffff::25", "h", "user@example.com", SPFPass},
+		{"2001:db8::1", "h", "user@example.com", SPFPass},
+		{"198.51.100.1", "h", "user@example.com", SPFFail},
+		{"198.51.100.1", "h", "user@soft.example.com", SPFSoftFail},
+		{"198.51.100.1", "h", "user@neutral.test", SPFNeutral},
+		{"198.51.100.1", "h", "user@empty.test", SPFNeutral},
+		{"198.51.100.1", "h", "user@nospf.test", SPFNone},
+		{"192.0.2.10", "h", "user@redirect.test", SPFPass},
+		{"198.51.100.1", "h", "user@redirect.test", SPFFail},
+		{"198.51.100.1", "h", "user@two.test", SPFPermError},
+		{"198.51.100.1", "h", "user@bad.test", SPFPermError},
+		{"198.51.100.1", "h", "john@macro.test", SPFPass},
+		{"198.51.100.1", "h", "jane@macro.test", SPFFail},
+		{"198.51.100.200", "h", "user@cidr.test", SPFPass},
+		{"198.51.101.1", "h", "user@cidr.test", SPFFail},
+		{"198.51.100.1", "h", "user@temp.test", SPFTempError},
+		{"198.51.100.1", "h", "user@loop.test", SPFPermError},
+		{"198.51.100.9", "helo.example.com", "", SPFPass},
+		{"198.51.100.8", "helo.example.com", "", SPFFail},
+		{"198.51.100.1", "h", "user@unknownmod.test", SPFPass},
+		{"198.51.100.1", "h", "user@void.test", SPFPermError},
+		{"192.0.2.77", "h", "user@case.test", SPFPass},
+		{"198.51.100.1", "h", "user@nxinclude.test", SPFPermError},
+		{"198.51.100.1", "h", "user@ipv6mismatch.test", SPFPermError},
+	}
+	for _, tt := range table {
+		got := CheckSPF(r, net.ParseIP(tt.ip), tt.helo, tt.sender)
+		if got != tt.expect {
+			t.Errorf("CheckSPF(%v, %q, %q) expected %v, got %v", tt.ip, tt.helo, tt.sender,
+				tt.expect, got)
+		}
+	}
+}
+
+func TestSPFMacroExpansion(t *testing.T) {
+	c := &spfCheck{ip: net.ParseIP("192.0.2.3"), helo: "mx.example.org",
+		sender: "strong-bad@email.example.com"}
+	var table = []struct {
+		spec, expect string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{h}%%%_%-", "mx.example.org% %20"},
+	}
+	for _, tt := range table {
+		got, err := c.expand(tt.spec, "email.example.com")
+		if err != nil {
+			t.Errorf("Expanding %q: %v", tt.spec, err)
+		} else if got != tt.expect {
+			t.Errorf("Expanding %q, expected %q, got %q", tt.spec, tt.expect, got)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	got, _ := c.expand("%{ir}.%{v}", "")
+	expect := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6"
+	if got != expect {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+
+	for _, spec := range []string{"%", "%x", "%{", "%{q}", "%{d0}"} {
+		if _, err := c.expand(spec, "example.com"); err == nil {
+			t.Errorf("Expected error expanding %q", spec)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package mailauth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// StaticResolver answers lookups from a fixed set of records, such as test DKIM keys.  Lookups
+// for which it has no records of the requested type are passed to the fallback Resolver, or
+// report that no records exist if there is no fallback.
+type StaticResolver struct {
+	txt      map[string][]string
+	ip       map[string][]net.IP
+	mx       map[string][]*net.MX
+	fallback Resolver
+}
+
+// NewStaticResolver creates an empty StaticResolver, fallback may be nil
+func NewStaticResolver(fallback Resolver) *StaticResolver {
+	return &StaticResolver{
+		txt:      make(map[string][]string),
+		ip:       make(map[string][]net.IP),
+		mx:       make(map[string][]*net.MX),
+		fallback: fallback,
+	}
+}
+
+// LoadStaticResolver creates a StaticResolver with the records in the named file, see Read
+// for the format
+func LoadStaticResolver(path string, fallback Resolver) (*StaticResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	s := NewStaticResolver(fallback)
+	if err := s.Read(f); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return s, nil
+}
+
+// Read adds records from r, one per line in the form "name type value", where type is TXT,
+// A, AAAA or MX.  MX values are a preference followed by the host.  Blank lines and those
+// starting with # are ignored.
+func (s *StaticResolver) Read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return fmt.Errorf("line %v: expected name type value", line)
+		}
+		// TXT values may contain spaces, take everything following the type
+		value := strings.TrimSpace(text[strings.Index(text, fields[1])+len(fields[1]):])
+		if err := s.Add(fields[0], fields[1], value); err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Add adds a single record
+func (s *StaticResolver) Add(name, rtype, value string) error {
+	name = canonicalName(name)
+	switch strings.ToUpper(rtype) {
+	case "TXT":
+		s.txt[name] = append(s.txt[name], strings.Trim(value, `"`))
+	case "A", "AAAA":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", value)
+		}
+		s.ip[name] = append(s.ip[name], ip)
+	case "MX":
+		var pref uint16
+		var host string
+		if _, err := fmt.Sscanf(value, "%d %s", &pref, &host); err != nil {
+			return fmt.Errorf("expected MX preference and host, got %q", value)
+		}
+		s.mx[name] = append(s.mx[name], &net.MX{Host: host, Pref: pref})
+	default:
+		return fmt.Errorf("unsupported record type %q", rtype)
+	}
+	return nil
+}
+
+// LookupTXT returns the TXT records for name
+func (s *StaticResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := s.txt[canonicalName(name)]; ok {
+		return txts, nil
+	}
+	if s.fallback == nil {
+		return nil, nil
+	}
+	return s.fallback.LookupTXT(name)
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host
+func (s *StaticResolver) LookupIP(host string) ([]net.IP, error) {
+	if ips, ok := s.ip[canonicalName(host)]; ok {
+		return ips, nil
+	}
+	if s.fallback == nil {
+		return nil, nil
+	}
+	return s.fallback.LookupIP(host)
+}
+
+// LookupMX returns the MX records for name
+func (s *StaticResolver) LookupMX(name string) ([]*net.MX, error) {
+	if mxs, ok := s.mx[canonicalName(name)]; ok {
+		return mxs, nil
+	}
+	if s.fallback == nil {
+		return nil, nil
+	}
+	return s.fallback.LookupMX(name)
+}
+
+// canonicalName lower cases a domain name and removes any trailing dot
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
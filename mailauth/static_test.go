@@ -0,0 +1,46 @@
+package mailauth
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticResolver(t *testing.T) {
+	fallback := NewStaticResolver(nil)
+	assert.Nil(t, fallback.Add("fallback.test", "TXT", "from fallback"))
+
+	s := NewStaticResolver(fallback)
+	err := s.Read(strings.NewReader(`
+# Test records
+sel._domainkey.Example.COM. TXT "v=DKIM1; k=rsa; p=abc"
+example.com  A    192.0.2.1
+example.com  AAAA 2001:db8::1
+example.com  MX   10 mail.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txts, err := s.LookupTXT("sel._domainkey.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=DKIM1; k=rsa; p=abc"}, txts)
+	ips, err := s.LookupIP("EXAMPLE.com.")
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, ips)
+	mxs, err := s.LookupMX("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []*net.MX{{Host: "mail.example.com", Pref: 10}}, mxs)
+
+	txts, _ = s.LookupTXT("fallback.test")
+	assert.Equal(t, []string{"from fallback"}, txts)
+	txts, err = s.LookupTXT("missing.test")
+	assert.Nil(t, err)
+	assert.Nil(t, txts)
+
+	for _, bad := range []string{"name TXT", "name A bogus", "name MX mail", "name SRV x"} {
+		assert.NotNil(t, NewStaticResolver(nil).Read(strings.NewReader(bad)), bad)
+	}
+}
@@ -90,6 +90,14 @@ func (hub *Hub) AddListener(l Listener) {
 	}
 }
 
+// AddLiveListener registers a listener to receive broadcasted messages, without playback of
+// the history buffer.
+func (hub *Hub) AddLiveListener(l Listener) {
+	hub.opChan <- func(h *Hub) {
+		h.listeners[l] = struct{}{}
+	}
+}
+
 // RemoveListener deletes a listener registration, it will cease to receive messages.
 func (hub *Hub) RemoveListener(l Listener) {
 	hub.opChan <- func(h *Hub) {
@@ -180,6 +180,38 @@ func TestHubHistoryReplay(t *testing.T) {
 	}
 }
 
+func TestHubLiveListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := New(ctx, 100)
+
+	// Broadcast a message with no listeners
+	hub.Dispatch(Message{Subject: "history"})
+
+	l := newTestListener(1)
+	hub.AddLiveListener(l)
+	hub.Dispatch(Message{Subject: "live"})
+
+	// Wait for messages
+	select {
+	case <-l.done:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout:", l)
+	}
+	hub.Sync()
+	select {
+	case <-l.overflow:
+		t.Error("Received history:", l)
+	default:
+	}
+
+	got := l.messages[0].Subject
+	want := "live"
+	if got != want {
+		t.Errorf("msg[0].Subject == %q, want %q", got, want)
+	}
+}
+
 func TestHubHistoryReplayWrap(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,199 @@
+package pop3d
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+var (
+	// errAuthCanceled indicates the client aborted the AUTH exchange with "*"
+	errAuthCanceled = errors.New("Authentication canceled by client")
+
+	// errAuthSyntax indicates the client sent a response we could not decode
+	errAuthSyntax = errors.New("Malformed authentication response")
+
+	// errAuthInvalid indicates the client sent credentials that did not match
+	errAuthInvalid = errors.New("Invalid credentials")
+)
+
+// authMechanisms lists the SASL mechanisms we advertise, in order of preference
+var authMechanisms = []string{"PLAIN"}
+
+// authHandler processes the RFC 5034 AUTH command, args contains the mechanism followed by
+// an optional initial response.  Without a mechanism, the supported mechanisms are listed.
+func (ses *Session) authHandler(args []string) {
+	if len(args) == 0 {
+		ses.send("+OK Supported mechanisms follow")
+		for _, mech := range authMechanisms {
+			ses.send(mech)
+		}
+		ses.send(".")
+		return
+	}
+	if len(args) > 2 {
+		ses.send("-ERR AUTH requires a mechanism and optional initial response")
+		ses.logWarn("AUTH got unexpected arguments: %q", args)
+		return
+	}
+	mech, initial := strings.ToUpper(args[0]), ""
+	if len(args) == 2 {
+		initial = args[1]
+	}
+
+	var user string
+	var err error
+	switch mech {
+	case "PLAIN":
+		user, err = ses.authPlain(initial)
+	default:
+		ses.send("-ERR Unrecognized authentication mechanism")
+		ses.logWarn("Unsupported AUTH mechanism: %q", mech)
+		return
+	}
+
+	switch err {
+	case nil:
+		ses.logInfo("Authenticated as %q using %v", user, mech)
+		ses.openMailbox(user)
+	case errAuthCanceled:
+		ses.send("-ERR Authentication canceled")
+		ses.logWarn("Client canceled AUTH %v", mech)
+	case errAuthSyntax:
+		ses.send("-ERR Malformed authentication response")
+		ses.logWarn("Garbled AUTH %v response", mech)
+	case errAuthInvalid:
+		expLoginFailures.Add(1)
+		ses.send("-ERR Authentication failed")
+		ses.logWarn("AUTH %v failed for %q", mech, user)
+	default:
+		// Network error while reading response
+		ses.logWarn("Error during AUTH: %v", err)
+		ses.enterState(QUIT)
+	}
+}
+
+// authPlain implements the RFC 4616 PLAIN mechanism
+func (ses *Session) authPlain(initial string) (user string, err error) {
+	var resp []byte
+	if initial == "" {
+		resp, err = ses.authChallenge("")
+	} else {
+		resp, err = decodeAuthResponse(initial)
+	}
+	if err != nil {
+		return "", err
+	}
+	// authzid NUL authcid NUL passwd
+	parts := bytes.Split(resp, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return "", errAuthSyntax
+	}
+	user = string(parts[1])
+	if !ses.passwordValid(user, string(parts[2])) {
+		return user, errAuthInvalid
+	}
+	return user, nil
+}
+
+// authChallenge sends a base64 encoded challenge to the client and returns its decoded
+// response
+func (ses *Session) authChallenge(challenge string) ([]byte, error) {
+	ses.send("+ " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+	if ses.sendError != nil {
+		return nil, ses.sendError
+	}
+	line, err := ses.readLine()
+	if err != nil {
+		return nil, err
+	}
+	ses.transcript.Client("[credentials]")
+	return decodeAuthResponse(line)
+}
+
+// decodeAuthResponse decodes a base64 client response, mapping "*" to errAuthCanceled
+func decodeAuthResponse(resp string) ([]byte, error) {
+	resp = strings.TrimSpace(resp)
+	if resp == "*" {
+		return nil, errAuthCanceled
+	}
+	if resp == "=" {
+		// Empty initial response
+		return []byte{}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return nil, errAuthSyntax
+	}
+	return data, nil
+}
+
+// passwordValid checks the password given for a mailbox against the one configured for it,
+// or the "*" default.  Any password is valid for a mailbox without one.  Private mailboxes are
+// opened with one of their tokens instead.
+func (ses *Session) passwordValid(user, password string) bool {
+	name, err := smtpd.ParseMailboxName(user)
+	if err != nil {
+		return false
+	}
+	if smtpd.MailboxPrivate(name) {
+		return smtpd.MailboxTokenValid(name, password)
+	}
+	expect, ok := ses.server.passwords[name]
+	if !ok {
+		if expect, ok = ses.server.passwords["*"]; !ok {
+			return true
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(expect), []byte(password)) == 1
+}
+
+// apopValid checks an APOP digest, the MD5 of the greeting timestamp followed by the
+// mailbox's shared secret (RFC 1939).  Without any secrets, any digest is valid for a mailbox
+// that has no password.  Private mailboxes must be opened with PASS or AUTH.
+func (ses *Session) apopValid(user, digest string) bool {
+	name, err := smtpd.ParseMailboxName(user)
+	if err != nil || smtpd.MailboxPrivate(name) {
+		return false
+	}
+	secret, ok := ses.server.apopSecrets[name]
+	if !ok {
+		return len(ses.server.apopSecrets) == 0 && !ses.server.hasPassword(name)
+	}
+	sum := md5.Sum([]byte(ses.timestamp + secret))
+	expect := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expect), []byte(strings.ToLower(digest))) == 1
+}
+
+// hasPassword returns true if a password is configured for the named mailbox, or by default
+func (s *Server) hasPassword(name string) bool {
+	_, ok := s.passwords[name]
+	_, def := s.passwords["*"]
+	return ok || def
+}
+
+// mailboxCredentials re-keys credentials by mailbox name, so that they are found however a
+// client spells the mailbox.  The "*" default is kept, invalid names are dropped.
+func mailboxCredentials(creds map[string]string) map[string]string {
+	result := make(map[string]string, len(creds))
+	for user, secret := range creds {
+		if user == "*" {
+			result[user] = secret
+			continue
+		}
+		name, err := smtpd.ParseMailboxName(user)
+		if err != nil {
+			log.Errorf("Ignoring POP3 credentials for %q: %v", user, err)
+			continue
+		}
+		result[name] = secret
+	}
+	return result
+}
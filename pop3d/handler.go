@@ -3,6 +3,7 @@ package pop3d
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -53,30 +54,42 @@ var commands = map[string]bool{
 	"PASS": true,
 	"APOP": true,
 	"CAPA": true,
+	"STLS": true,
+	"AUTH": true,
 }
 
 // Session defines an active POP3 session
 type Session struct {
-	server     *Server         // Reference to the server we belong to
-	id         int             // Session ID number
-	conn       net.Conn        // Our network connection
-	remoteHost string          // IP address of client
-	sendError  error           // Used to bail out of read loop on send error
-	state      State           // Current session state
-	reader     *bufio.Reader   // Buffered reader for our net conn
-	user       string          // Mailbox name
-	mailbox    smtpd.Mailbox   // Mailbox instance
-	messages   []smtpd.Message // Slice of messages in mailbox
-	retain     []bool          // Messages to retain upon UPDATE (true=retain)
-	msgCount   int             // Number of undeleted messages
+	server     *Server           // Reference to the server we belong to
+	id         int               // Session ID number
+	conn       net.Conn          // Our network connection
+	remoteHost string            // IP address of client
+	sendError  error             // Used to bail out of read loop on send error
+	state      State             // Current session state
+	reader     *bufio.Reader     // Buffered reader for our net conn
+	tlsActive  bool              // Connection is encrypted, by STLS or POP3S
+	timestamp  string            // Greeting timestamp, the basis of APOP digests
+	user       string            // Mailbox name
+	mailbox    smtpd.Mailbox     // Mailbox instance
+	messages   []smtpd.Message   // Slice of messages in mailbox
+	retain     []bool            // Messages to retain upon UPDATE (true=retain)
+	msgCount   int               // Number of undeleted messages
+	retrieved  int               // Messages sent by RETR
+	bytesSent  int64             // Message data sent by RETR and TOP
+	transcript *smtpd.Transcript // Commands and replies, nil if not recorded
 }
 
 // NewSession creates a new POP3 session
 func NewSession(server *Server, id int, conn net.Conn) *Session {
 	reader := bufio.NewReader(conn)
 	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	return &Session{server: server, id: id, conn: conn, state: AUTHORIZATION,
-		reader: reader, remoteHost: host}
+	_, tlsActive := conn.(*tls.Conn)
+	ses := &Session{server: server, id: id, conn: conn, state: AUTHORIZATION,
+		reader: reader, remoteHost: host, tlsActive: tlsActive}
+	if server.transcripts {
+		ses.transcript = new(smtpd.Transcript)
+	}
+	return ses
 }
 
 func (ses *Session) String() string {
@@ -92,23 +105,31 @@ func (ses *Session) String() string {
  */
 func (s *Server) startSession(id int, conn net.Conn) {
 	log.Infof("POP3 connection from %v, starting session <%v>", conn.RemoteAddr(), id)
-	//expConnectsCurrent.Add(1)
+	expConnectsTotal.Add(1)
+	expConnectsCurrent.Add(1)
 	defer func() {
 		if err := conn.Close(); err != nil {
 			log.Errorf("Error closing POP3 connection for <%v>: %v", id, err)
 		}
 		s.waitgroup.Done()
-		//expConnectsCurrent.Add(-1)
+		expConnectsCurrent.Add(-1)
 	}()
 
 	ses := NewSession(s, id, conn)
-	ses.send(fmt.Sprintf("+OK Inbucket POP3 server ready <%v.%v@%v>", os.Getpid(),
-		time.Now().Unix(), s.domain))
+	if !s.sessionLimit.acquire(ses.remoteHost) {
+		ses.send("-ERR too many connections")
+		ses.logWarn("Concurrent session limit reached")
+		return
+	}
+	defer s.sessionLimit.release(ses.remoteHost)
+	ses.timestamp = fmt.Sprintf("<%v.%v@%v>", os.Getpid(), time.Now().UnixNano(), s.domain)
+	ses.send("+OK Inbucket POP3 server ready " + ses.timestamp)
 
 	// This is our command reading loop
 	for ses.state != QUIT && ses.sendError == nil {
 		line, err := ses.readLine()
 		if err == nil {
+			ses.transcript.Client(line)
 			if cmd, arg, ok := ses.parseCmd(line); ok {
 				// Check against valid SMTP commands
 				if cmd == "" {
@@ -129,6 +150,15 @@ func (s *Server) startSession(id int, conn net.Conn) {
 					ses.send("TOP")
 					ses.send("USER")
 					ses.send("UIDL")
+					ses.send("RESP-CODES")
+					ses.send("EXPIRE " + ses.server.expire)
+					if ses.server.loginDelay > 0 {
+						ses.send(fmt.Sprintf("LOGIN-DELAY %v", ses.server.loginDelay))
+					}
+					ses.send("SASL " + strings.Join(authMechanisms, " "))
+					if ses.server.tlsConfig != nil && !ses.tlsActive {
+						ses.send("STLS")
+					}
 					ses.send("IMPLEMENTATION Inbucket")
 					ses.send(".")
 					continue
@@ -175,7 +205,11 @@ func (s *Server) startSession(id int, conn net.Conn) {
 	if ses.sendError != nil {
 		ses.logWarn("Network send error: %v", ses.sendError)
 	}
-	ses.logInfo("Closing connection")
+	ses.logInfo("Closing connection, %v messages retrieved, %v bytes sent", ses.retrieved,
+		ses.bytesSent)
+	if ses.transcript != nil {
+		ses.logInfo("Session transcript:\r\n%v", ses.transcript)
+	}
 }
 
 // AUTHORIZATION state
@@ -194,42 +228,100 @@ func (ses *Session) authorizationHandler(cmd string, args []string) {
 	case "PASS":
 		if ses.user == "" {
 			ses.ooSeq(cmd)
+		} else if !ses.passwordValid(ses.user, strings.Join(args, " ")) {
+			ses.logWarn("Invalid password for %v", ses.user)
+			expLoginFailures.Add(1)
+			ses.send("-ERR Authentication failed")
+			ses.user = ""
 		} else {
-			var err error
-			ses.mailbox, err = ses.server.dataStore.MailboxFor(ses.user)
-			if err != nil {
-				ses.logError("Failed to open mailbox for %v", ses.user)
-				ses.send(fmt.Sprintf("-ERR Failed to open mailbox for %v", ses.user))
-				ses.enterState(QUIT)
-				return
-			}
-			ses.loadMailbox()
-			ses.send(fmt.Sprintf("+OK Found %v messages for %v", ses.msgCount, ses.user))
-			ses.enterState(TRANSACTION)
+			ses.openMailbox(ses.user)
 		}
+	case "STLS":
+		ses.stlsHandler(args)
 	case "APOP":
 		if len(args) != 2 {
 			ses.logWarn("Expected two arguments for APOP")
 			ses.send("-ERR APOP requires two arguments")
 			return
 		}
-		ses.user = args[0]
-		var err error
-		ses.mailbox, err = ses.server.dataStore.MailboxFor(ses.user)
-		if err != nil {
-			ses.logError("Failed to open mailbox for %v", ses.user)
-			ses.send(fmt.Sprintf("-ERR Failed to open mailbox for %v", ses.user))
-			ses.enterState(QUIT)
+		if !ses.apopValid(args[0], args[1]) {
+			ses.logWarn("APOP digest mismatch for %v", args[0])
+			expLoginFailures.Add(1)
+			ses.send("-ERR Authentication failed")
 			return
 		}
-		ses.loadMailbox()
-		ses.send(fmt.Sprintf("+OK Found %v messages for %v", ses.msgCount, ses.user))
-		ses.enterState(TRANSACTION)
+		ses.openMailbox(args[0])
+	case "AUTH":
+		ses.authHandler(args)
 	default:
 		ses.ooSeq(cmd)
 	}
 }
 
+// openMailbox opens the mailbox of an authenticated user and enters the TRANSACTION state
+func (ses *Session) openMailbox(user string) {
+	ses.user = user
+	var err error
+	ses.mailbox, err = ses.server.dataStore.MailboxFor(user)
+	if err != nil {
+		ses.logError("Failed to open mailbox for %v", user)
+		ses.send(fmt.Sprintf("-ERR Failed to open mailbox for %v", user))
+		ses.enterState(QUIT)
+		return
+	}
+	if !ses.server.logins.allow(ses.mailbox.Name(), time.Now()) {
+		ses.logWarn("Login to %v refused by LOGIN-DELAY", user)
+		ses.send("-ERR [LOGIN-DELAY] Minimum time between logins not elapsed")
+		ses.user = ""
+		ses.mailbox = nil
+		return
+	}
+	expLoginsTotal.Add(1)
+	ses.loadMailbox()
+	ses.send(fmt.Sprintf("+OK Found %v messages for %v", ses.msgCount, user))
+	ses.enterState(TRANSACTION)
+}
+
+// stlsHandler upgrades the connection to TLS per RFC 2595
+func (ses *Session) stlsHandler(args []string) {
+	if ses.server.tlsConfig == nil {
+		ses.send("-ERR TLS not available")
+		ses.logWarn("STLS requested, but TLS is not configured")
+		return
+	}
+	if ses.tlsActive {
+		ses.send("-ERR TLS already active")
+		ses.logWarn("STLS requested on a TLS session")
+		return
+	}
+	if len(args) != 0 {
+		ses.send("-ERR STLS command must have no arguments")
+		ses.logWarn("Got unexpected args on STLS: %q", args)
+		return
+	}
+	ses.send("+OK Begin TLS negotiation")
+	if ses.sendError != nil {
+		return
+	}
+	tlsConn := tls.Server(ses.conn, ses.server.tlsConfig)
+	if err := tlsConn.SetDeadline(ses.nextDeadline()); err != nil {
+		ses.sendError = err
+		return
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		ses.logWarn("TLS handshake failed: %v", err)
+		ses.enterState(QUIT)
+		return
+	}
+	ses.conn = tlsConn
+	ses.reader = bufio.NewReader(tlsConn)
+	ses.tlsActive = true
+	// Anything learned before negotiation must be forgotten
+	ses.user = ""
+	ses.logInfo("TLS session established")
+	ses.transcript.Note("TLS session established")
+}
+
 // TRANSACTION state
 func (ses *Session) transactionHandler(cmd string, args []string) {
 	switch cmd {
@@ -314,12 +406,12 @@ func (ses *Session) transactionHandler(cmd string, args []string) {
 				ses.send(fmt.Sprintf("-ERR You deleted message %v", msgNum))
 				return
 			}
-			ses.send(fmt.Sprintf("+OK %v %v", msgNum, ses.messages[msgNum-1].ID()))
+			ses.send(fmt.Sprintf("+OK %v %v", msgNum, ses.messages[msgNum-1].UIDL()))
 		} else {
 			ses.send(fmt.Sprintf("+OK Listing %v messages", ses.msgCount))
 			for i, msg := range ses.messages {
 				if ses.retain[i] {
-					ses.send(fmt.Sprintf("%v %v", i+1, msg.ID()))
+					ses.send(fmt.Sprintf("%v %v", i+1, msg.UIDL()))
 				}
 			}
 			ses.send(".")
@@ -378,6 +470,16 @@ func (ses *Session) transactionHandler(cmd string, args []string) {
 		}
 		ses.send(fmt.Sprintf("+OK %v bytes follows", ses.messages[msgNum-1].Size()))
 		ses.sendMessage(ses.messages[msgNum-1])
+		ses.retrieved++
+		expRetrievedTotal.Add(1)
+		if ses.server.deleteMode != "readonly" {
+			ses.markSeen(ses.messages[msgNum-1])
+		}
+		if ses.server.deleteMode == "retr" && ses.retain[msgNum-1] {
+			// Removed at UPDATE like DELE, so RSET may still restore it
+			ses.retain[msgNum-1] = false
+			ses.msgCount--
+		}
 	case "TOP":
 		if len(args) != 2 {
 			ses.logWarn("TOP command had invalid number of arguments")
@@ -452,7 +554,7 @@ func (ses *Session) sendMessage(msg smtpd.Message) {
 		if strings.HasPrefix(line, ".") {
 			line = "." + line
 		}
-		ses.send(line)
+		ses.sendData(line)
 	}
 
 	if err = scanner.Err(); err != nil {
@@ -499,7 +601,7 @@ func (ses *Session) sendMessageTop(msg smtpd.Message, lineCount int) {
 				inBody = true
 			}
 		}
-		ses.send(line)
+		ses.sendData(line)
 	}
 
 	if err = scanner.Err(); err != nil {
@@ -531,11 +633,25 @@ func (ses *Session) retainAll() {
 	ses.msgCount = len(ses.messages)
 }
 
+// markSeen flags a retrieved message \Seen, so IMAP clients and the web UI show it as read
+func (ses *Session) markSeen(msg smtpd.Message) {
+	if smtpd.HasFlag(msg, smtpd.FlagSeen) {
+		return
+	}
+	if err := msg.SetFlags(smtpd.WithFlag(msg.Flags(), smtpd.FlagSeen, true)); err != nil {
+		ses.logWarn("Failed to flag %v as seen: %v", msg, err)
+	}
+}
+
 // This would be considered the "UPDATE" state in the RFC, but it does not fit
 // with our state-machine design here, since no commands are accepted - it just
 // indicates that the session was closed cleanly and that deletes should be
 // processed.
 func (ses *Session) processDeletes() {
+	if ses.server.deleteMode == "readonly" {
+		ses.logInfo("Read-only mode, ignoring deletes")
+		return
+	}
 	ses.logInfo("Processing deletes")
 	for i, msg := range ses.messages {
 		if !ses.retain[i] {
@@ -559,6 +675,20 @@ func (ses *Session) nextDeadline() time.Time {
 
 // Send requested message, store errors in Session.sendError
 func (ses *Session) send(msg string) {
+	ses.transcript.Server(msg)
+	ses.write(msg)
+}
+
+// sendData sends a line of message data, which is counted but not transcribed
+func (ses *Session) sendData(line string) {
+	n := int64(len(line) + 2)
+	ses.bytesSent += n
+	expBytesSent.Add(n)
+	ses.write(line)
+}
+
+// write sends a line to the client, storing errors in Session.sendError
+func (ses *Session) write(msg string) {
 	if err := ses.conn.SetWriteDeadline(ses.nextDeadline()); err != nil {
 		ses.sendError = err
 		return
@@ -645,12 +775,12 @@ func (ses *Session) logInfo(msg string, args ...interface{}) {
 
 func (ses *Session) logWarn(msg string, args ...interface{}) {
 	// Update metrics
-	//expWarnsTotal.Add(1)
+	expWarnsTotal.Add(1)
 	log.Warnf("POP3[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
 }
 
 func (ses *Session) logError(msg string, args ...interface{}) {
 	// Update metrics
-	//expErrorsTotal.Add(1)
+	expErrorsTotal.Add(1)
 	log.Errorf("POP3[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
 }
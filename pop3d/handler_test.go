@@ -0,0 +1,1061 @@
+package pop3d
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/smtpd"
+	"github.com/stretchr/testify/mock"
+)
+
+type scriptStep struct {
+	send   string
+	expect string // Status of the reply: "+OK", "-ERR" or "+" for a challenge
+}
+
+// Test upgrading a session with STLS
+func TestSTLS(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+
+	// STLS is refused until TLS is configured
+	if err := playSession(t, server, []scriptStep{{"STLS", "-ERR"}}); err != nil {
+		t.Error(err)
+	}
+
+	certFile, keyFile, cleanup := writeTestCert(t)
+	defer cleanup()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	pipe := setupPOP3Session(server)
+	c := textproto.NewConn(pipe)
+	if greeting, err := c.ReadLine(); err != nil || !strings.HasPrefix(greeting, "+OK ") {
+		t.Fatalf("Expected a +OK greeting, got %q, %v", greeting, err)
+	}
+	if _, capa, err := sendCommand(c, "CAPA"); err != nil {
+		t.Fatal(err)
+	} else if !hasLine(capa, "STLS") {
+		t.Errorf("Expected STLS in CAPA, got %q", capa)
+	}
+	script := []scriptStep{
+		{"STLS now", "-ERR"},
+		{"USER u1", "+OK"},
+		{"STLS", "+OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+
+	// Handshake and continue the session over TLS
+	tlsConn := tls.Client(pipe, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	c = textproto.NewConn(tlsConn)
+	if _, capa, err := sendCommand(c, "CAPA"); err != nil {
+		t.Fatal(err)
+	} else if hasLine(capa, "STLS") {
+		t.Errorf("Did not expect STLS in CAPA over TLS, got %q", capa)
+	}
+	script = []scriptStep{
+		{"STLS", "-ERR"},
+		// The USER sent before negotiation is forgotten
+		{"PASS any", "-ERR"},
+		{"USER u1", "+OK"},
+		{"PASS any", "+OK"},
+		{"QUIT", "+OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test APOP digests against per mailbox secrets
+func TestAPOP(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+	server.apopSecrets = mailboxCredentials(map[string]string{"u1": "tanstaaf"})
+
+	c, greeting, err := dialPOP3(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`<\d+\.\d+@inbucket\.local>$`).MatchString(greeting) {
+		t.Errorf("Expected an APOP timestamp in the greeting, got %q", greeting)
+	}
+	// A digest of another session's timestamp can not be replayed
+	c2, other, err := dialPOP3(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c2.Close()
+	script := []scriptStep{
+		{"APOP u1", "-ERR"},
+		{"APOP u1 " + apopDigest(greeting, "tanstaaf") + " extra", "-ERR"},
+		{"APOP u1 " + apopDigest(other, "tanstaaf"), "-ERR"},
+		{"APOP u2 " + apopDigest(greeting, "tanstaaf"), "-ERR"},
+		{"APOP u1 " + strings.ToUpper(apopDigest(greeting, "tanstaaf")), "+OK"},
+		{"STAT", "+OK"},
+		{"QUIT", "+OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	_ = c.Close()
+
+	// Private mailboxes must be opened with their token
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "team", Pattern: "u1", Token: "t0k"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+	c, greeting, err = dialPOP3(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script = []scriptStep{
+		{"APOP u1 " + apopDigest(greeting, "tanstaaf"), "-ERR"},
+		{"APOP u1 " + apopDigest(greeting, "t0k"), "-ERR"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test per mailbox passwords, which apply however the client spells the mailbox name
+func TestPasswords(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("alice")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+	server.passwords = mailboxCredentials(map[string]string{"Alice": "secret"})
+
+	var testTable = []struct {
+		user, password, expect string
+	}{
+		{"alice", "secret", "+OK"},
+		{"alice", "wrong", "-ERR"},
+		{"Alice", "wrong", "-ERR"},
+		{"ALICE", "secret", "+OK"},
+		{"alice+x", "wrong", "-ERR"},
+		{"Alice+Label", "wrong", "-ERR"},
+		{"alice+x", "secret", "+OK"},
+		{"bob", "anything", "+OK"},
+		{"Bob", "anything", "+OK"},
+	}
+	for _, tt := range testTable {
+		script := []scriptStep{
+			{"USER " + tt.user, "+OK"},
+			{"PASS " + tt.password, tt.expect},
+		}
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("USER %v, PASS %v: %v", tt.user, tt.password, err)
+		}
+	}
+
+	// The default password covers every other mailbox
+	server.passwords["*"] = "default"
+	for _, tt := range []struct {
+		user, password, expect string
+	}{
+		{"bob", "anything", "-ERR"},
+		{"Bob+x", "default", "+OK"},
+		{"alice", "default", "-ERR"},
+	} {
+		script := []scriptStep{
+			{"USER " + tt.user, "+OK"},
+			{"PASS " + tt.password, tt.expect},
+		}
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("USER %v, PASS %v: %v", tt.user, tt.password, err)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test APOP does not bypass the passwords of mailboxes without a secret
+func TestAPOPPasswords(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("alice")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+	server.passwords = mailboxCredentials(map[string]string{"alice": "secret"})
+
+	var testTable = []struct {
+		user, expect string
+	}{
+		{"alice", "-ERR"},
+		{"Alice", "-ERR"},
+		{"alice+x", "-ERR"},
+		{"bob", "+OK"},
+	}
+	for _, tt := range testTable {
+		script := []scriptStep{{"APOP " + tt.user + " c4c9334bac560ecc979e58001b3e22fb", tt.expect}}
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("APOP %v: %v", tt.user, err)
+		}
+	}
+
+	// Once secrets are configured, the digest of the mailbox's secret is required
+	server.apopSecrets = mailboxCredentials(map[string]string{"Alice": "tanstaaf"})
+	for _, tt := range []struct {
+		user, secret, expect string
+	}{
+		{"alice", "tanstaaf", "+OK"},
+		{"ALICE+x", "tanstaaf", "+OK"},
+		{"alice", "wrong", "-ERR"},
+		{"bob", "tanstaaf", "-ERR"},
+	} {
+		c, greeting, err := dialPOP3(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script := []scriptStep{{"APOP " + tt.user + " " + apopDigest(greeting, tt.secret),
+			tt.expect}}
+		if err := playScriptAgainst(t, c, script); err != nil {
+			t.Errorf("APOP %v with %v: %v", tt.user, tt.secret, err)
+		}
+		_ = c.Close()
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test the implicit TLS (POP3S) listener
+func TestPOP3S(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	certFile, keyFile, cleanup := writeTestCert(t)
+	defer cleanup()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+	// STLS is offered on plain text sessions only
+	server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if err := server.listenTLS(config.POP3Config{TLSCert: "missing.pem"}); err == nil {
+		t.Error("Expected an error for a missing certificate")
+	}
+	cfg := config.POP3Config{
+		IP4address: net.IPv4(127, 0, 0, 1),
+		TLSCert:    certFile,
+		TLSPrivKey: keyFile,
+	}
+	if err := server.listenTLS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.serve(ctx, server.tlsListener)
+	defer func() {
+		cancel()
+		_ = server.tlsListener.Close()
+		server.Drain()
+	}()
+
+	conn, err := tls.Dial("tcp", server.tlsListener.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	c := textproto.NewConn(conn)
+	if greeting, err := c.ReadLine(); err != nil || !strings.HasPrefix(greeting, "+OK ") {
+		t.Fatalf("Expected a +OK greeting, got %q, %v", greeting, err)
+	}
+	_, capa, err := sendCommand(c, "CAPA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasLine(capa, "STLS") {
+		t.Errorf("Did not expect STLS in CAPA over TLS, got %q", capa)
+	}
+	script := []scriptStep{
+		{"STLS", "-ERR"},
+		{"USER u1", "+OK"},
+		{"PASS any", "+OK"},
+		{"STAT", "+OK"},
+		{"QUIT", "+OK"},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test SASL AUTH with the PLAIN mechanism
+func TestAuthPlain(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+	server.passwords = mailboxCredentials(map[string]string{"u1": "secret"})
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "team", Pattern: "team-*", Token: "t0k"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+
+	// Without a mechanism, the supported ones are listed
+	c, _, err := dialPOP3(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, mechs, err := sendCommand(c, "AUTH"); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(status, "+OK") || !hasLine(mechs, "PLAIN") {
+		t.Errorf("Expected PLAIN to be listed, got %q %q", status, mechs)
+	}
+	_ = c.Close()
+
+	var testTable = []struct {
+		name   string
+		script []scriptStep
+	}{
+		{"initial response", []scriptStep{
+			{"AUTH PLAIN " + b64("\x00u1\x00secret"), "+OK"},
+			{"STAT", "+OK"},
+		}},
+		{"challenge", []scriptStep{
+			{"AUTH plain", "+"},
+			{b64("u1\x00u1\x00secret"), "+OK"},
+			{"STAT", "+OK"},
+		}},
+		{"empty initial response", []scriptStep{
+			{"AUTH PLAIN =", "-ERR"},
+			{"STAT", "-ERR"},
+		}},
+		{"canceled", []scriptStep{
+			{"AUTH PLAIN", "+"},
+			{"*", "-ERR"},
+			{"STAT", "-ERR"},
+		}},
+		{"canceled initial response", []scriptStep{
+			{"AUTH PLAIN *", "-ERR"},
+		}},
+		{"malformed base64", []scriptStep{
+			{"AUTH PLAIN !!!", "-ERR"},
+			{"AUTH PLAIN", "+"},
+			{"not base64!", "-ERR"},
+		}},
+		{"malformed response", []scriptStep{
+			{"AUTH PLAIN " + b64("u1\x00secret"), "-ERR"},
+			{"AUTH PLAIN " + b64("\x00\x00secret"), "-ERR"},
+		}},
+		{"wrong password", []scriptStep{
+			{"AUTH PLAIN " + b64("\x00u1\x00wrong"), "-ERR"},
+			{"AUTH PLAIN " + b64("\x00U1+x\x00wrong"), "-ERR"},
+			{"STAT", "-ERR"},
+		}},
+		{"private mailbox token", []scriptStep{
+			{"AUTH PLAIN " + b64("\x00team-a\x00t0k"), "+OK"},
+			{"STAT", "+OK"},
+		}},
+		{"private mailbox wrong token", []scriptStep{
+			{"AUTH PLAIN " + b64("\x00team-a\x00secret"), "-ERR"},
+			{"AUTH PLAIN " + b64("\x00team-a\x00"), "-ERR"},
+		}},
+		{"unknown mechanism", []scriptStep{
+			{"AUTH CRAM-MD5", "-ERR"},
+			{"AUTH PLAIN a b", "-ERR"},
+		}},
+	}
+	for _, tt := range testTable {
+		if err := playSession(t, server, tt.script); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test the delete modes, which decide what DELE and RETR remove at QUIT
+func TestDeleteModes(t *testing.T) {
+	var testTable = []struct {
+		mode    string
+		script  []scriptStep
+		deleted []bool // By message
+		seen    []bool // By message
+	}{
+		{"normal", []scriptStep{
+			{"DELE 1", "+OK"},
+			{"RETR 2", "+OK"},
+			{"LIST", "+OK"},
+			{"QUIT", "+OK"},
+		}, []bool{true, false}, []bool{false, true}},
+		{"normal", []scriptStep{
+			{"DELE 1", "+OK"},
+			{"DELE 1", "-ERR"},
+			{"RSET", "+OK"},
+			{"QUIT", "+OK"},
+		}, []bool{false, false}, []bool{false, false}},
+		{"readonly", []scriptStep{
+			{"DELE 1", "+OK"},
+			{"RETR 2", "+OK"},
+			{"LIST 1", "-ERR"},
+			{"QUIT", "+OK"},
+		}, []bool{false, false}, []bool{false, false}},
+		{"retr", []scriptStep{
+			{"RETR 2", "+OK"},
+			{"LIST 2", "-ERR"},
+			{"RETR 2", "+OK"},
+			{"QUIT", "+OK"},
+		}, []bool{false, true}, []bool{false, true}},
+		{"retr", []scriptStep{
+			{"DELE 1", "+OK"},
+			{"RETR 2", "+OK"},
+			{"QUIT", "+OK"},
+		}, []bool{true, true}, []bool{false, true}},
+		{"retr", []scriptStep{
+			{"RETR 1", "+OK"},
+			{"RSET", "+OK"},
+			{"QUIT", "+OK"},
+		}, []bool{false, false}, []bool{true, false}},
+	}
+	for _, tt := range testTable {
+		// Setup mock objects
+		mds := &MockDataStore{}
+		mb1 := &MockMailbox{}
+		mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+		mb1.On("Name").Return("u1")
+		msgs := mockMessages(mb1, "Subject: one\r\n\r\nHi\r\n", "Subject: two\r\n\r\nHi\r\n")
+
+		server, logbuf, teardown := setupPOP3Server(mds)
+		server.deleteMode = tt.mode
+		script := append([]scriptStep{{"USER u1", "+OK"}, {"PASS any", "+OK"}}, tt.script...)
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("%v mode: %v", tt.mode, err)
+		}
+		// Wait for the session to process deletes
+		server.waitgroup.Wait()
+		teardown()
+
+		for i, msg := range msgs {
+			if got := called(msg, "Delete"); got != tt.deleted[i] {
+				t.Errorf("%v mode, %q: got deleted %v for message %v, want %v", tt.mode,
+					tt.script, got, i+1, tt.deleted[i])
+			}
+			if got := called(msg, "SetFlags"); got != tt.seen[i] {
+				t.Errorf("%v mode, %q: got seen %v for message %v, want %v", tt.mode,
+					tt.script, got, i+1, tt.seen[i])
+			}
+		}
+		if t.Failed() {
+			// Dump buffered log data if there was a failure
+			_, _ = io.Copy(os.Stderr, logbuf)
+			return
+		}
+	}
+}
+
+// Test the total and per IP session limits
+func TestSessionLimits(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+	if newSessionLimiter(0, 0) != nil {
+		t.Error("Expected no limiter without limits")
+	}
+	server.sessionLimit = newSessionLimiter(2, 1)
+
+	var testTable = []struct {
+		ip, expect string
+	}{
+		{"10.0.0.1", "+OK"},
+		{"10.0.0.1", "-ERR too many connections"},
+		{"10.0.0.2", "+OK"},
+		{"10.0.0.3", "-ERR too many connections"},
+	}
+	var open []*textproto.Conn
+	for _, tt := range testTable {
+		c := textproto.NewConn(setupPOP3SessionFrom(server, tt.ip))
+		greeting, err := c.ReadLine()
+		if err != nil || !strings.HasPrefix(greeting, tt.expect) {
+			t.Errorf("Expected %q greeting for %v, got %q, %v", tt.expect, tt.ip, greeting, err)
+		}
+		open = append(open, c)
+	}
+
+	// Sessions are released when they end
+	for _, c := range open {
+		_ = c.Close()
+	}
+	server.waitgroup.Wait()
+	for _, ip := range []string{"10.0.0.1", "10.0.0.3"} {
+		c := textproto.NewConn(setupPOP3SessionFrom(server, ip))
+		if greeting, err := c.ReadLine(); err != nil || !strings.HasPrefix(greeting, "+OK") {
+			t.Errorf("Expected +OK greeting for %v, got %q, %v", ip, greeting, err)
+		}
+		defer func() {
+			_ = c.Close()
+		}()
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test the EXPIRE and LOGIN-DELAY capabilities, and the enforcement of LOGIN-DELAY
+func TestLoginDelay(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mb2 := &MockMailbox{}
+	mds.On("MailboxFor", "u1").Return(mb1, nil)
+	mds.On("MailboxFor", "U1+x").Return(mb1, nil)
+	mds.On("MailboxFor", "u2").Return(mb2, nil)
+	mb1.On("Name").Return("u1")
+	mb1.On("GetMessages").Return([]smtpd.Message{}, nil)
+	mb2.On("Name").Return("u2")
+	mb2.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+
+	// capa returns the capabilities of a new session
+	capa := func() []string {
+		c, _, err := dialPOP3(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = c.Close()
+		}()
+		_, lines, err := sendCommand(c, "CAPA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lines
+	}
+	if lines := capa(); !hasLine(lines, "EXPIRE NEVER") || hasLine(lines, "LOGIN-DELAY 0") {
+		t.Errorf("Expected EXPIRE NEVER without LOGIN-DELAY, got %q", lines)
+	}
+
+	server.expire = "0"
+	server.loginDelay = 60
+	server.logins = newLoginTracker(60)
+	if lines := capa(); !hasLine(lines, "EXPIRE 0") || !hasLine(lines, "LOGIN-DELAY 60") {
+		t.Errorf("Expected EXPIRE 0 and LOGIN-DELAY 60, got %q", lines)
+	}
+
+	var testTable = []struct {
+		user, expect string
+	}{
+		{"u1", "+OK"},
+		{"u1", "-ERR [LOGIN-DELAY]"},
+		{"U1+x", "-ERR [LOGIN-DELAY]"},
+		{"u2", "+OK"},
+	}
+	for _, tt := range testTable {
+		script := []scriptStep{
+			{"USER " + tt.user, "+OK"},
+			{"PASS any", tt.expect},
+		}
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("USER %v: %v", tt.user, err)
+		}
+	}
+
+	// Logins are allowed again once the delay has passed
+	if !server.logins.allow("u1", time.Now().Add(61*time.Second)) {
+		t.Error("Expected login to be allowed after the delay")
+	}
+	if newLoginTracker(0) != nil {
+		t.Error("Expected no tracker without a delay")
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestExpirePolicy(t *testing.T) {
+	var testTable = []struct {
+		mode      string
+		retention int
+		want      string
+	}{
+		{"normal", 0, "NEVER"},
+		{"readonly", 0, "NEVER"},
+		{"normal", 60, "0"},
+		{"normal", 3 * 24 * 60, "3"},
+		{"readonly", 7*24*60 + 5, "7"},
+		{"retr", 0, "0"},
+		{"retr", 3 * 24 * 60, "0"},
+	}
+	for _, tt := range testTable {
+		if got := expirePolicy(tt.mode, tt.retention); got != tt.want {
+			t.Errorf("expirePolicy(%q, %v) got %q, want %q", tt.mode, tt.retention, got, tt.want)
+		}
+	}
+}
+
+// Test the session metrics
+func TestMetrics(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	mockMessages(mb1, "Subject: one\r\n\r\nHi\r\n")
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+	server.passwords = map[string]string{"u1": "secret"}
+
+	// expValue returns the value of an expvar counter
+	expValue := func(v *expvar.Int) int64 {
+		n, _ := strconv.ParseInt(v.String(), 10, 64)
+		return n
+	}
+	logins := expValue(expLoginsTotal)
+	failures := expValue(expLoginFailures)
+	retrieved := expValue(expRetrievedTotal)
+	bytesSent := expValue(expBytesSent)
+
+	script := []scriptStep{
+		{"USER u1", "+OK"},
+		{"PASS wrong", "-ERR"},
+		{"USER u1", "+OK"},
+		{"PASS secret", "+OK"},
+		{"RETR 1", "+OK"},
+		{"TOP 1 0", "+OK"},
+		{"QUIT", "+OK"},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	// Wait for the session to finish updating counters
+	server.waitgroup.Wait()
+
+	if got := expValue(expLoginsTotal) - logins; got != 1 {
+		t.Errorf("Expected 1 login, got %v", got)
+	}
+	if got := expValue(expLoginFailures) - failures; got != 1 {
+		t.Errorf("Expected 1 login failure, got %v", got)
+	}
+	if got := expValue(expRetrievedTotal) - retrieved; got != 1 {
+		t.Errorf("Expected 1 message retrieved, got %v", got)
+	}
+	// RETR sends 3 lines, TOP the header and the blank line after it
+	if got := expValue(expBytesSent) - bytesSent; got != 20+16 {
+		t.Errorf("Expected 36 bytes sent, got %v", got)
+	}
+	if !strings.Contains(logbuf.String(), "1 messages retrieved, 36 bytes sent") {
+		t.Errorf("Expected the session totals to be logged")
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test recording of session transcripts
+func TestTranscript(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor", mock.Anything).Return(mb1, nil)
+	mb1.On("Name").Return("u1")
+	mockMessages(mb1, "Subject: secret\r\n\r\nHi\r\n")
+
+	server, logbuf, teardown := setupPOP3Server(mds)
+	defer teardown()
+
+	// Transcripts are off by default
+	if err := playSession(t, server, []scriptStep{{"NOOP", "-ERR"}}); err != nil {
+		t.Error(err)
+	}
+	server.waitgroup.Wait()
+	if strings.Contains(logbuf.String(), "Session transcript") {
+		t.Errorf("Did not expect a transcript to be logged")
+	}
+
+	server.transcripts = true
+	script := []scriptStep{
+		{"USER u1", "+OK"},
+		{"PASS hunter2", "+OK"},
+		{"RETR 1", "+OK"},
+		{"QUIT", "+OK"},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	server.waitgroup.Wait()
+	// The trace log shows everything, only check the transcript itself
+	transcript := logbuf.String()
+	start := strings.Index(transcript, "Session transcript:")
+	if start < 0 {
+		t.Fatalf("Expected a transcript to be logged")
+	}
+	transcript = transcript[start:]
+	for _, want := range []string{
+		"Session transcript:\r\nS: +OK Inbucket POP3 server ready",
+		"C: USER u1\r\nS: +OK ",
+		"C: PASS [credentials]\r\nS: +OK ",
+		"C: RETR 1\r\nS: +OK ",
+		"C: QUIT\r\nS: +OK ",
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("Expected transcript to contain %q", want)
+		}
+	}
+	for _, secret := range []string{"hunter2", "Subject: secret"} {
+		if strings.Contains(transcript, secret) {
+			t.Errorf("Did not expect transcript to contain %q", secret)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// called returns true if method was called on m
+func called(m *MockMessage, method string) bool {
+	for _, call := range m.Calls {
+		if call.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// mockMessages creates a message in mailbox mb for each of the raw messages
+func mockMessages(mb *MockMailbox, raws ...string) []*MockMessage {
+	msgs := make([]*MockMessage, 0, len(raws))
+	list := make([]smtpd.Message, 0, len(raws))
+	for i, raw := range raws {
+		msg := &MockMessage{}
+		msg.On("Size").Return(len(raw))
+		msg.On("UIDL").Return(fmt.Sprintf("uidl-%v", i+1))
+		msg.On("String").Return(fmt.Sprintf("Message %v", i+1))
+		for j := 0; j < 3; j++ {
+			// Each RETR or TOP reads the message anew
+			msg.On("RawReader").Return(ioutil.NopCloser(strings.NewReader(raw)), nil).Once()
+		}
+		msg.On("Flags").Return([]string{})
+		msg.On("SetFlags", mock.Anything).Return(nil)
+		msg.On("Delete").Return(nil)
+		msgs = append(msgs, msg)
+		list = append(list, msg)
+	}
+	mb.On("GetMessages").Return(list, nil)
+	return msgs
+}
+
+// apopDigest calculates the APOP digest of secret for the timestamp in greeting
+func apopDigest(greeting, secret string) string {
+	sum := md5.Sum([]byte(greeting[strings.Index(greeting, "<"):] + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// dialPOP3 creates a new session and reads its greeting
+func dialPOP3(server *Server) (c *textproto.Conn, greeting string, err error) {
+	c = textproto.NewConn(setupPOP3Session(server))
+	greeting, err = c.ReadLine()
+	if err == nil && !strings.HasPrefix(greeting, "+OK ") {
+		err = fmt.Errorf("Expected a +OK greeting, got %q", greeting)
+	}
+	return c, greeting, err
+}
+
+// playSession creates a new session, reads the greeting and then plays the script
+func playSession(t *testing.T, server *Server, script []scriptStep) error {
+	c, _, err := dialPOP3(server)
+	if err != nil {
+		return err
+	}
+
+	err = playScriptAgainst(t, c, script)
+
+	// Not all tests leave the session in a clean state, so the following two
+	// calls can fail
+	_ = c.PrintfLine("QUIT")
+	_, _ = c.ReadLine()
+	_ = c.Close()
+
+	return err
+}
+
+// playScriptAgainst an existing connection, does not handle server greeting
+func playScriptAgainst(t *testing.T, c *textproto.Conn, script []scriptStep) error {
+	for i, step := range script {
+		status, _, err := sendCommand(c, step.send)
+		if err != nil {
+			return fmt.Errorf("Step %d, sent %q: %v", i, step.send, err)
+		}
+		if !strings.HasPrefix(status+" ", step.expect+" ") {
+			return fmt.Errorf("Step %d, sent %q, expected %v, got %q",
+				i, step.send, step.expect, status)
+		}
+	}
+	return nil
+}
+
+// sendCommand sends cmd and reads the status line of the reply, followed by the lines of a
+// successful multi-line reply
+func sendCommand(c *textproto.Conn, cmd string) (status string, lines []string, err error) {
+	if err = c.PrintfLine("%s", cmd); err != nil {
+		return "", nil, err
+	}
+	if status, err = c.ReadLine(); err != nil {
+		return "", nil, err
+	}
+	if strings.HasPrefix(status, "+OK") && multiline(cmd) {
+		lines, err = c.ReadDotLines()
+	}
+	return status, lines, err
+}
+
+// hasLine returns true if lines contains line
+func hasLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// multiline returns true if a successful reply to cmd spans multiple lines
+func multiline(cmd string) bool {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return false
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CAPA", "RETR", "TOP":
+		return true
+	case "LIST", "UIDL", "AUTH":
+		return len(args) == 1
+	}
+	return false
+}
+
+// net.Pipe does not implement deadlines
+type mockConn struct {
+	net.Conn
+}
+
+func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// setupPOP3Server creates a server with the default test configuration, tests may change its
+// settings before starting sessions
+func setupPOP3Server(ds smtpd.DataStore) (s *Server, buf *bytes.Buffer, teardown func()) {
+	// Capture log output
+	buf = new(bytes.Buffer)
+	log.SetOutput(buf)
+
+	// Create a server, don't start it
+	shutdownChan := make(chan bool)
+	teardown = func() {
+		close(shutdownChan)
+	}
+	s = &Server{
+		domain:         "inbucket.local",
+		maxIdleSeconds: 5,
+		apopSecrets:    map[string]string{},
+		passwords:      map[string]string{},
+		deleteMode:     "normal",
+		expire:         "NEVER",
+		dataStore:      ds,
+		globalShutdown: shutdownChan,
+		waitgroup:      new(sync.WaitGroup),
+	}
+	return s, buf, teardown
+}
+
+var sessionNum int
+
+// setupPOP3Session starts a session over a pipe, returning the client end
+func setupPOP3Session(server *Server) net.Conn {
+	// Pair of pipes to communicate
+	serverConn, clientConn := net.Pipe()
+	// Start the session
+	server.waitgroup.Add(1)
+	sessionNum++
+	go server.startSession(sessionNum, &mockConn{serverConn})
+
+	return clientConn
+}
+
+// writeTestCert generates a self-signed certificate and key, returning their paths
+func writeTestCert(t *testing.T) (certFile, keyFile string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "inbucket-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(dir)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "inbucket.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cleanup
+}
+
+// remoteAddrConn reports a fixed remote address for a test connection
+type remoteAddrConn struct {
+	mockConn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+// setupPOP3SessionFrom starts a session that appears to originate from ip
+func setupPOP3SessionFrom(server *Server, ip string) net.Conn {
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	sessionNum++
+	conn := &remoteAddrConn{mockConn{serverConn}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 110}}
+	go server.startSession(sessionNum, conn)
+
+	return clientConn
+}
@@ -2,8 +2,11 @@ package pop3d
 
 import (
 	"context"
+	"crypto/tls"
+	"expvar"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,12 +19,34 @@ import (
 type Server struct {
 	domain         string
 	maxIdleSeconds int
+	tlsConfig      *tls.Config       // nil if STLS is disabled
+	apopSecrets    map[string]string // Secret by mailbox, see apopValid
+	passwords      map[string]string // Password by mailbox, "*" for the default
+	deleteMode     string            // normal, readonly or retr
+	transcripts    bool              // Log session transcripts
+	sessionLimit   *sessionLimiter   // nil if sessions are unlimited
+	logins         *loginTracker     // nil if LOGIN-DELAY is not enforced
+	loginDelay     int               // LOGIN-DELAY in seconds
+	expire         string            // EXPIRE capability argument, days or NEVER
 	dataStore      smtpd.DataStore
 	listener       net.Listener
+	tlsListener    net.Listener // Incoming POP3S connections, nil if disabled
 	globalShutdown chan bool
 	waitgroup      *sync.WaitGroup
 }
 
+var (
+	// Raw stat collectors
+	expConnectsTotal   = new(expvar.Int)
+	expConnectsCurrent = new(expvar.Int)
+	expLoginsTotal     = new(expvar.Int)
+	expLoginFailures   = new(expvar.Int)
+	expRetrievedTotal  = new(expvar.Int)
+	expBytesSent       = new(expvar.Int) // Message data sent by RETR and TOP
+	expErrorsTotal     = new(expvar.Int)
+	expWarnsTotal      = new(expvar.Int)
+)
+
 // New creates a new Server struct
 func New(shutdownChan chan bool) *Server {
 	// Get a new instance of the the FileDataStore - the locking and counting
@@ -30,15 +55,46 @@ func New(shutdownChan chan bool) *Server {
 	// instance.
 	ds := smtpd.DefaultFileDataStore()
 	cfg := config.GetPOP3Config()
+	var tlsConfig *tls.Config
+	if cfg.STLSEnabled {
+		smtpCfg := config.GetSMTPConfig()
+		cert, err := tls.LoadX509KeyPair(smtpCfg.TLSCert, smtpCfg.TLSPrivKey)
+		if err != nil {
+			log.Errorf("Failed to load TLS certificate/key, STLS disabled: %v", err)
+		} else {
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
 	return &Server{
 		domain:         cfg.Domain,
 		dataStore:      ds,
 		maxIdleSeconds: cfg.MaxIdleSeconds,
+		tlsConfig:      tlsConfig,
+		apopSecrets:    mailboxCredentials(cfg.APOPSecrets),
+		passwords:      mailboxCredentials(cfg.Passwords),
+		deleteMode:     cfg.DeleteMode,
+		transcripts:    cfg.Transcripts,
+		sessionLimit:   newSessionLimiter(cfg.MaxSessions, cfg.MaxSessionsIP),
+		logins:         newLoginTracker(cfg.LoginDelay),
+		loginDelay:     cfg.LoginDelay,
+		expire:         expirePolicy(cfg.DeleteMode, config.GetDataStoreConfig().RetentionMinutes),
 		globalShutdown: shutdownChan,
 		waitgroup:      new(sync.WaitGroup),
 	}
 }
 
+// expirePolicy returns the RFC 2449 EXPIRE argument: the number of days messages are kept
+// before the retention scanner may delete them, 0 if RETR deletes them, or NEVER
+func expirePolicy(deleteMode string, retentionMinutes int) string {
+	if deleteMode == "retr" {
+		return "0"
+	}
+	if retentionMinutes <= 0 {
+		return "NEVER"
+	}
+	return strconv.Itoa(retentionMinutes / (24 * 60))
+}
+
 // Start the server and listen for connections
 func (s *Server) Start(ctx context.Context) {
 	cfg := config.GetPOP3Config()
@@ -57,9 +113,25 @@ func (s *Server) Start(ctx context.Context) {
 		s.emergencyShutdown()
 		return
 	}
+	if cfg.ProxyProtocol {
+		log.Infof("POP3 connections must begin with a PROXY protocol header")
+		s.listener = smtpd.NewProxyListener(s.listener,
+			time.Duration(s.maxIdleSeconds)*time.Second)
+	}
 
-	// Listener go routine
-	go s.serve(ctx)
+	if cfg.TLSEnabled {
+		if err := s.listenTLS(cfg); err != nil {
+			log.Errorf("POP3S failed to start listener: %v", err)
+			s.emergencyShutdown()
+			return
+		}
+	}
+
+	// Listener go routines
+	go s.serve(ctx, s.listener)
+	if s.tlsListener != nil {
+		go s.serve(ctx, s.tlsListener)
+	}
 
 	// Wait for shutdown
 	select {
@@ -71,14 +143,46 @@ func (s *Server) Start(ctx context.Context) {
 	if err := s.listener.Close(); err != nil {
 		log.Errorf("Error closing POP3 listener: %v", err)
 	}
+	if s.tlsListener != nil {
+		if err := s.tlsListener.Close(); err != nil {
+			log.Errorf("Error closing POP3S listener: %v", err)
+		}
+	}
+}
+
+// listenTLS opens the implicit TLS listener, the TLS handshake takes place when a session
+// first reads from or writes to its connection
+func (s *Server) listenTLS(cfg config.POP3Config) error {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSPrivKey)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v", cfg.IP4address, cfg.TLSPort))
+	if err != nil {
+		return err
+	}
+	log.Infof("POP3S listening on TCP4 %v", addr)
+	listener, err := net.ListenTCP("tcp4", addr)
+	if err != nil {
+		return err
+	}
+	s.tlsListener = listener
+	if cfg.ProxyProtocol {
+		// The PROXY header precedes the TLS handshake
+		s.tlsListener = smtpd.NewProxyListener(s.tlsListener,
+			time.Duration(s.maxIdleSeconds)*time.Second)
+	}
+	s.tlsListener = tls.NewListener(s.tlsListener,
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+	return nil
 }
 
 // serve is the listen/accept loop
-func (s *Server) serve(ctx context.Context) {
+func (s *Server) serve(ctx context.Context, listener net.Listener) {
 	// Handle incoming connections
 	var tempDelay time.Duration
 	for sid := 1; ; sid++ {
-		if conn, err := s.listener.Accept(); err != nil {
+		if conn, err := listener.Accept(); err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 				// Temporary error, sleep for a bit and try again
 				if tempDelay == 0 {
@@ -127,3 +231,15 @@ func (s *Server) Drain() {
 	s.waitgroup.Wait()
 	log.Tracef("POP3 connections have drained")
 }
+
+func init() {
+	m := expvar.NewMap("pop3")
+	m.Set("ConnectsTotal", expConnectsTotal)
+	m.Set("ConnectsCurrent", expConnectsCurrent)
+	m.Set("LoginsTotal", expLoginsTotal)
+	m.Set("LoginFailuresTotal", expLoginFailures)
+	m.Set("RetrievedTotal", expRetrievedTotal)
+	m.Set("BytesSentTotal", expBytesSent)
+	m.Set("ErrorsTotal", expErrorsTotal)
+	m.Set("WarnsTotal", expWarnsTotal)
+}
@@ -0,0 +1,51 @@
+package pop3d
+
+import (
+	"sync"
+	"time"
+)
+
+// loginTracker enforces the RFC 2449 LOGIN-DELAY, the minimum time between logins to each
+// mailbox.  A nil loginTracker allows every login.
+type loginTracker struct {
+	mu        sync.Mutex
+	delay     time.Duration
+	last      map[string]time.Time // Time of the most recent login by mailbox name
+	lastSweep time.Time
+}
+
+// newLoginTracker creates a loginTracker, returns nil if seconds is not positive
+func newLoginTracker(seconds int) *loginTracker {
+	if seconds <= 0 {
+		return nil
+	}
+	return &loginTracker{
+		delay: time.Duration(seconds) * time.Second,
+		last:  make(map[string]time.Time),
+	}
+}
+
+// allow records a login to the named mailbox at now, returning false without recording it if
+// the previous login was too recent
+func (t *loginTracker) allow(name string, now time.Time) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastSweep) >= t.delay {
+		// Discard logins that no longer delay anything
+		t.lastSweep = now
+		for key, last := range t.last {
+			if now.Sub(last) >= t.delay {
+				delete(t.last, key)
+			}
+		}
+	}
+	if last, ok := t.last[name]; ok && now.Sub(last) < t.delay {
+		return false
+	}
+	t.last[name] = now
+	return true
+}
@@ -0,0 +1,53 @@
+package pop3d
+
+import "sync"
+
+// sessionLimiter caps the number of concurrent sessions, both in total and for each remote
+// IP address.  A nil sessionLimiter allows everything.
+type sessionLimiter struct {
+	mu     sync.Mutex
+	max    int // Total sessions, 0 is unlimited
+	perIP  int // Sessions per remote IP, 0 is unlimited
+	total  int
+	byHost map[string]int
+}
+
+// newSessionLimiter creates a sessionLimiter, returns nil if both limits are unlimited
+func newSessionLimiter(max, perIP int) *sessionLimiter {
+	if max <= 0 && perIP <= 0 {
+		return nil
+	}
+	return &sessionLimiter{max: max, perIP: perIP, byHost: make(map[string]int)}
+}
+
+// acquire reserves a session for host, returning false if a limit has been reached.  Each
+// successful acquire must be paired with a release.
+func (l *sessionLimiter) acquire(host string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+	if l.perIP > 0 && l.byHost[host] >= l.perIP {
+		return false
+	}
+	l.total++
+	l.byHost[host]++
+	return true
+}
+
+// release frees a session previously acquired for host
+func (l *sessionLimiter) release(host string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.byHost[host]--; l.byHost[host] <= 0 {
+		delete(l.byHost, host)
+	}
+}
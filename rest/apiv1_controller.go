@@ -3,20 +3,36 @@ package rest
 import (
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
 
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jhillyerd/enmime"
+	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/httpd"
 	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/msghub"
 	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/jhillyerd/inbucket/sanitize"
+	"github.com/jhillyerd/inbucket/search"
 	"github.com/jhillyerd/inbucket/smtpd"
 )
 
-// MailboxListV1 renders a list of messages in a mailbox
+// MailboxListV1 renders a list of messages in a mailbox.  The auth-user query parameter
+// limits the list to messages sent by that SMTP AUTH identity, or unauthenticated messages if
+// it is empty.
 func MailboxListV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
@@ -34,10 +50,169 @@ func MailboxListV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context)
 		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
 	}
 	log.Tracef("Got %v messsages", len(messages))
+	authUser, filtered := req.URL.Query()["auth-user"]
 
-	jmessages := make([]*model.JSONMessageHeaderV1, len(messages))
-	for i, msg := range messages {
-		jmessages[i] = &model.JSONMessageHeaderV1{
+	jmessages := make([]*model.JSONMessageHeaderV1, 0, len(messages))
+	for _, msg := range messages {
+		delivery := msg.Delivery()
+		if filtered && delivery.AuthUser != authUser[0] {
+			continue
+		}
+		jmessages = append(jmessages, &model.JSONMessageHeaderV1{
+			Mailbox:  name,
+			ID:       msg.ID(),
+			From:     msg.From(),
+			To:       msg.To(),
+			Subject:  msg.Subject(),
+			Date:     msg.Date(),
+			Size:     msg.Size(),
+			AuthUser: delivery.AuthUser,
+			Seen:     smtpd.HasFlag(msg, smtpd.FlagSeen),
+			Flagged:  smtpd.HasFlag(msg, smtpd.FlagFlagged),
+		})
+	}
+	return httpd.RenderJSONConditional(w, req, jmessages, time.Time{})
+}
+
+// MailboxInjectV1 stores a message in a mailbox without SMTP, and renders its header.  A
+// request with a JSON content type describes the message with a JSONInjectV1, otherwise the
+// request body is stored as the raw message source.
+func MailboxInjectV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var body io.Reader = req.Body
+	if max := config.GetSMTPConfig().MaxMessageBytes; max > 0 {
+		body = http.MaxBytesReader(w, req.Body, int64(max))
+	}
+	var raw []byte
+	var delivery smtpd.Delivery
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var inject model.JSONInjectV1
+		if err := json.NewDecoder(body).Decode(&inject); err != nil {
+			http.Error(w, "Unable to parse message: "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		raw = buildMessage(&inject, time.Now())
+		delivery.MailFrom = inject.From
+		delivery.Recipients = inject.To
+	} else {
+		if raw, err = ioutil.ReadAll(body); err != nil {
+			http.Error(w, "Unable to read message: "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if len(raw) == 0 {
+			http.Error(w, "Message source is required", http.StatusBadRequest)
+			return nil
+		}
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		delivery.RemoteAddr = host
+	}
+
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	msg, err := storeMessage(ctx, name, mb, delivery, raw)
+	if err != nil {
+		return err
+	}
+	log.Tracef("HTTP injected message %q into %q", msg.ID(), name)
+
+	return httpd.RenderJSON(w, &model.JSONMessageHeaderV1{
+		Mailbox:  name,
+		ID:       msg.ID(),
+		From:     msg.From(),
+		To:       msg.To(),
+		Subject:  msg.Subject(),
+		Date:     msg.Date(),
+		Size:     msg.Size(),
+		AuthUser: delivery.AuthUser,
+	})
+}
+
+// MailboxImportV1 loads the messages of an uploaded mbox file, or ZIP archive of .eml files
+// when the format query parameter is zip, into a mailbox and renders their headers.  Nothing is
+// stored unless every message can be read.
+func MailboxImportV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "mbox"
+	}
+	if format != "mbox" && format != "zip" {
+		http.Error(w, fmt.Sprintf("Unknown format %q, must be mbox or zip", format),
+			http.StatusBadRequest)
+		return nil
+	}
+	maxUpload := ctx.WebConfig.ImportMaxBytes
+	var body io.Reader = req.Body
+	if maxUpload > 0 {
+		body = http.MaxBytesReader(w, req.Body, int64(maxUpload))
+	}
+	upload, err := ioutil.ReadAll(body)
+	if err != nil {
+		if maxUpload > 0 && len(upload) >= maxUpload {
+			http.Error(w, fmt.Sprintf("Upload is larger than %v bytes", maxUpload),
+				http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		http.Error(w, "Unable to read upload: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	max := config.GetSMTPConfig().MaxMessageBytes
+	var imported []importedMessage
+	if format == "zip" {
+		imported, err = readZip(upload, max, maxUpload)
+	} else {
+		imported = readMbox(upload)
+	}
+	if _, ok := err.(*importSizeError); ok {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, "Unable to read upload: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if len(imported) == 0 {
+		http.Error(w, "Upload contains no messages", http.StatusBadRequest)
+		return nil
+	}
+	for i, m := range imported {
+		if max > 0 && len(m.raw) > max {
+			http.Error(w, fmt.Sprintf("Message %v is larger than %v bytes", i+1, max),
+				http.StatusRequestEntityTooLarge)
+			return nil
+		}
+	}
+
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	var remoteAddr string
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		remoteAddr = host
+	}
+	headers := make([]*model.JSONMessageHeaderV1, 0, len(imported))
+	for _, m := range imported {
+		msg, err := storeMessage(ctx, name, mb,
+			smtpd.Delivery{MailFrom: m.mailFrom, RemoteAddr: remoteAddr}, m.raw)
+		if err != nil {
+			return err
+		}
+		headers = append(headers, &model.JSONMessageHeaderV1{
 			Mailbox: name,
 			ID:      msg.ID(),
 			From:    msg.From(),
@@ -45,9 +220,37 @@ func MailboxListV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context)
 			Subject: msg.Subject(),
 			Date:    msg.Date(),
 			Size:    msg.Size(),
-		}
+		})
 	}
-	return httpd.RenderJSON(w, jmessages)
+	log.Tracef("HTTP imported %v messages into %q", len(headers), name)
+	return httpd.RenderJSON(w, headers)
+}
+
+// storeMessage writes raw to a new message in mb, the mailbox called name, and announces its
+// arrival
+func storeMessage(ctx *httpd.Context, name string, mb smtpd.Mailbox, delivery smtpd.Delivery,
+	raw []byte) (smtpd.Message, error) {
+	msg, err := mb.NewMessage()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create message in %q: %v", name, err)
+	}
+	msg.SetDelivery(delivery)
+	if err := msg.Append(raw); err != nil {
+		return nil, fmt.Errorf("Failed to append to mailbox %q: %v", name, err)
+	}
+	if err := msg.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to close message for %q: %v", name, err)
+	}
+	ctx.MsgHub.Dispatch(msghub.Message{
+		Mailbox: name,
+		ID:      msg.ID(),
+		From:    msg.From(),
+		To:      msg.To(),
+		Subject: msg.Subject(),
+		Date:    msg.Date(),
+		Size:    msg.Size(),
+	})
+	return msg, nil
 }
 
 // MailboxShowV1 renders a particular message from a mailbox
@@ -72,13 +275,24 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context)
 		// This doesn't indicate empty, likely an IO error
 		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
 	}
+	message, err := jsonMessage(req, name, msg)
+	if err != nil {
+		return err
+	}
+	return httpd.RenderJSONConditional(w, req, message, msg.Date())
+}
+
+// jsonMessage converts a message in the named mailbox to JSON
+func jsonMessage(req *http.Request, name string, msg smtpd.Message) (*model.JSONMessageV1,
+	error) {
+	id := msg.ID()
 	header, err := msg.ReadHeader()
 	if err != nil {
-		return fmt.Errorf("ReadHeader(%q) failed: %v", id, err)
+		return nil, fmt.Errorf("ReadHeader(%q) failed: %v", id, err)
 	}
 	mime, err := msg.ReadBody()
 	if err != nil {
-		return fmt.Errorf("ReadBody(%q) failed: %v", id, err)
+		return nil, fmt.Errorf("ReadBody(%q) failed: %v", id, err)
 	}
 
 	attachments := make([]*model.JSONMessageAttachmentV1, len(mime.Attachments))
@@ -95,36 +309,243 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context)
 		}
 	}
 
-	return httpd.RenderJSON(w,
-		&model.JSONMessageV1{
-			Mailbox: name,
-			ID:      msg.ID(),
-			From:    msg.From(),
-			To:      msg.To(),
-			Subject: msg.Subject(),
-			Date:    msg.Date(),
-			Size:    msg.Size(),
-			Header:  header.Header,
-			Body: &model.JSONMessageBodyV1{
-				Text: mime.Text,
-				HTML: mime.HTML,
-			},
-			Attachments: attachments,
-		})
+	delivery := msg.Delivery()
+	dkim := make([]*model.JSONDKIMResultV1, len(delivery.DKIM))
+	for i, r := range delivery.DKIM {
+		dkim[i] = &model.JSONDKIMResultV1{
+			Domain:   r.Domain,
+			Selector: r.Selector,
+			Result:   string(r.Result),
+			Reason:   r.Reason,
+		}
+	}
+
+	return &model.JSONMessageV1{
+		Mailbox:  name,
+		ID:       msg.ID(),
+		From:     msg.From(),
+		To:       msg.To(),
+		Subject:  msg.Subject(),
+		Date:     msg.Date(),
+		Size:     msg.Size(),
+		AuthUser: delivery.AuthUser,
+		Seen:     smtpd.HasFlag(msg, smtpd.FlagSeen),
+		Flagged:  smtpd.HasFlag(msg, smtpd.FlagFlagged),
+		Header:   header.Header,
+		Body: &model.JSONMessageBodyV1{
+			Text: mime.Text,
+			HTML: mime.HTML,
+		},
+		Attachments: attachments,
+		DKIM:        dkim,
+		Envelope: &model.JSONEnvelopeV1{
+			MailFrom:   delivery.MailFrom,
+			RcptTo:     delivery.Recipients,
+			MailParams: delivery.MailParams,
+			RcptParams: delivery.RcptParams,
+			Helo:       delivery.Helo,
+			RemoteAddr: delivery.RemoteAddr,
+			Added:      delivery.AddedHeaders,
+		},
+	}, nil
+}
+
+// MailboxHeadersV1 renders every header field of a message, keyed by canonical field name.
+// Encoded words in the values are decoded.
+func MailboxHeadersV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	msg, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	header, err := msg.ReadHeader()
+	if err != nil {
+		return fmt.Errorf("ReadHeader(%q) failed: %v", id, err)
+	}
+
+	dec := new(mime.WordDecoder)
+	fields := make(map[string][]string, len(header.Header))
+	for key, values := range header.Header {
+		decoded := make([]string, len(values))
+		for i, v := range values {
+			if decoded[i], err = dec.DecodeHeader(v); err != nil {
+				// Leave undecodable values as they are
+				decoded[i] = v
+			}
+		}
+		fields[key] = decoded
+	}
+	return httpd.RenderJSONConditional(w, req, fields, msg.Date())
+}
+
+const (
+	// Time MailboxWaitV1 waits for a message when no timeout is given
+	defaultWaitTimeout = 30 * time.Second
+
+	// Longest timeout accepted by MailboxWaitV1, it must be less than the server write timeout
+	maxWaitTimeout = 50 * time.Second
+)
+
+// messageWaiter receives the IDs of messages delivered to a mailbox from the msghub
+type messageWaiter struct {
+	mailbox string
+	c       chan string
+}
+
+// Receive queues the ID of a message delivered to the mailbox, it implements msghub.Listener
+func (mw *messageWaiter) Receive(msg msghub.Message) error {
+	if msg.Mailbox != mw.mailbox {
+		return nil
+	}
+	select {
+	case mw.c <- msg.ID:
+	default:
+		log.Warnf("HTTP wait queue for %v full, dropped %v", mw.mailbox, msg.ID)
+	}
+	return nil
+}
+
+// MailboxWaitV1 renders the newest message in a mailbox matching the filter query parameters
+// of MailboxPurgeV1, waiting for one to be delivered if there is none.  The timeout query
+// parameter sets how long to wait, 404 is returned if no message arrives within it.
+func MailboxWaitV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	query := req.URL.Query()
+	timeout := defaultWaitTimeout
+	if v := query.Get("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > maxWaitTimeout {
+			http.Error(w, fmt.Sprintf("Invalid timeout %q, must be a duration up to %v", v,
+				maxWaitTimeout), http.StatusBadRequest)
+			return nil
+		}
+	}
+	query.Del("timeout")
+	filter := messageFilter(func(smtpd.Message) bool { return true })
+	if len(query) > 0 {
+		if filter, err = parseMessageFilter(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	// Listen before looking in the mailbox, so that no delivery is missed
+	mw := &messageWaiter{mailbox: name, c: make(chan string, 100)}
+	ctx.MsgHub.AddLiveListener(mw)
+	defer ctx.MsgHub.RemoveListener(mw)
+
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	messages, err := mb.GetMessages()
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+	}
+	var found smtpd.Message
+	for _, msg := range messages {
+		if filter(msg) && (found == nil || !msg.Date().Before(found.Date())) {
+			found = msg
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for found == nil {
+		select {
+		case id := <-mw.c:
+			msg, err := mb.GetMessage(id)
+			if err == smtpd.ErrNotExist {
+				// Deleted since it was delivered
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+			}
+			if filter(msg) {
+				found = msg
+			}
+		case <-timer.C:
+			http.Error(w, fmt.Sprintf("No matching message within %v", timeout),
+				http.StatusNotFound)
+			return nil
+		case <-req.Context().Done():
+			// Client went away
+			return nil
+		}
+	}
+	message, err := jsonMessage(req, name, found)
+	if err != nil {
+		return err
+	}
+	return httpd.RenderJSON(w, message)
 }
 
-// MailboxPurgeV1 deletes all messages from a mailbox
+// MailboxPurgeV1 deletes all messages from a mailbox.  If any of the older-than, from, subject
+// or domain query parameters are given, only messages matching all of them are deleted, and
+// the number deleted is rendered.  older-than is a duration such as 90m, from matches part of
+// the sender ignoring case, subject is a regular expression, and domain matches messages with
+// a recipient in that domain.
 func MailboxPurgeV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
 	if err != nil {
 		return err
 	}
+	query := req.URL.Query()
+	var filter messageFilter
+	if len(query) > 0 {
+		if filter, err = parseMessageFilter(query); err != nil {
+			// An unusable filter must never fall back to a purge
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
 	mb, err := ctx.DataStore.MailboxFor(name)
 	if err != nil {
 		// This doesn't indicate not found, likely an IO error
 		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
 	}
+	if filter != nil {
+		messages, err := mb.GetMessages()
+		if err != nil {
+			// This doesn't indicate empty, likely an IO error
+			return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+		}
+		deleted := 0
+		for _, msg := range messages {
+			if !filter(msg) {
+				continue
+			}
+			if err := msg.Delete(); err != nil {
+				return fmt.Errorf("Delete(%q) failed: %v", msg.ID(), err)
+			}
+			deleted++
+		}
+		log.Tracef("HTTP deleted %v messages matching %v from %q", deleted, query, name)
+		return httpd.RenderJSON(w, &model.JSONDeleteResultV1{Deleted: deleted})
+	}
 	// Delete all messages
 	err = mb.Purge()
 	if err != nil {
@@ -135,7 +556,245 @@ func MailboxPurgeV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context
 	return httpd.RenderJSON(w, "OK")
 }
 
-// MailboxSourceV1 displays the raw source of a message, including headers. Renders text/plain
+// mailboxesByName implements sort.Interface to order mailbox summaries by name
+type mailboxesByName []*model.JSONMailboxV1
+
+func (s mailboxesByName) Len() int           { return len(s) }
+func (s mailboxesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s mailboxesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// MailboxIndexV1 renders every mailbox in the datastore, ordered by name, with its message
+// count, total size and the date of its newest message.
+func MailboxIndexV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	mailboxes, err := ctx.DataStore.AllMailboxes()
+	if err != nil {
+		return fmt.Errorf("Failed to get mailboxes: %v", err)
+	}
+	summaries := make([]*model.JSONMailboxV1, 0, len(mailboxes))
+	for _, mb := range mailboxes {
+		name := mb.Name()
+		if name == "" {
+			// Stored by an older version of Inbucket, the name is unknown
+			continue
+		}
+		if !mailboxVisible(req, ctx, name) {
+			continue
+		}
+		messages, err := mb.GetMessages()
+		if err != nil {
+			// This doesn't indicate empty, likely an IO error
+			return fmt.Errorf("Failed to get messages for %v: %v", mb, err)
+		}
+		summary := &model.JSONMailboxV1{Name: name, Count: len(messages)}
+		for _, msg := range messages {
+			summary.Size += msg.Size()
+			if date := msg.Date(); summary.Newest == nil || date.After(*summary.Newest) {
+				summary.Newest = &date
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Sort(mailboxesByName(summaries))
+
+	return httpd.RenderJSONConditional(w, req, summaries, time.Time{})
+}
+
+type mailboxStatsByName []*model.JSONMailboxStatsV1
+
+func (s mailboxStatsByName) Len() int           { return len(s) }
+func (s mailboxStatsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s mailboxStatsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// StatsV1 renders message counts and sizes for every mailbox and in total, the number of
+// stored messages received in the last five minutes, hour and day, and retention deletes.
+func StatsV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	mailboxes, err := ctx.DataStore.AllMailboxes()
+	if err != nil {
+		return fmt.Errorf("Failed to get mailboxes: %v", err)
+	}
+	now := time.Now()
+	stats := &model.JSONStatsV1{
+		Retention: model.JSONRetentionStatsV1{
+			Period: config.GetDataStoreConfig().RetentionMinutes,
+		},
+		Mailboxes: make([]*model.JSONMailboxStatsV1, 0, len(mailboxes)),
+	}
+	stats.Retention.Deletes, stats.Retention.DeletesInHour = smtpd.RetentionDeletes()
+	for _, mb := range mailboxes {
+		messages, err := mb.GetMessages()
+		if err != nil {
+			// This doesn't indicate empty, likely an IO error
+			return fmt.Errorf("Failed to get messages for %v: %v", mb, err)
+		}
+		mbStats := &model.JSONMailboxStatsV1{Name: mb.Name(), Count: len(messages)}
+		for _, msg := range messages {
+			mbStats.Size += msg.Size()
+			age := now.Sub(msg.Date())
+			if age < 5*time.Minute {
+				mbStats.Received.FiveMinutes++
+			}
+			if age < time.Hour {
+				mbStats.Received.Hour++
+			}
+			if age < 24*time.Hour {
+				mbStats.Received.Day++
+			}
+		}
+		stats.Count += mbStats.Count
+		stats.Size += mbStats.Size
+		stats.Received.FiveMinutes += mbStats.Received.FiveMinutes
+		stats.Received.Hour += mbStats.Received.Hour
+		stats.Received.Day += mbStats.Received.Day
+		if mbStats.Name == "" || !mailboxVisible(req, ctx, mbStats.Name) {
+			// Stored by an older version of Inbucket or private, counted only in the totals
+			continue
+		}
+		stats.Mailboxes = append(stats.Mailboxes, mbStats)
+	}
+	sort.Sort(mailboxStatsByName(stats.Mailboxes))
+	return httpd.RenderJSON(w, stats)
+}
+
+// MailboxesPurgeV1 deletes the messages in every mailbox, and renders the number deleted.  The
+// filter query parameters of MailboxPurgeV1 limit the messages deleted.  Requires the admin
+// token.
+func MailboxesPurgeV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	if !checkAdmin(w, req, ctx) {
+		return nil
+	}
+	query := req.URL.Query()
+	var filter messageFilter
+	if len(query) > 0 {
+		if filter, err = parseMessageFilter(query); err != nil {
+			// An unusable filter must never fall back to a purge
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+	mailboxes, err := ctx.DataStore.AllMailboxes()
+	if err != nil {
+		return fmt.Errorf("Failed to get mailboxes: %v", err)
+	}
+	deleted := 0
+	for _, mb := range mailboxes {
+		messages, err := mb.GetMessages()
+		if err != nil {
+			// This doesn't indicate empty, likely an IO error
+			return fmt.Errorf("Failed to get messages for %v: %v", mb, err)
+		}
+		if filter == nil {
+			if err := mb.Purge(); err != nil {
+				return fmt.Errorf("Mailbox(%v) purge failed: %v", mb, err)
+			}
+			deleted += len(messages)
+			continue
+		}
+		for _, msg := range messages {
+			if !filter(msg) {
+				continue
+			}
+			if err := msg.Delete(); err != nil {
+				return fmt.Errorf("Delete(%q) failed: %v", msg.ID(), err)
+			}
+			deleted++
+		}
+	}
+	log.Infof("HTTP admin deleted %v messages from %v mailboxes matching %v", deleted,
+		len(mailboxes), query)
+
+	return httpd.RenderJSON(w, &model.JSONDeleteResultV1{Deleted: deleted})
+}
+
+// messageFilter returns true for messages that should be deleted
+type messageFilter func(msg smtpd.Message) bool
+
+// parseMessageFilter builds a filter matching all of the older-than, from, subject and domain
+// query parameters, any other parameter is an error
+func parseMessageFilter(query url.Values) (messageFilter, error) {
+	var filters []messageFilter
+	for key := range query {
+		value := query.Get(key)
+		switch key {
+		case "older-than":
+			age, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid older-than: %v", err)
+			}
+			filters = append(filters, func(msg smtpd.Message) bool {
+				return time.Since(msg.Date()) > age
+			})
+		case "from":
+			from := strings.ToLower(value)
+			filters = append(filters, func(msg smtpd.Message) bool {
+				return strings.Contains(strings.ToLower(msg.From()), from)
+			})
+		case "domain":
+			domain := strings.ToLower(value)
+			filters = append(filters, func(msg smtpd.Message) bool {
+				return hasRecipientDomain(msg, domain)
+			})
+		case "subject":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid subject: %v", err)
+			}
+			filters = append(filters, func(msg smtpd.Message) bool {
+				return re.MatchString(msg.Subject())
+			})
+		default:
+			return nil, fmt.Errorf("Unknown filter %q", key)
+		}
+	}
+	return func(msg smtpd.Message) bool {
+		for _, f := range filters {
+			if !f(msg) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// MailboxExportV1 streams every message in a mailbox as a single download.  The format query
+// parameter selects an mbox file, the default, or a ZIP archive of .eml files.
+func MailboxExportV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "mbox"
+	}
+	if format != "mbox" && format != "zip" {
+		http.Error(w, fmt.Sprintf("Unknown format %q, must be mbox or zip", format),
+			http.StatusBadRequest)
+		return nil
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	messages, err := mb.GetMessages()
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": name + "." + format}))
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		return writeZip(w, messages)
+	}
+	w.Header().Set("Content-Type", "application/mbox")
+	return writeMbox(w, messages)
+}
+
+// MailboxSourceV1 streams the raw source of a message, exactly as stored, including headers.
+// Renders message/rfc822 with a filename of the message ID and an .eml extension
 func MailboxSourceV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	id := ctx.Vars["id"]
@@ -157,20 +816,26 @@ func MailboxSourceV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Contex
 		// This doesn't indicate missing, likely an IO error
 		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
 	}
-	raw, err := message.ReadRaw()
+	raw, err := message.RawReader()
 	if err != nil {
-		return fmt.Errorf("ReadRaw(%q) failed: %v", id, err)
+		return fmt.Errorf("RawReader(%q) failed: %v", id, err)
 	}
+	defer func() {
+		_ = raw.Close()
+	}()
 
-	w.Header().Set("Content-Type", "text/plain")
-	if _, err := io.WriteString(w, *raw); err != nil {
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": id + ".eml"}))
+	if _, err := io.Copy(w, raw); err != nil {
 		return err
 	}
 	return nil
 }
 
-// MailboxDeleteV1 removes a particular message from a mailbox
-func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+// MailboxTranscriptV1 displays the SMTP transcript recorded when a message was delivered,
+// which is empty if transcripts are disabled. Renders text/plain
+func MailboxTranscriptV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	id := ctx.Vars["id"]
 	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
@@ -191,10 +856,750 @@ func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Contex
 		// This doesn't indicate missing, likely an IO error
 		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
 	}
-	err = message.Delete()
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := io.WriteString(w, message.Delivery().Transcript); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MailboxDeliveryV1 renders the details of the SMTP session that delivered a message: the
+// client address and HELO, TLS and AUTH details, and when it was received
+func MailboxDeliveryV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
 	if err != nil {
-		return fmt.Errorf("Delete(%q) failed: %v", id, err)
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+
+	delivery := message.Delivery()
+	return httpd.RenderJSONConditional(w, req, &model.JSONDeliveryV1{
+		Received:      message.Date(),
+		SessionID:     delivery.SessionID,
+		Protocol:      delivery.Protocol,
+		RemoteAddr:    delivery.RemoteAddr,
+		Helo:          delivery.Helo,
+		TLSVersion:    delivery.TLSVersion,
+		TLSCipher:     delivery.TLSCipher,
+		ClientCert:    delivery.ClientCert,
+		AuthUser:      delivery.AuthUser,
+		AuthMechanism: delivery.AuthMechanism,
+		MailFrom:      delivery.MailFrom,
+		RcptTo:        delivery.Recipients,
+	}, message.Date())
+}
+
+// MailboxAttachmentV1 streams the decoded content of an attachment, numbered from zero in the
+// order they appear in the message.  The declared content type is used unless it is missing or
+// generic, in which case the type is sniffed from the content.
+func MailboxAttachmentV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	num, err := strconv.ParseUint(ctx.Vars["index"], 10, 32)
+	if err != nil {
+		http.Error(w, "Attachment index must be unsigned numeric", http.StatusBadRequest)
+		return nil
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	body, err := message.ReadBody()
+	if err != nil {
+		return fmt.Errorf("ReadBody(%q) failed: %v", id, err)
+	}
+	if num >= uint64(len(body.Attachments)) {
+		http.NotFound(w, req)
+		return nil
+	}
+	part := body.Attachments[num]
+
+	contentType := part.ContentType
+	if contentType == "" || strings.EqualFold(contentType, "application/octet-stream") {
+		contentType = http.DetectContentType(part.Content)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(part.Content)))
+	disposition := "attachment"
+	if part.FileName != "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{
+			"filename": part.FileName,
+		})
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	if _, err := w.Write(part.Content); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MailboxHTMLV1 renders the HTML body of a message with scripts, forms and anything loaded from
+// other servers removed, so that it is safe to display, along with a list of what was removed
+func MailboxHTMLV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	body, err := message.ReadBody()
+	if err != nil {
+		return fmt.Errorf("ReadBody(%q) failed: %v", id, err)
+	}
+	if body.HTML == "" {
+		http.Error(w, "Message has no HTML body", http.StatusNotFound)
+		return nil
+	}
+	safe, removed, err := sanitize.HTML(body.HTML)
+	if err != nil {
+		return fmt.Errorf("Failed to sanitize HTML of %q: %v", id, err)
+	}
+	result := &model.JSONSanitizedHTMLV1{
+		HTML:    safe,
+		Removed: make([]*model.JSONRemovalV1, len(removed)),
+	}
+	for i, r := range removed {
+		result.Removed[i] = &model.JSONRemovalV1{Kind: r.Kind, Name: r.Name, Value: r.Value}
+	}
+	return httpd.RenderJSONConditional(w, req, result, message.Date())
+}
+
+// MailboxTextV1 renders the plain text body of a message as text/plain.  Messages without a
+// text/plain part have their HTML body converted to text instead.
+func MailboxTextV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	body, err := message.ReadBody()
+	if err != nil {
+		return fmt.Errorf("ReadBody(%q) failed: %v", id, err)
+	}
+	text := body.Text
+	if body.HTML != "" && !hasTextPart(body.Root) {
+		text = sanitize.HTMLToText(body.HTML)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, text); err != nil {
+		return err
+	}
+	return nil
+}
+
+// hasTextPart returns true if part or any of its descendants is an inline text/plain part
+func hasTextPart(part *enmime.Part) bool {
+	if part == nil {
+		return false
+	}
+	if part.ContentType == "text/plain" && part.Disposition != "attachment" {
+		return true
+	}
+	for child := part.FirstChild; child != nil; child = child.NextSibling {
+		if hasTextPart(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// MailboxDiffV1 renders the differences between a message and the message named by the with
+// query parameter, found in the mailbox named by the mailbox parameter or the same mailbox.
+// Header fields that differ between deliveries are not compared unless ignore parameters name
+// the fields to skip instead; an empty ignore parameter compares every field.
+func MailboxDiffV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	query := req.URL.Query()
+	otherID := query.Get("with")
+	if otherID == "" {
+		http.Error(w, "The with parameter must name the message to compare with",
+			http.StatusBadRequest)
+		return nil
+	}
+	otherName := name
+	if v := query.Get("mailbox"); v != "" {
+		if otherName, err = smtpd.ParseMailboxName(v); err != nil {
+			return err
+		}
+		if !checkMailboxVisible(w, req, ctx, otherName) {
+			return nil
+		}
+	}
+	ignore := diffIgnoredHeaders
+	if v, ok := query["ignore"]; ok {
+		ignore = v
+	}
+
+	var headers [2]*mail.Message
+	var bodies [2]*enmime.Envelope
+	for i, ref := range [2][2]string{{name, id}, {otherName, otherID}} {
+		mb, err := ctx.DataStore.MailboxFor(ref[0])
+		if err != nil {
+			// This doesn't indicate not found, likely an IO error
+			return fmt.Errorf("Failed to get mailbox for %q: %v", ref[0], err)
+		}
+		msg, err := mb.GetMessage(ref[1])
+		if err == smtpd.ErrNotExist {
+			http.NotFound(w, req)
+			return nil
+		}
+		if err != nil {
+			// This doesn't indicate missing, likely an IO error
+			return fmt.Errorf("GetMessage(%q) failed: %v", ref[1], err)
+		}
+		if headers[i], err = msg.ReadHeader(); err != nil {
+			return fmt.Errorf("ReadHeader(%q) failed: %v", ref[1], err)
+		}
+		if bodies[i], err = msg.ReadBody(); err != nil {
+			return fmt.Errorf("ReadBody(%q) failed: %v", ref[1], err)
+		}
+	}
+
+	diff := &model.JSONMessageDiffV1{
+		Headers: make([]*model.JSONHeaderDiffV1, 0),
+		Text:    jsonLineDiff(lineDiff(splitLines(bodies[0].Text), splitLines(bodies[1].Text))),
+		HTML:    jsonLineDiff(lineDiff(splitLines(bodies[0].HTML), splitLines(bodies[1].HTML))),
+	}
+	for _, c := range headerDiff(headers[0].Header, headers[1].Header, ignore) {
+		diff.Headers = append(diff.Headers, &model.JSONHeaderDiffV1{Name: c.Name, A: c.A, B: c.B})
+	}
+	diff.Equal = len(diff.Headers) == 0 && len(diff.Text) == 0 && len(diff.HTML) == 0
+	return httpd.RenderJSON(w, diff)
+}
+
+// jsonLineDiff converts the changes found by lineDiff to JSON
+func jsonLineDiff(changes []lineChange) []*model.JSONLineDiffV1 {
+	result := make([]*model.JSONLineDiffV1, len(changes))
+	for i, c := range changes {
+		result[i] = &model.JSONLineDiffV1{Op: c.Op, Line: c.Line, Text: c.Text}
+	}
+	return result
+}
+
+// MailboxPartsV1 renders the MIME structure of a message as a tree of parts.  The root part
+// has an empty path, its children are numbered from one, and deeper parts append their number
+// to the path of their parent separated by a period, ex: 1.2
+func MailboxPartsV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	body, err := message.ReadBody()
+	if err != nil {
+		return fmt.Errorf("ReadBody(%q) failed: %v", id, err)
+	}
+	if body.Root == nil {
+		return fmt.Errorf("Message %q has no MIME structure", id)
+	}
+	return httpd.RenderJSONConditional(w, req, jsonPart(body.Root, ""),
+		message.Date())
+}
+
+// jsonPart converts a MIME part and its descendants to JSON
+func jsonPart(part *enmime.Part, path string) *model.JSONMIMEPartV1 {
+	jpart := &model.JSONMIMEPartV1{
+		Path:        path,
+		ContentType: part.ContentType,
+		Charset:     part.Charset,
+		Disposition: part.Disposition,
+		FileName:    part.FileName,
+		ContentID:   part.ContentID,
+		Size:        len(part.Content),
+		Parts:       make([]*model.JSONMIMEPartV1, 0),
+	}
+	n := 1
+	for child := part.FirstChild; child != nil; child = child.NextSibling {
+		childPath := strconv.Itoa(n)
+		if path != "" {
+			childPath = path + "." + childPath
+		}
+		jpart.Parts = append(jpart.Parts, jsonPart(child, childPath))
+		n++
+	}
+	return jpart
+}
+
+// MailboxDeleteV1 removes a particular message from a mailbox
+func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	err = message.Delete()
+	if err != nil {
+		return fmt.Errorf("Delete(%q) failed: %v", id, err)
 	}
 
 	return httpd.RenderJSON(w, "OK")
 }
+
+// MailboxFlagsV1 sets or clears the seen and flagged flags of a message, as given by the JSON
+// request body, and renders the resulting flags
+func MailboxFlagsV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var update model.JSONMessageFlagsV1
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+		http.Error(w, "Unable to parse flags request: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	flags := message.Flags()
+	if update.Seen != nil {
+		flags = smtpd.WithFlag(flags, smtpd.FlagSeen, *update.Seen)
+	}
+	if update.Flagged != nil {
+		flags = smtpd.WithFlag(flags, smtpd.FlagFlagged, *update.Flagged)
+	}
+	if err := message.SetFlags(flags); err != nil {
+		return fmt.Errorf("SetFlags(%q) failed: %v", id, err)
+	}
+	seen := smtpd.HasFlag(message, smtpd.FlagSeen)
+	flagged := smtpd.HasFlag(message, smtpd.FlagFlagged)
+	return httpd.RenderJSON(w, &model.JSONMessageFlagsV1{Seen: &seen, Flagged: &flagged})
+}
+
+// MailboxReleaseV1 re-sends a message to the addresses in the JSON request body, through the
+// upstream SMTP server configured by relay.host
+func MailboxReleaseV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var release model.JSONReleaseV1
+	if err := json.NewDecoder(req.Body).Decode(&release); err != nil {
+		http.Error(w, "Unable to parse release request: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if len(release.To) == 0 {
+		http.Error(w, "At least one recipient is required", http.StatusBadRequest)
+		return nil
+	}
+	for _, to := range release.To {
+		if _, _, err := smtpd.ParseEmailAddress(to); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid recipient %q: %v", to, err), http.StatusBadRequest)
+			return nil
+		}
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	err = smtpd.ReleaseMessage(config.GetSMTPConfig(), message, release.To)
+	if err == smtpd.ErrReleaseDisabled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Release of %q failed: %v", id, err)
+	}
+	log.Tracef("HTTP released message %q from %q to %v", id, name, release.To)
+
+	return httpd.RenderJSON(w, "OK")
+}
+
+// MailboxCopyV1 copies a message to the mailbox named by the JSON request body, and renders
+// the header of the copy
+func MailboxCopyV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	return transferMessage(w, req, ctx, false)
+}
+
+// MailboxMoveV1 moves a message to the mailbox named by the JSON request body, and renders its
+// header in the new mailbox
+func MailboxMoveV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	return transferMessage(w, req, ctx, true)
+}
+
+// transferMessage copies a message to another mailbox, deleting the original if move is set.
+// The new message is announced to monitors like a delivery.
+func transferMessage(w http.ResponseWriter, req *http.Request, ctx *httpd.Context,
+	move bool) error {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var transfer model.JSONTransferV1
+	if err := json.NewDecoder(req.Body).Decode(&transfer); err != nil {
+		http.Error(w, "Unable to parse request: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	destName, err := smtpd.ParseMailboxName(transfer.Mailbox)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid mailbox %q: %v", transfer.Mailbox, err),
+			http.StatusBadRequest)
+		return nil
+	}
+	if move && destName == name {
+		http.Error(w, "Message is already in mailbox "+name, http.StatusBadRequest)
+		return nil
+	}
+	// authorized only checks the mailbox in the path, a private destination needs its token
+	if !checkMailboxVisible(w, req, ctx, destName) {
+		return nil
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	dest, err := ctx.DataStore.MailboxFor(destName)
+	if err != nil {
+		return fmt.Errorf("Failed to get mailbox for %q: %v", destName, err)
+	}
+	copied, err := dest.CopyMessage(message)
+	if err != nil {
+		return fmt.Errorf("CopyMessage(%q) to %q failed: %v", id, destName, err)
+	}
+	if move {
+		if err := message.Delete(); err != nil {
+			return fmt.Errorf("Delete(%q) failed: %v", id, err)
+		}
+	}
+	log.Tracef("HTTP copied message %q from %q to %q as %q", id, name, destName, copied.ID())
+	ctx.MsgHub.Dispatch(msghub.Message{
+		Mailbox: destName,
+		ID:      copied.ID(),
+		From:    copied.From(),
+		To:      copied.To(),
+		Subject: copied.Subject(),
+		Date:    copied.Date(),
+		Size:    copied.Size(),
+	})
+
+	return httpd.RenderJSON(w, &model.JSONMessageHeaderV1{
+		Mailbox:  destName,
+		ID:       copied.ID(),
+		From:     copied.From(),
+		To:       copied.To(),
+		Subject:  copied.Subject(),
+		Date:     copied.Date(),
+		Size:     copied.Size(),
+		AuthUser: copied.Delivery().AuthUser,
+		Seen:     smtpd.HasFlag(copied, smtpd.FlagSeen),
+		Flagged:  smtpd.HasFlag(copied, smtpd.FlagFlagged),
+	})
+}
+
+// searchIndex answers MessageSearchV1 queries when the search index is enabled
+var searchIndex *search.Index
+
+// SetSearchIndex makes MessageSearchV1 query index instead of reading every message.  It should
+// be called before the HTTP server is started.
+func SetSearchIndex(index *search.Index) {
+	searchIndex = index
+}
+
+// MessageSearchV1 renders the headers of messages whose subject, from, to or body text contain
+// the q query parameter, ignoring case.  The mailbox query parameter limits the search to a
+// single mailbox, otherwise every mailbox is searched.  When the search index is enabled, q
+// is split into words, each of which must begin a word of the message or its text attachments.
+func MessageSearchV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	query := req.URL.Query()
+	term := strings.ToLower(query.Get("q"))
+	if term == "" {
+		http.Error(w, "The q parameter is required", http.StatusBadRequest)
+		return nil
+	}
+	var name string
+	if query.Get("mailbox") != "" {
+		name, err = smtpd.ParseMailboxName(query.Get("mailbox"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if !checkMailboxVisible(w, req, ctx, name) {
+			return nil
+		}
+	}
+	var jmessages []*model.JSONMessageHeaderV1
+	if searchIndex != nil {
+		jmessages, err = indexSearch(ctx.DataStore, term, name)
+	} else {
+		jmessages, err = scanSearch(ctx.DataStore, term, name)
+	}
+	if err != nil {
+		return err
+	}
+	// Leave out private mailboxes the request has no token for
+	visible := jmessages[:0]
+	for _, jm := range jmessages {
+		if mailboxVisible(req, ctx, jm.Mailbox) {
+			visible = append(visible, jm)
+		}
+	}
+	jmessages = visible
+	log.Tracef("Search for %q matched %v messages", term, len(jmessages))
+	return httpd.RenderJSON(w, jmessages)
+}
+
+// indexSearch finds messages matching term with the search index, limited to the named
+// mailbox if name is not empty
+func indexSearch(ds smtpd.DataStore, term, name string) ([]*model.JSONMessageHeaderV1, error) {
+	jmessages := make([]*model.JSONMessageHeaderV1, 0)
+	mailboxes := make(map[string]smtpd.Mailbox)
+	for _, ref := range searchIndex.Search(term) {
+		if name != "" && ref.Mailbox != name {
+			continue
+		}
+		mb := mailboxes[ref.Mailbox]
+		if mb == nil {
+			var err error
+			if mb, err = ds.MailboxFor(ref.Mailbox); err != nil {
+				// This doesn't indicate not found, likely an IO error
+				return nil, fmt.Errorf("Failed to get mailbox for %q: %v", ref.Mailbox, err)
+			}
+			mailboxes[ref.Mailbox] = mb
+		}
+		msg, err := mb.GetMessage(ref.ID)
+		if err == smtpd.ErrNotExist {
+			// Deleted while the index was not watching
+			if err := searchIndex.Remove(ref); err != nil {
+				log.Errorf("Failed to remove %v/%v from search index: %v", ref.Mailbox, ref.ID, err)
+			}
+			continue
+		}
+		if err != nil {
+			// This doesn't indicate missing, likely an IO error
+			return nil, fmt.Errorf("GetMessage(%q) failed: %v", ref.ID, err)
+		}
+		jmessages = append(jmessages, searchResult(mb, msg))
+	}
+	return jmessages, nil
+}
+
+// scanSearch finds messages matching term by reading every message, or those in the named
+// mailbox if name is not empty
+func scanSearch(ds smtpd.DataStore, term, name string) ([]*model.JSONMessageHeaderV1, error) {
+	var mailboxes []smtpd.Mailbox
+	if name != "" {
+		mb, err := ds.MailboxFor(name)
+		if err != nil {
+			// This doesn't indicate not found, likely an IO error
+			return nil, fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+		}
+		mailboxes = []smtpd.Mailbox{mb}
+	} else {
+		var err error
+		if mailboxes, err = ds.AllMailboxes(); err != nil {
+			return nil, fmt.Errorf("Failed to get mailboxes: %v", err)
+		}
+	}
+
+	jmessages := make([]*model.JSONMessageHeaderV1, 0)
+	for _, mb := range mailboxes {
+		messages, err := mb.GetMessages()
+		if err != nil {
+			// This doesn't indicate empty, likely an IO error
+			return nil, fmt.Errorf("Failed to get messages for %v: %v", mb, err)
+		}
+		for _, msg := range messages {
+			match, err := messageContains(msg, term)
+			if err != nil {
+				// One unreadable message should not fail the whole search
+				log.Errorf("Failed to search %v: %v", msg, err)
+				continue
+			}
+			if match {
+				jmessages = append(jmessages, searchResult(mb, msg))
+			}
+		}
+	}
+	return jmessages, nil
+}
+
+// searchResult returns the JSON header of a message found by a search
+func searchResult(mb smtpd.Mailbox, msg smtpd.Message) *model.JSONMessageHeaderV1 {
+	return &model.JSONMessageHeaderV1{
+		Mailbox:  mb.Name(),
+		ID:       msg.ID(),
+		From:     msg.From(),
+		To:       msg.To(),
+		Subject:  msg.Subject(),
+		Date:     msg.Date(),
+		Size:     msg.Size(),
+		AuthUser: msg.Delivery().AuthUser,
+		Seen:     smtpd.HasFlag(msg, smtpd.FlagSeen),
+		Flagged:  smtpd.HasFlag(msg, smtpd.FlagFlagged),
+	}
+}
+
+// hasRecipientDomain returns true if any recipient of msg is in the lower case domain, the To
+// header is used for messages stored without their envelope recipients
+func hasRecipientDomain(msg smtpd.Message, domain string) bool {
+	recipients := msg.Delivery().Recipients
+	if len(recipients) == 0 {
+		recipients = msg.To()
+	}
+	return hasDomain(recipients, domain)
+}
+
+// hasDomain returns true if any of the addresses is in the lower case domain
+func hasDomain(addresses []string, domain string) bool {
+	for _, recip := range addresses {
+		if addr, err := mail.ParseAddress(recip); err == nil {
+			recip = addr.Address
+		}
+		at := strings.LastIndex(recip, "@")
+		if at >= 0 && strings.ToLower(recip[at+1:]) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// messageContains returns true if the subject, from, to, body text or HTML body with its tags
+// stripped of msg contain the lower case term, the body is only read if the header fields do
+// not match
+func messageContains(msg smtpd.Message, term string) (bool, error) {
+	fields := []string{msg.Subject(), msg.From(), strings.Join(msg.To(), ", ")}
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), term) {
+			return true, nil
+		}
+	}
+	body, err := msg.ReadBody()
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(strings.ToLower(body.Text), term) {
+		return true, nil
+	}
+	return strings.Contains(strings.ToLower(sanitize.HTMLToText(body.HTML)), term), nil
+}
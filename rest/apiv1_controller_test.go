@@ -1,32 +1,50 @@
 package rest
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jhillyerd/enmime"
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/mailauth"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/search"
 	"github.com/jhillyerd/inbucket/smtpd"
+	"github.com/stretchr/testify/mock"
 )
 
 const (
 	baseURL = "http://localhost/api/v1"
 
 	// JSON map keys
-	mailboxKey = "mailbox"
-	idKey      = "id"
-	fromKey    = "from"
-	toKey      = "to"
-	subjectKey = "subject"
-	dateKey    = "date"
-	sizeKey    = "size"
-	headerKey  = "header"
-	bodyKey    = "body"
-	textKey    = "text"
-	htmlKey    = "html"
+	mailboxKey  = "mailbox"
+	idKey       = "id"
+	fromKey     = "from"
+	toKey       = "to"
+	subjectKey  = "subject"
+	dateKey     = "date"
+	sizeKey     = "size"
+	headerKey   = "header"
+	bodyKey     = "body"
+	textKey     = "text"
+	htmlKey     = "html"
+	dkimKey     = "dkim"
+	envelopeKey = "envelope"
+	authUserKey = "auth-user"
 )
 
 func TestRestMailboxList(t *testing.T) {
@@ -100,12 +118,13 @@ func TestRestMailboxList(t *testing.T) {
 		Date:    time.Date(2012, 2, 1, 10, 11, 12, 253, time.FixedZone("PST", -800)),
 	}
 	data2 := &InputMessageData{
-		Mailbox: "good",
-		ID:      "0002",
-		From:    "from2",
-		To:      []string{"to1"},
-		Subject: "subject 2",
-		Date:    time.Date(2012, 7, 1, 10, 11, 12, 253, time.FixedZone("PDT", -700)),
+		Mailbox:  "good",
+		ID:       "0002",
+		From:     "from2",
+		To:       []string{"to1"},
+		Subject:  "subject 2",
+		Date:     time.Date(2012, 7, 1, 10, 11, 12, 253, time.FixedZone("PDT", -700)),
+		AuthUser: "svc",
 	}
 	goodbox := &MockMailbox{}
 	ds.On("MailboxFor", "good").Return(goodbox, nil)
@@ -145,6 +164,34 @@ func TestRestMailboxList(t *testing.T) {
 		}
 	}
 
+	// Check filtering by authenticated sender
+	for _, tc := range []struct {
+		query string
+		want  *InputMessageData
+	}{
+		{"?auth-user=svc", data2},
+		{"?auth-user=", data1},
+	} {
+		w, err = testRestGet(baseURL + "/mailbox/good" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = nil
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Errorf("Failed to decode JSON: %v", err)
+		}
+		if len(result) != 1 {
+			t.Errorf("Expected 1 result for %q, got %v", tc.query, len(result))
+			continue
+		}
+		if errors := tc.want.CompareToJSONHeaderMap(result[0]); len(errors) > 0 {
+			t.Logf("%v", result[0])
+			for _, e := range errors {
+				t.Error(e)
+			}
+		}
+	}
+
 	if t.Failed() {
 		// Wait for handler to finish logging
 		time.Sleep(2 * time.Second)
@@ -227,6 +274,14 @@ func TestRestMessage(t *testing.T) {
 		},
 		Text: "This is some text",
 		HTML: "This is some HTML",
+		DKIM: []mailauth.DKIMResult{
+			{Domain: "example.com", Selector: "sel", Result: mailauth.DKIMPass},
+			{Domain: "example.org", Selector: "old", Result: mailauth.DKIMFail,
+				Reason: "body hash did not verify"},
+		},
+		MailFrom: "sender@example.com",
+		Helo:     "mx.example.com",
+		RcptTo:   []string{"good@inbucket.local", "other@inbucket.local"},
 	}
 	goodbox := &MockMailbox{}
 	ds.On("MailboxFor", "good").Return(goodbox, nil)
@@ -264,3 +319,1439 @@ func TestRestMessage(t *testing.T) {
 		_, _ = io.Copy(os.Stderr, logbuf)
 	}
 }
+
+func TestRestMessageAttachment(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	pdf := []byte("%PDF-1.4\n%binary\xe2\xe3\n")
+	data := &InputMessageData{
+		Mailbox: "good",
+		ID:      "0001",
+		Attachments: []*enmime.Part{
+			{ContentType: "text/csv", FileName: "report 1.csv", Content: []byte("a,b\n1,2\n")},
+			{ContentType: "application/octet-stream", FileName: "doc.pdf", Content: pdf},
+			{Content: []byte("plain")},
+		},
+	}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(data.MockMessage(), nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+
+	for _, tc := range []struct {
+		path, contentType, disposition string
+		content                        []byte
+	}{
+		{"/0", "text/csv", `attachment; filename="report 1.csv"`, []byte("a,b\n1,2\n")},
+		{"/1", "application/pdf", "attachment; filename=doc.pdf", pdf},
+		{"/2", "text/plain; charset=utf-8", "attachment", []byte("plain")},
+	} {
+		w, err := testRestGet(baseURL + "/mailbox/good/0001/attach" + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Errorf("Expected code 200 for %v, got %v", tc.path, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.contentType {
+			t.Errorf("Expected Content-Type %q for %v, got %q", tc.contentType, tc.path, got)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tc.disposition {
+			t.Errorf("Expected Content-Disposition %q for %v, got %q", tc.disposition, tc.path,
+				got)
+		}
+		if got := w.Body.Bytes(); !bytes.Equal(got, tc.content) {
+			t.Errorf("Expected content %q for %v, got %q", tc.content, tc.path, got)
+		}
+	}
+
+	// Test missing attachments and messages
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/0001/attach/3", 404},
+		{"/0001/attach/x", 400},
+		{"/0002/attach/0", 404},
+	} {
+		w, err := testRestGet(baseURL + "/mailbox/good" + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tc.code {
+			t.Errorf("Expected code %v for %v, got %v", tc.code, tc.path, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageSource(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	source := "From: a@example.com\r\nSubject: raw\r\n\r\nBody \xff\r\n"
+	msg := &MockMessage{}
+	msg.On("RawReader").Return(ioutil.NopCloser(strings.NewReader(source)), nil)
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(msg, nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+
+	w, err := testRestGet(baseURL + "/mailbox/good/0001/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if got, want := w.Header().Get("Content-Type"), "message/rfc822"; got != want {
+		t.Errorf("Expected Content-Type %q, got %q", want, got)
+	}
+	if got, want := w.Header().Get("Content-Disposition"),
+		"attachment; filename=0001.eml"; got != want {
+		t.Errorf("Expected Content-Disposition %q, got %q", want, got)
+	}
+	if got := w.Body.String(); got != source {
+		t.Errorf("Expected source %q, got %q", source, got)
+	}
+
+	// Test missing message
+	w, err = testRestGet(baseURL + "/mailbox/good/0002/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxExport(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessages").Return([]smtpd.Message{
+		exportMessage("0001", "a@example.com", "Subject: one\r\n\r\nBody\r\n"),
+	}, nil)
+
+	w, err := testRestGet(baseURL + "/mailbox/good/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/mbox"; got != want {
+		t.Errorf("Expected Content-Type %q, got %q", want, got)
+	}
+	if got, want := w.Header().Get("Content-Disposition"),
+		"attachment; filename=good.mbox"; got != want {
+		t.Errorf("Expected Content-Disposition %q, got %q", want, got)
+	}
+	want := "From a@example.com Thu Nov  2 14:04:05 2017\nSubject: one\n\nBody\n\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("Expected mbox %q, got %q", want, got)
+	}
+
+	w, err = testRestGet(baseURL + "/mailbox/good/export?format=zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/zip"; got != want {
+		t.Errorf("Expected Content-Type %q, got %q", want, got)
+	}
+
+	// Test unknown format
+	w, err = testRestGet(baseURL + "/mailbox/good/export?format=tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 {
+		t.Errorf("Expected code 400, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxWait(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	older := &InputMessageData{Mailbox: "good", ID: "0001", Subject: "Welcome",
+		Date: time.Date(2017, 11, 20, 10, 0, 0, 0, time.UTC)}
+	newer := &InputMessageData{Mailbox: "good", ID: "0002", Subject: "Welcome back",
+		Date: time.Date(2017, 11, 21, 10, 0, 0, 0, time.UTC)}
+	other := &InputMessageData{Mailbox: "good", ID: "0003", Subject: "Other",
+		Date: time.Date(2017, 11, 22, 10, 0, 0, 0, time.UTC)}
+	arrival := &InputMessageData{Mailbox: "later", ID: "0004", Subject: "Reset password",
+		Date: time.Date(2017, 11, 23, 10, 0, 0, 0, time.UTC)}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessages").Return([]smtpd.Message{
+		older.MockMessage(), newer.MockMessage(), other.MockMessage()}, nil)
+	ready := make(chan struct{})
+	laterbox := &MockMailbox{}
+	ds.On("MailboxFor", "later").Return(laterbox, nil)
+	laterbox.On("GetMessages").Return([]smtpd.Message{}, nil).Run(func(mock.Arguments) {
+		close(ready)
+	})
+	laterbox.On("GetMessage", "0004").Return(arrival.MockMessage(), nil)
+
+	// Test a matching message already in the mailbox
+	w, err := testRestGet(baseURL + "/mailbox/good/wait?subject=^Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"id":"0002"`) {
+		t.Errorf("Expected message 0002, got %v", w.Body.String())
+	}
+
+	// Test invalid timeouts
+	for _, timeout := range []string{"forever", "-1s", "1h"} {
+		w, err = testRestGet(baseURL + "/mailbox/good/wait?timeout=" + timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for timeout %v, got %v", timeout, w.Code)
+		}
+	}
+
+	// Test timing out
+	w, err = testRestGet(baseURL + "/mailbox/good/wait?subject=password&timeout=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	// Test waiting for a delivery
+	hub := msghub.New(context.Background(), 10)
+	req, err := http.NewRequest("GET", baseURL+"/mailbox/later/wait?subject=password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &httpd.Context{Vars: map[string]string{"name": "later"}, DataStore: ds, MsgHub: hub}
+	w = httptest.NewRecorder()
+	done := make(chan error)
+	go func() {
+		done <- MailboxWaitV1(w, req, ctx)
+	}()
+	// The handler has registered with the hub once it lists the mailbox
+	<-ready
+	hub.Dispatch(msghub.Message{Mailbox: "good", ID: "0009"})
+	hub.Dispatch(msghub.Message{Mailbox: "later", ID: "0004"})
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for MailboxWaitV1")
+	}
+	if !strings.Contains(w.Body.String(), `"id":"0004"`) {
+		t.Errorf("Expected message 0004, got %v", w.Body.String())
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageHeaders(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	data := &InputMessageData{
+		Mailbox: "good",
+		ID:      "0001",
+		Header: mail.Header{
+			"Subject":    []string{"=?utf-8?q?Caf=C3=A9?="},
+			"Received":   []string{"from a", "from b"},
+			"X-Mailer":   []string{"test"},
+			"Message-Id": []string{"<1@example.com>"},
+		},
+	}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(data.MockMessage(), nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+
+	w, err := testRestGet(baseURL + "/mailbox/good/0001/headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	want := `{"Message-Id":["\u003c1@example.com\u003e"],"Received":["from a","from b"],` +
+		`"Subject":["Café"],"X-Mailer":["test"]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	w, err = testRestGet(baseURL + "/mailbox/good/0002/headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageDelivery(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	zone := time.FixedZone("", -7*60*60)
+	msg := &MockMessage{}
+	msg.On("Date").Return(time.Date(2017, 11, 21, 10, 30, 5, 0, zone))
+	msg.On("Delivery").Return(smtpd.Delivery{
+		MailFrom:      "from@example.com",
+		Recipients:    []string{"good@example.com"},
+		AuthUser:      "joe",
+		AuthMechanism: "PLAIN",
+		RemoteAddr:    "192.0.2.1",
+		Helo:          "client.example.com",
+		SessionID:     42,
+		Protocol:      "ESMTPSA",
+		TLSVersion:    "TLS1.2",
+		TLSCipher:     "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	})
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(msg, nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+
+	w, err := testRestGet(baseURL + "/mailbox/good/0001/delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	want := `{"received":"2017-11-21T10:30:05-07:00","session-id":42,"protocol":"ESMTPSA",` +
+		`"remote-addr":"192.0.2.1","helo":"client.example.com","tls-version":"TLS1.2",` +
+		`"tls-cipher":"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256","client-cert":"",` +
+		`"auth-user":"joe","auth-mechanism":"PLAIN","mail-from":"from@example.com",` +
+		`"rcpt-to":["good@example.com"]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	w, err = testRestGet(baseURL + "/mailbox/good/0002/delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageDiff(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	first := &InputMessageData{
+		ID: "0001",
+		Header: mail.Header{
+			"Subject": {"Your code"},
+			"Date":    {"Mon, 02 Jan 2017 15:04:05 +0000"},
+		},
+		Text: "Your code is 1234\r\nThanks\r\n",
+		HTML: "<p>1234</p>",
+	}
+	second := &InputMessageData{
+		ID: "0002",
+		Header: mail.Header{
+			"Subject": {"Your new code"},
+			"Date":    {"Tue, 03 Jan 2017 15:04:05 +0000"},
+		},
+		Text: "Your code is 5678\r\nThanks\r\n",
+		HTML: "<p>1234</p>",
+	}
+	goodbox := &MockMailbox{}
+	otherbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	ds.On("MailboxFor", "other").Return(otherbox, nil)
+	goodbox.On("GetMessage", "0001").Return(first.MockMessage(), nil)
+	goodbox.On("GetMessage", "0002").Return(second.MockMessage(), nil)
+	goodbox.On("GetMessage", "0003").Return(&MockMessage{}, smtpd.ErrNotExist)
+	otherbox.On("GetMessage", "0001").Return(first.MockMessage(), nil)
+
+	w, err := testRestGet(baseURL + "/mailbox/good/0001/diff?with=0002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	want := `{"equal":false,"headers":[` +
+		`{"name":"Subject","a":["Your code"],"b":["Your new code"]}],` +
+		`"text":[{"op":"-","line":1,"text":"Your code is 1234"},` +
+		`{"op":"+","line":1,"text":"Your code is 5678"}],"html":[]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Messages in another mailbox, comparing every header
+	w, err = testRestGet(baseURL + "/mailbox/good/0001/diff?with=0001&mailbox=other&ignore=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"equal":true,"headers":[],"text":[],"html":[]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Test missing message and parameter
+	w, err = testRestGet(baseURL + "/mailbox/good/0001/diff?with=0003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+	w, err = testRestGet(baseURL + "/mailbox/good/0001/diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 {
+		t.Errorf("Expected code 400, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageHTML(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	data := &InputMessageData{
+		Mailbox: "good",
+		ID:      "0001",
+		HTML:    `<p>Hi<script>alert(1)</script><img src="http://evil/t.gif"></p>`,
+	}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(data.MockMessage(), nil)
+	goodbox.On("GetMessage", "0002").Return((&InputMessageData{ID: "0002"}).MockMessage(), nil)
+
+	w, err := testRestGet(baseURL + "/mailbox/good/0001/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	want := `{"html":"\u003cp\u003eHi\u003cimg\u003e\u003c/p\u003e","removed":[` +
+		`{"kind":"element","name":"script"},` +
+		`{"kind":"external","name":"src","value":"http://evil/t.gif"}]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Text only messages have no HTML body
+	w, err = testRestGet(baseURL + "/mailbox/good/0002/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageText(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	htmlOnly := &InputMessageData{
+		ID:   "0001",
+		HTML: `<p>Your code is <b>1234</b></p><p><a href="https://example.com/">Log in</a></p>`,
+		Root: &enmime.Part{ContentType: "text/html"},
+	}
+	withText := &InputMessageData{
+		ID:   "0002",
+		Text: "Plain version",
+		HTML: "<p>HTML version</p>",
+		Root: &enmime.Part{ContentType: "multipart/alternative"},
+	}
+	withText.Root.FirstChild = &enmime.Part{ContentType: "text/plain", Parent: withText.Root}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(htmlOnly.MockMessage(), nil)
+	goodbox.On("GetMessage", "0002").Return(withText.MockMessage(), nil)
+
+	for id, want := range map[string]string{
+		"0001": "Your code is 1234\n\nLog in (https://example.com/)",
+		"0002": "Plain version",
+	} {
+		w, err := testRestGet(baseURL + "/mailbox/good/" + id + "/text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200, got %v", w.Code)
+		}
+		if got := w.Body.String(); got != want {
+			t.Errorf("Expected text of %v to be %q, got %q", id, want, got)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageParts(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	// multipart/mixed containing multipart/alternative and an attachment
+	text := &enmime.Part{ContentType: "text/plain", Charset: "utf-8", Content: []byte("hi")}
+	html := &enmime.Part{ContentType: "text/html", Charset: "utf-8", Content: []byte("<p>hi</p>")}
+	alt := &enmime.Part{ContentType: "multipart/alternative", FirstChild: text}
+	text.Parent, html.Parent, text.NextSibling = alt, alt, html
+	attach := &enmime.Part{ContentType: "application/pdf", Disposition: "attachment",
+		FileName: "doc.pdf", ContentID: "<doc@example>", Content: []byte("%PDF")}
+	root := &enmime.Part{ContentType: "multipart/mixed", FirstChild: alt}
+	alt.Parent, attach.Parent, alt.NextSibling = root, root, attach
+
+	data := &InputMessageData{Mailbox: "good", ID: "0001", Root: root}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(data.MockMessage(), nil)
+
+	w, err := testRestGet(baseURL + "/mailbox/good/0001/parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	want := `{"path":"","content-type":"multipart/mixed","charset":"","disposition":"",` +
+		`"filename":"","content-id":"","size":0,"parts":[` +
+		`{"path":"1","content-type":"multipart/alternative","charset":"","disposition":"",` +
+		`"filename":"","content-id":"","size":0,"parts":[` +
+		`{"path":"1.1","content-type":"text/plain","charset":"utf-8","disposition":"",` +
+		`"filename":"","content-id":"","size":2,"parts":[]},` +
+		`{"path":"1.2","content-type":"text/html","charset":"utf-8","disposition":"",` +
+		`"filename":"","content-id":"","size":9,"parts":[]}]},` +
+		`{"path":"2","content-type":"application/pdf","charset":"","disposition":"attachment",` +
+		`"filename":"doc.pdf","content-id":"\u003cdoc@example\u003e","size":4,"parts":[]}]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected JSON:\n%v\ngot:\n%v", want, got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageInject(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	var msgs []*MockMessage
+	for i := 0; i < 2; i++ {
+		data := &InputMessageData{
+			Mailbox: "good",
+			ID:      fmt.Sprintf("000%v", i+1),
+			From:    "from1",
+			To:      []string{"to1"},
+			Subject: "subject 1",
+			Date:    time.Date(2012, 2, 1, 10, 11, 12, 253, time.FixedZone("PST", -800)),
+		}
+		msg := data.MockMessage()
+		msg.On("SetDelivery", mock.Anything).Return()
+		msg.On("Close").Return(nil)
+		msgs = append(msgs, msg)
+	}
+	goodbox.On("NewMessage").Return(msgs[0], nil).Once()
+	goodbox.On("NewMessage").Return(msgs[1], nil).Once()
+
+	// Test JSON message
+	w, err := testRestPost(baseURL+"/mailbox/good",
+		`{"from":"a@example.com","to":["b@example.com"],"subject":"Hi","body":{"text":"Hello"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	var result map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	if result[idKey] != "0001" {
+		t.Errorf("Expected id 0001, got %v", result[idKey])
+	}
+	source := string(msgs[0].appended)
+	for _, want := range []string{"From: a@example.com\r\n", "To: b@example.com\r\n",
+		"Subject: Hi\r\n", "\r\n\r\nHello\r\n"} {
+		if !strings.Contains(source, want) {
+			t.Errorf("Expected message source to contain %q, got:\n%v", want, source)
+		}
+	}
+	msgs[0].AssertCalled(t, "SetDelivery", mock.MatchedBy(func(d smtpd.Delivery) bool {
+		return d.MailFrom == "a@example.com" && len(d.Recipients) == 1
+	}))
+
+	// Test raw message
+	raw := "From: c@example.com\r\nSubject: Raw\r\n\r\nBody\r\n"
+	w, err = testRestPostType(baseURL+"/mailbox/good", "message/rfc822", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if got := string(msgs[1].appended); got != raw {
+		t.Errorf("Expected raw message %q, got %q", raw, got)
+	}
+
+	// Test invalid requests
+	for _, tc := range []struct {
+		contentType, body string
+	}{
+		{"application/json", "{"},
+		{"message/rfc822", ""},
+	} {
+		w, err = testRestPostType(baseURL+"/mailbox/good", tc.contentType, tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %q, got %v", tc.body, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxImport(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	var msgs []*MockMessage
+	for i := 0; i < 2; i++ {
+		msg := (&InputMessageData{Mailbox: "good", ID: fmt.Sprintf("000%v", i+1)}).MockMessage()
+		msg.On("SetDelivery", mock.Anything).Return()
+		msg.On("Close").Return(nil)
+		msgs = append(msgs, msg)
+	}
+	goodbox.On("NewMessage").Return(msgs[0], nil).Once()
+	goodbox.On("NewMessage").Return(msgs[1], nil).Once()
+
+	mbox := "From a@example.com Thu Nov  2 14:04:05 2017\nSubject: one\n\nFirst\n\n" +
+		"From MAILER-DAEMON Thu Nov  2 14:04:05 2017\nSubject: two\n\nSecond\n\n"
+	w, err := testRestPostType(baseURL+"/mailbox/good/import", "application/mbox", mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	var result []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	if len(result) != 2 || result[0][idKey] != "0001" || result[1][idKey] != "0002" {
+		t.Errorf("Expected ids 0001 and 0002, got %v", result)
+	}
+	for i, want := range []string{"Subject: one\r\n\r\nFirst\r\n",
+		"Subject: two\r\n\r\nSecond\r\n"} {
+		if got := string(msgs[i].appended); got != want {
+			t.Errorf("Expected message %v source %q, got %q", i+1, want, got)
+		}
+	}
+	msgs[0].AssertCalled(t, "SetDelivery", mock.MatchedBy(func(d smtpd.Delivery) bool {
+		return d.MailFrom == "a@example.com"
+	}))
+	msgs[1].AssertCalled(t, "SetDelivery", mock.MatchedBy(func(d smtpd.Delivery) bool {
+		return d.MailFrom == ""
+	}))
+
+	// Test invalid requests, nothing is stored
+	for _, tc := range []struct {
+		url, body string
+	}{
+		{"/mailbox/good/import", ""},
+		{"/mailbox/good/import?format=zip", "not a zip"},
+		{"/mailbox/good/import?format=tar", mbox},
+	} {
+		w, err = testRestPostType(baseURL+tc.url, "application/octet-stream", tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %v, got %v", tc.url, w.Code)
+		}
+	}
+
+	// Test uploads and archive entries over the limit, nothing is stored
+	logbuf = setupWebServerConfig(ds, config.WebConfig{ImportMaxBytes: 1000})
+	zb := new(bytes.Buffer)
+	zw := zip.NewWriter(zb)
+	fw, err := zw.Create("0001.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write(bytes.Repeat([]byte("a"), 2000))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		url, body string
+	}{
+		{"/mailbox/good/import", mbox + strings.Repeat("Padding\n", 200)},
+		{"/mailbox/good/import?format=zip", zb.String()},
+	} {
+		w, err = testRestPostType(baseURL+tc.url, "application/octet-stream", tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 413 {
+			t.Errorf("Expected code 413 for %v, got %v", tc.url, w.Code)
+		}
+	}
+	goodbox.AssertNumberOfCalls(t, "NewMessage", 2)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxDeleteFiltered(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	now := time.Now()
+	var msgs []smtpd.Message
+	for i, d := range []struct {
+		from, subject string
+		age           time.Duration
+	}{
+		{"Fred <fred@example.com>", "Re: hello", 2 * time.Hour},
+		{"wilma@example.com", "Re: hello", 2 * time.Hour},
+		{"fred@example.com", "Report", 2 * time.Hour},
+		{"fred@example.com", "Re: recent", time.Minute},
+	} {
+		data := &InputMessageData{
+			Mailbox: "good",
+			ID:      fmt.Sprintf("000%v", i+1),
+			From:    d.from,
+			Subject: d.subject,
+			Date:    now.Add(-d.age),
+		}
+		msg := data.MockMessage()
+		msg.On("Delete").Return(nil)
+		msgs = append(msgs, msg)
+	}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessages").Return(msgs, nil)
+
+	w, err := testRestDelete(baseURL + "/mailbox/good?older-than=1h&from=FRED&subject=%5ERe:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"deleted":1}`; got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for i, msg := range msgs {
+		if i == 0 {
+			msg.(*MockMessage).AssertCalled(t, "Delete")
+		} else {
+			msg.(*MockMessage).AssertNotCalled(t, "Delete")
+		}
+	}
+
+	// Invalid filters must not purge the mailbox
+	for _, query := range []string{"?older-than=1x", "?subject=(", "?sender=fred"} {
+		w, err = testRestDelete(baseURL + "/mailbox/good" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %q, got %v", query, w.Code)
+		}
+	}
+	goodbox.AssertNotCalled(t, "Purge")
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxIndex(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	older := time.Date(2017, 11, 20, 10, 0, 0, 0, time.UTC)
+	newer := time.Date(2017, 11, 21, 10, 0, 0, 0, time.UTC)
+	zbox, abox, empty, legacy := &MockMailbox{}, &MockMailbox{}, &MockMailbox{}, &MockMailbox{}
+	zbox.On("Name").Return("zed")
+	zbox.On("GetMessages").Return([]smtpd.Message{
+		(&InputMessageData{ID: "0001", Date: newer, Size: 100}).MockMessage(),
+		(&InputMessageData{ID: "0002", Date: older, Size: 50}).MockMessage(),
+	}, nil)
+	abox.On("Name").Return("alpha")
+	abox.On("GetMessages").Return([]smtpd.Message{
+		(&InputMessageData{ID: "0003", Date: older, Size: 10}).MockMessage(),
+	}, nil)
+	empty.On("Name").Return("empty")
+	empty.On("GetMessages").Return([]smtpd.Message{}, nil)
+	legacy.On("Name").Return("")
+	ds.On("AllMailboxes").Return([]smtpd.Mailbox{zbox, abox, empty, legacy}, nil)
+
+	// Test mailbox summaries
+	w, err := testRestGet(baseURL + "/mailboxes")
+	expectCode := 200
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != expectCode {
+		t.Fatalf("Expected code %v, got %v", expectCode, w.Code)
+	}
+
+	want := `[{"name":"alpha","count":1,"size":10,"newest":"2017-11-20T10:00:00Z"},` +
+		`{"name":"empty","count":0,"size":0},` +
+		`{"name":"zed","count":2,"size":150,"newest":"2017-11-21T10:00:00Z"}]`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	legacy.AssertNotCalled(t, "GetMessages")
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestStats(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	now := time.Now()
+	zbox, abox := &MockMailbox{}, &MockMailbox{}
+	zbox.On("Name").Return("zed")
+	zbox.On("GetMessages").Return([]smtpd.Message{
+		(&InputMessageData{ID: "0001", Date: now.Add(-time.Minute), Size: 100}).MockMessage(),
+		(&InputMessageData{ID: "0002", Date: now.Add(-2 * time.Hour), Size: 50}).MockMessage(),
+	}, nil)
+	abox.On("Name").Return("alpha")
+	abox.On("GetMessages").Return([]smtpd.Message{
+		(&InputMessageData{ID: "0003", Date: now.Add(-48 * time.Hour), Size: 10}).MockMessage(),
+	}, nil)
+	ds.On("AllMailboxes").Return([]smtpd.Mailbox{zbox, abox}, nil)
+
+	w, err := testRestGet(baseURL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	want := `{"count":3,"size":160,"received":{"5m":1,"1h":1,"24h":2},` +
+		`"retention":{"period":0,"deletes":0,"deletes-1h":0},"mailboxes":[` +
+		`{"name":"alpha","count":1,"size":10,"received":{"5m":0,"1h":0,"24h":0}},` +
+		`{"name":"zed","count":2,"size":150,"received":{"5m":1,"1h":1,"24h":2}}]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestConditionalGet(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	data := &InputMessageData{Mailbox: "good", ID: "0001", Subject: "hello",
+		Date: time.Date(2017, 11, 21, 10, 0, 0, 0, time.UTC)}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessages").Return([]smtpd.Message{data.MockMessage()}, nil)
+	goodbox.On("GetMessage", "0001").Return(data.MockMessage(), nil)
+
+	get := func(url, header, value string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		httpd.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test mailbox listing ETag
+	w := get(baseURL+"/mailbox/good", "", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || etag == "" {
+		t.Fatalf("Expected code 200 with an ETag, got %v with %q", w.Code, etag)
+	}
+	w = get(baseURL+"/mailbox/good", "If-None-Match", etag)
+	if w.Code != 304 {
+		t.Errorf("Expected code 304 for matching ETag, got %v", w.Code)
+	}
+
+	// Test message Last-Modified
+	w = get(baseURL+"/mailbox/good/0001", "If-Modified-Since", "Tue, 21 Nov 2017 10:00:00 GMT")
+	if w.Code != 304 {
+		t.Errorf("Expected code 304 for unmodified message, got %v", w.Code)
+	}
+	w = get(baseURL+"/mailbox/good/0001", "If-Modified-Since", "Mon, 20 Nov 2017 10:00:00 GMT")
+	if w.Code != 200 {
+		t.Errorf("Expected code 200 for modified message, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxesPurge(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{AdminToken: "s3cret"})
+
+	box1, box2 := &MockMailbox{}, &MockMailbox{}
+	for _, mb := range []*MockMailbox{box1, box2} {
+		mb.On("String").Return("box")
+		mb.On("Purge").Return(nil)
+	}
+	var msgs []smtpd.Message
+	for i, to := range []string{"a@example.com", "b@test.local", "c@Example.COM"} {
+		data := &InputMessageData{
+			ID:     fmt.Sprintf("000%v", i+1),
+			To:     []string{to},
+			RcptTo: []string{to},
+			Date:   time.Now(),
+		}
+		msg := data.MockMessage()
+		msg.On("Delete").Return(nil)
+		msgs = append(msgs, msg)
+	}
+	box1.On("GetMessages").Return(msgs[:2], nil)
+	box2.On("GetMessages").Return(msgs[2:], nil)
+	ds.On("AllMailboxes").Return([]smtpd.Mailbox{box1, box2}, nil)
+
+	// Test authorization
+	for _, token := range []string{"", "wrong"} {
+		w, err := testRestAuth("DELETE", baseURL+"/mailboxes", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 401 {
+			t.Errorf("Expected code 401 for token %q, got %v", token, w.Code)
+		}
+	}
+
+	// Test deleting by domain
+	w, err := testRestAuth("DELETE", baseURL+"/mailboxes?domain=example.com", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"deleted":2}`; got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	msgs[0].(*MockMessage).AssertCalled(t, "Delete")
+	msgs[1].(*MockMessage).AssertNotCalled(t, "Delete")
+	msgs[2].(*MockMessage).AssertCalled(t, "Delete")
+	box1.AssertNotCalled(t, "Purge")
+
+	// Test purging everything
+	w, err = testRestAuth("DELETE", baseURL+"/mailboxes", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"deleted":3}`; got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	box1.AssertCalled(t, "Purge")
+	box2.AssertCalled(t, "Purge")
+
+	// Test disabled admin endpoints
+	setupWebServer(ds)
+	w, err = testRestAuth("DELETE", baseURL+"/mailboxes", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 403 {
+		t.Errorf("Expected code 403, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageFlags(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	msg := (&InputMessageData{ID: "0001", Flags: []string{smtpd.FlagSeen}}).MockMessage()
+	msg.On("SetFlags", []string{smtpd.FlagFlagged}).Return(nil)
+	goodbox.On("GetMessage", "0001").Return(msg, nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+
+	var testTable = []struct {
+		id, body   string
+		expectCode int
+	}{
+		{"0001", "not json", 400},
+		{"0002", `{"seen": true}`, 404},
+		{"0001", `{"seen": false, "flagged": true}`, 200},
+	}
+	for _, tt := range testTable {
+		w, err := testRestPatch(baseURL+"/mailbox/good/"+tt.id, tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.expectCode {
+			t.Errorf("Patching %v with %q, expected code %v, got %v", tt.id, tt.body,
+				tt.expectCode, w.Code)
+		}
+	}
+	msg.AssertCalled(t, "SetFlags", []string{smtpd.FlagFlagged})
+
+	// Flags are reported by the message list
+	msgs := []smtpd.Message{
+		(&InputMessageData{ID: "0001", Flags: []string{smtpd.FlagSeen}}).MockMessage(),
+		(&InputMessageData{ID: "0002", Flags: []string{smtpd.FlagFlagged}}).MockMessage(),
+	}
+	goodbox.On("GetMessages").Return(msgs, nil)
+	w, err := testRestGet(baseURL + "/mailbox/good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []struct {
+		Seen, Flagged bool
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got[0].Seen || got[0].Flagged || got[1].Seen || !got[1].Flagged {
+		t.Errorf("Expected seen first and flagged second message, got %+v", got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageTransfer(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+	goodbox, otherbox := &MockMailbox{}, &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	ds.On("MailboxFor", "other").Return(otherbox, nil)
+	msg := &MockMessage{}
+	msg.On("Delete").Return(nil)
+	copied := (&InputMessageData{ID: "0003", Subject: "Moved"}).MockMessage()
+	goodbox.On("GetMessage", "0001").Return(msg, nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+	otherbox.On("CopyMessage", msg).Return(copied, nil)
+
+	var testTable = []struct {
+		id, action, body string
+		expectCode       int
+	}{
+		{"0001", "copy", "not json", 400},
+		{"0001", "copy", `{"mailbox": ""}`, 400},
+		{"0001", "move", `{"mailbox": "good"}`, 400},
+		{"0002", "move", `{"mailbox": "other"}`, 404},
+		{"0001", "copy", `{"mailbox": "other"}`, 200},
+	}
+	for _, tt := range testTable {
+		w, err := testRestPost(baseURL+"/mailbox/good/"+tt.id+"/"+tt.action, tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.expectCode {
+			t.Errorf("%v of %v with %q, expected code %v, got %v", tt.action, tt.id, tt.body,
+				tt.expectCode, w.Code)
+		}
+	}
+	msg.AssertNotCalled(t, "Delete")
+
+	w, err := testRestPost(baseURL+"/mailbox/good/0001/move", `{"mailbox": "other"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	msg.AssertCalled(t, "Delete")
+	var header struct {
+		Mailbox, ID string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Mailbox != "other" || header.ID != "0003" {
+		t.Errorf("Expected moved message other/0003, got %v/%v", header.Mailbox, header.ID)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageRelease(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(&MockMessage{}, nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+
+	var testTable = []struct {
+		id, body   string
+		expectCode int
+	}{
+		{"0001", "not json", 400},
+		{"0001", `{"to": []}`, 400},
+		{"0001", `{"to": ["not an address"]}`, 400},
+		{"0002", `{"to": ["real@example.com"]}`, 404},
+		// No relay.host is configured
+		{"0001", `{"to": ["real@example.com"]}`, 503},
+	}
+	for _, tt := range testTable {
+		w, err := testRestPost(baseURL+"/mailbox/good/"+tt.id+"/release", tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.expectCode {
+			t.Errorf("Releasing %v with %q, expected code %v, got %v", tt.id, tt.body,
+				tt.expectCode, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageSearch(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	data1 := &InputMessageData{
+		Mailbox: "box1",
+		ID:      "0001",
+		From:    "from1",
+		To:      []string{"to1"},
+		Subject: "Welcome aboard",
+		Date:    time.Date(2012, 2, 1, 10, 11, 12, 253, time.FixedZone("PST", -800)),
+		Text:    "Your activation code is 1234",
+	}
+	data2 := &InputMessageData{
+		Mailbox: "box2",
+		ID:      "0002",
+		From:    "alerts@example.com",
+		To:      []string{"to2"},
+		Subject: "Password reset",
+		Date:    time.Date(2012, 7, 1, 10, 11, 12, 253, time.FixedZone("PDT", -700)),
+		Text:    "Click the link",
+	}
+	data3 := &InputMessageData{
+		Mailbox: "box2",
+		ID:      "0003",
+		From:    "news",
+		To:      []string{"subscriber"},
+		Subject: "Newsletter",
+		Date:    time.Date(2012, 8, 1, 10, 11, 12, 253, time.FixedZone("PDT", -700)),
+		HTML:    "<p>Your <b>invoice</b> is ready</p>",
+	}
+	// A message that fails to read is skipped rather than failing the search
+	broken := &MockMessage{}
+	broken.On("Subject").Return("Broken")
+	broken.On("From").Return("nobody")
+	broken.On("To").Return([]string{"nobody"})
+	broken.On("ReadBody").Return((*enmime.Envelope)(nil), fmt.Errorf("unreadable"))
+	box1, box2 := &MockMailbox{}, &MockMailbox{}
+	box1.On("Name").Return("box1")
+	box2.On("Name").Return("box2")
+	box1.On("GetMessages").Return([]smtpd.Message{broken, data1.MockMessage()}, nil)
+	box2.On("GetMessages").Return([]smtpd.Message{data2.MockMessage(), data3.MockMessage()}, nil)
+	ds.On("MailboxFor", "box1").Return(box1, nil)
+	ds.On("AllMailboxes").Return([]smtpd.Mailbox{box1, box2}, nil)
+
+	// Test missing query
+	w, err := testRestGet(baseURL + "/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 {
+		t.Errorf("Expected code 400, got %v", w.Code)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []*InputMessageData
+	}{
+		{"?q=password", []*InputMessageData{data2}},
+		{"?q=ACTIVATION", []*InputMessageData{data1}},
+		{"?q=example.com", []*InputMessageData{data2}},
+		{"?q=to", []*InputMessageData{data1, data2}},
+		{"?q=to&mailbox=box1", []*InputMessageData{data1}},
+		{"?q=your+invoice", []*InputMessageData{data3}},
+		{"?q=nothing", []*InputMessageData{}},
+	} {
+		w, err = testRestGet(baseURL + "/search" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Errorf("Expected code 200 for %q, got %v", tc.query, w.Code)
+			continue
+		}
+		var result []interface{}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Errorf("Failed to decode JSON: %v", err)
+		}
+		if len(result) != len(tc.want) {
+			t.Errorf("Expected %v results for %q, got %v", len(tc.want), tc.query, len(result))
+			continue
+		}
+		for i, want := range tc.want {
+			if errors := want.CompareToJSONHeaderMap(result[i]); len(errors) > 0 {
+				t.Logf("%v", result[i])
+				for _, e := range errors {
+					t.Error(e)
+				}
+			}
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageSearchIndex(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := search.Open(filepath.Join(dir, "search.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	SetSearchIndex(index)
+	defer SetSearchIndex(nil)
+
+	data1 := &InputMessageData{
+		Mailbox: "box1",
+		ID:      "0001",
+		From:    "from1",
+		To:      []string{"to1"},
+		Subject: "Welcome aboard",
+		Date:    time.Date(2012, 2, 1, 10, 11, 12, 253, time.FixedZone("PST", -800)),
+	}
+	data2 := &InputMessageData{
+		Mailbox: "box2",
+		ID:      "0002",
+		From:    "from2",
+		To:      []string{"to2"},
+		Subject: "Password reset",
+		Date:    time.Date(2012, 7, 1, 10, 11, 12, 253, time.FixedZone("PDT", -700)),
+	}
+	box1, box2 := &MockMailbox{}, &MockMailbox{}
+	box1.On("Name").Return("box1")
+	box2.On("Name").Return("box2")
+	box1.On("GetMessage", "0001").Return(data1.MockMessage(), nil)
+	box1.On("GetMessage", "0009").Return(&MockMessage{}, smtpd.ErrNotExist)
+	box2.On("GetMessage", "0002").Return(data2.MockMessage(), nil)
+	ds.On("MailboxFor", "box1").Return(box1, nil)
+	ds.On("MailboxFor", "box2").Return(box2, nil)
+
+	// Index text beyond the headers, and a message that has since been deleted
+	_ = index.Add(search.Ref{Mailbox: "box1", ID: "0001"}, "Welcome aboard, attached.txt")
+	_ = index.Add(search.Ref{Mailbox: "box1", ID: "0009"}, "Welcome back")
+	_ = index.Add(search.Ref{Mailbox: "box2", ID: "0002"}, "Password reset, welcome")
+
+	for _, tc := range []struct {
+		query string
+		want  []*InputMessageData
+	}{
+		{"?q=attached", []*InputMessageData{data1}},
+		{"?q=welc", []*InputMessageData{data1, data2}},
+		{"?q=welcome&mailbox=box2", []*InputMessageData{data2}},
+		{"?q=welcome+reset", []*InputMessageData{data2}},
+	} {
+		w, err := testRestGet(baseURL + "/search" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Errorf("Expected code 200 for %q, got %v", tc.query, w.Code)
+			continue
+		}
+		var result []interface{}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Errorf("Failed to decode JSON: %v", err)
+		}
+		if len(result) != len(tc.want) {
+			t.Errorf("Expected %v results for %q, got %v", len(tc.want), tc.query, len(result))
+			continue
+		}
+		for i, want := range tc.want {
+			if errors := want.CompareToJSONHeaderMap(result[i]); len(errors) > 0 {
+				t.Logf("%v", result[i])
+				for _, e := range errors {
+					t.Error(e)
+				}
+			}
+		}
+	}
+
+	// The deleted message is dropped from the index
+	if index.Len() != 2 {
+		t.Errorf("Expected 2 indexed messages, got %v", index.Len())
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,144 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// defaultPageLimit is the number of messages returned by MailboxListV2 when the request does
+// not include a limit
+const defaultPageLimit = 50
+
+// messageSorters compare two messages for each supported value of the sort query parameter
+var messageSorters = map[string]func(a, b smtpd.Message) bool{
+	"date": func(a, b smtpd.Message) bool { return a.Date().Before(b.Date()) },
+	"size": func(a, b smtpd.Message) bool { return a.Size() < b.Size() },
+	"from": func(a, b smtpd.Message) bool {
+		return strings.ToLower(a.From()) < strings.ToLower(b.From())
+	},
+}
+
+// messageSort implements sort.Interface for a slice of messages
+type messageSort struct {
+	messages []smtpd.Message
+	less     func(a, b smtpd.Message) bool
+	reverse  bool
+}
+
+func (s *messageSort) Len() int      { return len(s.messages) }
+func (s *messageSort) Swap(i, j int) { s.messages[i], s.messages[j] = s.messages[j], s.messages[i] }
+func (s *messageSort) Less(i, j int) bool {
+	if s.reverse {
+		return s.less(s.messages[j], s.messages[i])
+	}
+	return s.less(s.messages[i], s.messages[j])
+}
+
+// MailboxListV2 renders a page of the messages in a mailbox along with the total number of
+// matching messages.  The limit and offset query parameters select the page, sort orders the
+// messages by date, size or from, descending if prefixed with a minus sign.  The auth-user
+// query parameter filters messages as it does for MailboxListV1.
+func MailboxListV2(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	query := req.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultPageLimit)
+	if err != nil {
+		http.Error(w, "Invalid limit: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil {
+		http.Error(w, "Invalid offset: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	order := query.Get("sort")
+	if order == "" {
+		order = "date"
+	}
+	reverse := strings.HasPrefix(order, "-")
+	less, ok := messageSorters[strings.TrimPrefix(order, "-")]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Invalid sort %q", order), http.StatusBadRequest)
+		return nil
+	}
+
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	messages, err := mb.GetMessages()
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+	}
+	log.Tracef("Got %v messsages", len(messages))
+
+	if authUser, filtered := query["auth-user"]; filtered {
+		matched := make([]smtpd.Message, 0, len(messages))
+		for _, msg := range messages {
+			if msg.Delivery().AuthUser == authUser[0] {
+				matched = append(matched, msg)
+			}
+		}
+		messages = matched
+	}
+	sort.Stable(&messageSort{messages: messages, less: less, reverse: reverse})
+
+	page := &model.JSONMessagePageV2{
+		Total:    len(messages),
+		Offset:   offset,
+		Limit:    limit,
+		Messages: make([]*model.JSONMessageHeaderV1, 0, limit),
+	}
+	if offset > len(messages) {
+		offset = len(messages)
+	}
+	messages = messages[offset:]
+	if limit < len(messages) {
+		messages = messages[:limit]
+	}
+	for _, msg := range messages {
+		page.Messages = append(page.Messages, &model.JSONMessageHeaderV1{
+			Mailbox:  name,
+			ID:       msg.ID(),
+			From:     msg.From(),
+			To:       msg.To(),
+			Subject:  msg.Subject(),
+			Date:     msg.Date(),
+			Size:     msg.Size(),
+			AuthUser: msg.Delivery().AuthUser,
+			Seen:     smtpd.HasFlag(msg, smtpd.FlagSeen),
+			Flagged:  smtpd.HasFlag(msg, smtpd.FlagFlagged),
+		})
+	}
+	return httpd.RenderJSONConditional(w, req, page, time.Time{})
+}
+
+// queryInt parses a non-negative integer query parameter, returning def if it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%v is negative", n)
+	}
+	return n, nil
+}
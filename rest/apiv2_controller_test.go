@@ -0,0 +1,120 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+const baseURLV2 = "http://localhost/api/v2"
+
+func TestRestMailboxListV2(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	data := []*InputMessageData{
+		{
+			Mailbox: "good",
+			ID:      "0001",
+			From:    "Carol",
+			Subject: "subject 1",
+			Date:    time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC),
+			Size:    300,
+		},
+		{
+			Mailbox:  "good",
+			ID:       "0002",
+			From:     "alice",
+			Subject:  "subject 2",
+			Date:     time.Date(2012, 7, 1, 10, 11, 12, 0, time.UTC),
+			Size:     100,
+			AuthUser: "svc",
+		},
+		{
+			Mailbox: "good",
+			ID:      "0003",
+			From:    "Bob",
+			Subject: "subject 3",
+			Date:    time.Date(2012, 3, 1, 10, 11, 12, 0, time.UTC),
+			Size:    200,
+		},
+	}
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	messages := make([]smtpd.Message, len(data))
+	for i, d := range data {
+		messages[i] = d.MockMessage()
+	}
+	goodbox.On("GetMessages").Return(messages, nil)
+
+	for _, tc := range []struct {
+		query string
+		total int
+		ids   []string
+	}{
+		{"", 3, []string{"0001", "0003", "0002"}},
+		{"?sort=-date", 3, []string{"0002", "0003", "0001"}},
+		{"?sort=size", 3, []string{"0002", "0003", "0001"}},
+		{"?sort=-from", 3, []string{"0001", "0003", "0002"}},
+		{"?limit=2", 3, []string{"0001", "0003"}},
+		{"?limit=2&offset=2", 3, []string{"0002"}},
+		{"?offset=5", 3, []string{}},
+		{"?auth-user=", 2, []string{"0001", "0003"}},
+		{"?auth-user=&limit=1&offset=1&sort=from", 2, []string{"0001"}},
+	} {
+		w, err := testRestGet(baseURLV2 + "/mailbox/good" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Errorf("Expected code 200 for %q, got %v", tc.query, w.Code)
+			continue
+		}
+		var page model.JSONMessagePageV2
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Errorf("Failed to decode JSON for %q: %v", tc.query, err)
+			continue
+		}
+		if page.Total != tc.total {
+			t.Errorf("Expected total %v for %q, got %v", tc.total, tc.query, page.Total)
+		}
+		ids := make([]string, len(page.Messages))
+		for i, msg := range page.Messages {
+			ids[i] = msg.ID
+		}
+		if len(ids) != len(tc.ids) {
+			t.Errorf("Expected IDs %v for %q, got %v", tc.ids, tc.query, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tc.ids[i] {
+				t.Errorf("Expected IDs %v for %q, got %v", tc.ids, tc.query, ids)
+				break
+			}
+		}
+	}
+
+	// Test invalid parameters
+	for _, query := range []string{"?limit=x", "?limit=-1", "?offset=-5", "?sort=subject"} {
+		w, err := testRestGet(baseURLV2 + "/mailbox/good" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %q, got %v", query, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
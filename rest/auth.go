@@ -0,0 +1,174 @@
+package rest
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// scopeLevels ranks API token scopes, each scope includes those with a lower level
+var scopeLevels = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// requestToken returns the bearer token sent with req in its Authorization header or its
+// access_token query parameter
+func requestToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return req.URL.Query().Get("access_token")
+}
+
+// tokenScope returns the scope of the configured API token matching token, admin for the
+// admin token, or "" if none match
+func tokenScope(cfg config.WebConfig, token string) string {
+	scope := ""
+	if cfg.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1 {
+		scope = "admin"
+	}
+	for _, t := range cfg.APITokens {
+		// Check every token, so that the time taken does not reveal which matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			scope = t.Scope
+		}
+	}
+	return scope
+}
+
+// authorized wraps a REST handler to require an API token, the login of a basic authentication
+// user or an OpenID Connect session, when any are configured.  GET requests need the read
+// scope, all others the write scope, which logins are granted.  Requests carrying a signature
+// query parameter are allowed by a valid signed URL instead of a token.  The access_token,
+// expires and signature query parameters are removed before the handler sees the request.
+// Private mailboxes named in the path also need one of their tokens, which may stand in for an
+// API token, or the admin scope.
+func authorized(h httpd.Handler) httpd.Handler {
+	return func(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) error {
+		query := req.URL.Query()
+		if _, ok := query["signature"]; ok {
+			if !validSignature(req, ctx.WebConfig) {
+				http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+				return nil
+			}
+			query.Del("expires")
+			query.Del("signature")
+			req.URL.RawQuery = query.Encode()
+			return h(w, req, ctx)
+		}
+		if _, ok := query["access_token"]; ok {
+			// Handlers reject unknown query parameters, keep the token in the header instead
+			token := requestToken(req)
+			query.Del("access_token")
+			req.URL.RawQuery = query.Encode()
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		cfg := ctx.WebConfig
+		need := "write"
+		if req.Method == "GET" || req.Method == "HEAD" {
+			need = "read"
+		}
+		token := requestToken(req)
+		scope := tokenScope(cfg, token)
+		if scope == "" && len(cfg.APITokens) == 0 && !httpd.LoginRequired(cfg) {
+			// The API is open
+			scope = "write"
+		}
+		if scope == "" && httpd.LoginUser(req, cfg) != "" {
+			scope = "write"
+		}
+		// A mailbox token grants access to its private mailbox in place of an API token
+		private := privateMailbox(ctx)
+		unlocked := private != "" && ctx.MailboxUnlocked(private, token)
+		if scope == "" && unlocked {
+			scope = "write"
+		}
+		if scope == "" {
+			msg := "Invalid API token"
+			if len(cfg.APITokens) > 0 {
+				w.Header().Add("WWW-Authenticate", "Bearer")
+			}
+			if len(cfg.BasicAuthUsers) > 0 {
+				httpd.RequestLogin(w, cfg)
+			}
+			if httpd.LoginRequired(cfg) {
+				msg = "Invalid API token or login"
+			}
+			http.Error(w, msg, http.StatusUnauthorized)
+			return nil
+		}
+		if scopeLevels[scope] < scopeLevels[need] {
+			http.Error(w, "API token does not have the "+need+" scope", http.StatusForbidden)
+			return nil
+		}
+		if private != "" && scope != "admin" && !unlocked {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Mailbox "+private+" is private, its token is required",
+				http.StatusUnauthorized)
+			return nil
+		}
+		return h(w, req, ctx)
+	}
+}
+
+// privateMailbox returns the parsed name of the private mailbox named by the request path, or
+// "" if there is none
+func privateMailbox(ctx *httpd.Context) string {
+	if ctx.Vars["name"] == "" {
+		return ""
+	}
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil || !smtpd.MailboxPrivate(name) {
+		// Handlers report invalid names
+		return ""
+	}
+	return name
+}
+
+// mailboxVisible returns true if messages of the named mailbox may be listed in the response to
+// req, which those of private mailboxes are only with one of their tokens or the admin scope
+func mailboxVisible(req *http.Request, ctx *httpd.Context, name string) bool {
+	token := requestToken(req)
+	return ctx.MailboxUnlocked(name, token) || tokenScope(ctx.WebConfig, token) == "admin"
+}
+
+// checkMailboxVisible returns true if the messages of the named mailbox may be read in the
+// response to req, otherwise it renders an error response.  Handlers call it for mailboxes named
+// outside the request path, which authorized does not check.
+func checkMailboxVisible(w http.ResponseWriter, req *http.Request, ctx *httpd.Context,
+	name string) bool {
+	if mailboxVisible(req, ctx, name) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Mailbox "+name+" is private, its token is required", http.StatusUnauthorized)
+	return false
+}
+
+// checkAdmin returns true if the request carries the configured admin token, or an API token
+// with the admin scope, otherwise it renders an error response
+func checkAdmin(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) bool {
+	enabled := ctx.WebConfig.AdminToken != ""
+	for _, t := range ctx.WebConfig.APITokens {
+		enabled = enabled || t.Scope == "admin"
+	}
+	if !enabled {
+		http.Error(w, "Admin endpoints are disabled, configure admin.token to enable them",
+			http.StatusForbidden)
+		return false
+	}
+	if tokenScope(ctx.WebConfig, requestToken(req)) != "admin" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
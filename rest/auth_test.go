@@ -0,0 +1,382 @@
+package rest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/smtpd"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRestAPITokens(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{
+		APITokens: []config.APIToken{
+			{Name: "dashboard", Scope: "read", Token: "r3ad"},
+			{Name: "ci", Scope: "write", Token: "wr1te"},
+			{Name: "ops", Scope: "admin", Token: "adm1n"},
+		},
+	})
+
+	goodbox := &MockMailbox{}
+	goodbox.On("String").Return("good")
+	goodbox.On("GetMessages").Return([]smtpd.Message{}, nil)
+	goodbox.On("Purge").Return(nil)
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	ds.On("AllMailboxes").Return([]smtpd.Mailbox{goodbox}, nil)
+
+	var testTable = []struct {
+		method, url, token string
+		code               int
+	}{
+		{"GET", "/mailbox/good", "", 401},
+		{"GET", "/mailbox/good", "wrong", 401},
+		{"GET", "/mailbox/good", "r3ad", 200},
+		{"GET", "/mailbox/good?access_token=r3ad", "", 200},
+		{"DELETE", "/mailbox/good", "r3ad", 403},
+		{"DELETE", "/mailbox/good", "wr1te", 200},
+		{"DELETE", "/mailbox/good?access_token=wr1te&from=fred", "", 200},
+		{"DELETE", "/mailboxes", "wr1te", 401},
+		{"DELETE", "/mailboxes", "adm1n", 200},
+	}
+	for _, tt := range testTable {
+		w, err := testRestAuth(tt.method, baseURL+tt.url, tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("%v %v with token %q: expected code %v, got %v", tt.method, tt.url,
+				tt.token, tt.code, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestBasicAuth(t *testing.T) {
+	// Setup
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{
+		APITokens:      []config.APIToken{{Name: "ci", Scope: "read", Token: "r3ad"}},
+		BasicAuthUsers: []config.BasicAuthUser{{Name: "lab", Hash: hash}},
+		BasicAuthRealm: "Lab",
+	})
+
+	goodbox := &MockMailbox{}
+	goodbox.On("String").Return("good")
+	goodbox.On("GetMessages").Return([]smtpd.Message{}, nil)
+	goodbox.On("Purge").Return(nil)
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	ds.On("AllMailboxes").Return([]smtpd.Mailbox{goodbox}, nil)
+
+	var testTable = []struct {
+		method, url, user, password, token string
+		code                               int
+	}{
+		{"GET", "/mailbox/good", "", "", "", 401},
+		{"GET", "/mailbox/good", "lab", "wrong", "", 401},
+		{"GET", "/mailbox/good", "other", "s3cret", "", 401},
+		{"GET", "/mailbox/good", "lab", "s3cret", "", 200},
+		{"GET", "/mailbox/good", "", "", "r3ad", 200},
+		{"DELETE", "/mailbox/good", "lab", "s3cret", "", 200},
+		{"DELETE", "/mailbox/good", "", "", "r3ad", 403},
+		{"DELETE", "/mailboxes", "lab", "s3cret", "", 403},
+	}
+	for _, tt := range testTable {
+		req, err := http.NewRequest(tt.method, baseURL+tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		httpd.Router.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%v %v as %q with token %q: expected code %v, got %v", tt.method, tt.url,
+				tt.user, tt.token, tt.code, w.Code)
+		}
+		if w.Code == 401 {
+			want := []string{"Bearer", `Basic realm="Lab"`}
+			if got := w.Header()["Www-Authenticate"]; len(got) != 2 || got[0] != want[0] ||
+				got[1] != want[1] {
+				t.Errorf("Expected WWW-Authenticate %q, got %q", want, got)
+			}
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestPrivateMailboxes(t *testing.T) {
+	// Setup
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "a", Pattern: "team-a*", Token: "t0k-a"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	private, public := &MockMailbox{}, &MockMailbox{}
+	private.On("Name").Return("team-a")
+	private.On("String").Return("team-a")
+	private.On("GetMessages").Return([]smtpd.Message{}, nil)
+	private.On("Purge").Return(nil)
+	public.On("Name").Return("public")
+	public.On("GetMessages").Return([]smtpd.Message{}, nil)
+	ds.On("MailboxFor", "team-a").Return(private, nil)
+	ds.On("MailboxFor", "public").Return(public, nil)
+	ds.On("AllMailboxes").Return([]smtpd.Mailbox{private, public}, nil)
+
+	var testTable = []struct {
+		method, url, token string
+		code               int
+	}{
+		{"GET", "/mailbox/public", "", 200},
+		{"GET", "/mailbox/team-a", "", 401},
+		{"GET", "/mailbox/Team-A", "wrong", 401},
+		{"GET", "/mailbox/team-a", "t0k-a", 200},
+		{"GET", "/mailbox/team-a?access_token=t0k-a", "", 200},
+		{"DELETE", "/mailbox/team-a", "t0k-a", 200},
+	}
+	for _, tt := range testTable {
+		w, err := testRestAuth(tt.method, baseURL+tt.url, tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("%v %v with token %q: expected code %v, got %v", tt.method, tt.url,
+				tt.token, tt.code, w.Code)
+		}
+	}
+
+	// Private mailboxes are only listed with their token
+	for token, want := range map[string]string{
+		"":      `[{"name":"public","count":0,"size":0}]`,
+		"t0k-a": `[{"name":"public","count":0,"size":0},{"name":"team-a","count":0,"size":0}]`,
+	} {
+		w, err := testRestAuth("GET", baseURL+"/mailboxes", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != want {
+			t.Errorf("With token %q expected %v, got %v", token, want, got)
+		}
+	}
+
+	// Mailbox tokens stand in for API tokens, the admin token opens every mailbox
+	logbuf = setupWebServerConfig(ds, config.WebConfig{
+		AdminToken: "adm1n",
+		APITokens:  []config.APIToken{{Name: "ci", Scope: "read", Token: "r3ad"}},
+	})
+	for _, tt := range []struct {
+		token string
+		code  int
+	}{
+		{"r3ad", 401},
+		{"t0k-a", 200},
+		{"adm1n", 200},
+	} {
+		w, err := testRestAuth("GET", baseURL+"/mailbox/team-a", tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("GET team-a with token %q: expected code %v, got %v", tt.token, tt.code,
+				w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestPrivateMailboxDiff(t *testing.T) {
+	// Setup
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "a", Pattern: "team-a*", Token: "t0k-a"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{AdminToken: "adm1n"})
+
+	msg := &InputMessageData{
+		ID:     "0001",
+		Header: mail.Header{"Subject": {"Your code"}},
+		Text:   "Your code is 1234\r\n",
+	}
+	private, public := &MockMailbox{}, &MockMailbox{}
+	ds.On("MailboxFor", "team-a").Return(private, nil)
+	ds.On("MailboxFor", "public").Return(public, nil)
+	private.On("GetMessage", "0001").Return(msg.MockMessage(), nil)
+	public.On("GetMessage", "0001").Return(msg.MockMessage(), nil)
+
+	// Comparing with a private mailbox's message requires its token
+	var testTable = []struct {
+		url, token string
+		code       int
+	}{
+		{"/mailbox/public/0001/diff?with=0001&mailbox=public", "", 200},
+		{"/mailbox/public/0001/diff?with=0001&mailbox=team-a", "", 401},
+		{"/mailbox/public/0001/diff?with=0001&mailbox=Team-A%2Bx", "", 401},
+		{"/mailbox/public/0001/diff?with=0001&mailbox=team-a", "wrong", 401},
+		{"/mailbox/public/0001/diff?with=0001&mailbox=team-a", "t0k-a", 200},
+		{"/mailbox/public/0001/diff?with=0001&mailbox=team-a", "adm1n", 200},
+		{"/mailbox/team-a/0001/diff?with=0001&mailbox=public", "", 401},
+	}
+	for _, tt := range testTable {
+		w, err := testRestAuth("GET", baseURL+tt.url, tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("GET %v with token %q: expected code %v, got %v", tt.url, tt.token,
+				tt.code, w.Code)
+		}
+		if w.Code == 401 && strings.Contains(w.Body.String(), "1234") {
+			t.Errorf("GET %v with token %q: response contains the message", tt.url, tt.token)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestPrivateMailboxSearch(t *testing.T) {
+	// Setup
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "a", Pattern: "team-a*", Token: "t0k-a"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{AdminToken: "adm1n"})
+
+	msg := &InputMessageData{
+		Mailbox: "team-a",
+		ID:      "0001",
+		Subject: "Your code",
+		Header:  mail.Header{"Subject": {"Your code"}},
+		Text:    "Your code is 1234\r\n",
+	}
+	private := &MockMailbox{}
+	ds.On("MailboxFor", "team-a").Return(private, nil)
+	private.On("Name").Return("team-a")
+	private.On("GetMessages").Return([]smtpd.Message{msg.MockMessage()}, nil)
+
+	// Searching a private mailbox requires its token
+	var testTable = []struct {
+		url, token string
+		code       int
+	}{
+		{"/search?q=code&mailbox=team-a", "", 401},
+		{"/search?q=code&mailbox=TEAM-A", "wrong", 401},
+		{"/search?q=code&mailbox=team-a", "t0k-a", 200},
+		{"/search?q=code&mailbox=team-a", "adm1n", 200},
+	}
+	for _, tt := range testTable {
+		w, err := testRestAuth("GET", baseURL+tt.url, tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("GET %v with token %q: expected code %v, got %v", tt.url, tt.token,
+				tt.code, w.Code)
+		}
+		if got := strings.Contains(w.Body.String(), "Your code"); got != (tt.code == 200) {
+			t.Errorf("GET %v with token %q: got message %v, body %v", tt.url, tt.token, got,
+				w.Body.String())
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestPrivateMailboxTransfer(t *testing.T) {
+	// Setup
+	smtpd.SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "a", Pattern: "team-a*", Token: "t0k-a"},
+	})
+	defer smtpd.SetPrivateMailboxes(nil)
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{AdminToken: "adm1n"})
+
+	private, public := &MockMailbox{}, &MockMailbox{}
+	ds.On("MailboxFor", "team-a").Return(private, nil)
+	ds.On("MailboxFor", "public").Return(public, nil)
+	msg := &MockMessage{}
+	msg.On("Delete").Return(nil)
+	copied := (&InputMessageData{ID: "0002", Subject: "Planted"}).MockMessage()
+	public.On("GetMessage", "0001").Return(msg, nil)
+	private.On("CopyMessage", msg).Return(copied, nil)
+
+	// Copying or moving into a private mailbox requires its token
+	var testTable = []struct {
+		action, query, body string
+		code                int
+	}{
+		{"copy", "", `{"mailbox": "team-a"}`, 401},
+		{"move", "", `{"mailbox": "team-a"}`, 401},
+		{"copy", "", `{"mailbox": "Team-A+x"}`, 401},
+		{"move", "?access_token=wrong", `{"mailbox": "team-a"}`, 401},
+		{"copy", "?access_token=t0k-a", `{"mailbox": "team-a"}`, 200},
+		{"copy", "?access_token=adm1n", `{"mailbox": "team-a"}`, 200},
+	}
+	for _, tt := range testTable {
+		url := baseURL + "/mailbox/public/0001/" + tt.action + tt.query
+		w, err := testRestPost(url, tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("POST %v with %v: expected code %v, got %v", url, tt.body, tt.code,
+				w.Code)
+		}
+	}
+	msg.AssertNotCalled(t, "Delete")
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
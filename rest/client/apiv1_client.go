@@ -2,9 +2,12 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/jhillyerd/inbucket/rest/model"
@@ -33,6 +36,12 @@ func NewV1(baseURL string) (*ClientV1, error) {
 	return c, nil
 }
 
+// ListMailboxes returns a summary of every mailbox on the server, ordered by name
+func (c *ClientV1) ListMailboxes() (mailboxes []*model.JSONMailboxV1, err error) {
+	err = c.doJSON("GET", "/api/v1/mailboxes", &mailboxes)
+	return
+}
+
 // ListMailbox returns a list of messages for the requested mailbox
 func (c *ClientV1) ListMailbox(name string) (headers []*model.JSONMessageHeaderV1, err error) {
 	uri := "/api/v1/mailbox/" + url.QueryEscape(name)
@@ -40,6 +49,37 @@ func (c *ClientV1) ListMailbox(name string) (headers []*model.JSONMessageHeaderV
 	return
 }
 
+// ListMailboxByAuthUser returns a list of the messages in the requested mailbox that were
+// sent by the specified SMTP AUTH identity, an empty user lists unauthenticated messages
+func (c *ClientV1) ListMailboxByAuthUser(name, user string) (
+	headers []*model.JSONMessageHeaderV1, err error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "?auth-user=" + url.QueryEscape(user)
+	err = c.doJSON("GET", uri, &headers)
+	return
+}
+
+// ExportMailbox returns every message in the requested mailbox as a single file, format is
+// "mbox" or "zip" for a ZIP archive of .eml files.
+func (c *ClientV1) ExportMailbox(name, format string) (*bytes.Buffer, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/export?format=" +
+		url.QueryEscape(format)
+	resp, err := c.do("GET", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	return buf, err
+}
+
 // GetMessage returns the message details given a mailbox name and message ID.
 func (c *ClientV1) GetMessage(name, id string) (message *model.JSONMessageV1, err error) {
 	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id
@@ -47,6 +87,38 @@ func (c *ClientV1) GetMessage(name, id string) (message *model.JSONMessageV1, er
 	return
 }
 
+// WaitForMessage returns the newest message in the given mailbox with from in the sender and
+// a subject matching the regular expression subject, ignoring those that are empty.  If there
+// is none, it waits up to timeout for one to be delivered, returning an error if none is.  The
+// timeout must be shorter than the 30 second timeout of the client.
+func (c *ClientV1) WaitForMessage(name, from, subject string, timeout time.Duration) (
+	message *model.JSONMessageV1, err error) {
+	query := url.Values{}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if subject != "" {
+		query.Set("subject", subject)
+	}
+	if timeout > 0 {
+		query.Set("timeout", timeout.String())
+	}
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/wait"
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	err = c.doJSON("GET", uri, &message)
+	return
+}
+
+// GetMessageHeaders returns every header field of a message, keyed by canonical field name,
+// given the mailbox name and message ID.
+func (c *ClientV1) GetMessageHeaders(name, id string) (header map[string][]string, err error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/headers"
+	err = c.doJSON("GET", uri, &header)
+	return
+}
+
 // GetMessageSource returns the message source given a mailbox name and message ID.
 func (c *ClientV1) GetMessageSource(name, id string) (*bytes.Buffer, error) {
 	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/source"
@@ -67,6 +139,104 @@ func (c *ClientV1) GetMessageSource(name, id string) (*bytes.Buffer, error) {
 	return buf, err
 }
 
+// GetMessageTranscript returns the SMTP transcript of a message given a mailbox name and
+// message ID.
+func (c *ClientV1) GetMessageTranscript(name, id string) (*bytes.Buffer, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/transcript"
+	resp, err := c.do("GET", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	return buf, err
+}
+
+// GetMessageDelivery returns the details of the SMTP session that delivered a message, given a
+// mailbox name and message ID.
+func (c *ClientV1) GetMessageDelivery(name, id string) (
+	delivery *model.JSONDeliveryV1, err error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/delivery"
+	err = c.doJSON("GET", uri, &delivery)
+	return
+}
+
+// DiffMessages returns the differences in headers and bodies between a message and another
+// message, which may be in a different mailbox.
+func (c *ClientV1) DiffMessages(name, id, otherName, otherID string) (
+	diff *model.JSONMessageDiffV1, err error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/diff?with=" +
+		url.QueryEscape(otherID) + "&mailbox=" + url.QueryEscape(otherName)
+	err = c.doJSON("GET", uri, &diff)
+	return
+}
+
+// GetMessageHTML returns the HTML body of a message with scripts, forms and external loads
+// removed, and a list of what was removed, given a mailbox name and message ID.
+func (c *ClientV1) GetMessageHTML(name, id string) (html *model.JSONSanitizedHTMLV1, err error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/html"
+	err = c.doJSON("GET", uri, &html)
+	return
+}
+
+// GetMessageText returns the plain text body of a message given a mailbox name and message ID,
+// converted from its HTML body if it has no text/plain part.
+func (c *ClientV1) GetMessageText(name, id string) (*bytes.Buffer, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/text"
+	resp, err := c.do("GET", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	return buf, err
+}
+
+// GetMessageParts returns the MIME structure of a message given a mailbox name and message ID.
+func (c *ClientV1) GetMessageParts(name, id string) (root *model.JSONMIMEPartV1, err error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/parts"
+	err = c.doJSON("GET", uri, &root)
+	return
+}
+
+// GetMessageAttachment returns the decoded content of an attachment given a mailbox name,
+// message ID and the attachment index, numbered from zero.
+func (c *ClientV1) GetMessageAttachment(name, id string, index int) (*bytes.Buffer, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/attach/" +
+		strconv.Itoa(index)
+	resp, err := c.do("GET", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	return buf, err
+}
+
 // DeleteMessage deletes a single message given the mailbox name and message ID.
 func (c *ClientV1) DeleteMessage(name, id string) error {
 	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id
@@ -94,3 +264,255 @@ func (c *ClientV1) PurgeMailbox(name string) error {
 	}
 	return nil
 }
+
+// DeleteMessages deletes the messages in the given mailbox that match every non-zero filter:
+// received longer than olderThan ago, with from in the sender, and a subject matching the
+// regular expression subject.  It returns the number of messages deleted.
+func (c *ClientV1) DeleteMessages(name string, olderThan time.Duration, from, subject string) (
+	int, error) {
+	query := url.Values{}
+	if olderThan > 0 {
+		query.Set("older-than", olderThan.String())
+	}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if subject != "" {
+		query.Set("subject", subject)
+	}
+	if len(query) == 0 {
+		return 0, fmt.Errorf("At least one filter is required, use PurgeMailbox to delete all")
+	}
+	var result model.JSONDeleteResultV1
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "?" + query.Encode()
+	err := c.doJSON("DELETE", uri, &result)
+	return result.Deleted, err
+}
+
+// PurgeAllMailboxes deletes messages from every mailbox on the server, limited to recipients
+// in domain and messages received longer than olderThan ago when those are non-zero.  It
+// requires an admin token and returns the number of messages deleted.
+func (c *ClientV1) PurgeAllMailboxes(domain string, olderThan time.Duration) (int, error) {
+	query := url.Values{}
+	if domain != "" {
+		query.Set("domain", domain)
+	}
+	if olderThan > 0 {
+		query.Set("older-than", olderThan.String())
+	}
+	uri := "/api/v1/mailboxes"
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	var result model.JSONDeleteResultV1
+	err := c.doJSON("DELETE", uri, &result)
+	return result.Deleted, err
+}
+
+// ReleaseMessage re-sends a message to the specified addresses through the upstream SMTP
+// server configured on the Inbucket server, given the mailbox name and message ID.
+func (c *ClientV1) ReleaseMessage(name, id string, to []string) error {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/release"
+	resp, err := c.doBody("POST", uri, &model.JSONReleaseV1{To: to})
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// SetMessageFlags sets or clears the seen and flagged flags of a message, given the mailbox
+// name and message ID, flags left nil are unchanged.  It returns the resulting flags.
+func (c *ClientV1) SetMessageFlags(name, id string, flags *model.JSONMessageFlagsV1) (
+	*model.JSONMessageFlagsV1, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id
+	resp, err := c.doBody("PATCH", uri, flags)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	result := new(model.JSONMessageFlagsV1)
+	err = json.NewDecoder(resp.Body).Decode(result)
+	return result, err
+}
+
+// CopyMessage copies a message to the dest mailbox, given the mailbox name and message ID, and
+// returns the header of the copy.
+func (c *ClientV1) CopyMessage(name, id, dest string) (*model.JSONMessageHeaderV1, error) {
+	return c.transferMessage(name, id, dest, "copy")
+}
+
+// MoveMessage moves a message to the dest mailbox, given the mailbox name and message ID, and
+// returns its header in the new mailbox, where it has a new ID.
+func (c *ClientV1) MoveMessage(name, id, dest string) (*model.JSONMessageHeaderV1, error) {
+	return c.transferMessage(name, id, dest, "move")
+}
+
+// transferMessage sends a copy or move request for a message
+func (c *ClientV1) transferMessage(name, id, dest, action string) (
+	*model.JSONMessageHeaderV1, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/" + action
+	resp, err := c.doBody("POST", uri, &model.JSONTransferV1{Mailbox: dest})
+	if err != nil {
+		return nil, err
+	}
+	return decodeHeader(resp)
+}
+
+// ShareMessage returns a signed URL for the source, text, html or attach/<index> resource of a
+// message, which can be fetched without an API token for ttl.  A zero ttl uses the server
+// default of an hour.
+func (c *ClientV1) ShareMessage(name, id, resource string, ttl time.Duration) (
+	*model.JSONSharedURLV1, error) {
+	share := &model.JSONShareV1{Resource: resource}
+	if ttl > 0 {
+		share.TTL = ttl.String()
+	}
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/" + id + "/share"
+	resp, err := c.doBody("POST", uri, share)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	shared := new(model.JSONSharedURLV1)
+	err = json.NewDecoder(resp.Body).Decode(shared)
+	return shared, err
+}
+
+// InjectMessage creates a message in the given mailbox without SMTP, built from the sender,
+// recipients, subject, body and attachments in msg, and returns its header.
+func (c *ClientV1) InjectMessage(name string, msg *model.JSONInjectV1) (
+	*model.JSONMessageHeaderV1, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name)
+	resp, err := c.doBody("POST", uri, msg)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHeader(resp)
+}
+
+// InjectRawMessage creates a message in the given mailbox without SMTP from its raw RFC 5322
+// source, and returns its header.
+func (c *ClientV1) InjectRawMessage(name string, source []byte) (
+	*model.JSONMessageHeaderV1, error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name)
+	resp, err := c.doReader("POST", uri, "message/rfc822", bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	return decodeHeader(resp)
+}
+
+// ImportMailbox loads the messages of an mbox file, or a ZIP archive of .eml files when format
+// is "zip", into the given mailbox and returns their headers.
+func (c *ClientV1) ImportMailbox(name, format string, upload io.Reader) (
+	headers []*model.JSONMessageHeaderV1, err error) {
+	uri := "/api/v1/mailbox/" + url.QueryEscape(name) + "/import?format=" +
+		url.QueryEscape(format)
+	contentType := "application/mbox"
+	if format == "zip" {
+		contentType = "application/zip"
+	}
+	resp, err := c.doReader("POST", uri, contentType, upload)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&headers)
+	return headers, err
+}
+
+// decodeHeader decodes the message header in a successful response
+func decodeHeader(resp *http.Response) (*model.JSONMessageHeaderV1, error) {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	header := new(model.JSONMessageHeaderV1)
+	err := json.NewDecoder(resp.Body).Decode(header)
+	return header, err
+}
+
+// GetStats returns message counts and sizes for every mailbox and in total, recent delivery
+// rates and the number of messages deleted by retention.
+func (c *ClientV1) GetStats() (stats *model.JSONStatsV1, err error) {
+	err = c.doJSON("GET", "/api/v1/stats", &stats)
+	return
+}
+
+// ListWebhooks returns the webhooks registered with the server.
+func (c *ClientV1) ListWebhooks() (webhooks []*model.JSONWebhookV1, err error) {
+	err = c.doJSON("GET", "/api/v1/webhooks", &webhooks)
+	return
+}
+
+// AddWebhook registers a webhook to be sent events affecting mailbox, or every mailbox if it is
+// empty.  Events lists "delivery" and "delete" events to send, all are sent if it is empty.
+// The registered webhook is returned with its ID.
+func (c *ClientV1) AddWebhook(webhookURL, mailbox string, events []string) (
+	*model.JSONWebhookV1, error) {
+	resp, err := c.doBody("POST", "/api/v1/webhooks",
+		&model.JSONWebhookV1{URL: webhookURL, Mailbox: mailbox, Events: events})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil,
+			fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	webhook := new(model.JSONWebhookV1)
+	err = json.NewDecoder(resp.Body).Decode(webhook)
+	return webhook, err
+}
+
+// DeleteWebhook removes a registered webhook given its ID.
+func (c *ClientV1) DeleteWebhook(id string) error {
+	resp, err := c.do("DELETE", "/api/v1/webhooks/"+url.QueryEscape(id))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// SearchMessages returns the messages whose subject, from, to or body text contain query, an
+// empty mailbox searches every mailbox.
+func (c *ClientV1) SearchMessages(query, mailbox string) (
+	headers []*model.JSONMessageHeaderV1, err error) {
+	uri := "/api/v1/search?q=" + url.QueryEscape(query)
+	if mailbox != "" {
+		uri += "&mailbox=" + url.QueryEscape(mailbox)
+	}
+	err = c.doJSON("GET", uri, &headers)
+	return
+}
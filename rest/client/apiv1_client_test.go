@@ -1,6 +1,12 @@
 package client
 
-import "testing"
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/rest/model"
+)
 
 func TestClientV1ListMailbox(t *testing.T) {
 	var want, got string
@@ -28,6 +34,32 @@ func TestClientV1ListMailbox(t *testing.T) {
 	}
 }
 
+func TestClientV1ListMailboxByAuthUser(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{}
+	c.client = mth
+
+	// Method under test
+	c.ListMailboxByAuthUser("testbox", "svc@example.com")
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox?auth-user=svc%40example.com"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+}
+
 func TestClientV1GetMessage(t *testing.T) {
 	var want, got string
 
@@ -92,6 +124,233 @@ func TestClientV1GetMessageSource(t *testing.T) {
 	}
 }
 
+func TestClientV1GetMessageTranscript(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{
+		statusCode: 200,
+		body:       "S: 220 ready",
+	}
+	c.client = mth
+
+	// Method under test
+	transcript, err := c.GetMessageTranscript("testbox", "20170107T224128-0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/transcript"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	want = "S: 220 ready"
+	got = transcript.String()
+	if got != want {
+		t.Errorf("Transcript == %q, want: %q", got, want)
+	}
+}
+
+func TestClientV1WaitForMessage(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{statusCode: 200, body: `{"mailbox":"testbox","id":"0002"}`}
+	c.client = mth
+
+	// Method under test
+	message, err := c.WaitForMessage("testbox", "", "^Welcome", 20*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/wait?subject=%5EWelcome&timeout=20s"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	want = "0002"
+	got = message.ID
+	if got != want {
+		t.Errorf("message.ID == %q, want %q", got, want)
+	}
+
+	// No match within the timeout
+	mth.statusCode = 404
+	if _, err = c.WaitForMessage("testbox", "", "", 0); err == nil {
+		t.Error("Expected error for 404 response")
+	}
+}
+
+func TestClientV1GetMessageHeaders(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{}
+	c.client = mth
+
+	// Method under test
+	c.GetMessageHeaders("testbox", "20170107T224128-0000")
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/headers"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+}
+
+func TestClientV1GetMessageHTML(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{}
+	c.client = mth
+
+	// Method under test
+	c.GetMessageHTML("testbox", "20170107T224128-0000")
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/html"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+}
+
+func TestClientV1GetMessageText(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{
+		statusCode: 200,
+		body:       "Your code is 1234",
+	}
+	c.client = mth
+
+	// Method under test
+	text, err := c.GetMessageText("testbox", "20170107T224128-0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/text"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	want = "Your code is 1234"
+	got = text.String()
+	if got != want {
+		t.Errorf("Text == %q, want: %q", got, want)
+	}
+}
+
+func TestClientV1GetMessageParts(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{}
+	c.client = mth
+
+	// Method under test
+	c.GetMessageParts("testbox", "20170107T224128-0000")
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/parts"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+}
+
+func TestClientV1GetMessageAttachment(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{
+		statusCode: 200,
+		body:       "a,b,c\n",
+	}
+	c.client = mth
+
+	// Method under test
+	content, err := c.GetMessageAttachment("testbox", "20170107T224128-0000", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/attach/1"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	want = "a,b,c\n"
+	got = content.String()
+	if got != want {
+		t.Errorf("Content == %q, want: %q", got, want)
+	}
+}
+
 func TestClientV1DeleteMessage(t *testing.T) {
 	var want, got string
 
@@ -143,3 +402,363 @@ func TestClientV1PurgeMailbox(t *testing.T) {
 		t.Errorf("req.URL == %q, want %q", got, want)
 	}
 }
+
+func TestClientV1DeleteMessages(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{statusCode: 200, body: `{"deleted":3}`}
+	c.client = mth
+
+	// Method under test
+	deleted, err := c.DeleteMessages("testbox", 90*time.Minute, "fred", "^Re:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "DELETE"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox?from=fred&older-than=1h30m0s&subject=%5ERe%3A"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	if deleted != 3 {
+		t.Errorf("deleted == %v, want 3", deleted)
+	}
+
+	// Without filters nothing is requested
+	mth.req = nil
+	if _, err = c.DeleteMessages("testbox", 0, "", ""); err == nil {
+		t.Error("Expected error without filters")
+	}
+	if mth.req != nil {
+		t.Error("Expected no request without filters")
+	}
+}
+
+func TestClientV1ListMailboxes(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{
+		statusCode: 200,
+		body:       `[{"name":"alpha","count":2,"size":150,"newest":"2017-11-21T10:00:00Z"}]`,
+	}
+	c.client = mth
+
+	// Method under test
+	mailboxes, err := c.ListMailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailboxes"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	if len(mailboxes) != 1 {
+		t.Fatalf("len(mailboxes) == %v, want 1", len(mailboxes))
+	}
+	mb := mailboxes[0]
+	if mb.Name != "alpha" || mb.Count != 2 || mb.Size != 150 {
+		t.Errorf("mailboxes[0] == %+v, want alpha with 2 messages of 150 bytes", mb)
+	}
+	if mb.Newest == nil || !mb.Newest.Equal(time.Date(2017, 11, 21, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("mailboxes[0].Newest == %v, want 2017-11-21 10:00", mb.Newest)
+	}
+}
+
+func TestClientV1PurgeAllMailboxes(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetToken("s3cret")
+	mth := &mockHTTPClient{statusCode: 200, body: `{"deleted":7}`}
+	c.client = mth
+
+	// Method under test
+	deleted, err := c.PurgeAllMailboxes("example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "DELETE"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailboxes?domain=example.com&older-than=1h0m0s"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	want = "Bearer s3cret"
+	got = mth.req.Header.Get("Authorization")
+	if got != want {
+		t.Errorf("Authorization == %q, want %q", got, want)
+	}
+
+	if deleted != 7 {
+		t.Errorf("deleted == %v, want 7", deleted)
+	}
+}
+
+func TestClientV1ReleaseMessage(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{statusCode: 200}
+	c.client = mth
+
+	// Method under test
+	err = c.ReleaseMessage("testbox", "20170107T224128-0000", []string{"real@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "POST"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/release"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	body, err := ioutil.ReadAll(mth.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"to":["real@example.com"]}`
+	got = string(body)
+	if got != want {
+		t.Errorf("req.Body == %q, want %q", got, want)
+	}
+}
+
+func TestClientV1SetMessageFlags(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{statusCode: 200, body: `{"seen":false,"flagged":true}`}
+	c.client = mth
+
+	// Method under test
+	flagged := true
+	flags, err := c.SetMessageFlags("testbox", "20170107T224128-0000",
+		&model.JSONMessageFlagsV1{Flagged: &flagged})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "PATCH"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	body, err := ioutil.ReadAll(mth.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"flagged":true}`
+	got = string(body)
+	if got != want {
+		t.Errorf("req.Body == %q, want %q", got, want)
+	}
+
+	if flags.Seen == nil || *flags.Seen || flags.Flagged == nil || !*flags.Flagged {
+		t.Errorf("Got flags %+v, want seen false and flagged true", flags)
+	}
+}
+
+func TestClientV1MoveMessage(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{statusCode: 200, body: `{"mailbox":"other","id":"0002"}`}
+	c.client = mth
+
+	// Method under test
+	header, err := c.MoveMessage("testbox", "20170107T224128-0000", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "POST"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox/20170107T224128-0000/move"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	body, err := ioutil.ReadAll(mth.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"mailbox":"other"}`
+	got = string(body)
+	if got != want {
+		t.Errorf("req.Body == %q, want %q", got, want)
+	}
+
+	want = "0002"
+	got = header.ID
+	if got != want {
+		t.Errorf("header.ID == %q, want %q", got, want)
+	}
+}
+
+func TestClientV1SearchMessages(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{}
+	c.client = mth
+
+	// Method under test
+	c.SearchMessages("reset password", "testbox")
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/search?q=reset+password&mailbox=testbox"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+}
+
+func TestClientV1InjectMessage(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{statusCode: 200, body: `{"id":"20170107T224128-0000"}`}
+	c.client = mth
+
+	// Method under test
+	header, err := c.InjectMessage("testbox", &model.JSONInjectV1{Subject: "Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "POST"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v1/mailbox/testbox"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+
+	want = "application/json"
+	got = mth.req.Header.Get("Content-Type")
+	if got != want {
+		t.Errorf("Content-Type == %q, want %q", got, want)
+	}
+
+	want = "20170107T224128-0000"
+	got = header.ID
+	if got != want {
+		t.Errorf("header.ID == %q, want %q", got, want)
+	}
+}
+
+func TestClientV1InjectRawMessage(t *testing.T) {
+	var want, got string
+
+	c, err := NewV1(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{statusCode: 200, body: `{"id":"20170107T224128-0000"}`}
+	c.client = mth
+
+	// Method under test
+	_, err = c.InjectRawMessage("testbox", []byte("Subject: raw\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "message/rfc822"
+	got = mth.req.Header.Get("Content-Type")
+	if got != want {
+		t.Errorf("Content-Type == %q, want %q", got, want)
+	}
+
+	body, err := ioutil.ReadAll(mth.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Subject: raw\r\n\r\nbody\r\n"
+	got = string(body)
+	if got != want {
+		t.Errorf("req.Body == %q, want %q", got, want)
+	}
+
+	// Test failure
+	mth.statusCode = 400
+	if _, err = c.InjectRawMessage("testbox", nil); err == nil {
+		t.Error("Expected error for HTTP 400")
+	}
+}
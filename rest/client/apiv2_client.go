@@ -0,0 +1,49 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jhillyerd/inbucket/rest/model"
+)
+
+// ClientV2 accesses the Inbucket REST API v2
+type ClientV2 struct {
+	restClient
+}
+
+// NewV2 creates a new v2 REST API client given the base URL of an Inbucket server, ex:
+// "http://localhost:9000"
+func NewV2(baseURL string) (*ClientV2, error) {
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &ClientV2{
+		restClient{
+			client: &http.Client{
+				Timeout: 30 * time.Second,
+			},
+			baseURL: parsedURL,
+		},
+	}
+	return c, nil
+}
+
+// ListMailbox returns a page of at most limit messages from the requested mailbox, skipping
+// the first offset messages.  Messages are ordered by sort, which is one of date, size or
+// from, prefixed with a minus sign for descending order.
+func (c *ClientV2) ListMailbox(name string, limit, offset int, sort string) (
+	page *model.JSONMessagePageV2, err error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+	if sort != "" {
+		query.Set("sort", sort)
+	}
+	uri := "/api/v2/mailbox/" + url.QueryEscape(name) + "?" + query.Encode()
+	err = c.doJSON("GET", uri, &page)
+	return
+}
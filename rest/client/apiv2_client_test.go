@@ -0,0 +1,29 @@
+package client
+
+import "testing"
+
+func TestClientV2ListMailbox(t *testing.T) {
+	var want, got string
+
+	c, err := NewV2(baseURLStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mth := &mockHTTPClient{}
+	c.client = mth
+
+	// Method under test
+	c.ListMailbox("testbox", 20, 40, "-date")
+
+	want = "GET"
+	got = mth.req.Method
+	if got != want {
+		t.Errorf("req.Method == %q, want %q", got, want)
+	}
+
+	want = baseURLStr + "/api/v2/mailbox/testbox?limit=20&offset=40&sort=-date"
+	got = mth.req.URL.String()
+	if got != want {
+		t.Errorf("req.URL == %q, want %q", got, want)
+	}
+}
@@ -1,8 +1,10 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 )
@@ -16,10 +18,37 @@ type httpClient interface {
 type restClient struct {
 	client  httpClient
 	baseURL *url.URL
+	token   string // Sent as a bearer token if not empty
+}
+
+// SetToken sets the API token sent with every request, required when the server has API
+// tokens configured, and by admin endpoints such as PurgeAllMailboxes
+func (c *restClient) SetToken(token string) {
+	c.token = token
 }
 
 // do performs an HTTP request with this client and returns the response
 func (c *restClient) do(method, uri string) (*http.Response, error) {
+	return c.doBody(method, uri, nil)
+}
+
+// doBody performs an HTTP request with this client, sending v encoded as JSON if it is not
+// nil, and returns the response
+func (c *restClient) doBody(method, uri string, v interface{}) (*http.Response, error) {
+	if v == nil {
+		return c.doReader(method, uri, "", nil)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.doReader(method, uri, "application/json", bytes.NewReader(b))
+}
+
+// doReader performs an HTTP request with this client, sending the content of body with the
+// specified content type if body is not nil, and returns the response
+func (c *restClient) doReader(method, uri, contentType string, body io.Reader) (
+	*http.Response, error) {
 	rel, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
@@ -28,10 +57,16 @@ func (c *restClient) do(method, uri string) (*http.Response, error) {
 	url := c.baseURL.ResolveReference(rel)
 
 	// Build the request
-	req, err := http.NewRequest(method, url.String(), nil)
+	req, err := http.NewRequest(method, url.String(), body)
 	if err != nil {
 		return nil, err
 	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
 
 	// Send the request
 	return c.client.Do(req)
@@ -40,7 +40,7 @@ func TestDo(t *testing.T) {
 	var want, got string
 
 	mth := &mockHTTPClient{}
-	c := &restClient{mth, baseURL}
+	c := &restClient{client: mth, baseURL: baseURL}
 
 	_, err := c.do("POST", "/dopost")
 	if err != nil {
@@ -67,7 +67,7 @@ func TestDoJSON(t *testing.T) {
 		statusCode: 200,
 		body:       `{"foo": "bar"}`,
 	}
-	c := &restClient{mth, baseURL}
+	c := &restClient{client: mth, baseURL: baseURL}
 
 	var v map[string]interface{}
 	c.doJSON("GET", "/doget", &v)
@@ -99,7 +99,7 @@ func TestDoJSONNilV(t *testing.T) {
 	var want, got string
 
 	mth := &mockHTTPClient{statusCode: 200}
-	c := &restClient{mth, baseURL}
+	c := &restClient{client: mth, baseURL: baseURL}
 
 	err := c.doJSON("GET", "/doget", nil)
 	if err != nil {
@@ -0,0 +1,52 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+)
+
+// apiHandler wraps a REST handler with CORS, rate limits and API token checks
+func apiHandler(h httpd.Handler) httpd.Handler {
+	return withCORS(rateLimited(authorized(h)))
+}
+
+// withCORS wraps a REST handler to add CORS headers to its responses
+func withCORS(h httpd.Handler) httpd.Handler {
+	return func(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) error {
+		setCORSHeaders(w, req, ctx.WebConfig)
+		return h(w, req, ctx)
+	}
+}
+
+// setCORSHeaders adds the CORS response headers if the origin of req is allowed, returning true
+// if it was
+func setCORSHeaders(w http.ResponseWriter, req *http.Request, cfg config.WebConfig) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range cfg.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			return true
+		}
+	}
+	return false
+}
+
+// CORSPreflightV1 answers the OPTIONS request a browser sends before a cross-origin request
+func CORSPreflightV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	if !setCORSHeaders(w, req, ctx.WebConfig) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(ctx.WebConfig.CORSMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(ctx.WebConfig.CORSHeaders, ", "))
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
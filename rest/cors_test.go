@@ -0,0 +1,86 @@
+package rest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+func TestRestCORS(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{
+		APITokens:   []config.APIToken{{Name: "ci", Scope: "read", Token: "r3ad"}},
+		CORSOrigins: []string{"http://dash.example"},
+		CORSMethods: []string{"GET", "DELETE"},
+		CORSHeaders: []string{"Authorization"},
+	})
+	goodbox := &MockMailbox{}
+	goodbox.On("GetMessages").Return([]smtpd.Message{}, nil)
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+
+	request := func(method, origin, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, baseURL+"/mailbox/good", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		httpd.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test preflight
+	w := request("OPTIONS", "http://dash.example", "")
+	if w.Code != 204 {
+		t.Errorf("Expected preflight code 204, got %v", w.Code)
+	}
+	var testTable = []struct {
+		header, want string
+	}{
+		{"Access-Control-Allow-Origin", "http://dash.example"},
+		{"Access-Control-Allow-Methods", "GET, DELETE"},
+		{"Access-Control-Allow-Headers", "Authorization"},
+	}
+	for _, tt := range testTable {
+		if got := w.Header().Get(tt.header); got != tt.want {
+			t.Errorf("Preflight %v == %q, want %q", tt.header, got, tt.want)
+		}
+	}
+	w = request("OPTIONS", "http://evil.example", "")
+	if w.Code != 403 {
+		t.Errorf("Expected preflight code 403 for other origin, got %v", w.Code)
+	}
+
+	// Test requests, including failed ones
+	for _, token := range []string{"r3ad", ""} {
+		w = request("GET", "http://dash.example", token)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://dash.example" {
+			t.Errorf("Access-Control-Allow-Origin == %q with token %q, want origin", got, token)
+		}
+	}
+	w = request("GET", "http://evil.example", "r3ad")
+	if w.Code != 200 {
+		t.Errorf("Expected code 200, got %v", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin == %q for other origin, want none", got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
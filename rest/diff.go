@@ -0,0 +1,119 @@
+package rest
+
+import (
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// diffIgnoredHeaders differ between any two deliveries of the same message, so are left out of
+// message diffs unless asked for
+var diffIgnoredHeaders = []string{"Date", "Message-Id", "Received", "Return-Path"}
+
+// maxDiffCells limits the size of the table lineDiff compares lines with, larger inputs are
+// reported as entirely changed
+const maxDiffCells = 16 * 1024 * 1024
+
+// lineChange is a line deleted from the first text of a diff or inserted from the second, Line
+// numbers start at one
+type lineChange struct {
+	Op   string // "-" for deleted lines, "+" for inserted lines
+	Line int
+	Text string
+}
+
+// headerChange is a header field whose values differ between two messages
+type headerChange struct {
+	Name string
+	A, B []string
+}
+
+// headerDiff returns the fields that differ between a and b, sorted by name, skipping those
+// named in ignore
+func headerDiff(a, b mail.Header, ignore []string) []headerChange {
+	skip := make(map[string]bool, len(ignore))
+	for _, name := range ignore {
+		skip[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	names := make([]string, 0, len(a)+len(b))
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changes []headerChange
+	for _, name := range names {
+		if skip[textproto.CanonicalMIMEHeaderKey(name)] || reflect.DeepEqual(a[name], b[name]) {
+			continue
+		}
+		changes = append(changes, headerChange{Name: name, A: a[name], B: b[name]})
+	}
+	return changes
+}
+
+// splitLines splits text into lines, ignoring CRs and the newline ending the last line
+func splitLines(text string) []string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// lineDiff returns the lines to delete from a and insert from b to turn a into b, following a
+// longest common subsequence of their lines
+func lineDiff(a, b []string) []lineChange {
+	// Lines shared at the start and end need not be compared
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		start++
+	}
+	end := 0
+	for end < len(a)-start && end < len(b)-start && a[len(a)-1-end] == b[len(b)-1-end] {
+		end++
+	}
+	ra, rb := a[start:len(a)-end], b[start:len(b)-end]
+	n, m := len(ra), len(rb)
+
+	// lcs[i*(m+1)+j] is the length of the longest common subsequence of ra[i:] and rb[j:]
+	var lcs []int
+	if (n+1)*(m+1) <= maxDiffCells {
+		lcs = make([]int, (n+1)*(m+1))
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				switch {
+				case ra[i] == rb[j]:
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+				case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+				default:
+					lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+				}
+			}
+		}
+	}
+
+	var changes []lineChange
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case lcs != nil && i < n && j < m && ra[i] == rb[j]:
+			i++
+			j++
+		case i < n && (j == m || lcs == nil || lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]):
+			changes = append(changes, lineChange{Op: "-", Line: start + i + 1, Text: ra[i]})
+			i++
+		default:
+			changes = append(changes, lineChange{Op: "+", Line: start + j + 1, Text: rb[j]})
+			j++
+		}
+	}
+	return changes
+}
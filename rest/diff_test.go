@@ -0,0 +1,53 @@
+package rest
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineDiff(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		want []lineChange
+	}{
+		{"same\nlines\n", "same\r\nlines", nil},
+		{"", "added\n", []lineChange{{"+", 1, "added"}}},
+		{"removed\n", "", []lineChange{{"-", 1, "removed"}}},
+		{
+			"Hello Fred,\nYour code is 1234\nThanks\n",
+			"Hello Fred,\nYour code is 5678\nThanks\n",
+			[]lineChange{{"-", 2, "Your code is 1234"}, {"+", 2, "Your code is 5678"}},
+		},
+		{
+			"a\nb\nc\nd\n",
+			"a\nc\nd\ne\n",
+			[]lineChange{{"-", 2, "b"}, {"+", 4, "e"}},
+		},
+	}
+	for _, tc := range testCases {
+		got := lineDiff(splitLines(tc.a), splitLines(tc.b))
+		assert.Equal(t, tc.want, got, "lineDiff(%q, %q)", tc.a, tc.b)
+	}
+}
+
+func TestHeaderDiff(t *testing.T) {
+	a := mail.Header{
+		"Subject":    {"Welcome"},
+		"Date":       {"Mon, 02 Jan 2017 15:04:05 +0000"},
+		"X-Campaign": {"one"},
+	}
+	b := mail.Header{
+		"Subject": {"Welcome!"},
+		"Date":    {"Tue, 03 Jan 2017 15:04:05 +0000"},
+		"X-Extra": {"yes"},
+	}
+	want := []headerChange{
+		{"Subject", []string{"Welcome"}, []string{"Welcome!"}},
+		{"X-Campaign", []string{"one"}, nil},
+		{"X-Extra", nil, []string{"yes"}},
+	}
+	assert.Equal(t, want, headerDiff(a, b, []string{"date"}))
+	assert.Len(t, headerDiff(a, b, nil), 4)
+}
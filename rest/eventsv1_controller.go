@@ -0,0 +1,222 @@
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// writeEventStreamHeader starts the response to an event stream, which ends when the connection
+// is closed, keeping the headers already set on the response such as those for CORS
+func writeEventStreamHeader(w io.Writer, header http.Header) error {
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "close")
+	if _, err := io.WriteString(w, "HTTP/1.1 200 OK\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// event is a server-sent event, Data is encoded as JSON
+type event struct {
+	Name string
+	Data interface{}
+}
+
+// eventListeners receive the messages deleted from the datastore
+var eventListeners = struct {
+	sync.Mutex
+	m map[*eventListener]struct{}
+}{m: make(map[*eventListener]struct{})}
+
+// NotifyDelete sends a delete event to the event streams watching mailbox, it should be
+// registered with smtpd.AddDeleteHook
+func NotifyDelete(mailbox, id string) {
+	eventListeners.Lock()
+	defer eventListeners.Unlock()
+	for el := range eventListeners.m {
+		el.send(mailbox, &event{
+			Name: "delete",
+			Data: &model.JSONMessageRefV1{Mailbox: mailbox, ID: id},
+		})
+	}
+}
+
+// eventListener queues delivery and delete events for an event stream
+type eventListener struct {
+	hub     *msghub.Hub               // Global message hub
+	c       chan *event               // Queue of events to send
+	mailbox string                    // Name of mailbox to watch, "" == all mailboxes
+	visible func(mailbox string) bool // Watched mailboxes, nil == all mailboxes
+	done    chan struct{}             // Closed once the listener is removed
+	once    sync.Once
+}
+
+// newEventListener creates a listener and registers it for new deliveries and deletes.
+// Optional mailbox parameter will restrict events to that mailbox only, and the optional
+// visible function to the mailboxes it returns true for.
+func newEventListener(hub *msghub.Hub, mailbox string,
+	visible func(mailbox string) bool) *eventListener {
+	el := &eventListener{
+		hub:     hub,
+		c:       make(chan *event, 100),
+		mailbox: mailbox,
+		visible: visible,
+		done:    make(chan struct{}),
+	}
+	hub.AddLiveListener(el)
+	eventListeners.Lock()
+	eventListeners.m[el] = struct{}{}
+	eventListeners.Unlock()
+	return el
+}
+
+// Receive queues a delivery event, it implements msghub.Listener
+func (el *eventListener) Receive(msg msghub.Message) error {
+	el.send(msg.Mailbox, &event{
+		Name: "delivery",
+		Data: &model.JSONMessageHeaderV1{
+			Mailbox: msg.Mailbox,
+			ID:      msg.ID,
+			From:    msg.From,
+			To:      msg.To,
+			Subject: msg.Subject,
+			Date:    msg.Date,
+			Size:    msg.Size,
+		},
+	})
+	return nil
+}
+
+// send queues an event for mailbox if the listener is watching it, events are dropped if the
+// client is not keeping up
+func (el *eventListener) send(mailbox string, ev *event) {
+	if el.mailbox != "" && el.mailbox != mailbox {
+		// Did not match mailbox name
+		return
+	}
+	if el.visible != nil && !el.visible(mailbox) {
+		return
+	}
+	select {
+	case el.c <- ev:
+	default:
+		log.Warnf("Event stream queue full, dropped %v event for %v", ev.Name, mailbox)
+	}
+}
+
+// Close removes the listener registrations
+func (el *eventListener) Close() {
+	el.once.Do(func() {
+		el.hub.RemoveListener(el)
+		eventListeners.Lock()
+		delete(eventListeners.m, el)
+		eventListeners.Unlock()
+		close(el.done)
+	})
+}
+
+// writeEvent writes ev in the text/event-stream format
+func writeEvent(w io.Writer, ev *event) error {
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, data)
+	return err
+}
+
+// EventsAllMessagesV1 streams delivery and delete events for all mailboxes as server-sent
+// events
+func EventsAllMessagesV1(
+	w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	return serveEvents(w, req, ctx, "")
+}
+
+// EventsMailboxMessagesV1 streams delivery and delete events for a mailbox as server-sent
+// events
+func EventsMailboxMessagesV1(
+	w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	return serveEvents(w, req, ctx, name)
+}
+
+// serveEvents takes over the connection, so that the server write timeout does not end the
+// stream, and writes events to it until the client disconnects
+func serveEvents(w http.ResponseWriter, req *http.Request, ctx *httpd.Context,
+	mailbox string) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("Event streams are not supported by this connection")
+	}
+	// The response headers can not be read once the connection is taken over
+	header := w.Header()
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	log.Tracef("HTTP[%v] Started event stream", req.RemoteAddr)
+
+	el := newEventListener(ctx.MsgHub, mailbox, func(name string) bool {
+		return mailboxVisible(req, ctx, name)
+	})
+	defer el.Close()
+	go func() {
+		// Anything sent by the client is discarded, the read fails once it disconnects
+		_ = conn.SetReadDeadline(time.Time{})
+		_, _ = io.Copy(ioutil.Discard, rw)
+		el.Close()
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	err = writeEventStreamHeader(rw, header)
+	for err == nil {
+		if err = flushEvents(conn, rw.Writer); err != nil {
+			break
+		}
+		select {
+		case <-el.done:
+			log.Tracef("HTTP[%v] Closing event stream", req.RemoteAddr)
+			return nil
+		case ev := <-el.c:
+			err = writeEvent(rw, ev)
+		case <-ticker.C:
+			// A comment keeps proxies from closing an idle connection
+			_, err = rw.WriteString(": ping\n\n")
+		}
+	}
+	log.Tracef("HTTP[%v] Event stream error: %v", req.RemoteAddr, err)
+	return nil
+}
+
+// flushEvents sends buffered events to the client
+func flushEvents(conn net.Conn, w *bufio.Writer) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
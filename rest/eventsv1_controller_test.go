@@ -0,0 +1,105 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/msghub"
+)
+
+func TestRestEventStream(t *testing.T) {
+	// Setup
+	logbuf := setupWebServer(&MockDataStore{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := msghub.New(ctx, 10)
+	hub.Dispatch(msghub.Message{Mailbox: "good", ID: "0000"})
+
+	handled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			defer close(handled)
+			ctx := &httpd.Context{
+				MsgHub:    hub,
+				WebConfig: config.WebConfig{CORSOrigins: []string{"https://app.example.com"}},
+			}
+			_ = withCORS(func(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) error {
+				return serveEvents(w, req, ctx, "good")
+			})(w, req, ctx)
+		}))
+	defer server.Close()
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://app.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	for _, tc := range []struct{ name, want string }{
+		{"Content-Type", "text/event-stream"},
+		{"Access-Control-Allow-Origin", "https://app.example.com"},
+		{"Vary", "Origin"},
+	} {
+		if got := resp.Header.Get(tc.name); got != tc.want {
+			t.Errorf("%v == %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// History is not replayed, other mailboxes are ignored
+	hub.Sync()
+	date := time.Date(2017, 11, 21, 10, 0, 0, 0, time.UTC)
+	hub.Dispatch(msghub.Message{Mailbox: "other", ID: "0001"})
+	hub.Dispatch(msghub.Message{Mailbox: "good", ID: "0002", From: "a@b", Date: date, Size: 9})
+	hub.Sync()
+	NotifyDelete("other", "0001")
+	NotifyDelete("good", "0002")
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	want := "event: delivery\n" + `data: {"mailbox":"good","id":"0002","from":"a@b","to":null,` +
+		`"subject":"","date":"2017-11-21T10:00:00Z","size":9,"auth-user":""}` + "\n"
+	if got := readEvent(); got != want {
+		t.Errorf("Got event %q, want %q", got, want)
+	}
+	want = "event: delete\n" + `data: {"mailbox":"good","id":"0002"}` + "\n"
+	if got := readEvent(); got != want {
+		t.Errorf("Got event %q, want %q", got, want)
+	}
+
+	// The handler removes its listener once the client disconnects, before hub shuts down
+	_ = resp.Body.Close()
+	<-handled
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,201 @@
+package rest
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// writeMbox writes messages to w in mboxrd format: each message follows a From_ line with its
+// envelope sender and date, lines are LF terminated, and body lines starting with any number of
+// '>' followed by "From " gain another '>'
+func writeMbox(w io.Writer, messages []smtpd.Message) error {
+	bw := bufio.NewWriter(w)
+	for _, msg := range messages {
+		sender := msg.Delivery().MailFrom
+		if sender == "" {
+			sender = "MAILER-DAEMON"
+		}
+		_, _ = fmt.Fprintf(bw, "From %s %s\n", sender,
+			msg.Date().UTC().Format("Mon Jan _2 15:04:05 2006"))
+		if err := writeMboxMessage(bw, msg); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeMboxMessage writes the source of msg to w with From_ quoting, followed by a blank line
+func writeMboxMessage(w *bufio.Writer, msg smtpd.Message) error {
+	raw, err := msg.RawReader()
+	if err != nil {
+		return fmt.Errorf("RawReader(%q) failed: %v", msg.ID(), err)
+	}
+	defer func() {
+		_ = raw.Close()
+	}()
+	r := bufio.NewReader(raw)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				_ = w.WriteByte('>')
+			}
+			_, _ = w.Write(line)
+			_ = w.WriteByte('\n')
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read %q: %v", msg.ID(), err)
+		}
+	}
+	_, err = w.WriteString("\n")
+	return err
+}
+
+// writeZip writes messages to w as a ZIP archive holding one .eml file per message, named
+// after the message ID and dated when it was received
+func writeZip(w io.Writer, messages []smtpd.Message) error {
+	zw := zip.NewWriter(w)
+	for _, msg := range messages {
+		fh := &zip.FileHeader{Name: msg.ID() + ".eml", Method: zip.Deflate}
+		fh.SetModTime(msg.Date())
+		fw, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		raw, err := msg.RawReader()
+		if err != nil {
+			return fmt.Errorf("RawReader(%q) failed: %v", msg.ID(), err)
+		}
+		_, err = io.Copy(fw, raw)
+		_ = raw.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read %q: %v", msg.ID(), err)
+		}
+	}
+	return zw.Close()
+}
+
+// importedMessage is a message read from an uploaded mbox file or ZIP archive
+type importedMessage struct {
+	mailFrom string // Envelope sender from the From_ line, empty if unknown
+	raw      []byte
+}
+
+// readMbox splits an mbox file into messages.  A From_ line at the start of the file or after
+// a blank line begins a message, mboxrd quoting is removed and lines are CRLF terminated.
+func readMbox(upload []byte) []importedMessage {
+	var messages []importedMessage
+	var cur *bytes.Buffer
+	var mailFrom string
+	blank := true
+	finish := func() {
+		if cur == nil {
+			return
+		}
+		raw := cur.Bytes()
+		// The blank line before the next From_ line separates messages
+		raw = bytes.TrimSuffix(raw, []byte("\r\n\r\n"))
+		if len(raw) < cur.Len() {
+			raw = append(raw, '\r', '\n')
+		}
+		messages = append(messages, importedMessage{mailFrom: mailFrom, raw: raw})
+	}
+	for _, line := range bytes.Split(upload, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if blank && bytes.HasPrefix(line, []byte("From ")) {
+			finish()
+			cur = new(bytes.Buffer)
+			mailFrom = ""
+			if fields := strings.Fields(string(line[5:])); len(fields) > 0 &&
+				fields[0] != "MAILER-DAEMON" {
+				mailFrom = fields[0]
+			}
+			blank = false
+			continue
+		}
+		blank = len(line) == 0
+		if cur == nil {
+			// Text before the first From_ line is not part of a message
+			continue
+		}
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) && line[0] == '>' {
+			line = line[1:]
+		}
+		cur.Write(line)
+		cur.WriteString("\r\n")
+	}
+	if cur != nil {
+		// The final newline of the file does not begin another line
+		raw := bytes.TrimSuffix(cur.Bytes(), []byte("\r\n"))
+		cur.Truncate(len(raw))
+	}
+	finish()
+	return messages
+}
+
+// importSizeError reports an entry of a ZIP archive that unpacks to more than a size limit
+type importSizeError struct {
+	name string
+	max  int
+}
+
+func (e *importSizeError) Error() string {
+	return fmt.Sprintf("%s unpacks to more than %v bytes", e.name, e.max)
+}
+
+// readZip returns the content of each .eml file in a ZIP archive, in archive order.  Each file
+// may unpack to at most maxMessage bytes, and all of them to at most maxTotal bytes; limits of
+// 0 are unlimited.
+func readZip(upload []byte, maxMessage, maxTotal int) ([]importedMessage, error) {
+	zr, err := zip.NewReader(bytes.NewReader(upload), int64(len(upload)))
+	if err != nil {
+		return nil, err
+	}
+	var messages []importedMessage
+	total := 0
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".eml") {
+			continue
+		}
+		// The smaller of the message limit and what remains of the total limit
+		max, limited := maxMessage, maxMessage > 0
+		if maxTotal > 0 && (!limited || maxTotal-total < max) {
+			max, limited = maxTotal-total, true
+		}
+		if limited && f.UncompressedSize64 > uint64(max) {
+			return nil, &importSizeError{f.Name, max}
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		// The recorded size may be false, so never read past the limit
+		var lr io.Reader = r
+		if limited {
+			lr = io.LimitReader(r, int64(max)+1)
+		}
+		raw, err := ioutil.ReadAll(lr)
+		_ = r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		if limited && len(raw) > max {
+			return nil, &importSizeError{f.Name, max}
+		}
+		total += len(raw)
+		messages = append(messages, importedMessage{raw: raw})
+	}
+	return messages, nil
+}
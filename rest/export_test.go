@@ -0,0 +1,157 @@
+package rest
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+func exportMessage(id, mailFrom, source string) *MockMessage {
+	msg := &MockMessage{}
+	msg.On("ID").Return(id)
+	msg.On("Date").Return(time.Date(2017, 11, 2, 15, 4, 5, 0, time.FixedZone("", 3600)))
+	msg.On("Delivery").Return(smtpd.Delivery{MailFrom: mailFrom})
+	msg.On("RawReader").Return(ioutil.NopCloser(strings.NewReader(source)), nil)
+	return msg
+}
+
+func TestWriteMbox(t *testing.T) {
+	messages := []smtpd.Message{
+		exportMessage("0001", "fred@example.com",
+			"Subject: one\r\n\r\nFrom here\r\n>From there\r\nFrom: not a header\r\n"),
+		exportMessage("0002", "", "Subject: bounce\r\n\r\nno newline"),
+	}
+	b := new(bytes.Buffer)
+	if err := writeMbox(b, messages); err != nil {
+		t.Fatal(err)
+	}
+	want := "From fred@example.com Thu Nov  2 14:04:05 2017\n" +
+		"Subject: one\n\n>From here\n>>From there\nFrom: not a header\n\n" +
+		"From MAILER-DAEMON Thu Nov  2 14:04:05 2017\n" +
+		"Subject: bounce\n\nno newline\n\n"
+	assert.Equal(t, want, b.String())
+}
+
+func TestWriteZip(t *testing.T) {
+	messages := []smtpd.Message{
+		exportMessage("0001", "fred@example.com", "Subject: one\r\n\r\nFirst\r\n"),
+		exportMessage("0002", "", "Subject: two\r\n\r\nSecond\r\n"),
+	}
+	b := new(bytes.Buffer)
+	if err := writeZip(b, messages); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, zr.File, 2) {
+		return
+	}
+	for i, want := range []string{"Subject: one\r\n\r\nFirst\r\n", "Subject: two\r\n\r\nSecond\r\n"} {
+		f := zr.File[i]
+		assert.Equal(t, messages[i].ID()+".eml", f.Name)
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		_ = r.Close()
+		assert.Equal(t, want, string(got))
+	}
+}
+
+func TestReadMbox(t *testing.T) {
+	// Text before the first From_ line is ignored, unquoted From lines inside a paragraph are
+	// not separators
+	mbox := "preamble\n\n" +
+		"From fred@example.com Thu Nov  2 14:04:05 2017\n" +
+		"Subject: one\n\n>From here\n>>From there\nFrom within\n\n\n" +
+		"From MAILER-DAEMON Thu Nov  2 14:04:05 2017\r\n" +
+		"Subject: bounce\r\n\r\nno newline"
+	messages := readMbox([]byte(mbox))
+	if !assert.Len(t, messages, 2) {
+		return
+	}
+	assert.Equal(t, "fred@example.com", messages[0].mailFrom)
+	assert.Equal(t, "Subject: one\r\n\r\nFrom here\r\n>From there\r\nFrom within\r\n\r\n",
+		string(messages[0].raw))
+	assert.Equal(t, "", messages[1].mailFrom)
+	assert.Equal(t, "Subject: bounce\r\n\r\nno newline", string(messages[1].raw))
+}
+
+func TestReadZip(t *testing.T) {
+	b := new(bytes.Buffer)
+	zw := zip.NewWriter(b)
+	for _, f := range []struct{ name, content string }{
+		{"0001.eml", "Subject: one\r\n\r\nFirst\r\n"},
+		{"notes.txt", "Not a message"},
+		{"dir/0002.EML", "Subject: two\r\n\r\nSecond\r\n"},
+	} {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write([]byte(f.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := readZip(b.Bytes(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, messages, 2) {
+		return
+	}
+	assert.Equal(t, "Subject: one\r\n\r\nFirst\r\n", string(messages[0].raw))
+	assert.Equal(t, "Subject: two\r\n\r\nSecond\r\n", string(messages[1].raw))
+
+	_, err = readZip([]byte("not a zip"), 0, 0)
+	assert.Error(t, err)
+}
+
+func TestReadZipLimits(t *testing.T) {
+	// Highly compressible entries, as in a ZIP bomb
+	b := new(bytes.Buffer)
+	zw := zip.NewWriter(b)
+	for _, name := range []string{"0001.eml", "0002.eml"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write(bytes.Repeat([]byte("a"), 10000))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var testTable = []struct {
+		maxMessage, maxTotal int
+		ok                   bool
+	}{
+		{0, 0, true},
+		{10000, 20000, true},
+		{9999, 0, false},
+		{0, 19999, false},
+		{10000, 15000, false},
+		{0, 10000, false},
+	}
+	for _, tt := range testTable {
+		messages, err := readZip(b.Bytes(), tt.maxMessage, tt.maxTotal)
+		if tt.ok {
+			assert.NoError(t, err, "limits %v, %v", tt.maxMessage, tt.maxTotal)
+			assert.Len(t, messages, 2, "limits %v, %v", tt.maxMessage, tt.maxTotal)
+			continue
+		}
+		if assert.Error(t, err, "limits %v, %v", tt.maxMessage, tt.maxTotal) {
+			assert.IsType(t, &importSizeError{}, err)
+		}
+	}
+}
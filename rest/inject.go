@@ -0,0 +1,91 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/rest/model"
+)
+
+// buildMessage generates an RFC 5322 message from the JSON description of a message to
+// inject.  The body is multipart/alternative if it has both text and HTML, and is wrapped in
+// multipart/mixed along with any attachments.
+func buildMessage(inject *model.JSONInjectV1, now time.Time) []byte {
+	b := new(bytes.Buffer)
+	line := func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(b, format+"\r\n", args...)
+	}
+	line("From: %s", inject.From)
+	line("To: %s", strings.Join(inject.To, ", "))
+	line("Subject: %s", mime.QEncoding.Encode("utf-8", inject.Subject))
+	line("Date: %s", now.Format(time.RFC1123Z))
+	line("Message-ID: <%x.inject@inbucket>", now.UnixNano())
+	line("MIME-Version: 1.0")
+	if len(inject.Attachments) == 0 {
+		writeBody(b, inject.Body, now)
+		return b.Bytes()
+	}
+
+	boundary := fmt.Sprintf("inbucket-mixed-%x", now.UnixNano())
+	line("Content-Type: multipart/mixed; boundary=\"%s\"", boundary)
+	line("")
+	line("--%s", boundary)
+	writeBody(b, inject.Body, now)
+	for _, a := range inject.Attachments {
+		line("--%s", boundary)
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		line("Content-Type: %s", contentType)
+		line("Content-Transfer-Encoding: base64")
+		line("Content-Disposition: %s",
+			mime.FormatMediaType("attachment", map[string]string{"filename": a.FileName}))
+		line("")
+		encoded := base64.StdEncoding.EncodeToString(a.Content)
+		for len(encoded) > 76 {
+			line("%s", encoded[:76])
+			encoded = encoded[76:]
+		}
+		line("%s", encoded)
+	}
+	line("--%s--", boundary)
+	return b.Bytes()
+}
+
+// writeBody writes the header fields and content of the text and HTML body parts, a message
+// without either gets an empty text body
+func writeBody(b *bytes.Buffer, body model.JSONMessageBodyV1, now time.Time) {
+	if body.Text != "" && body.HTML != "" {
+		boundary := fmt.Sprintf("inbucket-alt-%x", now.UnixNano())
+		_, _ = fmt.Fprintf(b, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n",
+			boundary)
+		_, _ = fmt.Fprintf(b, "--%s\r\n", boundary)
+		writeTextPart(b, "text/plain", body.Text)
+		_, _ = fmt.Fprintf(b, "--%s\r\n", boundary)
+		writeTextPart(b, "text/html", body.HTML)
+		_, _ = fmt.Fprintf(b, "--%s--\r\n", boundary)
+		return
+	}
+	if body.HTML != "" {
+		writeTextPart(b, "text/html", body.HTML)
+		return
+	}
+	writeTextPart(b, "text/plain", body.Text)
+}
+
+// writeTextPart writes the header fields and quoted-printable content of a text part
+func writeTextPart(b *bytes.Buffer, contentType, text string) {
+	_, _ = fmt.Fprintf(b, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	_, _ = fmt.Fprintf(b, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	// Line breaks are written as CRLF by the quoted-printable writer
+	qp := quotedprintable.NewWriter(b)
+	_, _ = qp.Write([]byte(text))
+	_ = qp.Close()
+	_, _ = fmt.Fprintf(b, "\r\n")
+}
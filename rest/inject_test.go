@@ -0,0 +1,77 @@
+package rest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildMessage(t *testing.T) {
+	now := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	inject := &model.JSONInjectV1{
+		From:    "Fred <fred@example.com>",
+		To:      []string{"wilma@example.com", "barney@example.com"},
+		Subject: "Café report",
+		Body:    model.JSONMessageBodyV1{Text: "Hello\nthere", HTML: "<p>Hello</p>"},
+		Attachments: []*model.JSONInjectAttachmentV1{
+			{FileName: "report.csv", ContentType: "text/csv", Content: []byte("a,b\n1,2\n")},
+		},
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(buildMessage(inject, now)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Fred <fred@example.com>", msg.Header.Get("From"))
+	assert.Equal(t, "wilma@example.com, barney@example.com", msg.Header.Get("To"))
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	assert.Equal(t, "Café report", subject)
+	assert.Equal(t, "Mon, 02 Jan 2017 15:04:05 +0000", msg.Header.Get("Date"))
+
+	// multipart/mixed containing multipart/alternative and the attachment
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+	mixed := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	assert.Equal(t, "multipart/alternative", mediaType)
+	alt := multipart.NewReader(part, params["boundary"])
+	for _, want := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", "Hello\r\nthere"},
+		{"text/html; charset=utf-8", "<p>Hello</p>"},
+	} {
+		// multipart.Reader decodes quoted-printable parts
+		p, err := alt.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want.contentType, p.Header.Get("Content-Type"))
+		content, _ := ioutil.ReadAll(p)
+		assert.Equal(t, want.content, string(content))
+	}
+	part, err = mixed.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text/csv", part.Header.Get("Content-Type"))
+	assert.Equal(t, "report.csv", part.FileName())
+	assert.Equal(t, "base64", part.Header.Get("Content-Transfer-Encoding"))
+
+	// A text only message has no multipart structure
+	inject = &model.JSONInjectV1{From: "a@example.com", Body: model.JSONMessageBodyV1{Text: "x"}}
+	msg, err = mail.ReadMessage(bytes.NewReader(buildMessage(inject, now)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text/plain; charset=utf-8", msg.Header.Get("Content-Type"))
+}
@@ -7,13 +7,16 @@ import (
 
 // JSONMessageHeaderV1 contains the basic header data for a message
 type JSONMessageHeaderV1 struct {
-	Mailbox string    `json:"mailbox"`
-	ID      string    `json:"id"`
-	From    string    `json:"from"`
-	To      []string  `json:"to"`
-	Subject string    `json:"subject"`
-	Date    time.Time `json:"date"`
-	Size    int64     `json:"size"`
+	Mailbox  string    `json:"mailbox"`
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Date     time.Time `json:"date"`
+	Size     int64     `json:"size"`
+	AuthUser string    `json:"auth-user"`
+	Seen     bool      `json:"seen,omitempty"`
+	Flagged  bool      `json:"flagged,omitempty"`
 }
 
 // JSONMessageV1 contains the same data as the header plus a JSONMessageBody
@@ -25,9 +28,14 @@ type JSONMessageV1 struct {
 	Subject     string                     `json:"subject"`
 	Date        time.Time                  `json:"date"`
 	Size        int64                      `json:"size"`
+	AuthUser    string                     `json:"auth-user"`
+	Seen        bool                       `json:"seen,omitempty"`
+	Flagged     bool                       `json:"flagged,omitempty"`
 	Body        *JSONMessageBodyV1         `json:"body"`
 	Header      mail.Header                `json:"header"`
 	Attachments []*JSONMessageAttachmentV1 `json:"attachments"`
+	DKIM        []*JSONDKIMResultV1        `json:"dkim"`
+	Envelope    *JSONEnvelopeV1            `json:"envelope"`
 }
 
 type JSONMessageAttachmentV1 struct {
@@ -38,8 +46,221 @@ type JSONMessageAttachmentV1 struct {
 	MD5          string `json:"md5"`
 }
 
+// JSONDKIMResultV1 describes the verification of a single DKIM signature
+type JSONDKIMResultV1 struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Result   string `json:"result"`
+	Reason   string `json:"reason"`
+}
+
+// JSONEnvelopeV1 describes the SMTP transaction that delivered a message
+type JSONEnvelopeV1 struct {
+	MailFrom   string            `json:"mail-from"`
+	RcptTo     []string          `json:"rcpt-to"`
+	MailParams string            `json:"mail-params"`
+	RcptParams map[string]string `json:"rcpt-params"`
+	Helo       string            `json:"helo"`
+	RemoteAddr string            `json:"remote-addr"`
+	Added      []string          `json:"added-headers"`
+}
+
+// JSONDeliveryV1 describes the SMTP session that delivered a message, Received keeps the
+// time zone of the server that received it
+type JSONDeliveryV1 struct {
+	Received      time.Time `json:"received"`
+	SessionID     int       `json:"session-id"`
+	Protocol      string    `json:"protocol"`
+	RemoteAddr    string    `json:"remote-addr"`
+	Helo          string    `json:"helo"`
+	TLSVersion    string    `json:"tls-version"`
+	TLSCipher     string    `json:"tls-cipher"`
+	ClientCert    string    `json:"client-cert"`
+	AuthUser      string    `json:"auth-user"`
+	AuthMechanism string    `json:"auth-mechanism"`
+	MailFrom      string    `json:"mail-from"`
+	RcptTo        []string  `json:"rcpt-to"`
+}
+
+// JSONReleaseV1 is the request body for releasing a message to real recipients
+type JSONReleaseV1 struct {
+	To []string `json:"to"`
+}
+
+// JSONMessageFlagsV1 is the request body for changing the flags of a message, flags left out
+// are unchanged
+type JSONMessageFlagsV1 struct {
+	Seen    *bool `json:"seen,omitempty"`
+	Flagged *bool `json:"flagged,omitempty"`
+}
+
+// JSONTransferV1 is the request body for copying or moving a message to another mailbox
+type JSONTransferV1 struct {
+	Mailbox string `json:"mailbox"`
+}
+
 // JSONMessageBodyV1 contains the Text and HTML versions of the message body
 type JSONMessageBodyV1 struct {
 	Text string `json:"text"`
 	HTML string `json:"html"`
 }
+
+// JSONSanitizedHTMLV1 is the HTML body of a message with scripts, forms and external loads
+// removed, and a description of each thing removed
+type JSONSanitizedHTMLV1 struct {
+	HTML    string           `json:"html"`
+	Removed []*JSONRemovalV1 `json:"removed"`
+}
+
+// JSONRemovalV1 describes an element, attribute or external load removed from HTML
+type JSONRemovalV1 struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// JSONMessageDiffV1 describes how a second message differs from the first, Equal is true when
+// none of the compared headers or bodies differ
+type JSONMessageDiffV1 struct {
+	Equal   bool                `json:"equal"`
+	Headers []*JSONHeaderDiffV1 `json:"headers"`
+	Text    []*JSONLineDiffV1   `json:"text"`
+	HTML    []*JSONLineDiffV1   `json:"html"`
+}
+
+// JSONHeaderDiffV1 is a header field with different values in the two messages, a field
+// missing from one of them has no values there
+type JSONHeaderDiffV1 struct {
+	Name string   `json:"name"`
+	A    []string `json:"a"`
+	B    []string `json:"b"`
+}
+
+// JSONLineDiffV1 is a line of a body deleted from the first message, op "-", or inserted from
+// the second, op "+".  Line is its line number in that message, starting at one.
+type JSONLineDiffV1 struct {
+	Op   string `json:"op"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// JSONMIMEPartV1 describes a part of the MIME structure of a message, multipart parts contain
+// their children in Parts
+type JSONMIMEPartV1 struct {
+	Path        string            `json:"path"`
+	ContentType string            `json:"content-type"`
+	Charset     string            `json:"charset"`
+	Disposition string            `json:"disposition"`
+	FileName    string            `json:"filename"`
+	ContentID   string            `json:"content-id"`
+	Size        int               `json:"size"`
+	Parts       []*JSONMIMEPartV1 `json:"parts"`
+}
+
+// JSONInjectV1 is the request body for creating a message without SMTP
+type JSONInjectV1 struct {
+	From        string                    `json:"from"`
+	To          []string                  `json:"to"`
+	Subject     string                    `json:"subject"`
+	Body        JSONMessageBodyV1         `json:"body"`
+	Attachments []*JSONInjectAttachmentV1 `json:"attachments"`
+}
+
+// JSONInjectAttachmentV1 is an attachment of a JSONInjectV1, Content is base64 encoded in JSON
+type JSONInjectAttachmentV1 struct {
+	FileName    string `json:"filename"`
+	ContentType string `json:"content-type"`
+	Content     []byte `json:"content"`
+}
+
+// JSONMessageEventV1 is sent by the stream WebSockets, Type is "message" for a newly received
+// message, or "delete" for a deleted message, of which only the mailbox and ID are set
+type JSONMessageEventV1 struct {
+	Type    string               `json:"type"`
+	Message *JSONMessageHeaderV1 `json:"message"`
+}
+
+// JSONMessageRefV1 identifies a message, it is sent by the event streams when a message is
+// deleted
+type JSONMessageRefV1 struct {
+	Mailbox string `json:"mailbox"`
+	ID      string `json:"id"`
+}
+
+// JSONWebhookV1 describes a webhook, which is sent a JSONWebhookEventV1 for each event in
+// Events, or every event if it is empty, affecting Mailbox, or any mailbox if it is empty
+type JSONWebhookV1 struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Mailbox string   `json:"mailbox"`
+	Events  []string `json:"events"`
+}
+
+// JSONWebhookEventV1 is posted to a webhook, Event is delivery or delete.  Message holds the
+// header of delivered messages.
+type JSONWebhookEventV1 struct {
+	Event   string               `json:"event"`
+	Webhook string               `json:"webhook"`
+	Mailbox string               `json:"mailbox"`
+	ID      string               `json:"id"`
+	Message *JSONMessageHeaderV1 `json:"message,omitempty"`
+}
+
+// JSONMailboxV1 summarizes the content of a mailbox
+type JSONMailboxV1 struct {
+	Name   string     `json:"name"`
+	Count  int        `json:"count"`
+	Size   int64      `json:"size"`
+	Newest *time.Time `json:"newest,omitempty"`
+}
+
+// JSONStatsV1 reports the messages stored in every mailbox and in total, how many arrived
+// recently, and how many the retention scanner has deleted
+type JSONStatsV1 struct {
+	Count     int                   `json:"count"`
+	Size      int64                 `json:"size"`
+	Received  JSONRatesV1           `json:"received"`
+	Retention JSONRetentionStatsV1  `json:"retention"`
+	Mailboxes []*JSONMailboxStatsV1 `json:"mailboxes"`
+}
+
+// JSONMailboxStatsV1 reports the messages stored in a single mailbox
+type JSONMailboxStatsV1 struct {
+	Name     string      `json:"name"`
+	Count    int         `json:"count"`
+	Size     int64       `json:"size"`
+	Received JSONRatesV1 `json:"received"`
+}
+
+// JSONRatesV1 counts the stored messages received within recent windows of time
+type JSONRatesV1 struct {
+	FiveMinutes int `json:"5m"`
+	Hour        int `json:"1h"`
+	Day         int `json:"24h"`
+}
+
+// JSONRetentionStatsV1 reports the retention period in minutes, zero if messages are kept
+// forever, and the number of messages deleted by the retention scanner
+type JSONRetentionStatsV1 struct {
+	Period        int   `json:"period"`
+	Deletes       int64 `json:"deletes"`
+	DeletesInHour int64 `json:"deletes-1h"`
+}
+
+// JSONDeleteResultV1 reports the number of messages removed by a filtered delete
+type JSONDeleteResultV1 struct {
+	Deleted int `json:"deleted"`
+}
+
+// JSONShareV1 is the request body for signing a URL of a message.  Resource is source, text,
+// html or attach/ followed by the attachment index, TTL is a duration such as 1h.
+type JSONShareV1 struct {
+	Resource string `json:"resource"`
+	TTL      string `json:"ttl"`
+}
+
+// JSONSharedURLV1 is a signed URL that can be fetched without an API token until it expires
+type JSONSharedURLV1 struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
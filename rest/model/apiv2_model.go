@@ -0,0 +1,10 @@
+package model
+
+// JSONMessagePageV2 contains one page of the message headers in a mailbox, along with the
+// total number of messages available
+type JSONMessagePageV2 struct {
+	Total    int                    `json:"total"`
+	Offset   int                    `json:"offset"`
+	Limit    int                    `json:"limit"`
+	Messages []*JSONMessageHeaderV1 `json:"messages"`
+}
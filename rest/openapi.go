@@ -0,0 +1,166 @@
+package rest
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+)
+
+// pathParams matches the variables in a route path
+var pathParams = regexp.MustCompile(`{([^}]+)}`)
+
+// OpenAPIV1 renders the OpenAPI 3 specification of the REST API, generated from the routes it
+// describes
+func OpenAPIV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	return httpd.RenderJSON(w, openAPISpec(apiRoutes))
+}
+
+// object is a JSON object in the OpenAPI specification
+type object map[string]interface{}
+
+// openAPISpec returns the OpenAPI 3 specification of routes
+func openAPISpec(routes []apiRoute) object {
+	schemas := object{}
+	paths := object{}
+	for _, route := range routes {
+		item, ok := paths[route.Path].(object)
+		if !ok {
+			item = object{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = openAPIOperation(route, schemas)
+	}
+	return object{
+		"openapi": "3.0.0",
+		"info": object{
+			"title":   "Inbucket REST API",
+			"version": config.Version,
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"bearer": object{"type": "http", "scheme": "bearer"},
+			},
+		},
+		// API tokens are only required when some are configured
+		"security": []object{{}, {"bearer": []string{}}},
+	}
+}
+
+// openAPIOperation describes a single route, adding the schemas of its bodies to schemas
+func openAPIOperation(route apiRoute, schemas object) object {
+	params := []object{}
+	for _, m := range pathParams.FindAllStringSubmatch(route.Path, -1) {
+		typ := "string"
+		if m[1] == "index" {
+			typ = "integer"
+		}
+		params = append(params, object{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   object{"type": typ},
+		})
+	}
+	for _, p := range route.Query {
+		schema := object{"type": p.Type}
+		if p.Repeated {
+			schema = object{"type": "array", "items": schema}
+		}
+		params = append(params, object{
+			"name":        p.Name,
+			"in":          "query",
+			"description": p.Description,
+			"required":    p.Required,
+			"schema":      schema,
+		})
+	}
+
+	op := object{
+		"operationId": route.Name,
+		"summary":     route.Summary,
+		"parameters":  params,
+		"responses": object{
+			"200": object{
+				"description": "Success",
+				"content":     openAPIContent(route.ResponseType, route.Response, schemas),
+			},
+		},
+	}
+	if route.WebSocket {
+		op["responses"] = object{
+			"101": object{"description": "Switching to the WebSocket protocol"},
+		}
+	}
+	if route.Request != nil || route.RequestType != "" {
+		op["requestBody"] = object{
+			"required": true,
+			"content":  openAPIContent(route.RequestType, route.Request, schemas),
+		}
+	}
+	return op
+}
+
+// openAPIContent describes a body of contentType, or JSON encoding the type of example
+func openAPIContent(contentType string, example interface{}, schemas object) object {
+	if contentType != "" {
+		return object{contentType: object{"schema": object{"type": "string", "format": "binary"}}}
+	}
+	schema := object{}
+	if example != nil {
+		schema = openAPISchema(reflect.TypeOf(example), schemas)
+	}
+	return object{"application/json": object{"schema": schema}}
+}
+
+// openAPISchema describes the JSON encoding of t.  Structs are added to schemas, named after
+// their type without the JSON prefix, and referenced.
+func openAPISchema(t reflect.Type, schemas object) object {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return object{"type": "string", "format": "date-time"}
+	case reflect.TypeOf([]byte{}):
+		return object{"type": "string", "format": "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return openAPISchema(t.Elem(), schemas)
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice:
+		return object{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return object{"type": "object",
+			"additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := strings.TrimPrefix(t.Name(), "JSON")
+		if _, ok := schemas[name]; !ok {
+			props := object{}
+			// Registered before the fields, so that recursive types refer to themselves
+			schemas[name] = object{"type": "object", "properties": props}
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				tag := strings.Split(f.Tag.Get("json"), ",")[0]
+				if tag == "-" || f.PkgPath != "" {
+					continue
+				}
+				if tag == "" {
+					tag = f.Name
+				}
+				props[tag] = openAPISchema(f.Type, schemas)
+			}
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	}
+	return object{}
+}
@@ -0,0 +1,114 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRestOpenAPI(t *testing.T) {
+	// Setup
+	logbuf := setupWebServer(&MockDataStore{})
+
+	w, err := testRestGet("http://localhost/api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			Parameters  []struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+			} `json:"parameters"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	body := w.Body.String()
+	if err := json.Unmarshal([]byte(body), &spec); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if spec.OpenAPI != "3.0.0" {
+		t.Errorf("Expected openapi 3.0.0, got %q", spec.OpenAPI)
+	}
+
+	// Every route of the router is described, and every path variable is a parameter
+	operations := map[string]bool{}
+	r := mux.NewRouter()
+	SetupRoutes(r)
+	err = r.Walk(func(route *mux.Route, router *mux.Router, _ []*mux.Route) error {
+		name := route.GetName()
+		if name == "OpenAPIV1" || name == "CORSPreflightV1" {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		methods, ok := spec.Paths[path]
+		if !ok {
+			t.Errorf("Route %v path %q is not in the specification", name, path)
+			return nil
+		}
+		found := false
+		for _, op := range methods {
+			if op.OperationID != name {
+				continue
+			}
+			found = true
+			for _, v := range regexp.MustCompile(`{([^}]+)}`).FindAllStringSubmatch(path, -1) {
+				param := false
+				for _, p := range op.Parameters {
+					param = param || (p.In == "path" && p.Name == v[1])
+				}
+				if !param {
+					t.Errorf("Operation %v does not describe path parameter %v", name, v[1])
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Route %v has no operation in the specification", name)
+		}
+		if operations[name] {
+			t.Errorf("Route name %v is not unique", name)
+		}
+		operations[name] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(operations) != len(apiRoutes) {
+		t.Errorf("Found %v routes, want %v", len(operations), len(apiRoutes))
+	}
+
+	// Every schema reference resolves
+	for _, m := range regexp.MustCompile(`"#/components/schemas/([^"]+)"`).FindAllStringSubmatch(
+		body, -1) {
+		if _, ok := spec.Components.Schemas[m[1]]; !ok {
+			t.Errorf("Schema %v is referenced but not defined", m[1])
+		}
+	}
+	if _, ok := spec.Components.Schemas["MessageHeaderV1"]; !ok {
+		t.Errorf("Expected MessageHeaderV1 schema, got %v", spec.Components.Schemas)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,139 @@
+package rest
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/httpd"
+)
+
+// rateLimiter implements a token bucket for each API token or client IP address.  A nil
+// rateLimiter allows everything.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	rate      float64 // Tokens added per second
+	burst     float64 // Maximum tokens held by a bucket
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time // Replaceable for tests
+}
+
+// tokenBucket tracks the available tokens for a single key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// apiLimiters hold the rate limiters for requests with and without an API token, they are
+// replaced when the configured rates change
+var apiLimiters = struct {
+	sync.Mutex
+	ip, token *rateLimiter
+}{}
+
+// newRateLimiter creates a rateLimiter permitting perMinute requests per key, with bursts of up
+// to perMinute requests.  Returns nil if perMinute is not positive.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		perMinute: perMinute,
+		rate:      float64(perMinute) / 60,
+		burst:     float64(perMinute),
+		buckets:   make(map[string]*tokenBucket),
+		now:       time.Now,
+	}
+}
+
+// take takes a token from the bucket for key, returning false if none were available.  It also
+// returns the tokens remaining, and how long until the next token is available.
+func (r *rateLimiter) take(key string) (ok bool, remaining int, wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+	b, found := r.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	}
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / r.rate * float64(time.Second))
+	}
+	return ok, int(b.tokens), wait
+}
+
+// sweep discards buckets that have refilled completely, they are indistinguishable from new
+// buckets.  Must be called with the lock held.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// currentLimiter returns *l, replacing it if it does not permit perMinute requests
+func currentLimiter(l **rateLimiter, perMinute int) *rateLimiter {
+	if *l == nil || (*l).perMinute != perMinute {
+		*l = newRateLimiter(perMinute)
+	}
+	return *l
+}
+
+// rateLimited wraps a REST handler to limit the requests per minute of each API token, or of
+// each client IP address for requests without a valid token.  Responses carry the
+// X-RateLimit-Limit and X-RateLimit-Remaining headers, refused requests get 429 and a
+// Retry-After header.
+func rateLimited(h httpd.Handler) httpd.Handler {
+	return func(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) error {
+		var limiter *rateLimiter
+		var key string
+		token := requestToken(req)
+		apiLimiters.Lock()
+		if token != "" && tokenScope(ctx.WebConfig, token) != "" {
+			limiter = currentLimiter(&apiLimiters.token, ctx.WebConfig.RateTokenReqs)
+			key = "token " + token
+		} else {
+			limiter = currentLimiter(&apiLimiters.ip, ctx.WebConfig.RateRequests)
+			key, _, _ = net.SplitHostPort(req.RemoteAddr)
+			if key == "" {
+				key = req.RemoteAddr
+			}
+		}
+		apiLimiters.Unlock()
+		if limiter == nil {
+			return h(w, req, ctx)
+		}
+
+		ok, remaining, wait := limiter.take(key)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.perMinute))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+			return nil
+		}
+		return h(w, req, ctx)
+	}
+}
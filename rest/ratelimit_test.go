@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0), "Zero rate should be unlimited")
+
+	clock := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(3)
+	rl.now = func() time.Time { return clock }
+
+	// Burst up to the limit
+	for i := 2; i >= 0; i-- {
+		ok, remaining, _ := rl.take("1.2.3.4")
+		assert.True(t, ok, "Request should be allowed")
+		assert.Equal(t, i, remaining)
+	}
+	ok, _, wait := rl.take("1.2.3.4")
+	assert.False(t, ok, "Burst exceeded")
+	assert.Equal(t, 20*time.Second, wait, "3 per minute refills a token every 20 seconds")
+	ok, _, _ = rl.take("5.6.7.8")
+	assert.True(t, ok, "Other clients are unaffected")
+
+	clock = clock.Add(10 * time.Second)
+	ok, _, wait = rl.take("1.2.3.4")
+	assert.False(t, ok, "Not yet refilled")
+	assert.Equal(t, 10*time.Second, wait)
+	clock = clock.Add(10 * time.Second)
+	ok, _, _ = rl.take("1.2.3.4")
+	assert.True(t, ok, "Refilled one token")
+
+	// Idle buckets are discarded once full
+	clock = clock.Add(time.Hour)
+	ok, _, _ = rl.take("1.2.3.4")
+	assert.True(t, ok)
+	assert.Len(t, rl.buckets, 1, "Full bucket for 5.6.7.8 should have been swept")
+}
+
+func TestRestRateLimit(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{
+		APITokens:     []config.APIToken{{Name: "ci", Scope: "read", Token: "r3ad"}},
+		RateRequests:  2,
+		RateTokenReqs: 3,
+	})
+	defer func() {
+		apiLimiters.Lock()
+		apiLimiters.ip, apiLimiters.token = nil, nil
+		apiLimiters.Unlock()
+	}()
+
+	goodbox := &MockMailbox{}
+	goodbox.On("GetMessages").Return([]smtpd.Message{}, nil)
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+
+	var testTable = []struct {
+		token     string
+		code      int
+		remaining string
+	}{
+		// Requests without a valid token are limited by IP address
+		{"", 401, "1"},
+		{"wrong", 401, "0"},
+		{"", 429, "0"},
+		// Tokens have their own, separate limit
+		{"r3ad", 200, "2"},
+		{"r3ad", 200, "1"},
+		{"r3ad", 200, "0"},
+		{"r3ad", 429, "0"},
+	}
+	for i, tt := range testTable {
+		w, err := testRestAuth("GET", baseURL+"/mailbox/good", tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("Request %v with token %q: expected code %v, got %v", i, tt.token, tt.code,
+				w.Code)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("Request %v: expected %v remaining, got %q", i, tt.remaining, got)
+		}
+		if tt.code == 429 {
+			if got := w.Header().Get("Retry-After"); got != "20" && got != "30" {
+				t.Errorf("Request %v: expected Retry-After, got %q", i, got)
+			}
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -1,23 +1,209 @@
 package rest
 
-import "github.com/gorilla/mux"
-import "github.com/jhillyerd/inbucket/httpd"
+import (
+	"github.com/gorilla/mux"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/rest/model"
+)
+
+// apiRoute describes a REST endpoint, both for the router and for the OpenAPI specification
+type apiRoute struct {
+	Path    string
+	Method  string
+	Name    string // Route name and OpenAPI operationId
+	Handler httpd.Handler
+	Summary string
+	Query   []apiParam
+	// Request and Response are example values of the JSON bodies, their types are described in
+	// the specification.  RequestType and ResponseType override the application/json content
+	// type for other bodies.
+	Request      interface{}
+	RequestType  string
+	Response     interface{}
+	ResponseType string
+	WebSocket    bool // Upgrades the connection rather than responding
+}
+
+// apiParam describes a query parameter of an apiRoute
+type apiParam struct {
+	Name        string
+	Type        string // string, integer or boolean
+	Description string
+	Required    bool
+	Repeated    bool
+}
+
+// filterParams are the message filters accepted by the purge and wait endpoints
+var filterParams = []apiParam{
+	{Name: "older-than", Type: "string", Description: "Duration, such as 90m"},
+	{Name: "from", Type: "string", Description: "Part of the sender, ignoring case"},
+	{Name: "subject", Type: "string", Description: "Regular expression matching the subject"},
+	{Name: "domain", Type: "string", Description: "Domain of a recipient"},
+}
+
+// monitorParams are the message filters accepted by the monitor WebSockets
+var monitorParams = []apiParam{
+	{Name: "domain", Type: "string", Description: "Domain of a recipient"},
+	{Name: "mailbox", Type: "string", Description: "Mailbox name pattern, such as team-*"},
+	{Name: "from", Type: "string", Description: "Part of the sender, ignoring case"},
+}
+
+// formatParam selects the file format of the export and import endpoints
+var formatParam = apiParam{Name: "format", Type: "string", Description: "mbox (default) or zip"}
+
+// apiRoutes lists the REST endpoints in the order they are matched, so fixed paths must precede
+// paths with variables that would match them
+var apiRoutes = []apiRoute{
+	// API v1
+	{Path: "/api/v1/mailbox/{name}", Method: "GET", Name: "MailboxListV1",
+		Handler: MailboxListV1, Summary: "List the messages in a mailbox",
+		Query: []apiParam{{Name: "auth-user", Type: "string",
+			Description: "Only messages sent by this SMTP AUTH identity, empty for none"}},
+		Response: []*model.JSONMessageHeaderV1{}},
+	{Path: "/api/v1/mailbox/{name}", Method: "POST", Name: "MailboxInjectV1",
+		Handler: MailboxInjectV1, Summary: "Store a message without SMTP",
+		Request: &model.JSONInjectV1{}, Response: &model.JSONMessageHeaderV1{}},
+	{Path: "/api/v1/mailbox/{name}", Method: "DELETE", Name: "MailboxPurgeV1",
+		Handler: MailboxPurgeV1, Summary: "Delete the messages in a mailbox matching the filters",
+		Query: filterParams},
+	{Path: "/api/v1/mailbox/{name}/wait", Method: "GET", Name: "MailboxWaitV1",
+		Handler: MailboxWaitV1, Summary: "Wait for a message matching the filters",
+		Query: append([]apiParam{{Name: "timeout", Type: "string",
+			Description: "How long to wait, such as 30s"}}, filterParams...),
+		Response: &model.JSONMessageV1{}},
+	{Path: "/api/v1/mailbox/{name}/export", Method: "GET", Name: "MailboxExportV1",
+		Handler: MailboxExportV1, Summary: "Download every message in a mailbox",
+		Query: []apiParam{formatParam}, ResponseType: "application/octet-stream"},
+	{Path: "/api/v1/mailbox/{name}/import", Method: "POST", Name: "MailboxImportV1",
+		Handler: MailboxImportV1, Summary: "Load the messages of an mbox file or ZIP archive",
+		Query: []apiParam{formatParam}, RequestType: "application/octet-stream",
+		Response: []*model.JSONMessageHeaderV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}", Method: "GET", Name: "MailboxShowV1",
+		Handler: MailboxShowV1, Summary: "Get a message",
+		Response: &model.JSONMessageV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}", Method: "DELETE", Name: "MailboxDeleteV1",
+		Handler: MailboxDeleteV1, Summary: "Delete a message", Response: "OK"},
+	{Path: "/api/v1/mailbox/{name}/{id}", Method: "PATCH", Name: "MailboxFlagsV1",
+		Handler: MailboxFlagsV1, Summary: "Set or clear the flags of a message",
+		Request: &model.JSONMessageFlagsV1{}, Response: &model.JSONMessageFlagsV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/headers", Method: "GET", Name: "MailboxHeadersV1",
+		Handler: MailboxHeadersV1, Summary: "Get the decoded header fields of a message",
+		Response: map[string][]string{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/source", Method: "GET", Name: "MailboxSourceV1",
+		Handler: MailboxSourceV1, Summary: "Download the raw source of a message",
+		ResponseType: "message/rfc822"},
+	{Path: "/api/v1/mailbox/{name}/{id}/transcript", Method: "GET", Name: "MailboxTranscriptV1",
+		Handler: MailboxTranscriptV1, Summary: "Get the SMTP transcript of a message",
+		ResponseType: "text/plain"},
+	{Path: "/api/v1/mailbox/{name}/{id}/delivery", Method: "GET", Name: "MailboxDeliveryV1",
+		Handler: MailboxDeliveryV1, Summary: "Get the SMTP session details of a message",
+		Response: &model.JSONDeliveryV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/html", Method: "GET", Name: "MailboxHTMLV1",
+		Handler: MailboxHTMLV1, Summary: "Get the sanitized HTML body of a message",
+		Response: &model.JSONSanitizedHTMLV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/text", Method: "GET", Name: "MailboxTextV1",
+		Handler: MailboxTextV1, Summary: "Get the plain text body of a message",
+		ResponseType: "text/plain"},
+	{Path: "/api/v1/mailbox/{name}/{id}/diff", Method: "GET", Name: "MailboxDiffV1",
+		Handler: MailboxDiffV1, Summary: "Compare a message with another message",
+		Query: []apiParam{
+			{Name: "with", Type: "string", Description: "ID of the other message",
+				Required: true},
+			{Name: "mailbox", Type: "string", Description: "Mailbox of the other message"},
+			{Name: "ignore", Type: "string", Description: "Header fields not to compare",
+				Repeated: true},
+		},
+		Response: &model.JSONMessageDiffV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/parts", Method: "GET", Name: "MailboxPartsV1",
+		Handler: MailboxPartsV1, Summary: "Get the MIME structure of a message",
+		Response: &model.JSONMIMEPartV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/attach/{index}", Method: "GET",
+		Name: "MailboxAttachmentV1", Handler: MailboxAttachmentV1,
+		Summary: "Download an attachment of a message", ResponseType: "application/octet-stream"},
+	{Path: "/api/v1/mailbox/{name}/{id}/release", Method: "POST", Name: "MailboxReleaseV1",
+		Handler: MailboxReleaseV1, Summary: "Send a message on through the relay host",
+		Request: &model.JSONReleaseV1{}, Response: "OK"},
+	{Path: "/api/v1/mailbox/{name}/{id}/copy", Method: "POST", Name: "MailboxCopyV1",
+		Handler: MailboxCopyV1, Summary: "Copy a message to another mailbox",
+		Request: &model.JSONTransferV1{}, Response: &model.JSONMessageHeaderV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/move", Method: "POST", Name: "MailboxMoveV1",
+		Handler: MailboxMoveV1, Summary: "Move a message to another mailbox",
+		Request: &model.JSONTransferV1{}, Response: &model.JSONMessageHeaderV1{}},
+	{Path: "/api/v1/mailbox/{name}/{id}/share", Method: "POST", Name: "MailboxShareV1",
+		Handler: MailboxShareV1, Summary: "Sign an expiring URL for the source, body or an " +
+			"attachment of a message", Request: &model.JSONShareV1{},
+		Response: &model.JSONSharedURLV1{}},
+	{Path: "/api/v1/mailboxes", Method: "GET", Name: "MailboxIndexV1",
+		Handler: MailboxIndexV1, Summary: "List every mailbox",
+		Response: []*model.JSONMailboxV1{}},
+	{Path: "/api/v1/mailboxes", Method: "DELETE", Name: "MailboxesPurgeV1",
+		Handler: MailboxesPurgeV1, Summary: "Delete the messages in every mailbox, admin only",
+		Query: filterParams, Response: &model.JSONDeleteResultV1{}},
+	{Path: "/api/v1/stats", Method: "GET", Name: "StatsV1",
+		Handler: StatsV1, Summary: "Get message counts, delivery rates and retention deletes",
+		Response: &model.JSONStatsV1{}},
+	{Path: "/api/v1/webhooks", Method: "GET", Name: "WebhookListV1",
+		Handler: WebhookListV1, Summary: "List the registered webhooks",
+		Response: []*model.JSONWebhookV1{}},
+	{Path: "/api/v1/webhooks", Method: "POST", Name: "WebhookCreateV1",
+		Handler: WebhookCreateV1, Summary: "Register a webhook",
+		Request: &model.JSONWebhookV1{}, Response: &model.JSONWebhookV1{}},
+	{Path: "/api/v1/webhooks/{id}", Method: "GET", Name: "WebhookShowV1",
+		Handler: WebhookShowV1, Summary: "Get a registered webhook",
+		Response: &model.JSONWebhookV1{}},
+	{Path: "/api/v1/webhooks/{id}", Method: "DELETE", Name: "WebhookDeleteV1",
+		Handler: WebhookDeleteV1, Summary: "Remove a registered webhook", Response: "OK"},
+	{Path: "/api/v1/search", Method: "GET", Name: "MessageSearchV1",
+		Handler: MessageSearchV1, Summary: "Search the messages in one or every mailbox",
+		Query: []apiParam{
+			{Name: "q", Type: "string", Description: "Text to search for", Required: true},
+			{Name: "mailbox", Type: "string", Description: "Only search this mailbox"},
+		},
+		Response: []*model.JSONMessageHeaderV1{}},
+	{Path: "/api/v1/monitor/messages", Method: "GET", Name: "MonitorAllMessagesV1",
+		Handler: MonitorAllMessagesV1, WebSocket: true, Query: monitorParams,
+		Summary: "WebSocket sending the headers of recent and new messages"},
+	{Path: "/api/v1/monitor/messages/{name}", Method: "GET", Name: "MonitorMailboxMessagesV1",
+		Handler: MonitorMailboxMessagesV1, WebSocket: true, Query: monitorParams,
+		Summary: "WebSocket sending the headers of recent and new messages in a mailbox"},
+	{Path: "/api/v1/stream/messages", Method: "GET", Name: "StreamAllMessagesV1",
+		Handler: StreamAllMessagesV1, WebSocket: true,
+		Summary: "WebSocket sending an event for each new or deleted message"},
+	{Path: "/api/v1/stream/messages/{name}", Method: "GET", Name: "StreamMailboxMessagesV1",
+		Handler: StreamMailboxMessagesV1, WebSocket: true,
+		Summary: "WebSocket sending an event for each new or deleted message in a mailbox"},
+	{Path: "/api/v1/events/messages", Method: "GET", Name: "EventsAllMessagesV1",
+		Handler: EventsAllMessagesV1, Summary: "Server-sent delivery and delete events",
+		ResponseType: "text/event-stream"},
+	{Path: "/api/v1/events/messages/{name}", Method: "GET", Name: "EventsMailboxMessagesV1",
+		Handler:      EventsMailboxMessagesV1,
+		Summary:      "Server-sent delivery and delete events for a mailbox",
+		ResponseType: "text/event-stream"},
+
+	// API v2
+	{Path: "/api/v2/mailbox/{name}", Method: "GET", Name: "MailboxListV2",
+		Handler: MailboxListV2, Summary: "List a page of the messages in a mailbox",
+		Query: []apiParam{
+			{Name: "limit", Type: "integer", Description: "Number of messages in the page"},
+			{Name: "offset", Type: "integer", Description: "Number of messages to skip"},
+			{Name: "sort", Type: "string",
+				Description: "date, size or from, prefixed with - for descending order"},
+			{Name: "auth-user", Type: "string",
+				Description: "Only messages sent by this SMTP AUTH identity, empty for none"},
+		},
+		Response: &model.JSONMessagePageV2{}},
+}
 
 // SetupRoutes populates the routes for the REST interface
 func SetupRoutes(r *mux.Router) {
-	// API v1
-	r.Path("/api/v1/mailbox/{name}").Handler(
-		httpd.Handler(MailboxListV1)).Name("MailboxListV1").Methods("GET")
-	r.Path("/api/v1/mailbox/{name}").Handler(
-		httpd.Handler(MailboxPurgeV1)).Name("MailboxPurgeV1").Methods("DELETE")
-	r.Path("/api/v1/mailbox/{name}/{id}").Handler(
-		httpd.Handler(MailboxShowV1)).Name("MailboxShowV1").Methods("GET")
-	r.Path("/api/v1/mailbox/{name}/{id}").Handler(
-		httpd.Handler(MailboxDeleteV1)).Name("MailboxDeleteV1").Methods("DELETE")
-	r.Path("/api/v1/mailbox/{name}/{id}/source").Handler(
-		httpd.Handler(MailboxSourceV1)).Name("MailboxSourceV1").Methods("GET")
-	r.Path("/api/v1/monitor/messages").Handler(
-		httpd.Handler(MonitorAllMessagesV1)).Name("MonitorAllMessagesV1").Methods("GET")
-	r.Path("/api/v1/monitor/messages/{name}").Handler(
-		httpd.Handler(MonitorMailboxMessagesV1)).Name("MonitorMailboxMessagesV1").Methods("GET")
+	for _, route := range apiRoutes {
+		r.Path(route.Path).Handler(
+			apiHandler(route.Handler)).Name(route.Name).Methods(route.Method)
+	}
+	r.Path("/api/openapi.json").Handler(
+		withCORS(OpenAPIV1)).Name("OpenAPIV1").Methods("GET")
+
+	// CORS preflight for both API versions
+	r.PathPrefix("/api/").Handler(
+		httpd.Handler(CORSPreflightV1)).Name("CORSPreflightV1").Methods("OPTIONS")
 }
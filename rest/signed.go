@@ -0,0 +1,121 @@
+package rest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// defaultShareTTL is how long a signed URL is valid when the request does not say
+const defaultShareTTL = time.Hour
+
+// shareResource matches the message resources a signed URL may point at
+var shareResource = regexp.MustCompile(`^(source|text|html|attach/[0-9]+)$`)
+
+// signedPath matches the request paths a signature may grant access to, nothing else can be
+// fetched with a signed URL
+var signedPath = regexp.MustCompile(`^/api/v1/mailbox/[^/]+/[^/]+/(source|text|html|attach/[0-9]+)$`)
+
+// urlSignature returns the hex encoded HMAC-SHA256 of path and its expiry time in Unix seconds
+func urlSignature(key, path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature returns true if req is a GET of a signable path carrying an unexpired
+// signature made with the configured key
+func validSignature(req *http.Request, cfg config.WebConfig) bool {
+	if cfg.SignedURLKey == "" || (req.Method != "GET" && req.Method != "HEAD") ||
+		!signedPath.MatchString(req.URL.Path) {
+		return false
+	}
+	query := req.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	want := urlSignature(cfg.SignedURLKey, req.URL.Path, expires)
+	return hmac.Equal([]byte(query.Get("signature")), []byte(want))
+}
+
+// MailboxShareV1 renders a signed URL for the body, source or an attachment of a message, which
+// can be fetched without an API token until it expires
+func MailboxShareV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	if ctx.WebConfig.SignedURLKey == "" {
+		http.Error(w, "Signed URLs are disabled, configure signed.url.key to enable them",
+			http.StatusForbidden)
+		return nil
+	}
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	share := model.JSONShareV1{Resource: "source"}
+	if err := json.NewDecoder(req.Body).Decode(&share); err != nil {
+		http.Error(w, "Unable to parse share request: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if share.Resource == "" {
+		share.Resource = "source"
+	}
+	if !shareResource.MatchString(share.Resource) {
+		http.Error(w, fmt.Sprintf(
+			"Unknown resource %q, must be source, text, html or attach/<index>", share.Resource),
+			http.StatusBadRequest)
+		return nil
+	}
+	maxTTL := time.Duration(ctx.WebConfig.SignedURLMax) * time.Minute
+	ttl := defaultShareTTL
+	if share.TTL != "" {
+		ttl, err = time.ParseDuration(share.TTL)
+		if err != nil || ttl <= 0 || ttl > maxTTL {
+			http.Error(w, fmt.Sprintf("Invalid ttl %q, must be a duration up to %v", share.TTL,
+				maxTTL), http.StatusBadRequest)
+			return nil
+		}
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	if _, err = mb.GetMessage(id); err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	// The signature covers the decoded path, as validSignature sees it in req.URL.Path
+	path := "/api/v1/mailbox/" + name + "/" + id + "/" + share.Resource
+	escaped := "/api/v1/mailbox/" + url.PathEscape(name) + "/" + url.PathEscape(id) + "/" +
+		share.Resource
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", urlSignature(ctx.WebConfig.SignedURLKey, path, expires.Unix()))
+	return httpd.RenderJSON(w, &model.JSONSharedURLV1{
+		URL:     httpd.BaseURL(req, ctx.WebConfig) + escaped + "?" + query.Encode(),
+		Expires: expires,
+	})
+}
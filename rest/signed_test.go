@@ -0,0 +1,210 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+func TestRestSignedURLs(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{
+		APITokens:    []config.APIToken{{Name: "ci", Scope: "write", Token: "wr1te"}},
+		SignedURLKey: "k3y",
+		SignedURLMax: 120,
+	})
+
+	source := "From: a@example.com\r\nSubject: Shared\r\n\r\nBody\r\n"
+	msg := &MockMessage{}
+	msg.On("RawReader").Return(ioutil.NopCloser(strings.NewReader(source)), nil)
+	goodbox := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(goodbox, nil)
+	goodbox.On("GetMessage", "0001").Return(msg, nil)
+	goodbox.On("GetMessage", "0002").Return(&MockMessage{}, smtpd.ErrNotExist)
+
+	share := func(id, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", baseURL+"/mailbox/good/"+id+"/share",
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Authorization", "Bearer wr1te")
+		w := httptest.NewRecorder()
+		httpd.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test minting
+	w := share("0001", `{"ttl":"30m"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v: %v", w.Code, w.Body.String())
+	}
+	shared := new(model.JSONSharedURLV1)
+	if err := json.NewDecoder(w.Body).Decode(shared); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	u, err := url.Parse(shared.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/api/v1/mailbox/good/0001/source" {
+		t.Errorf("Expected source path, got %v", u.Path)
+	}
+	if d := shared.Expires.Sub(time.Now()); d < 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("Expected expiry in 30m, got %v", shared.Expires)
+	}
+
+	// Test fetching without a token
+	w, err = testRestGet(shared.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected code 200, got %v", w.Code)
+	}
+	if got := w.Body.String(); got != source {
+		t.Errorf("Expected source %q, got %q", source, got)
+	}
+
+	// Test signatures that must be refused
+	query := u.Query()
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	var testTable = []struct {
+		name, url string
+	}{
+		{"expired", u.Path + "?expires=" + past + "&signature=" +
+			urlSignature("k3y", u.Path, time.Now().Add(-time.Minute).Unix())},
+		{"tampered", u.Path + "?expires=" + query.Get("expires") + "0&signature=" +
+			query.Get("signature")},
+		{"other path", "/api/v1/mailbox/good/0002/source?" + u.RawQuery},
+		{"not signable", "/api/v1/mailbox/good/0001?expires=" + query.Get("expires") +
+			"&signature=" + urlSignature("k3y", "/api/v1/mailbox/good/0001",
+			shared.Expires.Unix())},
+	}
+	for _, tt := range testTable {
+		w, err = testRestGet("http://localhost" + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 403 {
+			t.Errorf("%v: expected code 403, got %v", tt.name, w.Code)
+		}
+	}
+
+	// Test invalid share requests
+	for _, tt := range []struct {
+		id, body string
+		code     int
+	}{
+		{"0002", `{}`, 404},
+		{"0001", `{"resource":"headers"}`, 400},
+		{"0001", `{"ttl":"3h"}`, 400},
+	} {
+		if w = share(tt.id, tt.body); w.Code != tt.code {
+			t.Errorf("Share %v %v: expected code %v, got %v", tt.id, tt.body, tt.code, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestSignedURLsBaseURL(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServerConfig(ds, config.WebConfig{
+		APITokens:    []config.APIToken{{Name: "ci", Scope: "write", Token: "wr1te"}},
+		SignedURLKey: "k3y",
+		SignedURLMax: 120,
+		BaseURL:      "https://inbucket.example.com",
+	})
+
+	source := "From: a@example.com\r\nSubject: Shared\r\n\r\nBody\r\n"
+	msg := &MockMessage{}
+	msg.On("RawReader").Return(ioutil.NopCloser(strings.NewReader(source)), nil)
+	box := &MockMailbox{}
+	ds.On("MailboxFor", "qa#1").Return(box, nil)
+	box.On("GetMessage", "0001").Return(msg, nil)
+
+	// The link comes from base.url rather than the request, with the mailbox name escaped
+	req, err := http.NewRequest("POST", baseURL+"/mailbox/qa%231/0001/share",
+		strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer wr1te")
+	w := httptest.NewRecorder()
+	httpd.Router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v: %v", w.Code, w.Body.String())
+	}
+	shared := new(model.JSONSharedURLV1)
+	if err := json.NewDecoder(w.Body).Decode(shared); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	want := "https://inbucket.example.com/api/v1/mailbox/qa%231/0001/source?"
+	if !strings.HasPrefix(shared.URL, want) {
+		t.Errorf("Expected URL starting with %v, got %v", want, shared.URL)
+	}
+
+	// Test fetching without a token
+	w, err = testRestGet(shared.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected code 200, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestSignedURLsDisabled(t *testing.T) {
+	// Setup
+	logbuf := setupWebServer(&MockDataStore{})
+
+	w, err := testRestPost(baseURL+"/mailbox/good/0001/share", `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 403 {
+		t.Errorf("Expected code 403, got %v", w.Code)
+	}
+	w, err = testRestGet(baseURL + "/mailbox/good/0001/source?expires=1&signature=00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 403 {
+		t.Errorf("Expected code 403, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -1,7 +1,11 @@
 package rest
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -37,15 +41,21 @@ type msgListener struct {
 	hub     *msghub.Hub         // Global message hub
 	c       chan msghub.Message // Queue of messages from Receive()
 	mailbox string              // Name of mailbox to monitor, "" == all mailboxes
+	filter  hubFilter           // Messages to monitor, nil == all messages
 }
 
+// hubFilter returns true for hub messages that should be monitored
+type hubFilter func(msg msghub.Message) bool
+
 // newMsgListener creates a listener and registers it.  Optional mailbox parameter will restrict
-// messages sent to WebSocket to that mailbox only.
-func newMsgListener(hub *msghub.Hub, mailbox string) *msgListener {
+// messages sent to WebSocket to that mailbox only, and optional filter to the messages it
+// matches.
+func newMsgListener(hub *msghub.Hub, mailbox string, filter hubFilter) *msgListener {
 	ml := &msgListener{
 		hub:     hub,
 		c:       make(chan msghub.Message, 100),
 		mailbox: mailbox,
+		filter:  filter,
 	}
 	hub.AddListener(ml)
 	return ml
@@ -57,13 +67,63 @@ func (ml *msgListener) Receive(msg msghub.Message) error {
 		// Did not match mailbox name
 		return nil
 	}
+	if ml.filter != nil && !ml.filter(msg) {
+		return nil
+	}
 	ml.c <- msg
 	return nil
 }
 
+// parseMonitorFilter builds a filter matching all of the domain, mailbox and from query
+// parameters, or nil if there are none.  Mailbox is a pattern such as team-*, any other
+// parameter is an error.
+func parseMonitorFilter(query url.Values) (hubFilter, error) {
+	var filters []hubFilter
+	for key := range query {
+		value := strings.ToLower(query.Get(key))
+		switch key {
+		case "domain":
+			filters = append(filters, func(msg msghub.Message) bool {
+				return hasDomain(msg.To, value)
+			})
+		case "mailbox":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("Invalid mailbox pattern %q: %v", value, err)
+			}
+			filters = append(filters, func(msg msghub.Message) bool {
+				ok, _ := path.Match(value, msg.Mailbox)
+				return ok
+			})
+		case "from":
+			filters = append(filters, func(msg msghub.Message) bool {
+				return strings.Contains(strings.ToLower(msg.From), value)
+			})
+		default:
+			return nil, fmt.Errorf("Unknown filter %q", key)
+		}
+	}
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return func(msg msghub.Message) bool {
+		for _, f := range filters {
+			if !f(msg) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
 // WSReader makes sure the websocket client is still connected, discards any messages from client
 func (ml *msgListener) WSReader(conn *websocket.Conn) {
 	defer ml.Close()
+	readWebSocket(conn)
+}
+
+// readWebSocket discards any messages from the client, answering its pings, and returns once it
+// disconnects
+func readWebSocket(conn *websocket.Conn) {
 	conn.SetReadLimit(maxMessageSize)
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
@@ -144,8 +204,58 @@ func (ml *msgListener) Close() {
 	}
 }
 
+// MonitorAllMessagesV1 sends the headers of recent and new messages in all mailboxes over a
+// WebSocket, limited by the filters of parseMonitorFilter
 func MonitorAllMessagesV1(
 	w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	return serveMessages(w, req, ctx, "")
+}
+
+// MonitorMailboxMessagesV1 sends the headers of recent and new messages in a mailbox over a
+// WebSocket, limited by the filters of parseMonitorFilter
+func MonitorMailboxMessagesV1(
+	w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	return serveMessages(w, req, ctx, name)
+}
+
+// StreamAllMessagesV1 sends an event over a WebSocket as each message arrives in or is deleted
+// from any mailbox
+func StreamAllMessagesV1(
+	w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	return serveStream(w, req, ctx, "")
+}
+
+// StreamMailboxMessagesV1 sends an event over a WebSocket as each message arrives in or is
+// deleted from a mailbox
+func StreamMailboxMessagesV1(
+	w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	return serveStream(w, req, ctx, name)
+}
+
+// serveMessages upgrades the request to a WebSocket and relays messages from the hub matching
+// the query parameters until the client disconnects, see newMsgListener for mailbox
+func serveMessages(w http.ResponseWriter, req *http.Request, ctx *httpd.Context,
+	mailbox string) error {
+	filter, err := parseMonitorFilter(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if mailbox == "" {
+		// Private mailboxes are left out unless the request has their token
+		match := filter
+		filter = func(msg msghub.Message) bool {
+			return mailboxVisible(req, ctx, msg.Mailbox) && (match == nil || match(msg))
+		}
+	}
 	// Upgrade to Websocket
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
@@ -160,20 +270,17 @@ func MonitorAllMessagesV1(
 	log.Tracef("HTTP[%v] Upgraded to websocket", req.RemoteAddr)
 
 	// Create, register listener; then interact with conn
-	ml := newMsgListener(ctx.MsgHub, "")
+	ml := newMsgListener(ctx.MsgHub, mailbox, filter)
 	go ml.WSWriter(conn)
 	ml.WSReader(conn)
 
 	return nil
 }
 
-func MonitorMailboxMessagesV1(
-	w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
-	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
-	if err != nil {
-		return err
-	}
-	// Upgrade to Websocket
+// serveStream upgrades the request to a WebSocket and sends the delivery and delete events of
+// an eventListener, each wrapped in a JSONMessageEventV1, until the client disconnects
+func serveStream(w http.ResponseWriter, req *http.Request, ctx *httpd.Context,
+	mailbox string) error {
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		return err
@@ -183,13 +290,53 @@ func MonitorMailboxMessagesV1(
 		_ = conn.Close()
 		httpd.ExpWebSocketConnectsCurrent.Add(-1)
 	}()
-
 	log.Tracef("HTTP[%v] Upgraded to websocket", req.RemoteAddr)
 
-	// Create, register listener; then interact with conn
-	ml := newMsgListener(ctx.MsgHub, name)
-	go ml.WSWriter(conn)
-	ml.WSReader(conn)
+	el := newEventListener(ctx.MsgHub, mailbox, func(name string) bool {
+		return mailboxVisible(req, ctx, name)
+	})
+	defer el.Close()
+	go func() {
+		readWebSocket(conn)
+		el.Close()
+	}()
 
-	return nil
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-el.done:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			_ = conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return nil
+		case ev := <-el.c:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if conn.WriteJSON(messageEvent(ev)) != nil {
+				// Write failed
+				return nil
+			}
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if conn.WriteMessage(websocket.PingMessage, []byte{}) != nil {
+				// Write error
+				return nil
+			}
+			log.Tracef("HTTP[%v] Sent WebSocket ping", req.RemoteAddr)
+		}
+	}
+}
+
+// messageEvent converts an event stream event to the JSONMessageEventV1 sent by the stream
+// WebSockets, a deleted message is only identified by its mailbox and ID
+func messageEvent(ev *event) *model.JSONMessageEventV1 {
+	switch data := ev.Data.(type) {
+	case *model.JSONMessageHeaderV1:
+		return &model.JSONMessageEventV1{Type: "message", Message: data}
+	case *model.JSONMessageRefV1:
+		return &model.JSONMessageEventV1{
+			Type:    ev.Name,
+			Message: &model.JSONMessageHeaderV1{Mailbox: data.Mailbox, ID: data.ID},
+		}
+	}
+	return &model.JSONMessageEventV1{Type: ev.Name}
 }
@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/rest/model"
+)
+
+func TestRestMessageStream(t *testing.T) {
+	// Setup
+	logbuf := setupWebServer(&MockDataStore{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := msghub.New(ctx, 10)
+	hub.Dispatch(msghub.Message{Mailbox: "good", ID: "0000"})
+
+	handled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			defer close(handled)
+			_ = serveStream(w, req, &httpd.Context{MsgHub: hub}, "good")
+		}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// History is not replayed, other mailboxes are ignored
+	hub.Sync()
+	hub.Dispatch(msghub.Message{Mailbox: "other", ID: "0001"})
+	hub.Dispatch(msghub.Message{Mailbox: "good", ID: "0002", Subject: "Hi"})
+	hub.Sync()
+	NotifyDelete("other", "0001")
+	NotifyDelete("good", "0002")
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ev := new(model.JSONMessageEventV1)
+	if err := conn.ReadJSON(ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != "message" || ev.Message.ID != "0002" || ev.Message.Subject != "Hi" {
+		t.Errorf("Expected message event for 0002, got %+v", ev)
+	}
+	ev = new(model.JSONMessageEventV1)
+	if err := conn.ReadJSON(ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != "delete" || ev.Message.Mailbox != "good" || ev.Message.ID != "0002" {
+		t.Errorf("Expected delete event for good/0002, got %+v", ev)
+	}
+
+	// The handler removes its listener once the client disconnects, before hub shuts down
+	_ = conn.Close()
+	<-handled
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMonitorFilter(t *testing.T) {
+	msg := msghub.Message{
+		Mailbox: "team-a",
+		From:    "CI Bot <ci@build.example.com>",
+		To:      []string{"Team A <team-a@Example.com>"},
+	}
+	var testTable = []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"domain=example.com", true},
+		{"domain=other.com", false},
+		{"mailbox=team-*", true},
+		{"mailbox=team-b", false},
+		{"from=ci@build", true},
+		{"from=someone", false},
+		{"domain=example.com&mailbox=team-?&from=bot", true},
+		{"domain=example.com&from=someone", false},
+	}
+	for _, tt := range testTable {
+		query, _ := url.ParseQuery(tt.query)
+		filter, err := parseMonitorFilter(query)
+		if err != nil {
+			t.Errorf("Filter %q failed: %v", tt.query, err)
+			continue
+		}
+		if got := filter == nil || filter(msg); got != tt.want {
+			t.Errorf("Filter %q matched %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Invalid filters are refused before upgrading to a WebSocket
+	logbuf := setupWebServer(&MockDataStore{})
+	for _, query := range []string{"mailbox=%5B", "subject=hi"} {
+		w, err := testRestGet(baseURL + "/monitor/messages?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %v, got %v", query, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -40,6 +40,11 @@ func (m *MockMailbox) GetMessage(id string) (smtpd.Message, error) {
 	return args.Get(0).(smtpd.Message), args.Error(1)
 }
 
+func (m *MockMailbox) CopyMessage(msg smtpd.Message) (smtpd.Message, error) {
+	args := m.Called(msg)
+	return args.Get(0).(smtpd.Message), args.Error(1)
+}
+
 func (m *MockMailbox) Purge() error {
 	args := m.Called()
 	return args.Error(0)
@@ -63,6 +68,7 @@ func (m *MockMailbox) String() string {
 // Mock Message object
 type MockMessage struct {
 	mock.Mock
+	appended []byte // Data passed to Append
 }
 
 func (m *MockMessage) ID() string {
@@ -117,6 +123,7 @@ func (m *MockMessage) Size() int64 {
 
 func (m *MockMessage) Append(data []byte) error {
 	// []byte arg seems to mess up testify/mock
+	m.appended = append(m.appended, data...)
 	return nil
 }
 
@@ -134,3 +141,32 @@ func (m *MockMessage) String() string {
 	args := m.Called()
 	return args.String(0)
 }
+
+func (m *MockMessage) UIDL() string {
+	args := m.Called()
+	return args.String(0)
+}
+
+func (m *MockMessage) IMAPUID() uint32 {
+	args := m.Called()
+	return args.Get(0).(uint32)
+}
+
+func (m *MockMessage) Delivery() smtpd.Delivery {
+	args := m.Called()
+	return args.Get(0).(smtpd.Delivery)
+}
+
+func (m *MockMessage) SetDelivery(d smtpd.Delivery) {
+	m.Called(d)
+}
+
+func (m *MockMessage) Flags() []string {
+	args := m.Called()
+	return args.Get(0).([]string)
+}
+
+func (m *MockMessage) SetFlags(flags []string) error {
+	args := m.Called(flags)
+	return args.Error(0)
+}
@@ -2,16 +2,19 @@ package rest
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/jhillyerd/enmime"
 	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/mailauth"
 	"github.com/jhillyerd/inbucket/msghub"
 	"github.com/jhillyerd/inbucket/smtpd"
 )
@@ -23,6 +26,12 @@ type InputMessageData struct {
 	Size                       int
 	Header                     mail.Header
 	HTML, Text                 string
+	Attachments                []*enmime.Part
+	Root                       *enmime.Part
+	DKIM                       []mailauth.DKIMResult
+	MailFrom, Helo, AuthUser   string
+	RcptTo                     []string
+	Flags                      []string
 }
 
 func (d *InputMessageData) MockMessage() *MockMessage {
@@ -33,15 +42,25 @@ func (d *InputMessageData) MockMessage() *MockMessage {
 	msg.On("Subject").Return(d.Subject)
 	msg.On("Date").Return(d.Date)
 	msg.On("Size").Return(d.Size)
+	msg.On("Flags").Return(d.Flags)
 	gomsg := &mail.Message{
 		Header: d.Header,
 	}
 	msg.On("ReadHeader").Return(gomsg, nil)
 	body := &enmime.Envelope{
-		Text: d.Text,
-		HTML: d.HTML,
+		Text:        d.Text,
+		HTML:        d.HTML,
+		Attachments: d.Attachments,
+		Root:        d.Root,
 	}
 	msg.On("ReadBody").Return(body, nil)
+	msg.On("Delivery").Return(smtpd.Delivery{
+		DKIM:       d.DKIM,
+		MailFrom:   d.MailFrom,
+		Recipients: d.RcptTo,
+		Helo:       d.Helo,
+		AuthUser:   d.AuthUser,
+	})
 	return msg
 }
 
@@ -97,6 +116,9 @@ func (d *InputMessageData) CompareToJSONHeaderMap(json interface{}) (errors []st
 		if msg, ok := isJSONNumberEqual(sizeKey, float64(d.Size), m[sizeKey]); !ok {
 			errors = append(errors, msg)
 		}
+		if msg, ok := isJSONStringEqual(authUserKey, d.AuthUser, m[authUserKey]); !ok {
+			errors = append(errors, msg)
+		}
 		return errors
 	}
 	panic(fmt.Sprintf("Expected map[string]interface{} in json, got %T", json))
@@ -133,6 +155,51 @@ func (d *InputMessageData) CompareToJSONMessageMap(json interface{}) (errors []s
 			errors = append(errors, msg)
 		}
 
+		// Get nested DKIM results
+		if dkim, ok := m[dkimKey].([]interface{}); ok && len(dkim) == len(d.DKIM) {
+			for i, r := range d.DKIM {
+				result, _ := dkim[i].(map[string]interface{})
+				for key, expect := range map[string]string{
+					"domain":   r.Domain,
+					"selector": r.Selector,
+					"result":   string(r.Result),
+					"reason":   r.Reason,
+				} {
+					if msg, ok := isJSONStringEqual(dkimKey+"."+key, expect, result[key]); !ok {
+						errors = append(errors, msg)
+					}
+				}
+			}
+		} else {
+			errors = append(errors, fmt.Sprintf("Expected %v DKIM results in JSON %q, got %v",
+				len(d.DKIM), dkimKey, m[dkimKey]))
+		}
+
+		// Get nested envelope map
+		if envelope, ok := m[envelopeKey].(map[string]interface{}); ok {
+			if msg, ok := isJSONStringEqual(envelopeKey+".mail-from", d.MailFrom,
+				envelope["mail-from"]); !ok {
+				errors = append(errors, msg)
+			}
+			if msg, ok := isJSONStringEqual(envelopeKey+".helo", d.Helo, envelope["helo"]); !ok {
+				errors = append(errors, msg)
+			}
+			rcptTo, _ := envelope["rcpt-to"].([]interface{})
+			if len(rcptTo) != len(d.RcptTo) {
+				errors = append(errors, fmt.Sprintf("Expected %v recipients in JSON %q, got %v",
+					len(d.RcptTo), envelopeKey, envelope["rcpt-to"]))
+			}
+			for i := 0; i < len(rcptTo) && i < len(d.RcptTo); i++ {
+				if msg, ok := isJSONStringEqual(envelopeKey+".rcpt-to", d.RcptTo[i],
+					rcptTo[i]); !ok {
+					errors = append(errors, msg)
+				}
+			}
+		} else {
+			errors = append(errors, fmt.Sprintf("Expected envelope in JSON %q, got %v",
+				envelopeKey, m[envelopeKey]))
+		}
+
 		// Get nested header map
 		if m[headerKey] != nil {
 			if header, ok := m[headerKey].(map[string]interface{}); ok {
@@ -188,19 +255,65 @@ func testRestGet(url string) (*httptest.ResponseRecorder, error) {
 	return w, nil
 }
 
+func testRestDelete(url string) (*httptest.ResponseRecorder, error) {
+	return testRestAuth("DELETE", url, "")
+}
+
+func testRestAuth(method, url, token string) (*httptest.ResponseRecorder, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	httpd.Router.ServeHTTP(w, req)
+	return w, nil
+}
+
+func testRestPost(url, body string) (*httptest.ResponseRecorder, error) {
+	return testRestPostType(url, "application/json", body)
+}
+
+func testRestPostType(url, contentType, body string) (*httptest.ResponseRecorder, error) {
+	return testRestSend("POST", url, contentType, body)
+}
+
+func testRestPatch(url, body string) (*httptest.ResponseRecorder, error) {
+	return testRestSend("PATCH", url, "application/json", body)
+}
+
+func testRestSend(method, url, contentType, body string) (*httptest.ResponseRecorder, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", contentType)
+
+	w := httptest.NewRecorder()
+	httpd.Router.ServeHTTP(w, req)
+	return w, nil
+}
+
 func setupWebServer(ds smtpd.DataStore) *bytes.Buffer {
+	return setupWebServerConfig(ds, config.WebConfig{})
+}
+
+func setupWebServerConfig(ds smtpd.DataStore, cfg config.WebConfig) *bytes.Buffer {
 	// Capture log output
 	buf := new(bytes.Buffer)
 	log.SetOutput(buf)
 
 	// Have to reset default mux to prevent duplicate routes
 	http.DefaultServeMux = http.NewServeMux()
-	cfg := config.WebConfig{
-		TemplateDir: "../themes/bootstrap/templates",
-		PublicDir:   "../themes/bootstrap/public",
-	}
+	cfg.TemplateDir = "../themes/bootstrap/templates"
+	cfg.PublicDir = "../themes/bootstrap/public"
 	shutdownChan := make(chan bool)
-	httpd.Initialize(cfg, shutdownChan, ds, &msghub.Hub{})
+	httpd.Initialize(cfg, shutdownChan, ds, msghub.New(context.Background(), 10))
 	SetupRoutes(httpd.Router)
 
 	return buf
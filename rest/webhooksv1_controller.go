@@ -0,0 +1,250 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/rest/model"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// webhookEvents are the events a webhook may subscribe to
+var webhookEvents = map[string]bool{"delivery": true, "delete": true}
+
+// Length of the queue of webhook requests waiting to be sent
+const webhookQueueLen = 1000
+
+// webhookTimeout limits how long a webhook may take to respond
+const webhookTimeout = 10 * time.Second
+
+// webhooks holds the webhooks registered through the API, they are not persisted
+var webhooks = struct {
+	sync.RWMutex
+	m map[string]*model.JSONWebhookV1
+}{m: make(map[string]*model.JSONWebhookV1)}
+
+// webhookPost is an event waiting to be sent to a webhook
+type webhookPost struct {
+	url   string
+	event *model.JSONWebhookEventV1
+}
+
+// webhookSender posts delivery and delete events to the registered webhooks
+type webhookSender struct {
+	queue  chan webhookPost
+	client *http.Client
+}
+
+// StartWebhooks registers for deliveries on msgHub and for deletes from the datastore, and
+// posts them to the matching webhooks until ctx is canceled
+func StartWebhooks(ctx context.Context, msgHub *msghub.Hub) {
+	s := newWebhookSender()
+	smtpd.AddDeleteHook(s.deleted)
+	msgHub.AddLiveListener(s)
+	go s.run(ctx)
+}
+
+// newWebhookSender creates a webhookSender, run must be called to start sending
+func newWebhookSender() *webhookSender {
+	return &webhookSender{
+		queue:  make(chan webhookPost, webhookQueueLen),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Receive queues a delivery event, it implements msghub.Listener
+func (s *webhookSender) Receive(msg msghub.Message) error {
+	s.send(&model.JSONWebhookEventV1{
+		Event:   "delivery",
+		Mailbox: msg.Mailbox,
+		ID:      msg.ID,
+		Message: &model.JSONMessageHeaderV1{
+			Mailbox: msg.Mailbox,
+			ID:      msg.ID,
+			From:    msg.From,
+			To:      msg.To,
+			Subject: msg.Subject,
+			Date:    msg.Date,
+			Size:    msg.Size,
+		},
+	})
+	return nil
+}
+
+// deleted queues a delete event, it is registered with smtpd.AddDeleteHook
+func (s *webhookSender) deleted(mailbox, id string) {
+	s.send(&model.JSONWebhookEventV1{Event: "delete", Mailbox: mailbox, ID: id})
+}
+
+// send queues ev for each webhook subscribed to it, events are dropped if the webhooks are not
+// keeping up
+func (s *webhookSender) send(ev *model.JSONWebhookEventV1) {
+	webhooks.RLock()
+	defer webhooks.RUnlock()
+	for _, wh := range webhooks.m {
+		if !webhookMatches(wh, ev) {
+			continue
+		}
+		post := *ev
+		post.Webhook = wh.ID
+		select {
+		case s.queue <- webhookPost{url: wh.URL, event: &post}:
+		default:
+			log.Warnf("Webhook queue full, dropped %v event for %v", ev.Event, wh.URL)
+		}
+	}
+}
+
+// webhookMatches returns true if wh is subscribed to ev
+func webhookMatches(wh *model.JSONWebhookV1, ev *model.JSONWebhookEventV1) bool {
+	if wh.Mailbox != "" && wh.Mailbox != ev.Mailbox {
+		return false
+	}
+	if wh.Mailbox == "" && smtpd.MailboxPrivate(ev.Mailbox) {
+		// Private mailboxes need a webhook of their own
+		return false
+	}
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, name := range wh.Events {
+		if name == ev.Event {
+			return true
+		}
+	}
+	return false
+}
+
+// run sends queued events until ctx is canceled
+func (s *webhookSender) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case post := <-s.queue:
+			if err := s.post(post); err != nil {
+				log.Warnf("Webhook %v failed: %v", post.url, err)
+			}
+		}
+	}
+}
+
+// post sends a single event to a webhook, any 2xx response is success
+func (s *webhookSender) post(post webhookPost) error {
+	body, err := json.Marshal(post.event)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(post.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected HTTP response status %v", resp.Status)
+	}
+	return nil
+}
+
+type webhooksByID []*model.JSONWebhookV1
+
+func (s webhooksByID) Len() int           { return len(s) }
+func (s webhooksByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s webhooksByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// WebhookListV1 renders the registered webhooks, ordered by ID
+func WebhookListV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	webhooks.RLock()
+	list := make([]*model.JSONWebhookV1, 0, len(webhooks.m))
+	for _, wh := range webhooks.m {
+		list = append(list, wh)
+	}
+	webhooks.RUnlock()
+	sort.Sort(webhooksByID(list))
+	return httpd.RenderJSON(w, list)
+}
+
+// WebhookCreateV1 registers the webhook described by the JSONWebhookV1 request body and
+// renders it with its assigned ID.  An empty mailbox matches every mailbox except private ones,
+// and no events subscribes to all of them.
+func WebhookCreateV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	var wh model.JSONWebhookV1
+	if err := json.NewDecoder(req.Body).Decode(&wh); err != nil {
+		http.Error(w, "Unable to parse webhook: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		http.Error(w, fmt.Sprintf("Invalid webhook URL %q, must be an http or https URL",
+			wh.URL), http.StatusBadRequest)
+		return nil
+	}
+	if wh.Mailbox != "" {
+		if wh.Mailbox, err = smtpd.ParseMailboxName(wh.Mailbox); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if !mailboxVisible(req, ctx, wh.Mailbox) {
+			http.Error(w, "Mailbox "+wh.Mailbox+" is private, its token is required",
+				http.StatusForbidden)
+			return nil
+		}
+	}
+	for _, name := range wh.Events {
+		if !webhookEvents[name] {
+			http.Error(w, fmt.Sprintf("Unknown event %q, must be delivery or delete", name),
+				http.StatusBadRequest)
+			return nil
+		}
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("Failed to generate webhook ID: %v", err)
+	}
+	wh.ID = hex.EncodeToString(b)
+
+	webhooks.Lock()
+	webhooks.m[wh.ID] = &wh
+	webhooks.Unlock()
+	log.Infof("Registered webhook %v for %v", wh.ID, wh.URL)
+	return httpd.RenderJSON(w, &wh)
+}
+
+// WebhookShowV1 renders a registered webhook
+func WebhookShowV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	webhooks.RLock()
+	wh, ok := webhooks.m[ctx.Vars["id"]]
+	webhooks.RUnlock()
+	if !ok {
+		http.NotFound(w, req)
+		return nil
+	}
+	return httpd.RenderJSON(w, wh)
+}
+
+// WebhookDeleteV1 removes a registered webhook, events already queued for it are still sent
+func WebhookDeleteV1(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	id := ctx.Vars["id"]
+	webhooks.Lock()
+	_, ok := webhooks.m[id]
+	delete(webhooks.m, id)
+	webhooks.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return nil
+	}
+	log.Infof("Removed webhook %v", id)
+	return httpd.RenderJSON(w, "OK")
+}
@@ -0,0 +1,145 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/rest/model"
+)
+
+func TestRestWebhooks(t *testing.T) {
+	// Setup
+	logbuf := setupWebServer(&MockDataStore{})
+	defer func() {
+		webhooks.Lock()
+		webhooks.m = make(map[string]*model.JSONWebhookV1)
+		webhooks.Unlock()
+	}()
+
+	received := make(chan *model.JSONWebhookEventV1, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			ev := new(model.JSONWebhookEventV1)
+			if err := json.NewDecoder(req.Body).Decode(ev); err != nil {
+				t.Errorf("Failed to decode webhook event: %v", err)
+			}
+			received <- ev
+		}))
+	defer server.Close()
+
+	// Register webhooks for deletes from one mailbox, and everything
+	w, err := testRestPost(baseURL+"/webhooks",
+		`{"url":"`+server.URL+`/good","mailbox":"Good","events":["delete"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	good := new(model.JSONWebhookV1)
+	if err := json.NewDecoder(w.Body).Decode(good); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if good.ID == "" || good.Mailbox != "good" {
+		t.Errorf("Expected an ID and mailbox good, got %+v", good)
+	}
+	w, err = testRestPost(baseURL+"/webhooks", `{"url":"`+server.URL+`/all"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := new(model.JSONWebhookV1)
+	if err := json.NewDecoder(w.Body).Decode(all); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+
+	w, err = testRestGet(baseURL + "/webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []*model.JSONWebhookV1
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if len(list) != 2 {
+		t.Errorf("Expected 2 webhooks, got %v", len(list))
+	}
+
+	// Events are sent to the matching webhooks
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newWebhookSender()
+	go s.run(ctx)
+	_ = s.Receive(msghub.Message{Mailbox: "good", ID: "0001", Subject: "Hi"})
+	ev := <-received
+	if ev.Event != "delivery" || ev.Webhook != all.ID || ev.Message.Subject != "Hi" {
+		t.Errorf("Expected delivery to %v, got %+v", all.ID, ev)
+	}
+	s.deleted("good", "0001")
+	s.deleted("other", "0002")
+	got := map[string]string{}
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-received:
+			got[ev.Webhook+" "+ev.Mailbox] = ev.Event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for webhook")
+		}
+	}
+	want := map[string]string{
+		good.ID + " good": "delete", all.ID + " good": "delete", all.ID + " other": "delete",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Expected %v event for %v, got %q", v, k, got[k])
+		}
+	}
+
+	// Test delete
+	w, err = testRestDelete(baseURL + "/webhooks/" + good.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected code 200, got %v", w.Code)
+	}
+	w, err = testRestGet(baseURL + "/webhooks/" + good.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	// Test invalid webhooks
+	for _, body := range []string{
+		`{"url":"ftp://example.com/"}`,
+		`{"url":"http://example.com/","events":["bounce"]}`,
+		`{"url":`,
+	} {
+		w, err = testRestPost(baseURL+"/webhooks", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %v, got %v", body, w.Code)
+		}
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Unable to parse") {
+		t.Errorf("Expected parse error, got %q", body)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
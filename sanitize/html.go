@@ -0,0 +1,280 @@
+package sanitize
+
+import (
+	"bytes"
+	"io"
+	neturl "net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Removal describes something taken out of an HTML document by HTML
+type Removal struct {
+	Kind  string // element, attribute or external
+	Name  string // Tag name of elements, attribute name otherwise
+	Value string // URL of external loads, empty otherwise
+}
+
+// droppedElements are removed along with everything inside them
+var droppedElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Applet:   true,
+	atom.Template: true,
+	atom.Textarea: true,
+	atom.Select:   true,
+	atom.Button:   true,
+	atom.Svg:      true,
+	atom.Math:     true,
+}
+
+// strippedElements are removed, but what is inside them is kept
+var strippedElements = map[atom.Atom]bool{
+	atom.Form:  true,
+	atom.Input: true,
+	atom.Link:  true,
+	atom.Meta:  true,
+	atom.Base:  true,
+}
+
+// loadAttrs hold URLs the browser loads while rendering, rather than when a link is followed
+var loadAttrs = map[string]bool{
+	"src":        true,
+	"srcset":     true,
+	"background": true,
+	"poster":     true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+}
+
+// linkAttrs hold URLs followed only when the reader clicks them
+var linkAttrs = map[string]bool{
+	"href":     true,
+	"cite":     true,
+	"longdesc": true,
+}
+
+// HTML returns src with scripts, forms and anything that would be loaded from another server
+// while rendering removed, and a list of what was removed.  Embedded cid: and data:image
+// resources are kept, as are links to web and mailto: URLs.
+func HTML(src string) (string, []Removal, error) {
+	return clean(src, false)
+}
+
+// HTMLWithExternal is like HTML, but keeps the images and other resources loaded from web
+// servers while rendering.  Styles loading resources are still removed.
+func HTMLWithExternal(src string) (string, []Removal, error) {
+	return clean(src, true)
+}
+
+// clean implements HTML and HTMLWithExternal
+func clean(src string, external bool) (string, []Removal, error) {
+	var removed []Removal
+	var out bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(src))
+	// Name and nesting depth of the dropped element being skipped over
+	var skip atom.Atom
+	depth := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return out.String(), removed, nil
+			}
+			return "", nil, z.Err()
+		}
+		tok := z.Token()
+		if skip != 0 {
+			if tok.DataAtom == skip {
+				switch tt {
+				case html.StartTagToken:
+					depth++
+				case html.EndTagToken:
+					depth--
+				}
+				if depth == 0 {
+					skip = 0
+				}
+			}
+			continue
+		}
+		switch tt {
+		case html.CommentToken:
+			// Conditional comments may hold markup for some mail clients, drop them all
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			if droppedElements[tok.DataAtom] {
+				if tt == html.StartTagToken {
+					removed = append(removed, Removal{Kind: "element", Name: tok.Data})
+					skip, depth = tok.DataAtom, 1
+				}
+				continue
+			}
+			if strippedElements[tok.DataAtom] {
+				if tt != html.EndTagToken {
+					removed = append(removed, Removal{Kind: "element", Name: tok.Data})
+				}
+				continue
+			}
+			if tt != html.EndTagToken {
+				tok.Attr = cleanAttrs(tok.Attr, external, &removed)
+			}
+			if tok.DataAtom == atom.Style && tt == html.StartTagToken {
+				if z.Next() == html.TextToken {
+					css := z.Token().Data
+					if unsafeCSS(css) {
+						removed = append(removed, Removal{Kind: "element", Name: tok.Data})
+						skip, depth = tok.DataAtom, 1
+						continue
+					}
+					out.WriteString(tok.String())
+					out.WriteString(css)
+					continue
+				}
+				// An empty style element, the end tag has been consumed
+				continue
+			}
+		}
+		out.WriteString(tok.String())
+	}
+}
+
+// cleanAttrs returns attrs without event handlers, scripted URLs, unsafe styles and, unless
+// allowExternal is set, external URLs, adding what it leaves out to removed
+func cleanAttrs(attrs []html.Attribute, allowExternal bool, removed *[]Removal) []html.Attribute {
+	kept := attrs[:0]
+	for _, a := range attrs {
+		name := strings.ToLower(a.Key)
+		value := strings.TrimSpace(a.Val)
+		switch {
+		case strings.HasPrefix(name, "on"), name == "action", name == "formaction":
+			*removed = append(*removed, Removal{Kind: "attribute", Name: name})
+			continue
+		case name == "style" && unsafeCSS(value):
+			*removed = append(*removed, Removal{Kind: "attribute", Name: name})
+			continue
+		case loadAttrs[name] && !embeddedURL(value) && !(allowExternal && webURL(value)):
+			if external(value) {
+				*removed = append(*removed, Removal{Kind: "external", Name: name, Value: value})
+			} else {
+				*removed = append(*removed, Removal{Kind: "attribute", Name: name})
+			}
+			continue
+		case linkAttrs[name] && !safeLink(value):
+			*removed = append(*removed, Removal{Kind: "attribute", Name: name})
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// unsafeCSS returns true if css may load resources or run script
+func unsafeCSS(css string) bool {
+	css = strings.ToLower(css)
+	return strings.Contains(css, "url(") || strings.Contains(css, "@import") ||
+		strings.Contains(css, "expression(") || strings.Contains(css, "behavior:")
+}
+
+// scheme returns the lower case scheme of url, or "" for relative URLs.  Browsers ignore
+// whitespace and control characters in the scheme, so they are ignored here too.
+func scheme(url string) string {
+	url = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, url)
+	colon := strings.IndexAny(url, ":/?#")
+	if colon < 1 || url[colon] != ':' {
+		return ""
+	}
+	return strings.ToLower(url[:colon])
+}
+
+// external returns true if url refers to another server
+func external(url string) bool {
+	s := scheme(url)
+	return s == "http" || s == "https" || s == "ftp" || strings.HasPrefix(url, "//")
+}
+
+// webURL returns true if url is loaded from a web server
+func webURL(url string) bool {
+	s := scheme(url)
+	return s == "http" || s == "https" || strings.HasPrefix(url, "//")
+}
+
+// embeddedURL returns true if url refers to a part of the message or holds an image
+func embeddedURL(url string) bool {
+	switch scheme(url) {
+	case "cid":
+		return true
+	case "data":
+		return strings.HasPrefix(strings.ToLower(url), "data:image/")
+	}
+	return false
+}
+
+// safeLink returns true if url may be followed by the reader without running script
+func safeLink(url string) bool {
+	switch scheme(url) {
+	case "", "http", "https", "mailto", "cid":
+		return true
+	}
+	return false
+}
+
+// ReplaceCID returns src with the cid: URLs of resources loaded while rendering replaced by the
+// result of resolve, which is passed the Content-ID they refer to.  It is meant for HTML
+// already cleaned by HTML, so that a browser can load the parts of the message it embeds.
+func ReplaceCID(src string, resolve func(cid string) string) (string, error) {
+	var out bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return out.String(), nil
+			}
+			return "", z.Err()
+		}
+		// Everything but rewritten tags is copied unchanged, re-encoding would mangle styles
+		raw := string(z.Raw())
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.WriteString(raw)
+			continue
+		}
+		tok := z.Token()
+		changed := false
+		for i, a := range tok.Attr {
+			name := strings.ToLower(a.Key)
+			value := strings.TrimSpace(a.Val)
+			if !loadAttrs[name] || name == "srcset" || scheme(value) != "cid" {
+				continue
+			}
+			tok.Attr[i].Val = resolve(contentID(value))
+			changed = true
+		}
+		if changed {
+			out.WriteString(tok.String())
+		} else {
+			out.WriteString(raw)
+		}
+	}
+}
+
+// contentID returns the Content-ID referenced by a cid: URL, which may be percent-encoded
+func contentID(url string) string {
+	cid := url[strings.Index(url, ":")+1:]
+	// Not a query, but a literal + must survive unescaping
+	if s, err := neturl.QueryUnescape(strings.Replace(cid, "+", "%2B", -1)); err == nil {
+		return s
+	}
+	return cid
+}
@@ -0,0 +1,72 @@
+package sanitize
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLRemovesScripts(t *testing.T) {
+	got, removed, err := HTML(`<p onclick="steal()">Hi<script>alert("<p>")</script></p>` +
+		`<a href=" java&#09;script:steal()">x</a><a href="https://example.com/">y</a>`)
+	assert.NoError(t, err)
+	assert.Equal(t, `<p>Hi</p><a>x</a><a href="https://example.com/">y</a>`, got)
+	assert.Equal(t, []Removal{
+		{Kind: "attribute", Name: "onclick"},
+		{Kind: "element", Name: "script"},
+		{Kind: "attribute", Name: "href"},
+	}, removed)
+}
+
+func TestHTMLRemovesExternalLoads(t *testing.T) {
+	got, removed, err := HTML(`<link rel="stylesheet" href="http://evil/a.css">` +
+		`<img src="http://evil/pixel.gif"><img src="cid:logo@example"><img src="//evil/b.png">` +
+		`<div style="background: url(http://evil/c.png)">text</div>` +
+		`<style>p { color: red }</style><style>@import "http://evil/d.css";</style>`)
+	assert.NoError(t, err)
+	assert.Equal(t, `<img><img src="cid:logo@example"><img><div>text</div>`+
+		`<style>p { color: red }</style>`, got)
+	assert.Equal(t, []Removal{
+		{Kind: "element", Name: "link"},
+		{Kind: "external", Name: "src", Value: "http://evil/pixel.gif"},
+		{Kind: "external", Name: "src", Value: "//evil/b.png"},
+		{Kind: "attribute", Name: "style"},
+		{Kind: "element", Name: "style"},
+	}, removed)
+}
+
+func TestReplaceCID(t *testing.T) {
+	got, err := ReplaceCID(`<style>p > b { color: red }</style><img src="cid:logo%40example" `+
+		`alt="a &amp; b"><td background=" CID:bg+1"><a href="cid:doc">x</a><img src="a.png">`,
+		func(cid string) string { return "/inline?cid=" + cid })
+	assert.NoError(t, err)
+	assert.Equal(t, `<style>p > b { color: red }</style><img src="/inline?cid=logo@example" `+
+		`alt="a &amp; b"><td background="/inline?cid=bg+1"><a href="cid:doc">x</a>`+
+		`<img src="a.png">`, got)
+}
+
+func TestHTMLWithExternal(t *testing.T) {
+	got, removed, err := HTMLWithExternal(`<img src="http://example.com/a.gif">` +
+		`<img src="ftp://example.com/b.gif"><script src="https://evil/c.js"></script>` +
+		`<div style="background: url(http://example.com/d.png)">text</div>`)
+	assert.NoError(t, err)
+	assert.Equal(t, `<img src="http://example.com/a.gif"><img><div>text</div>`, got)
+	assert.Equal(t, []Removal{
+		{Kind: "external", Name: "src", Value: "ftp://example.com/b.gif"},
+		{Kind: "element", Name: "script"},
+		{Kind: "attribute", Name: "style"},
+	}, removed)
+}
+
+func TestHTMLRemovesForms(t *testing.T) {
+	got, removed, err := HTML(`<form action="http://evil/">Name <input name="n">` +
+		`<select><option>a</option></select><button>Send</button></form><p>After</p>`)
+	assert.NoError(t, err)
+	assert.Equal(t, `Name <p>After</p>`, got)
+	assert.Equal(t, []Removal{
+		{Kind: "element", Name: "form"},
+		{Kind: "element", Name: "input"},
+		{Kind: "element", Name: "select"},
+		{Kind: "element", Name: "button"},
+	}, removed)
+}
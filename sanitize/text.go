@@ -0,0 +1,212 @@
+package sanitize
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// hiddenElements are not rendered, so their content is left out of plain text
+var hiddenElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Title:    true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Template: true,
+}
+
+// paragraphElements are separated from surrounding text by a blank line
+var paragraphElements = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true,
+	atom.H6: true, atom.Blockquote: true, atom.Pre: true, atom.Table: true, atom.Ul: true,
+	atom.Ol: true, atom.Dl: true,
+}
+
+// lineElements start and end on a line of their own
+var lineElements = map[atom.Atom]bool{
+	atom.Div: true, atom.Tr: true, atom.Li: true, atom.Dt: true, atom.Dd: true,
+	atom.Section: true, atom.Article: true, atom.Header: true, atom.Footer: true,
+	atom.Center: true, atom.Address: true, atom.Caption: true,
+}
+
+// HTMLToText renders src as readable plain text: whitespace is collapsed outside of pre
+// elements, blocks are broken into lines and paragraphs, list items are marked, and links are
+// followed by their URL in parentheses.
+func HTMLToText(src string) string {
+	p := &plainText{}
+	z := html.NewTokenizer(strings.NewReader(src))
+	var skip atom.Atom
+	depth, pre := 0, 0
+	var lists []int // Next number of each open ordered list, 0 for unordered lists
+	var href string
+	var linkStart int
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			// The tokenizer reports malformed HTML as text, any error is the end of input
+			return p.out.String()
+		}
+		tok := z.Token()
+		if skip != 0 {
+			if tok.DataAtom == skip {
+				switch tt {
+				case html.StartTagToken:
+					depth++
+				case html.EndTagToken:
+					depth--
+				}
+				if depth == 0 {
+					skip = 0
+				}
+			}
+			continue
+		}
+		switch tt {
+		case html.TextToken:
+			p.text(tok.Data, pre > 0)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if hiddenElements[tok.DataAtom] {
+				if tt == html.StartTagToken {
+					skip, depth = tok.DataAtom, 1
+				}
+				continue
+			}
+			switch {
+			case paragraphElements[tok.DataAtom]:
+				p.lineBreak(2)
+			case lineElements[tok.DataAtom]:
+				p.lineBreak(1)
+			}
+			switch tok.DataAtom {
+			case atom.Br:
+				p.breaks++
+				p.space = false
+			case atom.Hr:
+				p.lineBreak(1)
+				p.write("----")
+				p.lineBreak(1)
+			case atom.Pre:
+				pre++
+			case atom.Ul:
+				lists = append(lists, 0)
+			case atom.Ol:
+				lists = append(lists, 1)
+			case atom.Li:
+				marker := "-"
+				if n := len(lists); n > 0 && lists[n-1] > 0 {
+					marker = strconv.Itoa(lists[n-1]) + "."
+					lists[n-1]++
+				}
+				p.write(marker)
+				p.space = true
+			case atom.Td, atom.Th:
+				p.space = true
+			case atom.Img:
+				p.text(attr(tok, "alt"), false)
+			case atom.A:
+				href, linkStart = attr(tok, "href"), p.out.Len()
+			}
+		case html.EndTagToken:
+			switch {
+			case paragraphElements[tok.DataAtom]:
+				p.lineBreak(2)
+			case lineElements[tok.DataAtom]:
+				p.lineBreak(1)
+			}
+			switch tok.DataAtom {
+			case atom.Pre:
+				if pre > 0 {
+					pre--
+				}
+			case atom.Ul, atom.Ol:
+				if n := len(lists); n > 0 {
+					lists = lists[:n-1]
+				}
+			case atom.Td, atom.Th:
+				p.space = true
+			case atom.A:
+				if linkURL(href) && linkText(p.out.Bytes()[linkStart:]) != linkText([]byte(href)) {
+					p.space = true
+					p.write("(" + strings.TrimPrefix(href, "mailto:") + ")")
+				}
+				href = ""
+			}
+		}
+	}
+}
+
+// plainText accumulates text, holding back spaces and line breaks until more text follows
+type plainText struct {
+	out    bytes.Buffer
+	breaks int  // Line breaks to write before the next text
+	space  bool // A space is due before the next text
+}
+
+// lineBreak ensures the next text starts n lines below the last, 2 leaves a blank line
+func (p *plainText) lineBreak(n int) {
+	if n > p.breaks {
+		p.breaks = n
+	}
+	p.space = false
+}
+
+// text adds the content of a text node, collapsing its whitespace unless pre is set
+func (p *plainText) text(s string, pre bool) {
+	if pre {
+		p.write(s)
+		return
+	}
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		p.space = p.space || s != ""
+		return
+	}
+	if unicode.IsSpace([]rune(s)[0]) {
+		p.space = true
+	}
+	p.write(strings.Join(words, " "))
+	p.space = strings.TrimRightFunc(s, unicode.IsSpace) != s
+}
+
+// write adds s after any pending line breaks or space, which are dropped at the start
+func (p *plainText) write(s string) {
+	if p.out.Len() > 0 {
+		if p.breaks > 0 {
+			p.out.WriteString(strings.Repeat("\n", p.breaks))
+		} else if p.space {
+			p.out.WriteByte(' ')
+		}
+	}
+	p.breaks, p.space = 0, false
+	p.out.WriteString(s)
+}
+
+// attr returns the value of the named attribute of tok, or ""
+func attr(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if strings.EqualFold(a.Key, name) {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+// linkURL returns true if url is worth showing after the text of a link
+func linkURL(url string) bool {
+	switch scheme(url) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// linkText normalizes the text of a link for comparison with its URL
+func linkText(b []byte) string {
+	s := strings.ToLower(strings.TrimSpace(string(b)))
+	s = strings.TrimPrefix(s, "mailto:")
+	return strings.TrimSuffix(s, "/")
+}
@@ -0,0 +1,30 @@
+package sanitize
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLToText(t *testing.T) {
+	testTable := []struct {
+		input, want string
+	}{
+		{"<p>Hello\n   <b>World</b>!</p><p>Bye</p>", "Hello World!\n\nBye"},
+		{"<head><title>T</title><style>p {}</style></head><body>Body</body>", "Body"},
+		{"Line one<br>Line two<br><br>Line four", "Line one\nLine two\n\nLine four"},
+		{"<ul><li>One</li><li> Two</li></ul><ol><li>A<li>B</ol>", "- One\n- Two\n\n1. A\n2. B"},
+		{`<a href="https://example.com/reset?t=1">Reset password</a> now`,
+			"Reset password (https://example.com/reset?t=1) now"},
+		{`<a href="https://example.com/">https://example.com</a>`, "https://example.com"},
+		{`<a href="mailto:help@example.com">Email us</a>`, "Email us (help@example.com)"},
+		{"<table><tr><td>Total</td><td>&pound;5&nbsp;00</td></tr><tr><td>Tax</td></tr></table>",
+			"Total £5 00\nTax"},
+		{"<pre>a\n  b</pre>after", "a\n  b\n\nafter"},
+		{`<div><img src="cid:x" alt="Logo"></div><div>Text<hr>More</div>`,
+			"Logo\nText\n----\nMore"},
+	}
+	for _, tt := range testTable {
+		assert.Equal(t, tt.want, HTMLToText(tt.input), "HTMLToText(%q)", tt.input)
+	}
+}
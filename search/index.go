@@ -0,0 +1,290 @@
+package search
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jhillyerd/inbucket/log"
+)
+
+// maxTermLength is the length of the longest word that will be indexed, longer words are
+// usually encoded data rather than text
+const maxTermLength = 64
+
+// Ref identifies an indexed message
+type Ref struct {
+	Mailbox string `json:"mailbox"`
+	ID      string `json:"id"`
+}
+
+// entry is a single record of the index log, it either adds (or replaces) the terms of a
+// message, removes the message from the index, or records that the index has been built
+type entry struct {
+	Ref
+	Remove bool     `json:"remove,omitempty"`
+	Terms  []string `json:"terms,omitempty"`
+	Built  bool     `json:"built,omitempty"` // Ref is empty
+}
+
+// Index is an inverted index from words to the messages containing them.  It is held in
+// memory and persisted to an append-only log file, which is compacted each time the index is
+// opened.
+type Index struct {
+	sync.RWMutex
+	path  string
+	file  *os.File
+	terms map[string]map[Ref]struct{} // Messages containing each term
+	docs  map[Ref][]string            // Terms of each message, to support removal
+	isNew bool
+	built bool // Every stored message has been indexed
+}
+
+// Open loads the index stored at path, creating it if it does not exist
+func Open(path string) (*Index, error) {
+	x := &Index{
+		path:  path,
+		terms: make(map[string]map[Ref]struct{}),
+		docs:  make(map[Ref][]string),
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		x.isNew = true
+	} else if err != nil {
+		return nil, err
+	} else {
+		err = x.load(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := x.compact(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// load replays the entries of the index log
+func (x *Index) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Likely a partial write while shutting down, drop the rest of the log
+			log.Warnf("Search index %v corrupt at line %v: %v", x.path, line, err)
+			return nil
+		}
+		x.apply(e)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the index log with a single entry per indexed message, and leaves it open
+// for appending
+func (x *Index) compact() error {
+	tmpPath := x.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if x.built {
+		if err := writeEntry(w, entry{Built: true}); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	for ref, terms := range x.docs {
+		if err := writeEntry(w, entry{Ref: ref, Terms: terms}); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, x.path); err != nil {
+		return err
+	}
+	x.file, err = os.OpenFile(x.path, os.O_WRONLY|os.O_APPEND, 0660)
+	return err
+}
+
+// IsNew returns true if the index did not exist before it was opened
+func (x *Index) IsNew() bool {
+	return x.isNew
+}
+
+// Built returns true if the index has been built from every stored message, an index whose
+// build was interrupted must be built again
+func (x *Index) Built() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return x.built
+}
+
+// MarkBuilt records that the index has been built from every stored message
+func (x *Index) MarkBuilt() error {
+	return x.append(entry{Built: true})
+}
+
+// Len returns the number of indexed messages
+func (x *Index) Len() int {
+	x.RLock()
+	defer x.RUnlock()
+	return len(x.docs)
+}
+
+// Add indexes the words in text for a message, replacing any words previously indexed for it
+func (x *Index) Add(ref Ref, text string) error {
+	return x.append(entry{Ref: ref, Terms: Tokenize(text)})
+}
+
+// Remove drops a message from the index
+func (x *Index) Remove(ref Ref) error {
+	x.RLock()
+	_, ok := x.docs[ref]
+	x.RUnlock()
+	if !ok {
+		return nil
+	}
+	return x.append(entry{Ref: ref, Remove: true})
+}
+
+// append applies an entry to the index and records it in the log
+func (x *Index) append(e entry) error {
+	x.Lock()
+	defer x.Unlock()
+	x.apply(e)
+	if x.file == nil {
+		return nil
+	}
+	return writeEntry(x.file, e)
+}
+
+// apply updates the in memory index with an entry, caller must hold the write lock
+func (x *Index) apply(e entry) {
+	if e.Built {
+		x.built = true
+		return
+	}
+	if old, ok := x.docs[e.Ref]; ok {
+		for _, term := range old {
+			refs := x.terms[term]
+			delete(refs, e.Ref)
+			if len(refs) == 0 {
+				delete(x.terms, term)
+			}
+		}
+		delete(x.docs, e.Ref)
+	}
+	if e.Remove {
+		return
+	}
+	x.docs[e.Ref] = e.Terms
+	for _, term := range e.Terms {
+		refs := x.terms[term]
+		if refs == nil {
+			refs = make(map[Ref]struct{})
+			x.terms[term] = refs
+		}
+		refs[e.Ref] = struct{}{}
+	}
+}
+
+// Search returns the messages containing every word of query, each word also matches longer
+// words it is a prefix of.  Results are ordered by mailbox and ID.
+func (x *Index) Search(query string) []Ref {
+	words := Tokenize(query)
+	if len(words) == 0 {
+		return nil
+	}
+	x.RLock()
+	defer x.RUnlock()
+	var found map[Ref]struct{}
+	for _, word := range words {
+		matched := make(map[Ref]struct{})
+		for term, refs := range x.terms {
+			if !strings.HasPrefix(term, word) {
+				continue
+			}
+			for ref := range refs {
+				if _, ok := found[ref]; found == nil || ok {
+					matched[ref] = struct{}{}
+				}
+			}
+		}
+		found = matched
+		if len(found) == 0 {
+			return nil
+		}
+	}
+	result := make([]Ref, 0, len(found))
+	for ref := range found {
+		result = append(result, ref)
+	}
+	sort.Sort(refSort(result))
+	return result
+}
+
+// Close closes the index log
+func (x *Index) Close() error {
+	x.Lock()
+	defer x.Unlock()
+	if x.file == nil {
+		return nil
+	}
+	err := x.file.Close()
+	x.file = nil
+	return err
+}
+
+// Tokenize splits text into unique lower case words
+func Tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool, len(fields))
+	words := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if len(f) > maxTermLength || seen[f] {
+			continue
+		}
+		seen[f] = true
+		words = append(words, f)
+	}
+	return words
+}
+
+// writeEntry writes an entry as a single line of JSON
+func writeEntry(w io.Writer, e entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// refSort orders refs by mailbox and then ID, which sorts messages by arrival
+type refSort []Ref
+
+func (s refSort) Len() int      { return len(s) }
+func (s refSort) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s refSort) Less(i, j int) bool {
+	if s[i].Mailbox != s[j].Mailbox {
+		return s[i].Mailbox < s[j].Mailbox
+	}
+	return s[i].ID < s[j].ID
+}
@@ -0,0 +1,121 @@
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world", "example", "com", "2017"},
+		Tokenize("Hello, World! <hello@example.com> 2017"))
+	assert.Equal(t, []string{"straße", "日本語"}, Tokenize("Straße 日本語"))
+	assert.Empty(t, Tokenize(" -- "))
+}
+
+func TestIndexSearch(t *testing.T) {
+	index, dir := openTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer index.Close()
+
+	refA := Ref{Mailbox: "fred", ID: "0001"}
+	refB := Ref{Mailbox: "fred", ID: "0002"}
+	refC := Ref{Mailbox: "barney", ID: "0003"}
+	assert.Nil(t, index.Add(refA, "Your activation code"))
+	assert.Nil(t, index.Add(refB, "Password reset code"))
+	assert.Nil(t, index.Add(refC, "Activate your account"))
+	assert.Equal(t, 3, index.Len())
+
+	assert.Equal(t, []Ref{refA}, index.Search("activation"))
+	assert.Equal(t, []Ref{refC, refA}, index.Search("ACTIV"))
+	assert.Equal(t, []Ref{refA, refB}, index.Search("code"))
+	assert.Equal(t, []Ref{refB}, index.Search("reset code"))
+	assert.Empty(t, index.Search("reset activ"))
+	assert.Empty(t, index.Search("missing"))
+	assert.Empty(t, index.Search(""))
+
+	// Replacing and removing messages
+	assert.Nil(t, index.Add(refA, "Welcome"))
+	assert.Equal(t, []Ref{refB}, index.Search("code"))
+	assert.Nil(t, index.Remove(refB))
+	assert.Empty(t, index.Search("code"))
+	assert.Equal(t, 2, index.Len())
+}
+
+func TestIndexPersistence(t *testing.T) {
+	index, dir := openTestIndex(t)
+	defer os.RemoveAll(dir)
+	assert.True(t, index.IsNew())
+
+	refA := Ref{Mailbox: "fred", ID: "0001"}
+	refB := Ref{Mailbox: "fred", ID: "0002"}
+	assert.Nil(t, index.Add(refA, "first message"))
+	assert.Nil(t, index.Add(refB, "second message"))
+	assert.Nil(t, index.Add(refA, "first message updated"))
+	assert.Nil(t, index.Remove(refB))
+	assert.Nil(t, index.Close())
+
+	// Simulate a partial write
+	path := filepath.Join(dir, "search.index")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(`{"mailbox":"fr`)
+	_ = file.Close()
+
+	index, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	assert.False(t, index.IsNew())
+	assert.Equal(t, 1, index.Len())
+	assert.Equal(t, []Ref{refA}, index.Search("updated"))
+	assert.Empty(t, index.Search("second"))
+
+	// Compaction leaves a single entry per message
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"mailbox":"fred","id":"0001","terms":["first","message","updated"]}`+"\n",
+		string(data))
+}
+
+func TestIndexBuilt(t *testing.T) {
+	index, dir := openTestIndex(t)
+	defer os.RemoveAll(dir)
+	assert.False(t, index.Built())
+	assert.Nil(t, index.Add(Ref{Mailbox: "fred", ID: "0001"}, "first message"))
+	assert.Nil(t, index.MarkBuilt())
+	assert.True(t, index.Built())
+	assert.Nil(t, index.Close())
+
+	// The build is recorded across compaction
+	for i := 0; i < 2; i++ {
+		index, err := Open(filepath.Join(dir, "search.index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, index.Built())
+		assert.Equal(t, 1, index.Len())
+		assert.Nil(t, index.Close())
+	}
+}
+
+// openTestIndex opens a new index in a temporary directory
+func openTestIndex(t *testing.T) (*Index, string) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := Open(filepath.Join(dir, "search.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index, dir
+}
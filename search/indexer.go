@@ -0,0 +1,165 @@
+package search
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/sanitize"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// Length of the queue of messages waiting to be indexed
+const queueLen = 1000
+
+// Indexer keeps an Index up to date with the messages in a DataStore, indexing them as they
+// are delivered and removing them as they are deleted
+type Indexer struct {
+	index *Index
+	ds    smtpd.DataStore
+	queue chan Ref
+}
+
+// NewIndexer creates an Indexer, which listens to msgHub for deliveries and registers the
+// datastore delete hook.  If the index has not been built, every stored message is indexed in
+// the background while deliveries continue to be indexed, and the completed build is recorded
+// so that one interrupted by a shutdown is started again.  The indexer runs until ctx is
+// canceled.
+func NewIndexer(ctx context.Context, index *Index, ds smtpd.DataStore,
+	msgHub *msghub.Hub) *Indexer {
+	ix := &Indexer{
+		index: index,
+		ds:    ds,
+		queue: make(chan Ref, queueLen),
+	}
+	smtpd.AddDeleteHook(func(mailbox, id string) {
+		if err := index.Remove(Ref{Mailbox: mailbox, ID: id}); err != nil {
+			log.Errorf("Failed to remove %v/%v from search index: %v", mailbox, id, err)
+		}
+	})
+	go ix.run(ctx, !index.Built())
+	msgHub.AddListener(ix)
+	return ix
+}
+
+// Receive queues a delivered message for indexing, it implements msghub.Listener
+func (ix *Indexer) Receive(msg msghub.Message) error {
+	select {
+	case ix.queue <- Ref{Mailbox: msg.Mailbox, ID: msg.ID}:
+	default:
+		log.Errorf("Search index queue full, %v/%v will not be indexed", msg.Mailbox, msg.ID)
+	}
+	return nil
+}
+
+// run indexes queued messages until ctx is canceled, rebuilding the index alongside them if
+// rebuild is set
+func (ix *Indexer) run(ctx context.Context, rebuild bool) {
+	rebuilt := make(chan struct{})
+	if rebuild {
+		go func() {
+			defer close(rebuilt)
+			if !ix.indexAll(ctx) {
+				return
+			}
+			if err := ix.index.MarkBuilt(); err != nil {
+				log.Errorf("Failed to record search index build: %v", err)
+			}
+		}()
+	} else {
+		close(rebuilt)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// The rebuild stops once ctx is canceled, wait for it before closing the index
+			<-rebuilt
+			if err := ix.index.Close(); err != nil {
+				log.Errorf("Failed to close search index: %v", err)
+			}
+			return
+		case ref := <-ix.queue:
+			mb, err := ix.ds.MailboxFor(ref.Mailbox)
+			if err != nil {
+				log.Errorf("Failed to get mailbox for %q: %v", ref.Mailbox, err)
+				continue
+			}
+			msg, err := mb.GetMessage(ref.ID)
+			if err == smtpd.ErrNotExist {
+				// Deleted before it could be indexed
+				continue
+			}
+			if err != nil {
+				log.Errorf("Failed to get message %v/%v: %v", ref.Mailbox, ref.ID, err)
+				continue
+			}
+			ix.add(ref, msg)
+		}
+	}
+}
+
+// indexAll indexes every message in the datastore, returning false if it could not finish
+func (ix *Indexer) indexAll(ctx context.Context) bool {
+	log.Infof("Building search index")
+	mailboxes, err := ix.ds.AllMailboxes()
+	if err != nil {
+		log.Errorf("Failed to list mailboxes for search index: %v", err)
+		return false
+	}
+	complete := true
+	for _, mb := range mailboxes {
+		if mb.Name() == "" {
+			// Stored before mailbox names were persisted, it cannot be searched
+			log.Warnf("Search index skipping unnamed mailbox %v", mb)
+			continue
+		}
+		messages, err := mb.GetMessages()
+		if err != nil {
+			log.Errorf("Failed to get messages for %v: %v", mb, err)
+			complete = false
+			continue
+		}
+		for _, msg := range messages {
+			select {
+			case <-ctx.Done():
+				return false
+			default:
+			}
+			ix.add(Ref{Mailbox: mb.Name(), ID: msg.ID()}, msg)
+		}
+	}
+	log.Infof("Search index contains %v messages", ix.index.Len())
+	return complete
+}
+
+// add indexes a single message
+func (ix *Indexer) add(ref Ref, msg smtpd.Message) {
+	text, err := MessageText(msg)
+	if err != nil {
+		log.Errorf("Failed to read %v for search index: %v", msg, err)
+		return
+	}
+	if err := ix.index.Add(ref, text); err != nil {
+		log.Errorf("Failed to add %v to search index: %v", msg, err)
+	}
+}
+
+// MessageText returns the searchable text of a message: its subject, from and to addresses,
+// body text, HTML body with its tags stripped, and the names and content of any text
+// attachments
+func MessageText(msg smtpd.Message) (string, error) {
+	body, err := msg.ReadBody()
+	if err != nil {
+		return "", err
+	}
+	parts := []string{msg.Subject(), msg.From(), strings.Join(msg.To(), " "), body.Text,
+		sanitize.HTMLToText(body.HTML)}
+	for _, a := range body.Attachments {
+		parts = append(parts, a.FileName)
+		if strings.HasPrefix(strings.ToLower(a.ContentType), "text/") {
+			parts = append(parts, string(a.Content))
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
@@ -0,0 +1,108 @@
+package search
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/jhillyerd/inbucket/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingStore holds up AllMailboxes until release is closed, keeping a rebuild running
+type blockingStore struct {
+	smtpd.DataStore
+	release chan struct{}
+}
+
+func (s *blockingStore) AllMailboxes() ([]smtpd.Mailbox, error) {
+	<-s.release
+	return s.DataStore.AllMailboxes()
+}
+
+func TestIndexerRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := smtpd.NewFileDataStore(config.DataStoreConfig{Path: dir})
+	storeTestMessage(t, ds, "fred", "Stored before the index")
+
+	// An index whose build was interrupted is built again
+	path := filepath.Join(dir, "search.index")
+	index, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, index.Add(Ref{Mailbox: "fred", ID: "0001"}, "partial"))
+	assert.Nil(t, index.Close())
+	index, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, index.IsNew())
+	assert.False(t, index.Built())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := msghub.New(ctx, 10)
+	store := &blockingStore{DataStore: ds, release: make(chan struct{})}
+	NewIndexer(ctx, index, store, hub)
+
+	// Deliveries are indexed while the build is running
+	id := storeTestMessage(t, ds, "fred", "Delivered during the build")
+	hub.Dispatch(msghub.Message{Mailbox: "fred", ID: id})
+	waitFor(t, "the delivery to be indexed", func() bool {
+		return len(index.Search("during")) == 1
+	})
+	assert.False(t, index.Built())
+
+	close(store.release)
+	waitFor(t, "the build to complete", index.Built)
+	assert.Len(t, index.Search("before"), 1)
+
+	// The completed build is recorded
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	assert.True(t, reopened.Built())
+	assert.Len(t, reopened.Search("before"), 1)
+}
+
+// storeTestMessage stores a message with subject in the named mailbox, returning its ID
+func storeTestMessage(t *testing.T, ds smtpd.DataStore, name, subject string) string {
+	mb, err := ds.MailboxFor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mb.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := "From: sender@example.com\r\nSubject: " + subject + "\r\n\r\n" + subject + "\r\n"
+	if err := msg.Append([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return msg.ID()
+}
+
+// waitFor polls cond until it returns true, failing the test if it takes too long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i == 500 {
+			t.Fatalf("Timeout waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,216 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// errAuthCanceled indicates the client aborted the AUTH exchange with "*"
+	errAuthCanceled = errors.New("Authentication canceled by client")
+
+	// errAuthSyntax indicates the client sent a response we could not decode
+	errAuthSyntax = errors.New("Malformed authentication response")
+
+	// errAuthInvalid indicates the client sent credentials that did not match
+	errAuthInvalid = errors.New("Invalid credentials")
+)
+
+// authMechanisms lists the SASL mechanisms we advertise, in order of preference
+var authMechanisms = []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+
+// authHandler processes the AUTH command, arg contains the mechanism followed by an optional
+// initial response
+func (ss *Session) authHandler(arg string) {
+	if !ss.server.authEnabled {
+		ss.send("502 AUTH command not enabled")
+		ss.logWarn("AUTH requested, but it is not enabled")
+		return
+	}
+	if ss.authUser != "" {
+		ss.send("503 Already authenticated")
+		ss.logWarn("AUTH requested on an authenticated session")
+		return
+	}
+	mech, initial := arg, ""
+	if idx := strings.IndexByte(arg, ' '); idx >= 0 {
+		mech, initial = arg[:idx], strings.TrimSpace(arg[idx+1:])
+	}
+	if mech == "" {
+		ss.send("501 AUTH requires a mechanism")
+		ss.logWarn("AUTH without mechanism")
+		return
+	}
+
+	var user string
+	var err error
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		user, err = ss.authPlain(initial)
+	case "LOGIN":
+		user, err = ss.authLogin(initial)
+	case "CRAM-MD5":
+		user, err = ss.authCRAMMD5(initial)
+	default:
+		ss.send("504 Unrecognized authentication mechanism")
+		ss.logWarn("Unsupported AUTH mechanism: %q", mech)
+		return
+	}
+
+	switch err {
+	case nil:
+		ss.authUser = user
+		ss.authMech = strings.ToUpper(mech)
+		ss.send("235 Authentication successful")
+		ss.logInfo("Authenticated as %q using %v", user, strings.ToUpper(mech))
+	case errAuthCanceled:
+		ss.send("501 Authentication canceled")
+		ss.logWarn("Client canceled AUTH %v", strings.ToUpper(mech))
+	case errAuthSyntax:
+		ss.send("501 Malformed authentication response")
+		ss.logWarn("Garbled AUTH %v response", strings.ToUpper(mech))
+	case errAuthInvalid:
+		ss.send("535 Authentication credentials invalid")
+		ss.logWarn("AUTH %v failed for %q", strings.ToUpper(mech), user)
+	default:
+		// Network error while reading response
+		ss.logWarn("Error during AUTH: %v", err)
+		ss.enterState(QUIT)
+	}
+}
+
+// authPlain implements the RFC 4616 PLAIN mechanism
+func (ss *Session) authPlain(initial string) (user string, err error) {
+	var resp []byte
+	if initial == "" {
+		resp, err = ss.authChallenge("")
+	} else {
+		resp, err = decodeAuthResponse(initial)
+	}
+	if err != nil {
+		return "", err
+	}
+	// authzid NUL authcid NUL passwd
+	parts := bytes.Split(resp, []byte{0})
+	if len(parts) != 3 {
+		return "", errAuthSyntax
+	}
+	user = string(parts[1])
+	if !ss.server.checkCredentials(user, string(parts[2])) {
+		return user, errAuthInvalid
+	}
+	return user, nil
+}
+
+// authLogin implements the non-standard, but widely used, LOGIN mechanism
+func (ss *Session) authLogin(initial string) (user string, err error) {
+	var resp []byte
+	if initial == "" {
+		resp, err = ss.authChallenge("Username:")
+	} else {
+		resp, err = decodeAuthResponse(initial)
+	}
+	if err != nil {
+		return "", err
+	}
+	user = string(resp)
+	pass, err := ss.authChallenge("Password:")
+	if err != nil {
+		return user, err
+	}
+	if !ss.server.checkCredentials(user, string(pass)) {
+		return user, errAuthInvalid
+	}
+	return user, nil
+}
+
+// authCRAMMD5 implements the RFC 2195 CRAM-MD5 challenge/response mechanism
+func (ss *Session) authCRAMMD5(initial string) (user string, err error) {
+	if initial != "" {
+		// CRAM-MD5 does not permit an initial response
+		return "", errAuthSyntax
+	}
+	challenge := fmt.Sprintf("<%v.%v@%v>", os.Getpid(), time.Now().UnixNano(), ss.server.domain)
+	resp, err := ss.authChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	// Response is: username SP hex-digest
+	idx := bytes.LastIndexByte(resp, ' ')
+	if idx < 1 {
+		return "", errAuthSyntax
+	}
+	user = string(resp[:idx])
+	digest, err := hex.DecodeString(string(resp[idx+1:]))
+	if err != nil {
+		return user, errAuthSyntax
+	}
+	if len(ss.server.authCredentials) == 0 {
+		// Accept any credentials
+		return user, nil
+	}
+	secret, ok := ss.server.authCredentials[user]
+	if !ok {
+		return user, errAuthInvalid
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	_, _ = mac.Write([]byte(challenge))
+	if !hmac.Equal(mac.Sum(nil), digest) {
+		return user, errAuthInvalid
+	}
+	return user, nil
+}
+
+// authChallenge sends a base64 encoded challenge to the client and returns its decoded
+// response
+func (ss *Session) authChallenge(challenge string) ([]byte, error) {
+	ss.send("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+	if ss.sendError != nil {
+		return nil, ss.sendError
+	}
+	line, err := ss.readLine()
+	if err != nil {
+		return nil, err
+	}
+	ss.transcript.Client("[credentials]")
+	return decodeAuthResponse(strings.TrimRight(line, "\r\n"))
+}
+
+// decodeAuthResponse decodes a base64 client response, mapping "*" to errAuthCanceled
+func decodeAuthResponse(resp string) ([]byte, error) {
+	resp = strings.TrimSpace(resp)
+	if resp == "*" {
+		return nil, errAuthCanceled
+	}
+	if resp == "=" {
+		// Empty initial response
+		return []byte{}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return nil, errAuthSyntax
+	}
+	return data, nil
+}
+
+// checkCredentials compares the supplied credentials with those configured.  If no
+// credentials are configured, any username and password will be accepted.
+func (s *Server) checkCredentials(user, pass string) bool {
+	if len(s.authCredentials) == 0 {
+		return true
+	}
+	expected, ok := s.authCredentials[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(pass)) == 1
+}
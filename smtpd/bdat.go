@@ -0,0 +1,473 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/mailauth"
+)
+
+// messageWriter accumulates the data for a mail transaction, regardless of whether it
+// arrived via DATA or BDAT, and delivers it to each recipient once complete.  When no
+// enabled feature needs the complete message, the data is instead streamed straight to each
+// recipient's mailbox as it arrives, so large messages are never held in memory.
+type messageWriter struct {
+	ss         *Session
+	recipients []recipientDetails
+	relayTo    []string         // Recipients to be relayed upstream rather than stored
+	msgBuf     [][]byte         // Buffered message data, unused when streaming
+	streams    []*messageStream // One per recipient, nil unless streaming
+	size       int
+	header     headerCounter // Size and fields of the message header
+}
+
+// headerCounter measures the message header as the data arrives, up to the blank line
+// that separates it from the body
+type headerCounter struct {
+	bytes    int
+	fields   int
+	received int    // Received fields, to detect mail loops
+	name     []byte // Name of the current field, until its colon
+	inName   bool
+	lineLen  int  // Bytes in the current line, excluding line endings
+	done     bool // End of header reached
+}
+
+// messageStream is a recipient's message, written to as the message data arrives
+type messageStream struct {
+	r   recipientDetails
+	msg Message // nil once closed or discarded
+	err error   // First failure creating or writing the message
+}
+
+// newMessageWriter opens the mailbox for each recipient of the current transaction, and
+// collects the recipients to be relayed upstream.  On failure the client has been sent an error, the session reset, and nil is returned.
+func (ss *Session) newMessageWriter() *messageWriter {
+	mw := &messageWriter{
+		ss:         ss,
+		recipients: make([]recipientDetails, 0, ss.recipients.Len()),
+		msgBuf:     make([][]byte, 0, 1024),
+	}
+	// Get a Mailbox for each recipient
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		recip := e.Value.(string)
+		target := ss.server.rewriteAddress(recip)
+		if target != recip {
+			ss.logInfo("Rewrote recipient %q to %q", recip, target)
+		}
+		local, domain, err := ParseEmailAddress(target)
+		if err != nil {
+			ss.logError("Failed to parse address for %q", target)
+			ss.send(fmt.Sprintf("451 Failed to open mailbox for %v", recip))
+			ss.reset()
+			return nil
+		}
+		if ss.server.relay.relays(domain) {
+			ss.logTrace("Relaying message for %q", recip)
+			mw.relayTo = append(mw.relayTo, target)
+		} else if !ss.server.storeMessages {
+			// Load test mode, nothing is stored
+		} else if ss.server.bounceRule(recip) != nil {
+			ss.logTrace("Bouncing message for %q", recip)
+		} else if ss.server.dsnEnabled && ss.server.dsnFailed(domain) {
+			ss.logTrace("Simulating delivery failure for %q", recip)
+		} else if normalizeDomain(domain) != ss.server.domainNoStore {
+			// Not our "no store" domain, so store the message
+			mb, err := ss.server.dataStore.MailboxFor(MailboxAddress(local, domain))
+			if err != nil {
+				ss.logError("Failed to open mailbox for %q: %s", target, err)
+				ss.send(fmt.Sprintf("451 Failed to open mailbox for %v", local))
+				ss.reset()
+				return nil
+			}
+			mw.recipients = append(mw.recipients, recipientDetails{recip, local, domain, mb})
+		} else {
+			ss.logTrace("Not storing message for %q", recip)
+		}
+	}
+	if mw.streamable() {
+		mw.openStreams()
+	}
+	return mw
+}
+
+// streamable returns true if the message data may be written to the recipients' mailboxes
+// as it arrives.  Scripts, content rules, DKIM, duplicate suppression, deferred delivery,
+// DSNs, relaying and adding missing headers all need the complete message, so it must be
+// buffered for them.
+func (mw *messageWriter) streamable() bool {
+	s := mw.ss.server
+	return s.storeMessages && s.script == nil && len(s.headerRules) == 0 && !s.dkimEnabled &&
+		s.duplicates == nil && s.queue == nil && !s.dsnEnabled && len(s.bounceRules) == 0 &&
+		len(mw.relayTo) == 0 && !s.addHeaders
+}
+
+// openStreams creates each recipient's message and writes its trace headers.  Failures are
+// reported to the client when the message data is complete.
+func (mw *messageWriter) openStreams() {
+	ss := mw.ss
+	mw.streams = make([]*messageStream, 0, len(mw.recipients))
+	for _, r := range mw.recipients {
+		st := &messageStream{r: r}
+		mw.streams = append(mw.streams, st)
+		st.msg, st.err = r.mailbox.NewMessage()
+		if st.err != nil {
+			ss.logError("Failed to create message for %q: %s", r.localPart, st.err)
+			continue
+		}
+		recd := ss.authResultsHeader() + ss.receivedHeader(r.address, time.Now())
+		if st.err = st.msg.Append([]byte(recd)); st.err != nil {
+			ss.logError("Failed to write received header for %q: %s", r.localPart, st.err)
+		}
+	}
+}
+
+// write appends a copy of data to the message
+func (mw *messageWriter) write(data []byte) {
+	mw.size += len(data)
+	mw.header.count(data)
+	if mw.streams == nil {
+		mw.msgBuf = append(mw.msgBuf, append([]byte{}, data...))
+		return
+	}
+	for _, st := range mw.streams {
+		if st.err != nil {
+			continue
+		}
+		if st.err = st.msg.Append(data); st.err != nil {
+			mw.ss.logError("Failed to append to mailbox %v: %v", st.r.mailbox, st.err)
+		}
+	}
+}
+
+// count adds the header bytes and fields in data, which may end mid-line
+func (hc *headerCounter) count(data []byte) {
+	for _, c := range data {
+		if hc.done {
+			return
+		}
+		hc.bytes++
+		switch c {
+		case '\n':
+			if hc.lineLen == 0 {
+				hc.done = true
+			}
+			hc.lineLen = 0
+			hc.inName = false
+		case '\r':
+		default:
+			if hc.lineLen == 0 && c != ' ' && c != '\t' {
+				// Not a continuation line, so a new field
+				hc.fields++
+				hc.name = hc.name[:0]
+				hc.inName = true
+			}
+			if hc.inName {
+				if c == ':' {
+					hc.inName = false
+					if strings.EqualFold(strings.TrimSpace(string(hc.name)), "Received") {
+						hc.received++
+					}
+				} else if len(hc.name) < 16 {
+					hc.name = append(hc.name, c)
+				}
+			}
+			hc.lineLen++
+		}
+	}
+}
+
+// headerLimit returns the reply refusing a message header that exceeds the server's limits
+// or has passed through too many hosts, or an empty string if it does not
+func (mw *messageWriter) headerLimit() string {
+	s := mw.ss.server
+	if s.maxHeaderBytes > 0 && mw.header.bytes > s.maxHeaderBytes {
+		return "552 Maximum header size exceeded"
+	}
+	if s.maxHeaderCount > 0 && mw.header.fields > s.maxHeaderCount {
+		return "552 Too many header fields"
+	}
+	if s.maxReceived > 0 && mw.header.received > s.maxReceived {
+		return "554 Mail loop detected"
+	}
+	return ""
+}
+
+// Write implements io.Writer, so that BDAT chunks may be copied straight into the message
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	mw.write(p)
+	return len(p), nil
+}
+
+// discard throws away the message data received so far, and removes any messages that were
+// being streamed from their mailboxes
+func (mw *messageWriter) discard() {
+	mw.msgBuf = nil
+	for _, st := range mw.streams {
+		if st.msg == nil {
+			continue
+		}
+		msg := st.msg
+		st.msg = nil
+		// The message must be closed before it can be deleted
+		err := msg.Close()
+		if err == nil {
+			err = msg.Delete()
+		}
+		if err != nil {
+			mw.ss.logWarn("Failed to discard incomplete message for %q: %v", st.r.localPart,
+				err)
+		}
+	}
+}
+
+// closeStream completes the message streamed to a recipient and announces its arrival,
+// returning false if it could not be stored
+func (mw *messageWriter) closeStream(st *messageStream) bool {
+	if st.err != nil {
+		// Left for discard to clean up
+		return false
+	}
+	msg := st.msg
+	st.msg = nil
+	msg.SetDelivery(mw.ss.newDelivery(st.r, mw.ss.from))
+	if err := msg.Close(); err != nil {
+		mw.ss.logError("Error while closing message for %v: %v", st.r.mailbox, err)
+		return false
+	}
+	mw.ss.server.broadcast(st.r.mailbox, msg)
+	return true
+}
+
+// finish delivers the message to all recipients, replies to the client and resets the
+// session
+func (mw *messageWriter) finish() {
+	ss := mw.ss
+	// Clean up any messages that were streamed but not delivered
+	defer mw.discard()
+	if ss.server.script != nil {
+		reply, data := ss.runScript("on_data", string(bytes.Join(mw.msgBuf, nil)))
+		if reply != "" {
+			ss.sendDataReply(reply)
+			ss.reset()
+			return
+		}
+		if data != nil {
+			mw.msgBuf = [][]byte{data}
+			mw.size = len(data)
+		}
+	}
+	if rule := ss.server.headerRule(bytes.Join(mw.msgBuf, nil)); rule != nil {
+		ss.logInfo("Refusing message matching content rule %q", rule.Name)
+		ss.sendDataReply("554 " + rule.Message)
+		ss.reset()
+		return
+	}
+	failed := make(map[string]string)
+	if ss.server.storeMessages {
+		raw := bytes.Join(mw.msgBuf, nil)
+		ss.authenticate(raw)
+		msgID := ""
+		if ss.server.duplicates != nil {
+			msgID = messageID(raw)
+		}
+		stored := mw.msgBuf
+		if ss.server.addHeaders {
+			var added string
+			added, ss.addedHeaders = ss.missingHeaders(raw, time.Now())
+			if added != "" {
+				ss.logTrace("Adding missing %v", strings.Join(ss.addedHeaders, " and "))
+				stored = append([][]byte{[]byte(added)}, mw.msgBuf...)
+			}
+		}
+		// Create a message for each valid recipient, or complete those already streamed
+		for i, r := range mw.recipients {
+			if msgID != "" && ss.server.duplicates.duplicate(r.mailbox.Name(), msgID) {
+				ss.logInfo("Not storing duplicate message %v for %q", msgID, r.localPart)
+				continue
+			}
+			var ok bool
+			if mw.streams != nil {
+				ok = mw.closeStream(mw.streams[i])
+			} else {
+				ok = ss.deliverMessage(r, ss.from, stored)
+			}
+			if ok {
+				expReceivedTotal.Add(1)
+			} else {
+				// Delivery failure
+				reply := fmt.Sprintf("451 Failed to store message for %v", r.localPart)
+				if !ss.lmtp {
+					ss.send(reply)
+					ss.reset()
+					return
+				}
+				failed[r.address] = reply
+			}
+		}
+		ss.sendDSN(mw.msgBuf)
+	} else {
+		expReceivedTotal.Add(1)
+	}
+	if len(mw.relayTo) > 0 {
+		ss.relayMessage(mw.relayTo, mw.msgBuf)
+	}
+	if ss.lmtp {
+		// LMTP reports the outcome for each recipient, in RCPT order
+		for e := ss.recipients.Front(); e != nil; e = e.Next() {
+			recip := e.Value.(string)
+			if reply, ok := failed[recip]; ok {
+				ss.send(reply)
+			} else {
+				ss.send(fmt.Sprintf("250 Mail accepted for delivery to <%v>", recip))
+			}
+		}
+	} else {
+		ss.send("250 Mail accepted for delivery")
+	}
+	ss.logInfo("Message size %v bytes", mw.size)
+	ss.reset()
+}
+
+// authenticate performs the DKIM and DMARC checks enabled for the message, SPF was checked
+// when the sender was given
+func (ss *Session) authenticate(raw []byte) {
+	if ss.server.dkimEnabled {
+		ss.dkim = mailauth.VerifyDKIM(ss.server.resolver, raw)
+		ss.dkimChecked = true
+		for _, r := range ss.dkim {
+			ss.logInfo("DKIM result for d=%v s=%v: %v %v", r.Domain, r.Selector, r.Result,
+				r.Reason)
+		}
+	}
+	if ss.server.dmarcEnabled {
+		_, spfDomain, _ := ParseEmailAddress(ss.from)
+		ss.dmarc = mailauth.CheckDMARC(ss.server.resolver, mailauth.HeaderFromDomain(raw),
+			ss.spf, spfDomain, ss.dkim)
+		ss.logInfo("DMARC result for %v: %v (p=%v)", ss.dmarc.Domain, ss.dmarc.Result,
+			ss.dmarc.Policy)
+	}
+}
+
+// bdatHandler processes an RFC 3030 BDAT chunk.  The chunk data must always be consumed
+// from the connection, even if the command is going to be rejected.
+func (ss *Session) bdatHandler(arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) < 1 || len(fields) > 2 {
+		ss.send("501 Was expecting BDAT arg syntax of <size> [LAST]")
+		ss.logWarn("Bad BDAT argument: %q", arg)
+		return
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		ss.send("501 Unable to parse BDAT chunk size")
+		ss.logWarn("Bad BDAT chunk size: %q", fields[0])
+		return
+	}
+	last := false
+	if len(fields) == 2 {
+		if strings.ToUpper(fields[1]) != "LAST" {
+			ss.send("501 Was expecting BDAT arg syntax of <size> [LAST]")
+			ss.logWarn("Bad BDAT argument: %q", arg)
+			return
+		}
+		last = true
+	}
+
+	// Determine if we will accept this chunk before reading it
+	if ss.state != MAIL || ss.recipients.Len() == 0 {
+		if err := ss.discardChunk(size); err == nil {
+			ss.ooSeq("BDAT")
+		}
+		return
+	}
+	total := size
+	if ss.chunkWriter != nil {
+		total += int64(ss.chunkWriter.size)
+	}
+	if total > int64(ss.maxBytes) {
+		if err := ss.discardChunk(size); err != nil {
+			return
+		}
+		if last {
+			ss.sendDataReply("552 Maximum message size exceeded")
+		} else {
+			ss.send("552 Maximum message size exceeded")
+		}
+		ss.logWarn("Max message size exceeded while in BDAT")
+		ss.reset()
+		return
+	}
+
+	if ss.chunkWriter == nil {
+		if ss.chunkWriter = ss.newMessageWriter(); ss.chunkWriter == nil {
+			// Client has already been notified, but the chunk must still be consumed
+			_ = ss.discardChunk(size)
+			return
+		}
+	}
+	if err := ss.readChunk(ss.chunkWriter, size); err != nil {
+		ss.chunkWriter.discard()
+		return
+	}
+	if reply := ss.chunkWriter.headerLimit(); reply != "" {
+		if last {
+			ss.sendDataReply(reply)
+		} else {
+			ss.send(reply)
+		}
+		ss.logWarn("Refused message header while in BDAT: %v", reply)
+		ss.reset()
+		return
+	}
+	if last {
+		ss.chunkWriter.finish()
+		return
+	}
+	ss.send(fmt.Sprintf("250 %v octets received", size))
+}
+
+// readChunk copies size bytes of BDAT data from the client to w
+func (ss *Session) readChunk(w io.Writer, size int64) error {
+	if err := ss.prepareRead(ss.server.dataTimeout); err != nil {
+		ss.chunkError(err)
+		return err
+	}
+	if _, err := io.CopyN(w, ss.reader, size); err != nil {
+		ss.chunkError(err)
+		return err
+	}
+	ss.logTrace("Received BDAT chunk of %v bytes", size)
+	return nil
+}
+
+// discardChunk reads and throws away size bytes of BDAT data
+func (ss *Session) discardChunk(size int64) error {
+	if err := ss.prepareRead(ss.server.dataTimeout); err != nil {
+		ss.chunkError(err)
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, ss.reader, size); err != nil {
+		ss.chunkError(err)
+		return err
+	}
+	ss.logTrace("Discarded BDAT chunk of %v bytes", size)
+	return nil
+}
+
+// chunkError handles a failure while reading BDAT data, the session cannot continue
+func (ss *Session) chunkError(err error) {
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			ss.sendTimeout()
+		}
+	}
+	ss.logWarn("Error: %v while reading BDAT", err)
+	ss.enterState(QUIT)
+}
@@ -0,0 +1,113 @@
+package smtpd
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// chaosCommands lists the commands that faults may be injected into
+var chaosCommands = map[string]bool{
+	"HELO": true,
+	"EHLO": true,
+	"LHLO": true,
+	"MAIL": true,
+	"RCPT": true,
+	"DATA": true,
+}
+
+// faultInjector randomly disrupts SMTP sessions, to exercise client retry and timeout
+// handling.  A nil faultInjector never injects faults.
+type faultInjector struct {
+	cfg  config.ChaosConfig
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newFaultInjector creates a faultInjector, returns nil if chaos mode is disabled
+func newFaultInjector(cfg config.ChaosConfig) *faultInjector {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &faultInjector{
+		cfg:  cfg,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// roll returns true with the specified percentage chance
+func (f *faultInjector) roll(percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Intn(100) < percent
+}
+
+// targets returns true if faults may be injected into the command.  When a recipient pattern
+// is configured, only RCPT commands for matching recipients and DATA commands for
+// transactions including one are affected.
+func (f *faultInjector) targets(ss *Session, cmd, arg string) bool {
+	if !chaosCommands[cmd] {
+		return false
+	}
+	if f.cfg.Recipients == nil {
+		return true
+	}
+	switch cmd {
+	case "RCPT":
+		start, end := strings.IndexByte(arg, '<'), strings.IndexByte(arg, '>')
+		return start >= 0 && end > start && f.cfg.Recipients.MatchString(arg[start+1:end])
+	case "DATA":
+		if ss.recipients == nil {
+			return false
+		}
+		for e := ss.recipients.Front(); e != nil; e = e.Next() {
+			if f.cfg.Recipients.MatchString(e.Value.(string)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// injectFault may delay the reply to cmd, drop the connection, or reply with a temporary
+// failure.  Returns true if the command was consumed and should not be processed further.
+func (ss *Session) injectFault(cmd, arg string) bool {
+	f := ss.server.faults
+	if f == nil || !f.targets(ss, cmd, arg) {
+		return false
+	}
+	if f.roll(f.cfg.DelayPercent) {
+		// Replies to earlier pipelined commands should not be held up
+		ss.flush()
+		ss.logInfo("Chaos: delaying %v by %v ms", cmd, f.cfg.DelayMillis)
+		time.Sleep(time.Duration(f.cfg.DelayMillis) * time.Millisecond)
+	}
+	if f.roll(f.cfg.DisconnectPercent) {
+		ss.logInfo("Chaos: dropping connection on %v", cmd)
+		ss.enterState(QUIT)
+		return true
+	}
+	if f.roll(f.cfg.TempFailPercent) {
+		ss.logInfo("Chaos: temporary failure on %v", cmd)
+		switch cmd {
+		case "HELO", "EHLO", "LHLO":
+			ss.send(fmt.Sprintf("421 %v Simulated temporary failure, closing connection",
+				ss.server.domain))
+			ss.enterState(QUIT)
+		default:
+			ss.send("451 Simulated temporary failure, try again later")
+		}
+		return true
+	}
+	return false
+}
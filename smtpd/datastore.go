@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/jhillyerd/enmime"
+	"github.com/jhillyerd/inbucket/mailauth"
 )
 
 var (
@@ -29,6 +30,7 @@ type Mailbox interface {
 	GetMessage(id string) (Message, error)
 	Purge() error
 	NewMessage() (Message, error)
+	CopyMessage(msg Message) (Message, error)
 	Name() string
 	String() string
 }
@@ -36,6 +38,8 @@ type Mailbox interface {
 // Message is an interface for a single message in a Mailbox
 type Message interface {
 	ID() string
+	UIDL() string
+	IMAPUID() uint32
 	From() string
 	To() []string
 	Date() time.Time
@@ -49,4 +53,62 @@ type Message interface {
 	Delete() error
 	String() string
 	Size() int64
+	Delivery() Delivery
+	SetDelivery(d Delivery)
+	Flags() []string
+	SetFlags(flags []string) error
+}
+
+// Flags a Message may carry, named after the IMAP system flags of RFC 3501
+const (
+	FlagSeen    = `\Seen`
+	FlagFlagged = `\Flagged`
+)
+
+// HasFlag returns true if msg carries flag
+func HasFlag(msg Message, flag string) bool {
+	for _, f := range msg.Flags() {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// WithFlag returns flags with flag added if set is true, or removed if it is false
+func WithFlag(flags []string, flag string, set bool) []string {
+	result := make([]string, 0, len(flags)+1)
+	for _, f := range flags {
+		if f != flag {
+			result = append(result, f)
+		}
+	}
+	if set {
+		result = append(result, flag)
+	}
+	return result
+}
+
+// Delivery contains details about the SMTP transaction that delivered a Message
+type Delivery struct {
+	MailFrom      string                // Reverse-path given with MAIL, empty for bounces
+	MailParams    string                // ESMTP parameters given with MAIL
+	Recipients    []string              // Every RCPT TO address of the transaction
+	RcptParams    map[string]string     // ESMTP parameters given with RCPT, by address
+	AuthUser      string                // Identity the client authenticated as, empty if none
+	AuthMechanism string                // SASL mechanism used to authenticate
+	RemoteAddr    string                // IP address of the client, as reported by XCLIENT if used
+	Helo          string                // Domain given by the client in HELO/EHLO
+	SessionID     int                   // Number of the SMTP session, as in the Received header
+	Protocol      string                // RFC 3848 protocol name, such as ESMTPSA
+	TLSVersion    string                // TLS protocol version, empty without STARTTLS
+	TLSCipher     string                // TLS cipher suite, empty without STARTTLS
+	Label         string                // Sub-address label of the recipient, if preserved
+	SPF           string                // SPF result for the sender, empty if not checked
+	DKIM          []mailauth.DKIMResult // One result per signature verified
+	DMARC         string                // DMARC verdict, empty if not checked
+	DMARCPolicy   string                // Policy requested by the From domain
+	ClientCert    string                // Subject of the verified TLS client certificate
+	Transcript    string                // SMTP commands and replies, if recorded
+	AddedHeaders  []string              // Header fields added because the message lacked them
 }
@@ -0,0 +1,95 @@
+package smtpd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// deliveryQueue holds messages whose delivery has been deferred, so that they appear in
+// their mailbox some time after being accepted.  A nil deliveryQueue defers nothing.
+type deliveryQueue struct {
+	mu      sync.Mutex
+	delay   time.Duration // Applies to recipients not matching a rule
+	rules   []config.DelayRule
+	pending map[*pendingDelivery]*time.Timer
+	flushed bool           // Shutting down, deliver immediately
+	wg      sync.WaitGroup // Tracks deliveries that have not completed
+}
+
+// pendingDelivery is a deferred delivery waiting for its timer
+type pendingDelivery struct {
+	deliver func()
+}
+
+// newDeliveryQueue creates a deliveryQueue, returns nil if no delivery is ever deferred
+func newDeliveryQueue(seconds int, rules []config.DelayRule) *deliveryQueue {
+	if seconds <= 0 && len(rules) == 0 {
+		return nil
+	}
+	return &deliveryQueue{
+		delay:   time.Duration(seconds) * time.Second,
+		rules:   rules,
+		pending: make(map[*pendingDelivery]*time.Timer),
+	}
+}
+
+// delayFor returns how long delivery to the recipient address should be deferred
+func (q *deliveryQueue) delayFor(address string) time.Duration {
+	if q == nil {
+		return 0
+	}
+	for _, rule := range q.rules {
+		if rule.Pattern.MatchString(address) {
+			return time.Duration(rule.Seconds) * time.Second
+		}
+	}
+	return q.delay
+}
+
+// schedule calls deliver once delay has elapsed, or immediately if the queue has been
+// flushed
+func (q *deliveryQueue) schedule(delay time.Duration, deliver func()) {
+	p := &pendingDelivery{deliver: deliver}
+	q.mu.Lock()
+	if q.flushed {
+		q.mu.Unlock()
+		deliver()
+		return
+	}
+	q.wg.Add(1)
+	q.pending[p] = time.AfterFunc(delay, func() { q.run(p) })
+	q.mu.Unlock()
+}
+
+// run performs a deferred delivery when its timer fires, unless flush got to it first
+func (q *deliveryQueue) run(p *pendingDelivery) {
+	q.mu.Lock()
+	_, ok := q.pending[p]
+	delete(q.pending, p)
+	q.mu.Unlock()
+	if ok {
+		p.deliver()
+		q.wg.Done()
+	}
+}
+
+// flush performs all pending deliveries immediately, and blocks until they have completed.
+// Deliveries scheduled afterwards are not deferred.
+func (q *deliveryQueue) flush() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.flushed = true
+	pending := q.pending
+	q.pending = make(map[*pendingDelivery]*time.Timer)
+	q.mu.Unlock()
+	for p, timer := range pending {
+		timer.Stop()
+		p.deliver()
+		q.wg.Done()
+	}
+	q.wg.Wait()
+}
@@ -0,0 +1,56 @@
+package smtpd
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeliveryQueue(t *testing.T) {
+	assert.Nil(t, newDeliveryQueue(0, nil), "Expected nil queue without delays")
+
+	var q *deliveryQueue
+	assert.Equal(t, time.Duration(0), q.delayFor("a@host"))
+	q.flush()
+}
+
+func TestDeliveryQueueDelayFor(t *testing.T) {
+	q := newDeliveryQueue(5, []config.DelayRule{
+		{Name: "slow", Pattern: regexp.MustCompile("(?i)^slow@"), Seconds: 30},
+		{Name: "fast", Pattern: regexp.MustCompile("(?i)^fast@"), Seconds: 0},
+	})
+	assert.Equal(t, 30*time.Second, q.delayFor("SLOW@host"))
+	assert.Equal(t, time.Duration(0), q.delayFor("fast@host"))
+	assert.Equal(t, 5*time.Second, q.delayFor("other@host"))
+}
+
+func TestDeliveryQueueSchedule(t *testing.T) {
+	q := newDeliveryQueue(1, nil)
+	var mu sync.Mutex
+	delivered := make([]string, 0)
+	deliver := func(name string) func() {
+		return func() {
+			mu.Lock()
+			delivered = append(delivered, name)
+			mu.Unlock()
+		}
+	}
+
+	q.schedule(10*time.Millisecond, deliver("soon"))
+	q.schedule(time.Hour, deliver("later"))
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"soon"}, delivered)
+	mu.Unlock()
+
+	// Flush delivers whatever is still waiting, then no longer defers
+	q.flush()
+	assert.Equal(t, []string{"soon", "later"}, delivered)
+	q.schedule(time.Hour, deliver("now"))
+	assert.Equal(t, []string{"soon", "later", "now"}, delivered)
+	assert.Empty(t, q.pending)
+}
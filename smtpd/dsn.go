@@ -0,0 +1,248 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dsnRequest holds the RFC 3461 parameters supplied for the current transaction
+type dsnRequest struct {
+	ret    string            // FULL or HDRS, from MAIL
+	envID  string            // ENVID from MAIL
+	notify map[string]string // NOTIFY by recipient address, from RCPT
+	orcpt  map[string]string // ORCPT by recipient address, from RCPT
+}
+
+// dsnStatus describes the simulated outcome of delivery to a single recipient
+type dsnStatus struct {
+	recipient string
+	failed    bool
+	code      int    // Reply code of a bounce rule, 0 for a simulated failure
+	text      string // Reply text of a bounce rule
+}
+
+// parseNotify validates and normalizes an RCPT NOTIFY parameter value
+func parseNotify(value string) (string, bool) {
+	value = strings.ToUpper(value)
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(value, ",") {
+		switch v {
+		case "SUCCESS", "FAILURE", "DELAY":
+		case "NEVER":
+			if value != "NEVER" {
+				// NEVER cannot be combined with other values
+				return "", false
+			}
+		default:
+			return "", false
+		}
+		if seen[v] {
+			return "", false
+		}
+		seen[v] = true
+	}
+	return value, true
+}
+
+// notifyOn returns true if the recipient asked to be notified of the specified event.  In
+// the absence of a NOTIFY parameter, only failures are reported.
+func (d dsnRequest) notifyOn(recipient, event string) bool {
+	notify, ok := d.notify[recipient]
+	if !ok {
+		return event == "FAILURE"
+	}
+	for _, v := range strings.Split(notify, ",") {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// dsnFailed returns true if delivery to the recipient domain should simulate a failure
+func (s *Server) dsnFailed(domain string) bool {
+	return s.dsnFailureDomain != "" && normalizeDomain(domain) == s.dsnFailureDomain
+}
+
+// sendDSN delivers a delivery status notification into the sender's mailbox for each
+// recipient that requested one, and for each recipient matching a bounce rule.  Errors are
+// logged, they do not affect the transaction.
+func (ss *Session) sendDSN(msgBuf [][]byte) {
+	if ss.recipients == nil || !ss.server.dsnEnabled && len(ss.server.bounceRules) == 0 {
+		return
+	}
+	statuses := make([]dsnStatus, 0, ss.recipients.Len())
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		recip := e.Value.(string)
+		_, domain, err := ParseEmailAddress(recip)
+		if err != nil {
+			continue
+		}
+		st := dsnStatus{recipient: recip}
+		if rule := ss.server.bounceRule(recip); rule != nil {
+			st.failed, st.code, st.text = true, rule.Code, rule.Message
+		} else if ss.server.dsnEnabled {
+			st.failed = ss.server.dsnFailed(domain)
+		} else {
+			continue
+		}
+		event := "SUCCESS"
+		if st.failed {
+			event = "FAILURE"
+		}
+		if ss.dsn.notifyOn(recip, event) {
+			statuses = append(statuses, st)
+		}
+	}
+	if len(statuses) == 0 {
+		return
+	}
+	if ss.from == "" {
+		// Never reply to a bounce
+		ss.logTrace("Not sending DSN for message from null sender")
+		return
+	}
+
+	local, domain, err := ParseEmailAddress(ss.from)
+	if err != nil {
+		ss.logWarn("Unable to send DSN to %q: %v", ss.from, err)
+		return
+	}
+	mb, err := ss.server.dataStore.MailboxFor(MailboxAddress(local, domain))
+	if err != nil {
+		ss.logError("Failed to open mailbox for DSN to %q: %s", ss.from, err)
+		return
+	}
+	dsn := buildDSN(ss.server.domain, ss.from, ss.dsn, statuses, bytes.Join(msgBuf, nil),
+		time.Now())
+	if ss.deliverMessage(recipientDetails{ss.from, local, domain, mb}, "", dsn) {
+		ss.logInfo("Sent DSN for %v recipient(s) to %v", len(statuses), ss.from)
+	}
+}
+
+// buildDSN generates an RFC 3464 multipart/report message describing the outcome of
+// delivery to each recipient.  raw is the original message, which is returned in full or
+// as headers only depending on the RET parameter.
+func buildDSN(mtaDomain, from string, req dsnRequest, statuses []dsnStatus, raw []byte,
+	now time.Time) [][]byte {
+	summary := "Success"
+	for _, st := range statuses {
+		if st.failed {
+			summary = "Failure"
+			break
+		}
+	}
+	boundary := fmt.Sprintf("inbucket-dsn-%x", now.UnixNano())
+	date := now.Format(time.RFC1123Z)
+
+	b := new(bytes.Buffer)
+	line := func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(b, format+"\r\n", args...)
+	}
+	line("From: Mail Delivery System <MAILER-DAEMON@%s>", mtaDomain)
+	line("To: <%s>", from)
+	line("Subject: Delivery Status Notification (%s)", summary)
+	line("Date: %s", date)
+	line("Auto-Submitted: auto-replied")
+	line("MIME-Version: 1.0")
+	line("Content-Type: multipart/report; report-type=delivery-status;")
+	line("  boundary=\"%s\"", boundary)
+	line("")
+	line("--%s", boundary)
+	line("Content-Type: text/plain; charset=us-ascii")
+	line("")
+	line("This is a simulated delivery status notification generated by Inbucket.")
+	line("")
+	for _, st := range statuses {
+		if st.failed {
+			line("Delivery to <%s> failed permanently.", st.recipient)
+		} else {
+			line("Delivery to <%s> succeeded.", st.recipient)
+		}
+	}
+	line("")
+	line("--%s", boundary)
+	line("Content-Type: message/delivery-status")
+	line("")
+	line("Reporting-MTA: dns; %s", mtaDomain)
+	if req.envID != "" {
+		line("Original-Envelope-Id: %s", req.envID)
+	}
+	line("Arrival-Date: %s", date)
+	for _, st := range statuses {
+		line("")
+		if orcpt := req.orcpt[st.recipient]; orcpt != "" {
+			line("Original-Recipient: %s", orcpt)
+		}
+		line("Final-Recipient: rfc822; %s", st.recipient)
+		if st.failed && st.code != 0 {
+			line("Action: failed")
+			line("Status: %s", enhancedStatus(st.code, st.text))
+			line("Diagnostic-Code: smtp; %v %s", st.code, st.text)
+		} else if st.failed {
+			line("Action: failed")
+			line("Status: 5.1.1")
+			line("Diagnostic-Code: smtp; 550 5.1.1 Simulated delivery failure")
+		} else {
+			line("Action: delivered")
+			line("Status: 2.0.0")
+		}
+	}
+	line("")
+	line("--%s", boundary)
+	if req.ret == "FULL" {
+		line("Content-Type: message/rfc822")
+		line("")
+		_, _ = b.Write(raw)
+	} else {
+		line("Content-Type: text/rfc822-headers")
+		line("")
+		_, _ = b.Write(messageHeaders(raw))
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		line("")
+	}
+	line("--%s--", boundary)
+
+	// deliverMessage expects the message split into lines
+	lines := bytes.SplitAfter(b.Bytes(), []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// messageHeaders returns the header section of a raw message, including the trailing
+// blank line if present
+func messageHeaders(raw []byte) []byte {
+	if idx := bytes.Index(raw, []byte("\r\n\r\n")); idx >= 0 {
+		return raw[:idx+4]
+	}
+	if idx := bytes.Index(raw, []byte("\n\n")); idx >= 0 {
+		return raw[:idx+2]
+	}
+	return raw
+}
+
+// enhancedStatus returns the RFC 3463 status code at the start of text, or a generic status
+// for the class of the reply code if there is none
+func enhancedStatus(code int, text string) string {
+	if fields := strings.Fields(text); len(fields) > 0 {
+		parts := strings.Split(fields[0], ".")
+		if len(parts) == 3 && parts[0] == strconv.Itoa(code/100) {
+			valid := true
+			for _, p := range parts[1:] {
+				if _, err := strconv.Atoi(p); err != nil {
+					valid = false
+				}
+			}
+			if valid {
+				return fields[0]
+			}
+		}
+	}
+	return fmt.Sprintf("%v.0.0", code/100)
+}
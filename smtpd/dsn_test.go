@@ -0,0 +1,104 @@
+package smtpd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNotify(t *testing.T) {
+	var testTable = []struct {
+		input, expect string
+		ok            bool
+	}{
+		{"NEVER", "NEVER", true},
+		{"success", "SUCCESS", true},
+		{"SUCCESS,FAILURE,DELAY", "SUCCESS,FAILURE,DELAY", true},
+		{"", "", false},
+		{"NEVER,SUCCESS", "", false},
+		{"SUCCESS,SUCCESS", "", false},
+		{"BOUNCE", "", false},
+	}
+
+	for _, tt := range testTable {
+		got, ok := parseNotify(tt.input)
+		if ok != tt.ok || got != tt.expect {
+			t.Errorf("parseNotify(%q) got (%q, %v), expected (%q, %v)",
+				tt.input, got, ok, tt.expect, tt.ok)
+		}
+	}
+}
+
+func TestNotifyOn(t *testing.T) {
+	req := dsnRequest{notify: map[string]string{
+		"a@host": "SUCCESS,DELAY",
+		"b@host": "NEVER",
+	}}
+	assert.True(t, req.notifyOn("a@host", "SUCCESS"))
+	assert.False(t, req.notifyOn("a@host", "FAILURE"))
+	assert.False(t, req.notifyOn("b@host", "FAILURE"))
+	assert.True(t, req.notifyOn("c@host", "FAILURE"), "Failures reported by default")
+	assert.False(t, req.notifyOn("c@host", "SUCCESS"), "Success not reported by default")
+}
+
+func TestBuildDSN(t *testing.T) {
+	raw := []byte("Subject: original\r\nFrom: james@host\r\n\r\nsecret body\r\n")
+	statuses := []dsnStatus{
+		{recipient: "good@host"},
+		{recipient: "bad@bounce.local", failed: true},
+	}
+	req := dsnRequest{
+		envID: "QQ314159",
+		orcpt: map[string]string{"bad@bounce.local": "rfc822;alias@bounce.local"},
+	}
+
+	dsn := string(bytes.Join(
+		buildDSN("inbucket.local", "james@host", req, statuses, raw, time.Now()), nil))
+	assert.Contains(t, dsn, "Subject: Delivery Status Notification (Failure)\r\n")
+	assert.Contains(t, dsn, "Original-Envelope-Id: QQ314159\r\n")
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; good@host\r\nAction: delivered\r\n")
+	assert.Contains(t, dsn, "Original-Recipient: rfc822;alias@bounce.local\r\n"+
+		"Final-Recipient: rfc822; bad@bounce.local\r\nAction: failed\r\n")
+	assert.Contains(t, dsn, "Content-Type: text/rfc822-headers\r\n")
+	assert.Contains(t, dsn, "Subject: original\r\n")
+	assert.NotContains(t, dsn, "secret body", "RET=HDRS is the default")
+
+	req.ret = "FULL"
+	dsn = string(bytes.Join(
+		buildDSN("inbucket.local", "james@host", req, statuses[:1], raw, time.Now()), nil))
+	assert.Contains(t, dsn, "Subject: Delivery Status Notification (Success)\r\n")
+	assert.Contains(t, dsn, "Content-Type: message/rfc822\r\n")
+	assert.Contains(t, dsn, "secret body\r\n")
+
+	// Bounce rules supply the status and diagnostic
+	statuses = []dsnStatus{
+		{recipient: "gone@host", failed: true, code: 550, text: "5.1.1 User unknown"},
+	}
+	dsn = string(bytes.Join(
+		buildDSN("inbucket.local", "james@host", req, statuses, raw, time.Now()), nil))
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; gone@host\r\nAction: failed\r\n"+
+		"Status: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 User unknown\r\n")
+}
+
+func TestEnhancedStatus(t *testing.T) {
+	var testTable = []struct {
+		code         int
+		text, expect string
+	}{
+		{550, "5.1.1 User unknown", "5.1.1"},
+		{552, "5.2.2 Mailbox full", "5.2.2"},
+		{550, "User unknown", "5.0.0"},
+		{550, "4.2.2 Wrong class", "5.0.0"},
+		{554, "5.x.1 Not numeric", "5.0.0"},
+		{554, "", "5.0.0"},
+	}
+
+	for _, tt := range testTable {
+		if got := enhancedStatus(tt.code, tt.text); got != tt.expect {
+			t.Errorf("enhancedStatus(%v, %q) got %q, expected %q",
+				tt.code, tt.text, got, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// duplicateFilter remembers the Message-IDs recently delivered to each mailbox, so that
+// retried messages are not stored twice.  A nil duplicateFilter remembers nothing.
+type duplicateFilter struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time // Delivery time keyed by mailbox and Message-ID
+	lastSweep time.Time
+	now       func() time.Time // Replaceable for tests
+}
+
+// newDuplicateFilter creates a duplicateFilter that remembers Message-IDs for the specified
+// number of minutes.  Returns nil if minutes is not positive.
+func newDuplicateFilter(minutes int) *duplicateFilter {
+	if minutes <= 0 {
+		return nil
+	}
+	return &duplicateFilter{
+		window: time.Duration(minutes) * time.Minute,
+		seen:   make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// duplicate records the delivery of messageID to mailbox, returning true if it was already
+// delivered there within the window
+func (f *duplicateFilter) duplicate(mailbox, messageID string) bool {
+	if f == nil || messageID == "" {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	f.sweep(now)
+	key := mailbox + "\x00" + messageID
+	if last, ok := f.seen[key]; ok && now.Sub(last) < f.window {
+		return true
+	}
+	f.seen[key] = now
+	return false
+}
+
+// sweep discards Message-IDs older than the window.  Must be called with the lock held.
+func (f *duplicateFilter) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < time.Minute {
+		return
+	}
+	f.lastSweep = now
+	for key, last := range f.seen {
+		if now.Sub(last) >= f.window {
+			delete(f.seen, key)
+		}
+	}
+}
+
+// messageID returns the Message-ID header of raw, or an empty string if it has none
+func messageID(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(msg.Header.Get("Message-ID"))
+}
@@ -0,0 +1,84 @@
+package smtpd
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDuplicateFilter(t *testing.T) {
+	var nilFilter *duplicateFilter
+	assert.False(t, nilFilter.duplicate("u1", "<1@example.com>"), "nil filter allows everything")
+	assert.Nil(t, newDuplicateFilter(0), "Zero window should disable filter")
+
+	clock := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := newDuplicateFilter(10)
+	f.now = func() time.Time { return clock }
+
+	assert.False(t, f.duplicate("u1", "<1@example.com>"), "First delivery")
+	assert.True(t, f.duplicate("u1", "<1@example.com>"), "Repeat delivery")
+	assert.False(t, f.duplicate("u2", "<1@example.com>"), "Other mailboxes are unaffected")
+	assert.False(t, f.duplicate("u1", ""), "Messages without an ID are never duplicates")
+
+	// Message-IDs are forgotten after the window
+	clock = clock.Add(9 * time.Minute)
+	assert.True(t, f.duplicate("u1", "<1@example.com>"), "Within window")
+	clock = clock.Add(10 * time.Minute)
+	assert.False(t, f.duplicate("u1", "<1@example.com>"), "Window has passed")
+	assert.Len(t, f.seen, 1, "Expired entry for u2 should have been swept")
+}
+
+func TestMessageID(t *testing.T) {
+	assert.Equal(t, "<1@example.com>",
+		messageID([]byte("Subject: hi\r\nMessage-Id:  <1@example.com>\r\n\r\nHi\r\n")))
+	assert.Equal(t, "", messageID([]byte("Subject: hi\r\n\r\nHi\r\n")))
+}
+
+// Test a retried message is only stored once
+func TestDuplicateSession(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.DuplicateMinutes = 10
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	transaction := []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Message-ID: <1@example.com>\r\n\r\nHi\r\n.", 250},
+	}
+	script := []scriptStep{{"HELO localhost", 250}}
+	script = append(script, transaction...)
+	script = append(script, transaction...)
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	mb1.AssertNumberOfCalls(t, "NewMessage", 1)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -2,12 +2,16 @@ package smtpd
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/jhillyerd/enmime"
@@ -19,12 +23,17 @@ import (
 type FileMessage struct {
 	mailbox *FileMailbox
 	// Stored in GOB
-	Fid      string
-	Fdate    time.Time
-	Ffrom    string
-	Fto      []string
-	Fsubject string
-	Fsize    int64
+	Fid       string
+	Fmailbox  string // Empty for messages stored before mailbox names were persisted
+	Fuidl     string // Empty for messages stored before UIDLs were persisted
+	Fimapuid  uint32 // Zero for messages stored before IMAP UIDs were persisted
+	Fdate     time.Time
+	Ffrom     string
+	Fto       []string
+	Fsubject  string
+	Fsize     int64
+	Fdelivery Delivery
+	Fflags    []string // IMAP style flags, such as \Seen
 	// These are for creating new messages only
 	writable   bool
 	writerFile *os.File
@@ -41,7 +50,56 @@ func (mb *FileMailbox) NewMessage() (Message, error) {
 		}
 	}
 
-	// Delete old messages over messageCap
+	mb.enforceMessageCap()
+	date := time.Now()
+	id := generateID(date)
+	var last uint32
+	if n := len(mb.messages); n > 0 {
+		last = mb.messages[n-1].IMAPUID()
+	}
+	return &FileMessage{mailbox: mb, Fid: id, Fmailbox: mb.name, Fuidl: generateUIDL(),
+		Fimapuid: generateIMAPUID(date, last), Fdate: date, writable: true}, nil
+}
+
+// CopyMessage adds a copy of msg, which may be in another mailbox of the same datastore, to
+// this mailbox.  The raw source is linked rather than rewritten, and the copy keeps the date,
+// delivery details and flags of msg under a new ID.
+func (mb *FileMailbox) CopyMessage(msg Message) (Message, error) {
+	src, ok := msg.(*FileMessage)
+	if !ok {
+		return nil, fmt.Errorf("Cannot copy %v from another kind of datastore", msg)
+	}
+	// Refresh the index before adding to it
+	if err := mb.readIndex(); err != nil {
+		return nil, err
+	}
+	mb.enforceMessageCap()
+	if err := mb.createDir(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var last uint32
+	if n := len(mb.messages); n > 0 {
+		last = mb.messages[n-1].IMAPUID()
+	}
+	m := &FileMessage{mailbox: mb, Fid: generateID(now), Fmailbox: mb.name,
+		Fuidl: generateUIDL(), Fimapuid: generateIMAPUID(now, last), Fdate: src.Fdate,
+		Ffrom: src.Ffrom, Fto: src.Fto, Fsubject: src.Fsubject, Fsize: src.Fsize,
+		Fdelivery: src.Fdelivery, Fflags: append([]string(nil), src.Fflags...)}
+	if err := linkOrCopy(src.rawPath(), m.rawPath()); err != nil {
+		return nil, err
+	}
+	mb.messages = append(mb.messages, m)
+	if err := mb.writeIndex(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// enforceMessageCap deletes the oldest messages until there is room for one more under
+// messageCap, if configured.  The index must be loaded.
+func (mb *FileMailbox) enforceMessageCap() {
 	if mb.store.messageCap > 0 {
 		for len(mb.messages) >= mb.store.messageCap {
 			log.Infof("Mailbox %q over configured message cap", mb.name)
@@ -50,10 +108,75 @@ func (mb *FileMailbox) NewMessage() (Message, error) {
 			}
 		}
 	}
+}
 
-	date := time.Now()
-	id := generateID(date)
-	return &FileMessage{mailbox: mb, Fid: id, Fdate: date, writable: true}, nil
+// linkOrCopy hard links the file src to dst, falling back to copying it where links are not
+// supported.  Deleting either file leaves the other intact.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// imapUIDEpoch is the origin of IMAP UIDs, which count the seconds elapsed since
+var imapUIDEpoch = time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// lastIMAPUID is the most recent IMAP UID generated by this process, it keeps UIDs from being
+// reused when the latest message of a mailbox is deleted and another arrives in the same second
+var lastIMAPUID struct {
+	sync.Mutex
+	uid uint32
+}
+
+// imapUIDFor returns the IMAP UID corresponding to date
+func imapUIDFor(date time.Time) uint32 {
+	if date.Before(imapUIDEpoch) {
+		return 1
+	}
+	return uint32(date.Sub(imapUIDEpoch)/time.Second) + 1
+}
+
+// generateIMAPUID returns an IMAP UID for a message delivered at date, greater than last, the
+// UID of the newest message in its mailbox
+func generateIMAPUID(date time.Time, last uint32) uint32 {
+	lastIMAPUID.Lock()
+	defer lastIMAPUID.Unlock()
+	uid := imapUIDFor(date)
+	if uid <= lastIMAPUID.uid {
+		uid = lastIMAPUID.uid + 1
+	}
+	if uid <= last {
+		uid = last + 1
+	}
+	lastIMAPUID.uid = uid
+	return uid
+}
+
+// generateUIDL returns a random unique-id for POP3 UIDL, which is stored in the index so
+// that it never changes
+func generateUIDL() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("Failed to generate UIDL, using message ID: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
 }
 
 // ID gets the ID of the Message
@@ -61,6 +184,24 @@ func (m *FileMessage) ID() string {
 	return m.Fid
 }
 
+// UIDL returns the POP3 unique-id of the Message, which persists across restarts
+func (m *FileMessage) UIDL() string {
+	if m.Fuidl == "" {
+		// The ID is also stored in the index, so is equally stable
+		return m.Fid
+	}
+	return m.Fuidl
+}
+
+// IMAPUID returns the IMAP unique identifier of the Message, which persists across restarts
+// and increases with each message delivered to a mailbox
+func (m *FileMessage) IMAPUID() uint32 {
+	if m.Fimapuid == 0 {
+		return imapUIDFor(m.Fdate)
+	}
+	return m.Fimapuid
+}
+
 // Date returns the date/time this Message was received by Inbucket
 func (m *FileMessage) Date() time.Time {
 	return m.Fdate
@@ -91,6 +232,51 @@ func (m *FileMessage) Size() int64 {
 	return m.Fsize
 }
 
+// Delivery returns details about how this Message was delivered
+func (m *FileMessage) Delivery() Delivery {
+	return m.Fdelivery
+}
+
+// SetDelivery records details about how this Message was delivered, it must be called
+// prior to Close()
+func (m *FileMessage) SetDelivery(d Delivery) {
+	m.Fdelivery = d
+}
+
+// Flags returns the flags set on this Message
+func (m *FileMessage) Flags() []string {
+	return m.Fflags
+}
+
+// SetFlags replaces the flags of this Message and saves them to the index
+func (m *FileMessage) SetFlags(flags []string) error {
+	mb := m.mailbox
+	// Keep the Message objects held by callers, readIndex() replaces them
+	held := make(map[string]*FileMessage, len(mb.messages))
+	for _, mm := range mb.messages {
+		held[mm.Fid] = mm
+	}
+	if err := mb.readIndex(); err != nil {
+		return err
+	}
+	found := false
+	for i, mm := range mb.messages {
+		if mm.Fid == m.Fid {
+			m.Fflags = flags
+			mb.messages[i] = m
+			found = true
+		} else if h := held[mm.Fid]; h != nil {
+			// Pick up flag changes made by other sessions
+			h.Fflags = mm.Fflags
+			mb.messages[i] = h
+		}
+	}
+	if !found {
+		return ErrNotExist
+	}
+	return mb.writeIndex()
+}
+
 func (m *FileMessage) rawPath() string {
 	return filepath.Join(m.mailbox.path, m.Fid+".raw")
 }
@@ -207,28 +393,37 @@ func (m *FileMessage) Close() error {
 		}
 	}
 
-	// Fetch headers
-	body, err := m.ReadBody()
+	// Fetch headers, the body may be large and is not read
+	header, err := m.ReadHeader()
 	if err != nil {
 		return err
 	}
+	dec := new(mime.WordDecoder)
+	decode := func(name string) string {
+		value := header.Header.Get(name)
+		if decoded, err := dec.DecodeHeader(value); err == nil {
+			return decoded
+		}
+		// Leave undecodable values as they are
+		return value
+	}
 
 	// Only public fields are stored in gob, hence starting with capital F
 	// Parse From address
-	if address, err := mail.ParseAddress(body.GetHeader("From")); err == nil {
+	if address, err := mail.ParseAddress(header.Header.Get("From")); err == nil {
 		m.Ffrom = address.String()
 	} else {
-		m.Ffrom = body.GetHeader("From")
+		m.Ffrom = decode("From")
 	}
-	m.Fsubject = body.GetHeader("Subject")
+	m.Fsubject = decode("Subject")
 
 	// Turn the To header into a slice
-	if addresses, err := body.AddressList("To"); err == nil {
+	if addresses, err := header.Header.AddressList("To"); err == nil {
 		for _, a := range addresses {
 			m.Fto = append(m.Fto, a.String())
 		}
 	} else {
-		m.Fto = []string{body.GetHeader("To")}
+		m.Fto = []string{decode("To")}
 	}
 
 	// Refresh the index before adding our message
@@ -247,7 +442,7 @@ func (m *FileMessage) Close() error {
 func (m *FileMessage) Delete() error {
 	messages := m.mailbox.messages
 	for i, mm := range messages {
-		if m == mm {
+		if m.Fid == mm.Fid {
 			// Slice around message we are deleting
 			m.mailbox.messages = append(messages[:i], messages[i+1:]...)
 			break
@@ -256,6 +451,7 @@ func (m *FileMessage) Delete() error {
 	if err := m.mailbox.writeIndex(); err != nil {
 		return err
 	}
+	notifyDelete(m.mailbox.Name(), m.Fid)
 
 	if len(m.mailbox.messages) == 0 {
 		// This was the last message, thus writeIndex() has removed the entire
@@ -34,6 +34,23 @@ var (
 	countChannel = make(chan int, 10)
 )
 
+// deleteHooks are called with the mailbox name and ID of each message deleted from a
+// FileMailbox
+var deleteHooks []func(mailbox, id string)
+
+// AddDeleteHook registers a function to be called after a message has been deleted from the
+// file datastore, including by Purge.  It should be called before any servers are started.
+func AddDeleteHook(hook func(mailbox, id string)) {
+	deleteHooks = append(deleteHooks, hook)
+}
+
+// notifyDelete calls the delete hooks
+func notifyDelete(mailbox, id string) {
+	for _, hook := range deleteHooks {
+		hook(mailbox, id)
+	}
+}
+
 func init() {
 	// Start generator
 	go countGenerator(countChannel)
@@ -149,7 +166,14 @@ type FileMailbox struct {
 	messages    []*FileMessage
 }
 
+// Name returns the name of the mailbox.  Mailboxes listed by AllMailboxes learn their name
+// from their index, which is loaded if necessary.
 func (mb *FileMailbox) Name() string {
+	if mb.name == "" && !mb.indexLoaded {
+		if err := mb.readIndex(); err != nil {
+			log.Errorf("Failed to read index for %v: %v", mb.path, err)
+		}
+	}
 	return mb.name
 }
 
@@ -192,8 +216,24 @@ func (mb *FileMailbox) GetMessage(id string) (Message, error) {
 
 // Purge deletes all messages in this mailbox
 func (mb *FileMailbox) Purge() error {
+	if !mb.indexLoaded {
+		// The index lists the messages being purged, but a corrupt one must not prevent purging
+		if err := mb.readIndex(); err != nil {
+			log.Errorf("Failed to read index for %v: %v", mb, err)
+		}
+	}
+	purged := make([]string, len(mb.messages))
+	for i, m := range mb.messages {
+		purged[i] = m.Fid
+	}
 	mb.messages = mb.messages[:0]
-	return mb.writeIndex()
+	if err := mb.writeIndex(); err != nil {
+		return err
+	}
+	for _, id := range purged {
+		notifyDelete(mb.Name(), id)
+	}
+	return nil
 }
 
 // readIndex loads the mailbox index data from disk
@@ -232,6 +272,9 @@ func (mb *FileMailbox) readIndex() error {
 			return fmt.Errorf("Corrupt mailbox %q: %v", mb.indexPath, err)
 		}
 		msg.mailbox = mb
+		if mb.name == "" {
+			mb.name = msg.Fmailbox
+		}
 		mb.messages = append(mb.messages, msg)
 	}
 
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
@@ -250,6 +251,60 @@ func TestFSDelete(t *testing.T) {
 	}
 }
 
+// Test the delete hook and names of mailboxes listed by AllMailboxes
+func TestFSDeleteHook(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+	var deleted []string
+	AddDeleteHook(func(mailbox, id string) {
+		deleted = append(deleted, mailbox+"/"+id)
+	})
+	defer func() { deleteHooks = nil }()
+
+	mbName := "fred"
+	var ids []string
+	for _, subj := range []string{"alpha", "bravo", "charlie"} {
+		id, _ := deliverMessage(ds, mbName, subj, time.Now())
+		ids = append(ids, id)
+	}
+
+	mailboxes, err := ds.AllMailboxes()
+	if err != nil {
+		t.Fatalf("Failed to AllMailboxes(): %v", err)
+	}
+	if assert.Equal(t, 1, len(mailboxes)) {
+		assert.Equal(t, mbName, mailboxes[0].Name())
+	}
+
+	// Delete a message
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msg, err := mb.GetMessage(ids[1])
+	if err != nil {
+		t.Fatalf("Failed to GetMessage(%q): %v", ids[1], err)
+	}
+	assert.Nil(t, msg.Delete())
+	assert.Equal(t, []string{mbName + "/" + ids[1]}, deleted)
+
+	// Purge the remaining messages through a mailbox listed without its name
+	deleted = nil
+	mailboxes, err = ds.AllMailboxes()
+	if err != nil {
+		t.Fatalf("Failed to AllMailboxes(): %v", err)
+	}
+	assert.Nil(t, mailboxes[0].Purge())
+	assert.Equal(t, []string{mbName + "/" + ids[0], mbName + "/" + ids[2]}, deleted)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
 // Test purging a mailbox
 func TestFSPurge(t *testing.T) {
 	ds, logbuf := setupDataStore(config.DataStoreConfig{})
@@ -336,6 +391,289 @@ func TestFSSize(t *testing.T) {
 	}
 }
 
+// Test that closing a large message reads only its header, not the body
+func TestFSLargeMessage(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mb, err := ds.MailboxFor("fred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mb.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "From: =?UTF-8?Q?J=C3=B6rg?= <jorg@example.com>\r\n" +
+		"To: fred@example.com, barney@example.com\r\n" +
+		"Subject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"\r\n"
+	if err := msg.Append([]byte(header)); err != nil {
+		t.Fatal(err)
+	}
+	const bodySize = 16 * 1024 * 1024
+	line := bytes.Repeat([]byte("x"), 998)
+	line = append(line, "\r\n"...)
+	for written := 0; written < bodySize; written += len(line) {
+		if err := msg.Append(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Parsing or buffering the body would allocate at least its size
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := msg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > bodySize/8 {
+		t.Errorf("Close allocated %v bytes for a %v byte body", alloc, bodySize)
+	}
+
+	assert.Equal(t, "Grüße", msg.Subject())
+	assert.Equal(t, "=?utf-8?q?J=C3=B6rg?= <jorg@example.com>", msg.From())
+	assert.Equal(t, []string{"<fred@example.com>", "<barney@example.com>"}, msg.To())
+	assert.True(t, msg.Size() > bodySize, "Expected size over %v, got %v", bodySize,
+		msg.Size())
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test UIDLs are unique and survive reloading the datastore
+func TestFSUIDL(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	uidls := make(map[string]string)
+	for _, subj := range []string{"a", "b", "c"} {
+		id, _ := deliverMessage(ds, mbName, subj, time.Now())
+		mb, err := ds.MailboxFor(mbName)
+		if err != nil {
+			t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+		}
+		msg, err := mb.GetMessage(id)
+		if err != nil {
+			t.Fatalf("Failed to GetMessage(%q): %v", id, err)
+		}
+		uidls[id] = msg.UIDL()
+	}
+	seen := make(map[string]bool)
+	for _, uidl := range uidls {
+		assert.NotEmpty(t, uidl)
+		assert.False(t, seen[uidl], "UIDL %q is not unique", uidl)
+		seen[uidl] = true
+	}
+
+	// A new datastore reads the index from disk, as after a restart
+	reloaded := NewFileDataStore(config.DataStoreConfig{Path: ds.path})
+	mb, err := reloaded.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	assert.Equal(t, len(uidls), len(msgs))
+	for _, msg := range msgs {
+		assert.Equal(t, uidls[msg.ID()], msg.UIDL(), "UIDL of %v changed", msg.ID())
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test IMAP UIDs increase, are not reused and persist in the index
+func TestFSIMAPUID(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	for _, subj := range []string{"a", "b", "c"} {
+		deliverMessage(ds, mbName, subj, time.Now())
+	}
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	// Remove the newest message, its UID must not be handed out again
+	deleted := msgs[len(msgs)-1].IMAPUID()
+	if err := msgs[len(msgs)-1].Delete(); err != nil {
+		t.Fatalf("Failed to Delete: %v", err)
+	}
+	deliverMessage(ds, mbName, "d", time.Now())
+
+	mb, err = ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, err = mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	uids := make(map[string]uint32)
+	var prev uint32
+	for _, msg := range msgs {
+		uid := msg.IMAPUID()
+		assert.True(t, uid > prev, "UID %v of %v does not increase", uid, msg.ID())
+		prev = uid
+		uids[msg.ID()] = uid
+	}
+	assert.True(t, prev > deleted, "UID %v of deleted message was reused", deleted)
+
+	// A new datastore reads the index from disk, as after a restart
+	reloaded := NewFileDataStore(config.DataStoreConfig{Path: ds.path})
+	mb, err = reloaded.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, err = mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	assert.Equal(t, len(uids), len(msgs))
+	for _, msg := range msgs {
+		assert.Equal(t, uids[msg.ID()], msg.IMAPUID(), "UID of %v changed", msg.ID())
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test flags persist, and setting them leaves sibling messages deletable
+func TestFSFlags(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	for _, subj := range []string{"a", "b", "c"} {
+		deliverMessage(ds, mbName, subj, time.Now())
+	}
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	assert.Empty(t, msgs[0].Flags())
+	if err := msgs[0].SetFlags([]string{FlagSeen, FlagFlagged}); err != nil {
+		t.Fatalf("Failed to SetFlags: %v", err)
+	}
+	if err := msgs[1].SetFlags([]string{FlagSeen}); err != nil {
+		t.Fatalf("Failed to SetFlags: %v", err)
+	}
+	if err := msgs[2].Delete(); err != nil {
+		t.Fatalf("Failed to Delete: %v", err)
+	}
+
+	// A new datastore reads the index from disk, as after a restart
+	reloaded := NewFileDataStore(config.DataStoreConfig{Path: ds.path})
+	mb, err = reloaded.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, err = mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	if assert.Equal(t, 2, len(msgs)) {
+		assert.Equal(t, []string{FlagSeen, FlagFlagged}, msgs[0].Flags())
+		assert.True(t, HasFlag(msgs[1], FlagSeen))
+		assert.False(t, HasFlag(msgs[1], FlagFlagged))
+	}
+	assert.Equal(t, []string{FlagSeen}, WithFlag([]string{FlagFlagged, FlagSeen}, FlagFlagged, false))
+	assert.Equal(t, []string{FlagSeen, FlagFlagged}, WithFlag([]string{FlagSeen}, FlagFlagged, true))
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test copies keep the message details, and outlive the original
+func TestFSCopy(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	date := time.Date(2017, 11, 21, 10, 0, 0, 0, time.UTC)
+	id, size := deliverMessage(ds, "fred", "hello", date)
+	src, err := ds.MailboxFor("fred")
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", "fred", err)
+	}
+	msg, err := src.GetMessage(id)
+	if err != nil {
+		t.Fatalf("Failed to GetMessage(%q): %v", id, err)
+	}
+	if err := msg.SetFlags([]string{FlagFlagged}); err != nil {
+		t.Fatalf("Failed to SetFlags: %v", err)
+	}
+	dest, err := ds.MailboxFor("wilma")
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", "wilma", err)
+	}
+	copied, err := dest.CopyMessage(msg)
+	if err != nil {
+		t.Fatalf("Failed to CopyMessage: %v", err)
+	}
+	assert.NotEqual(t, id, copied.ID())
+	if err := msg.Delete(); err != nil {
+		t.Fatalf("Failed to Delete: %v", err)
+	}
+
+	// A new datastore reads the index from disk, as after a restart
+	reloaded := NewFileDataStore(config.DataStoreConfig{Path: ds.path})
+	dest, err = reloaded.MailboxFor("wilma")
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", "wilma", err)
+	}
+	msgs, err := dest.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", "wilma", err)
+	}
+	if assert.Equal(t, 1, len(msgs)) {
+		assert.Equal(t, copied.ID(), msgs[0].ID())
+		assert.Equal(t, "hello", msgs[0].Subject())
+		assert.Equal(t, size, msgs[0].Size())
+		assert.True(t, msgs[0].Date().Equal(date))
+		assert.Equal(t, []string{FlagFlagged}, msgs[0].Flags())
+		raw, err := msgs[0].ReadRaw()
+		if assert.NoError(t, err) {
+			assert.Contains(t, *raw, "Subject: hello")
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
 // Test missing files
 func TestFSMissing(t *testing.T) {
 	ds, logbuf := setupDataStore(config.DataStoreConfig{})
@@ -2,8 +2,8 @@ package smtpd
 
 import (
 	"bufio"
-	"bytes"
 	"container/list"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/mailauth"
 	"github.com/jhillyerd/inbucket/msghub"
 )
 
@@ -51,21 +52,26 @@ func (s State) String() string {
 }
 
 var commands = map[string]bool{
-	"HELO": true,
-	"EHLO": true,
-	"MAIL": true,
-	"RCPT": true,
-	"DATA": true,
-	"RSET": true,
-	"SEND": true,
-	"SOML": true,
-	"SAML": true,
-	"VRFY": true,
-	"EXPN": true,
-	"HELP": true,
-	"NOOP": true,
-	"QUIT": true,
-	"TURN": true,
+	"HELO":     true,
+	"EHLO":     true,
+	"MAIL":     true,
+	"RCPT":     true,
+	"DATA":     true,
+	"RSET":     true,
+	"SEND":     true,
+	"SOML":     true,
+	"SAML":     true,
+	"VRFY":     true,
+	"EXPN":     true,
+	"HELP":     true,
+	"NOOP":     true,
+	"QUIT":     true,
+	"TURN":     true,
+	"STARTTLS": true,
+	"AUTH":     true,
+	"BDAT":     true,
+	"LHLO":     true,
+	"XCLIENT":  true,
 }
 
 // recipientDetails for message delivery
@@ -74,25 +80,68 @@ type recipientDetails struct {
 	mailbox                        Mailbox
 }
 
+// lenientPathRegex matches a MAIL or RCPT argument with common syntax violations: spaces
+// around the colon or within the angle brackets, or the brackets missing entirely
+var lenientPathRegex = regexp.MustCompile(
+	`(?i)^(FROM|TO)\s*:\s*(?:<\s*([^<>]*?)\s*>|([^\s<>]+))((?:\s+[\w-]+(?:=\S+)?)*)\s*$`)
+
+// esmtpParamsRegex matches the ESMTP parameters that may follow an address
+var esmtpParamsRegex = regexp.MustCompile(`^(?: [\w-]+(?:=\S+)?)+$`)
+
+// valuelessParams lists the ESMTP parameters that are not followed by =value
+var valuelessParams = map[string]bool{
+	"SMTPUTF8": true,
+}
+
 // Session holds the state of an SMTP session
 type Session struct {
-	server       *Server
-	id           int
-	conn         net.Conn
-	remoteDomain string
-	remoteHost   string
-	sendError    error
-	state        State
-	reader       *bufio.Reader
-	from         string
-	recipients   *list.List
+	server         *Server
+	id             int
+	conn           net.Conn
+	remoteDomain   string
+	remoteHost     string
+	sendError      error
+	state          State
+	reader         *bufio.Reader
+	writer         *bufio.Writer // Replies are buffered to support PIPELINING
+	from           string
+	recipients     *list.List
+	tlsState       *tls.ConnectionState  // nil until STARTTLS completes
+	authUser       string                // Identity from SMTP AUTH, empty if none
+	authMech       string                // SASL mechanism used to authenticate
+	smtpUTF8       bool                  // Current transaction requested SMTPUTF8
+	binaryMIME     bool                  // Current transaction declared BODY=BINARYMIME
+	chunkWriter    *messageWriter        // Non-nil while receiving BDAT chunks
+	declaredSize   int                   // SIZE parameter from MAIL, 0 if not provided
+	maxBytes       int                   // Size limit for the current transaction's recipients
+	dsn            dsnRequest            // DSN parameters for the current transaction
+	lmtp           bool                  // Speaking LMTP (RFC 2033) rather than SMTP
+	xclientTrusted bool                  // Client may use XCLIENT
+	xclientHelo    string                // HELO from XCLIENT, overrides the client's own
+	extended       bool                  // Client greeted with EHLO or LHLO rather than HELO
+	spf            mailauth.SPFResult    // SPF result for the current sender, empty if unchecked
+	dkim           []mailauth.DKIMResult // DKIM results for the current message
+	dkimChecked    bool                  // DKIM verification was performed
+	dmarc          mailauth.DMARCResult  // DMARC verdict for the current message
+	addedHeaders   []string              // Header fields synthesized for the current message
+	transcript     *Transcript           // Commands and replies, nil if not recorded
+	mailParams     string                // ESMTP parameters given with MAIL
+	rcptParams     map[string]string     // ESMTP parameters given with each RCPT
+	tarpit         *tarpit               // Delays replies to misbehaving clients, may be nil
 }
 
 // NewSession creates a new Session for the given connection
 func NewSession(server *Server, id int, conn net.Conn) *Session {
 	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
 	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	return &Session{server: server, id: id, conn: conn, state: GREET, reader: reader, remoteHost: host}
+	ss := &Session{server: server, id: id, conn: conn, state: GREET, reader: reader, writer: writer,
+		remoteHost: host, xclientTrusted: server.xclientTrusted(host)}
+	if server.transcripts {
+		ss.transcript = new(Transcript)
+	}
+	ss.tarpit = newTarpit(server.tarpit)
+	return ss
 }
 
 func (ss *Session) String() string {
@@ -106,8 +155,10 @@ func (ss *Session) String() string {
  *  4. If bad cmd, respond error
  *  5. Goto 2
  */
-func (s *Server) startSession(id int, conn net.Conn) {
-	log.Infof("SMTP Connection from %v, starting session <%v>", conn.RemoteAddr(), id)
+func (s *Server) startSession(id int, conn net.Conn, lmtp bool) {
+	ss := NewSession(s, id, conn)
+	ss.lmtp = lmtp
+	log.Infof("%v Connection from %v, starting session <%v>", ss.protocol(), conn.RemoteAddr(), id)
 	expConnectsCurrent.Add(1)
 	defer func() {
 		if err := conn.Close(); err != nil {
@@ -117,7 +168,23 @@ func (s *Server) startSession(id int, conn net.Conn) {
 		expConnectsCurrent.Add(-1)
 	}()
 
-	ss := NewSession(s, id, conn)
+	if !s.connectionAllowed(ss.remoteHost) {
+		ss.send("554 Connections from your address are not permitted")
+		ss.logWarn("Connection refused by network access rules")
+		ss.flush()
+		return
+	}
+	if !s.connLimiter.allow(ss.remoteHost) {
+		ss.send("421 Too many connections from your address, try again later")
+		ss.logWarn("Connection rate limit exceeded")
+		ss.flush()
+		return
+	}
+	if reply, _ := ss.runScript("on_connect"); reply != "" {
+		ss.send(reply)
+		ss.flush()
+		return
+	}
 	ss.greet()
 
 	// This is our command reading loop
@@ -129,27 +196,38 @@ func (s *Server) startSession(id int, conn net.Conn) {
 		}
 		line, err := ss.readLine()
 		if err == nil {
+			ss.transcript.Client(line)
+			ss.tarpit.command()
+			ss.tarpitDelay()
 			if cmd, arg, ok := ss.parseCmd(line); ok {
 				// Check against valid SMTP commands
 				if cmd == "" {
 					ss.send("500 Speak up")
 					continue
 				}
-				if !commands[cmd] {
+				if commands[cmd] {
+					expCommands.Add(cmd, 1)
+				} else {
+					expCommands.Add("UNKNOWN", 1)
+				}
+				if !commands[cmd] || !ss.helloAllowed(cmd) {
 					ss.send(fmt.Sprintf("500 Syntax error, %v command unrecognized", cmd))
 					ss.logWarn("Unrecognized command: %v", cmd)
 					continue
 				}
+				if ss.injectFault(cmd, arg) {
+					continue
+				}
 
 				// Commands we handle in any state
 				switch cmd {
-				case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+				case "SEND", "SOML", "SAML", "HELP", "TURN":
 					// These commands are not implemented in any state
 					ss.send(fmt.Sprintf("502 %v command not implemented", cmd))
 					ss.logWarn("Command %v not implemented by Inbucket", cmd)
 					continue
-				case "VRFY":
-					ss.send("252 Cannot VRFY user, but will accept message")
+				case "VRFY", "EXPN":
+					ss.vrfyHandler(cmd, arg)
 					continue
 				case "NOOP":
 					ss.send("250 I have sucessfully done nothing")
@@ -164,6 +242,13 @@ func (s *Server) startSession(id int, conn net.Conn) {
 					ss.send("221 Goodnight and good luck")
 					ss.enterState(QUIT)
 					continue
+				case "BDAT":
+					// Chunk data must be consumed regardless of state
+					ss.bdatHandler(arg)
+					continue
+				case "XCLIENT":
+					ss.xclientHandler(arg)
+					continue
 				}
 
 				// Send command to handler for current state
@@ -199,7 +284,7 @@ func (s *Server) startSession(id int, conn net.Conn) {
 			ss.logWarn("Connection error: %v", err)
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() {
-					ss.send("221 Idle timeout, bye bye")
+					ss.sendTimeout()
 					break
 				}
 			}
@@ -207,6 +292,12 @@ func (s *Server) startSession(id int, conn net.Conn) {
 			break
 		}
 	}
+	if ss.chunkWriter != nil {
+		// The client went away during a BDAT transfer
+		ss.chunkWriter.discard()
+	}
+	// Deliver any replies still buffered, such as our 221
+	ss.flush()
 	if ss.sendError != nil {
 		ss.logWarn("Network send error: %v", ss.sendError)
 	}
@@ -222,25 +313,62 @@ func (ss *Session) greetHandler(cmd string, arg string) {
 			ss.send("501 Domain/address argument required for HELO")
 			return
 		}
-		ss.remoteDomain = domain
+		ss.setRemoteDomain(domain)
+		ss.extended = false
 		ss.send("250 Great, let's get this show on the road")
 		ss.enterState(READY)
-	case "EHLO":
+	case "EHLO", "LHLO":
 		domain, err := parseHelloArgument(arg)
 		if err != nil {
-			ss.send("501 Domain/address argument required for EHLO")
+			ss.send(fmt.Sprintf("501 Domain/address argument required for %v", cmd))
 			return
 		}
-		ss.remoteDomain = domain
+		ss.setRemoteDomain(domain)
+		ss.extended = true
 		ss.send("250-Great, let's get this show on the road")
 		ss.send("250-8BITMIME")
-		ss.send(fmt.Sprintf("250 SIZE %v", ss.server.maxMessageBytes))
+		ss.send("250-SMTPUTF8")
+		ss.send("250-CHUNKING")
+		ss.send("250-BINARYMIME")
+		ss.send("250-PIPELINING")
+		ss.send("250-DSN")
+		if ss.server.tlsConfig != nil && ss.tlsState == nil {
+			ss.send("250-STARTTLS")
+		}
+		if ss.server.authEnabled {
+			ss.send("250-AUTH " + strings.Join(authMechanisms, " "))
+		}
+		if ss.xclientTrusted {
+			ss.send("250-XCLIENT " + strings.Join(xclientAttrs, " "))
+		}
+		ss.send(fmt.Sprintf("250 SIZE %v", ss.server.largestMessageBytes()))
 		ss.enterState(READY)
 	default:
 		ss.ooSeq(cmd)
 	}
 }
 
+// setRemoteDomain records the domain from HELO/EHLO, unless XCLIENT supplied the original
+// client's
+func (ss *Session) setRemoteDomain(domain string) {
+	if ss.xclientHelo != "" {
+		domain = ss.xclientHelo
+	}
+	ss.remoteDomain = domain
+}
+
+// helloAllowed returns false for greeting commands that belong to the other protocol;
+// LMTP sessions must use LHLO, SMTP sessions HELO or EHLO
+func (ss *Session) helloAllowed(cmd string) bool {
+	switch cmd {
+	case "HELO", "EHLO":
+		return !ss.lmtp
+	case "LHLO":
+		return ss.lmtp
+	}
+	return true
+}
+
 func parseHelloArgument(arg string) (string, error) {
 	domain := arg
 	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
@@ -254,24 +382,41 @@ func parseHelloArgument(arg string) (string, error) {
 
 // READY state -> waiting for MAIL
 func (ss *Session) readyHandler(cmd string, arg string) {
+	if cmd == "STARTTLS" {
+		ss.startTLSHandler(arg)
+		return
+	}
+	if cmd == "AUTH" {
+		ss.authHandler(arg)
+		return
+	}
 	if cmd == "MAIL" {
 		// Match FROM, while accepting '>' as quoted pair and in double quoted strings
-		// (?i) makes the regex case insensitive, (?:) is non-grouping sub-match
-		re := regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])+|\"[^\"]+\"@[^>]+)>( [\\w= ]+)?$")
+		// (?i) makes the regex case insensitive, (?:) is non-grouping sub-match.  An empty
+		// address is the null reverse-path used by bounces.
+		re := regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])*|\"[^\"]+\"@[^>]+)>((?: \\S+)+)?$")
 		m := re.FindStringSubmatch(arg)
+		if m == nil && ss.server.lenientAddresses {
+			if lenient, ok := lenientPath("FROM", arg); ok {
+				ss.logTrace("Leniently parsed MAIL argument %q as %q", arg, lenient)
+				m = re.FindStringSubmatch(lenient)
+			}
+		}
 		if m == nil {
 			ss.send("501 Was expecting MAIL arg syntax of FROM:<address>")
 			ss.logWarn("Bad MAIL argument: %q", arg)
 			return
 		}
 		from := m[1]
-		if _, _, err := ParseEmailAddress(from); err != nil {
+		if _, _, err := ParseEmailAddress(from); err != nil && from != "" {
 			ss.send("501 Bad sender address syntax")
 			ss.logWarn("Bad address as MAIL arg: %q, %s", from, err)
 			return
 		}
-		// This is where the client may put BODY=8BITMIME, but we already
-		// read the DATA as bytes, so it does not effect our processing.
+		smtpUTF8 := false
+		binaryMIME := false
+		declaredSize := 0
+		dsn := dsnRequest{notify: make(map[string]string), orcpt: make(map[string]string)}
 		if m[2] != "" {
 			args, ok := ss.parseArgs(m[2])
 			if !ok {
@@ -286,16 +431,64 @@ func (ss *Session) readyHandler(cmd string, arg string) {
 					ss.logWarn("Unable to parse SIZE %q as an integer", args["SIZE"])
 					return
 				}
-				if int(size) > ss.server.maxMessageBytes {
+				if int(size) > ss.server.largestMessageBytes() {
 					ss.send("552 Max message size exceeded")
 					ss.logWarn("Client wanted to send oversized message: %v", args["SIZE"])
 					return
 				}
+				declaredSize = int(size)
 			}
+			// We read the message data as bytes, so 8BITMIME does not effect our processing.
+			// BINARYMIME data may only be sent with BDAT, and is stored untouched.
+			if body, ok := args["BODY"]; ok {
+				switch strings.ToUpper(body) {
+				case "7BIT", "8BITMIME":
+				case "BINARYMIME":
+					binaryMIME = true
+				default:
+					ss.send("501 BODY must be 7BIT, 8BITMIME or BINARYMIME")
+					ss.logWarn("Bad BODY parameter: %q", body)
+					return
+				}
+			}
+			_, smtpUTF8 = args["SMTPUTF8"]
+			if ret, ok := args["RET"]; ok {
+				dsn.ret = strings.ToUpper(ret)
+				if dsn.ret != "FULL" && dsn.ret != "HDRS" {
+					ss.send("501 RET must be FULL or HDRS")
+					ss.logWarn("Bad RET parameter: %q", ret)
+					return
+				}
+			}
+			dsn.envID = args["ENVID"]
+		}
+		if !smtpUTF8 && !isASCII(from) {
+			ss.send("553 Internationalized address requires SMTPUTF8")
+			ss.logWarn("Non-ASCII MAIL address without SMTPUTF8: %q", from)
+			return
 		}
+		if !ss.server.msgLimiter.allow(ss.remoteHost) {
+			ss.send("450 Too many messages from your address, try again later")
+			ss.logWarn("Message rate limit exceeded")
+			return
+		}
+		if reply, _ := ss.runScript("on_mail", from); reply != "" {
+			ss.send(reply)
+			return
+		}
+		ss.smtpUTF8 = smtpUTF8
+		ss.binaryMIME = binaryMIME
+		ss.declaredSize = declaredSize
+		ss.dsn = dsn
 		ss.from = from
+		ss.mailParams = strings.TrimSpace(m[2])
 		ss.recipients = list.New()
 		ss.logInfo("Mail from: %v", from)
+		if ss.server.spfEnabled {
+			ss.spf = mailauth.CheckSPF(ss.server.resolver, net.ParseIP(ss.remoteHost),
+				ss.remoteDomain, from)
+			ss.logInfo("SPF result for %v: %v", from, ss.spf)
+		}
 		ss.send(fmt.Sprintf("250 Roger, accepting mail from <%v>", from))
 		ss.enterState(MAIL)
 	} else {
@@ -303,32 +496,196 @@ func (ss *Session) readyHandler(cmd string, arg string) {
 	}
 }
 
+// startTLSHandler upgrades the connection to TLS, the client must then start over with EHLO
+func (ss *Session) startTLSHandler(arg string) {
+	if ss.server.tlsConfig == nil {
+		ss.send("454 TLS not available")
+		ss.logWarn("STARTTLS requested, but TLS is not configured")
+		return
+	}
+	if ss.tlsState != nil {
+		ss.send("503 TLS already active")
+		ss.logWarn("STARTTLS requested on a TLS session")
+		return
+	}
+	if arg != "" {
+		ss.send("501 STARTTLS command should not have any arguments")
+		ss.logWarn("Got unexpected args on STARTTLS: %q", arg)
+		return
+	}
+	ss.send("220 Ready to start TLS")
+	ss.flush()
+	if ss.sendError != nil {
+		return
+	}
+	if ss.reader.Buffered() > 0 {
+		// RFC 3207: anything pipelined after STARTTLS must be discarded
+		ss.logWarn("Discarding %v bytes pipelined after STARTTLS", ss.reader.Buffered())
+	}
+	tlsConn := tls.Server(ss.conn, ss.server.tlsConfig)
+	if err := tlsConn.SetDeadline(ss.nextDeadline(ss.server.commandTimeout)); err != nil {
+		ss.sendError = err
+		return
+	}
+	expTLSHandshakes.Add(1)
+	if err := tlsConn.Handshake(); err != nil {
+		expTLSFailures.Add(1)
+		ss.logWarn("TLS handshake failed: %v", err)
+		ss.enterState(QUIT)
+		return
+	}
+	state := tlsConn.ConnectionState()
+	ss.conn = tlsConn
+	ss.reader = bufio.NewReader(tlsConn)
+	ss.writer = bufio.NewWriter(tlsConn)
+	ss.tlsState = &state
+	ss.logInfo("TLS session established")
+	ss.transcript.Note("TLS session established")
+	if subject := ss.clientCertSubject(); subject != "" {
+		ss.logInfo("TLS client certificate: %v", subject)
+	}
+	// RFC 3207: the client must discard all prior knowledge, including the HELO/EHLO
+	ss.remoteDomain = ""
+	ss.authUser = ""
+	ss.authMech = ""
+	ss.reset()
+	ss.enterState(GREET)
+}
+
+// clientCertSubject returns the subject of the verified TLS client certificate, or an empty
+// string if the client did not present one
+func (ss *Session) clientCertSubject() string {
+	if ss.tlsState == nil || len(ss.tlsState.VerifiedChains) == 0 {
+		return ""
+	}
+	name := ss.tlsState.VerifiedChains[0][0].Subject
+	var parts []string
+	add := func(key string, values []string) {
+		for _, v := range values {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	if name.CommonName != "" {
+		add("CN", []string{name.CommonName})
+	}
+	add("OU", name.OrganizationalUnit)
+	add("O", name.Organization)
+	add("L", name.Locality)
+	add("ST", name.Province)
+	add("C", name.Country)
+	return strings.Join(parts, ",")
+}
+
 // MAIL state -> waiting for RCPTs followed by DATA
 func (ss *Session) mailHandler(cmd string, arg string) {
 	switch cmd {
 	case "RCPT":
+		accepted := ss.recipients.Len()
+		defer func() {
+			if ss.recipients.Len() == accepted {
+				expRcptRejected.Add(1)
+			}
+		}()
+		if ss.server.lenientAddresses {
+			if lenient, ok := lenientPath("TO", arg); ok && lenient != arg {
+				ss.logTrace("Leniently parsed RCPT argument %q as %q", arg, lenient)
+				arg = lenient
+			}
+		}
 		if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
 			ss.send("501 Was expecting RCPT arg syntax of TO:<address>")
 			ss.logWarn("Bad RCPT argument: %q", arg)
 			return
 		}
+		rcptArg, params := arg[3:], ""
+		if idx := strings.LastIndex(rcptArg, "> "); idx >= 0 &&
+			esmtpParamsRegex.MatchString(rcptArg[idx+1:]) {
+			rcptArg, params = rcptArg[:idx+1], rcptArg[idx+1:]
+		}
 		// This trim is probably too forgiving
-		recip := strings.Trim(arg[3:], "<> ")
-		if _, _, err := ParseEmailAddress(recip); err != nil {
+		recip := strings.Trim(rcptArg, "<> ")
+		_, domain, err := ParseEmailAddress(recip)
+		if err != nil {
 			ss.send("501 Bad recipient address syntax")
 			ss.logWarn("Bad address as RCPT arg: %q, %s", recip, err)
 			return
 		}
-		if ss.recipients.Len() >= ss.server.maxRecips {
+		if !ss.smtpUTF8 && !isASCII(recip) {
+			ss.send("553 Internationalized address requires SMTPUTF8")
+			ss.logWarn("Non-ASCII RCPT address without SMTPUTF8: %q", recip)
+			return
+		}
+		if rule := ss.server.recipientRule(recip); rule != nil {
+			ss.send(fmt.Sprintf("%v %v", rule.Code, rule.Message))
+			ss.logInfo("Recipient %v rejected by rule %q", recip, rule.Name)
+			return
+		}
+		limit := ss.server.maxMessageBytesFor(domain)
+		if ss.declaredSize > limit {
+			ss.send(fmt.Sprintf("552 Max message size for <%v> is %v bytes", recip, limit))
+			ss.logWarn("Declared SIZE %v exceeds limit of %v for %q", ss.declaredSize, limit, recip)
+			return
+		}
+		notify, orcpt := "", ""
+		if params != "" {
+			args, ok := ss.parseArgs(params)
+			if !ok {
+				ss.send("501 Unable to parse RCPT ESMTP parameters")
+				ss.logWarn("Bad RCPT argument: %q", arg)
+				return
+			}
+			if value, ok := args["NOTIFY"]; ok {
+				if notify, ok = parseNotify(value); !ok {
+					ss.send("501 NOTIFY must be NEVER, or a list of SUCCESS, FAILURE and DELAY")
+					ss.logWarn("Bad NOTIFY parameter: %q", value)
+					return
+				}
+			}
+			orcpt = args["ORCPT"]
+		}
+		if ss.server.maxRecips > 0 && ss.recipients.Len() >= ss.server.maxRecips {
+			// RFC 5321 4.5.3.1.10: 452 lets the client retry the remaining recipients
+			// in a later transaction
 			ss.logWarn("Maximum limit of %v recipients reached", ss.server.maxRecips)
-			ss.send(fmt.Sprintf("552 Maximum limit of %v recipients reached", ss.server.maxRecips))
+			ss.send(fmt.Sprintf("452 Too many recipients, limit is %v", ss.server.maxRecips))
+			return
+		}
+		if reply, _ := ss.runScript("on_rcpt", recip); reply != "" {
+			ss.send(reply)
 			return
 		}
 		ss.recipients.PushBack(recip)
+		if params != "" {
+			if ss.rcptParams == nil {
+				ss.rcptParams = make(map[string]string)
+			}
+			ss.rcptParams[recip] = strings.TrimSpace(params)
+		}
+		if notify != "" {
+			ss.dsn.notify[recip] = notify
+		}
+		if orcpt != "" {
+			ss.dsn.orcpt[recip] = orcpt
+		}
+		if ss.maxBytes == 0 || limit < ss.maxBytes {
+			ss.maxBytes = limit
+		}
 		ss.logInfo("Recipient: %v", recip)
 		ss.send(fmt.Sprintf("250 I'll make sure <%v> gets this", recip))
 		return
 	case "DATA":
+		if ss.chunkWriter != nil {
+			// RFC 3030 does not permit mixing BDAT and DATA
+			ss.send("503 DATA not permitted during BDAT transfer")
+			ss.logWarn("Got DATA during BDAT transfer")
+			return
+		}
+		if ss.binaryMIME {
+			// RFC 3030: BINARYMIME messages cannot be dot-stuffed, they must be sent with BDAT
+			ss.send("503 DATA not permitted for BODY=BINARYMIME, use BDAT")
+			ss.logWarn("Got DATA for BINARYMIME message")
+			return
+		}
 		if arg != "" {
 			ss.send("501 DATA command should not have any arguments")
 			ss.logWarn("Got unexpected args on DATA: %q", arg)
@@ -346,138 +703,220 @@ func (ss *Session) mailHandler(cmd string, arg string) {
 	ss.ooSeq(cmd)
 }
 
+// vrfyHandler answers VRFY and EXPN according to the configured mode.  We have no mailing
+// lists, so EXPN of an address is treated as verifying it.
+func (ss *Session) vrfyHandler(cmd string, arg string) {
+	switch ss.server.vrfyMode {
+	case "disabled":
+		ss.send(fmt.Sprintf("502 %v command disabled", cmd))
+		ss.logWarn("Refused disabled command %v", cmd)
+		return
+	case "lookup":
+	default:
+		ss.send(fmt.Sprintf("252 Cannot %v user, but will accept message", cmd))
+		return
+	}
+	address := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(arg), "<"), ">")
+	if address == "" {
+		ss.send(fmt.Sprintf("501 Was expecting %v arg syntax of <address>", cmd))
+		ss.logWarn("Bad %v argument: %q", cmd, arg)
+		return
+	}
+	if !strings.Contains(address, "@") {
+		address += "@" + ss.server.domain
+	}
+	local, domain, err := ParseEmailAddress(address)
+	if err != nil {
+		ss.send(fmt.Sprintf("501 Bad address syntax for %v", cmd))
+		ss.logWarn("Bad address as %v arg: %q, %s", cmd, arg, err)
+		return
+	}
+	if !ss.mailboxExists(local, domain) {
+		ss.send(fmt.Sprintf("550 No such user <%v>", address))
+		return
+	}
+	ss.logInfo("Verified %v with %v", address, cmd)
+	ss.send(fmt.Sprintf("250 <%v>", address))
+}
+
+// mailboxExists returns true if the mailbox for the address holds at least one message
+func (ss *Session) mailboxExists(local, domain string) bool {
+	mb, err := ss.server.dataStore.MailboxFor(MailboxAddress(local, domain))
+	if err != nil {
+		return false
+	}
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		ss.logError("Failed to read mailbox %v: %v", mb, err)
+		return false
+	}
+	return len(msgs) > 0
+}
+
 // DATA
 func (ss *Session) dataHandler() {
-	recipients := make([]recipientDetails, 0, ss.recipients.Len())
-	// Get a Mailbox and a new Message for each recipient
-	msgSize := 0
-	if ss.server.storeMessages {
-		for e := ss.recipients.Front(); e != nil; e = e.Next() {
-			recip := e.Value.(string)
-			local, domain, err := ParseEmailAddress(recip)
-			if err != nil {
-				ss.logError("Failed to parse address for %q", recip)
-				ss.send(fmt.Sprintf("451 Failed to open mailbox for %v", recip))
-				ss.reset()
-				return
-			}
-			if strings.ToLower(domain) != ss.server.domainNoStore {
-				// Not our "no store" domain, so store the message
-				mb, err := ss.server.dataStore.MailboxFor(local)
-				if err != nil {
-					ss.logError("Failed to open mailbox for %q: %s", local, err)
-					ss.send(fmt.Sprintf("451 Failed to open mailbox for %v", local))
-					ss.reset()
-					return
-				}
-				recipients = append(recipients, recipientDetails{recip, local, domain, mb})
-			} else {
-				log.Tracef("Not storing message for %q", recip)
-			}
-		}
+	mw := ss.newMessageWriter()
+	if mw == nil {
+		// Client has already been notified
+		return
 	}
 
 	ss.send("354 Start mail input; end with <CRLF>.<CRLF>")
-	var lineBuf bytes.Buffer
-	msgBuf := make([][]byte, 0, 1024)
+	refusal := "" // Reply once a limit has been exceeded
+	lineStart := true
 	for {
-		lineBuf.Reset()
-		err := ss.readByteLine(&lineBuf)
+		line, err := ss.readDataLine()
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() {
-					ss.send("221 Idle timeout, bye bye")
+					ss.sendTimeout()
 				}
 			}
 			ss.logWarn("Error: %v while reading", err)
+			mw.discard()
 			ss.enterState(QUIT)
 			return
 		}
-		line := lineBuf.Bytes()
 		// ss.logTrace("DATA: %q", line)
-		if string(line) == ".\r\n" || string(line) == ".\n" {
+		if lineStart && (string(line) == ".\r\n" || string(line) == ".\n") {
 			// Mail data complete
-			if ss.server.storeMessages {
-				// Create a message for each valid recipient
-				for _, r := range recipients {
-					if ok := ss.deliverMessage(r, msgBuf); ok {
-						expReceivedTotal.Add(1)
-					} else {
-						// Delivery failure
-						ss.send(fmt.Sprintf("451 Failed to store message for %v", r.localPart))
-						ss.reset()
-						return
-					}
-				}
-			} else {
-				expReceivedTotal.Add(1)
+			ss.transcript.Note("%v bytes of message data", mw.size)
+			if refusal != "" {
+				ss.sendDataReply(refusal)
+				ss.reset()
+				return
 			}
-			ss.send("250 Mail accepted for delivery")
-			ss.logInfo("Message size %v bytes", msgSize)
-			ss.reset()
+			mw.finish()
 			return
 		}
+		// Only the first piece of a long line may be dot-stuffed or end the data
+		first := lineStart
+		lineStart = line[len(line)-1] == '\n'
+		if refusal != "" {
+			// Discard remaining data, the client is not listening until it sends "."
+			continue
+		}
 		// SMTP RFC says remove leading periods from input
-		if len(line) > 0 && line[0] == '.' {
+		if first && line[0] == '.' {
 			line = line[1:]
 		}
-		// Second append copies line/lineBuf so we can reuse it
-		msgBuf = append(msgBuf, append([]byte{}, line...))
-		msgSize += len(line)
-		if msgSize > ss.server.maxMessageBytes {
-			// Max message size exceeded
-			ss.send("552 Maximum message size exceeded")
-			ss.logWarn("Max message size exceeded while in DATA")
-			ss.reset()
-			// Should really cleanup the crap on filesystem (after issue #23)
-			return
+		// write copies line, as it is only valid until the next read
+		mw.write(line)
+		if mw.size > ss.maxBytes {
+			// Max message size exceeded, reply once the client has finished sending
+			ss.logWarn("Max message size of %v exceeded while in DATA", ss.maxBytes)
+			refusal = "552 Maximum message size exceeded"
+			mw.discard()
+		} else if reply := mw.headerLimit(); reply != "" {
+			ss.logWarn("Refused message header while in DATA: %v", reply)
+			refusal = reply
+			mw.discard()
 		}
 	} // end for
 }
 
-// deliverMessage creates and populates a new Message for the specified recipient
-func (ss *Session) deliverMessage(r recipientDetails, msgBuf [][]byte) (ok bool) {
+// deliverMessage creates and populates a new Message for the specified recipient, from is
+// the reverse-path recorded with it.  If delivery to the recipient is deferred, the message
+// is queued and true returned.
+func (ss *Session) deliverMessage(r recipientDetails, from string, msgBuf [][]byte) (ok bool) {
+	delivery := ss.newDelivery(r, from)
+
+	// Generate trace headers
+	recd := ss.authResultsHeader() + ss.receivedHeader(r.address, time.Now())
+	prefix := fmt.Sprintf("%v[%v]<%v>", ss.protocol(), ss.remoteHost, ss.id)
+	if delay := ss.server.queue.delayFor(r.address); delay > 0 {
+		ss.logInfo("Deferring delivery to %q for %v", r.localPart, delay)
+		server := ss.server
+		server.queue.schedule(delay, func() {
+			server.storeMessage(prefix, r, delivery, recd, msgBuf)
+		})
+		return true
+	}
+	return ss.server.storeMessage(prefix, r, delivery, recd, msgBuf)
+}
+
+// newDelivery collects the details of the current transaction to be stored with the
+// recipient's message, from is the reverse-path
+func (ss *Session) newDelivery(r recipientDetails, from string) Delivery {
+	delivery := Delivery{
+		MailFrom:      from,
+		MailParams:    ss.mailParams,
+		RcptParams:    ss.rcptParams,
+		AuthUser:      ss.authUser,
+		AuthMechanism: ss.authMech,
+		RemoteAddr:    ss.remoteHost,
+		Helo:          ss.remoteDomain,
+		SessionID:     ss.id,
+		Protocol:      ss.withProtocol(),
+		SPF:           string(ss.spf),
+		DKIM:          ss.dkim,
+		DMARC:         string(ss.dmarc.Result),
+		DMARCPolicy:   ss.dmarc.Policy,
+		ClientCert:    ss.clientCertSubject(),
+		Transcript:    ss.transcript.String(),
+		AddedHeaders:  ss.addedHeaders,
+	}
+	if ss.tlsState != nil {
+		delivery.TLSVersion = tlsVersionName(ss.tlsState.Version)
+		delivery.TLSCipher = tlsCipherName(ss.tlsState.CipherSuite)
+	}
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		delivery.Recipients = append(delivery.Recipients, e.Value.(string))
+	}
+	if ss.server.subAddressLabel {
+		_, delivery.Label, _ = SplitMailboxName(r.localPart)
+	}
+	return delivery
+}
+
+// storeMessage writes a message to the recipient's mailbox and announces its arrival, prefix
+// identifies the session in log messages
+func (s *Server) storeMessage(prefix string, r recipientDetails, delivery Delivery, recd string,
+	msgBuf [][]byte) (ok bool) {
+	logError := func(msg string, args ...interface{}) {
+		// Update metrics
+		expErrorsTotal.Add(1)
+		log.Errorf("%v %v", prefix, fmt.Sprintf(msg, args...))
+	}
 	msg, err := r.mailbox.NewMessage()
 	if err != nil {
-		ss.logError("Failed to create message for %q: %s", r.localPart, err)
+		logError("Failed to create message for %q: %s", r.localPart, err)
 		return false
 	}
+	msg.SetDelivery(delivery)
 
-	// Generate Received header
-	stamp := time.Now().Format(timeStampFormat)
-	recd := fmt.Sprintf("Received: from %s ([%s]) by %s\r\n  for <%s>; %s\r\n",
-		ss.remoteDomain, ss.remoteHost, ss.server.domain, r.address, stamp)
 	if err := msg.Append([]byte(recd)); err != nil {
-		ss.logError("Failed to write received header for %q: %s", r.localPart, err)
+		logError("Failed to write received header for %q: %s", r.localPart, err)
 		return false
 	}
 
 	// Append lines from msgBuf
 	for _, line := range msgBuf {
 		if err := msg.Append(line); err != nil {
-			ss.logError("Failed to append to mailbox %v: %v", r.mailbox, err)
+			logError("Failed to append to mailbox %v: %v", r.mailbox, err)
 			// Should really cleanup the crap on filesystem
 			return false
 		}
 	}
 	if err := msg.Close(); err != nil {
-		ss.logError("Error while closing message for %v: %v", r.mailbox, err)
+		logError("Error while closing message for %v: %v", r.mailbox, err)
 		return false
 	}
+	s.broadcast(r.mailbox, msg)
+	return true
+}
 
-	// Broadcast message information
-	broadcast := msghub.Message{
-		Mailbox: r.mailbox.Name(),
+// broadcast announces the arrival of a stored message
+func (s *Server) broadcast(mb Mailbox, msg Message) {
+	s.msgHub.Dispatch(msghub.Message{
+		Mailbox: mb.Name(),
 		ID:      msg.ID(),
 		From:    msg.From(),
 		To:      msg.To(),
 		Subject: msg.Subject(),
 		Date:    msg.Date(),
 		Size:    msg.Size(),
-	}
-	ss.server.msgHub.Dispatch(broadcast)
-
-	return true
+	})
 }
 
 func (ss *Session) enterState(state State) {
@@ -486,49 +925,111 @@ func (ss *Session) enterState(state State) {
 }
 
 func (ss *Session) greet() {
-	ss.send(fmt.Sprintf("220 %v Inbucket SMTP ready", ss.server.domain))
+	ss.send(fmt.Sprintf("220 %v Inbucket %v ready", ss.server.domain, ss.protocol()))
 }
 
-// Calculate the next read or write deadline based on maxIdleSeconds
-func (ss *Session) nextDeadline() time.Time {
-	return time.Now().Add(time.Duration(ss.server.maxIdleSeconds) * time.Second)
+// protocol returns the name of the protocol this session is speaking
+func (ss *Session) protocol() string {
+	if ss.lmtp {
+		return "LMTP"
+	}
+	return "SMTP"
 }
 
-// Send requested message, store errors in Session.sendError
-func (ss *Session) send(msg string) {
-	if err := ss.conn.SetWriteDeadline(ss.nextDeadline()); err != nil {
-		ss.sendError = err
+// sendDataReply sends the reply to the end of message data.  LMTP requires a reply for each
+// accepted recipient, SMTP a single reply for the transaction.
+func (ss *Session) sendDataReply(msg string) {
+	if !ss.lmtp || ss.recipients == nil {
+		ss.send(msg)
 		return
 	}
-	if _, err := fmt.Fprint(ss.conn, msg+"\r\n"); err != nil {
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		ss.send(msg)
+	}
+}
+
+// Calculate the next read or write deadline based on the specified timeout
+func (ss *Session) nextDeadline(timeout time.Duration) time.Time {
+	return time.Now().Add(timeout)
+}
+
+// commandTimeout returns how long to wait for the client's next command, which is the
+// greeting timeout until HELO or EHLO has been received
+func (ss *Session) commandTimeout() time.Duration {
+	if ss.state == GREET {
+		return ss.server.greetingTimeout
+	}
+	return ss.server.commandTimeout
+}
+
+// sendTimeout tells the client the connection is being closed because it was idle too long
+func (ss *Session) sendTimeout() {
+	ss.send(fmt.Sprintf("421 %v Idle timeout, closing connection", ss.server.domain))
+}
+
+// Send requested message, store errors in Session.sendError.  The message is buffered
+// until flush is called.
+func (ss *Session) send(msg string) {
+	if _, err := fmt.Fprint(ss.writer, msg+"\r\n"); err != nil {
 		ss.sendError = err
 		ss.logWarn("Failed to send: %q", msg)
 		return
 	}
 	ss.logTrace(">> %v >>", msg)
+	ss.transcript.Server(msg)
+	if len(msg) < 3 || len(msg) > 3 && msg[3] == '-' {
+		// Only count the last line of a multiline reply
+		return
+	}
+	expReplies.Add(msg[:1]+"xx", 1)
+	ss.tarpit.reply(msg[0])
 }
 
-// readByteLine reads a line of input into the provided buffer. Does
-// not reset the Buffer - please do so prior to calling.
-func (ss *Session) readByteLine(buf *bytes.Buffer) error {
-	if err := ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
-		return err
+// flush writes any buffered replies to the client, store errors in Session.sendError
+func (ss *Session) flush() {
+	if ss.sendError != nil || ss.writer.Buffered() == 0 {
+		return
 	}
-	for {
-		line, err := ss.reader.ReadBytes('\n')
-		if err != nil {
-			return err
-		}
-		if _, err = buf.Write(line); err != nil {
-			return err
+	if err := ss.conn.SetWriteDeadline(ss.nextDeadline(ss.server.commandTimeout)); err != nil {
+		ss.sendError = err
+		return
+	}
+	if err := ss.writer.Flush(); err != nil {
+		ss.sendError = err
+		ss.logWarn("Failed to flush replies: %v", err)
+	}
+}
+
+// prepareRead sets the read deadline to timeout from now, and flushes buffered replies unless
+// the client has already pipelined further input for us to process
+func (ss *Session) prepareRead(timeout time.Duration) error {
+	if ss.reader.Buffered() == 0 {
+		ss.flush()
+		if ss.sendError != nil {
+			return ss.sendError
 		}
-		return nil
 	}
+	return ss.conn.SetReadDeadline(ss.nextDeadline(timeout))
+}
+
+// readDataLine reads the next line of message data.  Lines longer than the read buffer are
+// returned in several pieces, only the last of which ends with a newline, so that a client
+// cannot make us hold an arbitrarily large line in memory.  The result is only valid until
+// the next read.
+func (ss *Session) readDataLine() ([]byte, error) {
+	if err := ss.prepareRead(ss.server.dataTimeout); err != nil {
+		return nil, err
+	}
+	line, err := ss.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return line, nil
+	}
+	return line, err
 }
 
 // Reads a line of input
 func (ss *Session) readLine() (line string, err error) {
-	if err = ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
+	if err = ss.prepareRead(ss.commandTimeout()); err != nil {
 		return "", err
 	}
 	line, err = ss.reader.ReadString('\n')
@@ -555,31 +1056,76 @@ func (ss *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
 		ss.logWarn("Mangled command: %q", line)
 		return "", "", false
 	}
-	// If we made it here, command is long enough to have args
-	if line[4] != ' ' {
+	// If we made it here, command is long enough to have args.  Most commands are four
+	// letters long, but extensions such as STARTTLS are not
+	idx := strings.IndexByte(line, ' ')
+	if idx == -1 {
+		if l > 4 && commands[strings.ToUpper(line)] {
+			// A long command without arguments
+			return strings.ToUpper(line), "", true
+		}
 		// There wasn't a space after the command?
 		ss.logWarn("Mangled command: %q", line)
 		return "", "", false
 	}
+	if idx < 4 {
+		ss.logWarn("Mangled command: %q", line)
+		return "", "", false
+	}
 	// I'm not sure if we should trim the args or not, but we will for now
-	return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " "), true
+	return strings.ToUpper(line[0:idx]), strings.Trim(line[idx+1:], " "), true
+}
+
+// lenientPath rewrites a sloppy MAIL or RCPT argument for the keyword (FROM or TO) into its
+// RFC 5321 form, returning false if it is beyond repair.  A local part that is only invalid
+// because of its periods or spaces is quoted.
+func lenientPath(keyword string, arg string) (string, bool) {
+	m := lenientPathRegex.FindStringSubmatch(arg)
+	if m == nil || !strings.EqualFold(m[1], keyword) {
+		return "", false
+	}
+	address := m[2] + m[3]
+	if address != "" {
+		if _, _, err := ParseEmailAddress(address); err != nil {
+			at := strings.LastIndex(address, "@")
+			if at < 1 || strings.ContainsAny(address[:at], "\"\\") {
+				return "", false
+			}
+			address = "\"" + address[:at] + "\"" + address[at:]
+			if _, _, err := ParseEmailAddress(address); err != nil {
+				return "", false
+			}
+		}
+	}
+	params := ""
+	if fields := strings.Fields(m[4]); len(fields) > 0 {
+		params = " " + strings.Join(fields, " ")
+	}
+	return fmt.Sprintf("%v:<%v>%v", keyword, address, params), true
 }
 
 // parseArgs takes the arguments proceeding a command and files them
-// into a map[string]string after uppercasing each key.  Sample arg
-// string:
-//		" BODY=8BITMIME SIZE=1024"
+// into a map[string]string after uppercasing each key.  Keywords listed
+// in valuelessParams map to an empty string.  Sample arg string:
+//
+//	" BODY=8BITMIME SIZE=1024 SMTPUTF8"
+//
 // The leading space is mandatory.
 func (ss *Session) parseArgs(arg string) (args map[string]string, ok bool) {
 	args = make(map[string]string)
-	re := regexp.MustCompile(" (\\w+)=(\\w+)")
+	re := regexp.MustCompile(" ([\\w-]+)(?:=(\\S+))?")
 	pm := re.FindAllStringSubmatch(arg, -1)
 	if pm == nil {
-		ss.logWarn("Failed to parse arg string: %q")
+		ss.logWarn("Failed to parse arg string: %q", arg)
 		return nil, false
 	}
 	for _, m := range pm {
-		args[strings.ToUpper(m[1])] = m[2]
+		key := strings.ToUpper(m[1])
+		if m[2] == "" && !valuelessParams[key] {
+			ss.logWarn("ESMTP param %v requires a value", key)
+			return nil, false
+		}
+		args[key] = m[2]
 	}
 	ss.logTrace("ESMTP params: %v", args)
 	return args, true
@@ -588,7 +1134,24 @@ func (ss *Session) parseArgs(arg string) (args map[string]string, ok bool) {
 func (ss *Session) reset() {
 	ss.enterState(READY)
 	ss.from = ""
+	ss.mailParams = ""
 	ss.recipients = nil
+	ss.rcptParams = nil
+	ss.smtpUTF8 = false
+	ss.binaryMIME = false
+	if ss.chunkWriter != nil {
+		// Abandon any BDAT transfer in progress
+		ss.chunkWriter.discard()
+	}
+	ss.chunkWriter = nil
+	ss.declaredSize = 0
+	ss.maxBytes = 0
+	ss.dsn = dsnRequest{}
+	ss.spf = ""
+	ss.dkim = nil
+	ss.dkimChecked = false
+	ss.dmarc = mailauth.DMARCResult{}
+	ss.addedHeaders = nil
 }
 
 func (ss *Session) ooSeq(cmd string) {
@@ -598,21 +1161,21 @@ func (ss *Session) ooSeq(cmd string) {
 
 // Session specific logging methods
 func (ss *Session) logTrace(msg string, args ...interface{}) {
-	log.Tracef("SMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+	log.Tracef("%v[%v]<%v> %v", ss.protocol(), ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
 }
 
 func (ss *Session) logInfo(msg string, args ...interface{}) {
-	log.Infof("SMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+	log.Infof("%v[%v]<%v> %v", ss.protocol(), ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
 }
 
 func (ss *Session) logWarn(msg string, args ...interface{}) {
 	// Update metrics
 	expWarnsTotal.Add(1)
-	log.Warnf("SMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+	log.Warnf("%v[%v]<%v> %v", ss.protocol(), ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
 }
 
 func (ss *Session) logError(msg string, args ...interface{}) {
 	// Update metrics
 	expErrorsTotal.Add(1)
-	log.Errorf("SMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+	log.Errorf("%v[%v]<%v> %v", ss.protocol(), ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
 }
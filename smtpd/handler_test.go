@@ -3,18 +3,36 @@ package smtpd
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"expvar"
 	"fmt"
 	"io"
-
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/textproto"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/msghub"
+	"github.com/stretchr/testify/mock"
 )
 
 type scriptStep struct {
@@ -108,6 +126,7 @@ func TestReadyState(t *testing.T) {
 		{"MAIL FROM: <john@gmail.com> SIZE147", 501},
 		{"MAIL FROM:<first@last@gmail.com>", 501},
 		{"MAIL FROM:<first last@gmail.com>", 501},
+		{"MAIL FROM:<jösé@gmail.com>", 553},
 	}
 	if err := playSession(t, server, script); err != nil {
 		t.Error(err)
@@ -135,6 +154,10 @@ func TestReadyState(t *testing.T) {
 		{"MAIL FROM:<\"user>name\"@host.com>", 250},
 		{"RSET", 250},
 		{"MAIL FROM:<\"user@internal\"@external.com>", 250},
+		{"RSET", 250},
+		{"MAIL FROM:<john@gmail.com> SMTPUTF8", 250},
+		{"RSET", 250},
+		{"MAIL FROM:<jösé@bücher.de> BODY=8BITMIME SMTPUTF8", 250},
 	}
 	if err := playSession(t, server, script); err != nil {
 		t.Error(err)
@@ -164,6 +187,7 @@ func TestMailState(t *testing.T) {
 	msg1.On("Subject").Return("")
 	msg1.On("Size").Return(0)
 	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
 
 	server, logbuf, teardown := setupSMTPServer(mds)
 	defer teardown()
@@ -202,6 +226,11 @@ func TestMailState(t *testing.T) {
 		{"RCPT TO:<\"first last\"@host.com", 250},
 		{"RCPT TO:<user\\>name@host.com>", 250},
 		{"RCPT TO:<\"user>name\"@host.com>", 250},
+		{"RCPT TO:<用户@例子.广告>", 553},
+		{"RSET", 250},
+		{"MAIL FROM:<john@gmail.com> SMTPUTF8", 250},
+		{"RCPT TO:<用户@例子.广告>", 250},
+		{"RCPT TO:<θσερ@εχαμπλε.ψομ>", 250},
 	}
 	if err := playSession(t, server, script); err != nil {
 		t.Error(err)
@@ -216,7 +245,9 @@ func TestMailState(t *testing.T) {
 		{"RCPT TO:<u3@gmail.com>", 250},
 		{"RCPT TO:<u4@gmail.com>", 250},
 		{"RCPT TO:<u5@gmail.com>", 250},
-		{"RCPT TO:<u6@gmail.com>", 552},
+		{"RCPT TO:<u6@gmail.com>", 452},
+		{"DATA", 354},
+		{".", 250},
 	}
 	if err := playSession(t, server, script); err != nil {
 		t.Error(err)
@@ -281,6 +312,7 @@ func TestDataState(t *testing.T) {
 	msg1.On("Subject").Return("")
 	msg1.On("Size").Return(0)
 	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
 
 	server, logbuf, teardown := setupSMTPServer(mds)
 	defer teardown()
@@ -324,6 +356,18 @@ Hi!
 	}
 }
 
+// delivery matches a SetDelivery argument equal to want apart from its session ID, which
+// depends on the order tests run in but must be set
+func delivery(want Delivery) interface{} {
+	return mock.MatchedBy(func(d Delivery) bool {
+		if d.SessionID == 0 {
+			return false
+		}
+		d.SessionID = 0
+		return reflect.DeepEqual(d, want)
+	})
+}
+
 // playSession creates a new session, reads the greeting and then plays the script
 func playSession(t *testing.T, server *Server, script []scriptStep) error {
 	pipe := setupSMTPSession(server)
@@ -376,9 +420,14 @@ func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
 func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
 func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
 
+// setupSMTPServer creates a server with the default test configuration
 func setupSMTPServer(ds DataStore) (s *Server, buf *bytes.Buffer, teardown func()) {
-	// Test Server Config
-	cfg := config.SMTPConfig{
+	return setupSMTPServerConfig(ds, testSMTPConfig())
+}
+
+// testSMTPConfig returns the configuration used by most SMTP tests
+func testSMTPConfig() config.SMTPConfig {
+	return config.SMTPConfig{
 		IP4address:      net.IPv4(127, 0, 0, 1),
 		IP4port:         2500,
 		Domain:          "inbucket.local",
@@ -388,7 +437,11 @@ func setupSMTPServer(ds DataStore) (s *Server, buf *bytes.Buffer, teardown func(
 		MaxMessageBytes: 5000,
 		StoreMessages:   true,
 	}
+}
 
+// setupSMTPServerConfig creates a server with the provided configuration
+func setupSMTPServerConfig(ds DataStore, cfg config.SMTPConfig) (
+	s *Server, buf *bytes.Buffer, teardown func()) {
 	// Capture log output
 	buf = new(bytes.Buffer)
 	log.SetOutput(buf)
@@ -407,12 +460,1964 @@ func setupSMTPServer(ds DataStore) (s *Server, buf *bytes.Buffer, teardown func(
 var sessionNum int
 
 func setupSMTPSession(server *Server) net.Conn {
+	return setupSession(server, false)
+}
+
+// setupSession starts a session speaking either SMTP or LMTP
+func setupSession(server *Server, lmtp bool) net.Conn {
 	// Pair of pipes to communicate
 	serverConn, clientConn := net.Pipe()
 	// Start the session
 	server.waitgroup.Add(1)
 	sessionNum++
-	go server.startSession(sessionNum, &mockConn{serverConn})
+	go server.startSession(sessionNum, &mockConn{serverConn}, lmtp)
 
 	return clientConn
 }
+
+// Test timeouts for each phase of the session are reported with a 421
+func TestTimeouts(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor").Return(mb1, nil)
+
+	cfg := testSMTPConfig()
+	cfg.MaxIdleSeconds = 30
+	cfg.GreetingTimeout = 1
+	cfg.DataTimeout = 1
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	// mockConn ignores deadlines, so sessions must run over TCP
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+	dial := func() *textproto.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverConn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.waitgroup.Add(1)
+		sessionNum++
+		go server.startSession(sessionNum, serverConn, false)
+		c := textproto.NewConn(conn)
+		if _, _, err := c.ReadCodeLine(220); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// Client never says HELO
+	c := dial()
+	if _, msg, err := c.ReadCodeLine(421); err != nil {
+		t.Errorf("Expected 421 after greeting timeout, got %v", err)
+	} else if want := "inbucket.local Idle timeout, closing connection"; msg != want {
+		t.Errorf("Got %q, expected %q", msg, want)
+	}
+	_ = c.Close()
+
+	// Client stalls during DATA
+	c = dial()
+	for _, step := range []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@bitbucket.local>", 250},
+		{"DATA", 354},
+	} {
+		if err := c.PrintfLine("%s", step.send); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadCodeLine(step.expect); err != nil {
+			t.Fatalf("Sent %q: %v", step.send, err)
+		}
+	}
+	if _, _, err := c.ReadCodeLine(421); err != nil {
+		t.Errorf("Expected 421 after data timeout, got %v", err)
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test STARTTLS negotiation
+func TestStartTLS(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor").Return(mb1, nil)
+
+	certFile, keyFile, cleanup := writeTestCert(t)
+	defer cleanup()
+	cfg := testSMTPConfig()
+	cfg.TLSEnabled = true
+	cfg.TLSCert = certFile
+	cfg.TLSPrivKey = keyFile
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	// STARTTLS requires EHLO first, and takes no arguments
+	script := []scriptStep{
+		{"STARTTLS", 503},
+		{"EHLO localhost", 250},
+		{"STARTTLS now", 501},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v", code)
+	}
+	if err := c.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("Expected 250 to EHLO, got %v", err)
+	}
+	if !strings.Contains(msg, "STARTTLS") {
+		t.Errorf("Expected STARTTLS in EHLO response, got %q", msg)
+	}
+	if err := playScriptAgainst(t, c, []scriptStep{{"STARTTLS", 220}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Handshake and continue the session over TLS
+	tlsConn := tls.Client(pipe, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	c = textproto.NewConn(tlsConn)
+	if err := c.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err = c.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("Expected 250 to EHLO over TLS, got %v", err)
+	}
+	if strings.Contains(msg, "STARTTLS") {
+		t.Errorf("Did not expect STARTTLS in EHLO response over TLS, got %q", msg)
+	}
+	script = []scriptStep{
+		{"STARTTLS", 503},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"QUIT", 221},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test verification of TLS client certificates
+func TestClientCert(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	certFile, keyFile, cleanup := writeTestCert(t)
+	defer cleanup()
+	caFile, clientCert, caCleanup := writeTestClientCert(t)
+	defer caCleanup()
+	cfg := testSMTPConfig()
+	cfg.TLSEnabled = true
+	cfg.TLSCert = certFile
+	cfg.TLSPrivKey = keyFile
+	cfg.TLSClientCA = caFile
+	cfg.TLSClientAuth = "require"
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	// startTLS negotiates STARTTLS and returns the resulting connection
+	startTLS := func(certs []tls.Certificate) *textproto.Conn {
+		pipe := setupSMTPSession(server)
+		c := textproto.NewConn(pipe)
+		if code, _, err := c.ReadCodeLine(220); err != nil {
+			t.Fatalf("Expected a 220 greeting, got %v", code)
+		}
+		if err := playScriptAgainst(t, c, []scriptStep{
+			{"EHLO localhost", 250},
+			{"STARTTLS", 220},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tlsConn := tls.Client(pipe, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		_ = tlsConn.Handshake()
+		return textproto.NewConn(tlsConn)
+	}
+
+	// A verified certificate is recorded with the message
+	c := startTLS([]tls.Certificate{clientCert})
+	if err := playScriptAgainst(t, c, []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: test\r\n\r\nHi\r\n.", 250},
+		{"QUIT", 221},
+	}); err != nil {
+		t.Error(err)
+	}
+	msg1.AssertCalled(t, "SetDelivery", mock.MatchedBy(func(d Delivery) bool {
+		return d.ClientCert == "CN=client.example.com,O=Inbucket Test"
+	}))
+
+	// Without a certificate the server aborts the handshake
+	c = startTLS(nil)
+	if _, err := c.ReadLine(); err == nil {
+		t.Error("Expected session without a client certificate to fail")
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test additional listeners apply their own policies
+func TestListeners(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	mds.On("MailboxFor").Return(mb1, nil)
+
+	cfg := testSMTPConfig()
+	submission := testSMTPConfig()
+	submission.Name = "submission"
+	submission.AuthEnabled = true
+	submission.MaxRecipients = 1
+	cfg.Listeners = []config.SMTPConfig{submission}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	if len(server.listeners) != 1 {
+		t.Fatalf("Expected 1 additional listener, got %v", len(server.listeners))
+	}
+	listener := server.listeners[0]
+	if listener.name != "submission" {
+		t.Errorf("Expected listener name submission, got %q", listener.name)
+	}
+
+	// The primary listener keeps its own policy
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN " + b64("\x00joe\x00secret"), 502},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com>", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	script = []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN " + b64("\x00joe\x00secret"), 235},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com>", 452},
+	}
+	if err := playSession(t, listener, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test SMTP AUTH mechanisms
+func TestAuth(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	// AUTH is rejected unless enabled
+	server, logbuf, teardown := setupSMTPServer(mds)
+	defer teardown()
+	if err := playSession(t, server, []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN " + b64("\x00joe\x00secret"), 502},
+	}); err != nil {
+		t.Error(err)
+	}
+
+	cfg := testSMTPConfig()
+	cfg.AuthEnabled = true
+	cfg.AuthCredentials = map[string]string{"joe": "secret"}
+	server, logbuf, teardown = setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH", 501},
+		{"AUTH CRAZY", 504},
+		{"AUTH PLAIN " + b64("\x00joe\x00wrong"), 535},
+		{"AUTH PLAIN " + b64("\x00bob\x00secret"), 535},
+		{"AUTH PLAIN garbage!", 501},
+		{"AUTH PLAIN", 334},
+		{"*", 501},
+		{"AUTH LOGIN", 334},
+		{b64("joe"), 334},
+		{b64("wrong"), 535},
+		{"AUTH PLAIN " + b64("\x00joe\x00secret"), 235},
+		{"AUTH PLAIN " + b64("\x00joe\x00secret"), 503},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	// Interactive PLAIN and LOGIN
+	if err := playSession(t, server, []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN", 334},
+		{b64("\x00joe\x00secret"), 235},
+	}); err != nil {
+		t.Error(err)
+	}
+	script = []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH LOGIN " + b64("joe"), 334},
+		{b64("secret"), 235},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: test\r\n\r\nHi!\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	msg1.AssertCalled(t, "SetDelivery",
+		delivery(Delivery{MailFrom: "john@gmail.com", Recipients: []string{"u1@gmail.com"},
+			AuthUser: "joe", AuthMechanism: "LOGIN", Helo: "localhost", Protocol: "ESMTPA"}))
+
+	// Accept any credentials when none are configured
+	cfg.AuthCredentials = nil
+	server, logbuf, teardown = setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+	if err := playSession(t, server, []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN " + b64("\x00anybody\x00anything"), 235},
+	}); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test the CRAM-MD5 challenge/response exchange
+func TestAuthCRAMMD5(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	cfg := testSMTPConfig()
+	cfg.AuthEnabled = true
+	cfg.AuthCredentials = map[string]string{"joe": "secret"}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	for _, tc := range []struct {
+		user, secret string
+		expect       int
+	}{
+		{"joe", "secret", 235},
+		{"joe", "wrong", 535},
+		{"bob", "secret", 535},
+	} {
+		pipe := setupSMTPSession(server)
+		c := textproto.NewConn(pipe)
+		if code, _, err := c.ReadCodeLine(220); err != nil {
+			t.Fatalf("Expected a 220 greeting, got %v", code)
+		}
+		if err := playScriptAgainst(t, c, []scriptStep{{"EHLO localhost", 250}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.PrintfLine("AUTH CRAM-MD5"); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := c.ReadCodeLine(334)
+		if err != nil {
+			t.Fatalf("Expected 334 challenge, got %v", err)
+		}
+		challenge, err := base64.StdEncoding.DecodeString(msg)
+		if err != nil {
+			t.Fatalf("Failed to decode challenge %q: %v", msg, err)
+		}
+		mac := hmac.New(md5.New, []byte(tc.secret))
+		_, _ = mac.Write(challenge)
+		resp := fmt.Sprintf("%s %x", tc.user, mac.Sum(nil))
+		if err := playScriptAgainst(t, c, []scriptStep{{b64(resp), tc.expect}}); err != nil {
+			t.Error(err)
+		}
+		_ = c.Close()
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test message size limits, including per domain overrides
+func TestMessageSizeLimits(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("Delete").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.DomainMaxBytes = map[string]int{"small.com": 100, "big.com": 10000}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	// Declared SIZE checks
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com> SIZE=20000", 552},
+		{"MAIL FROM:<john@gmail.com> SIZE=8000", 250},
+		{"RCPT TO:<u1@gmail.com>", 552},
+		{"RCPT TO:<u1@small.com>", 552},
+		{"RCPT TO:<u1@BIG.com>", 250},
+		{"RSET", 250},
+		{"MAIL FROM:<john@gmail.com> SIZE=50", 250},
+		{"RCPT TO:<u1@small.com>", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	// Oversized DATA must be consumed before replying
+	long := strings.Repeat("x", 78)
+	script = []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@big.com>", 250},
+		{"RCPT TO:<u1@small.com>", 250},
+		{"DATA", 354},
+		{long + "\r\n" + long + "\r\n.", 552},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@big.com>", 250},
+		{"DATA", 354},
+		{long + "\r\n" + long + "\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	// Messages streamed for both recipients of the oversized DATA are removed
+	msg1.AssertNumberOfCalls(t, "Delete", 2)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test messages with oversized headers are refused once the data is complete
+func TestHeaderLimits(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("Delete").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.MaxHeaderBytes = 100
+	cfg.MaxHeaderCount = 3
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	// Continuation lines are part of the preceding field, and the body is not counted
+	long := strings.Repeat("x", 60)
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"From: a\r\nTo: b\r\nSubject: c\r\n d\r\n\r\nE: f\r\n.", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"From: a\r\nTo: b\r\nSubject: c\r\nX: d\r\n\r\nbody\r\n.", 552},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: " + long + "\r\n " + long + "\r\n\r\nbody\r\n.", 552},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: c\r\n\r\n" + long + "\r\n" + long + "\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	// Header fields are counted across BDAT chunks
+	script = []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"BDAT 9\r\nFrom: a", 250},
+		{"BDAT 11\r\nTo: b\r\n c", 250},
+		{"BDAT 12 LAST\r\nX: d\r\nY: e", 552},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"BDAT 14 LAST\r\nFrom: a\r\n\r\nb", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test messages with too many Received headers are refused as a mail loop
+func TestMailLoop(t *testing.T) {
+	ds := &MockDataStore{}
+	cfg := testSMTPConfig()
+	cfg.StoreMessages = false
+	cfg.MaxReceived = 2
+	server, logbuf, teardown := setupSMTPServerConfig(ds, cfg)
+	defer teardown()
+
+	received := "Received: from a by b; Mon, 1 Jan 2017 00:00:00 +0000\r\n"
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{received + "RECEIVED : from c\r\n by d\r\nX-Received: e\r\n\r\n" + received + ".", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{received + received + "received:\r\n\r\nbody\r\n.", 554},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"BDAT 11\r\nReceived:", 250},
+		{fmt.Sprintf("BDAT %v LAST\r\n%v%va: b", 2*len(received)+6, received, received), 554},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test sloppy addresses are accepted only by lenient parsing
+func TestLenientAddresses(t *testing.T) {
+	var testTable = []struct {
+		keyword, input, expect string
+	}{
+		{"FROM", "FROM:<john@gmail.com>", "FROM:<john@gmail.com>"},
+		{"FROM", "from : < john@gmail.com >  SIZE=10", "FROM:<john@gmail.com> SIZE=10"},
+		{"FROM", "FROM:<>", "FROM:<>"},
+		{"TO", "TO:u1@gmail.com", "TO:<u1@gmail.com>"},
+		{"TO", "To: u1.@docomo.ne.jp NOTIFY=NEVER", "TO:<\"u1.\"@docomo.ne.jp> NOTIFY=NEVER"},
+		{"TO", "TO:<first..last@gmail.com>", "TO:<\"first..last\"@gmail.com>"},
+		{"TO", "TO:<john doe@gmail.com>", "TO:<\"john doe\"@gmail.com>"},
+	}
+	for _, tt := range testTable {
+		got, ok := lenientPath(tt.keyword, tt.input)
+		if !ok || got != tt.expect {
+			t.Errorf("lenientPath(%q) got %q, %v, expected %q", tt.input, got, ok, tt.expect)
+		}
+	}
+	var badTable = []struct {
+		keyword, input string
+	}{
+		{"FROM", "TO:<u1@gmail.com>"},
+		{"TO", "TO:u1 @gmail.com"},
+		{"TO", "TO:<u1@bad!domain>"},
+		{"TO", "TO:<\"u1@gmail.com>"},
+	}
+	for _, tt := range badTable {
+		if got, ok := lenientPath(tt.keyword, tt.input); ok {
+			t.Errorf("lenientPath(%q) got %q, expected failure", tt.input, got)
+		}
+	}
+
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	strict := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:john@gmail.com", 501},
+		{"MAIL FROM: <john@gmail.com>", 250},
+		{"RCPT TO:<u1.@gmail.com>", 501},
+	}
+	lenient := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:john@gmail.com", 250},
+		{"RCPT TO : u1.@gmail.com", 250},
+		{"RCPT TO:< u2@gmail.com >", 250},
+		{"DATA", 354},
+		{".", 250},
+	}
+	for _, lenientMode := range []bool{false, true} {
+		cfg := testSMTPConfig()
+		cfg.LenientAddresses = lenientMode
+		server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+		script := strict
+		if lenientMode {
+			script = lenient
+		}
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("Lenient %v: %v", lenientMode, err)
+		}
+		teardown()
+
+		if t.Failed() {
+			// Wait for handler to finish logging
+			time.Sleep(2 * time.Second)
+			// Dump buffered log data if there was a failure
+			_, _ = io.Copy(os.Stderr, logbuf)
+			return
+		}
+	}
+	msg1.AssertNumberOfCalls(t, "SetDelivery", 2)
+}
+
+// Test each VRFY and EXPN mode
+func TestVRFY(t *testing.T) {
+	ds, _ := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+	deliverMessage(ds, "u1", "test", time.Now())
+
+	var testTable = []struct {
+		mode   string
+		script []scriptStep
+	}{
+		{"", []scriptStep{
+			{"HELO localhost", 250},
+			{"VRFY <nobody@gmail.com>", 252},
+			{"EXPN list", 252},
+		}},
+		{"lookup", []scriptStep{
+			{"HELO localhost", 250},
+			{"VRFY <u1@gmail.com>", 250},
+			{"VRFY U1+label@inbucket.local", 250},
+			{"VRFY u1", 250},
+			{"EXPN <u1@gmail.com>", 250},
+			{"VRFY <nobody@gmail.com>", 550},
+			{"VRFY", 501},
+			{"VRFY <bad..user@gmail.com>", 501},
+		}},
+		{"disabled", []scriptStep{
+			{"HELO localhost", 250},
+			{"VRFY <u1@gmail.com>", 502},
+			{"EXPN <u1@gmail.com>", 502},
+		}},
+	}
+	for _, tt := range testTable {
+		cfg := testSMTPConfig()
+		cfg.VRFYMode = tt.mode
+		server, logbuf, teardown := setupSMTPServerConfig(ds, cfg)
+		if err := playSession(t, server, tt.script); err != nil {
+			t.Errorf("Mode %q: %v", tt.mode, err)
+		}
+		teardown()
+
+		if t.Failed() {
+			// Wait for handler to finish logging
+			time.Sleep(2 * time.Second)
+			// Dump buffered log data if there was a failure
+			_, _ = io.Copy(os.Stderr, logbuf)
+			return
+		}
+	}
+}
+
+// Test message data is written to the datastore as it arrives
+func TestDataStreaming(t *testing.T) {
+	ds, _ := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+	cfg := testSMTPConfig()
+	cfg.MaxMessageBytes = 20000
+	server, logbuf, teardown := setupSMTPServerConfig(ds, cfg)
+	defer teardown()
+
+	// Lines longer than the read buffer arrive in pieces, only the first may be dot-stuffed
+	long := strings.Repeat("x", 4095) + ".." + strings.Repeat("y", 5000)
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: big\r\n\r\n" + long + "\r\n..dot\r\n.", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{strings.Repeat("z", 30000) + "\r\n.", 552},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	mb, err := ds.MailboxFor("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Got %v messages, expected only the first to be stored", len(msgs))
+	}
+	raw, err := msgs[0].ReadRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(*raw, "\r\nSubject: big\r\n\r\n"+long+"\r\n.dot\r\n") {
+		t.Errorf("Stored message data was not as sent, ends with %q", (*raw)[len(*raw)-40:])
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test DSN parameters and simulated notifications
+func TestDSN(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.DSNEnabled = true
+	cfg.DSNFailureDomain = "bounce.local"
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com> RET=ALL", 501},
+		{"MAIL FROM:<john@gmail.com> RET=FULL ENVID=QQ314159+2B", 250},
+		{"RCPT TO:<u1@gmail.com> NOTIFY=BOGUS", 501},
+		{"RCPT TO:<u1@gmail.com> NOTIFY=NEVER,SUCCESS", 501},
+		{"RCPT TO:<u1@gmail.com> NOTIFY=SUCCESS ORCPT=rfc822;u1@gmail.com", 250},
+		{"DATA", 354},
+		{".", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@bounce.local>", 250},
+		{"DATA", 354},
+		{".", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@bounce.local> NOTIFY=NEVER", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	// Delivered message and success DSN, failure DSN, delivered message only
+	msg1.AssertNumberOfCalls(t, "Close", 4)
+	// The envelope parameters are stored with the message
+	msg1.AssertCalled(t, "SetDelivery", delivery(Delivery{MailFrom: "john@gmail.com",
+		MailParams: "RET=FULL ENVID=QQ314159+2B", Recipients: []string{"u1@gmail.com"},
+		RcptParams: map[string]string{"u1@gmail.com": "NOTIFY=SUCCESS ORCPT=rfc822;u1@gmail.com"},
+		Helo:       "localhost", Protocol: "ESMTP"}))
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test LMTP greeting and per recipient DATA replies
+func TestLMTP(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	server, logbuf, teardown := setupSMTPServer(mds)
+	defer teardown()
+
+	pipe := setupSession(server, true)
+	c := textproto.NewConn(pipe)
+	if _, msg, err := c.ReadCodeLine(220); err != nil || !strings.Contains(msg, "LMTP") {
+		t.Fatalf("Expected a 220 LMTP greeting, got %q", msg)
+	}
+	script := []scriptStep{
+		{"HELO localhost", 500},
+		{"EHLO localhost", 500},
+		{"LHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@bitbucket.local>", 250},
+		{"DATA", 354},
+		{".", 250},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+	// Second recipient reply
+	if code, msg, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected a 250 reply for second recipient, got %v: %q", code, msg)
+	} else if !strings.Contains(msg, "u2@bitbucket.local") {
+		t.Errorf("Expected reply for <u2@bitbucket.local>, got %q", msg)
+	}
+	if err := playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}}); err != nil {
+		t.Error(err)
+	}
+	_ = c.Close()
+
+	// SMTP sessions do not accept LHLO
+	if err := playSession(t, server, []scriptStep{{"LHLO localhost", 500}}); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test XCLIENT from trusted and untrusted clients
+func TestXClient(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg.XClientNetworks = []*net.IPNet{trusted}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	// Untrusted client
+	c := textproto.NewConn(setupSessionFrom(server, "192.168.1.1"))
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v", code)
+	}
+	if err := playScriptAgainst(t, c, []scriptStep{
+		{"EHLO proxy", 250},
+		{"XCLIENT ADDR=1.2.3.4", 550},
+	}); err != nil {
+		t.Error(err)
+	}
+	_ = c.Close()
+
+	// Trusted client
+	c = textproto.NewConn(setupSessionFrom(server, "10.1.1.1"))
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v", code)
+	}
+	if err := playScriptAgainst(t, c, []scriptStep{
+		{"EHLO proxy", 250},
+		{"XCLIENT", 501},
+		{"XCLIENT ADDR=bogus", 501},
+		{"XCLIENT FOO=bar", 501},
+		{"XCLIENT HELO=bad+xtext", 501},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"XCLIENT ADDR=1.2.3.4", 503},
+		{"RSET", 250},
+		{"XCLIENT ADDR=IPV6:2001:DB8::1 HELO=client+2Eexample.com NAME=[UNAVAILABLE]", 220},
+		{"MAIL FROM:<john@gmail.com>", 503},
+		{"EHLO proxy", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 250},
+	}); err != nil {
+		t.Error(err)
+	}
+	_ = c.Close()
+	msg1.AssertCalled(t, "SetDelivery",
+		delivery(Delivery{MailFrom: "john@gmail.com", Recipients: []string{"u1@gmail.com"},
+			RemoteAddr: "2001:db8::1", Helo: "client.example.com", Protocol: "ESMTP"}))
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// remoteAddrConn reports a fixed remote address for a test connection
+type remoteAddrConn struct {
+	mockConn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+// setupSessionFrom starts an SMTP session that appears to originate from ip
+func setupSessionFrom(server *Server, ip string) net.Conn {
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	sessionNum++
+	conn := &remoteAddrConn{mockConn{serverConn}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}}
+	go server.startSession(sessionNum, conn, false)
+
+	return clientConn
+}
+
+// Test per IP connection and message rate limits
+func TestRateLimits(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	cfg := testSMTPConfig()
+	cfg.RateConnections = 2
+	cfg.RateMessages = 1
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	if err := playSession(t, server, []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RSET", 250},
+		{"MAIL FROM:<john@gmail.com>", 450},
+	}); err != nil {
+		t.Error(err)
+	}
+	if err := playSession(t, server, []scriptStep{{"HELO localhost", 250}}); err != nil {
+		t.Error(err)
+	}
+
+	// Third connection within the minute is refused
+	c := textproto.NewConn(setupSMTPSession(server))
+	if code, msg, err := c.ReadCodeLine(421); err != nil {
+		t.Errorf("Expected a 421 greeting, got %v: %q", code, msg)
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test network allow and deny lists
+func TestNetworkAccess(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	cfg := testSMTPConfig()
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	_, denied, _ := net.ParseCIDR("10.66.0.0/16")
+	cfg.AllowNetworks = []*net.IPNet{allowed}
+	cfg.DenyNetworks = []*net.IPNet{denied}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	for _, tc := range []struct {
+		ip     string
+		expect int
+	}{
+		{"10.1.1.1", 220},
+		{"10.66.1.1", 554},
+		{"192.168.1.1", 554},
+	} {
+		c := textproto.NewConn(setupSessionFrom(server, tc.ip))
+		if code, msg, err := c.ReadCodeLine(tc.expect); err != nil {
+			t.Errorf("Expected %v greeting for %v, got %v: %q", tc.expect, tc.ip, code, msg)
+		}
+		_ = c.Close()
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test configured recipient rejection rules
+func TestRecipientRules(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	cfg := testSMTPConfig()
+	cfg.RecipientRules = []config.RecipientRule{
+		{Name: "unknown", Pattern: regexp.MustCompile("(?i)^.*reject.*@example\\.com$"),
+			Code: 550, Message: "User unknown"},
+		{Name: "busy", Pattern: regexp.MustCompile("(?i)^busy[0-9]+@"),
+			Code: 450, Message: "Mailbox busy"},
+	}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<please-REJECT-me@example.com>", 550},
+		{"RCPT TO:<reject@example.org>", 250},
+		{"RCPT TO:<busy42@example.org>", 450},
+		{"RCPT TO:<notbusy42@example.org>", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test recipient addresses are rewritten before the mailbox is chosen
+func TestRewriteRules(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	cfg := testSMTPConfig()
+	cfg.RewriteRules = []config.RewriteRule{
+		{Name: "discard", Pattern: regexp.MustCompile("(?i)^.*@legacy\\.example$"),
+			Replacement: "discard@bitbucket.local"},
+		{Name: "team", Pattern: regexp.MustCompile("(?i)^(.+)\\.team@example\\.com$"),
+			Replacement: "${1}@example.com"},
+	}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	var testTable = []struct {
+		input, expect string
+	}{
+		{"user1@legacy.example", "discard@bitbucket.local"},
+		{"james.team@example.com", "james@example.com"},
+		{"james@example.com", "james@example.com"},
+	}
+	for _, tt := range testTable {
+		if got := server.rewriteAddress(tt.input); got != tt.expect {
+			t.Errorf("rewriteAddress(%q) got %q, expected %q", tt.input, got, tt.expect)
+		}
+	}
+
+	// Mail for the legacy domain is rewritten to the no store domain
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<user1@legacy.example>", 250},
+		{"RCPT TO:<user2@legacy.example>", 250},
+		{"DATA", 354},
+		{".", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	mds.AssertNotCalled(t, "MailboxFor")
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test messages refused by header content rules
+func TestHeaderRules(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.HeaderRules = []config.HeaderRule{
+		{Name: "blockme", Header: "subject", Pattern: regexp.MustCompile("(?i)^.*X-Block-Me.*$"),
+			Message: "5.7.1 Blocked by policy"},
+	}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	var testTable = []struct {
+		header string
+		match  bool
+	}{
+		{"Subject: Please x-block-me now", true},
+		{"Subject: =?utf-8?q?X-Block-Me?=", true},
+		{"Subject: hello\r\nSubject: X-Block-Me", true},
+		{"Subject: hello", false},
+		{"X-Other: X-Block-Me", false},
+	}
+	for _, tt := range testTable {
+		raw := []byte(tt.header + "\r\n\r\nHi\r\n")
+		if got := server.headerRule(raw) != nil; got != tt.match {
+			t.Errorf("headerRule(%q) got match %v, expected %v", tt.header, got, tt.match)
+		}
+	}
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: X-Block-Me\r\n\r\nHi\r\n.", 554},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: hello\r\n\r\nHi\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	msg1.AssertNumberOfCalls(t, "SetDelivery", 1)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test bounces generated for recipients matching bounce rules
+func TestBounceRules(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.BounceRules = []config.RecipientRule{
+		{Name: "unknown", Pattern: regexp.MustCompile("(?i)^bounce@example\\.com$"),
+			Code: 550, Message: "5.1.1 User unknown"},
+	}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<bounce@example.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 250},
+		{"MAIL FROM:<>", 250},
+		{"RCPT TO:<bounce@example.com>", 250},
+		{"DATA", 354},
+		{".", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	// Delivered message and bounce, nothing for the null sender
+	msg1.AssertNumberOfCalls(t, "Close", 2)
+	// The bounce is from the null sender
+	msg1.AssertCalled(t, "SetDelivery", delivery(Delivery{
+		Recipients: []string{"bounce@example.com", "u1@gmail.com"}, Helo: "localhost",
+		Protocol: "SMTP"}))
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test messages are not stored until their delivery delay has passed
+func TestDeliveryDelay(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.DelaySeconds = 3600
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	mb1.AssertNotCalled(t, "NewMessage")
+
+	// Flushing the queue at shutdown delivers the waiting message
+	server.queue.flush()
+	mb1.AssertNumberOfCalls(t, "NewMessage", 1)
+	msg1.AssertNumberOfCalls(t, "Close", 1)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test chaos mode fault injection
+func TestChaos(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	// Temporary failures limited to matching recipients
+	cfg := testSMTPConfig()
+	cfg.Chaos = config.ChaosConfig{
+		Enabled:         true,
+		TempFailPercent: 100,
+		Recipients:      regexp.MustCompile("(?i)^.*flaky.*@example\\.com$"),
+	}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<flaky@example.com>", 451},
+		{"RCPT TO:<steady@example.com>", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	// Delays apply to every command without a recipient pattern
+	cfg = testSMTPConfig()
+	cfg.Chaos = config.ChaosConfig{Enabled: true, DelayPercent: 100, DelayMillis: 50}
+	server.faults = newFaultInjector(cfg.Chaos)
+	start := time.Now()
+	if err := playSession(t, server, []scriptStep{{"HELO localhost", 250}}); err != nil {
+		t.Error(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected HELO reply to be delayed, took %v", elapsed)
+	}
+
+	// Dropped connections receive no reply
+	cfg.Chaos = config.ChaosConfig{Enabled: true, DisconnectPercent: 100}
+	server.faults = newFaultInjector(cfg.Chaos)
+	c := textproto.NewConn(setupSMTPSession(server))
+	if code, msg, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %q", code, msg)
+	}
+	if _, err := c.Cmd("HELO localhost"); err != nil {
+		t.Fatalf("Failed to send HELO: %v", err)
+	}
+	if code, msg, err := c.ReadCodeLine(250); err == nil {
+		t.Errorf("Expected connection to be dropped, got %v: %q", code, msg)
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// txtResolver answers TXT lookups from a map, other records do not exist
+type txtResolver map[string][]string
+
+func (r txtResolver) LookupTXT(name string) ([]string, error) { return r[name], nil }
+func (r txtResolver) LookupIP(host string) ([]net.IP, error)  { return nil, nil }
+func (r txtResolver) LookupMX(name string) ([]*net.MX, error) { return nil, nil }
+
+// Test SPF evaluation of the sender
+func TestSPF(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.SPFEnabled = true
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+	server.resolver = txtResolver{"example.com": {"v=spf1 ip4:192.0.2.0/24 -all"}}
+
+	for _, tc := range []struct {
+		ip, expect string
+	}{
+		{"192.0.2.1", "pass"},
+		{"198.51.100.1", "fail"},
+	} {
+		c := textproto.NewConn(setupSessionFrom(server, tc.ip))
+		if code, _, err := c.ReadCodeLine(220); err != nil {
+			t.Fatalf("Expected a 220 greeting, got %v", code)
+		}
+		if err := playScriptAgainst(t, c, []scriptStep{
+			{"HELO localhost", 250},
+			{"MAIL FROM:<john@example.com>", 250},
+			{"RCPT TO:<u1@gmail.com>", 250},
+			{"DATA", 354},
+			{".", 250},
+		}); err != nil {
+			t.Error(err)
+		}
+		_ = c.Close()
+		msg1.AssertCalled(t, "SetDelivery",
+			delivery(Delivery{MailFrom: "john@example.com", Recipients: []string{"u1@gmail.com"},
+				RemoteAddr: tc.ip, Helo: "localhost", Protocol: "SMTP", SPF: tc.expect}))
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test per command, reply and recipient metrics
+func TestMetrics(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	server, logbuf, teardown := setupSMTPServer(mds)
+	defer teardown()
+
+	// expValue returns the value of an expvar counter, nil counters are zero
+	expValue := func(v expvar.Var) int64 {
+		if v == nil {
+			return 0
+		}
+		n, _ := strconv.ParseInt(v.String(), 10, 64)
+		return n
+	}
+	rcpts := expValue(expCommands.Get("RCPT"))
+	unknown := expValue(expCommands.Get("UNKNOWN"))
+	replies2xx := expValue(expReplies.Get("2xx"))
+	replies5xx := expValue(expReplies.Get("5xx"))
+	rejected := expValue(expRcptRejected)
+
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com> NOTIFY=BOGUS", 501},
+		{"RCPT TO:u3", 501},
+		{"FOOB", 500},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	// Wait for the session to finish updating counters
+	server.waitgroup.Wait()
+
+	if got := expValue(expCommands.Get("RCPT")) - rcpts; got != 3 {
+		t.Errorf("Expected 3 RCPT commands, got %v", got)
+	}
+	if got := expValue(expCommands.Get("UNKNOWN")) - unknown; got != 1 {
+		t.Errorf("Expected 1 unknown command, got %v", got)
+	}
+	if got := expValue(expRcptRejected) - rejected; got != 2 {
+		t.Errorf("Expected 2 rejected recipients, got %v", got)
+	}
+	// Greeting, EHLO, MAIL, RCPT and QUIT; multiline EHLO counts once
+	if got := expValue(expReplies.Get("2xx")) - replies2xx; got != 5 {
+		t.Errorf("Expected 5 2xx replies, got %v", got)
+	}
+	if got := expValue(expReplies.Get("5xx")) - replies5xx; got != 3 {
+		t.Errorf("Expected 3 5xx replies, got %v", got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test recording of session transcripts
+func TestTranscript(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.AuthEnabled = true
+	cfg.Transcripts = true
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN " + b64("\x00joe\x00secret"), 235},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: secret\r\n\r\nHi\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	var transcript string
+	for _, call := range msg1.Calls {
+		if call.Method == "SetDelivery" {
+			transcript = call.Arguments.Get(0).(Delivery).Transcript
+		}
+	}
+	for _, want := range []string{
+		"S: 220 ",
+		"C: EHLO localhost\r\nS: 250-",
+		"C: AUTH PLAIN [credentials]\r\nS: 235 ",
+		"C: MAIL FROM:<john@gmail.com>\r\nS: 250 ",
+		"C: RCPT TO:<u1@gmail.com>\r\nS: 250 ",
+		"C: DATA\r\nS: 354 ",
+		"-- 23 bytes of message data\r\n",
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("Expected transcript to contain %q, got:\n%v", want, transcript)
+		}
+	}
+	for _, secret := range []string{b64("\x00joe\x00secret"), "Subject"} {
+		if strings.Contains(transcript, secret) {
+			t.Errorf("Did not expect transcript to contain %q, got:\n%v", secret, transcript)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test DMARC evaluation combining the SPF and DKIM results
+func TestDMARC(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	cfg := testSMTPConfig()
+	cfg.DMARCEnabled = true
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+	server.resolver = txtResolver{
+		"example.com":        {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	}
+
+	for _, tc := range []struct {
+		ip, from, spf, dmarc string
+	}{
+		{"192.0.2.1", "joe@example.com", "pass", "pass"},
+		{"192.0.2.1", "joe@example.org", "pass", "none"},
+		{"198.51.100.1", "joe@example.com", "fail", "fail"},
+	} {
+		c := textproto.NewConn(setupSessionFrom(server, tc.ip))
+		if code, _, err := c.ReadCodeLine(220); err != nil {
+			t.Fatalf("Expected a 220 greeting, got %v", code)
+		}
+		if err := playScriptAgainst(t, c, []scriptStep{
+			{"HELO localhost", 250},
+			{"MAIL FROM:<bounce@example.com>", 250},
+			{"RCPT TO:<u1@gmail.com>", 250},
+			{"DATA", 354},
+			{"From: <" + tc.from + ">\r\n\r\nHi\r\n.", 250},
+		}); err != nil {
+			t.Error(err)
+		}
+		_ = c.Close()
+		policy := "reject"
+		if tc.dmarc == "none" {
+			policy = ""
+		}
+		msg1.AssertCalled(t, "SetDelivery", delivery(Delivery{MailFrom: "bounce@example.com",
+			Recipients: []string{"u1@gmail.com"}, RemoteAddr: tc.ip, Helo: "localhost",
+			Protocol: "SMTP", SPF: tc.spf, DMARC: tc.dmarc, DMARCPolicy: policy}))
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test RFC 3030 BDAT chunking
+func TestBDAT(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	server, logbuf, teardown := setupSMTPServer(mds)
+	defer teardown()
+
+	// textproto appends CRLF to each command, which is counted as chunk data
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"BDAT 7\r\nearly", 503},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"BDAT 7\r\nnorcp", 503},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"BDAT", 501},
+		{"BDAT x", 501},
+		{"BDAT 5 FIRST", 501},
+		{"BDAT 15\r\nSubject: test", 250},
+		{"DATA", 503},
+		{"BDAT 6\r\nbody", 250},
+		{"BDAT 0 LAST", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"BDAT 6 LAST\r\nbody", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"BDAT 6002\r\n" + strings.Repeat("x", 6000), 552},
+		{"RCPT TO:<u1@gmail.com>", 503},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	msg1.AssertNumberOfCalls(t, "Close", 2)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test BINARYMIME messages are only accepted with BDAT, and are stored untouched
+func TestBinaryMIME(t *testing.T) {
+	ds, _ := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+	server, logbuf, teardown := setupSMTPServer(ds)
+	defer teardown()
+
+	// textproto appends CRLF to each command, which is counted as chunk data
+	body := "Subject: bin\r\n\r\n\x00\xff\r\n.\r\n\n\r"
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com> BODY=BOGUS", 501},
+		{"MAIL FROM:<john@gmail.com> BODY=binarymime", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 503},
+		{fmt.Sprintf("BDAT %v LAST\r\n%v", len(body)+2, body), 250},
+		{"MAIL FROM:<john@gmail.com> BODY=8BITMIME", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	mb, err := ds.MailboxFor("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Got %v messages, expected 1", len(msgs))
+	}
+	raw, err := msgs[0].ReadRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(*raw, "\r\n"+body+"\r\n") {
+		t.Errorf("Stored message data was not as sent, got %q", *raw)
+	}
+	if got := msgs[0].Delivery().MailParams; got != "BODY=binarymime" {
+		t.Errorf("Got MAIL parameters %q, expected BODY=binarymime", got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test that pipelined commands are each answered, in order
+func TestPipelining(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	server, logbuf, teardown := setupSMTPServer(mds)
+	defer teardown()
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v", code)
+	}
+	if err := playScriptAgainst(t, c, []scriptStep{{"EHLO localhost", 250}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send a complete group of commands in a single write
+	group := "MAIL FROM:<john@gmail.com>\r\n" +
+		"RCPT TO:<u1@gmail.com>\r\n" +
+		"RCPT TO:<first last@gmail.com>\r\n" +
+		"RCPT TO:<u2@gmail.com>\r\n" +
+		"DATA\r\n"
+	go func() {
+		_, _ = pipe.Write([]byte(group))
+	}()
+	for i, expect := range []int{250, 250, 501, 250, 354} {
+		if code, msg, err := c.ReadResponse(expect); err != nil {
+			t.Fatalf("Response %d, expected %v, got %v: %q", i, expect, code, msg)
+		}
+	}
+	go func() {
+		_, _ = pipe.Write([]byte("Subject: pipelined\r\n\r\nbody\r\n.\r\nQUIT\r\n"))
+	}()
+	for i, expect := range []int{250, 221} {
+		if code, msg, err := c.ReadResponse(expect); err != nil {
+			t.Errorf("Response %d, expected %v, got %v: %q", i, expect, code, msg)
+		}
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// b64 encodes a string for SMTP AUTH
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// writeTestCert generates a self-signed certificate and key, returning their paths
+func writeTestCert(t *testing.T) (certFile, keyFile string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "inbucket-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(dir)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "inbucket.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cleanup
+}
+
+// writeTestClientCert writes a CA certificate to a temporary file, and returns a client
+// certificate signed by it
+func writeTestClientCert(t *testing.T) (caFile string, cert tls.Certificate, cleanup func()) {
+	dir, err := ioutil.TempDir("", "inbucket-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(dir)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Inbucket Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey,
+		caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{CommonName: "client.example.com",
+			Organization: []string{"Inbucket Test"}},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile = filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return caFile, cert, cleanup
+}
@@ -0,0 +1,224 @@
+package smtpd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Punycode parameters from RFC 3492
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	acePrefix       = "xn--" // Marks a punycode encoded label (A-label)
+)
+
+// ToASCIIDomain converts an internationalized domain to its ASCII form, replacing each
+// U-label with the equivalent A-label (ex: "bücher.de" becomes "xn--bcher-kva.de") and
+// lower casing the result.  Existing A-labels are checked to be valid punycode.
+func ToASCIIDomain(domain string) (string, error) {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			if strings.HasPrefix(label, acePrefix) {
+				if _, err := punycodeDecode(label[len(acePrefix):]); err != nil {
+					return "", fmt.Errorf("Invalid A-label %q: %v", label, err)
+				}
+			}
+			continue
+		}
+		label = norm.NFC.String(label)
+		if strings.HasPrefix(label, acePrefix) {
+			return "", fmt.Errorf("Label %q mixes an A-label prefix with Unicode", label)
+		}
+		encoded, err := punycodeEncode(label)
+		if err != nil {
+			return "", fmt.Errorf("Unable to encode label %q: %v", label, err)
+		}
+		labels[i] = acePrefix + encoded
+		if len(labels[i]) > 63 {
+			return "", fmt.Errorf("Encoded label %q exceeds 63 characters", labels[i])
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// normalizeDomain returns the ASCII form of domain for comparisons, or just the lower cased
+// domain if it cannot be converted
+func normalizeDomain(domain string) string {
+	if ascii, err := ToASCIIDomain(domain); err == nil {
+		return ascii
+	}
+	return strings.ToLower(domain)
+}
+
+// normalizeDomainLimits returns a copy of the per domain limits keyed by normalized domain
+func normalizeDomainLimits(limits map[string]int) map[string]int {
+	if limits == nil {
+		return nil
+	}
+	result := make(map[string]int, len(limits))
+	for domain, limit := range limits {
+		result[normalizeDomain(domain)] = limit
+	}
+	return result
+}
+
+// punyAdapt is the bias adaptation function from RFC 3492 section 6.1
+func punyAdapt(delta, numPoints int, firstTime bool) int {
+	if firstTime {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyThreshold returns the threshold for the digit at position k
+func punyThreshold(k, bias int) int {
+	t := k - bias
+	if t < punyTMin {
+		return punyTMin
+	}
+	if t > punyTMax {
+		return punyTMax
+	}
+	return t
+}
+
+// punyDigit returns the basic code point representing the digit d
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punycodeEncode encodes a Unicode label as punycode, without the ACE prefix
+func punycodeEncode(label string) (string, error) {
+	if !utf8.ValidString(label) {
+		return "", fmt.Errorf("Invalid UTF-8")
+	}
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < punyInitialN {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled < len(runes) {
+		// Find the smallest code point not yet handled
+		m := math.MaxInt32
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (math.MaxInt32-delta)/(handled+1) {
+			return "", fmt.Errorf("Overflow")
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punycodeDecode decodes a punycode label, without the ACE prefix, to Unicode
+func punycodeDecode(encoded string) (string, error) {
+	var out []rune
+	pos := 0
+	if b := strings.LastIndex(encoded, "-"); b > -1 {
+		for i := 0; i < b; i++ {
+			if encoded[i] >= punyInitialN {
+				return "", fmt.Errorf("Non-basic code point before delimiter")
+			}
+			out = append(out, rune(encoded[i]))
+		}
+		pos = b + 1
+	}
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(encoded) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(encoded) {
+				return "", fmt.Errorf("Truncated input")
+			}
+			c := encoded[pos]
+			pos++
+			var digit int
+			switch {
+			case 'a' <= c && c <= 'z':
+				digit = int(c - 'a')
+			case 'A' <= c && c <= 'Z':
+				digit = int(c - 'A')
+			case '0' <= c && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", fmt.Errorf("Invalid character %q", c)
+			}
+			if digit > (math.MaxInt32-i)/w {
+				return "", fmt.Errorf("Overflow")
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(out)+1, oldi == 0)
+		n += i / (len(out) + 1)
+		i %= len(out) + 1
+		if n > utf8.MaxRune {
+			return "", fmt.Errorf("Overflow")
+		}
+		out = append(out, 0)
+		copy(out[i+1:], out[i:])
+		out[i] = rune(n)
+		i++
+	}
+	return string(out), nil
+}
@@ -0,0 +1,62 @@
+package smtpd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPunycode(t *testing.T) {
+	var testTable = []struct {
+		unicode, ascii string
+	}{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"ü", "tda"},
+		{"例子", "fsqu00a"},
+		{"测试", "0zwm56d"},
+		{"abc", "abc-"},
+	}
+	for _, tt := range testTable {
+		got, err := punycodeEncode(tt.unicode)
+		if err != nil || got != tt.ascii {
+			t.Errorf("punycodeEncode(%q) got %q, %v, expected %q", tt.unicode, got, err, tt.ascii)
+		}
+		got, err = punycodeDecode(tt.ascii)
+		if err != nil || got != tt.unicode {
+			t.Errorf("punycodeDecode(%q) got %q, %v, expected %q", tt.ascii, got, err, tt.unicode)
+		}
+	}
+
+	for _, input := range []string{"bcher-kv", "bcher-kva!", "99999999999", "ü-tda"} {
+		if _, err := punycodeDecode(input); err == nil {
+			t.Errorf("punycodeDecode(%q) expected an error", input)
+		}
+	}
+}
+
+func TestToASCIIDomain(t *testing.T) {
+	var testTable = []struct {
+		input, expect string
+	}{
+		{"Example.COM", "example.com"},
+		{"Bücher.de", "xn--bcher-kva.de"},
+		{"xn--bcher-kva.de", "xn--bcher-kva.de"},
+		{"例子.测试", "xn--fsqu00a.xn--0zwm56d"},
+		{"bu\u0308cher.de", "xn--bcher-kva.de"},
+	}
+	for _, tt := range testTable {
+		got, err := ToASCIIDomain(tt.input)
+		if err != nil {
+			t.Errorf("ToASCIIDomain(%q) error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.expect {
+			t.Errorf("ToASCIIDomain(%q) got %q, expected %q", tt.input, got, tt.expect)
+		}
+	}
+
+	_, err := ToASCIIDomain("xn--bcher-kva!.de")
+	assert.Error(t, err, "Expected error for invalid A-label")
+	assert.Equal(t, "xn--bcher-kva.de", normalizeDomain("BÜCHER.de"))
+}
@@ -1,29 +1,76 @@
 package smtpd
 
 import (
+	"bytes"
 	"container/list"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"expvar"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net"
+	"net/mail"
+	"net/textproto"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/mailauth"
 	"github.com/jhillyerd/inbucket/msghub"
 )
 
 // Server holds the configuration and state of our SMTP server
 type Server struct {
 	// Configuration
-	domain          string
-	domainNoStore   string
-	maxRecips       int
-	maxIdleSeconds  int
-	maxMessageBytes int
-	storeMessages   bool
+	name             string // Listener name from an [smtp.<name>] section, empty for [smtp]
+	addr             string // host:port to listen on
+	proxyProtocol    bool
+	domain           string
+	domainNoStore    string
+	maxRecips        int
+	maxIdleSeconds   int
+	greetingTimeout  time.Duration // Wait for HELO/EHLO
+	commandTimeout   time.Duration // Wait for the next command
+	dataTimeout      time.Duration // Wait for DATA or BDAT message data
+	maxMessageBytes  int
+	domainMaxBytes   map[string]int // Per recipient domain overrides of maxMessageBytes
+	maxHeaderBytes   int            // 0 for unlimited
+	maxHeaderCount   int            // Header fields, 0 for unlimited
+	maxReceived      int            // Received fields before a loop is assumed, 0 for unlimited
+	storeMessages    bool
+	tlsConfig        *tls.Config // nil if STARTTLS is disabled
+	authEnabled      bool
+	authCredentials  map[string]string // Accept any credentials if empty
+	dsnEnabled       bool
+	dsnFailureDomain string       // Recipients at this domain simulate delivery failure
+	xclientNetworks  []*net.IPNet // Clients permitted to use XCLIENT
+	allowNetworks    []*net.IPNet // Clients permitted to connect, all if empty
+	denyNetworks     []*net.IPNet // Clients refused a connection
+	connLimiter      *rateLimiter // Connections per remote IP, nil if unlimited
+	msgLimiter       *rateLimiter // Messages per remote IP, nil if unlimited
+	recipientRules   []config.RecipientRule
+	bounceRules      []config.RecipientRule
+	rewriteRules     []config.RewriteRule
+	headerRules      []config.HeaderRule
+	faults           *faultInjector // Chaos mode, nil if disabled
+	tarpit           config.TarpitConfig
+	relay            *relayer // Upstream relay, nil if disabled
+	subAddressLabel  bool     // Record sub-address labels in Delivery
+	spfEnabled       bool
+	dkimEnabled      bool
+	dmarcEnabled     bool
+	resolver         mailauth.Resolver // DNS for sender authentication checks
+	transcripts      bool              // Record session transcripts in Delivery
+	script           *scriptEngine     // Lua hooks, nil if no script is configured
+	duplicates       *duplicateFilter  // Recent Message-IDs, nil if not suppressed
+	queue            *deliveryQueue    // Deferred deliveries, nil if none are deferred
+	vrfyMode         string            // How VRFY and EXPN are answered
+	lenientAddresses bool              // Accept sloppy MAIL and RCPT addresses
+	addHeaders       bool              // Add Message-ID and Date to messages lacking them
 
 	// Dependencies
 	dataStore        DataStore         // Mailbox/message store
@@ -32,8 +79,10 @@ type Server struct {
 	retentionScanner *RetentionScanner // Deletes expired messages
 
 	// State
-	listener  net.Listener    // Incoming network connections
-	waitgroup *sync.WaitGroup // Waitgroup tracks individual sessions
+	listener     net.Listener    // Incoming network connections
+	listeners    []*Server       // Additional listeners with their own policies
+	lmtpListener net.Listener    // Incoming LMTP connections, nil if disabled
+	waitgroup    *sync.WaitGroup // Waitgroup tracks individual sessions
 }
 
 var (
@@ -43,6 +92,11 @@ var (
 	expReceivedTotal   = new(expvar.Int)
 	expErrorsTotal     = new(expvar.Int)
 	expWarnsTotal      = new(expvar.Int)
+	expRcptRejected    = new(expvar.Int)
+	expTLSHandshakes   = new(expvar.Int)
+	expTLSFailures     = new(expvar.Int)
+	expCommands        = new(expvar.Map).Init() // Count of each command received
+	expReplies         = new(expvar.Map).Init() // Count of replies by class: 2xx, 4xx, etc
 
 	// History of certain stats
 	deliveredHist = list.New()
@@ -63,19 +117,210 @@ func NewServer(
 	globalShutdown chan bool,
 	ds DataStore,
 	msgHub *msghub.Hub) *Server {
-	return &Server{
+	var tlsConfig *tls.Config
+	if cfg.TLSEnabled {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSPrivKey)
+		if err != nil {
+			log.Errorf("Failed to load TLS certificate/key, STARTTLS disabled: %v", err)
+		} else {
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			if err := configureClientAuth(tlsConfig, cfg); err != nil {
+				log.Errorf("Failed to load TLS client CA, STARTTLS disabled: %v", err)
+				tlsConfig = nil
+			}
+		}
+	}
+	script, err := newScriptEngine(cfg.ScriptFile)
+	if err != nil {
+		log.Errorf("Failed to load SMTP script, hooks disabled: %v", err)
+	}
+	s := &Server{
+		name:             cfg.Name,
+		addr:             fmt.Sprintf("%v:%v", cfg.IP4address, cfg.IP4port),
+		proxyProtocol:    cfg.ProxyProtocol,
 		domain:           cfg.Domain,
-		domainNoStore:    strings.ToLower(cfg.DomainNoStore),
+		domainNoStore:    normalizeDomain(cfg.DomainNoStore),
 		maxRecips:        cfg.MaxRecipients,
 		maxIdleSeconds:   cfg.MaxIdleSeconds,
+		greetingTimeout:  idleTimeout(cfg.GreetingTimeout, cfg.MaxIdleSeconds),
+		commandTimeout:   idleTimeout(cfg.CommandTimeout, cfg.MaxIdleSeconds),
+		dataTimeout:      idleTimeout(cfg.DataTimeout, cfg.MaxIdleSeconds),
 		maxMessageBytes:  cfg.MaxMessageBytes,
+		domainMaxBytes:   normalizeDomainLimits(cfg.DomainMaxBytes),
+		maxHeaderBytes:   cfg.MaxHeaderBytes,
+		maxHeaderCount:   cfg.MaxHeaderCount,
+		maxReceived:      cfg.MaxReceived,
 		storeMessages:    cfg.StoreMessages,
+		tlsConfig:        tlsConfig,
+		authEnabled:      cfg.AuthEnabled,
+		authCredentials:  cfg.AuthCredentials,
+		dsnEnabled:       cfg.DSNEnabled,
+		dsnFailureDomain: normalizeDomain(cfg.DSNFailureDomain),
+		xclientNetworks:  cfg.XClientNetworks,
+		allowNetworks:    cfg.AllowNetworks,
+		denyNetworks:     cfg.DenyNetworks,
+		connLimiter:      newRateLimiter(cfg.RateConnections),
+		msgLimiter:       newRateLimiter(cfg.RateMessages),
+		recipientRules:   cfg.RecipientRules,
+		bounceRules:      cfg.BounceRules,
+		rewriteRules:     cfg.RewriteRules,
+		headerRules:      cfg.HeaderRules,
+		faults:           newFaultInjector(cfg.Chaos),
+		tarpit:           cfg.Tarpit,
+		relay:            newRelayer(cfg.Relay, cfg.Domain),
+		subAddressLabel:  cfg.SubAddressLabel,
+		spfEnabled:       cfg.SPFEnabled || cfg.DMARCEnabled,
+		dkimEnabled:      cfg.DKIMEnabled || cfg.DMARCEnabled,
+		dmarcEnabled:     cfg.DMARCEnabled,
+		resolver:         newResolver(cfg),
+		transcripts:      cfg.Transcripts,
+		script:           script,
+		duplicates:       newDuplicateFilter(cfg.DuplicateMinutes),
+		queue:            newDeliveryQueue(cfg.DelaySeconds, cfg.DelayRules),
+		vrfyMode:         cfg.VRFYMode,
+		lenientAddresses: cfg.LenientAddresses,
+		addHeaders:       cfg.AddHeaders,
 		globalShutdown:   globalShutdown,
 		dataStore:        ds,
 		msgHub:           msgHub,
 		retentionScanner: NewRetentionScanner(ds, globalShutdown),
 		waitgroup:        new(sync.WaitGroup),
 	}
+	for _, lcfg := range cfg.Listeners {
+		s.listeners = append(s.listeners, NewServer(lcfg, globalShutdown, ds, msgHub))
+	}
+	return s
+}
+
+// idleTimeout converts a timeout in seconds to a Duration, falling back to maxIdleSeconds if
+// it is not set
+func idleTimeout(seconds, maxIdleSeconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = maxIdleSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// connectionAllowed applies the allow and deny network lists to the client at host
+func (s *Server) connectionAllowed(host string) bool {
+	if networksContain(s.denyNetworks, host) {
+		return false
+	}
+	return len(s.allowNetworks) == 0 || networksContain(s.allowNetworks, host)
+}
+
+// configureClientAuth enables verification of client certificates against the configured CA
+func configureClientAuth(tlsConfig *tls.Config, cfg config.SMTPConfig) error {
+	switch cfg.TLSClientAuth {
+	case "request":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil
+	}
+	pem, err := ioutil.ReadFile(cfg.TLSClientCA)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No certificates found in %v", cfg.TLSClientCA)
+	}
+	return nil
+}
+
+// newResolver creates the Resolver used for sender authentication checks, which may be
+// loaded with static records for testing
+func newResolver(cfg config.SMTPConfig) mailauth.Resolver {
+	if cfg.DNSRecordsFile == "" {
+		return mailauth.DNSResolver{}
+	}
+	var fallback mailauth.Resolver = mailauth.DNSResolver{}
+	if cfg.DNSRecordsOnly {
+		fallback = nil
+	}
+	static, err := mailauth.LoadStaticResolver(cfg.DNSRecordsFile, fallback)
+	if err != nil {
+		log.Errorf("Failed to load DNS records, using system DNS: %v", err)
+		return mailauth.DNSResolver{}
+	}
+	return static
+}
+
+// recipientRule returns the first rule rejecting the recipient address, or nil
+func (s *Server) recipientRule(address string) *config.RecipientRule {
+	return matchRecipientRule(s.recipientRules, address)
+}
+
+// bounceRule returns the first rule bouncing messages for the recipient address, or nil
+func (s *Server) bounceRule(address string) *config.RecipientRule {
+	return matchRecipientRule(s.bounceRules, address)
+}
+
+// rewriteAddress applies the first matching rewrite rule to a recipient address
+func (s *Server) rewriteAddress(address string) string {
+	for _, rule := range s.rewriteRules {
+		if rule.Pattern.MatchString(address) {
+			return rule.Pattern.ReplaceAllString(address, rule.Replacement)
+		}
+	}
+	return address
+}
+
+// matchRecipientRule returns the first of rules matching address, or nil
+func matchRecipientRule(rules []config.RecipientRule, address string) *config.RecipientRule {
+	for i := range rules {
+		if rules[i].Pattern.MatchString(address) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// headerRule returns the first rule refusing the message because of one of its headers, or
+// nil.  Encoded words in header values are decoded before matching.
+func (s *Server) headerRule(raw []byte) *config.HeaderRule {
+	if len(s.headerRules) == 0 {
+		return nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	dec := new(mime.WordDecoder)
+	for i := range s.headerRules {
+		rule := &s.headerRules[i]
+		for _, value := range msg.Header[textproto.CanonicalMIMEHeaderKey(rule.Header)] {
+			if decoded, err := dec.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			if rule.Pattern.MatchString(strings.TrimSpace(value)) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// maxMessageBytesFor returns the message size limit for the specified recipient domain
+func (s *Server) maxMessageBytesFor(domain string) int {
+	if limit, ok := s.domainMaxBytes[normalizeDomain(domain)]; ok {
+		return limit
+	}
+	return s.maxMessageBytes
+}
+
+// largestMessageBytes returns the largest message we will accept for any domain, this is
+// the value advertised by the SIZE extension
+func (s *Server) largestMessageBytes() int {
+	largest := s.maxMessageBytes
+	for _, limit := range s.domainMaxBytes {
+		if limit > largest {
+			largest = limit
+		}
+	}
+	return largest
 }
 
 // Start the listener and handle incoming connections
@@ -97,17 +342,76 @@ func (s *Server) Start(ctx context.Context) {
 		return
 	}
 
+	if cfg.ProxyProtocol {
+		log.Infof("SMTP connections must begin with a PROXY protocol header")
+		s.listener = NewProxyListener(s.listener, time.Duration(s.maxIdleSeconds)*time.Second)
+	}
+
 	if !s.storeMessages {
 		log.Infof("Load test mode active, messages will not be stored")
 	} else if s.domainNoStore != "" {
 		log.Infof("Messages sent to domain '%v' will be discarded", s.domainNoStore)
 	}
+	if s.tlsConfig != nil {
+		log.Infof("STARTTLS is available")
+	}
+	if s.authEnabled && len(s.authCredentials) == 0 {
+		log.Infof("SMTP AUTH enabled, any credentials will be accepted")
+	}
+	if s.dsnEnabled && s.dsnFailureDomain != "" {
+		log.Infof("Delivery to domain '%v' will generate failure DSNs", s.dsnFailureDomain)
+	}
+	if s.relay != nil {
+		log.Infof("Messages for %v will be relayed to %v", strings.Join(s.relay.cfg.Domains, ", "),
+			s.relay.cfg.Host)
+	}
+	if s.faults != nil {
+		log.Warnf("SMTP chaos mode active, faults will be injected into sessions")
+	}
+	if s.queue != nil {
+		log.Infof("Delivery of messages will be deferred")
+	}
 
 	// Start retention scanner
 	s.retentionScanner.Start()
 
-	// Listener go routine
-	go s.serve(ctx)
+	if cfg.LMTPEnabled {
+		lmtpAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v",
+			cfg.IP4address, cfg.LMTPPort))
+		if err != nil {
+			log.Errorf("Failed to build LMTP tcp4 address: %v", err)
+			s.emergencyShutdown()
+			return
+		}
+		log.Infof("LMTP listening on TCP4 %v", lmtpAddr)
+		s.lmtpListener, err = net.ListenTCP("tcp4", lmtpAddr)
+		if err != nil {
+			log.Errorf("LMTP failed to start tcp4 listener: %v", err)
+			s.emergencyShutdown()
+			return
+		}
+		if cfg.ProxyProtocol {
+			s.lmtpListener = NewProxyListener(s.lmtpListener,
+				time.Duration(s.maxIdleSeconds)*time.Second)
+		}
+	}
+
+	for _, l := range s.listeners {
+		if err := l.listen(); err != nil {
+			log.Errorf("SMTP failed to start listener %q: %v", l.name, err)
+			s.emergencyShutdown()
+			return
+		}
+	}
+
+	// Listener go routines
+	go s.serve(ctx, s.listener, false)
+	if s.lmtpListener != nil {
+		go s.serve(ctx, s.lmtpListener, true)
+	}
+	for _, l := range s.listeners {
+		go l.serve(ctx, l.listener, false)
+	}
 
 	// Wait for shutdown
 	select {
@@ -119,14 +423,48 @@ func (s *Server) Start(ctx context.Context) {
 	if err := s.listener.Close(); err != nil {
 		log.Errorf("Failed to close SMTP listener: %v", err)
 	}
+	if s.lmtpListener != nil {
+		if err := s.lmtpListener.Close(); err != nil {
+			log.Errorf("Failed to close LMTP listener: %v", err)
+		}
+	}
+	for _, l := range s.listeners {
+		if err := l.listener.Close(); err != nil {
+			log.Errorf("Failed to close SMTP listener %q: %v", l.name, err)
+		}
+	}
+}
+
+// listen opens the network listener for an additional [smtp.<name>] listener, which is
+// started and stopped by the primary Server
+func (s *Server) listen() error {
+	addr, err := net.ResolveTCPAddr("tcp4", s.addr)
+	if err != nil {
+		return err
+	}
+	log.Infof("SMTP listener %q listening on TCP4 %v", s.name, addr)
+	s.listener, err = net.ListenTCP("tcp4", addr)
+	if err != nil {
+		return err
+	}
+	if s.proxyProtocol {
+		s.listener = NewProxyListener(s.listener, time.Duration(s.maxIdleSeconds)*time.Second)
+	}
+	if s.tlsConfig != nil {
+		log.Infof("SMTP listener %q offers STARTTLS", s.name)
+	}
+	if s.authEnabled {
+		log.Infof("SMTP listener %q offers AUTH", s.name)
+	}
+	return nil
 }
 
-// serve is the listen/accept loop
-func (s *Server) serve(ctx context.Context) {
+// serve is the listen/accept loop, lmtp selects the protocol spoken by accepted sessions
+func (s *Server) serve(ctx context.Context, listener net.Listener, lmtp bool) {
 	// Handle incoming connections
 	var tempDelay time.Duration
 	for sessionID := 1; ; sessionID++ {
-		if conn, err := s.listener.Accept(); err != nil {
+		if conn, err := listener.Accept(); err != nil {
 			// There was an error accepting the connection
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 				// Temporary error, sleep for a bit and try again
@@ -157,7 +495,7 @@ func (s *Server) serve(ctx context.Context) {
 			tempDelay = 0
 			expConnectsTotal.Add(1)
 			s.waitgroup.Add(1)
-			go s.startSession(sessionID, conn)
+			go s.startSession(sessionID, conn, lmtp)
 		}
 	}
 }
@@ -175,7 +513,15 @@ func (s *Server) emergencyShutdown() {
 func (s *Server) Drain() {
 	// Wait for sessions to close
 	s.waitgroup.Wait()
+	for _, l := range s.listeners {
+		l.waitgroup.Wait()
+	}
 	log.Tracef("SMTP connections have drained")
+	// Deliver messages still waiting out their delay
+	s.queue.flush()
+	for _, l := range s.listeners {
+		l.queue.flush()
+	}
 	s.retentionScanner.Join()
 }
 
@@ -215,6 +561,11 @@ func init() {
 	m.Set("ErrorsHist", expErrorsHist)
 	m.Set("WarnsTotal", expWarnsTotal)
 	m.Set("WarnsHist", expWarnsHist)
+	m.Set("RcptRejectedTotal", expRcptRejected)
+	m.Set("TLSHandshakesTotal", expTLSHandshakes)
+	m.Set("TLSFailuresTotal", expTLSFailures)
+	m.Set("Commands", expCommands)
+	m.Set("Replies", expReplies)
 
 	t := time.NewTicker(time.Minute)
 	go metricsTicker(t)
@@ -0,0 +1,43 @@
+package smtpd
+
+import (
+	"crypto/subtle"
+	"path"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// privateMailboxes are the mailbox patterns that may only be read with their tokens
+var privateMailboxes []config.PrivateMailbox
+
+// SetPrivateMailboxes changes the mailboxes that may only be read with a token.  It should be
+// called before any servers are started.
+func SetPrivateMailboxes(private []config.PrivateMailbox) {
+	privateMailboxes = private
+}
+
+// MailboxPrivate returns true if the mailbox name matches the pattern of a private mailbox
+func MailboxPrivate(name string) bool {
+	for _, p := range privateMailboxes {
+		if ok, _ := path.Match(p.Pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MailboxTokenValid returns true if token is the token of a private mailbox pattern matching
+// the mailbox name
+func MailboxTokenValid(name, token string) bool {
+	valid := false
+	for _, p := range privateMailboxes {
+		if ok, _ := path.Match(p.Pattern, name); !ok {
+			continue
+		}
+		// Check every token, so that the time taken does not reveal which matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
@@ -0,0 +1,37 @@
+package smtpd
+
+import (
+	"testing"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivateMailboxes(t *testing.T) {
+	SetPrivateMailboxes([]config.PrivateMailbox{
+		{Name: "a", Pattern: "team-a*", Token: "t0k-a"},
+		{Name: "ops", Pattern: "team-*", Token: "t0k-ops"},
+	})
+	defer SetPrivateMailboxes(nil)
+
+	assert.True(t, MailboxPrivate("team-a"))
+	assert.True(t, MailboxPrivate("team-b"))
+	assert.False(t, MailboxPrivate("public"))
+
+	var testTable = []struct {
+		name, token string
+		valid       bool
+	}{
+		{"team-a", "t0k-a", true},
+		{"team-a-ci", "t0k-a", true},
+		{"team-a", "t0k-ops", true},
+		{"team-b", "t0k-a", false},
+		{"team-b", "t0k-ops", true},
+		{"team-b", "", false},
+		{"public", "t0k-a", false},
+	}
+	for _, tt := range testTable {
+		assert.Equal(t, tt.valid, MailboxTokenValid(tt.name, tt.token), "%v with %q",
+			tt.name, tt.token)
+	}
+}
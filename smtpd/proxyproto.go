@@ -0,0 +1,187 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature begins every PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyListener wraps a net.Listener.  Connections it accepts must begin with a HAProxy PROXY
+// protocol (version 1 or 2) header, which provides the address of the original client.
+type ProxyListener struct {
+	net.Listener
+	timeout time.Duration // How long to wait for the header, 0 for no limit
+}
+
+// NewProxyListener creates a ProxyListener that waits up to timeout for each header
+func NewProxyListener(l net.Listener, timeout time.Duration) *ProxyListener {
+	return &ProxyListener{Listener: l, timeout: timeout}
+}
+
+// Accept waits for the next connection.  The PROXY header is not read until the returned
+// connection is first used, so a slow client cannot block the accept loop.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, timeout: l.timeout}, nil
+}
+
+// proxyConn is a net.Conn that reports the client address from its PROXY header
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+	once    sync.Once
+	reader  *bufio.Reader
+	remote  net.Addr
+	err     error // Error parsing the PROXY header, returned by Read
+}
+
+// init reads the PROXY header on first use of the connection
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote = c.Conn.RemoteAddr()
+		if c.timeout > 0 {
+			if c.err = c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); c.err != nil {
+				return
+			}
+		}
+		var addr net.Addr
+		addr, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY header from %v: %v", c.remote, c.err)
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+		c.err = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Read reads data following the PROXY header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the original client, or of the proxy if the header did
+// not provide one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader parses a version 1 or 2 PROXY header from r.  A nil address is returned
+// for headers that do not describe a TCP client, such as health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Even the shortest v1 header is longer than the v2 signature
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("Missing PROXY protocol header")
+}
+
+// readProxyV1 parses the human readable header, such as
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 25"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid header is 107 bytes
+	line := make([]byte, 0, 107)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("PROXY v1 header too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Malformed PROXY v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("Malformed PROXY v1 header")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY v1 protocol %q", fields[1])
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid PROXY v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PROXY v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY version %v", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0F {
+	case 0x0:
+		// LOCAL command, connection was initiated by the proxy itself
+		return nil, nil
+	case 0x1:
+		// PROXY command
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY v2 command %v", hdr[12]&0x0F)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1:
+		// IPv4: src, dst addresses, then src, dst ports
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("Short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2:
+		// IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("Short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// Unspecified or unix socket
+	return nil, nil
+}
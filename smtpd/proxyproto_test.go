@@ -0,0 +1,79 @@
+package smtpd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, fam byte, payload ...byte) string {
+		hdr := append([]byte{}, proxyV2Signature...)
+		hdr = append(hdr, verCmd, fam, 0, byte(len(payload)))
+		return string(append(hdr, payload...))
+	}
+	ipv4 := []byte{10, 1, 2, 3, 192, 168, 0, 1, 0xDB, 0x04, 0, 25}
+	ipv6 := make([]byte, 36)
+	ipv6[0], ipv6[1], ipv6[15] = 0x20, 0x01, 0x01
+	ipv6[32], ipv6[33] = 0xDB, 0x04
+
+	var testTable = []struct {
+		input  string
+		expect string // Expected address, empty for none
+		ok     bool
+	}{
+		{"PROXY TCP4 10.1.2.3 192.168.0.1 56068 25\r\n", "10.1.2.3:56068", true},
+		{"PROXY TCP6 2001::1 2001::2 56068 25\r\n", "[2001::1]:56068", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", true},
+		{"PROXY TCP4 10.1.2.3 192.168.0.1 56068\r\n", "", false},
+		{"PROXY TCP4 bogus 192.168.0.1 56068 25\r\n", "", false},
+		{"PROXY TCP4 10.1.2.3 192.168.0.1 99999 25\r\n", "", false},
+		{"PROXY UDP4 10.1.2.3 192.168.0.1 56068 25\r\n", "", false},
+		{"PROXY TCP4 " + string(make([]byte, 120)) + "\r\n", "", false},
+		{"EHLO localhost\r\n", "", false},
+		{v2(0x21, 0x11, ipv4...), "10.1.2.3:56068", true},
+		{v2(0x21, 0x21, ipv6...), "[2001::1]:56068", true},
+		{v2(0x20, 0x00), "", true},
+		{v2(0x21, 0x11, ipv4[:6]...), "", false},
+		{v2(0x11, 0x11, ipv4...), "", false},
+	}
+
+	for _, tt := range testTable {
+		r := bufio.NewReader(strings.NewReader(tt.input + "rest"))
+		addr, err := readProxyHeader(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("Expected ok=%v for %q, got error %v", tt.ok, tt.input, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if tt.expect == "" {
+			assert.Nil(t, addr, "Input %q", tt.input)
+		} else if assert.NotNil(t, addr, "Input %q", tt.input) {
+			assert.Equal(t, tt.expect, addr.String(), "Input %q", tt.input)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, "rest", string(rest), "Data following header for %q", tt.input)
+	}
+}
+
+func TestProxyConn(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	pc := &proxyConn{Conn: &mockConn{serverConn}, timeout: time.Second}
+	go func() {
+		_, _ = clientConn.Write([]byte("PROXY TCP4 10.1.2.3 192.168.0.1 56068 25\r\nHELO\r\n"))
+	}()
+
+	assert.Equal(t, "10.1.2.3:56068", pc.RemoteAddr().String())
+	line, err := bufio.NewReader(pc).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "HELO\r\n", line)
+	_ = clientConn.Close()
+}
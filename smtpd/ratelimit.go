@@ -0,0 +1,78 @@
+package smtpd
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter implements a token bucket for each remote IP address.  A nil rateLimiter
+// allows everything.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // Tokens added per second
+	burst     float64 // Maximum tokens held by a bucket
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time // Replaceable for tests
+}
+
+// tokenBucket tracks the available tokens for a single key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rateLimiter permitting perMinute events per key, with bursts of up
+// to perMinute events.  Returns nil if perMinute is not positive.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the bucket for key, returning false if none were available
+func (r *rateLimiter) allow(key string) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep discards buckets that have refilled completely, they are indistinguishable from new
+// buckets.  Must be called with the lock held.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *rateLimiter
+	assert.True(t, nilLimiter.allow("1.2.3.4"), "nil limiter allows everything")
+	assert.Nil(t, newRateLimiter(0), "Zero rate should be unlimited")
+
+	clock := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(3)
+	rl.now = func() time.Time { return clock }
+
+	// Burst up to the limit
+	for i := 0; i < 3; i++ {
+		assert.True(t, rl.allow("1.2.3.4"), "Request %v should be allowed", i)
+	}
+	assert.False(t, rl.allow("1.2.3.4"), "Burst exceeded")
+	assert.True(t, rl.allow("5.6.7.8"), "Other addresses are unaffected")
+
+	// 3 per minute refills a token every 20 seconds
+	clock = clock.Add(10 * time.Second)
+	assert.False(t, rl.allow("1.2.3.4"), "Not yet refilled")
+	clock = clock.Add(10 * time.Second)
+	assert.True(t, rl.allow("1.2.3.4"), "Refilled one token")
+	assert.False(t, rl.allow("1.2.3.4"), "Only one token refilled")
+
+	// Idle buckets are discarded once full
+	clock = clock.Add(time.Hour)
+	assert.True(t, rl.allow("1.2.3.4"))
+	assert.Len(t, rl.buckets, 1, "Full bucket for 5.6.7.8 should have been swept")
+}
@@ -0,0 +1,159 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// tlsVersionNames maps TLS protocol versions to the names used in Received headers
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSLv3",
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	0x0304:           "TLSv1.3",
+}
+
+// tlsCipherNames maps cipher suites to their IANA names
+var tlsCipherNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// receivedHeader generates an RFC 5321 trace header for the current transaction.  The for
+// clause is omitted if recipient is empty.
+func (ss *Session) receivedHeader(recipient string, now time.Time) string {
+	helo := ss.remoteDomain
+	if helo == "" {
+		helo = "unknown"
+	}
+	recd := fmt.Sprintf("Received: from %s ([%s])\r\n", helo, ss.remoteHost)
+	if ss.tlsState != nil {
+		recd += fmt.Sprintf("  (using %s with cipher %s)\r\n",
+			tlsVersionName(ss.tlsState.Version), tlsCipherName(ss.tlsState.CipherSuite))
+	}
+	recd += fmt.Sprintf("  by %s (Inbucket) with %s id %v", ss.server.domain,
+		ss.withProtocol(), ss.id)
+	if recipient != "" {
+		recd += fmt.Sprintf("\r\n  for <%s>", recipient)
+	}
+	return recd + fmt.Sprintf("; %s\r\n", now.Format(timeStampFormat))
+}
+
+// authResultsHeader generates an RFC 7601 header describing the sender authentication checks
+// performed, or an empty string if there were none
+func (ss *Session) authResultsHeader() string {
+	var results []string
+	if ss.spf != "" {
+		results = append(results, fmt.Sprintf("spf=%s smtp.mailfrom=%s", ss.spf, ss.from))
+	}
+	if ss.dkimChecked && len(ss.dkim) == 0 {
+		results = append(results, "dkim=none")
+	}
+	for _, r := range ss.dkim {
+		result := fmt.Sprintf("dkim=%s header.d=%s header.s=%s", r.Result, r.Domain, r.Selector)
+		if r.Reason != "" {
+			result += fmt.Sprintf(" reason=%q", r.Reason)
+		}
+		results = append(results, result)
+	}
+	if ss.dmarc.Result != "" {
+		result := fmt.Sprintf("dmarc=%s", ss.dmarc.Result)
+		if ss.dmarc.Policy != "" {
+			result += fmt.Sprintf(" (p=%s)", ss.dmarc.Policy)
+		}
+		if ss.dmarc.Domain != "" {
+			result += fmt.Sprintf(" header.from=%s", ss.dmarc.Domain)
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Authentication-Results: %s;\r\n  %s\r\n", ss.server.domain,
+		strings.Join(results, ";\r\n  "))
+}
+
+// missingHeaders generates the Message-ID and Date header fields that raw lacks, returning
+// them along with the names of the fields added
+func (ss *Session) missingHeaders(raw []byte, now time.Time) (string, []string) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		// Without a readable header we cannot tell what is missing
+		return "", nil
+	}
+	var fields string
+	var names []string
+	if header.Get("Message-Id") == "" {
+		fields += fmt.Sprintf("Message-ID: <%d.%d@%s>\r\n", now.UnixNano(), ss.id,
+			ss.server.domain)
+		names = append(names, "Message-ID")
+	}
+	if header.Get("Date") == "" {
+		fields += fmt.Sprintf("Date: %s\r\n", now.Format(time.RFC1123Z))
+		names = append(names, "Date")
+	}
+	return fields, names
+}
+
+// withProtocol returns the RFC 3848 protocol type for the Received header with clause
+func (ss *Session) withProtocol() string {
+	proto := "SMTP"
+	switch {
+	case ss.lmtp:
+		proto = "LMTP"
+	case ss.extended:
+		proto = "ESMTP"
+	}
+	if ss.smtpUTF8 {
+		// RFC 6531 uses UTF8SMTP in place of ESMTP
+		proto = "UTF8" + proto[len(proto)-4:]
+	}
+	if ss.tlsState != nil {
+		proto += "S"
+	}
+	if ss.authUser != "" {
+		proto += "A"
+	}
+	return proto
+}
+
+// tlsVersionName returns a human readable name for a TLS protocol version
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// tlsCipherName returns the IANA name of a TLS cipher suite
+func tlsCipherName(suite uint16) string {
+	if name, ok := tlsCipherNames[suite]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", suite)
+}
@@ -0,0 +1,108 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/mailauth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceivedHeader(t *testing.T) {
+	now := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+	ss := &Session{
+		server:       &Server{domain: "inbucket.local"},
+		id:           42,
+		remoteDomain: "client.example.com",
+		remoteHost:   "192.0.2.1",
+		extended:     true,
+	}
+	assert.Equal(t,
+		"Received: from client.example.com ([192.0.2.1])\r\n"+
+			"  by inbucket.local (Inbucket) with ESMTP id 42\r\n"+
+			"  for <u1@example.com>; Sat, 04 Mar 2017 05:06:07 +0000 (UTC)\r\n",
+		ss.receivedHeader("u1@example.com", now))
+
+	ss.tlsState = &tls.ConnectionState{Version: tls.VersionTLS12,
+		CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	ss.authUser = "user"
+	assert.Equal(t,
+		"Received: from client.example.com ([192.0.2.1])\r\n"+
+			"  (using TLSv1.2 with cipher TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)\r\n"+
+			"  by inbucket.local (Inbucket) with ESMTPSA id 42; "+
+			"Sat, 04 Mar 2017 05:06:07 +0000 (UTC)\r\n",
+		ss.receivedHeader("", now))
+}
+
+func TestAuthResultsHeader(t *testing.T) {
+	ss := &Session{server: &Server{domain: "inbucket.local"}, from: "joe@example.com"}
+	assert.Equal(t, "", ss.authResultsHeader())
+
+	ss.spf = mailauth.SPFPass
+	ss.dkimChecked = true
+	assert.Equal(t,
+		"Authentication-Results: inbucket.local;\r\n"+
+			"  spf=pass smtp.mailfrom=joe@example.com;\r\n"+
+			"  dkim=none\r\n",
+		ss.authResultsHeader())
+
+	ss.dkim = []mailauth.DKIMResult{
+		{Domain: "example.com", Selector: "s1", Result: mailauth.DKIMPass},
+		{Domain: "example.com", Selector: "s2", Result: mailauth.DKIMFail,
+			Reason: "body hash did not verify"},
+	}
+	assert.Equal(t,
+		"Authentication-Results: inbucket.local;\r\n"+
+			"  spf=pass smtp.mailfrom=joe@example.com;\r\n"+
+			"  dkim=pass header.d=example.com header.s=s1;\r\n"+
+			"  dkim=fail header.d=example.com header.s=s2 reason=\"body hash did not verify\"\r\n",
+		ss.authResultsHeader())
+
+	ss.spf, ss.dkim, ss.dkimChecked = "", nil, false
+	ss.dmarc = mailauth.DMARCResult{Result: mailauth.DMARCFail, Domain: "example.com",
+		Policy: "reject"}
+	assert.Equal(t,
+		"Authentication-Results: inbucket.local;\r\n"+
+			"  dmarc=fail (p=reject) header.from=example.com\r\n",
+		ss.authResultsHeader())
+}
+
+func TestWithProtocol(t *testing.T) {
+	var table = []struct {
+		ss     Session
+		expect string
+	}{
+		{Session{}, "SMTP"},
+		{Session{extended: true}, "ESMTP"},
+		{Session{extended: true, smtpUTF8: true}, "UTF8SMTP"},
+		{Session{extended: true, authUser: "u"}, "ESMTPA"},
+		{Session{extended: true, tlsState: &tls.ConnectionState{}}, "ESMTPS"},
+		{Session{lmtp: true, extended: true}, "LMTP"},
+		{Session{lmtp: true, extended: true, smtpUTF8: true}, "UTF8LMTP"},
+	}
+	for _, tt := range table {
+		assert.Equal(t, tt.expect, tt.ss.withProtocol())
+	}
+}
+
+func TestMissingHeaders(t *testing.T) {
+	now := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+	ss := &Session{server: &Server{domain: "inbucket.local"}, id: 42}
+
+	fields, names := ss.missingHeaders([]byte("Subject: test\r\n\r\nbody\r\n"), now)
+	assert.Equal(t, "Message-ID: <1488603967000000000.42@inbucket.local>\r\n"+
+		"Date: Sat, 04 Mar 2017 05:06:07 +0000\r\n", fields)
+	assert.Equal(t, []string{"Message-ID", "Date"}, names)
+
+	fields, names = ss.missingHeaders(
+		[]byte("Message-Id: <a@b>\r\nSubject: test\r\n\r\nDate: body\r\n"), now)
+	assert.Equal(t, "Date: Sat, 04 Mar 2017 05:06:07 +0000\r\n", fields)
+	assert.Equal(t, []string{"Date"}, names)
+
+	// Header without a body
+	fields, names = ss.missingHeaders(
+		[]byte("Message-ID: <a@b>\r\nDate: Sat, 04 Mar 2017 05:06:07 +0000\r\n"), now)
+	assert.Equal(t, "", fields)
+	assert.Nil(t, names)
+}
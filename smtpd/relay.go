@@ -0,0 +1,153 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/jhillyerd/inbucket/log"
+)
+
+// relayer forwards messages for selected domains to an upstream SMTP server.  A nil relayer
+// relays nothing.
+type relayer struct {
+	cfg     config.RelayConfig
+	helo    string // Domain we identify as to the upstream server
+	domains map[string]bool
+}
+
+// newRelayer creates a relayer, returns nil if no relay domains are configured
+func newRelayer(cfg config.RelayConfig, helo string) *relayer {
+	if len(cfg.Domains) == 0 {
+		return nil
+	}
+	r := &relayer{cfg: cfg, helo: helo, domains: make(map[string]bool)}
+	for _, domain := range cfg.Domains {
+		r.domains[normalizeDomain(domain)] = true
+	}
+	return r
+}
+
+// relays returns true if messages for the domain should be sent upstream instead of stored
+func (r *relayer) relays(domain string) bool {
+	return r != nil && r.domains[normalizeDomain(domain)]
+}
+
+// send delivers a message to the upstream server
+func (r *relayer) send(from string, to []string, data []byte) error {
+	host, _, err := net.SplitHostPort(r.cfg.Host)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	var c *smtp.Client
+	if r.cfg.Security == "tls" {
+		conn, err := tls.Dial("tcp", r.cfg.Host, tlsConfig)
+		if err != nil {
+			return err
+		}
+		if c, err = smtp.NewClient(conn, host); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	} else if c, err = smtp.Dial(r.cfg.Host); err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+
+	if err := c.Hello(r.helo); err != nil {
+		return err
+	}
+	if r.cfg.Security != "none" && r.cfg.Security != "tls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if r.cfg.Security == "starttls" {
+			return fmt.Errorf("Upstream server %v does not support STARTTLS", r.cfg.Host)
+		}
+	}
+	if r.cfg.Username != "" {
+		auth := smtp.PlainAuth("", r.cfg.Username, r.cfg.Password, host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, recip := range to {
+		if err := c.Rcpt(recip); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// relayMessage sends the message to the upstream server in the background, so the client is
+// not kept waiting.  Failures are logged, the client has already been told the message was
+// accepted.
+func (ss *Session) relayMessage(to []string, msgBuf [][]byte) {
+	recd := ss.receivedHeader("", time.Now())
+	data := append([]byte(recd), bytes.Join(msgBuf, nil)...)
+	prefix := fmt.Sprintf("%v[%v]<%v>", ss.protocol(), ss.remoteHost, ss.id)
+	from := ss.from
+	relay := ss.server.relay
+
+	ss.server.waitgroup.Add(1)
+	go func() {
+		defer ss.server.waitgroup.Done()
+		if err := relay.send(from, to, data); err != nil {
+			expWarnsTotal.Add(1)
+			log.Warnf("%v Failed to relay message for %v: %v", prefix, to, err)
+			return
+		}
+		log.Infof("%v Relayed message for %v to %v", prefix, to, relay.cfg.Host)
+	}()
+}
+
+// ErrReleaseDisabled indicates no upstream server is configured to release messages to
+var ErrReleaseDisabled = errors.New("Message release is not configured")
+
+// ReleaseMessage re-sends a stored message to the specified recipients through the upstream
+// server configured by relay.host.  The reverse-path is the original envelope sender if it
+// was recorded, otherwise the address in the From header.
+func ReleaseMessage(cfg config.SMTPConfig, msg Message, to []string) error {
+	if cfg.Relay.Host == "" {
+		return ErrReleaseDisabled
+	}
+	raw, err := msg.ReadRaw()
+	if err != nil {
+		return err
+	}
+	from := msg.Delivery().MailFrom
+	if from == "" {
+		if addr, err := mail.ParseAddress(msg.From()); err == nil {
+			from = addr.Address
+		}
+	}
+	r := &relayer{cfg: cfg.Relay, helo: cfg.Domain}
+	if err := r.send(from, to, []byte(*raw)); err != nil {
+		return err
+	}
+	log.Infof("Released message %v for %v to %v", msg.ID(), to, cfg.Relay.Host)
+	return nil
+}
@@ -0,0 +1,189 @@
+package smtpd
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// upstreamMessage records a transaction received by fakeUpstream
+type upstreamMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeUpstream accepts a single SMTP transaction on a random port, returning its address
+// and a channel the transaction will be sent to
+func fakeUpstream(t *testing.T) (string, <-chan upstreamMessage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan upstreamMessage, 1)
+	go func() {
+		defer func() {
+			_ = l.Close()
+		}()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := textproto.NewConn(conn)
+		defer func() {
+			_ = c.Close()
+		}()
+		var msg upstreamMessage
+		_ = c.PrintfLine("220 upstream ready")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(line[:4]); cmd {
+			case "EHLO":
+				_ = c.PrintfLine("250 upstream")
+			case "MAIL":
+				msg.from = strings.Trim(line[10:], "<>")
+				_ = c.PrintfLine("250 OK")
+			case "RCPT":
+				msg.to = append(msg.to, strings.Trim(line[8:], "<>"))
+				_ = c.PrintfLine("250 OK")
+			case "DATA":
+				_ = c.PrintfLine("354 Go ahead")
+				lines, err := c.ReadDotLines()
+				if err != nil {
+					return
+				}
+				msg.data = strings.Join(lines, "\n")
+				_ = c.PrintfLine("250 OK")
+			case "QUIT":
+				_ = c.PrintfLine("221 Bye")
+				received <- msg
+				return
+			default:
+				_ = c.PrintfLine("502 Unsupported")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestRelayerRelays(t *testing.T) {
+	var r *relayer
+	assert.False(t, r.relays("example.com"), "nil relayer should relay nothing")
+
+	r = newRelayer(config.RelayConfig{Domains: []string{"example.com"}}, "inbucket.local")
+	assert.True(t, r.relays("example.com"))
+	assert.True(t, r.relays("EXAMPLE.com"))
+	assert.False(t, r.relays("sub.example.com"))
+	assert.Nil(t, newRelayer(config.RelayConfig{Host: "localhost:25"}, "inbucket.local"))
+}
+
+func TestRelayerSend(t *testing.T) {
+	addr, received := fakeUpstream(t)
+	r := newRelayer(config.RelayConfig{Domains: []string{"example.com"}, Host: addr},
+		"inbucket.local")
+	err := r.send("john@gmail.com", []string{"u1@example.com", "u2@example.com"},
+		[]byte("Subject: test\r\n\r\n.leading dot\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		assert.Equal(t, "john@gmail.com", msg.from)
+		assert.Equal(t, []string{"u1@example.com", "u2@example.com"}, msg.to)
+		assert.Equal(t, "Subject: test\n\n.leading dot", msg.data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for upstream to receive message")
+	}
+}
+
+func TestReleaseMessage(t *testing.T) {
+	raw := "From: James <james@host>\r\nSubject: test\r\n\r\nHi\r\n"
+	msg := &MockMessage{}
+	msg.On("ID").Return("0001")
+	msg.On("From").Return("James <james@host>")
+	msg.On("ReadRaw").Return(&raw, nil)
+	msg.On("Delivery").Return(Delivery{})
+
+	err := ReleaseMessage(config.SMTPConfig{}, msg, []string{"real@example.com"})
+	assert.Equal(t, ErrReleaseDisabled, err)
+
+	// Without an envelope sender, the From header is used
+	addr, received := fakeUpstream(t)
+	cfg := config.SMTPConfig{Domain: "inbucket.local", Relay: config.RelayConfig{Host: addr}}
+	if err := ReleaseMessage(cfg, msg, []string{"real@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case up := <-received:
+		assert.Equal(t, "james@host", up.from)
+		assert.Equal(t, []string{"real@example.com"}, up.to)
+		assert.Equal(t, "From: James <james@host>\nSubject: test\n\nHi", up.data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for upstream to receive message")
+	}
+}
+
+// Test that only relay domain recipients are sent upstream
+func TestRelaySession(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("local")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	addr, received := fakeUpstream(t)
+	cfg := testSMTPConfig()
+	cfg.Relay = config.RelayConfig{Domains: []string{"real.com"}, Host: addr}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@real.com>", 250},
+		{"RCPT TO:<local@inbucket.local>", 250},
+		{"DATA", 354},
+		{"Subject: relayed\r\n\r\nHi!\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "john@gmail.com", msg.from)
+		assert.Equal(t, []string{"u1@real.com"}, msg.to)
+		assert.Contains(t, msg.data, "Subject: relayed")
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for upstream to receive message")
+	}
+	mds.AssertNumberOfCalls(t, "MailboxFor", 1)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -3,6 +3,8 @@ package smtpd
 import (
 	"container/list"
 	"expvar"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -175,3 +177,19 @@ func getRetentionScanCompleted() time.Time {
 func secondsSinceRetentionScanCompleted() interface{} {
 	return time.Since(getRetentionScanCompleted()) / time.Second
 }
+
+// RetentionDeletes returns the number of messages deleted by the retention scanner since
+// Inbucket started, and the number deleted in about the last hour
+func RetentionDeletes() (total, lastHour int64) {
+	total, _ = strconv.ParseInt(expRetentionDeletesTotal.String(), 10, 64)
+	lastHour = total
+	// The history holds the total as of each of the last 61 minutes, oldest first
+	hist, _ := strconv.Unquote(expRetentionDeletesHist.String())
+	if i := strings.Index(hist, ","); i > 0 {
+		hist = hist[:i]
+	}
+	if first, err := strconv.ParseInt(hist, 10, 64); err == nil {
+		lastHour = total - first
+	}
+	return total, lastHour
+}
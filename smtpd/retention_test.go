@@ -62,6 +62,24 @@ func TestDoRetentionScan(t *testing.T) {
 	old3.AssertNumberOfCalls(t, "Delete", 1)
 }
 
+func TestRetentionDeletes(t *testing.T) {
+	defer expRetentionDeletesTotal.Set(0)
+	defer expRetentionDeletesHist.Set("")
+
+	// Less than a minute of history
+	expRetentionDeletesTotal.Set(3)
+	expRetentionDeletesHist.Set("")
+	if total, lastHour := RetentionDeletes(); total != 3 || lastHour != 3 {
+		t.Errorf("RetentionDeletes() == %v, %v, want 3, 3", total, lastHour)
+	}
+
+	expRetentionDeletesTotal.Set(10)
+	expRetentionDeletesHist.Set("4,6,9")
+	if total, lastHour := RetentionDeletes(); total != 10 || lastHour != 6 {
+		t.Errorf("RetentionDeletes() == %v, %v, want 10, 6", total, lastHour)
+	}
+}
+
 // Make a MockMessage of a specific age
 func mockMessage(ageHours int) *MockMessage {
 	msg := &MockMessage{}
@@ -101,6 +119,11 @@ func (m *MockMailbox) GetMessage(id string) (Message, error) {
 	return args.Get(0).(Message), args.Error(1)
 }
 
+func (m *MockMailbox) CopyMessage(msg Message) (Message, error) {
+	args := m.Called(msg)
+	return args.Get(0).(Message), args.Error(1)
+}
+
 func (m *MockMailbox) Purge() error {
 	args := m.Called()
 	return args.Error(0)
@@ -195,3 +218,32 @@ func (m *MockMessage) String() string {
 	args := m.Called()
 	return args.String(0)
 }
+
+func (m *MockMessage) UIDL() string {
+	args := m.Called()
+	return args.String(0)
+}
+
+func (m *MockMessage) IMAPUID() uint32 {
+	args := m.Called()
+	return args.Get(0).(uint32)
+}
+
+func (m *MockMessage) Delivery() Delivery {
+	args := m.Called()
+	return args.Get(0).(Delivery)
+}
+
+func (m *MockMessage) SetDelivery(d Delivery) {
+	m.Called(d)
+}
+
+func (m *MockMessage) Flags() []string {
+	args := m.Called()
+	return args.Get(0).([]string)
+}
+
+func (m *MockMessage) SetFlags(flags []string) error {
+	args := m.Called(flags)
+	return args.Error(0)
+}
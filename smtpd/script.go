@@ -0,0 +1,116 @@
+package smtpd
+
+import (
+	"fmt"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scriptEngine runs the Lua hooks defined by the SMTP script file.  A Lua state may only be
+// used by one goroutine at a time, so hook calls are serialized.
+//
+// Hooks are global functions named on_connect(session), on_mail(session, from),
+// on_rcpt(session, to) and on_data(session, data).  A hook accepts by returning nothing,
+// or rejects by returning a 4xx or 5xx reply code and optional text.  on_data may also
+// return a string to replace the message data.
+type scriptEngine struct {
+	mu    sync.Mutex
+	state *lua.LState
+}
+
+// newScriptEngine loads the Lua script at path, returns nil if path is empty
+func newScriptEngine(path string) (*scriptEngine, error) {
+	if path == "" {
+		return nil, nil
+	}
+	state := lua.NewState()
+	if err := state.DoFile(path); err != nil {
+		state.Close()
+		return nil, err
+	}
+	return &scriptEngine{state: state}, nil
+}
+
+// scriptResult is the outcome of a script hook
+type scriptResult struct {
+	code int    // Reply code if the hook rejected, 0 if it accepted
+	text string // Reply text to accompany code
+	data []byte // Replacement message data from on_data, nil if unchanged
+}
+
+// call runs the named hook, if the script defines it
+func (e *scriptEngine) call(ss *Session, hook string, args ...string) (result scriptResult,
+	err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	L := e.state
+	fn := L.GetGlobal(hook)
+	if fn.Type() != lua.LTFunction {
+		return result, nil
+	}
+	params := []lua.LValue{e.sessionTable(ss)}
+	for _, arg := range args {
+		params = append(params, lua.LString(arg))
+	}
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, params...); err != nil {
+		return result, err
+	}
+	ret, text := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	switch ret := ret.(type) {
+	case lua.LNumber:
+		result.code = int(ret)
+		if result.code < 400 || result.code > 599 {
+			return scriptResult{}, fmt.Errorf("%v returned invalid reply code %v", hook, ret)
+		}
+		result.text = lua.LVAsString(text)
+	case lua.LString:
+		if hook != "on_data" {
+			return scriptResult{}, fmt.Errorf("%v may not return message data", hook)
+		}
+		result.data = []byte(ret)
+	}
+	return result, nil
+}
+
+// sessionTable describes the session to a hook
+func (e *scriptEngine) sessionTable(ss *Session) *lua.LTable {
+	L := e.state
+	t := L.NewTable()
+	L.SetField(t, "id", lua.LNumber(ss.id))
+	L.SetField(t, "remote_addr", lua.LString(ss.remoteHost))
+	L.SetField(t, "helo", lua.LString(ss.remoteDomain))
+	L.SetField(t, "auth_user", lua.LString(ss.authUser))
+	L.SetField(t, "tls", lua.LBool(ss.tlsState != nil))
+	L.SetField(t, "from", lua.LString(ss.from))
+	recipients := L.NewTable()
+	if ss.recipients != nil {
+		for el := ss.recipients.Front(); el != nil; el = el.Next() {
+			recipients.Append(lua.LString(el.Value.(string)))
+		}
+	}
+	L.SetField(t, "recipients", recipients)
+	return t
+}
+
+// runScript calls the named script hook, and returns the reply to send the client if the
+// hook rejected the command or failed.  The reply is empty if the command may proceed.
+func (ss *Session) runScript(hook string, args ...string) (reply string, data []byte) {
+	if ss.server.script == nil {
+		return "", nil
+	}
+	result, err := ss.server.script.call(ss, hook, args...)
+	if err != nil {
+		ss.logError("Script %v failed: %v", hook, err)
+		return "451 Local error in processing", nil
+	}
+	if result.code == 0 {
+		return "", result.data
+	}
+	ss.logInfo("Script %v rejected with %v %v", hook, result.code, result.text)
+	if result.text == "" {
+		result.text = "Rejected by script"
+	}
+	return fmt.Sprintf("%v %v", result.code, result.text), nil
+}
@@ -0,0 +1,167 @@
+package smtpd
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testScript = `
+function on_connect(s)
+  if s.remote_addr == "192.0.2.9" then
+    return 554, "Go away"
+  end
+end
+
+function on_mail(s, from)
+  if from == "spam@example.com" then
+    return 550, "No spam"
+  end
+end
+
+function on_rcpt(s, to)
+  if #s.recipients > 0 and to == "late@gmail.com" then
+    return 452
+  end
+end
+
+function on_data(s, data)
+  if string.find(data, "REJECT") then
+    return 554, "Content rejected"
+  end
+  if string.find(data, "BROKEN") then
+    return 200, "Not a rejection"
+  end
+  return "X-Sender: " .. s.from .. "\r\n" .. data
+end
+`
+
+// writeTestScript writes a Lua script to a temporary file
+func writeTestScript(t *testing.T, script string) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "inbucket-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "hooks.lua")
+	if err := ioutil.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestNewScriptEngine(t *testing.T) {
+	e, err := newScriptEngine("")
+	assert.Nil(t, e)
+	assert.Nil(t, err)
+
+	path, cleanup := writeTestScript(t, "function on_connect(s")
+	defer cleanup()
+	_, err = newScriptEngine(path)
+	assert.Error(t, err, "Expected syntax error")
+}
+
+func TestScriptEngineCall(t *testing.T) {
+	path, cleanup := writeTestScript(t, testScript)
+	defer cleanup()
+	e, err := newScriptEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &Session{remoteHost: "192.0.2.9", from: "joe@example.com", recipients: list.New()}
+
+	r, err := e.call(ss, "on_connect")
+	assert.Nil(t, err)
+	assert.Equal(t, scriptResult{code: 554, text: "Go away"}, r)
+
+	r, err = e.call(ss, "on_rcpt", "late@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, scriptResult{}, r, "Expected first recipient to be accepted")
+	ss.recipients.PushBack("u1@gmail.com")
+	r, err = e.call(ss, "on_rcpt", "late@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, scriptResult{code: 452}, r)
+
+	r, err = e.call(ss, "on_data", "Subject: hi\r\n\r\nHi\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "X-Sender: joe@example.com\r\nSubject: hi\r\n\r\nHi\r\n", string(r.data))
+
+	_, err = e.call(ss, "on_data", "BROKEN")
+	assert.Error(t, err, "Expected error for reply code 200")
+
+	r, err = e.call(ss, "on_undefined")
+	assert.Nil(t, err)
+	assert.Equal(t, scriptResult{}, r)
+}
+
+// Test script hooks during an SMTP session
+func TestScriptHooks(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+	mb1 := &MockMailbox{}
+	msg1 := &MockMessage{}
+	mds.On("MailboxFor").Return(mb1, nil)
+	mb1.On("NewMessage").Return(msg1, nil)
+	mb1.On("Name").Return("u1")
+	msg1.On("ID").Return("")
+	msg1.On("From").Return("")
+	msg1.On("To").Return(make([]string, 0))
+	msg1.On("Date").Return(time.Time{})
+	msg1.On("Subject").Return("")
+	msg1.On("Size").Return(0)
+	msg1.On("Close").Return(nil)
+	msg1.On("SetDelivery", mock.Anything).Return()
+
+	path, cleanup := writeTestScript(t, testScript)
+	defer cleanup()
+	cfg := testSMTPConfig()
+	cfg.ScriptFile = path
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<spam@example.com>", 550},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<late@gmail.com>", 250},
+		{"RCPT TO:<late@gmail.com>", 452},
+		{"DATA", 354},
+		{"Subject: REJECT\r\n\r\nHi\r\n.", 554},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: BROKEN\r\n\r\nHi\r\n.", 451},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: hello\r\n\r\nHi\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	mds.AssertNumberOfCalls(t, "MailboxFor", 3)
+	msg1.AssertNumberOfCalls(t, "SetDelivery", 1)
+
+	// The connection hook may refuse the client before the greeting
+	c := textproto.NewConn(setupSessionFrom(server, "192.0.2.9"))
+	if _, _, err := c.ReadCodeLine(554); err != nil {
+		t.Errorf("Expected 554 from on_connect, got %v", err)
+	}
+	_ = c.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
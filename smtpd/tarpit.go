@@ -0,0 +1,85 @@
+package smtpd
+
+import (
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+)
+
+// defaultTarpitMaxDelay limits tarpit delays when no maximum is configured
+const defaultTarpitMaxDelay = time.Minute
+
+// tarpit tracks the errors and command rate of a single session, and progressively delays
+// replies once the session misbehaves.  A nil tarpit never delays.
+type tarpit struct {
+	cfg      config.TarpitConfig
+	maxDelay time.Duration
+	errors   int       // Error replies sent to the client
+	window   time.Time // Start of the current one second command window
+	commands int       // Commands received in the current window
+	offenses int       // Errors and excess commands since triggering, 0 if not tarpitted
+	now      func() time.Time
+}
+
+// newTarpit creates a tarpit for a session, returns nil if tarpitting is disabled
+func newTarpit(cfg config.TarpitConfig) *tarpit {
+	if cfg.Errors <= 0 && cfg.Commands <= 0 || cfg.DelayMillis <= 0 {
+		return nil
+	}
+	maxDelay := time.Duration(cfg.MaxDelayMillis) * time.Millisecond
+	if maxDelay <= 0 {
+		maxDelay = defaultTarpitMaxDelay
+	}
+	return &tarpit{cfg: cfg, maxDelay: maxDelay, now: time.Now}
+}
+
+// reply records a reply sent to the client, class is the first digit of the reply code
+func (t *tarpit) reply(class byte) {
+	if t == nil || class != '4' && class != '5' {
+		return
+	}
+	t.errors++
+	if t.cfg.Errors > 0 && t.errors >= t.cfg.Errors {
+		t.offenses++
+	}
+}
+
+// command records a command received from the client
+func (t *tarpit) command() {
+	if t == nil {
+		return
+	}
+	now := t.now()
+	if now.Sub(t.window) >= time.Second {
+		t.window = now
+		t.commands = 0
+	}
+	t.commands++
+	if t.cfg.Commands > 0 && t.commands > t.cfg.Commands {
+		t.offenses++
+	}
+}
+
+// delay returns how long to wait before processing the next command
+func (t *tarpit) delay() time.Duration {
+	if t == nil || t.offenses == 0 {
+		return 0
+	}
+	d := time.Duration(t.cfg.DelayMillis) * time.Millisecond
+	for i := 1; i < t.offenses && d < t.maxDelay; i++ {
+		d *= 2
+	}
+	if d > t.maxDelay {
+		d = t.maxDelay
+	}
+	return d
+}
+
+// tarpitDelay holds up processing of the current command if the session is tarpitted.
+// Replies to earlier pipelined commands are held up as well.
+func (ss *Session) tarpitDelay() {
+	if d := ss.tarpit.delay(); d > 0 {
+		ss.logInfo("Tarpit: delaying command by %v", d)
+		time.Sleep(d)
+	}
+}
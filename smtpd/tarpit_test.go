@@ -0,0 +1,90 @@
+package smtpd
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTarpit(t *testing.T) {
+	assert.Nil(t, newTarpit(config.TarpitConfig{DelayMillis: 100}), "Expected no triggers")
+	assert.Nil(t, newTarpit(config.TarpitConfig{Errors: 3}), "Expected no delay")
+
+	var tp *tarpit
+	tp.reply('5')
+	tp.command()
+	assert.Equal(t, time.Duration(0), tp.delay())
+}
+
+func TestTarpitErrors(t *testing.T) {
+	tp := newTarpit(config.TarpitConfig{Errors: 2, DelayMillis: 100, MaxDelayMillis: 350})
+	tp.reply('2')
+	tp.reply('5')
+	assert.Equal(t, time.Duration(0), tp.delay(), "Below error threshold")
+	tp.reply('4')
+	assert.Equal(t, 100*time.Millisecond, tp.delay())
+	tp.reply('3')
+	assert.Equal(t, 100*time.Millisecond, tp.delay(), "Non-error replies are not offenses")
+	tp.reply('5')
+	assert.Equal(t, 200*time.Millisecond, tp.delay())
+	tp.reply('5')
+	assert.Equal(t, 350*time.Millisecond, tp.delay(), "Expected delay to be capped")
+}
+
+func TestTarpitCommands(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	tp := newTarpit(config.TarpitConfig{Commands: 2, DelayMillis: 100})
+	tp.now = func() time.Time { return now }
+
+	tp.command()
+	tp.command()
+	assert.Equal(t, time.Duration(0), tp.delay(), "Within command rate")
+	tp.command()
+	assert.Equal(t, 100*time.Millisecond, tp.delay())
+
+	// A new window starts the count over, but the session stays tarpitted
+	now = now.Add(time.Second)
+	tp.command()
+	tp.command()
+	assert.Equal(t, 100*time.Millisecond, tp.delay())
+	tp.command()
+	assert.Equal(t, 200*time.Millisecond, tp.delay())
+	assert.Equal(t, defaultTarpitMaxDelay, tp.maxDelay)
+}
+
+// Test commands are delayed once a session is tarpitted
+func TestTarpitSession(t *testing.T) {
+	// Setup mock objects
+	mds := &MockDataStore{}
+
+	cfg := testSMTPConfig()
+	cfg.Tarpit = config.TarpitConfig{Errors: 1, DelayMillis: 200}
+	server, logbuf, teardown := setupSMTPServerConfig(mds, cfg)
+	defer teardown()
+
+	start := time.Now()
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"NOOP", 250},
+		{"BOGUS", 500},
+		{"NOOP", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	// The NOOP and QUIT following the error are delayed
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected session to be tarpitted, took %v", elapsed)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
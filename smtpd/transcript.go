@@ -0,0 +1,65 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// maxTranscriptBytes limits the size of a session transcript, as it is stored with every
+// message delivered during the session
+const maxTranscriptBytes = 64 * 1024
+
+// Transcript records the commands and replies of an SMTP or POP3 session, a nil Transcript
+// records nothing
+type Transcript struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// Client records a line received from the client, credentials sent with AUTH or PASS are
+// masked
+func (t *Transcript) Client(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) > 5 && strings.EqualFold(line[:5], "AUTH ") {
+		// Keep the mechanism, but not an initial response
+		if fields := strings.Fields(line); len(fields) > 2 {
+			line = fields[0] + " " + fields[1] + " [credentials]"
+		}
+	} else if len(line) > 5 && strings.EqualFold(line[:5], "PASS ") {
+		line = line[:5] + "[credentials]"
+	}
+	t.add("C: " + line)
+}
+
+// Server records a reply sent to the client
+func (t *Transcript) Server(line string) {
+	t.add("S: " + line)
+}
+
+// Note records an event that is not part of the command/reply exchange
+func (t *Transcript) Note(format string, args ...interface{}) {
+	t.add("-- " + fmt.Sprintf(format, args...))
+}
+
+// add appends line to the transcript, it does nothing if t is nil
+func (t *Transcript) add(line string) {
+	if t == nil || t.truncated {
+		return
+	}
+	if t.buf.Len()+len(line)+2 > maxTranscriptBytes {
+		t.buf.WriteString("-- transcript truncated\r\n")
+		t.truncated = true
+		return
+	}
+	t.buf.WriteString(line)
+	t.buf.WriteString("\r\n")
+}
+
+// String returns the transcript recorded so far, or an empty string if t is nil
+func (t *Transcript) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.buf.String()
+}
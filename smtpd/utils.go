@@ -6,40 +6,182 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
+// subAddressSeparator divides the mailbox name from the sub-address label in a local part,
+// sub-addressing is disabled if empty
+var subAddressSeparator = "+"
+
+// SetSubAddressSeparator changes the separator used by ParseMailboxName, an empty string
+// disables sub-addressing.  It should be called before any servers are started.
+func SetSubAddressSeparator(sep string) {
+	subAddressSeparator = sep
+}
+
+// mailboxCaseFolding enables full Unicode case folding of mailbox names, rather than just
+// lower casing them
+var mailboxCaseFolding = false
+
+// SetMailboxCaseFolding enables or disables full Unicode case folding by ParseMailboxName,
+// so that names such as "STRASSE" and "straße" share a mailbox.  It should be called before
+// any servers are started.
+func SetMailboxCaseFolding(fold bool) {
+	mailboxCaseFolding = fold
+}
+
+// foldMailboxName returns the canonical case of a mailbox name
+func foldMailboxName(name string) string {
+	if mailboxCaseFolding {
+		return norm.NFC.String(cases.Fold().String(name))
+	}
+	return strings.ToLower(name)
+}
+
+// Mailbox naming policies, these control which part of a recipient address names its mailbox
+const (
+	MailboxNamingLocal  = "local"  // Local part only (ex: "user")
+	MailboxNamingFull   = "full"   // Complete address (ex: "user@example.com")
+	MailboxNamingDomain = "domain" // Domain only (ex: "example.com")
+)
+
+// mailboxNaming is the policy used by ParseMailboxName
+var mailboxNaming = MailboxNamingLocal
+
+// SetMailboxNaming changes the naming policy used by ParseMailboxName.  It should be called
+// before any servers are started.
+func SetMailboxNaming(naming string) {
+	mailboxNaming = naming
+}
+
+// MailboxAddress returns the portion of a recipient address that ParseMailboxName expects
+// under the current naming policy
+func MailboxAddress(local, domain string) string {
+	if mailboxNaming == MailboxNamingLocal {
+		return local
+	}
+	return local + "@" + domain
+}
+
 // ParseMailboxName takes a localPart string (ex: "user+ext" without "@domain")
 // and returns just the mailbox name (ex: "user").  Returns an error if
 // localPart contains invalid characters; it won't accept any that must be
-// quoted according to RFC3696.
+// quoted according to RFC3696.  Internationalized (RFC6531) letters and digits
+// are permitted.
+//
+// When mailboxes are named by full address, a complete address (ex:
+// "user+ext@Example.com") is required and the name includes the lower cased
+// domain (ex: "user@example.com").  When named by domain, either an address or
+// a bare domain is accepted, and the name is just the domain.
 func ParseMailboxName(localPart string) (result string, err error) {
+	switch mailboxNaming {
+	case MailboxNamingFull:
+		at := strings.LastIndex(localPart, "@")
+		if at == -1 {
+			return "", fmt.Errorf("Mailbox name must be a full address")
+		}
+		result, _, err = SplitMailboxName(localPart[:at])
+		if err != nil {
+			return "", err
+		}
+		domain, err := parseMailboxDomain(localPart[at+1:])
+		if err != nil {
+			return "", err
+		}
+		return result + "@" + domain, nil
+	case MailboxNamingDomain:
+		return parseMailboxDomain(localPart[strings.LastIndex(localPart, "@")+1:])
+	}
+	result, _, err = SplitMailboxName(localPart)
+	return result, err
+}
+
+// parseMailboxDomain validates the domain portion of a mailbox name, and normalizes it to
+// lower cased ASCII so that U-label and A-label forms share a mailbox
+func parseMailboxDomain(domain string) (string, error) {
+	if domain == "" {
+		return "", fmt.Errorf("Mailbox domain cannot be empty")
+	}
+	if !ValidateDomainPart(domain) {
+		return "", fmt.Errorf("Mailbox domain %q is invalid", domain)
+	}
+	return ToASCIIDomain(strings.TrimSuffix(domain, "."))
+}
+
+// SplitMailboxName is like ParseMailboxName, but also returns the sub-address label
+// (ex: "ext"), with its case preserved.  The label is empty if there was none.  Names are
+// normalized to Unicode NFC, so that composed and decomposed forms share a mailbox.
+func SplitMailboxName(localPart string) (result string, label string, err error) {
 	if localPart == "" {
-		return "", fmt.Errorf("Mailbox name cannot be empty")
+		return "", "", fmt.Errorf("Mailbox name cannot be empty")
+	}
+	if !utf8.ValidString(localPart) {
+		return "", "", fmt.Errorf("Mailbox name is not valid UTF-8")
 	}
-	result = strings.ToLower(localPart)
+	localPart = norm.NFC.String(localPart)
+	result = foldMailboxName(localPart)
 
-	invalid := make([]byte, 0, 10)
+	invalid := make([]rune, 0, 10)
 
-	for i := 0; i < len(result); i++ {
-		c := result[i]
+	for _, c := range result {
 		switch {
 		case 'a' <= c && c <= 'z':
 		case '0' <= c && c <= '9':
-		case bytes.IndexByte([]byte("!#$%&'*+-=/?^_`.{|}~"), c) >= 0:
+		case strings.ContainsRune("!#$%&'*+-=/?^_`.{|}~", c):
+		case c > unicode.MaxASCII && isUTF8MailboxRune(c):
 		default:
 			invalid = append(invalid, c)
 		}
 	}
 
 	if len(invalid) > 0 {
-		return "", fmt.Errorf("Mailbox name contained invalid character(s): %q", invalid)
+		return "", "", fmt.Errorf("Mailbox name contained invalid character(s): %q",
+			string(invalid))
+	}
+
+	if subAddressSeparator != "" {
+		// Split the original string, lower casing may change the length of some runes
+		if idx := strings.Index(localPart, subAddressSeparator); idx > -1 {
+			result = foldMailboxName(localPart[0:idx])
+			label = localPart[idx+len(subAddressSeparator):]
+		}
+	}
+	return result, label, nil
+}
+
+// isUTF8MailboxRune returns true if the non-ASCII rune c may be used unquoted in a mailbox
+func isUTF8MailboxRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c)
+}
+
+// isASCII returns true if s contains only US-ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
 	}
+	return true
+}
 
-	if idx := strings.Index(result, "+"); idx > -1 {
-		result = result[0:idx]
+// networksContain returns true if the IP address host is within any of the networks
+func networksContain(networks []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
 	}
-	return result, nil
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // HashMailboxName accepts a mailbox name and hashes it.  Inbucket uses this as
@@ -65,7 +207,8 @@ func JoinStringList(listOfStrings *list.List) string {
 	return strings.Join(s, ",")
 }
 
-// ValidateDomainPart returns true if the domain part complies to RFC3696, RFC1035
+// ValidateDomainPart returns true if the domain part complies to RFC3696, RFC1035.  Labels
+// may be internationalized U-labels (RFC5890), or A-labels holding valid punycode.
 func ValidateDomainPart(domain string) bool {
 	if len(domain) == 0 {
 		return false
@@ -87,6 +230,10 @@ func ValidateDomainPart(domain string) bool {
 			// Must contain some of these to be a valid label
 			hasAlphaNum = true
 			labelLen++
+		case c > unicode.MaxASCII && c != utf8.RuneError && isUTF8MailboxRune(c):
+			// Internationalized (U-label) letters and digits
+			hasAlphaNum = true
+			labelLen++
 		case c == '-':
 			if prev == '.' {
 				// Cannot lead with hyphen
@@ -112,12 +259,14 @@ func ValidateDomainPart(domain string) bool {
 		prev = c
 	}
 
-	return true
+	// U-labels must be representable as A-labels, and A-labels must be valid punycode
+	_, err := ToASCIIDomain(domain)
+	return err == nil
 }
 
 // ParseEmailAddress unescapes an email address, and splits the local part from the domain part.
 // An error is returned if the local or domain parts fail validation following the guidelines
-// in RFC3696.
+// in RFC3696.  UTF-8 characters are permitted in both parts as described by RFC6531.
 func ParseEmailAddress(address string) (local string, domain string, err error) {
 	if address == "" {
 		return "", "", fmt.Errorf("Empty address")
@@ -154,8 +303,8 @@ LOOP:
 			_ = buf.WriteByte(c)
 			inCharQuote = false
 		case c == '.':
-			// A single period is OK
-			if prev == '.' {
+			// A single period is OK, any number may be quoted
+			if prev == '.' && !inStringQuote {
 				// Sequence of periods is not permitted
 				return "", "", fmt.Errorf("Sequence of periods is not permitted")
 			}
@@ -192,7 +341,16 @@ LOOP:
 				break LOOP
 			}
 		case c > 127:
-			return "", "", fmt.Errorf("Characters outside of US-ASCII range not permitted")
+			// RFC6531 permits UTF-8 in atext, but not within a quoted-pair
+			r, size := utf8.DecodeRuneInString(address[i:])
+			if r == utf8.RuneError {
+				return "", "", fmt.Errorf("Address contains invalid UTF-8")
+			}
+			if inCharQuote {
+				return "", "", fmt.Errorf("Characters outside of US-ASCII range cannot be quoted")
+			}
+			_, _ = buf.WriteString(address[i : i+size])
+			i += size - 1
 		default:
 			if inCharQuote || inStringQuote {
 				_ = buf.WriteByte(c)
@@ -22,6 +22,9 @@ func TestParseMailboxName(t *testing.T) {
 		{"chars=/?^", "chars=/?^"},
 		{"chars_`.{", "chars_`.{"},
 		{"chars|}~", "chars|}~"},
+		{"Jösé", "jösé"},
+		{"用户+label", "用户"},
+		{"ΘΣΕΡ", "θσερ"},
 	}
 
 	for _, tt := range validTable {
@@ -42,6 +45,8 @@ func TestParseMailboxName(t *testing.T) {
 		{"first last", "Space not permitted"},
 		{"first\"last", "Double quote not permitted"},
 		{"first\nlast", "Control chars not permitted"},
+		{"bad\xffutf8", "Invalid UTF-8 not permitted"},
+		{"no\u00a0break", "Non-alphanumeric UTF-8 not permitted"},
 	}
 
 	for _, tt := range invalidTable {
@@ -51,6 +56,121 @@ func TestParseMailboxName(t *testing.T) {
 	}
 }
 
+func TestSplitMailboxName(t *testing.T) {
+	defer SetSubAddressSeparator("+")
+
+	var table = []struct {
+		sep, input, name, label string
+	}{
+		{"+", "user+Label", "user", "Label"},
+		{"+", "user-label", "user-label", ""},
+		{"+", "User+a+b", "user", "a+b"},
+		{"-", "user-label", "user", "label"},
+		{"-", "user+label", "user+label", ""},
+		{"=", "User=Label", "user", "Label"},
+		{"", "user+label", "user+label", ""},
+	}
+
+	for _, tt := range table {
+		SetSubAddressSeparator(tt.sep)
+		name, label, err := SplitMailboxName(tt.input)
+		if err != nil {
+			t.Errorf("Error while parsing %q with separator %q: %v", tt.input, tt.sep, err)
+			continue
+		}
+		if name != tt.name || label != tt.label {
+			t.Errorf("Parsing %q with separator %q, expected %q %q, got %q %q",
+				tt.input, tt.sep, tt.name, tt.label, name, label)
+		}
+	}
+}
+
+func TestParseMailboxNameNormalization(t *testing.T) {
+	defer SetMailboxCaseFolding(false)
+
+	var table = []struct {
+		fold          bool
+		input, expect string
+	}{
+		{false, "jos\u00e9", "jos\u00e9"},
+		{false, "jose\u0301", "jos\u00e9"},
+		{false, "JOSE\u0301+Label", "jos\u00e9"},
+		{false, "Stra\u00dfe", "stra\u00dfe"},
+		{true, "STRASSE", "strasse"},
+		{true, "Stra\u00dfe", "strasse"},
+		{true, "JOSE\u0301", "jos\u00e9"},
+		{true, "\u03a3\u03bf\u03c6\u03bf\u03c2", "\u03c3\u03bf\u03c6\u03bf\u03c3"},
+	}
+	for _, tt := range table {
+		SetMailboxCaseFolding(tt.fold)
+		result, err := ParseMailboxName(tt.input)
+		if err != nil {
+			t.Errorf("Error while parsing %q with folding %v: %v", tt.input, tt.fold, err)
+			continue
+		}
+		if result != tt.expect {
+			t.Errorf("Parsing %q with folding %v, expected %q, got %q",
+				tt.input, tt.fold, tt.expect, result)
+		}
+	}
+}
+
+func TestParseMailboxNameNaming(t *testing.T) {
+	defer SetMailboxNaming(MailboxNamingLocal)
+
+	var table = []struct {
+		naming, input, expect string
+	}{
+		{MailboxNamingLocal, "User+label", "user"},
+		{MailboxNamingFull, "User+label@Example.COM", "user@example.com"},
+		{MailboxNamingFull, "user@example.com.", "user@example.com"},
+		{MailboxNamingFull, "用户@例子.测试", "用户@xn--fsqu00a.xn--0zwm56d"},
+		{MailboxNamingFull, "用户@XN--fsqu00a.xn--0zwm56d", "用户@xn--fsqu00a.xn--0zwm56d"},
+		{MailboxNamingDomain, "Example.COM", "example.com"},
+		{MailboxNamingDomain, "user+label@example.com", "example.com"},
+	}
+	for _, tt := range table {
+		SetMailboxNaming(tt.naming)
+		result, err := ParseMailboxName(tt.input)
+		if err != nil {
+			t.Errorf("Error while parsing %q with naming %q: %v", tt.input, tt.naming, err)
+			continue
+		}
+		if result != tt.expect {
+			t.Errorf("Parsing %q with naming %q, expected %q, got %q",
+				tt.input, tt.naming, tt.expect, result)
+		}
+	}
+
+	var invalidTable = []struct {
+		naming, input, msg string
+	}{
+		{MailboxNamingFull, "user", "Domain is required"},
+		{MailboxNamingFull, "user@", "Empty domain not permitted"},
+		{MailboxNamingFull, "first last@example.com", "Space not permitted"},
+		{MailboxNamingFull, "user@exa mple.com", "Invalid domain not permitted"},
+		{MailboxNamingDomain, "", "Empty mailbox name is not permitted"},
+		{MailboxNamingDomain, "-example.com", "Invalid domain not permitted"},
+	}
+	for _, tt := range invalidTable {
+		SetMailboxNaming(tt.naming)
+		if _, err := ParseMailboxName(tt.input); err == nil {
+			t.Errorf("Didn't get an error while parsing %q with naming %q: %v",
+				tt.input, tt.naming, tt.msg)
+		}
+	}
+}
+
+func TestMailboxAddress(t *testing.T) {
+	defer SetMailboxNaming(MailboxNamingLocal)
+
+	assert.Equal(t, "user", MailboxAddress("user", "example.com"))
+	SetMailboxNaming(MailboxNamingFull)
+	assert.Equal(t, "user@example.com", MailboxAddress("user", "example.com"))
+	SetMailboxNaming(MailboxNamingDomain)
+	assert.Equal(t, "user@example.com", MailboxAddress("user", "example.com"))
+}
+
 func TestHashMailboxName(t *testing.T) {
 	assert.Equal(t, HashMailboxName("mail"), "1d6e1cf70ec6f9ab28d3ea4b27a49a77654d370e")
 }
@@ -82,6 +202,15 @@ func TestValidateDomain(t *testing.T) {
 		{"google\r.com", false, "Special chars not allowed"},
 		{"foo.-bar.com", false, "Label cannot start with hyphen"},
 		{"foo-.bar.com", false, "Label cannot end with hyphen"},
+		{"bücher.de", true, "UTF-8 letters are allowed"},
+		{"例子.广告", true, "UTF-8 only labels are allowed"},
+		{"bad\xff.com", false, "Invalid UTF-8 not allowed"},
+		{"snow\u2603man.com", false, "UTF-8 symbols not allowed"},
+		{"xn--bcher-kva.de", true, "A-labels are allowed"},
+		{"xn--bcher-kva!.de", false, "Invalid A-label not allowed"},
+		{"xn--bcher-k\u00e4.de", false, "Mixed A-label and UTF-8 not allowed"},
+		{"xn--99999999999.de", false, "Overflowing A-label not allowed"},
+		{strings.Repeat("ü", 60) + ".de", false, "A-label form exceeds 63 characters"},
 	}
 
 	for _, tt := range testTable {
@@ -124,6 +253,9 @@ func TestValidateLocal(t *testing.T) {
 		{"one\\$\\|", true, "Should be able to quote plain specials"},
 		{"return\\\r", true, "Should be able to quote ASCII control chars"},
 		{"high\\\x80", false, "Should not accept > 7-bit quoted chars"},
+		{"quoted\\ü", false, "Should not accept quoted UTF-8 chars"},
+		{"jösé", true, "UTF-8 characters permitted unquoted"},
+		{"bad\xffutf8", false, "Invalid UTF-8 not permitted"},
 		{"quote\\\"", true, "Quoted double quote is permitted"},
 		{"\"james\"", true, "Quoted a-z is permitted"},
 		{"\"first last\"", true, "Quoted space is permitted"},
@@ -172,6 +304,9 @@ func TestParseEmailAddress(t *testing.T) {
 		{"$A12345@host", "$A12345", "host"},
 		{"!def!xyz%abc@host", "!def!xyz%abc", "host"},
 		{"_somename@host", "_somename", "host"},
+		{"jösé@bücher.de", "jösé", "bücher.de"},
+		{"用户@例子.广告", "用户", "例子.广告"},
+		{"\"first..last.\"@host", "first..last.", "host"},
 	}
 
 	for _, tt := range testTable {
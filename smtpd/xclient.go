@@ -0,0 +1,124 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// xclientAttrs lists the XCLIENT attributes we advertise and accept
+var xclientAttrs = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN"}
+
+// xclientTrusted returns true if the client at host may use the XCLIENT command
+func (s *Server) xclientTrusted(host string) bool {
+	return networksContain(s.xclientNetworks, host)
+}
+
+// xclientHandler processes the Postfix XCLIENT command, allowing a trusted proxy to supply the
+// details of the original client.  On success the session starts over, as if the original
+// client had just connected.
+func (ss *Session) xclientHandler(arg string) {
+	if !ss.xclientTrusted {
+		ss.send("550 Insufficient authorization for XCLIENT")
+		ss.logWarn("XCLIENT from untrusted client")
+		return
+	}
+	if ss.state == MAIL {
+		ss.send("503 XCLIENT not permitted during a mail transaction")
+		ss.logWarn("XCLIENT during mail transaction")
+		return
+	}
+	attrs := strings.Fields(arg)
+	if len(attrs) == 0 {
+		ss.send("501 XCLIENT requires at least one attribute")
+		ss.logWarn("XCLIENT without attributes")
+		return
+	}
+
+	// Validate all attributes before applying any of them
+	values := make(map[string]string)
+	for _, attr := range attrs {
+		idx := strings.IndexByte(attr, '=')
+		if idx < 1 {
+			ss.send(fmt.Sprintf("501 Bad XCLIENT attribute syntax: %v", attr))
+			ss.logWarn("Bad XCLIENT attribute: %q", attr)
+			return
+		}
+		name := strings.ToUpper(attr[:idx])
+		value, err := decodeXtext(attr[idx+1:])
+		if err != nil {
+			ss.send(fmt.Sprintf("501 Bad XCLIENT attribute value: %v", attr))
+			ss.logWarn("Bad XCLIENT attribute %q: %v", attr, err)
+			return
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+		switch name {
+		case "ADDR":
+			value = strings.TrimPrefix(strings.ToUpper(value), "IPV6:")
+			if value != "" && net.ParseIP(value) == nil {
+				ss.send(fmt.Sprintf("501 Bad XCLIENT address: %v", value))
+				ss.logWarn("Bad XCLIENT address: %q", value)
+				return
+			}
+			value = strings.ToLower(value)
+		case "PORT":
+			if _, err := strconv.ParseUint(value, 10, 16); value != "" && err != nil {
+				ss.send(fmt.Sprintf("501 Bad XCLIENT port: %v", value))
+				ss.logWarn("Bad XCLIENT port: %q", value)
+				return
+			}
+		case "NAME", "PROTO", "HELO", "LOGIN":
+		default:
+			ss.send(fmt.Sprintf("501 Unsupported XCLIENT attribute: %v", name))
+			ss.logWarn("Unsupported XCLIENT attribute: %q", name)
+			return
+		}
+		values[name] = value
+	}
+
+	if addr, ok := values["ADDR"]; ok {
+		ss.remoteHost = addr
+	}
+	if helo, ok := values["HELO"]; ok {
+		ss.xclientHelo = helo
+	}
+	if login, ok := values["LOGIN"]; ok {
+		ss.authUser = login
+		ss.authMech = ""
+		if login != "" {
+			ss.authMech = "XCLIENT"
+		}
+	}
+	ss.logInfo("XCLIENT accepted: %v", arg)
+	ss.remoteDomain = ""
+	ss.reset()
+	ss.enterState(GREET)
+	ss.greet()
+}
+
+// decodeXtext decodes an RFC 3461 xtext string, where "+XX" represents a hex encoded byte
+func decodeXtext(s string) (string, error) {
+	if !strings.Contains(s, "+") {
+		return s, nil
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			buf = append(buf, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("Truncated xtext escape")
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("Invalid xtext escape %q", s[i:i+3])
+		}
+		buf = append(buf, byte(b))
+		i += 2
+	}
+	return string(buf), nil
+}
@@ -5,6 +5,19 @@ var messageListMargin = 275;
 var clipboard = null;
 var messageListScroll = false;
 var messageListData = null;
+var streamRetryDelay = 5000;
+
+// addListEntry appends a newly received message to the message list
+function addListEntry(msg) {
+  if (messageListData == null || listEntry(msg.id) != null) {
+    return;
+  }
+  messageListData.push(msg);
+  $('#message-list').loadTemplate($('#list-entry-template'), [msg], { append: true });
+  $('#' + msg.id).click(onMessageListClick);
+  updateListFlags();
+  updateMessageSearch();
+}
 
 // clearMessageSearch resets the message list search
 function clearMessageSearch() {
@@ -47,6 +60,7 @@ function loadList() {
       // Render list
       $('#message-list').loadTemplate($('#list-entry-template'), data);
       $('.message-list-entry').click(onMessageListClick);
+      updateListFlags();
       // Reveal and select current message
       $("#message-list").slideDown();
       if (selected != "") {
@@ -59,14 +73,14 @@ function loadList() {
   });
 }
 
-// makeDelay creates a call-back timer that prevents itself from being
-// stacked
-function makeDelay(ms) {
-  var timer = 0;
-  return (function(callback) {
-    clearTimeout (timer);
-    timer = setTimeout(callback, ms);
-  });
+// listEntry returns the message list data for a message, or null if it is not listed
+function listEntry(id) {
+  for (i=0; i<messageListData.length; i++) {
+    if (messageListData[i].id == id) {
+      return messageListData[i];
+    }
+  }
+  return null;
 }
 
 // messageSource pops open another window for message source
@@ -76,6 +90,111 @@ function messageSource(id) {
       'menubar=no,resizable=yes,scrollbars=yes,status=no,toolbar=no');
 }
 
+// messageTranscript pops open another window for the SMTP transcript
+function messageTranscript(id) {
+  window.open('/mailbox/' + mailbox + '/' + id + "/transcript", '_blank',
+      'width=800,height=600,' +
+      'menubar=no,resizable=yes,scrollbars=yes,status=no,toolbar=no');
+}
+
+// removeListEntry removes a deleted message from the message list, and clears the message
+// content if it was being shown
+function removeListEntry(id) {
+  if (messageListData == null) {
+    return;
+  }
+  messageListData = $.grep(messageListData, function(entry) {
+    return entry.id != id;
+  });
+  var el = $('#' + id);
+  if (el.hasClass('disabled')) {
+    $('#message-content').empty();
+  }
+  el.remove();
+}
+
+// releaseMessage asks for recipients, then re-sends a message to them through the
+// configured relay host
+function releaseMessage(id) {
+  var to = window.prompt('Release message to (comma separated addresses):');
+  if (to == null || $.trim(to) == '') {
+    return;
+  }
+  var addresses = $.map(to.split(','), function(addr) {
+    return $.trim(addr) || null;
+  });
+  $.ajax({
+    type: 'POST',
+    url: '/api/v1/mailbox/' + mailbox + '/' + id + '/release',
+    contentType: 'application/json',
+    data: JSON.stringify({to: addresses}),
+    success: function() {
+      alert('Message released to ' + addresses.join(', '));
+    },
+    error: function(xhr) {
+      alert('Release failed: ' + xhr.responseText);
+    }
+  });
+}
+
+// setMessageFlags sends the seen and flagged values in flags for a message, then
+// updates the message list to match
+function setMessageFlags(id, flags) {
+  $.ajax({
+    type: 'PATCH',
+    url: '/api/v1/mailbox/' + mailbox + '/' + id,
+    contentType: 'application/json',
+    data: JSON.stringify(flags),
+    success: function(data) {
+      var entry = listEntry(id);
+      if (entry != null) {
+        entry.seen = data.seen;
+        entry.flagged = data.flagged;
+        updateListFlags();
+      }
+    }
+  });
+}
+
+// showImage opens an image preview link in the lightbox, returning false so that the link is
+// not followed
+function showImage(el) {
+  $('#image-modal-title').text($(el).attr('title'));
+  $('#image-modal-image').attr('src', $(el).attr('href'));
+  $('#image-modal').modal('show');
+  return false;
+}
+
+// startMessageStream opens a WebSocket that keeps the message list up to date as messages
+// arrive and are deleted, reconnecting and reloading the list if it is closed
+function startMessageStream() {
+  var l = window.location;
+  var url = ((l.protocol === "https:") ? "wss://" : "ws://") + l.host +
+    '/api/v1/stream/messages/' + mailbox;
+  var ws = new WebSocket(url);
+  ws.addEventListener('message', function(e) {
+    var ev = JSON.parse(e.data);
+    if (ev.type == 'message') {
+      addListEntry(ev.message);
+    } else if (ev.type == 'delete') {
+      removeListEntry(ev.message.id);
+    }
+  });
+  ws.addEventListener('close', function(e) {
+    // Events may have been missed while disconnected
+    setTimeout(function() {
+      startMessageStream();
+      loadList();
+    }, streamRetryDelay);
+  });
+}
+
+// toggleFlagged flags a message for follow up, or clears the flag
+function toggleFlagged(id) {
+  var entry = listEntry(id);
+  setMessageFlags(id, {flagged: !(entry != null && entry.flagged)});
+}
+
 // toggleMessageLink shows/hids the message link URL form
 function toggleMessageLink(id) {
   var url = baseURL + '/link/' + mailbox + '/' + id;
@@ -127,6 +246,7 @@ function onDocumentReady() {
     searchDelay(updateMessageSearch);
   });
   loadList();
+  startMessageStream();
 }
 
 // onMessageListClick is triggered by clicks on the message list
@@ -135,6 +255,10 @@ function onMessageListClick() {
   $(this).addClass("disabled");
   $('#message-content').load('/mailbox/' + mailbox + '/' + this.id, onMessageLoaded);
   selected = this.id;
+  var entry = listEntry(this.id);
+  if (entry != null && !entry.seen) {
+    setMessageFlags(this.id, {seen: true});
+  }
 }
 
 // onMessageLoaded is called each time a new message is shown
@@ -144,6 +268,8 @@ function onMessageLoaded(responseText, textStatus, XMLHttpRequest) {
     return;
   }
   onDocumentChange();
+  highlightMatches('#message-content .message-header, #message-content .message-body',
+      searchCriteria());
   var top = $('#message-container').offset().top - navBarOffset;
   $(window).scrollTop(top);
 }
@@ -166,15 +292,34 @@ function onWindowResize() {
   }
 }
 
+// updateListFlags marks the message list entries that are unseen or flagged
+function updateListFlags() {
+  for (i=0; i<messageListData.length; i++) {
+    entry = messageListData[i];
+    $('#' + entry.id)
+      .toggleClass('message-unseen', !entry.seen)
+      .toggleClass('message-flagged', !!entry.flagged);
+  }
+}
+
+// searchCriteria returns the lower case search string, or "" if it is too short to search for
+function searchCriteria() {
+  var criteria = $.trim($('#message-search').val());
+  return criteria.length < 2 ? '' : criteria.toLowerCase();
+}
+
 // updateMessageSearch compares the message list subjects and senders against
-// the search string and hides entries that don't match
+// the search string and hides entries that don't match, entries with matching
+// message text are revealed when the server search completes.  Matches are
+// highlighted in the list and the message shown.
 function updateMessageSearch() {
-  var criteria = $('#message-search').val();
-  if (criteria.length < 2) {
+  var criteria = searchCriteria();
+  highlightMatches('.message-list-entry, #message-content .message-header, ' +
+      '#message-content .message-body', criteria);
+  if (criteria == '') {
     $('.message-list-entry').show();
     return;
   }
-  criteria = criteria.toLowerCase();
   for (i=0; i<messageListData.length; i++) {
     entry = messageListData[i];
     if ((entry.subject.toLowerCase().indexOf(criteria) > -1) ||
@@ -185,5 +330,19 @@ function updateMessageSearch() {
       $('#' + entry.id).hide();
     }
   }
+  $.ajax({
+    dataType: "json",
+    url: '/api/v1/search',
+    data: { q: criteria, mailbox: mailbox },
+    success: function(data) {
+      if (searchCriteria() != criteria) {
+        // Search has changed since this request was made
+        return;
+      }
+      for (i=0; i<data.length; i++) {
+        $('#' + data[i].id).show();
+      }
+    }
+  });
 }
 
@@ -1,6 +1,10 @@
 var baseURL = window.location.protocol + '//' + window.location.host;
+var monitorMailbox = '';
 
-function startMonitor(mailbox) {
+// startMonitor lists messages as they are delivered to mailbox, or every mailbox if it is
+// empty, limited by the domain, mailbox pattern and from filters
+function startMonitor(mailbox, filters) {
+  monitorMailbox = mailbox;
   $.addTemplateFormatter({
     "date": function(value, template) {
       return moment(value).calendar();
@@ -13,10 +17,18 @@ function startMonitor(mailbox) {
     }
   });
 
+  var searchDelay = makeDelay(300);
+  $('#monitor-search').on('change keyup', function(el) {
+    searchDelay(searchMessages);
+  });
+
   var uri = '/api/v1/monitor/messages'
   if (mailbox) {
     uri += '/' + mailbox;
   }
+  if (!$.isEmptyObject(filters)) {
+    uri += '?' + $.param(filters);
+  }
   var l = window.location;
   var url = ((l.protocol === "https:") ? "wss://" : "ws://") + l.host + uri
   var ws = new WebSocket(url);
@@ -46,3 +58,38 @@ function messageClick(node) {
 function clearClick() {
   $('#monitor-message-list').empty();
 }
+
+// searchMessages lists the stored messages matching the search box, in the monitored mailbox
+// if there is one, in place of the live messages.  The live messages return when the search
+// box is emptied.
+function searchMessages() {
+  var criteria = $.trim($('#monitor-search').val());
+  if (criteria.length < 2) {
+    $('#monitor-search-results').hide();
+    $('#monitor-live').show();
+    return;
+  }
+  $.ajax({
+    dataType: "json",
+    url: '/api/v1/search',
+    data: { q: criteria, mailbox: monitorMailbox },
+    success: function(data) {
+      if ($.trim($('#monitor-search').val()) != criteria) {
+        // Search has changed since this request was made
+        return;
+      }
+      for (var i=0; i<data.length; i++) {
+        data[i]['href'] = '/mailbox?name=' + data[i].mailbox + '&id=' + data[i].id;
+      }
+      $('#monitor-search-status').text(data.length + ' stored messages match "' + criteria + '".');
+      $('#monitor-search-list').empty().loadTemplate($('#message-template'), data);
+      highlightMatches('#monitor-search-list', criteria);
+      $('#monitor-live').hide();
+      $('#monitor-search-results').show();
+    },
+    error: function(xhr) {
+      $('#monitor-search-status').text('Search failed: ' + xhr.responseText);
+      $('#monitor-search-results').show();
+    }
+  });
+}
@@ -0,0 +1,55 @@
+// highlightMatches marks each occurrence of the words of criteria in the text of the elements
+// matched by selector, ignoring case.  Earlier highlights are removed first, so an empty
+// criteria clears them.
+function highlightMatches(selector, criteria) {
+  var els = $(selector);
+  els.find('mark.search-match').each(function() {
+    $(this).replaceWith(document.createTextNode($(this).text()));
+  });
+  els.each(function() {
+    this.normalize();
+  });
+  var words = $.trim(criteria || '').toLowerCase().split(/\s+/);
+  for (var i=0; i<words.length; i++) {
+    if (words[i] != '') {
+      els.each(function() {
+        markText(this, words[i]);
+      });
+    }
+  }
+}
+
+// makeDelay creates a call-back timer that prevents itself from being
+// stacked
+function makeDelay(ms) {
+  var timer = 0;
+  return (function(callback) {
+    clearTimeout (timer);
+    timer = setTimeout(callback, ms);
+  });
+}
+
+// markText wraps the occurrences of the lower case word in the text nodes below node in mark
+// elements
+function markText(node, word) {
+  if (node.nodeType == Node.TEXT_NODE) {
+    var i = node.data.toLowerCase().indexOf(word);
+    if (i < 0) {
+      return;
+    }
+    var match = node.splitText(i);
+    var rest = match.splitText(word.length);
+    var mark = document.createElement('mark');
+    mark.className = 'search-match';
+    match.parentNode.replaceChild(mark, match);
+    mark.appendChild(match);
+    markText(rest, word);
+    return;
+  }
+  if (node.nodeType == Node.ELEMENT_NODE && !/^(script|style|mark)$/i.test(node.nodeName)) {
+    var children = $.makeArray(node.childNodes);
+    for (var j=0; j<children.length; j++) {
+      markText(children[j], word);
+    }
+  }
+}
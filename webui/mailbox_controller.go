@@ -5,13 +5,72 @@ import (
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
+	"github.com/jhillyerd/enmime"
+	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/httpd"
 	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/sanitize"
 	"github.com/jhillyerd/inbucket/smtpd"
 )
 
+// imagePreview is an image attachment or inline image shown in the message view
+type imagePreview struct {
+	URL      string
+	FileName string
+}
+
+// imagePreviews lists the image attachments and inline images of the message name/id
+func imagePreviews(name, id string, env *enmime.Envelope) []imagePreview {
+	var images []imagePreview
+	for i, part := range env.Attachments {
+		if isImage(part) {
+			images = append(images, imagePreview{
+				URL: fmt.Sprintf("/mailbox/vattach/%v/%v/%v/%v", name, id, i,
+					url.QueryEscape(part.FileName)),
+				FileName: part.FileName,
+			})
+		}
+	}
+	for _, part := range env.Inlines {
+		if isImage(part) && part.ContentID != "" {
+			images = append(images, imagePreview{
+				URL:      inlineURL(name, id, part.ContentID),
+				FileName: part.FileName,
+			})
+		}
+	}
+	return images
+}
+
+// isImage returns true if part holds an image browsers can display.  SVG is left out, as it may
+// contain script.
+func isImage(part *enmime.Part) bool {
+	ct := strings.ToLower(part.ContentType)
+	return strings.HasPrefix(ct, "image/") && !strings.HasPrefix(ct, "image/svg")
+}
+
+// inlineURL returns the URL of the part with Content-ID cid in the message name/id
+func inlineURL(name, id, cid string) string {
+	return "/mailbox/" + name + "/" + id + "/inline?cid=" + url.QueryEscape(cid)
+}
+
+// inlinePart returns the image part of env with Content-ID cid, or nil if there is none
+func inlinePart(env *enmime.Envelope, cid string) *enmime.Part {
+	cid = strings.Trim(cid, "<>")
+	for _, parts := range [][]*enmime.Part{env.Inlines, env.Attachments, env.OtherParts} {
+		for _, part := range parts {
+			if isImage(part) && strings.Trim(part.ContentID, "<>") == cid {
+				return part
+			}
+		}
+	}
+	return nil
+}
+
 // MailboxIndex renders the index page for a particular mailbox
 func MailboxIndex(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
 	// Form values must be validated manually
@@ -37,8 +96,12 @@ func MailboxIndex(w http.ResponseWriter, req *http.Request, ctx *httpd.Context)
 	if err = ctx.Session.Save(req, w); err != nil {
 		return err
 	}
-	// Render template
-	return httpd.RenderTemplate("mailbox/index.html", w, map[string]interface{}{
+	// Render template, private mailboxes ask for a token until unlocked
+	page := "mailbox/index.html"
+	if !ctx.MailboxUnlocked(name, "") {
+		page = "mailbox/unlock.html"
+	}
+	return httpd.RenderTemplate(page, w, map[string]interface{}{
 		"ctx":        ctx,
 		"errorFlash": errorFlash,
 		"name":       name,
@@ -126,10 +189,20 @@ func MailboxShow(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (
 		"htmlAvailable": htmlAvailable,
 		"mimeErrors":    mime.Errors,
 		"attachments":   mime.Attachments,
+		"images":        imagePreviews(name, id, mime),
+		"release":       config.GetSMTPConfig().Relay.Host != "",
 	})
 }
 
-// MailboxHTML displays the HTML content of a message. Renders a partial
+// htmlFrameCSP is the Content-Security-Policy of the frame holding the HTML of a message.  It
+// forbids script, and loads from anywhere but Inbucket and data: URLs, unless the format
+// argument adds web servers.
+const htmlFrameCSP = "default-src 'none'; img-src 'self' data:%[1]v; " +
+	"style-src 'self' 'unsafe-inline'%[1]v; font-src data:%[1]v; media-src 'self'%[1]v; " +
+	"sandbox allow-popups allow-popups-to-escape-sandbox"
+
+// MailboxHTML displays the HTML content of a message in a sandboxed frame, along with a toggle
+// for loading external resources.  Renders a partial
 func MailboxHTML(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	id := ctx.Vars["id"]
@@ -137,33 +210,110 @@ func MailboxHTML(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (
 	if err != nil {
 		return err
 	}
-	mb, err := ctx.DataStore.MailboxFor(name)
+	external := req.URL.Query().Get("external") == "true"
+	message, _, removed, err := messageHTML(ctx, name, id, external)
 	if err != nil {
-		// This doesn't indicate not found, likely an IO error
-		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+		return err
 	}
-	message, err := mb.GetMessage(id)
-	if err == smtpd.ErrNotExist {
+	if message == nil {
 		http.NotFound(w, req)
 		return nil
 	}
-	if err != nil {
-		// This doesn't indicate missing, likely an IO error
-		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	blocked := 0
+	for _, r := range removed {
+		if r.Kind == "external" {
+			blocked++
+		}
 	}
-	mime, err := message.ReadBody()
-	if err != nil {
-		return fmt.Errorf("ReadBody(%q) failed: %v", id, err)
+	frameURL := "/mailbox/" + name + "/" + id + "/html/frame"
+	if external {
+		frameURL += "?external=true"
 	}
 	// Render partial template
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	return httpd.RenderPartial("mailbox/_html.html", w, map[string]interface{}{
+		"ctx":      ctx,
+		"name":     name,
+		"message":  message,
+		"external": external,
+		"blocked":  blocked,
+		"frameURL": frameURL,
+	})
+}
+
+// MailboxHTMLFrame serves the HTML content of a message, with scripts, forms and, unless the
+// external query parameter is true, external loads removed.  A Content-Security-Policy
+// sandboxes it and blocks anything the sanitizer missed.  Renders a partial
+func MailboxHTMLFrame(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	external := req.URL.Query().Get("external") == "true"
+	message, safe, _, err := messageHTML(ctx, name, id, external)
+	if err != nil {
+		return err
+	}
+	if message == nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	sources := ""
+	if external {
+		sources = " http: https:"
+	}
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf(htmlFrameCSP, sources))
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	return httpd.RenderPartial("mailbox/_frame.html", w, map[string]interface{}{
 		"ctx":     ctx,
 		"name":    name,
 		"message": message,
-		// TODO It is not really safe to render, need to sanitize, issue #5
-		"body": template.HTML(mime.HTML),
+		"body":    template.HTML(safe),
+	})
+}
+
+// messageHTML returns the message name/id, its HTML content sanitized, keeping external loads
+// if external is set, and what was removed.  The message is nil if it does not exist.
+func messageHTML(ctx *httpd.Context, name, id string, external bool) (
+	smtpd.Message, string, []sanitize.Removal, error) {
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return nil, "", nil, fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		return nil, "", nil, nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return nil, "", nil, fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	mime, err := message.ReadBody()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("ReadBody(%q) failed: %v", id, err)
+	}
+	clean := sanitize.HTML
+	if external {
+		clean = sanitize.HTMLWithExternal
+	}
+	safe, removed, err := clean(mime.HTML)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to sanitize HTML of %q: %v", id, err)
+	}
+	log.Tracef("Removed %v unsafe items from HTML of %q", len(removed), id)
+	// Point embedded images at the message parts they reference
+	safe, err = sanitize.ReplaceCID(safe, func(cid string) string {
+		return inlineURL(name, id, cid)
 	})
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to resolve inline images of %q: %v", id, err)
+	}
+	return message, safe, removed, nil
 }
 
 // MailboxSource displays the raw source of a message, including headers. Renders text/plain
@@ -200,6 +350,36 @@ func MailboxSource(w http.ResponseWriter, req *http.Request, ctx *httpd.Context)
 	return nil
 }
 
+// MailboxTranscript displays the SMTP transcript recorded when a message was delivered.
+// Renders text/plain
+func MailboxTranscript(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := io.WriteString(w, message.Delivery().Transcript); err != nil {
+		return err
+	}
+	return nil
+}
+
 // MailboxDownloadAttach sends the attachment to the client; disposition:
 // attachment, type: application/octet-stream
 func MailboxDownloadAttach(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
@@ -305,3 +485,44 @@ func MailboxViewAttach(w http.ResponseWriter, req *http.Request, ctx *httpd.Cont
 	}
 	return nil
 }
+
+// MailboxInline sends the image with the Content-ID given by the cid query parameter, so that
+// inline images referenced by cid: URLs can be displayed
+func MailboxInline(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		// This doesn't indicate not found, likely an IO error
+		return fmt.Errorf("Failed to get mailbox for %q: %v", name, err)
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	body, err := message.ReadBody()
+	if err != nil {
+		return err
+	}
+	part := inlinePart(body, req.URL.Query().Get("cid"))
+	if part == nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	// Only images are served, nothing the browser would run as part of this site
+	w.Header().Set("Content-Type", part.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, part); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package webui
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/jhillyerd/inbucket/httpd"
+	"github.com/jhillyerd/inbucket/log"
+	"github.com/jhillyerd/inbucket/smtpd"
+)
+
+// privateMailbox wraps a handler of a mailbox named in the path, refusing requests for a
+// private mailbox that has not been unlocked with one of its tokens
+func privateMailbox(h httpd.Handler) httpd.Handler {
+	return func(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) error {
+		name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+		if err == nil && !ctx.MailboxUnlocked(name, "") {
+			http.Error(w, "Mailbox "+name+" is private, unlock it with its token first",
+				http.StatusForbidden)
+			return nil
+		}
+		return h(w, req, ctx)
+	}
+}
+
+// MailboxUnlock saves the token form value in the session if it unlocks the private mailbox,
+// then returns to the mailbox page
+func MailboxUnlock(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		ctx.Session.AddFlash(err.Error(), "errors")
+		_ = ctx.Session.Save(req, w)
+		http.Redirect(w, req, httpd.Reverse("RootIndex"), http.StatusSeeOther)
+		return nil
+	}
+	if !ctx.UnlockMailbox(name, req.FormValue("token")) {
+		log.Warnf("HTTP[%v] Invalid token for private mailbox %v", req.RemoteAddr, name)
+		ctx.Session.AddFlash("Invalid token for mailbox "+name, "errors")
+	}
+	if err = ctx.Session.Save(req, w); err != nil {
+		return err
+	}
+	uri := fmt.Sprintf("%s?name=%s", httpd.Reverse("MailboxIndex"), url.QueryEscape(name))
+	http.Redirect(w, req, uri, http.StatusSeeOther)
+	return nil
+}
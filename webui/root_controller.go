@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/jhillyerd/inbucket/config"
 	"github.com/jhillyerd/inbucket/httpd"
@@ -30,7 +31,8 @@ func RootIndex(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (er
 	})
 }
 
-// RootMonitor serves the Inbucket monitor page
+// RootMonitor serves the Inbucket monitor page, watching the mailboxes matching the domain,
+// mailbox and from query parameters
 func RootMonitor(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (err error) {
 	if !config.GetWebConfig().MonitorVisible {
 		ctx.Session.AddFlash("Monitor is disabled in configuration", "errors")
@@ -43,10 +45,19 @@ func RootMonitor(w http.ResponseWriter, req *http.Request, ctx *httpd.Context) (
 	if err = ctx.Session.Save(req, w); err != nil {
 		return err
 	}
+	// Filters passed on to the monitor WebSocket
+	query := req.URL.Query()
+	filters := map[string]string{}
+	for _, key := range []string{"domain", "mailbox", "from"} {
+		if v := strings.TrimSpace(query.Get(key)); v != "" {
+			filters[key] = v
+		}
+	}
 	// Render template
 	return httpd.RenderTemplate("root/monitor.html", w, map[string]interface{}{
 		"ctx":        ctx,
 		"errorFlash": errorFlash,
+		"filters":    filters,
 	})
 }
 
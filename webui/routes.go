@@ -13,7 +13,7 @@ func SetupRoutes(r *mux.Router) {
 	r.Path("/monitor").Handler(
 		httpd.Handler(RootMonitor)).Name("RootMonitor").Methods("GET")
 	r.Path("/monitor/{name}").Handler(
-		httpd.Handler(RootMonitorMailbox)).Name("RootMonitorMailbox").Methods("GET")
+		httpd.Handler(privateMailbox(RootMonitorMailbox))).Name("RootMonitorMailbox").Methods("GET")
 	r.Path("/status").Handler(
 		httpd.Handler(RootStatus)).Name("RootStatus").Methods("GET")
 	r.Path("/link/{name}/{id}").Handler(
@@ -21,15 +21,25 @@ func SetupRoutes(r *mux.Router) {
 	r.Path("/mailbox").Handler(
 		httpd.Handler(MailboxIndex)).Name("MailboxIndex").Methods("GET")
 	r.Path("/mailbox/{name}").Handler(
-		httpd.Handler(MailboxList)).Name("MailboxList").Methods("GET")
+		httpd.Handler(privateMailbox(MailboxList))).Name("MailboxList").Methods("GET")
+	r.Path("/mailbox/{name}/unlock").Handler(
+		httpd.Handler(MailboxUnlock)).Name("MailboxUnlock").Methods("POST")
 	r.Path("/mailbox/{name}/{id}").Handler(
-		httpd.Handler(MailboxShow)).Name("MailboxShow").Methods("GET")
+		httpd.Handler(privateMailbox(MailboxShow))).Name("MailboxShow").Methods("GET")
 	r.Path("/mailbox/{name}/{id}/html").Handler(
-		httpd.Handler(MailboxHTML)).Name("MailboxHtml").Methods("GET")
+		httpd.Handler(privateMailbox(MailboxHTML))).Name("MailboxHtml").Methods("GET")
+	r.Path("/mailbox/{name}/{id}/html/frame").Handler(
+		httpd.Handler(privateMailbox(MailboxHTMLFrame))).Name("MailboxHtmlFrame").Methods("GET")
 	r.Path("/mailbox/{name}/{id}/source").Handler(
-		httpd.Handler(MailboxSource)).Name("MailboxSource").Methods("GET")
+		httpd.Handler(privateMailbox(MailboxSource))).Name("MailboxSource").Methods("GET")
+	r.Path("/mailbox/{name}/{id}/transcript").Handler(
+		httpd.Handler(privateMailbox(MailboxTranscript))).Name("MailboxTranscript").Methods("GET")
+	r.Path("/mailbox/{name}/{id}/inline").Handler(
+		httpd.Handler(privateMailbox(MailboxInline))).Name("MailboxInline").Methods("GET")
 	r.Path("/mailbox/dattach/{name}/{id}/{num}/{file}").Handler(
-		httpd.Handler(MailboxDownloadAttach)).Name("MailboxDownloadAttach").Methods("GET")
+		httpd.Handler(privateMailbox(MailboxDownloadAttach))).Name(
+		"MailboxDownloadAttach").Methods("GET")
 	r.Path("/mailbox/vattach/{name}/{id}/{num}/{file}").Handler(
-		httpd.Handler(MailboxViewAttach)).Name("MailboxViewAttach").Methods("GET")
+		httpd.Handler(privateMailbox(MailboxViewAttach))).Name(
+		"MailboxViewAttach").Methods("GET")
 }